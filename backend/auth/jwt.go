@@ -15,31 +15,41 @@ type Claims struct {
 	RoleLevel      int    `json:"role_level"`
 	OrganizationID string `json:"organization_id"`
 	OrgType        string `json:"org_type"`
+	SessionID      string `json:"sid,omitempty"` // Login session the token belongs to
+	CustomRoleID   string `json:"crid,omitempty"` // Custom role narrowing the role's permissions
 	jwt.RegisteredClaims
 }
 
+// AccessTokenTTL is how long an access token is valid. Sessions outlive their
+// access tokens and are extended with refresh tokens.
+var AccessTokenTTL = 15 * time.Minute
+
 func GenerateToken(userID, email, secret string) (string, error) {
 	// This is the legacy function for backward compatibility
-	return GenerateTokenWithRole(userID, email, "end_user", 5, "", "client", secret)
+	return GenerateTokenWithRole(userID, email, "end_user", 5, "", "client", "", secret)
 }
 
-func GenerateTokenWithRole(userID, email, roleName string, roleLevel int, organizationID, orgType, secret string) (string, error) {
-	expirationTime := time.Now().Add(7 * 24 * time.Hour) // 7 days
-	
-	claims := &Claims{
+func GenerateTokenWithRole(userID, email, roleName string, roleLevel int, organizationID, orgType, sessionID, secret string) (string, error) {
+	return GenerateAccessToken(Claims{
 		UserID:         userID,
 		Email:          email,
 		RoleName:       roleName,
 		RoleLevel:      roleLevel,
 		OrganizationID: organizationID,
 		OrgType:        orgType,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(expirationTime),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-		},
+		SessionID:      sessionID,
+	}, secret)
+}
+
+// GenerateAccessToken signs an access token carrying the given identity
+func GenerateAccessToken(claims Claims, secret string) (string, error) {
+	now := time.Now()
+	claims.RegisteredClaims = jwt.RegisteredClaims{
+		ExpiresAt: jwt.NewNumericDate(now.Add(AccessTokenTTL)),
+		IssuedAt:  jwt.NewNumericDate(now),
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &claims)
 	return token.SignedString([]byte(secret))
 }
 
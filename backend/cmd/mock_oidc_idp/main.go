@@ -0,0 +1,256 @@
+// Mock OpenID Connect identity provider for trying single sign-on locally.
+//
+// It approves every authorization request as the identity in its environment,
+// so a login can be driven end to end with a browser or curl:
+//
+//	go run ./cmd/mock_oidc_idp
+//	PUT /api/organizations/<id>/sso {"issuer": "http://localhost:9999",
+//	    "client_id": "email-backup", "client_secret": "mock-secret",
+//	    "role_mapping": {"it-admins": "client"}}
+//	GET /auth/sso/login/<id>   (follow the redirects)
+//
+// Environment: MOCK_OIDC_ADDR (:9999), MOCK_OIDC_ISSUER (http://localhost:9999),
+// MOCK_OIDC_CLIENT_ID (email-backup), MOCK_OIDC_CLIENT_SECRET (mock-secret),
+// MOCK_OIDC_EMAIL (sso.user@example.com), MOCK_OIDC_GROUPS (comma separated).
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const keyID = "mock-key-1"
+
+type authorization struct {
+	ClientID      string
+	RedirectURI   string
+	Nonce         string
+	CodeChallenge string
+	ExpiresAt     time.Time
+}
+
+type idp struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	email        string
+	groups       []string
+	key          *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]authorization
+}
+
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func randomString() string {
+	buf := make([]byte, 24)
+	rand.Read(buf)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func tokenError(w http.ResponseWriter, code, description string) {
+	log.Printf("❌ Token request refused: %s (%s)", code, description)
+	writeJSON(w, http.StatusBadRequest, map[string]string{"error": code, "error_description": description})
+}
+
+func (p *idp) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                p.issuer,
+		"authorization_endpoint":                p.issuer + "/authorize",
+		"token_endpoint":                        p.issuer + "/token",
+		"jwks_uri":                              p.issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (p *idp) jwks(w http.ResponseWriter, r *http.Request) {
+	pub := p.key.PublicKey
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": keyID,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+// authorize approves the request straight away and redirects back with a code
+func (p *idp) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	redirectURI := q.Get("redirect_uri")
+	target, err := url.Parse(redirectURI)
+	if err != nil || target.Host == "" {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	if q.Get("client_id") != p.clientID {
+		http.Error(w, "unknown client_id", http.StatusBadRequest)
+		return
+	}
+
+	params := target.Query()
+	params.Set("state", q.Get("state"))
+	switch {
+	case q.Get("response_type") != "code":
+		params.Set("error", "unsupported_response_type")
+	case !strings.Contains(" "+q.Get("scope")+" ", " openid "):
+		params.Set("error", "invalid_scope")
+	case q.Get("code_challenge") == "" || q.Get("code_challenge_method") != "S256":
+		params.Set("error", "invalid_request")
+		params.Set("error_description", "PKCE with S256 is required")
+	default:
+		code := randomString()
+		p.mu.Lock()
+		p.codes[code] = authorization{
+			ClientID:      p.clientID,
+			RedirectURI:   redirectURI,
+			Nonce:         q.Get("nonce"),
+			CodeChallenge: q.Get("code_challenge"),
+			ExpiresAt:     time.Now().Add(time.Minute),
+		}
+		p.mu.Unlock()
+		params.Set("code", code)
+		log.Printf("✅ Approved login of %s for %s", p.email, redirectURI)
+	}
+	target.RawQuery = params.Encode()
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+// token exchanges a code for an ID token after checking the client and PKCE verifier
+func (p *idp) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		tokenError(w, "invalid_request", err.Error())
+		return
+	}
+
+	clientID, clientSecret, ok := r.BasicAuth()
+	if ok {
+		clientID, _ = url.QueryUnescape(clientID)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+	} else {
+		clientID, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if clientID != p.clientID || clientSecret != p.clientSecret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		tokenError(w, "unsupported_grant_type", r.PostForm.Get("grant_type"))
+		return
+	}
+
+	code := r.PostForm.Get("code")
+	p.mu.Lock()
+	auth, found := p.codes[code]
+	delete(p.codes, code)
+	p.mu.Unlock()
+	if !found || time.Now().After(auth.ExpiresAt) {
+		tokenError(w, "invalid_grant", "unknown or expired code")
+		return
+	}
+	if r.PostForm.Get("redirect_uri") != auth.RedirectURI {
+		tokenError(w, "invalid_grant", "redirect_uri does not match")
+		return
+	}
+	verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(verifier[:]) != auth.CodeChallenge {
+		tokenError(w, "invalid_grant", "code_verifier does not match")
+		return
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":            p.issuer,
+		"sub":            "mock|" + p.email,
+		"aud":            auth.ClientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"nonce":          auth.Nonce,
+		"email":          p.email,
+		"email_verified": true,
+		"groups":         p.groups,
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = keyID
+	idToken, err := token.SignedString(p.key)
+	if err != nil {
+		tokenError(w, "server_error", err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+func main() {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		log.Fatalf("❌ Failed to generate signing key: %v", err)
+	}
+
+	groups := []string{}
+	for _, group := range strings.Split(getEnv("MOCK_OIDC_GROUPS", ""), ",") {
+		if group = strings.TrimSpace(group); group != "" {
+			groups = append(groups, group)
+		}
+	}
+	p := &idp{
+		issuer:       getEnv("MOCK_OIDC_ISSUER", "http://localhost:9999"),
+		clientID:     getEnv("MOCK_OIDC_CLIENT_ID", "email-backup"),
+		clientSecret: getEnv("MOCK_OIDC_CLIENT_SECRET", "mock-secret"),
+		email:        getEnv("MOCK_OIDC_EMAIL", "sso.user@example.com"),
+		groups:       groups,
+		key:          key,
+		codes:        map[string]authorization{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/jwks", p.jwks)
+	mux.HandleFunc("/authorize", p.authorize)
+	mux.HandleFunc("/token", p.token)
+
+	addr := getEnv("MOCK_OIDC_ADDR", ":9999")
+	log.Printf("🚀 Mock OIDC provider %s listening on %s (user %s, groups %v)", p.issuer, addr, p.email, groups)
+	log.Fatal(http.ListenAndServe(addr, mux))
+}
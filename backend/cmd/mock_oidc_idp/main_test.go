@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testRedirectURI = "http://localhost:8081/auth/sso/callback"
+
+func newTestServer(t *testing.T) (*idp, *httptest.Server) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	p := &idp{
+		clientID:     "email-backup",
+		clientSecret: "mock-secret",
+		email:        "sso.user@example.com",
+		groups:       []string{"it-admins"},
+		key:          key,
+		codes:        map[string]authorization{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/jwks", p.jwks)
+	mux.HandleFunc("/authorize", p.authorize)
+	mux.HandleFunc("/token", p.token)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	p.issuer = server.URL
+	return p, server
+}
+
+// noRedirects returns redirects to the caller instead of following them
+var noRedirects = &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+// authorize runs an authorization request and returns the callback parameters
+func authorize(t *testing.T, server *httptest.Server, params url.Values) url.Values {
+	t.Helper()
+	resp, err := noRedirects.Get(server.URL + "/authorize?" + params.Encode())
+	if err != nil {
+		t.Fatalf("authorize: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize returned %d, want a redirect", resp.StatusCode)
+	}
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || !strings.HasPrefix(callback.String(), testRedirectURI) {
+		t.Fatalf("unexpected callback %q", resp.Header.Get("Location"))
+	}
+	return callback.Query()
+}
+
+func authorizeParams(verifier string) url.Values {
+	challenge := sha256.Sum256([]byte(verifier))
+	return url.Values{
+		"response_type":         {"code"},
+		"client_id":             {"email-backup"},
+		"redirect_uri":          {testRedirectURI},
+		"scope":                 {"openid email"},
+		"state":                 {"state-1"},
+		"nonce":                 {"nonce-1"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+}
+
+// exchange posts a token request and returns the status and decoded body
+func exchange(t *testing.T, server *httptest.Server, secret string, form url.Values) (int, map[string]interface{}) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("email-backup", secret)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("token: %v", err)
+	}
+	defer resp.Body.Close()
+	body := map[string]interface{}{}
+	json.NewDecoder(resp.Body).Decode(&body)
+	return resp.StatusCode, body
+}
+
+func tokenForm(code, verifier string) url.Values {
+	return url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {testRedirectURI},
+		"code_verifier": {verifier},
+	}
+}
+
+func TestAuthorizeRedirect(t *testing.T) {
+	_, server := newTestServer(t)
+
+	tests := []struct {
+		name      string
+		change    func(url.Values)
+		wantError string
+	}{
+		{"approved", func(url.Values) {}, ""},
+		{"wrong response type", func(q url.Values) { q.Set("response_type", "token") }, "unsupported_response_type"},
+		{"no openid scope", func(q url.Values) { q.Set("scope", "email") }, "invalid_scope"},
+		{"no pkce", func(q url.Values) { q.Del("code_challenge") }, "invalid_request"},
+		{"plain pkce", func(q url.Values) { q.Set("code_challenge_method", "plain") }, "invalid_request"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := authorizeParams("verifier-1")
+			tt.change(params)
+			callback := authorize(t, server, params)
+
+			// The state is always echoed back for the client to check
+			if callback.Get("state") != "state-1" {
+				t.Errorf("state = %q, want state-1", callback.Get("state"))
+			}
+			if callback.Get("error") != tt.wantError {
+				t.Errorf("error = %q, want %q", callback.Get("error"), tt.wantError)
+			}
+			if (callback.Get("code") != "") != (tt.wantError == "") {
+				t.Errorf("code = %q with error %q", callback.Get("code"), callback.Get("error"))
+			}
+		})
+	}
+}
+
+func TestCodeExchange(t *testing.T) {
+	_, server := newTestServer(t)
+
+	tests := []struct {
+		name       string
+		secret     string
+		change     func(url.Values)
+		wantStatus int
+		wantError  string
+	}{
+		{"wrong client secret", "wrong", func(url.Values) {}, http.StatusUnauthorized, "invalid_client"},
+		{"wrong grant type", "mock-secret", func(f url.Values) { f.Set("grant_type", "password") }, http.StatusBadRequest, "unsupported_grant_type"},
+		{"unknown code", "mock-secret", func(f url.Values) { f.Set("code", "unknown") }, http.StatusBadRequest, "invalid_grant"},
+		{"other redirect uri", "mock-secret", func(f url.Values) { f.Set("redirect_uri", "http://evil.example.com/cb") }, http.StatusBadRequest, "invalid_grant"},
+		{"wrong verifier", "mock-secret", func(f url.Values) { f.Set("code_verifier", "verifier-2") }, http.StatusBadRequest, "invalid_grant"},
+		{"valid", "mock-secret", func(url.Values) {}, http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code := authorize(t, server, authorizeParams("verifier-1")).Get("code")
+			form := tokenForm(code, "verifier-1")
+			tt.change(form)
+
+			status, body := exchange(t, server, tt.secret, form)
+			if status != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%v)", status, tt.wantStatus, body)
+			}
+			if tt.wantError != "" {
+				if body["error"] != tt.wantError {
+					t.Errorf("error = %v, want %s", body["error"], tt.wantError)
+				}
+				return
+			}
+			if _, ok := body["id_token"].(string); !ok {
+				t.Fatalf("no id_token in %v", body)
+			}
+		})
+	}
+
+	// A code is redeemed once
+	code := authorize(t, server, authorizeParams("verifier-1")).Get("code")
+	if status, _ := exchange(t, server, "mock-secret", tokenForm(code, "verifier-1")); status != http.StatusOK {
+		t.Fatalf("first exchange returned %d", status)
+	}
+	if status, _ := exchange(t, server, "mock-secret", tokenForm(code, "verifier-1")); status != http.StatusBadRequest {
+		t.Errorf("second exchange returned %d, want %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestIDTokenValidation(t *testing.T) {
+	p, server := newTestServer(t)
+	code := authorize(t, server, authorizeParams("verifier-1")).Get("code")
+	_, body := exchange(t, server, "mock-secret", tokenForm(code, "verifier-1"))
+	rawToken, _ := body["id_token"].(string)
+
+	// Validate against the published keys, as a client would
+	resp, err := http.Get(server.URL + "/jwks")
+	if err != nil {
+		t.Fatalf("jwks: %v", err)
+	}
+	defer resp.Body.Close()
+	var jwks struct {
+		Keys []struct{ Kid, N, E string } `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil || len(jwks.Keys) != 1 {
+		t.Fatalf("unexpected jwks %v: %v", jwks, err)
+	}
+	n, _ := base64.RawURLEncoding.DecodeString(jwks.Keys[0].N)
+	e, _ := base64.RawURLEncoding.DecodeString(jwks.Keys[0].E)
+	pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(rawToken, claims, func(token *jwt.Token) (interface{}, error) {
+		if token.Header["kid"] != jwks.Keys[0].Kid {
+			t.Errorf("kid = %v, want %s", token.Header["kid"], jwks.Keys[0].Kid)
+		}
+		return pub, nil
+	}, jwt.WithValidMethods([]string{"RS256"}), jwt.WithIssuer(p.issuer), jwt.WithAudience("email-backup"), jwt.WithExpirationRequired())
+	if err != nil || !token.Valid {
+		t.Fatalf("ID token did not validate: %v", err)
+	}
+
+	want := map[string]interface{}{"nonce": "nonce-1", "email": "sso.user@example.com", "email_verified": true}
+	for name, value := range want {
+		if claims[name] != value {
+			t.Errorf("claim %s = %v, want %v", name, claims[name], value)
+		}
+	}
+	if groups, _ := claims["groups"].([]interface{}); len(groups) != 1 || groups[0] != "it-admins" {
+		t.Errorf("groups = %v, want [it-admins]", claims["groups"])
+	}
+
+	// Tokens signed with another key are rejected
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	forged, _ := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(other)
+	if _, err := jwt.Parse(forged, func(*jwt.Token) (interface{}, error) { return pub, nil }); err == nil {
+		t.Error("token signed by another key validated")
+	}
+}
@@ -3,6 +3,8 @@ package config
 import (
 	"log"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/joho/godotenv"
 )
@@ -17,6 +19,19 @@ type Config struct {
 	Office365 Office365Config
 	Yahoo     YahooConfig
 	Outlook   OutlookConfig
+	Throttle  ThrottleConfig
+	Sync      SyncConfig
+	Retention RetentionConfig
+	Integrity IntegrityConfig
+	Privacy   PrivacyConfig
+	Quota     QuotaConfig
+	Billing   BillingConfig
+	MFA       MFAConfig
+	SSO       SSOConfig
+	Directory DirectoryConfig
+	Connector ConnectorConfig
+	Password  PasswordConfig
+	Mail      MailConfig
 }
 
 type DatabaseConfig struct {
@@ -34,11 +49,13 @@ type MinIOConfig struct {
 	UseSSL          bool
 	BucketEmails    string
 	BucketAttachments string
+	ObjectLocking   bool // Create the emails bucket with object locking, needed for compliance archives
 }
 
 type JWTConfig struct {
-	Secret string
-	Expiry string
+	Secret        string
+	Expiry        string // lifetime of access tokens
+	RefreshExpiry string // lifetime of a session; each refresh token lasts this long
 }
 
 type ServerConfig struct {
@@ -79,6 +96,107 @@ type OutlookConfig struct {
 	RedirectURL  string
 }
 
+// ThrottleConfig holds provider request budgets and backoff limits
+type ThrottleConfig struct {
+	ServerRequestsPerSecond float64
+	ServerBurst             int
+	TenantRequestsPerSecond float64
+	TenantBurst             int
+	MaxRetries              int
+	MaxBackoffSeconds       int
+}
+
+// SyncConfig controls how much work a single account sync does in parallel
+type SyncConfig struct {
+	Parallelism        int    // parse and upload workers
+	FetchParallelism   int    // concurrent provider fetch requests
+	ExchangeBatchSize  int    // ItemIds per EWS GetItem call
+	IMAPFetchChunkSize int    // UIDs per IMAP UID FETCH command
+	MaxMessageBytes    int64  // largest message ingested in full
+	OversizePolicy     string // skip, truncate or store
+	StreamChunkBytes   int64  // IMAP messages larger than this are fetched in partial chunks of this size
+}
+
+// RetentionConfig controls the scheduled retention purge
+type RetentionConfig struct {
+	PurgeEnabled       bool // when false the scheduled run only produces a dry-run report
+	PurgeIntervalHours int
+}
+
+// IntegrityConfig controls the scheduled archive integrity verification
+type IntegrityConfig struct {
+	VerifyIntervalHours int // how often digests are sealed and stored objects re-read
+}
+
+// PrivacyConfig controls data subject request processing
+type PrivacyConfig struct {
+	CertificateKey string // HMAC key for completion certificates
+}
+
+// QuotaConfig controls organization quota warnings
+type QuotaConfig struct {
+	WarnThresholds []int // usage percentages that produce soft-limit warnings
+}
+
+// BillingConfig controls usage metering
+type BillingConfig struct {
+	SnapshotIntervalHours int    // how often the current day's usage snapshot is refreshed
+	Currency              string // default currency of new price plans
+}
+
+// MFAConfig controls TOTP multi-factor authentication
+type MFAConfig struct {
+	Issuer               string // name shown by authenticator apps
+	ChallengeMinutes     int    // how long a login challenge can be answered
+	MaxChallengeAttempts int    // wrong codes allowed per login challenge
+}
+
+// SSOConfig controls OpenID Connect single sign-on
+type SSOConfig struct {
+	CallbackURL  string // redirect URI registered with identity providers
+	FrontendURL  string // where the browser is sent after a login; empty returns tokens as JSON
+	StateMinutes int    // how long a login started at the identity provider can be completed
+}
+
+// DirectoryConfig controls LDAP / Active Directory login and user sync
+type DirectoryConfig struct {
+	SyncIntervalMinutes int // how often organizations' directories are synced
+	TimeoutSeconds      int // connection and request timeout for directory servers
+	PageSize            int // entries per page of a directory search
+}
+
+// ConnectorConfig controls tenant connectors, which back up every mailbox of
+// an Exchange organization or Microsoft 365 tenant with one service account
+type ConnectorConfig struct {
+	RunIntervalMinutes int    // how often connectors discover mailboxes and sync them
+	MailboxParallelism int    // mailboxes of one connector synced at the same time
+	GraphURL           string // Microsoft Graph API root
+	GraphLoginURL      string // Microsoft identity platform authority for client credentials
+}
+
+// PasswordConfig controls password policies, login lockout and password resets
+type PasswordConfig struct {
+	MinLength         int    // system minimum; organization policies can only raise it
+	BreachListPath    string // file of breached passwords, one per line, in plain text or as SHA-1 hashes
+	LockoutThreshold  int    // failed logins of an account before it is locked
+	LockoutMinutes    int    // first lockout, doubled with every further failure
+	MaxLockoutMinutes int    // longest lockout
+	IPMaxFailures     int    // failed logins allowed from one IP address within the window
+	IPWindowMinutes   int    // window of the per-IP limit
+	ResetTokenMinutes int    // how long a password reset link can be used
+	ResetURL          string // frontend page the reset token is appended to
+}
+
+// MailConfig selects how the backend sends email
+type MailConfig struct {
+	Sender       string // "log" writes messages to the log, "smtp" sends them
+	From         string
+	SMTPHost     string
+	SMTPPort     int // 465 uses implicit TLS, other ports STARTTLS when offered
+	SMTPUsername string
+	SMTPPassword string
+}
+
 func Load() *Config {
 	// Load .env file if it exists
 	if err := godotenv.Load(); err != nil {
@@ -100,10 +218,12 @@ func Load() *Config {
 			UseSSL:            getEnv("MINIO_USE_SSL", "false") == "true",
 			BucketEmails:      getEnv("MINIO_BUCKET_EMAILS", "email-backups"),
 			BucketAttachments: getEnv("MINIO_BUCKET_ATTACHMENTS", "email-attachments"),
+			ObjectLocking:     getEnv("MINIO_OBJECT_LOCKING", "false") == "true",
 		},
 		JWT: JWTConfig{
-			Secret: getEnv("JWT_SECRET", "EmailBackupMVP2025SecretKey!"),
-			Expiry: getEnv("JWT_EXPIRY", "24h"),
+			Secret:        getEnv("JWT_SECRET", "EmailBackupMVP2025SecretKey!"),
+			Expiry:        getEnv("JWT_EXPIRY", "15m"),
+			RefreshExpiry: getEnv("JWT_REFRESH_EXPIRY", "720h"),
 		},
 		Server: ServerConfig{
 			Port:    getEnv("PORT", "8080"),
@@ -137,6 +257,80 @@ func Load() *Config {
 			ClientSecret: getEnv("OUTLOOK_CLIENT_SECRET", ""),
 			RedirectURL:  getEnv("OUTLOOK_REDIRECT_URL", "http://localhost:8080/api/oauth/outlook/callback"),
 		},
+		Throttle: ThrottleConfig{
+			ServerRequestsPerSecond: getEnvFloat("THROTTLE_SERVER_RPS", 10),
+			ServerBurst:             getEnvInt("THROTTLE_SERVER_BURST", 20),
+			TenantRequestsPerSecond: getEnvFloat("THROTTLE_TENANT_RPS", 5),
+			TenantBurst:             getEnvInt("THROTTLE_TENANT_BURST", 10),
+			MaxRetries:              getEnvInt("THROTTLE_MAX_RETRIES", 5),
+			MaxBackoffSeconds:       getEnvInt("THROTTLE_MAX_BACKOFF_SECONDS", 300),
+		},
+		Sync: SyncConfig{
+			Parallelism:        getEnvInt("SYNC_PARALLELISM", 4),
+			FetchParallelism:   getEnvInt("SYNC_FETCH_PARALLELISM", 2),
+			ExchangeBatchSize:  getEnvInt("EWS_GETITEM_BATCH_SIZE", 25),
+			IMAPFetchChunkSize: getEnvInt("IMAP_FETCH_CHUNK_SIZE", 50),
+			MaxMessageBytes:    int64(getEnvInt("MAX_MESSAGE_SIZE_MB", 150)) << 20,
+			OversizePolicy:     getEnv("OVERSIZE_MESSAGE_POLICY", "store"),
+			StreamChunkBytes:   int64(getEnvInt("IMAP_STREAM_CHUNK_MB", 8)) << 20,
+		},
+		Retention: RetentionConfig{
+			PurgeEnabled:       getEnv("RETENTION_PURGE_ENABLED", "true") == "true",
+			PurgeIntervalHours: getEnvInt("RETENTION_PURGE_INTERVAL_HOURS", 24),
+		},
+		Integrity: IntegrityConfig{
+			VerifyIntervalHours: getEnvInt("INTEGRITY_VERIFY_INTERVAL_HOURS", 24),
+		},
+		Privacy: PrivacyConfig{
+			CertificateKey: getEnv("DSAR_CERTIFICATE_KEY", getEnv("JWT_SECRET", "EmailBackupMVP2025SecretKey!")),
+		},
+		Quota: QuotaConfig{
+			WarnThresholds: getEnvIntList("QUOTA_WARN_THRESHOLDS", []int{80, 95}),
+		},
+		Billing: BillingConfig{
+			SnapshotIntervalHours: getEnvInt("USAGE_SNAPSHOT_INTERVAL_HOURS", 6),
+			Currency:              getEnv("BILLING_CURRENCY", "USD"),
+		},
+		MFA: MFAConfig{
+			Issuer:               getEnv("MFA_ISSUER", "Email Backup"),
+			ChallengeMinutes:     getEnvInt("MFA_CHALLENGE_MINUTES", 5),
+			MaxChallengeAttempts: getEnvInt("MFA_MAX_CHALLENGE_ATTEMPTS", 5),
+		},
+		SSO: SSOConfig{
+			CallbackURL:  getEnv("SSO_CALLBACK_URL", "http://localhost:8081/auth/sso/callback"),
+			FrontendURL:  getEnv("SSO_FRONTEND_URL", ""),
+			StateMinutes: getEnvInt("SSO_STATE_MINUTES", 10),
+		},
+		Directory: DirectoryConfig{
+			SyncIntervalMinutes: getEnvInt("DIRECTORY_SYNC_INTERVAL_MINUTES", 60),
+			TimeoutSeconds:      getEnvInt("LDAP_TIMEOUT_SECONDS", 10),
+			PageSize:            getEnvInt("LDAP_PAGE_SIZE", 500),
+		},
+		Connector: ConnectorConfig{
+			RunIntervalMinutes: getEnvInt("CONNECTOR_RUN_INTERVAL_MINUTES", 360),
+			MailboxParallelism: getEnvInt("CONNECTOR_MAILBOX_PARALLELISM", 2),
+			GraphURL:           getEnv("GRAPH_API_URL", "https://graph.microsoft.com/v1.0"),
+			GraphLoginURL:      getEnv("GRAPH_LOGIN_URL", "https://login.microsoftonline.com"),
+		},
+		Password: PasswordConfig{
+			MinLength:         getEnvInt("PASSWORD_MIN_LENGTH", 8),
+			BreachListPath:    getEnv("PASSWORD_BREACH_LIST", ""),
+			LockoutThreshold:  getEnvInt("LOGIN_LOCKOUT_THRESHOLD", 5),
+			LockoutMinutes:    getEnvInt("LOGIN_LOCKOUT_MINUTES", 1),
+			MaxLockoutMinutes: getEnvInt("LOGIN_MAX_LOCKOUT_MINUTES", 60),
+			IPMaxFailures:     getEnvInt("LOGIN_IP_MAX_FAILURES", 20),
+			IPWindowMinutes:   getEnvInt("LOGIN_IP_WINDOW_MINUTES", 15),
+			ResetTokenMinutes: getEnvInt("PASSWORD_RESET_TOKEN_MINUTES", 30),
+			ResetURL:          getEnv("PASSWORD_RESET_URL", "http://localhost:3000/reset-password"),
+		},
+		Mail: MailConfig{
+			Sender:       getEnv("MAIL_SENDER", "log"),
+			From:         getEnv("MAIL_FROM", "Email Backup <no-reply@localhost>"),
+			SMTPHost:     getEnv("SMTP_HOST", ""),
+			SMTPPort:     getEnvInt("SMTP_PORT", 587),
+			SMTPUsername: getEnv("SMTP_USERNAME", ""),
+			SMTPPassword: getEnv("SMTP_PASSWORD", ""),
+		},
 	}
 }
 
@@ -145,4 +339,41 @@ func getEnv(key, defaultValue string) string {
 		return value
 	}
 	return defaultValue
-}
\ No newline at end of file
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil {
+			return parsed
+		}
+		log.Printf("Invalid integer for %s, using default %d", key, defaultValue)
+	}
+	return defaultValue
+}
+
+func getEnvIntList(key string, defaultValue []int) []int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	var list []int
+	for _, part := range strings.Split(value, ",") {
+		parsed, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			log.Printf("Invalid integer list for %s, using default %v", key, defaultValue)
+			return defaultValue
+		}
+		list = append(list, parsed)
+	}
+	return list
+}
+
+func getEnvFloat(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+			return parsed
+		}
+		log.Printf("Invalid number for %s, using default %g", key, defaultValue)
+	}
+	return defaultValue
+}
@@ -50,12 +50,58 @@ func Migrate() error {
 		&OrganizationSettings{},
 		&AccountStorageStats{},
 		&FolderStorageStats{},
+		&SyncFailure{},
+		&EmailEvent{},
+		&FolderSyncState{},
+		&RetentionPolicy{},
+		&RetentionRun{},
+		&RetentionRunItem{},
+		&LegalHold{},
+		&LegalHoldEvent{},
+		&ComplianceVerification{},
+		&ComplianceVerificationItem{},
+		&AuditEvent{},
+		&IntegrityDigest{},
+		&IntegrityDigestEntry{},
+		&IntegrityRun{},
+		&IntegrityDiscrepancy{},
+		&PermissionGrant{},
+		&DiscoveryCase{},
+		&DiscoverySearch{},
+		&DiscoveryItem{},
+		&DiscoveryExport{},
+		&DataSubjectRequest{},
+		&DataSubjectMatch{},
+		&UsageSnapshot{},
+		&PricePlan{},
+		&AuthSession{},
+		&RefreshToken{},
+		&UserMFA{},
+		&MFARecoveryCode{},
+		&MFAChallenge{},
+		&APIKey{},
+		&APIKeyUsage{},
+		&OrganizationSSO{},
+		&SSOLoginState{},
+		&OrganizationDirectory{},
+		&DirectoryUser{},
+		&DirectorySyncRun{},
+		&TenantConnector{},
+		&TenantConnectorRun{},
+		&PasswordHistory{},
+		&PasswordResetToken{},
+		&CustomRole{},
+		&MailboxGrant{},
 	)
 	if err != nil {
 		return fmt.Errorf("failed to migrate database: %v", err)
 	}
 	
 	log.Println("✅ Database migration successful!")
+
+	if err := protectAuditLog(); err != nil {
+		return fmt.Errorf("failed to protect audit log: %v", err)
+	}
 	
 	// Initialize default data
 	if err := initializeDefaultData(); err != nil {
@@ -79,6 +125,30 @@ func preMigrationCleanup() error {
 	return nil
 }
 
+// protectAuditLog makes audit_events append-only: a trigger rejects every
+// UPDATE and DELETE, whoever issues it
+func protectAuditLog() error {
+	statements := []string{
+		`CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+		BEGIN
+			RAISE EXCEPTION 'audit_events is append-only';
+		END;
+		$$ LANGUAGE plpgsql`,
+		`DROP TRIGGER IF EXISTS audit_events_append_only ON audit_events`,
+		`CREATE TRIGGER audit_events_append_only BEFORE UPDATE OR DELETE ON audit_events
+		FOR EACH ROW EXECUTE FUNCTION audit_events_append_only()`,
+		`DROP TRIGGER IF EXISTS audit_events_no_truncate ON audit_events`,
+		`CREATE TRIGGER audit_events_no_truncate BEFORE TRUNCATE ON audit_events
+		FOR EACH STATEMENT EXECUTE FUNCTION audit_events_append_only()`,
+	}
+	for _, statement := range statements {
+		if err := DB.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func initializeDefaultData() error {
 	// Create default roles if they don't exist
 	roles := []Role{
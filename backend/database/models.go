@@ -16,12 +16,21 @@ type User struct {
 	// Organization and role relationships
 	RoleID       *uuid.UUID `gorm:"type:uuid" json:"role_id"`
 	PrimaryOrgID *uuid.UUID `gorm:"type:uuid" json:"primary_org_id"`
+	CustomRoleID *uuid.UUID `gorm:"type:uuid;index" json:"custom_role_id,omitempty"` // Narrows the permissions of the role
+	
+	DisabledAt   *time.Time `json:"disabled_at,omitempty"` // Disabled users cannot sign in, e.g. after leaving a synced directory group
+	
+	// Login lockout after repeated wrong passwords
+	FailedLoginCount  int        `gorm:"default:0" json:"-"`
+	LockedUntil       *time.Time `json:"locked_until,omitempty"`
+	PasswordChangedAt *time.Time `json:"password_changed_at,omitempty"`
 	
 	CreatedAt    time.Time  `json:"created_at"`
 	UpdatedAt    time.Time  `json:"updated_at"`
 
 	// Relationships
 	Role         *Role                `gorm:"foreignKey:RoleID" json:"role,omitempty"`
+	CustomRole   *CustomRole          `gorm:"foreignKey:CustomRoleID" json:"custom_role,omitempty"`
 	PrimaryOrg   *Organization        `gorm:"foreignKey:PrimaryOrgID" json:"primary_org,omitempty"`
 	UserOrgs     []UserOrganization   `gorm:"foreignKey:UserID" json:"user_orgs,omitempty"`
 }
@@ -71,9 +80,26 @@ type EmailIndex struct {
 	Subject     string    `json:"subject"`
 	SenderEmail string    `json:"sender_email"`
 	SenderName  string    `json:"sender_name"`
+	Recipients  *string   `gorm:"type:text" json:"recipients,omitempty"` // To and Cc addresses, lowercased; nil for emails indexed before recipients were recorded
 	Date        time.Time `json:"date"`
 	Folder      string    `gorm:"default:'INBOX'" json:"folder"`
 	MinioPath   string    `json:"minio_path"`
+	RawMinioPath string   `json:"raw_minio_path,omitempty"` // Original RFC822 message, when the provider supplies one
+	IsTruncated  bool     `gorm:"default:false" json:"is_truncated"`  // Stored partially under the oversize policy
+
+	// Upstream state, kept in sync with the provider
+	ProviderItemID    string     `gorm:"size:1024;index" json:"provider_item_id,omitempty"` // EWS ItemId or IMAP UID within Folder
+	IsRead            bool       `gorm:"default:false" json:"is_read"`
+	IsFlagged         bool       `gorm:"default:false" json:"is_flagged"`
+	DeletedUpstreamAt *time.Time `gorm:"index" json:"deleted_upstream_at,omitempty"` // Removed on the server, archive copy kept
+
+	// SHA-256 of the stored objects, recorded when they are written
+	ContentSHA256 string `gorm:"size:64" json:"content_sha256,omitempty"` // Object at MinioPath
+	RawSHA256     string `gorm:"size:64" json:"raw_sha256,omitempty"`     // Object at RawMinioPath
+
+	// Object lock applied under a compliance archive
+	LockMode    string     `gorm:"size:20" json:"lock_mode,omitempty"`
+	RetainUntil *time.Time `gorm:"index" json:"retain_until,omitempty"`
 	
 	// Storage size fields
 	EmailSize       int64 `gorm:"default:0;not null" json:"email_size"`       // Total size (content + attachments)
@@ -296,6 +322,16 @@ type OrganizationSettings struct {
 	MaxEmailAccounts    *int      `json:"max_email_accounts"`
 	Features            string    `gorm:"type:jsonb;default:'{\"email_backup\":true,\"storage_analytics\":true,\"user_management\":true,\"api_access\":false}'" json:"features"`
 	EmailRetentionDays  *int      `json:"email_retention_days"`
+
+	// Compliance archive: message objects are written once and locked in storage
+	ComplianceArchive       bool   `gorm:"default:false" json:"compliance_archive"`
+	ComplianceLockMode      string `gorm:"size:20;default:'governance'" json:"compliance_lock_mode"` // governance or compliance
+	ComplianceRetentionDays int    `gorm:"default:0" json:"compliance_retention_days"`
+
+	// Role levels whose users must use multi-factor authentication, as a JSON array
+	MFARequiredLevels string `gorm:"type:jsonb;default:'[]'" json:"mfa_required_levels"`
+	// Password policy as a JSON object; the strictest policy along the organization chain applies
+	PasswordPolicy string `gorm:"type:jsonb;default:'{}'" json:"password_policy"`
 	CreatedAt           time.Time `json:"created_at"`
 	UpdatedAt           time.Time `json:"updated_at"`
 
@@ -420,6 +456,16 @@ func (o *Organization) GetHierarchyPath(db *gorm.DB) ([]Organization, error) {
 
 // Check if user can manage this organization
 func (o *Organization) CanUserManage(db *gorm.DB, userID uuid.UUID) bool {
+	// Client admins (level 4) manage their own client organization
+	if o.Type == "client" {
+		return o.canUserManage(db, userID, 4)
+	}
+	return o.canUserManage(db, userID, 3)
+}
+
+// canUserManage checks the user's role in this organization against maxLevel.
+// Managing an organization through one of its parents takes a reseller role.
+func (o *Organization) canUserManage(db *gorm.DB, userID uuid.UUID, maxLevel int) bool {
 	var userOrg UserOrganization
 	var role Role
 	
@@ -433,7 +479,7 @@ func (o *Organization) CanUserManage(db *gorm.DB, userID uuid.UUID) bool {
 		if o.ParentOrgID != nil {
 			var parent Organization
 			if db.First(&parent, *o.ParentOrgID).Error == nil {
-				return parent.CanUserManage(db, userID)
+				return parent.canUserManage(db, userID, 3)
 			}
 		}
 		return false
@@ -444,5 +490,1113 @@ func (o *Organization) CanUserManage(db *gorm.DB, userID uuid.UUID) bool {
 	}
 	
 	// Admin can manage everything, others can manage their level and below
-	return role.Level <= 3 // admin, distributor, dealer can manage
-}
\ No newline at end of file
+	return role.Level <= maxLevel
+}
+
+// ===== SYNC RELIABILITY MODELS =====
+
+// SyncFailure records a single message that could not be fetched or stored during a sync,
+// so it can be retried individually instead of waiting for the next full sync
+type SyncFailure struct {
+	ID             uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	AccountID      uuid.UUID  `gorm:"type:uuid;not null;uniqueIndex:idx_sync_failures_item" json:"account_id"`
+	Folder         string     `gorm:"size:255;not null;uniqueIndex:idx_sync_failures_item" json:"folder"`
+	ProviderItemID string     `gorm:"size:1024;not null;uniqueIndex:idx_sync_failures_item" json:"provider_item_id"` // EWS ItemId or IMAP UID
+	ChangeKey      string     `gorm:"size:1024" json:"change_key,omitempty"`                                           // EWS only
+	MessageID      string     `json:"message_id,omitempty"`
+	Subject        string     `json:"subject"`
+	Stage          string     `gorm:"size:20;not null" json:"stage"`       // fetch, parse, store, index
+	ErrorClass     string     `gorm:"size:30;not null" json:"error_class"` // network, auth, throttled, storage, database, parse, not_found, unknown
+	ErrorMessage   string     `gorm:"type:text" json:"error_message"`
+	AttemptCount   int        `gorm:"default:1;not null" json:"attempt_count"`
+	Status         string     `gorm:"size:20;not null;default:'pending';index" json:"status"` // pending, resolved, abandoned
+	FirstFailedAt  time.Time  `gorm:"not null" json:"first_failed_at"`
+	LastAttemptAt  time.Time  `gorm:"not null" json:"last_attempt_at"`
+	NextRetryAt    *time.Time `gorm:"index" json:"next_retry_at,omitempty"`
+	ResolvedAt     *time.Time `json:"resolved_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+
+	// Relationship
+	Account EmailAccount `gorm:"foreignKey:AccountID" json:"-"`
+}
+
+// BeforeCreate hook to set UUID for SyncFailure
+func (sf *SyncFailure) BeforeCreate(tx *gorm.DB) error {
+	if sf.ID == uuid.Nil {
+		sf.ID = uuid.New()
+	}
+	return nil
+}
+
+// ===== MESSAGE HISTORY MODELS =====
+
+// EmailEvent is one change observed on the provider for an archived message
+type EmailEvent struct {
+	ID         uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	EmailID    uuid.UUID `gorm:"type:uuid;not null;index" json:"email_id"`
+	AccountID  uuid.UUID `gorm:"type:uuid;not null;index" json:"account_id"`
+	EventType  string    `gorm:"size:20;not null" json:"event_type"` // moved, read, unread, flagged, unflagged, deleted, restored
+	FromFolder string    `gorm:"size:255" json:"from_folder,omitempty"`
+	ToFolder   string    `gorm:"size:255" json:"to_folder,omitempty"`
+	Detail     string    `gorm:"type:text" json:"detail,omitempty"`
+	DetectedAt time.Time `gorm:"not null;index" json:"detected_at"`
+	CreatedAt  time.Time `json:"created_at"`
+
+	// Relationship
+	Email EmailIndex `gorm:"foreignKey:EmailID" json:"-"`
+}
+
+// FolderSyncState stores the provider checkpoint used to detect changes in a folder
+type FolderSyncState struct {
+	ID               uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	AccountID        uuid.UUID  `gorm:"type:uuid;not null;uniqueIndex:idx_folder_sync_state" json:"account_id"`
+	Folder           string     `gorm:"size:255;not null;uniqueIndex:idx_folder_sync_state" json:"folder"`
+	UIDValidity      uint32     `json:"uid_validity,omitempty"` // IMAP
+	SyncState        string     `gorm:"type:text" json:"-"`     // EWS SyncFolderItems / Graph delta token
+	LastReconciledAt *time.Time `json:"last_reconciled_at,omitempty"`
+	CreatedAt        time.Time  `json:"created_at"`
+	UpdatedAt        time.Time  `json:"updated_at"`
+}
+
+// BeforeCreate hook to set UUID for EmailEvent
+func (ee *EmailEvent) BeforeCreate(tx *gorm.DB) error {
+	if ee.ID == uuid.Nil {
+		ee.ID = uuid.New()
+	}
+	return nil
+}
+
+// BeforeCreate hook to set UUID for FolderSyncState
+func (fst *FolderSyncState) BeforeCreate(tx *gorm.DB) error {
+	if fst.ID == uuid.Nil {
+		fst.ID = uuid.New()
+	}
+	return nil
+}
+
+// ===== RETENTION MODELS =====
+
+// RetentionPolicy defines how long archived emails are kept. Policies attach to an
+// organization, an email account or a single folder of an account; the most specific
+// policy wins unless a broader one forbids overrides.
+type RetentionPolicy struct {
+	ID             uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	Scope          string     `gorm:"size:20;not null;check:scope IN ('organization','account','folder')" json:"scope"`
+	OrganizationID *uuid.UUID `gorm:"type:uuid;index" json:"organization_id,omitempty"`
+	AccountID      *uuid.UUID `gorm:"type:uuid;index" json:"account_id,omitempty"`
+	Folder         string     `gorm:"size:255" json:"folder,omitempty"`
+	Action         string     `gorm:"size:30;not null;check:action IN ('keep_days','keep_forever','delete_unless_flagged')" json:"action"`
+	RetentionDays  int        `gorm:"default:0" json:"retention_days"`
+	AllowOverride  bool       `gorm:"default:true" json:"allow_override"` // Whether narrower scopes may replace this policy
+	CreatedBy      *uuid.UUID `gorm:"type:uuid" json:"created_by"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+
+	// Relationships
+	Organization *Organization `gorm:"foreignKey:OrganizationID" json:"organization,omitempty"`
+	Account      *EmailAccount `gorm:"foreignKey:AccountID" json:"-"`
+}
+
+// RetentionRun records one execution of the retention purge, real or dry-run
+type RetentionRun struct {
+	ID             uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	OrganizationID *uuid.UUID `gorm:"type:uuid;index" json:"organization_id,omitempty"` // Limited to one organization subtree, nil for all
+	DryRun         bool       `gorm:"default:false" json:"dry_run"`
+	TriggeredBy    *uuid.UUID `gorm:"type:uuid" json:"triggered_by,omitempty"` // nil for the scheduled job
+	Status         string     `gorm:"size:20;not null;check:status IN ('running','completed','failed')" json:"status"`
+	EmailsScanned  int        `gorm:"default:0" json:"emails_scanned"`
+	EmailsPurged   int        `gorm:"default:0" json:"emails_purged"` // Would be purged for a dry-run
+	EmailsHeld     int        `gorm:"default:0" json:"emails_held"`   // Expired but kept under a legal hold
+	EmailsLocked   int        `gorm:"default:0" json:"emails_locked"` // Expired but still locked by a compliance archive
+	BytesPurged    int64      `gorm:"default:0" json:"bytes_purged"`
+	ErrorMessage   string     `gorm:"type:text" json:"error_message,omitempty"`
+	StartedAt      time.Time  `gorm:"not null" json:"started_at"`
+	CompletedAt    *time.Time `json:"completed_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+// RetentionRunItem is the audit record of one email purged (or selected in a dry-run).
+// It keeps the identifying details since the email itself is gone afterwards.
+type RetentionRunItem struct {
+	ID        uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	RunID     uuid.UUID  `gorm:"type:uuid;not null;index" json:"run_id"`
+	EmailID   uuid.UUID  `gorm:"type:uuid;not null" json:"email_id"`
+	AccountID uuid.UUID  `gorm:"type:uuid;not null;index" json:"account_id"`
+	PolicyID  *uuid.UUID `gorm:"type:uuid" json:"policy_id,omitempty"` // nil when the organization setting applied
+	MessageID string     `json:"message_id"`
+	Subject   string     `json:"subject"`
+	Folder    string     `json:"folder"`
+	EmailDate time.Time  `json:"email_date"`
+	EmailSize int64      `json:"email_size"`
+	MinioPath string     `json:"minio_path"`
+	Reason    string     `gorm:"type:text" json:"reason"`
+	Error     string     `gorm:"type:text" json:"error,omitempty"` // Set when the purge of this email failed
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// BeforeCreate hook to set UUID for RetentionPolicy
+func (rp *RetentionPolicy) BeforeCreate(tx *gorm.DB) error {
+	if rp.ID == uuid.Nil {
+		rp.ID = uuid.New()
+	}
+	return nil
+}
+
+// BeforeCreate hook to set UUID for RetentionRun
+func (rr *RetentionRun) BeforeCreate(tx *gorm.DB) error {
+	if rr.ID == uuid.Nil {
+		rr.ID = uuid.New()
+	}
+	return nil
+}
+
+// BeforeCreate hook to set UUID for RetentionRunItem
+func (rri *RetentionRunItem) BeforeCreate(tx *gorm.DB) error {
+	if rri.ID == uuid.Nil {
+		rri.ID = uuid.New()
+	}
+	return nil
+}
+
+// ===== LEGAL HOLD MODELS =====
+
+// LegalHold preserves archived emails for litigation. A hold targets an organization
+// (including its descendants), a user, a single email account or the results of a
+// saved search; held emails are exempt from retention purges and deletion until released.
+type LegalHold struct {
+	ID                uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	CaseName          string     `gorm:"size:255;not null" json:"case_name"`
+	Description       string     `gorm:"type:text" json:"description,omitempty"`
+	TargetType        string     `gorm:"size:20;not null;check:target_type IN ('organization','user','account','search')" json:"target_type"`
+	OrganizationID    *uuid.UUID `gorm:"type:uuid;index" json:"organization_id,omitempty"`
+	UserID            *uuid.UUID `gorm:"type:uuid;index" json:"user_id,omitempty"`
+	AccountID         *uuid.UUID `gorm:"type:uuid;index" json:"account_id,omitempty"`
+	SearchQuery       string     `gorm:"type:jsonb;default:'{}'" json:"search_query"` // Saved search criteria for search holds
+	Custodians        string     `gorm:"type:jsonb;default:'[]'" json:"custodians"`   // JSON array of custodian names or addresses
+	Status            string     `gorm:"size:20;not null;default:'active';check:status IN ('active','released')" json:"status"`
+	ObjectLockApplied bool       `gorm:"default:false" json:"object_lock_applied"` // MinIO legal hold set on the held objects
+	CreatedBy         uuid.UUID  `gorm:"type:uuid;not null" json:"created_by"`
+	ReleasedBy        *uuid.UUID `gorm:"type:uuid" json:"released_by,omitempty"`
+	ReleasedAt        *time.Time `json:"released_at,omitempty"`
+	ReleaseReason     string     `gorm:"type:text" json:"release_reason,omitempty"`
+	CreatedAt         time.Time  `json:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at"`
+
+	// Relationships
+	Organization *Organization `gorm:"foreignKey:OrganizationID" json:"organization,omitempty"`
+}
+
+// LegalHoldEvent is the audit trail of a legal hold: creation, changes and release
+type LegalHoldEvent struct {
+	ID        uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	HoldID    uuid.UUID  `gorm:"type:uuid;not null;index" json:"hold_id"`
+	Action    string     `gorm:"size:30;not null" json:"action"`      // created, updated, custodians_updated, object_lock_applied, released
+	ActorID   *uuid.UUID `gorm:"type:uuid" json:"actor_id,omitempty"` // nil for background work
+	Detail    string     `gorm:"type:text" json:"detail,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// BeforeCreate hook to set UUID for LegalHold
+func (lh *LegalHold) BeforeCreate(tx *gorm.DB) error {
+	if lh.ID == uuid.Nil {
+		lh.ID = uuid.New()
+	}
+	return nil
+}
+
+// BeforeCreate hook to set UUID for LegalHoldEvent
+func (lhe *LegalHoldEvent) BeforeCreate(tx *gorm.DB) error {
+	if lhe.ID == uuid.Nil {
+		lhe.ID = uuid.New()
+	}
+	return nil
+}
+
+// ===== COMPLIANCE ARCHIVE MODELS =====
+
+// ComplianceVerification is a report on the storage lock state of an
+// organization's archived objects
+type ComplianceVerification struct {
+	ID                uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	OrganizationID    uuid.UUID  `gorm:"type:uuid;not null;index" json:"organization_id"`
+	TriggeredBy       *uuid.UUID `gorm:"type:uuid" json:"triggered_by,omitempty"`
+	Status            string     `gorm:"size:20;not null;check:status IN ('running','completed','failed')" json:"status"`
+	BucketLockEnabled bool       `gorm:"default:false" json:"bucket_lock_enabled"`
+	ObjectsChecked    int        `gorm:"default:0" json:"objects_checked"`
+	ObjectsLocked     int        `gorm:"default:0" json:"objects_locked"`     // Lock in storage matches the index
+	ObjectsUnlocked   int        `gorm:"default:0" json:"objects_unlocked"`   // No retention in storage although the index expects one
+	ObjectsMismatched int        `gorm:"default:0" json:"objects_mismatched"` // Weaker mode or earlier expiry than the index
+	ObjectsMissing    int        `gorm:"default:0" json:"objects_missing"`
+	ErrorMessage      string     `gorm:"type:text" json:"error_message,omitempty"`
+	StartedAt         time.Time  `gorm:"not null" json:"started_at"`
+	CompletedAt       *time.Time `json:"completed_at,omitempty"`
+	CreatedAt         time.Time  `json:"created_at"`
+}
+
+// ComplianceVerificationItem records one object whose lock state is not as expected
+type ComplianceVerificationItem struct {
+	ID                  uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	VerificationID      uuid.UUID  `gorm:"type:uuid;not null;index" json:"verification_id"`
+	EmailID             uuid.UUID  `gorm:"type:uuid;not null" json:"email_id"`
+	AccountID           uuid.UUID  `gorm:"type:uuid;not null" json:"account_id"`
+	ObjectPath          string     `json:"object_path"`
+	Problem             string     `gorm:"size:20;not null" json:"problem"` // unlocked, mismatched, missing, error
+	ExpectedMode        string     `gorm:"size:20" json:"expected_mode,omitempty"`
+	ExpectedRetainUntil *time.Time `json:"expected_retain_until,omitempty"`
+	ActualMode          string     `gorm:"size:20" json:"actual_mode,omitempty"`
+	ActualRetainUntil   *time.Time `json:"actual_retain_until,omitempty"`
+	Detail              string     `gorm:"type:text" json:"detail,omitempty"`
+	CreatedAt           time.Time  `json:"created_at"`
+}
+
+// BeforeCreate hook to set UUID for ComplianceVerification
+func (cv *ComplianceVerification) BeforeCreate(tx *gorm.DB) error {
+	if cv.ID == uuid.Nil {
+		cv.ID = uuid.New()
+	}
+	return nil
+}
+
+// BeforeCreate hook to set UUID for ComplianceVerificationItem
+func (cvi *ComplianceVerificationItem) BeforeCreate(tx *gorm.DB) error {
+	if cvi.ID == uuid.Nil {
+		cvi.ID = uuid.New()
+	}
+	return nil
+}
+
+// ===== AUDIT MODELS =====
+
+// AuditEvent is an entry of the audit log
+type AuditEvent struct {
+	ID             uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	ActorID        *uuid.UUID `gorm:"type:uuid;index" json:"actor_id,omitempty"` // nil for background jobs
+	ActorRole      string     `gorm:"size:50" json:"actor_role,omitempty"`
+	OrganizationID *uuid.UUID `gorm:"type:uuid;index" json:"organization_id,omitempty"`
+	Action         string     `gorm:"size:100;not null;index" json:"action"`
+	TargetType     string     `gorm:"size:50" json:"target_type,omitempty"`
+	TargetID       string     `gorm:"size:255" json:"target_id,omitempty"`
+	Result         string     `gorm:"size:20;not null" json:"result"` // success, failure or denied
+	IPAddress      string     `gorm:"size:64" json:"ip_address,omitempty"`
+	UserAgent      string     `gorm:"type:text" json:"user_agent,omitempty"`
+	Detail         string     `gorm:"type:text" json:"detail,omitempty"`
+	CreatedAt      time.Time  `gorm:"index" json:"created_at"`
+}
+
+// BeforeCreate hook to set UUID for AuditEvent
+func (ae *AuditEvent) BeforeCreate(tx *gorm.DB) error {
+	if ae.ID == uuid.Nil {
+		ae.ID = uuid.New()
+	}
+	return nil
+}
+
+// ===== INTEGRITY MODELS =====
+
+// IntegrityDigest seals the objects one account archived on one day: the Merkle
+// root over their hashes, chained to the account's previous digest so that
+// rewriting any earlier day breaks every later ChainHash.
+type IntegrityDigest struct {
+	ID            uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	AccountID     uuid.UUID `gorm:"type:uuid;not null;uniqueIndex:idx_integrity_digest_day" json:"account_id"`
+	Day           time.Time `gorm:"type:date;not null;uniqueIndex:idx_integrity_digest_day" json:"day"`
+	EmailCount    int       `gorm:"default:0" json:"email_count"`
+	ObjectCount   int       `gorm:"default:0" json:"object_count"`
+	MerkleRoot    string    `gorm:"size:64;not null" json:"merkle_root"`
+	PrevChainHash string    `gorm:"size:64" json:"prev_chain_hash"` // Empty for the first digest of an account
+	ChainHash     string    `gorm:"size:64;not null" json:"chain_hash"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// IntegrityDigestEntry is one leaf of a digest: an object and its hash at
+// sealing time. Entries outlive the emails they describe.
+type IntegrityDigestEntry struct {
+	ID         uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	DigestID   uuid.UUID `gorm:"type:uuid;not null;index" json:"digest_id"`
+	EmailID    uuid.UUID `gorm:"type:uuid;not null;index" json:"email_id"`
+	ObjectPath string    `gorm:"not null" json:"object_path"`
+	SHA256     string    `gorm:"size:64;not null" json:"sha256"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// IntegrityRun records one verification pass over the archive
+type IntegrityRun struct {
+	ID               uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	TriggeredBy      *uuid.UUID `gorm:"type:uuid" json:"triggered_by,omitempty"` // nil for the scheduled job
+	Status           string     `gorm:"size:20;not null;check:status IN ('running','completed','failed')" json:"status"`
+	DigestsSealed    int        `gorm:"default:0" json:"digests_sealed"`
+	DigestsChecked   int        `gorm:"default:0" json:"digests_checked"`
+	ObjectsChecked   int        `gorm:"default:0" json:"objects_checked"`
+	HashesBackfilled int        `gorm:"default:0" json:"hashes_backfilled"` // Objects archived before hashes were recorded
+	Discrepancies    int        `gorm:"default:0" json:"discrepancies"`
+	ErrorMessage     string     `gorm:"type:text" json:"error_message,omitempty"`
+	StartedAt        time.Time  `gorm:"not null" json:"started_at"`
+	CompletedAt      *time.Time `json:"completed_at,omitempty"`
+	CreatedAt        time.Time  `json:"created_at"`
+}
+
+// IntegrityDiscrepancy is a problem found by a verification run
+type IntegrityDiscrepancy struct {
+	ID         uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	RunID      uuid.UUID  `gorm:"type:uuid;not null;index" json:"run_id"`
+	AccountID  uuid.UUID  `gorm:"type:uuid;not null;index" json:"account_id"`
+	EmailID    *uuid.UUID `gorm:"type:uuid" json:"email_id,omitempty"`
+	DigestID   *uuid.UUID `gorm:"type:uuid" json:"digest_id,omitempty"`
+	ObjectPath string     `json:"object_path,omitempty"`
+	Kind       string     `gorm:"size:30;not null;index" json:"kind"` // missing, modified, unreadable, index_modified, digest_mismatch, chain_broken
+	Expected   string     `json:"expected,omitempty"`
+	Actual     string     `json:"actual,omitempty"`
+	Detail     string     `gorm:"type:text" json:"detail,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// BeforeCreate hook to set UUID for IntegrityDigest
+func (id *IntegrityDigest) BeforeCreate(tx *gorm.DB) error {
+	if id.ID == uuid.Nil {
+		id.ID = uuid.New()
+	}
+	return nil
+}
+
+// BeforeCreate hook to set UUID for IntegrityDigestEntry
+func (ide *IntegrityDigestEntry) BeforeCreate(tx *gorm.DB) error {
+	if ide.ID == uuid.Nil {
+		ide.ID = uuid.New()
+	}
+	return nil
+}
+
+// BeforeCreate hook to set UUID for IntegrityRun
+func (ir *IntegrityRun) BeforeCreate(tx *gorm.DB) error {
+	if ir.ID == uuid.Nil {
+		ir.ID = uuid.New()
+	}
+	return nil
+}
+
+// BeforeCreate hook to set UUID for IntegrityDiscrepancy
+func (idc *IntegrityDiscrepancy) BeforeCreate(tx *gorm.DB) error {
+	if idc.ID == uuid.Nil {
+		idc.ID = uuid.New()
+	}
+	return nil
+}
+
+// ===== EDISCOVERY MODELS =====
+
+// PermissionGrant gives a user an extra permission over an organization and
+// its descendants, independent of their role (e.g. compliance_officer)
+type PermissionGrant struct {
+	ID             uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	UserID         uuid.UUID `gorm:"type:uuid;not null;uniqueIndex:idx_permission_grant" json:"user_id"`
+	OrganizationID uuid.UUID `gorm:"type:uuid;not null;uniqueIndex:idx_permission_grant" json:"organization_id"`
+	Permission     string    `gorm:"size:50;not null;uniqueIndex:idx_permission_grant" json:"permission"`
+	GrantedBy      uuid.UUID `gorm:"type:uuid;not null" json:"granted_by"`
+	CreatedAt      time.Time `json:"created_at"`
+
+	// Relationships
+	User         *User         `gorm:"foreignKey:UserID" json:"user,omitempty"`
+	Organization *Organization `gorm:"foreignKey:OrganizationID" json:"organization,omitempty"`
+}
+
+// DiscoveryCase groups the searches, tagged emails and exports of one eDiscovery matter
+type DiscoveryCase struct {
+	ID             uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	OrganizationID uuid.UUID  `gorm:"type:uuid;not null;index" json:"organization_id"` // Searches cover this organization and its descendants
+	Name           string     `gorm:"size:255;not null" json:"name"`
+	Description    string     `gorm:"type:text" json:"description,omitempty"`
+	Status         string     `gorm:"size:20;not null;default:'open';check:status IN ('open','closed')" json:"status"`
+	CreatedBy      uuid.UUID  `gorm:"type:uuid;not null" json:"created_by"`
+	ClosedAt       *time.Time `json:"closed_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+// DiscoverySearch records a search run within a case
+type DiscoverySearch struct {
+	ID          uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	CaseID      uuid.UUID `gorm:"type:uuid;not null;index" json:"case_id"`
+	Query       string    `gorm:"type:jsonb;not null" json:"query"`
+	ResultCount int64     `gorm:"default:0" json:"result_count"`
+	ExecutedBy  uuid.UUID `gorm:"type:uuid;not null" json:"executed_by"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// DiscoveryItem is an email added to a case, with the tags reviewers gave it
+type DiscoveryItem struct {
+	ID        uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	CaseID    uuid.UUID `gorm:"type:uuid;not null;uniqueIndex:idx_discovery_item" json:"case_id"`
+	EmailID   uuid.UUID `gorm:"type:uuid;not null;uniqueIndex:idx_discovery_item" json:"email_id"`
+	AccountID uuid.UUID `gorm:"type:uuid;not null" json:"account_id"`
+	Tags      string    `gorm:"type:jsonb;default:'[]'" json:"tags"` // JSON array of tags
+	AddedBy   uuid.UUID `gorm:"type:uuid;not null" json:"added_by"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// DiscoveryExport is a case package: the case's emails plus a manifest with their hashes
+type DiscoveryExport struct {
+	ID             uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	CaseID         uuid.UUID  `gorm:"type:uuid;not null;index" json:"case_id"`
+	Tag            string     `gorm:"size:100" json:"tag,omitempty"` // Only items with this tag, all items when empty
+	Status         string     `gorm:"size:20;not null;check:status IN ('running','completed','failed')" json:"status"`
+	RequestedBy    uuid.UUID  `gorm:"type:uuid;not null" json:"requested_by"`
+	ItemCount      int        `gorm:"default:0" json:"item_count"`
+	MinioPath      string     `json:"minio_path,omitempty"`
+	PackageSize    int64      `gorm:"default:0" json:"package_size"`
+	PackageSHA256  string     `gorm:"size:64" json:"package_sha256,omitempty"`
+	ManifestSHA256 string     `gorm:"size:64" json:"manifest_sha256,omitempty"`
+	ErrorMessage   string     `gorm:"type:text" json:"error_message,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	CompletedAt    *time.Time `json:"completed_at,omitempty"`
+}
+
+// BeforeCreate hook to set UUID for PermissionGrant
+func (pg *PermissionGrant) BeforeCreate(tx *gorm.DB) error {
+	if pg.ID == uuid.Nil {
+		pg.ID = uuid.New()
+	}
+	return nil
+}
+
+// BeforeCreate hook to set UUID for DiscoveryCase
+func (dc *DiscoveryCase) BeforeCreate(tx *gorm.DB) error {
+	if dc.ID == uuid.Nil {
+		dc.ID = uuid.New()
+	}
+	return nil
+}
+
+// BeforeCreate hook to set UUID for DiscoverySearch
+func (ds *DiscoverySearch) BeforeCreate(tx *gorm.DB) error {
+	if ds.ID == uuid.Nil {
+		ds.ID = uuid.New()
+	}
+	return nil
+}
+
+// BeforeCreate hook to set UUID for DiscoveryItem
+func (di *DiscoveryItem) BeforeCreate(tx *gorm.DB) error {
+	if di.ID == uuid.Nil {
+		di.ID = uuid.New()
+	}
+	return nil
+}
+
+// BeforeCreate hook to set UUID for DiscoveryExport
+func (de *DiscoveryExport) BeforeCreate(tx *gorm.DB) error {
+	if de.ID == uuid.Nil {
+		de.ID = uuid.New()
+	}
+	return nil
+}
+
+// ===== DATA SUBJECT REQUEST MODELS =====
+
+// DataSubjectRequest is a GDPR access or erasure request for one person's
+// data across the archives of an organization subtree
+type DataSubjectRequest struct {
+	ID                   uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	OrganizationID       uuid.UUID  `gorm:"type:uuid;not null;index" json:"organization_id"`
+	RequestType          string     `gorm:"size:20;not null;check:request_type IN ('access','erasure')" json:"request_type"`
+	SubjectEmail         string     `gorm:"not null" json:"subject_email"`
+	SubjectName          string     `json:"subject_name,omitempty"`
+	Reference            string     `gorm:"size:255" json:"reference,omitempty"` // The requester's own ticket or letter reference
+	Status               string     `gorm:"size:20;not null;check:status IN ('searching','ready','processing','completed','failed')" json:"status"`
+	Action               string     `gorm:"size:20" json:"action,omitempty"` // redact or delete, once erasure has started
+	MatchCount           int        `gorm:"default:0" json:"match_count"`
+	EmailsRedacted       int        `gorm:"default:0" json:"emails_redacted"`
+	EmailsDeleted        int        `gorm:"default:0" json:"emails_deleted"`
+	EmailsHeld           int        `gorm:"default:0" json:"emails_held"`   // Kept because of a legal hold
+	EmailsLocked         int        `gorm:"default:0" json:"emails_locked"` // Kept because of a compliance lock
+	EmailsFailed         int        `gorm:"default:0" json:"emails_failed"`
+	Certificate          string     `gorm:"type:text" json:"certificate,omitempty"` // Signed JSON, kept byte for byte
+	CertificateSignature string     `gorm:"size:64" json:"certificate_signature,omitempty"` // HMAC-SHA256 of Certificate
+	ErrorMessage         string     `gorm:"type:text" json:"error_message,omitempty"`
+	CreatedBy            uuid.UUID  `gorm:"type:uuid;not null" json:"created_by"`
+	ProcessedBy          *uuid.UUID `gorm:"type:uuid" json:"processed_by,omitempty"`
+	CreatedAt            time.Time  `json:"created_at"`
+	UpdatedAt            time.Time  `json:"updated_at"`
+	CompletedAt          *time.Time `json:"completed_at,omitempty"`
+
+	// Relationships
+	Organization Organization `gorm:"foreignKey:OrganizationID" json:"organization,omitempty"`
+}
+
+// DataSubjectMatch is an archived email in which the subject of a request
+// appears, with what the erasure did to it
+type DataSubjectMatch struct {
+	ID          uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	RequestID   uuid.UUID `gorm:"type:uuid;not null;index" json:"request_id"`
+	EmailID     uuid.UUID `gorm:"type:uuid;not null;index" json:"email_id"` // No foreign key: the email may be deleted by the erasure
+	AccountID   uuid.UUID `gorm:"type:uuid;not null" json:"account_id"`
+	MessageID   string    `json:"message_id"`
+	Subject     string    `json:"subject"`
+	SenderEmail string    `json:"sender_email"`
+	EmailDate   time.Time `json:"email_date"`
+	Folder      string    `json:"folder"`
+	MatchedAs   string    `gorm:"size:20;not null" json:"matched_as"` // sender, recipient or both
+	Outcome     string    `gorm:"size:20;not null;default:'pending'" json:"outcome"`
+	Error       string    `gorm:"type:text" json:"error,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// BeforeCreate hook to set UUID for DataSubjectRequest
+func (dsr *DataSubjectRequest) BeforeCreate(tx *gorm.DB) error {
+	if dsr.ID == uuid.Nil {
+		dsr.ID = uuid.New()
+	}
+	return nil
+}
+
+// BeforeCreate hook to set UUID for DataSubjectMatch
+func (dsm *DataSubjectMatch) BeforeCreate(tx *gorm.DB) error {
+	if dsm.ID == uuid.Nil {
+		dsm.ID = uuid.New()
+	}
+	return nil
+}
+
+// ===== USAGE METERING MODELS =====
+
+// UsageSnapshot records an organization's usage on one UTC day. The plain
+// counts cover the organization's own members, the totals its whole subtree,
+// each user and mailbox counted once.
+type UsageSnapshot struct {
+	ID                   uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	OrganizationID       uuid.UUID `gorm:"type:uuid;not null;uniqueIndex:idx_usage_snapshot_day" json:"organization_id"`
+	Day                  time.Time `gorm:"type:date;not null;uniqueIndex:idx_usage_snapshot_day;index" json:"day"`
+	Users                int64     `gorm:"default:0" json:"users"`
+	ActiveMailboxes      int64     `gorm:"default:0" json:"active_mailboxes"`
+	StoredBytes          int64     `gorm:"default:0" json:"stored_bytes"`
+	IngestedBytes        int64     `gorm:"default:0" json:"ingested_bytes"` // Archived during the day
+	TotalUsers           int64     `gorm:"default:0" json:"total_users"`
+	TotalActiveMailboxes int64     `gorm:"default:0" json:"total_active_mailboxes"`
+	TotalStoredBytes     int64     `gorm:"default:0" json:"total_stored_bytes"`
+	TotalIngestedBytes   int64     `gorm:"default:0" json:"total_ingested_bytes"`
+	Final                bool      `gorm:"default:false" json:"final"` // Taken after the day ended
+	TakenAt              time.Time `json:"taken_at"`
+	CreatedAt            time.Time `json:"created_at"`
+	UpdatedAt            time.Time `json:"updated_at"`
+}
+
+// PricePlan prices a billing period for the organizations of one hierarchy
+// level, or for a single organization when OrganizationID is set. Prices are
+// in cents of Currency.
+type PricePlan struct {
+	ID                 uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	Name               string     `gorm:"size:255;not null" json:"name"`
+	OrgType            string     `gorm:"size:50;not null;index;check:org_type IN ('distributor','dealer','client')" json:"org_type"`
+	OrganizationID     *uuid.UUID `gorm:"type:uuid;index" json:"organization_id,omitempty"` // Overrides the level plan for one organization
+	Currency           string     `gorm:"size:3;not null" json:"currency"`
+	BaseFeeCents       int64      `gorm:"default:0" json:"base_fee_cents"`
+	PerUserCents       int64      `gorm:"default:0" json:"per_user_cents"`        // Per user at the period's peak
+	PerMailboxCents    int64      `gorm:"default:0" json:"per_mailbox_cents"`     // Per active mailbox at the period's peak
+	PerGBStoredCents   int64      `gorm:"default:0" json:"per_gb_stored_cents"`   // Per GB stored on average over the period
+	PerGBIngestedCents int64      `gorm:"default:0" json:"per_gb_ingested_cents"` // Per GB archived during the period
+	IsActive           bool       `gorm:"default:true" json:"is_active"`
+	CreatedBy          uuid.UUID  `gorm:"type:uuid;not null" json:"created_by"`
+	CreatedAt          time.Time  `json:"created_at"`
+	UpdatedAt          time.Time  `json:"updated_at"`
+}
+
+// BeforeCreate hook to set UUID for UsageSnapshot
+func (us *UsageSnapshot) BeforeCreate(tx *gorm.DB) error {
+	if us.ID == uuid.Nil {
+		us.ID = uuid.New()
+	}
+	return nil
+}
+
+// BeforeCreate hook to set UUID for PricePlan
+func (pp *PricePlan) BeforeCreate(tx *gorm.DB) error {
+	if pp.ID == uuid.Nil {
+		pp.ID = uuid.New()
+	}
+	return nil
+}
+
+// ===== SESSION MODELS =====
+
+// AuthSession is a login of one user on one client. Access tokens carry the
+// session ID and stop working as soon as the session is revoked.
+type AuthSession struct {
+	ID            uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	UserID        uuid.UUID  `gorm:"type:uuid;not null;index" json:"user_id"`
+	IPAddress     string     `gorm:"size:64" json:"ip_address"`
+	UserAgent     string     `gorm:"size:512" json:"user_agent"`
+	ExpiresAt     time.Time  `gorm:"not null" json:"expires_at"`
+	LastUsedAt    time.Time  `json:"last_used_at"` // Last refresh
+	RevokedAt     *time.Time `gorm:"index" json:"revoked_at,omitempty"`
+	RevokedReason string     `gorm:"size:100" json:"revoked_reason,omitempty"`
+	ActiveOrgID   *uuid.UUID `gorm:"type:uuid" json:"active_org_id,omitempty"` // Organization switched to, when not the primary one
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+
+	// Relationships
+	User User `gorm:"foreignKey:UserID" json:"-"`
+}
+
+// RefreshToken is one link in a session's refresh token chain. Only the
+// SHA-256 of the token is stored; each token can be exchanged once.
+type RefreshToken struct {
+	ID        uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	SessionID uuid.UUID  `gorm:"type:uuid;not null;index" json:"session_id"`
+	TokenHash string     `gorm:"size:64;not null;uniqueIndex" json:"-"`
+	ExpiresAt time.Time  `gorm:"not null" json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"` // Exchanged for a new token
+	CreatedAt time.Time  `json:"created_at"`
+
+	// Relationships
+	Session AuthSession `gorm:"foreignKey:SessionID" json:"-"`
+}
+
+// BeforeCreate hook to set UUID for AuthSession
+func (as *AuthSession) BeforeCreate(tx *gorm.DB) error {
+	if as.ID == uuid.Nil {
+		as.ID = uuid.New()
+	}
+	return nil
+}
+
+// BeforeCreate hook to set UUID for RefreshToken
+func (rt *RefreshToken) BeforeCreate(tx *gorm.DB) error {
+	if rt.ID == uuid.Nil {
+		rt.ID = uuid.New()
+	}
+	return nil
+}
+
+// ===== MFA MODELS =====
+
+// UserMFA is a user's TOTP enrollment. It only protects logins once the first
+// code has been confirmed.
+type UserMFA struct {
+	ID           uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	UserID       uuid.UUID  `gorm:"type:uuid;not null;uniqueIndex" json:"user_id"`
+	Secret       string     `gorm:"size:64;not null" json:"-"` // Base32 TOTP secret
+	ConfirmedAt  *time.Time `json:"confirmed_at,omitempty"`
+	LastUsedStep int64      `gorm:"default:0" json:"-"` // Time step of the last accepted code, so codes cannot be replayed
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+
+	// Relationships
+	User User `gorm:"foreignKey:UserID" json:"-"`
+}
+
+// MFARecoveryCode is a one-time code that stands in for a TOTP code when the
+// authenticator is lost. Only its SHA-256 is stored.
+type MFARecoveryCode struct {
+	ID        uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	UserID    uuid.UUID  `gorm:"type:uuid;not null;index" json:"user_id"`
+	CodeHash  string     `gorm:"size:64;not null;uniqueIndex" json:"-"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// MFAChallenge is the second step of a login whose password was accepted.
+// Only the SHA-256 of the challenge token is stored.
+type MFAChallenge struct {
+	ID        uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	UserID    uuid.UUID  `gorm:"type:uuid;not null;index" json:"user_id"`
+	TokenHash string     `gorm:"size:64;not null;uniqueIndex" json:"-"`
+	ExpiresAt time.Time  `gorm:"not null" json:"expires_at"`
+	Attempts  int        `gorm:"default:0" json:"attempts"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// BeforeCreate hook to set UUID for UserMFA
+func (um *UserMFA) BeforeCreate(tx *gorm.DB) error {
+	if um.ID == uuid.Nil {
+		um.ID = uuid.New()
+	}
+	return nil
+}
+
+// BeforeCreate hook to set UUID for MFARecoveryCode
+func (rc *MFARecoveryCode) BeforeCreate(tx *gorm.DB) error {
+	if rc.ID == uuid.Nil {
+		rc.ID = uuid.New()
+	}
+	return nil
+}
+
+// BeforeCreate hook to set UUID for MFAChallenge
+func (mc *MFAChallenge) BeforeCreate(tx *gorm.DB) error {
+	if mc.ID == uuid.Nil {
+		mc.ID = uuid.New()
+	}
+	return nil
+}
+
+// ===== API KEY MODELS =====
+
+// APIKey authenticates an integration without a login. A key acts as a user
+// (the owner of a personal key, the creator of an organization key) and is
+// limited to its scopes. Only the SHA-256 of the key is stored.
+type APIKey struct {
+	ID             uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	Name           string     `gorm:"size:255;not null" json:"name"`
+	OrganizationID uuid.UUID  `gorm:"type:uuid;not null;index" json:"organization_id"` // Whose api_access feature governs the key
+	UserID         *uuid.UUID `gorm:"type:uuid;index" json:"user_id,omitempty"`        // Set for personal keys
+	CreatedBy      uuid.UUID  `gorm:"type:uuid;not null;index" json:"created_by"`
+	Prefix         string     `gorm:"size:16;not null" json:"prefix"` // Shown to tell keys apart
+	KeyHash        string     `gorm:"size:64;not null;uniqueIndex" json:"-"`
+	Scopes         string     `gorm:"type:jsonb;not null;default:'[]'" json:"scopes"`      // JSON array of permissions
+	AllowedIPs     string     `gorm:"type:jsonb;not null;default:'[]'" json:"allowed_ips"` // JSON array of IPs or CIDRs; empty allows any
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt     *time.Time `json:"last_used_at,omitempty"`
+	LastUsedIP     string     `gorm:"size:64" json:"last_used_ip,omitempty"`
+	RequestCount   int64      `gorm:"default:0" json:"request_count"`
+	RevokedAt      *time.Time `gorm:"index" json:"revoked_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+// APIKeyUsage counts the requests made with a key on one UTC day
+type APIKeyUsage struct {
+	ID       uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	APIKeyID uuid.UUID `gorm:"type:uuid;not null;uniqueIndex:idx_api_key_usage_day" json:"api_key_id"`
+	Day      time.Time `gorm:"type:date;not null;uniqueIndex:idx_api_key_usage_day" json:"day"`
+	Requests int64     `gorm:"default:0" json:"requests"`
+	Denied   int64     `gorm:"default:0" json:"denied"` // Refused for scope or IP
+}
+
+// BeforeCreate hook to set UUID for APIKey
+func (ak *APIKey) BeforeCreate(tx *gorm.DB) error {
+	if ak.ID == uuid.Nil {
+		ak.ID = uuid.New()
+	}
+	return nil
+}
+
+// BeforeCreate hook to set UUID for APIKeyUsage
+func (au *APIKeyUsage) BeforeCreate(tx *gorm.DB) error {
+	if au.ID == uuid.Nil {
+		au.ID = uuid.New()
+	}
+	return nil
+}
+
+// ===== SSO MODELS =====
+
+// OrganizationSSO is an organization's OpenID Connect identity provider.
+// Users signing in through it are matched by email and, when provisioning is
+// on, created under the organization on their first login.
+type OrganizationSSO struct {
+	ID                   uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	OrganizationID       uuid.UUID `gorm:"type:uuid;not null;uniqueIndex" json:"organization_id"`
+	Issuer               string    `gorm:"size:512;not null" json:"issuer"`
+	ClientID             string    `gorm:"size:255;not null" json:"client_id"`
+	ClientSecret         string    `gorm:"size:512" json:"-"`
+	Scopes               string    `gorm:"size:255;default:'openid email profile'" json:"scopes"`
+	EmailClaim           string    `gorm:"size:100;default:'email'" json:"email_claim"`
+	RoleClaim            string    `gorm:"size:100;default:'groups'" json:"role_claim"`
+	RoleMapping          string    `gorm:"type:jsonb;default:'{}'" json:"role_mapping"`    // Claim value to role name
+	DefaultRole          string    `gorm:"size:50;default:'end_user'" json:"default_role"` // When no mapping matches; empty refuses the login
+	AllowedDomains       string    `gorm:"type:jsonb;default:'[]'" json:"allowed_domains"` // Email domains; empty allows any
+	JITProvisioning      bool      `gorm:"default:true" json:"jit_provisioning"`
+	DisablePasswordLogin bool      `gorm:"default:false" json:"disable_password_login"`
+	IsActive             bool      `gorm:"default:true" json:"is_active"`
+	CreatedBy            uuid.UUID `gorm:"type:uuid;not null" json:"created_by"`
+	CreatedAt            time.Time `json:"created_at"`
+	UpdatedAt            time.Time `json:"updated_at"`
+}
+
+// SSOLoginState tracks one login through an identity provider, from the
+// redirect to the provider until the browser redeems its login code
+type SSOLoginState struct {
+	ID             uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	OrganizationID uuid.UUID  `gorm:"type:uuid;not null;index" json:"organization_id"`
+	StateHash      string     `gorm:"size:64;not null;uniqueIndex" json:"-"`
+	Nonce          string     `gorm:"size:64;not null" json:"-"`
+	CodeVerifier   string     `gorm:"size:128;not null" json:"-"` // PKCE
+	ExpiresAt      time.Time  `gorm:"not null" json:"expires_at"`
+	CallbackAt     *time.Time `json:"callback_at,omitempty"`
+	UserID         *uuid.UUID `gorm:"type:uuid" json:"user_id,omitempty"`
+	LoginCodeHash  string     `gorm:"size:64;index" json:"-"` // Redeemed by the frontend for tokens
+	RedeemedAt     *time.Time `json:"redeemed_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+// BeforeCreate hook to set UUID for OrganizationSSO
+func (sso *OrganizationSSO) BeforeCreate(tx *gorm.DB) error {
+	if sso.ID == uuid.Nil {
+		sso.ID = uuid.New()
+	}
+	return nil
+}
+
+// BeforeCreate hook to set UUID for SSOLoginState
+func (ls *SSOLoginState) BeforeCreate(tx *gorm.DB) error {
+	if ls.ID == uuid.Nil {
+		ls.ID = uuid.New()
+	}
+	return nil
+}
+
+// ===== DIRECTORY MODELS =====
+
+// OrganizationDirectory is an organization's LDAP / Active Directory server.
+// Members of its group are synced as end users of the organization and can
+// sign in with their directory password.
+type OrganizationDirectory struct {
+	ID                 uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	OrganizationID     uuid.UUID `gorm:"type:uuid;not null;uniqueIndex" json:"organization_id"`
+	URL                string    `gorm:"size:512;not null" json:"url"` // ldap:// or ldaps://
+	StartTLS           bool      `gorm:"default:false" json:"start_tls"`
+	InsecureSkipVerify bool      `gorm:"default:false" json:"insecure_skip_verify"`
+	BindDN             string    `gorm:"size:512;not null" json:"bind_dn"` // Service account used to search the directory
+	BindPassword       string    `gorm:"size:512" json:"-"`
+	BaseDN             string    `gorm:"size:512;not null" json:"base_dn"`
+	UserFilter         string    `gorm:"size:512;default:'(&(objectCategory=person)(objectClass=user))'" json:"user_filter"`
+	GroupDN            string    `gorm:"size:512;not null" json:"group_dn"` // Members, including those of nested groups, are synced
+	IDAttribute        string    `gorm:"size:100;default:'objectGUID'" json:"id_attribute"`
+	EmailAttribute     string    `gorm:"size:100;default:'mail'" json:"email_attribute"`
+	LoginEnabled       bool      `gorm:"default:true" json:"login_enabled"`
+	SyncEnabled        bool      `gorm:"default:true" json:"sync_enabled"`
+
+	// Exchange service account with impersonation rights, used for the
+	// mailboxes of synced users
+	CreateMailboxAccounts bool   `gorm:"default:false" json:"create_mailbox_accounts"`
+	ExchangeServerURL     string `gorm:"size:512" json:"exchange_server_url,omitempty"`
+	ExchangeUsername      string `gorm:"size:255" json:"exchange_username,omitempty"`
+	ExchangePassword      string `gorm:"size:512" json:"-"`
+	ExchangeDomain        string `gorm:"size:255" json:"exchange_domain,omitempty"`
+
+	IsActive   bool       `gorm:"default:true" json:"is_active"`
+	LastSyncAt *time.Time `json:"last_sync_at,omitempty"`
+	CreatedBy  uuid.UUID  `gorm:"type:uuid;not null" json:"created_by"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+// DirectoryUser links a user to the directory entry it was synced from
+type DirectoryUser struct {
+	ID             uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	OrganizationID uuid.UUID  `gorm:"type:uuid;not null;uniqueIndex:idx_directory_user_external" json:"organization_id"`
+	ExternalID     string     `gorm:"size:255;not null;uniqueIndex:idx_directory_user_external" json:"external_id"` // Value of the directory's ID attribute
+	UserID         uuid.UUID  `gorm:"type:uuid;not null;uniqueIndex" json:"user_id"`
+	DN             string     `gorm:"size:1024" json:"dn"`
+	LastSeenAt     time.Time  `json:"last_seen_at"`
+	DisabledAt     *time.Time `json:"disabled_at,omitempty"` // Set while the entry is missing from the group or disabled in the directory
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+// DirectorySyncRun records one sync of an organization's directory
+type DirectorySyncRun struct {
+	ID              uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	OrganizationID  uuid.UUID  `gorm:"type:uuid;not null;index" json:"organization_id"`
+	TriggeredBy     *uuid.UUID `gorm:"type:uuid" json:"triggered_by,omitempty"` // nil for the scheduled job
+	Status          string     `gorm:"size:20;not null;check:status IN ('running','completed','failed')" json:"status"`
+	EntriesFound    int        `gorm:"default:0" json:"entries_found"`
+	UsersCreated    int        `gorm:"default:0" json:"users_created"`
+	UsersUpdated    int        `gorm:"default:0" json:"users_updated"`
+	UsersDisabled   int        `gorm:"default:0" json:"users_disabled"`
+	UsersEnabled    int        `gorm:"default:0" json:"users_enabled"`
+	AccountsCreated int        `gorm:"default:0" json:"accounts_created"`
+	EntriesSkipped  int        `gorm:"default:0" json:"entries_skipped"`
+	Warnings        string     `gorm:"type:text" json:"warnings,omitempty"` // One line per skipped entry
+	ErrorMessage    string     `gorm:"type:text" json:"error_message,omitempty"`
+	StartedAt       time.Time  `gorm:"not null" json:"started_at"`
+	CompletedAt     *time.Time `json:"completed_at,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+}
+
+// BeforeCreate hook to set UUID for OrganizationDirectory
+func (od *OrganizationDirectory) BeforeCreate(tx *gorm.DB) error {
+	if od.ID == uuid.Nil {
+		od.ID = uuid.New()
+	}
+	return nil
+}
+
+// BeforeCreate hook to set UUID for DirectoryUser
+func (du *DirectoryUser) BeforeCreate(tx *gorm.DB) error {
+	if du.ID == uuid.Nil {
+		du.ID = uuid.New()
+	}
+	return nil
+}
+
+// BeforeCreate hook to set UUID for DirectorySyncRun
+func (dr *DirectorySyncRun) BeforeCreate(tx *gorm.DB) error {
+	if dr.ID == uuid.Nil {
+		dr.ID = uuid.New()
+	}
+	return nil
+}
+
+// ===== TENANT CONNECTOR MODELS =====
+
+// TenantConnector backs up every mailbox of an Exchange organization or a
+// Microsoft 365 tenant with one service account instead of each user's own
+// credentials. Discovered mailboxes become Exchange or Office 365 accounts of
+// the organization's end users.
+type TenantConnector struct {
+	ID             uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	OrganizationID uuid.UUID `gorm:"type:uuid;not null;index" json:"organization_id"`
+	Name           string    `gorm:"size:255;not null" json:"name"`
+	Type           string    `gorm:"size:20;not null;check:type IN ('exchange_ews','graph')" json:"type"`
+
+	// exchange_ews: service account with the ApplicationImpersonation role.
+	// EWS cannot list every mailbox, so the members of a distribution group
+	// (nested groups included) are backed up.
+	ServerURL      string `gorm:"size:512" json:"server_url,omitempty"`
+	Username       string `gorm:"size:255" json:"username,omitempty"`
+	Password       string `gorm:"size:512" json:"-"`
+	Domain         string `gorm:"size:255" json:"domain,omitempty"`
+	DiscoveryGroup string `gorm:"size:255" json:"discovery_group,omitempty"`
+
+	// graph: app registration granted the User.Read.All and Mail.Read
+	// application permissions
+	TenantID     string `gorm:"size:255" json:"tenant_id,omitempty"`
+	ClientID     string `gorm:"size:255" json:"client_id,omitempty"`
+	ClientSecret string `gorm:"size:512" json:"-"`
+
+	SyncMailboxes bool       `gorm:"default:true" json:"sync_mailboxes"` // Sync the mailboxes after each discovery
+	IsActive      bool       `gorm:"default:true" json:"is_active"`
+	LastRunAt     *time.Time `json:"last_run_at,omitempty"`
+	CreatedBy     uuid.UUID  `gorm:"type:uuid;not null" json:"created_by"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+// TenantConnectorRun records one mailbox discovery of a connector and the
+// syncs of the mailboxes it found
+type TenantConnectorRun struct {
+	ID               uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	ConnectorID      uuid.UUID  `gorm:"type:uuid;not null;index" json:"connector_id"`
+	OrganizationID   uuid.UUID  `gorm:"type:uuid;not null;index" json:"organization_id"`
+	TriggeredBy      *uuid.UUID `gorm:"type:uuid" json:"triggered_by,omitempty"` // nil for the scheduled job
+	Status           string     `gorm:"size:20;not null;check:status IN ('running','completed','failed')" json:"status"`
+	MailboxesFound   int        `gorm:"default:0" json:"mailboxes_found"`
+	UsersCreated     int        `gorm:"default:0" json:"users_created"`
+	AccountsCreated  int        `gorm:"default:0" json:"accounts_created"`
+	AccountsPaused   int        `gorm:"default:0" json:"accounts_paused"` // Mailboxes no longer found
+	AccountsResumed  int        `gorm:"default:0" json:"accounts_resumed"`
+	MailboxesSkipped int        `gorm:"default:0" json:"mailboxes_skipped"`
+	MailboxesSynced  int        `gorm:"default:0" json:"mailboxes_synced"`
+	SyncsFailed      int        `gorm:"default:0" json:"syncs_failed"`
+	Warnings         string     `gorm:"type:text" json:"warnings,omitempty"` // One line per skipped mailbox or failed sync
+	ErrorMessage     string     `gorm:"type:text" json:"error_message,omitempty"`
+	StartedAt        time.Time  `gorm:"not null" json:"started_at"`
+	CompletedAt      *time.Time `json:"completed_at,omitempty"`
+	CreatedAt        time.Time  `json:"created_at"`
+}
+
+// BeforeCreate hook to set UUID for TenantConnector
+func (tc *TenantConnector) BeforeCreate(tx *gorm.DB) error {
+	if tc.ID == uuid.Nil {
+		tc.ID = uuid.New()
+	}
+	return nil
+}
+
+// BeforeCreate hook to set UUID for TenantConnectorRun
+func (tr *TenantConnectorRun) BeforeCreate(tx *gorm.DB) error {
+	if tr.ID == uuid.Nil {
+		tr.ID = uuid.New()
+	}
+	return nil
+}
+
+// ===== PASSWORD MODELS =====
+
+// PasswordHistory is a previous password of a user, kept so a password
+// policy can refuse reusing it
+type PasswordHistory struct {
+	ID           uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	UserID       uuid.UUID `gorm:"type:uuid;not null;index" json:"user_id"`
+	PasswordHash string    `gorm:"not null" json:"-"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// PasswordResetToken is a single-use link sent to a user who forgot their password
+type PasswordResetToken struct {
+	ID        uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	UserID    uuid.UUID  `gorm:"type:uuid;not null;index" json:"user_id"`
+	TokenHash string     `gorm:"size:64;not null;uniqueIndex" json:"-"`
+	ExpiresAt time.Time  `gorm:"not null" json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	RequestIP string     `gorm:"size:45" json:"request_ip"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// BeforeCreate hook to set UUID for PasswordHistory
+func (ph *PasswordHistory) BeforeCreate(tx *gorm.DB) error {
+	if ph.ID == uuid.Nil {
+		ph.ID = uuid.New()
+	}
+	return nil
+}
+
+// BeforeCreate hook to set UUID for PasswordResetToken
+func (pr *PasswordResetToken) BeforeCreate(tx *gorm.DB) error {
+	if pr.ID == uuid.Nil {
+		pr.ID = uuid.New()
+	}
+	return nil
+}
+
+// ===== CUSTOM ROLE MODELS =====
+
+// CustomRole is a role an organization defines on top of a built-in role. It
+// holds a subset of the built-in role's permissions and can be given to users
+// with that role in the organization or its descendants.
+type CustomRole struct {
+	ID             uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	OrganizationID uuid.UUID `gorm:"type:uuid;not null;uniqueIndex:idx_custom_role_name" json:"organization_id"`
+	BaseRoleID     uuid.UUID `gorm:"type:uuid;not null" json:"base_role_id"`
+	Name           string    `gorm:"size:100;not null;uniqueIndex:idx_custom_role_name" json:"name"`
+	Description    string    `gorm:"type:text" json:"description"`
+	Permissions    string    `gorm:"type:jsonb;default:'[]'" json:"permissions"` // JSON array, within the base role's permissions
+	CreatedBy      uuid.UUID `gorm:"type:uuid;not null" json:"created_by"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+
+	// Relationships
+	BaseRole *Role `gorm:"foreignKey:BaseRoleID" json:"base_role,omitempty"`
+}
+
+// BeforeCreate hook to set UUID for CustomRole
+func (cr *CustomRole) BeforeCreate(tx *gorm.DB) error {
+	if cr.ID == uuid.Nil {
+		cr.ID = uuid.New()
+	}
+	return nil
+}
+
+// ===== MAILBOX DELEGATION MODELS =====
+
+// MailboxGrant shares an email account with another user, such as an
+// assistant or an auditor, until it expires or is revoked
+type MailboxGrant struct {
+	ID        uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	AccountID uuid.UUID  `gorm:"type:uuid;not null;index" json:"account_id"`
+	GranteeID uuid.UUID  `gorm:"type:uuid;not null;index" json:"grantee_id"`
+	Scopes    string     `gorm:"type:jsonb;not null;default:'[]'" json:"scopes"` // JSON array: metadata, content, export, restore
+	Reason    string     `gorm:"type:text" json:"reason,omitempty"`
+	GrantedBy uuid.UUID  `gorm:"type:uuid;not null" json:"granted_by"`
+	ExpiresAt *time.Time `gorm:"index" json:"expires_at,omitempty"`
+	RevokedAt *time.Time `gorm:"index" json:"revoked_at,omitempty"`
+	RevokedBy *uuid.UUID `gorm:"type:uuid" json:"revoked_by,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+
+	// Relationships
+	Account *EmailAccount `gorm:"foreignKey:AccountID" json:"account,omitempty"`
+	Grantee *User         `gorm:"foreignKey:GranteeID" json:"grantee,omitempty"`
+}
+
+// BeforeCreate hook to set UUID for MailboxGrant
+func (mg *MailboxGrant) BeforeCreate(tx *gorm.DB) error {
+	if mg.ID == uuid.Nil {
+		mg.ID = uuid.New()
+	}
+	return nil
+}
@@ -10,11 +10,13 @@ import (
 
 	"emailprojectv2/auth"
 	"emailprojectv2/database"
+	"emailprojectv2/middleware"
 	"emailprojectv2/models"
 	"emailprojectv2/services"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"gorm.io/gorm"
 )
 
 type AccountHandler struct{
@@ -69,16 +71,6 @@ func (h *AccountHandler) AddGmailAccount(c *gin.Context) {
 		return
 	}
 
-	// CRITICAL: Only end users can manage email accounts
-	userClaims, exists := c.Get("user")
-	if exists {
-		claims := userClaims.(*auth.Claims)
-		if claims.RoleName != "end_user" {
-			c.JSON(http.StatusForbidden, gin.H{"error": "Only end users can manage email accounts"})
-			return
-		}
-	}
-
 	var req AddGmailRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -107,6 +99,11 @@ func (h *AccountHandler) AddGmailAccount(c *gin.Context) {
 		return
 	}
 
+	quotaWarnings, err := services.CheckAccountQuota(userUUID)
+	if respondQuotaError(c, err) {
+		return
+	}
+
 	account := database.EmailAccount{
 		ID:       uuid.New(),
 		UserID:   userUUID,
@@ -122,10 +119,10 @@ func (h *AccountHandler) AddGmailAccount(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusCreated, gin.H{
+	c.JSON(http.StatusCreated, withQuotaWarnings(gin.H{
 		"message": "Gmail account added successfully",
 		"account": account,
-	})
+	}, quotaWarnings))
 }
 
 func (h *AccountHandler) AddExchangeAccount(c *gin.Context) {
@@ -135,16 +132,6 @@ func (h *AccountHandler) AddExchangeAccount(c *gin.Context) {
 		return
 	}
 
-	// CRITICAL: Only end users can manage email accounts
-	userClaims, exists := c.Get("user")
-	if exists {
-		claims := userClaims.(*auth.Claims)
-		if claims.RoleName != "end_user" {
-			c.JSON(http.StatusForbidden, gin.H{"error": "Only end users can manage email accounts"})
-			return
-		}
-	}
-
 	var req AddExchangeRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -173,6 +160,11 @@ func (h *AccountHandler) AddExchangeAccount(c *gin.Context) {
 		return
 	}
 
+	quotaWarnings, err := services.CheckAccountQuota(userUUID)
+	if respondQuotaError(c, err) {
+		return
+	}
+
 	account := database.EmailAccount{
 		ID:        uuid.New(),
 		UserID:    userUUID,
@@ -190,10 +182,10 @@ func (h *AccountHandler) AddExchangeAccount(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusCreated, gin.H{
+	c.JSON(http.StatusCreated, withQuotaWarnings(gin.H{
 		"message": "Exchange account added successfully",
 		"account": account,
-	})
+	}, quotaWarnings))
 }
 
 func (h *AccountHandler) GetAccounts(c *gin.Context) {
@@ -203,26 +195,48 @@ func (h *AccountHandler) GetAccounts(c *gin.Context) {
 		return
 	}
 
-	// CRITICAL: Only end users can access email accounts
-	userClaims, exists := c.Get("user")
-	if exists {
-		claims := userClaims.(*auth.Claims)
-		if claims.RoleName != "end_user" {
-			c.JSON(http.StatusForbidden, gin.H{"error": "Only end users can access email accounts"})
+	// Users holding accounts.read see their own accounts
+	accounts := []database.EmailAccount{}
+	if middleware.HasPermission(c, "accounts.read") {
+		if err := database.DB.Where("user_id = ?", userID).Find(&accounts).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch accounts"})
 			return
 		}
 	}
 
-	// End users can only see their own accounts
-	var accounts []database.EmailAccount
-	err := database.DB.Where("user_id = ?", userID).Find(&accounts).Error
+	// Everyone sees the accounts other users have shared with them through mailbox grants
+	grants, err := services.SharedAccounts(uuid.MustParse(userID))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch accounts"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch shared accounts"})
 		return
 	}
+	shared := make([]gin.H, 0, len(grants))
+	for _, grant := range grants {
+		if grant.Account == nil {
+			continue
+		}
+		owner := grant.Account.User
+		grant.Account.User = database.User{}
+		shared = append(shared, gin.H{
+			"account":     grant.Account,
+			"grant_id":    grant.ID,
+			"scopes":      services.ParseMailboxScopes(grant.Scopes),
+			"expires_at":  grant.ExpiresAt,
+			"owner_email": owner.Email,
+		})
+	}
+	if len(shared) > 0 {
+		recordAudit(c, database.AuditEvent{
+			Action:     "mailbox.shared.list",
+			TargetType: "user",
+			TargetID:   userID,
+			Detail:     fmt.Sprintf("%d shared accounts", len(shared)),
+		})
+	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"accounts": accounts,
+		"accounts":        accounts,
+		"shared_accounts": shared,
 	})
 }
 
@@ -236,16 +250,6 @@ func (h *AccountHandler) SyncAccount(c *gin.Context) {
 		return
 	}
 
-	// CRITICAL: Only end users can access email operations
-	userClaims, exists := c.Get("user")
-	if exists {
-		claims := userClaims.(*auth.Claims)
-		if claims.RoleName != "end_user" {
-			c.JSON(http.StatusForbidden, gin.H{"error": "Only end users can access email operations"})
-			return
-		}
-	}
-
 	log.Printf("✅ User authenticated: %s", userID)
 
 	accountID := c.Param("id")
@@ -279,6 +283,11 @@ func (h *AccountHandler) SyncAccount(c *gin.Context) {
 		return
 	}
 
+	// Syncs are paused while the organization's storage quota is used up
+	if respondQuotaError(c, services.CheckSyncQuota(account.ID)) {
+		return
+	}
+
 	// Start sync in background
 	go func() {
 		switch account.Provider {
@@ -287,9 +296,14 @@ func (h *AccountHandler) SyncAccount(c *gin.Context) {
 			gmailService.SyncEmailsWithProgress(account.ID)
 		case "exchange":
 			log.Printf("📧 Starting Exchange email sync...")
-			exchangeService := services.NewExchangeService(account.ServerURL, account.Username, account.Password, account.Domain)
+			exchangeService := services.NewExchangeServiceForAccount(&account)
 			exchangeService.SyncEmailsWithProgress(account.ID)
 		case "office365":
+			// Mailboxes of tenant connectors are read with the connector's app credentials
+			if graphService, err := services.NewGraphMailServiceForAccount(&account); err == nil {
+				graphService.SyncEmailsWithProgress(account.ID)
+				return
+			}
 			log.Printf("📧 Office 365 sync temporarily disabled")
 			// TODO: Re-enable when Office365 service is available
 			// office365Service := services.NewOffice365ServiceWithToken("common", "", "", account.Email, account.ID)
@@ -312,6 +326,13 @@ func (h *AccountHandler) SyncAccount(c *gin.Context) {
 		}
 	}()
 
+	recordAudit(c, database.AuditEvent{
+		Action:     "account.sync.start",
+		TargetType: "email_account",
+		TargetID:   account.ID.String(),
+		Detail:     account.Provider,
+	})
+
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Email sync has been initiated",
 		"account_id": accountID,
@@ -326,16 +347,6 @@ func (h *AccountHandler) DeleteAccount(c *gin.Context) {
 		return
 	}
 
-	// CRITICAL: Only end users can delete email accounts
-	userClaims, exists := c.Get("user")
-	if exists {
-		claims := userClaims.(*auth.Claims)
-		if claims.RoleName != "end_user" {
-			c.JSON(http.StatusForbidden, gin.H{"error": "Only end users can delete email accounts"})
-			return
-		}
-	}
-
 	accountID := c.Param("id")
 	if accountID == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Account ID required"})
@@ -350,18 +361,65 @@ func (h *AccountHandler) DeleteAccount(c *gin.Context) {
 		return
 	}
 
-	// Delete associated emails first
-	if err := database.DB.Where("account_id = ?", accountID).Delete(&database.EmailIndex{}).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete emails"})
+	// Accounts holding mail under a legal hold cannot be removed
+	holds, err := services.LoadActiveHolds()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check legal holds"})
+		return
+	}
+	held, err := holds.AccountHeld(account.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check legal holds"})
+		return
+	}
+	if held {
+		c.JSON(http.StatusConflict, gin.H{"error": "Account is under a legal hold and cannot be deleted"})
+		return
+	}
+
+	// Emails in a compliance archive cannot be removed before their lock expires
+	lockedUntil, err := services.AccountLockedUntil(account.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check compliance locks"})
+		return
+	}
+	if lockedUntil != nil {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":        "Account contains archived emails under a compliance lock",
+			"locked_until": lockedUntil,
+		})
 		return
 	}
 
-	// Delete the account
-	if err := database.DB.Delete(&account).Error; err != nil {
+	// Delete sync bookkeeping and email history before the emails they
+	// reference, then the account, all or nothing
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		for _, model := range []interface{}{&database.EmailEvent{}, &database.FolderSyncState{}, &database.SyncFailure{}, &database.RetentionPolicy{}, &database.MailboxGrant{}} {
+			if err := tx.Where("account_id = ?", accountID).Delete(model).Error; err != nil {
+				return fmt.Errorf("failed to delete account sync data: %v", err)
+			}
+		}
+		if err := tx.Where("account_id = ?", accountID).Delete(&database.EmailIndex{}).Error; err != nil {
+			return fmt.Errorf("failed to delete emails: %v", err)
+		}
+		if err := tx.Delete(&account).Error; err != nil {
+			return fmt.Errorf("failed to delete account: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("❌ Failed to delete account %s: %v", account.ID, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete account"})
 		return
 	}
 
+	recordAudit(c, database.AuditEvent{
+		Action:     "account.delete",
+		TargetType: "email_account",
+		TargetID:   account.ID.String(),
+		Detail:     account.Email,
+	})
+
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Account deleted successfully",
 	})
@@ -388,11 +446,16 @@ func (h *AccountHandler) SyncStream(c *gin.Context) {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
 		return
 	}
+	if err := services.CheckSession(claims); err != nil {
+		log.Printf("❌ Session check failed: %v", err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Session is no longer valid, please log in again"})
+		return
+	}
 	
-	// CRITICAL: Only end users can access email operations
-	if claims.RoleName != "end_user" {
-		log.Printf("❌ Non-end-user attempted to access sync stream: %s", claims.RoleName)
-		c.JSON(http.StatusForbidden, gin.H{"error": "Only end users can access email sync operations"})
+	// The stream is outside the protected group, so check the permission here
+	if allowed, err := services.HasPermission(claims, "accounts.read"); err != nil || !allowed {
+		log.Printf("❌ User without accounts.read attempted to access sync stream: %s", claims.RoleName)
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied", "required_permission": "accounts.read"})
 		return
 	}
 	log.Printf("✅ Token validated successfully for user: %s", claims.UserID)
@@ -467,16 +530,6 @@ func (h *AccountHandler) GetSyncProgress(c *gin.Context) {
 		return
 	}
 
-	// CRITICAL: Only end users can access email operations
-	userClaims, exists := c.Get("user")
-	if exists {
-		claims := userClaims.(*auth.Claims)
-		if claims.RoleName != "end_user" {
-			c.JSON(http.StatusForbidden, gin.H{"error": "Only end users can access email operations"})
-			return
-		}
-	}
-
 	accountID := c.Param("id")
 	if accountID == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Account ID required"})
@@ -521,16 +574,6 @@ func (h *AccountHandler) GetSyncHistory(c *gin.Context) {
 		return
 	}
 
-	// CRITICAL: Only end users can access email operations
-	userClaims, exists := c.Get("user")
-	if exists {
-		claims := userClaims.(*auth.Claims)
-		if claims.RoleName != "end_user" {
-			c.JSON(http.StatusForbidden, gin.H{"error": "Only end users can access email operations"})
-			return
-		}
-	}
-
 	accountID := c.Param("id")
 	if accountID == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Account ID required"})
@@ -575,6 +618,120 @@ func (h *AccountHandler) GetSyncHistory(c *gin.Context) {
 	})
 }
 
+// GetSyncFailures returns messages that failed to sync for an account
+// GET /api/accounts/:id/sync-failures
+func (h *AccountHandler) GetSyncFailures(c *gin.Context) {
+	userID := c.GetString("user_id")
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User ID not found"})
+		return
+	}
+
+	accountID := c.Param("id")
+	accountUUID, err := uuid.Parse(accountID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account ID"})
+		return
+	}
+
+	// Verify account ownership
+	var account database.EmailAccount
+	err = database.DB.Where("id = ? AND user_id = ?", accountID, userID).First(&account).Error
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+		return
+	}
+
+	status := c.Query("status")
+	if status != "" && status != "pending" && status != "resolved" && status != "abandoned" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status filter"})
+		return
+	}
+
+	page := 1
+	limit := 50
+	if p, err := strconv.Atoi(c.Query("page")); err == nil && p > 0 {
+		page = p
+	}
+	if l, err := strconv.Atoi(c.Query("limit")); err == nil && l > 0 && l <= 200 {
+		limit = l
+	}
+
+	failures, total, err := services.FailureTracker.GetFailures(accountUUID, status, limit, (page-1)*limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch sync failures"})
+		return
+	}
+
+	summary, err := services.FailureTracker.GetFailureSummary(accountUUID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch sync failure summary"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"failures": failures,
+		"summary":  summary,
+		"pagination": gin.H{
+			"page":  page,
+			"limit": limit,
+			"total": total,
+			"pages": (total + int64(limit) - 1) / int64(limit),
+		},
+	})
+}
+
+// RetrySyncFailures refetches all pending failed messages of an account now
+// POST /api/accounts/:id/sync-failures/retry
+func (h *AccountHandler) RetrySyncFailures(c *gin.Context) {
+	userID := c.GetString("user_id")
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User ID not found"})
+		return
+	}
+
+	accountID := c.Param("id")
+	accountUUID, err := uuid.Parse(accountID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account ID"})
+		return
+	}
+
+	// Verify account ownership
+	var account database.EmailAccount
+	err = database.DB.Where("id = ? AND user_id = ?", accountID, userID).First(&account).Error
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+		return
+	}
+
+	if services.ProgressManager.IsAccountSyncing(accountUUID) {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Account is already syncing",
+			"message": "Please wait for the current sync to complete",
+		})
+		return
+	}
+
+	if respondQuotaError(c, services.CheckSyncQuota(accountUUID)) {
+		return
+	}
+
+	go func() {
+		recovered, err := services.FailureTracker.RetryAccountFailures(accountUUID, false)
+		if err != nil {
+			log.Printf("❌ Manual retry of failed messages for %s failed: %v", accountUUID, err)
+			return
+		}
+		log.Printf("🔁 Manual retry recovered %d messages for %s", recovered, accountUUID)
+	}()
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message":    "Retry of failed messages has been initiated",
+		"account_id": accountID,
+	})
+}
+
 // AddOffice365Account initiates Office 365 OAuth2 flow
 func (h *AccountHandler) AddOffice365Account(c *gin.Context) {
 	userID := c.GetString("user_id")
@@ -596,6 +753,11 @@ func (h *AccountHandler) AddOffice365Account(c *gin.Context) {
 		return
 	}
 
+	quotaWarnings, err := services.CheckAccountQuota(userUUID)
+	if respondQuotaError(c, err) {
+		return
+	}
+
 	account := database.EmailAccount{
 		ID:         uuid.New(),
 		UserID:     userUUID,
@@ -621,11 +783,11 @@ func (h *AccountHandler) AddOffice365Account(c *gin.Context) {
 	// TODO: Re-enable when Office365 service is available
 	authURL := "https://login.microsoftonline.com/oauth2/v2.0/authorize" // Placeholder
 
-	c.JSON(http.StatusCreated, gin.H{
+	c.JSON(http.StatusCreated, withQuotaWarnings(gin.H{
 		"message":    "Office 365 account placeholder created",
 		"account_id": account.ID.String(),
 		"auth_url":   authURL,
-	})
+	}, quotaWarnings))
 }
 
 // AddIMAPAccount adds a general IMAP account (Yahoo, Outlook, Custom)
@@ -662,6 +824,11 @@ func (h *AccountHandler) AddIMAPAccount(c *gin.Context) {
 		return
 	}
 
+	quotaWarnings, err := services.CheckAccountQuota(userUUID)
+	if respondQuotaError(c, err) {
+		return
+	}
+
 	_ = models.ProviderType(req.Provider) // TODO: Use when IMAP service is available
 
 	// For OAuth2 providers, initiate OAuth2 flow
@@ -694,11 +861,11 @@ func (h *AccountHandler) AddIMAPAccount(c *gin.Context) {
 			return
 		}
 
-		c.JSON(http.StatusCreated, gin.H{
+		c.JSON(http.StatusCreated, withQuotaWarnings(gin.H{
 			"message":    "IMAP account placeholder created",
 			"account_id": account.ID.String(),
 			"auth_url":   authURL,
-		})
+		}, quotaWarnings))
 		return
 	}
 
@@ -738,10 +905,10 @@ func (h *AccountHandler) AddIMAPAccount(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusCreated, gin.H{
+	c.JSON(http.StatusCreated, withQuotaWarnings(gin.H{
 		"message": "IMAP account added successfully",
 		"account": account,
-	})
+	}, quotaWarnings))
 }
 
 // OAuth2Callback handles OAuth2 callback for all providers
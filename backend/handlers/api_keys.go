@@ -0,0 +1,363 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"emailprojectv2/auth"
+	"emailprojectv2/database"
+	"emailprojectv2/middleware"
+	"emailprojectv2/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type APIKeyHandler struct {
+	DB *gorm.DB
+}
+
+func NewAPIKeyHandler(db *gorm.DB) *APIKeyHandler {
+	return &APIKeyHandler{DB: db}
+}
+
+type createAPIKeyRequest struct {
+	Name           string     `json:"name" binding:"required"`
+	OrganizationID *string    `json:"organization_id"` // Creates an organization key instead of a personal one
+	Scopes         []string   `json:"scopes" binding:"required,min=1"`
+	AllowedIPs     []string   `json:"allowed_ips"`
+	ExpiresAt      *time.Time `json:"expires_at"`
+}
+
+type apiAccessRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+// canManageOrgKeys checks whether the user may manage an organization's keys:
+// holders of settings.manage who are admins, managers of the organization or
+// members of it
+func (ah *APIKeyHandler) canManageOrgKeys(claims *auth.Claims, orgID uuid.UUID) bool {
+	if allowed, err := services.HasPermission(claims, "settings.manage"); err != nil || !allowed {
+		return false
+	}
+	if managesAllOrganizations(claims) {
+		return true
+	}
+	if claims.OrganizationID == orgID.String() {
+		return true
+	}
+	var org database.Organization
+	if err := ah.DB.First(&org, "id = ?", orgID).Error; err != nil {
+		return false
+	}
+	return org.CanUserManage(ah.DB, uuid.MustParse(claims.UserID))
+}
+
+// canManageKey checks whether the user may see or revoke a key
+func (ah *APIKeyHandler) canManageKey(claims *auth.Claims, key database.APIKey) bool {
+	userID := uuid.MustParse(claims.UserID)
+	if key.CreatedBy == userID || (key.UserID != nil && *key.UserID == userID) {
+		return true
+	}
+	return key.UserID == nil && ah.canManageOrgKeys(claims, key.OrganizationID)
+}
+
+// loadKey loads the key in the path and checks access to it
+func (ah *APIKeyHandler) loadKey(c *gin.Context) (*database.APIKey, bool) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return nil, false
+	}
+	keyID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid API key ID"})
+		return nil, false
+	}
+
+	var key database.APIKey
+	if err := ah.DB.First(&key, "id = ?", keyID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+			return nil, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch API key"})
+		return nil, false
+	}
+	if !ah.canManageKey(userClaims, key) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this API key"})
+		return nil, false
+	}
+	return &key, true
+}
+
+// GetScopes lists the scopes the current user can grant to a key
+// GET /api/api-keys/scopes
+func (ah *APIKeyHandler) GetScopes(c *gin.Context) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	scopes, err := services.EffectivePermissions(userClaims)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load permissions"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"scopes": scopes})
+}
+
+// GetAPIKeys lists the current user's keys, or the organization keys of an
+// organization the user manages
+// GET /api/api-keys?organization_id=
+func (ah *APIKeyHandler) GetAPIKeys(c *gin.Context) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	query := ah.DB.Model(&database.APIKey{})
+	if orgParam := c.Query("organization_id"); orgParam != "" {
+		orgID, err := uuid.Parse(orgParam)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid organization ID"})
+			return
+		}
+		if !ah.canManageOrgKeys(userClaims, orgID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this organization"})
+			return
+		}
+		query = query.Where("organization_id = ? AND user_id IS NULL", orgID)
+	} else {
+		query = query.Where("user_id = ? OR created_by = ?", userClaims.UserID, userClaims.UserID)
+	}
+	if c.Query("include_revoked") != "true" {
+		query = query.Where("revoked_at IS NULL")
+	}
+
+	var keys []database.APIKey
+	if err := query.Order("created_at DESC").Find(&keys).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch API keys"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"api_keys": keys})
+}
+
+// CreateAPIKey creates a personal key, or an organization key when an
+// organization is given. The key is returned only in this response.
+// POST /api/api-keys
+func (ah *APIKeyHandler) CreateAPIKey(c *gin.Context) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var req createAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data", "details": err.Error()})
+		return
+	}
+
+	// Keys cannot hold more than the user they act as
+	held, err := services.EffectivePermissions(userClaims)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load permissions"})
+		return
+	}
+	granted := map[string]bool{}
+	for _, p := range held {
+		granted[p] = true
+	}
+	scopes := []string{}
+	seen := map[string]bool{}
+	for _, scope := range req.Scopes {
+		if !granted[scope] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Scope not available to your role: " + scope})
+			return
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+	if err := services.ValidateAllowedIPs(req.AllowedIPs); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at must be in the future"})
+		return
+	}
+
+	userID := uuid.MustParse(userClaims.UserID)
+	key := database.APIKey{
+		Name:      req.Name,
+		CreatedBy: userID,
+		ExpiresAt: req.ExpiresAt,
+	}
+	if req.OrganizationID != nil {
+		orgID, err := uuid.Parse(*req.OrganizationID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid organization ID"})
+			return
+		}
+		if !ah.canManageOrgKeys(userClaims, orgID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this organization"})
+			return
+		}
+		key.OrganizationID = orgID
+	} else {
+		orgID, err := uuid.Parse(userClaims.OrganizationID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Personal API keys require an organization assignment"})
+			return
+		}
+		key.OrganizationID = orgID
+		key.UserID = &userID
+	}
+
+	enabled, err := services.APIAccessEnabled(key.OrganizationID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check organization features"})
+		return
+	}
+	if !enabled {
+		c.JSON(http.StatusForbidden, gin.H{"error": services.ErrAPIAccessDisabled.Error()})
+		return
+	}
+
+	encodedScopes, _ := json.Marshal(scopes)
+	if req.AllowedIPs == nil {
+		req.AllowedIPs = []string{}
+	}
+	encodedIPs, _ := json.Marshal(req.AllowedIPs)
+	key.Scopes = string(encodedScopes)
+	key.AllowedIPs = string(encodedIPs)
+
+	raw, err := services.CreateAPIKey(&key)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		return
+	}
+
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: &key.OrganizationID,
+		Action:         "api_key.create",
+		TargetType:     "api_key",
+		TargetID:       key.ID.String(),
+		Detail:         string(encodedScopes),
+	})
+
+	c.JSON(http.StatusCreated, gin.H{
+		"api_key": key,
+		"key":     raw,
+		"message": "Store this key now; it cannot be shown again",
+	})
+}
+
+// RevokeAPIKey revokes a key
+// DELETE /api/api-keys/:id
+func (ah *APIKeyHandler) RevokeAPIKey(c *gin.Context) {
+	key, ok := ah.loadKey(c)
+	if !ok {
+		return
+	}
+
+	if err := services.RevokeAPIKey(key.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke API key"})
+		return
+	}
+
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: &key.OrganizationID,
+		Action:         "api_key.revoke",
+		TargetType:     "api_key",
+		TargetID:       key.ID.String(),
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "API key revoked"})
+}
+
+// GetAPIKeyUsage returns a key's daily request counts, newest first
+// GET /api/api-keys/:id/usage
+func (ah *APIKeyHandler) GetAPIKeyUsage(c *gin.Context) {
+	key, ok := ah.loadKey(c)
+	if !ok {
+		return
+	}
+
+	var usage []database.APIKeyUsage
+	if err := ah.DB.Where("api_key_id = ?", key.ID).Order("day DESC").Limit(90).Find(&usage).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch API key usage"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"api_key": key, "usage": usage})
+}
+
+// SetAPIAccess turns the api_access feature of an organization on or off. It
+// is part of the organization's plan, so it is set by admins or by managers
+// of the organization's parent.
+// PUT /api/organizations/:id/api-access
+func (ah *APIKeyHandler) SetAPIAccess(c *gin.Context) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+	orgID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid organization ID"})
+		return
+	}
+
+	var req apiAccessRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data", "details": err.Error()})
+		return
+	}
+
+	var org database.Organization
+	if err := ah.DB.First(&org, "id = ?", orgID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Organization not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch organization"})
+		return
+	}
+	if !managesAllOrganizations(userClaims) {
+		var parent database.Organization
+		if org.ParentOrgID == nil || ah.DB.First(&parent, "id = ?", *org.ParentOrgID).Error != nil ||
+			!parent.CanUserManage(ah.DB, uuid.MustParse(userClaims.UserID)) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only admins or managers of the parent organization can change API access"})
+			return
+		}
+	}
+
+	if err := services.SetAPIAccess(orgID, req.Enabled); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update API access"})
+		return
+	}
+
+	detail := "disabled"
+	if req.Enabled {
+		detail = "enabled"
+	}
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: &orgID,
+		Action:         "organization.api_access",
+		TargetType:     "organization",
+		TargetID:       orgID.String(),
+		Detail:         detail,
+	})
+
+	c.JSON(http.StatusOK, gin.H{"organization_id": orgID, "api_access": req.Enabled})
+}
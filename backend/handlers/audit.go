@@ -0,0 +1,252 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"emailprojectv2/auth"
+	"emailprojectv2/database"
+	"emailprojectv2/middleware"
+	"emailprojectv2/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// recordAudit writes an audit event on behalf of the user making the request,
+// filling in the actor and client details from the request
+func recordAudit(c *gin.Context, event database.AuditEvent) {
+	middleware.RecordAudit(c, event)
+}
+
+type AuditHandler struct {
+	DB *gorm.DB
+}
+
+func NewAuditHandler(db *gorm.DB) *AuditHandler {
+	return &AuditHandler{DB: db}
+}
+
+// maxAuditExport caps the number of events in a single export
+const maxAuditExport = 100000
+
+// parseAuditTime accepts RFC 3339 timestamps and plain dates
+func parseAuditTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+// scopeQuery limits the audit log to what the user may see: admins see
+// everything, organization managers their organization subtree and everyone
+// else only their own actions
+func (ah *AuditHandler) scopeQuery(c *gin.Context, claims *auth.Claims, query *gorm.DB) (*gorm.DB, bool) {
+	orgParam := c.Query("organization_id")
+	var orgID uuid.UUID
+	if orgParam != "" {
+		id, err := uuid.Parse(orgParam)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid organization ID"})
+			return nil, false
+		}
+		orgID = id
+	}
+
+	if managesAllOrganizations(claims) {
+		if orgParam == "" {
+			return query, true
+		}
+		orgIDs, err := services.OrganizationSubtree(orgID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load organizations"})
+			return nil, false
+		}
+		return query.Where("organization_id IN ?", orgIDs), true
+	}
+
+	ownOrgID, err := uuid.Parse(claims.OrganizationID)
+	if !middleware.HasPermission(c, "audit.read") || err != nil {
+		if orgParam != "" {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this organization"})
+			return nil, false
+		}
+		return query.Where("actor_id = ?", claims.UserID), true
+	}
+
+	if orgParam == "" {
+		orgID = ownOrgID
+	} else {
+		within, err := services.OrganizationWithin(orgID, ownOrgID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check organization"})
+			return nil, false
+		}
+		if !within {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this organization"})
+			return nil, false
+		}
+	}
+
+	orgIDs, err := services.OrganizationSubtree(orgID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load organizations"})
+		return nil, false
+	}
+	return query.Where("organization_id IN ?", orgIDs), true
+}
+
+// filterQuery applies the query string filters
+func filterQuery(c *gin.Context, query *gorm.DB) (*gorm.DB, bool) {
+	if actorID := c.Query("actor_id"); actorID != "" {
+		if _, err := uuid.Parse(actorID); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid actor ID"})
+			return nil, false
+		}
+		query = query.Where("actor_id = ?", actorID)
+	}
+	// Matched by prefix, so "ediscovery." or "DELETE " selects a group of actions
+	if action := c.Query("action"); action != "" {
+		query = query.Where("action LIKE ?", action+"%")
+	}
+	for _, field := range []string{"target_type", "target_id", "result"} {
+		if value := c.Query(field); value != "" {
+			query = query.Where(field+" = ?", value)
+		}
+	}
+	for param, cond := range map[string]string{"from": "created_at >= ?", "to": "created_at <= ?"} {
+		if value := c.Query(param); value != "" {
+			t, err := parseAuditTime(value)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid %s time", param)})
+				return nil, false
+			}
+			query = query.Where(cond, t)
+		}
+	}
+	return query, true
+}
+
+// GetAuditEvents lists audit events, newest first, or exports them as CSV or JSON
+// GET /api/audit?organization_id=&actor_id=&action=&target_type=&target_id=&result=&from=&to=&page=1&limit=100&format=csv|json
+func (ah *AuditHandler) GetAuditEvents(c *gin.Context) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	query, ok := ah.scopeQuery(c, userClaims, ah.DB.Model(&database.AuditEvent{}))
+	if !ok {
+		return
+	}
+	if query, ok = filterQuery(c, query); !ok {
+		return
+	}
+
+	switch format := c.Query("format"); format {
+	case "":
+	case "csv", "json":
+		ah.exportEvents(c, query, format)
+		return
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be csv or json"})
+		return
+	}
+
+	page, limit := pageParams(c)
+
+	var total int64
+	query.Count(&total)
+
+	var events []database.AuditEvent
+	if err := query.Order("created_at DESC").Offset((page - 1) * limit).Limit(limit).Find(&events).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch audit events"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"events": events,
+		"pagination": gin.H{
+			"page":  page,
+			"limit": limit,
+			"total": total,
+		},
+	})
+}
+
+// exportEvents streams the matching events as a download
+func (ah *AuditHandler) exportEvents(c *gin.Context, query *gorm.DB, format string) {
+	recordAudit(c, database.AuditEvent{
+		Action:     "audit.export",
+		TargetType: "audit_log",
+		Detail:     c.Request.URL.RawQuery,
+	})
+
+	filename := fmt.Sprintf("audit-%s.%s", time.Now().UTC().Format("20060102-150405"), format)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+
+	rows, err := query.Order("created_at DESC").Limit(maxAuditExport).Rows()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch audit events"})
+		return
+	}
+	defer rows.Close()
+
+	if format == "csv" {
+		c.Header("Content-Type", "text/csv")
+		w := csv.NewWriter(c.Writer)
+		w.Write([]string{"id", "created_at", "actor_id", "actor_role", "organization_id", "action", "target_type", "target_id", "result", "ip_address", "user_agent", "detail"})
+		for rows.Next() {
+			var e database.AuditEvent
+			if err := ah.DB.ScanRows(rows, &e); err != nil {
+				break
+			}
+			w.Write([]string{
+				e.ID.String(),
+				e.CreatedAt.UTC().Format(time.RFC3339),
+				optionalID(e.ActorID),
+				e.ActorRole,
+				optionalID(e.OrganizationID),
+				e.Action,
+				e.TargetType,
+				e.TargetID,
+				e.Result,
+				e.IPAddress,
+				e.UserAgent,
+				e.Detail,
+			})
+		}
+		w.Flush()
+		return
+	}
+
+	c.Header("Content-Type", "application/json")
+	c.Writer.WriteString("[")
+	for first := true; rows.Next(); first = false {
+		var e database.AuditEvent
+		if err := ah.DB.ScanRows(rows, &e); err != nil {
+			break
+		}
+		data, err := json.Marshal(e)
+		if err != nil {
+			break
+		}
+		if !first {
+			c.Writer.WriteString(",")
+		}
+		c.Writer.Write(data)
+	}
+	c.Writer.WriteString("]")
+}
+
+func optionalID(id *uuid.UUID) string {
+	if id == nil {
+		return ""
+	}
+	return id.String()
+}
@@ -1,13 +1,20 @@
 package handlers
 
 import (
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
+	"time"
 
 	"emailprojectv2/auth"
 	"emailprojectv2/database"
+	"emailprojectv2/middleware"
+	"emailprojectv2/services"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"gorm.io/gorm"
 )
 
 type AuthHandler struct {
@@ -16,7 +23,7 @@ type AuthHandler struct {
 
 type RegisterRequest struct {
 	Email    string `json:"email" binding:"required,email"`
-	Password string `json:"password" binding:"required,min=6"`
+	Password string `json:"password" binding:"required"`
 }
 
 type LoginRequest struct {
@@ -24,9 +31,15 @@ type LoginRequest struct {
 	Password string `json:"password" binding:"required"`
 }
 
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
 type AuthResponse struct {
-	Token string              `json:"token"`
-	User  database.User       `json:"user"`
+	Token        string              `json:"token"`
+	RefreshToken string              `json:"refresh_token"`
+	ExpiresIn    int                 `json:"expires_in"` // Seconds until the access token expires
+	User         database.User       `json:"user"`
 }
 
 func NewAuthHandler(jwtSecret string) *AuthHandler {
@@ -49,6 +62,11 @@ func (h *AuthHandler) Register(c *gin.Context) {
 		return
 	}
 
+	// Registered users have no organization yet, so the system policy applies
+	if respondPasswordPolicyError(c, services.CheckNewPassword(nil, nil, req.Email, req.Password)) {
+		return
+	}
+
 	// Hash password
 	hashedPassword, err := auth.HashPassword(req.Password)
 	if err != nil {
@@ -72,29 +90,26 @@ func (h *AuthHandler) Register(c *gin.Context) {
 		// PrimaryOrgID will be nil - user needs to be assigned to organization by admin
 	}
 
-	if err := database.DB.Create(&user).Error; err != nil {
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+		return services.RecordPasswordHistory(tx, user.ID, hashedPassword)
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
 		return
 	}
 
-	// Generate token with default values
-	token, err := auth.GenerateTokenWithRole(
-		user.ID.String(),
-		user.Email,
-		"end_user",
-		5,
-		"", // No organization
-		"client",
-		h.JWTSecret,
-	)
+	// Load role for response
+	database.DB.Preload("Role").First(&user, user.ID)
+
+	tokens, err := h.startSession(c, &user)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
 	}
 
-	// Load role for response
-	database.DB.Preload("Role").First(&user, user.ID)
-
 	userResponse := map[string]interface{}{
 		"id":         user.ID,
 		"email":      user.Email,
@@ -103,10 +118,8 @@ func (h *AuthHandler) Register(c *gin.Context) {
 		"created_at": user.CreatedAt,
 	}
 
-	c.JSON(http.StatusCreated, gin.H{
-		"token": token,
-		"user":  userResponse,
-	})
+	tokens["user"] = userResponse
+	c.JSON(http.StatusCreated, tokens)
 }
 
 func (h *AuthHandler) Login(c *gin.Context) {
@@ -116,49 +129,128 @@ func (h *AuthHandler) Login(c *gin.Context) {
 		return
 	}
 
+	// Addresses with too many recent failures are refused before any lookup
+	if respondLoginBlocked(c, services.CheckIPAllowed(c.ClientIP())) {
+		return
+	}
+
 	// Find user with role and organization information
 	var user database.User
 	if err := database.DB.Preload("Role").Preload("PrimaryOrg").Where("email = ?", req.Email).First(&user).Error; err != nil {
+		services.RecordIPFailure(c.ClientIP())
+		recordAudit(c, database.AuditEvent{
+			Action:     "auth.login",
+			TargetType: "user",
+			Result:     services.AuditResultFailure,
+			Detail:     "unknown email " + req.Email,
+		})
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
 		return
 	}
 
-	// Check password
-	if !auth.CheckPassword(req.Password, user.PasswordHash) {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+	// Locked accounts are refused without checking the password
+	if err := services.CheckLoginAllowed(c.ClientIP(), &user); err != nil {
+		recordAudit(c, database.AuditEvent{
+			ActorID:        &user.ID,
+			OrganizationID: user.PrimaryOrgID,
+			Action:         "auth.login",
+			TargetType:     "user",
+			TargetID:       user.ID.String(),
+			Result:         services.AuditResultDenied,
+			Detail:         err.Error(),
+		})
+		respondLoginBlocked(c, err)
 		return
 	}
 
-	// Prepare token data - use defaults for users without organization assignment
-	var roleName string = "end_user"
-	var roleLevel int = 5
-	var organizationID string = ""
-	var orgType string = "client"
+	// Check password; users synced from a directory with login enabled use their directory password
+	passwordValid := false
+	switch err := services.CheckDirectoryPassword(&user, req.Password); {
+	case err == nil:
+		passwordValid = true
+	case errors.Is(err, services.ErrNotDirectoryUser):
+		passwordValid = auth.CheckPassword(req.Password, user.PasswordHash)
+	case errors.Is(err, services.ErrDirectoryCredentials):
+		// Wrong directory password; reported like a wrong local one
+	default:
+		log.Printf("❌ Directory login of %s failed: %v", user.Email, err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Directory server is unavailable"})
+		return
+	}
+	if !passwordValid {
+		detail := "invalid password"
+		lockedUntil, err := services.RecordLoginFailure(c.ClientIP(), &user)
+		if err != nil {
+			log.Printf("❌ %v", err)
+		}
+		if lockedUntil != nil {
+			detail = fmt.Sprintf("invalid password, account locked until %s", lockedUntil.Format(time.RFC3339))
+		}
+		recordAudit(c, database.AuditEvent{
+			ActorID:        &user.ID,
+			OrganizationID: user.PrimaryOrgID,
+			Action:         "auth.login",
+			TargetType:     "user",
+			TargetID:       user.ID.String(),
+			Result:         services.AuditResultFailure,
+			Detail:         detail,
+		})
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+		return
+	}
+	if user.DisabledAt != nil {
+		recordAudit(c, database.AuditEvent{
+			ActorID:        &user.ID,
+			OrganizationID: user.PrimaryOrgID,
+			Action:         "auth.login",
+			TargetType:     "user",
+			TargetID:       user.ID.String(),
+			Result:         services.AuditResultFailure,
+			Detail:         "account disabled",
+		})
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account is disabled"})
+		return
+	}
 
-	if user.Role != nil {
-		roleName = user.Role.Name
-		roleLevel = user.Role.Level
+	// Organizations can require their users to sign in through their identity provider
+	ssoOnly, err := services.PasswordLoginDisabled(&user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check single sign-on"})
+		return
+	}
+	if ssoOnly {
+		recordAudit(c, database.AuditEvent{
+			ActorID:        &user.ID,
+			OrganizationID: user.PrimaryOrgID,
+			Action:         "auth.login",
+			TargetType:     "user",
+			TargetID:       user.ID.String(),
+			Result:         services.AuditResultFailure,
+			Detail:         "password login disabled by SSO",
+		})
+		c.JSON(http.StatusForbidden, gin.H{
+			"error":     services.ErrSSOPasswordLogin.Error(),
+			"login_url": ssoLoginPath(*user.PrimaryOrgID),
+		})
+		return
 	}
 
-	if user.PrimaryOrg != nil {
-		organizationID = user.PrimaryOrg.ID.String()
-		orgType = user.PrimaryOrg.Type
+	// Users with MFA, or whose organization requires it, answer a challenge first
+	if h.mfaLoginChallenge(c, &user) {
+		return
+	}
+	// Failed logins are only cleared once every factor is verified
+	if err := services.RecordLoginSuccess(&user); err != nil {
+		log.Printf("⚠️ %v", err)
 	}
 
-	// Generate token with organization information
-	token, err := auth.GenerateTokenWithRole(
-		user.ID.String(),
-		user.Email,
-		roleName,
-		roleLevel,
-		organizationID,
-		orgType,
-		h.JWTSecret,
-	)
+	// Open a session; the access token carries its ID
+	tokens, err := h.startSession(c, &user)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
 	}
+	roleName, _, _, _ := tokenIdentity(&user)
 
 	// Prepare user response
 	userResponse := map[string]interface{}{
@@ -169,8 +261,192 @@ func (h *AuthHandler) Login(c *gin.Context) {
 		"created_at": user.CreatedAt,
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"token": token,
-		"user":  userResponse,
+	recordAudit(c, database.AuditEvent{
+		ActorID:        &user.ID,
+		ActorRole:      roleName,
+		OrganizationID: user.PrimaryOrgID,
+		Action:         "auth.login",
+		TargetType:     "user",
+		TargetID:       user.ID.String(),
 	})
-}
\ No newline at end of file
+
+	tokens["user"] = userResponse
+	c.JSON(http.StatusOK, tokens)
+}
+
+// tokenIdentity returns the role and organization an access token carries for
+// a user, with defaults for users without an assignment
+func tokenIdentity(user *database.User) (roleName string, roleLevel int, organizationID string, orgType string) {
+	roleName, roleLevel, orgType = "end_user", 5, "client"
+	if user.Role != nil {
+		roleName = user.Role.Name
+		roleLevel = user.Role.Level
+	}
+	if user.PrimaryOrg != nil {
+		organizationID = user.PrimaryOrg.ID.String()
+		orgType = user.PrimaryOrg.Type
+	}
+	return
+}
+
+// accessToken signs an access token for a user's session
+func (h *AuthHandler) accessToken(user *database.User, sessionID uuid.UUID) (string, error) {
+	roleName, roleLevel, organizationID, orgType := tokenIdentity(user)
+	// Sessions that switched organization carry the role of that membership
+	membership, err := services.ActiveMembership(sessionID, user.ID)
+	if err != nil {
+		return "", err
+	}
+	if membership != nil {
+		roleName, roleLevel = membership.Role.Name, membership.Role.Level
+		organizationID, orgType = membership.OrganizationID.String(), membership.Organization.Type
+	}
+	claims := auth.Claims{
+		UserID:         user.ID.String(),
+		Email:          user.Email,
+		RoleName:       roleName,
+		RoleLevel:      roleLevel,
+		OrganizationID: organizationID,
+		OrgType:        orgType,
+		SessionID:      sessionID.String(),
+	}
+	if user.CustomRoleID != nil {
+		claims.CustomRoleID = user.CustomRoleID.String()
+	}
+	return auth.GenerateAccessToken(claims, h.JWTSecret)
+}
+
+// sessionTokens signs an access token for a user's session and returns the
+// token fields of an auth response
+func (h *AuthHandler) sessionTokens(user *database.User, sessionID uuid.UUID, refreshToken string) (gin.H, error) {
+	token, err := h.accessToken(user, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return gin.H{
+		"token":         token,
+		"refresh_token": refreshToken,
+		"expires_in":    int(auth.AccessTokenTTL.Seconds()),
+	}, nil
+}
+
+// startSession opens a session for a user logging in from this request
+func (h *AuthHandler) startSession(c *gin.Context, user *database.User) (gin.H, error) {
+	session, refreshToken, err := services.CreateSession(user.ID, c.ClientIP(), c.Request.UserAgent())
+	if err != nil {
+		return nil, err
+	}
+	return h.sessionTokens(user, session.ID, refreshToken)
+}
+
+// Refresh exchanges a refresh token for a new access token and refresh token.
+// The access token reflects the user's current role and organization.
+// POST /auth/refresh
+func (h *AuthHandler) Refresh(c *gin.Context) {
+	var req RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	session, refreshToken, err := services.RotateRefreshToken(req.RefreshToken)
+	if err != nil {
+		var reused *services.RefreshReuseError
+		if errors.As(err, &reused) {
+			recordAudit(c, database.AuditEvent{
+				ActorID:    &reused.UserID,
+				Action:     "auth.refresh",
+				TargetType: "session",
+				TargetID:   reused.SessionID.String(),
+				Result:     services.AuditResultDenied,
+				Detail:     "refresh token reused, session revoked",
+			})
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh token has already been used; please log in again"})
+			return
+		}
+		if errors.Is(err, services.ErrRefreshTokenInvalid) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired refresh token"})
+			return
+		}
+		log.Printf("❌ Failed to refresh session: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refresh session"})
+		return
+	}
+
+	var user database.User
+	if err := database.DB.Preload("Role").Preload("PrimaryOrg").First(&user, session.UserID).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		return
+	}
+
+	tokens, err := h.sessionTokens(&user, session.ID, refreshToken)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	roleName, _, _, _ := tokenIdentity(&user)
+	recordAudit(c, database.AuditEvent{
+		ActorID:        &user.ID,
+		ActorRole:      roleName,
+		OrganizationID: user.PrimaryOrgID,
+		Action:         "auth.refresh",
+		TargetType:     "session",
+		TargetID:       session.ID.String(),
+	})
+
+	c.JSON(http.StatusOK, tokens)
+}
+
+// Logout revokes the session of the access token
+// POST /auth/logout
+func (h *AuthHandler) Logout(c *gin.Context) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	sessionID, err := uuid.Parse(userClaims.SessionID)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Token has no session"})
+		return
+	}
+	if err := services.RevokeSession(sessionID, services.SessionRevokedLogout); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+		return
+	}
+
+	recordAudit(c, database.AuditEvent{
+		Action:     "auth.logout",
+		TargetType: "session",
+		TargetID:   sessionID.String(),
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+}
+
+// LogoutAll revokes every session of the current user, including this one
+// POST /auth/logout-all
+func (h *AuthHandler) LogoutAll(c *gin.Context) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	revoked, err := services.RevokeUserSessions(uuid.MustParse(userClaims.UserID), services.SessionRevokedLogoutAll)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out sessions"})
+		return
+	}
+
+	recordAudit(c, database.AuditEvent{
+		Action:     "auth.logout_all",
+		TargetType: "user",
+		TargetID:   userClaims.UserID,
+		Detail:     fmt.Sprintf("%d sessions revoked", revoked),
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "All sessions logged out", "revoked": revoked})
+}
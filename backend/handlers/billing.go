@@ -0,0 +1,482 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"emailprojectv2/auth"
+	"emailprojectv2/database"
+	"emailprojectv2/middleware"
+	"emailprojectv2/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type BillingHandler struct {
+	DB *gorm.DB
+}
+
+func NewBillingHandler(db *gorm.DB) *BillingHandler {
+	return &BillingHandler{DB: db}
+}
+
+type pricePlanRequest struct {
+	Name               string     `json:"name" binding:"required"`
+	OrgType            string     `json:"org_type" binding:"required,oneof=distributor dealer client"`
+	OrganizationID     *uuid.UUID `json:"organization_id"`
+	Currency           string     `json:"currency"`
+	BaseFeeCents       int64      `json:"base_fee_cents" binding:"min=0"`
+	PerUserCents       int64      `json:"per_user_cents" binding:"min=0"`
+	PerMailboxCents    int64      `json:"per_mailbox_cents" binding:"min=0"`
+	PerGBStoredCents   int64      `json:"per_gb_stored_cents" binding:"min=0"`
+	PerGBIngestedCents int64      `json:"per_gb_ingested_cents" binding:"min=0"`
+	IsActive           *bool      `json:"is_active"`
+}
+
+// billingScope resolves the organizations a billing request covers: the
+// subtree of organization_id, defaulting to the user's own organization.
+// Admins see every organization when no organization is given. Billing is
+// open to the channel down to client organizations, each within its subtree.
+func (bh *BillingHandler) billingScope(c *gin.Context) (*auth.Claims, []uuid.UUID, bool) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return nil, nil, false
+	}
+
+	orgParam := c.Query("organization_id")
+	var orgID uuid.UUID
+	if orgParam != "" {
+		if orgID, err = uuid.Parse(orgParam); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid organization ID"})
+			return nil, nil, false
+		}
+	}
+
+	if managesAllOrganizations(userClaims) {
+		if orgParam == "" {
+			var all []uuid.UUID
+			if err := bh.DB.Model(&database.Organization{}).Pluck("id", &all).Error; err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load organizations"})
+				return nil, nil, false
+			}
+			return userClaims, all, true
+		}
+	} else {
+		ownOrgID, err := uuid.Parse(userClaims.OrganizationID)
+		if err != nil {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions to view billing"})
+			return nil, nil, false
+		}
+		if orgParam == "" {
+			orgID = ownOrgID
+		} else {
+			within, err := services.OrganizationWithin(orgID, ownOrgID)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check organization"})
+				return nil, nil, false
+			}
+			if !within {
+				c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this organization"})
+				return nil, nil, false
+			}
+		}
+	}
+
+	orgIDs, err := services.OrganizationSubtree(orgID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load organizations"})
+		return nil, nil, false
+	}
+	return userClaims, orgIDs, true
+}
+
+// exportFormat reads the format parameter: "" for a regular response, csv or json for a download
+func exportFormat(c *gin.Context) (string, bool) {
+	switch format := c.Query("format"); format {
+	case "", "csv", "json":
+		return format, true
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": "format must be csv or json"})
+	return "", false
+}
+
+// writeExport sends rows as a CSV or JSON download
+func writeExport(c *gin.Context, filename, format string, header []string, rows [][]string, records interface{}) {
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s.%s", filename, format))
+	if format == "json" {
+		data, err := json.Marshal(records)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode export"})
+			return
+		}
+		c.Data(http.StatusOK, "application/json", data)
+		return
+	}
+
+	c.Header("Content-Type", "text/csv")
+	c.Status(http.StatusOK)
+	w := csv.NewWriter(c.Writer)
+	w.Write(header)
+	w.WriteAll(rows)
+}
+
+// usageRecord is a usage snapshot with the organization it belongs to
+type usageRecord struct {
+	database.UsageSnapshot
+	OrganizationName string     `json:"organization_name"`
+	OrgType          string     `json:"org_type"`
+	ParentOrgID      *uuid.UUID `json:"parent_org_id,omitempty"`
+}
+
+// GetUsage lists daily usage snapshots of an organization subtree, or exports them as CSV or JSON
+// GET /api/billing/usage?organization_id=&from=2025-01-01&to=2025-01-31&format=csv|json
+func (bh *BillingHandler) GetUsage(c *gin.Context) {
+	_, orgIDs, ok := bh.billingScope(c)
+	if !ok {
+		return
+	}
+	format, ok := exportFormat(c)
+	if !ok {
+		return
+	}
+
+	query := bh.DB.Where("organization_id IN ?", orgIDs)
+	for param, cond := range map[string]string{"from": "day >= ?", "to": "day <= ?"} {
+		if value := c.Query(param); value != "" {
+			day, err := time.Parse("2006-01-02", value)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid %s date, expected YYYY-MM-DD", param)})
+				return
+			}
+			query = query.Where(cond, day)
+		}
+	}
+	if c.Query("from") == "" && c.Query("to") == "" {
+		query = query.Where("day >= ?", time.Now().UTC().AddDate(0, 0, -31))
+	}
+
+	var snapshots []database.UsageSnapshot
+	if err := query.Order("day ASC").Find(&snapshots).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch usage snapshots"})
+		return
+	}
+
+	var orgs []database.Organization
+	if err := bh.DB.Select("id", "name", "type", "parent_org_id").Where("id IN ?", orgIDs).Find(&orgs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load organizations"})
+		return
+	}
+	orgByID := make(map[uuid.UUID]database.Organization, len(orgs))
+	for _, org := range orgs {
+		orgByID[org.ID] = org
+	}
+
+	records := make([]usageRecord, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		org := orgByID[snapshot.OrganizationID]
+		records = append(records, usageRecord{
+			UsageSnapshot:    snapshot,
+			OrganizationName: org.Name,
+			OrgType:          org.Type,
+			ParentOrgID:      org.ParentOrgID,
+		})
+	}
+
+	if format == "" {
+		c.JSON(http.StatusOK, gin.H{"usage": records, "total": len(records)})
+		return
+	}
+
+	recordAudit(c, database.AuditEvent{
+		Action:     "billing.usage.export",
+		TargetType: "billing",
+		Detail:     c.Request.URL.RawQuery,
+	})
+
+	rows := make([][]string, 0, len(records))
+	for _, r := range records {
+		rows = append(rows, []string{
+			r.Day.Format("2006-01-02"),
+			r.OrganizationID.String(),
+			r.OrganizationName,
+			r.OrgType,
+			optionalID(r.ParentOrgID),
+			strconv.FormatInt(r.Users, 10),
+			strconv.FormatInt(r.ActiveMailboxes, 10),
+			strconv.FormatInt(r.StoredBytes, 10),
+			strconv.FormatInt(r.IngestedBytes, 10),
+			strconv.FormatInt(r.TotalUsers, 10),
+			strconv.FormatInt(r.TotalActiveMailboxes, 10),
+			strconv.FormatInt(r.TotalStoredBytes, 10),
+			strconv.FormatInt(r.TotalIngestedBytes, 10),
+			strconv.FormatBool(r.Final),
+		})
+	}
+	writeExport(c, "usage-"+time.Now().UTC().Format("20060102-150405"), format,
+		[]string{"day", "organization_id", "organization_name", "org_type", "parent_org_id", "users", "active_mailboxes", "stored_bytes", "ingested_bytes", "total_users", "total_active_mailboxes", "total_stored_bytes", "total_ingested_bytes", "final"},
+		rows, records)
+}
+
+// GetBillingPeriod rates a month of usage for every organization in the subtree
+// with its price plan, or exports the lines for invoicing as CSV or JSON
+// GET /api/billing/periods/:period?organization_id=&format=csv|json
+func (bh *BillingHandler) GetBillingPeriod(c *gin.Context) {
+	_, orgIDs, ok := bh.billingScope(c)
+	if !ok {
+		return
+	}
+	format, ok := exportFormat(c)
+	if !ok {
+		return
+	}
+
+	period := c.Param("period")
+	if _, _, err := services.ParseBillingPeriod(period); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	lines, err := services.ComputeBillingPeriod(orgIDs, period)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute billing period"})
+		return
+	}
+
+	if format == "" {
+		totals := map[string]int64{}
+		for _, line := range lines {
+			if line.Currency != "" {
+				totals[line.Currency] += line.TotalCents
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"period":       period,
+			"lines":        lines,
+			"total_cents":  totals,
+			"generated_at": time.Now().UTC(),
+		})
+		return
+	}
+
+	recordAudit(c, database.AuditEvent{
+		Action:     "billing.period.export",
+		TargetType: "billing",
+		TargetID:   period,
+		Detail:     c.Request.URL.RawQuery,
+	})
+
+	rows := make([][]string, 0, len(lines))
+	for _, l := range lines {
+		rows = append(rows, []string{
+			l.Period,
+			l.OrganizationID.String(),
+			l.OrganizationName,
+			l.OrgType,
+			optionalID(l.ParentOrgID),
+			strconv.Itoa(l.DaysMetered),
+			strconv.FormatInt(l.PeakUsers, 10),
+			strconv.FormatInt(l.PeakMailboxes, 10),
+			strconv.FormatInt(l.AvgStoredBytes, 10),
+			strconv.FormatInt(l.IngestedBytes, 10),
+			optionalID(l.PlanID),
+			l.PlanName,
+			l.Currency,
+			strconv.FormatInt(l.BaseFeeCents, 10),
+			strconv.FormatInt(l.UsersCents, 10),
+			strconv.FormatInt(l.MailboxesCents, 10),
+			strconv.FormatInt(l.StorageCents, 10),
+			strconv.FormatInt(l.IngestCents, 10),
+			strconv.FormatInt(l.TotalCents, 10),
+		})
+	}
+	writeExport(c, "billing-"+period, format,
+		[]string{"period", "organization_id", "organization_name", "org_type", "parent_org_id", "days_metered", "peak_users", "peak_mailboxes", "avg_stored_bytes", "ingested_bytes", "plan_id", "plan_name", "currency", "base_fee_cents", "users_cents", "mailboxes_cents", "storage_cents", "ingest_cents", "total_cents"},
+		rows, lines)
+}
+
+// GetPricePlans lists the price plans
+// GET /api/billing/plans
+func (bh *BillingHandler) GetPricePlans(c *gin.Context) {
+	if _, err := middleware.GetUserFromContext(c); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var plans []database.PricePlan
+	if err := bh.DB.Order("org_type ASC, created_at DESC").Find(&plans).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch price plans"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"plans": plans})
+}
+
+// applyPlanRequest validates a plan request and copies it onto the plan
+func (bh *BillingHandler) applyPlanRequest(c *gin.Context, plan *database.PricePlan, req *pricePlanRequest) bool {
+	if req.OrganizationID != nil {
+		var org database.Organization
+		if err := bh.DB.First(&org, "id = ?", *req.OrganizationID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Organization not found"})
+			return false
+		}
+		if org.Type != req.OrgType {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Organization is a %s, not a %s", org.Type, req.OrgType)})
+			return false
+		}
+	}
+
+	currency := strings.ToUpper(req.Currency)
+	if currency == "" {
+		currency = services.BillingSettings.Currency
+	}
+	if len(currency) != 3 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "currency must be a 3-letter ISO code"})
+		return false
+	}
+
+	plan.Name = req.Name
+	plan.OrgType = req.OrgType
+	plan.OrganizationID = req.OrganizationID
+	plan.Currency = currency
+	plan.BaseFeeCents = req.BaseFeeCents
+	plan.PerUserCents = req.PerUserCents
+	plan.PerMailboxCents = req.PerMailboxCents
+	plan.PerGBStoredCents = req.PerGBStoredCents
+	plan.PerGBIngestedCents = req.PerGBIngestedCents
+	if req.IsActive != nil {
+		plan.IsActive = *req.IsActive
+	}
+	return true
+}
+
+// CreatePricePlan adds a price plan for a hierarchy level or a single organization (admin only)
+// POST /api/billing/plans
+func (bh *BillingHandler) CreatePricePlan(c *gin.Context) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var req pricePlanRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data", "details": err.Error()})
+		return
+	}
+
+	plan := database.PricePlan{IsActive: true, CreatedBy: uuid.MustParse(userClaims.UserID)}
+	if !bh.applyPlanRequest(c, &plan, &req) {
+		return
+	}
+	if err := bh.DB.Create(&plan).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create price plan"})
+		return
+	}
+
+	recordAudit(c, database.AuditEvent{
+		Action:     "billing.plan.create",
+		TargetType: "price_plan",
+		TargetID:   plan.ID.String(),
+		Detail:     fmt.Sprintf("%s for %s", plan.Name, plan.OrgType),
+	})
+
+	c.JSON(http.StatusCreated, plan)
+}
+
+// UpdatePricePlan changes a price plan (admin only). Billing periods are rated
+// with the current plans, so changes apply to every period computed afterwards.
+// PUT /api/billing/plans/:id
+func (bh *BillingHandler) UpdatePricePlan(c *gin.Context) {
+	if _, err := middleware.GetUserFromContext(c); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var plan database.PricePlan
+	if err := bh.DB.First(&plan, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Price plan not found"})
+		return
+	}
+
+	var req pricePlanRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data", "details": err.Error()})
+		return
+	}
+	if !bh.applyPlanRequest(c, &plan, &req) {
+		return
+	}
+	if err := bh.DB.Save(&plan).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update price plan"})
+		return
+	}
+
+	recordAudit(c, database.AuditEvent{
+		Action:     "billing.plan.update",
+		TargetType: "price_plan",
+		TargetID:   plan.ID.String(),
+		Detail:     fmt.Sprintf("%s for %s", plan.Name, plan.OrgType),
+	})
+
+	c.JSON(http.StatusOK, plan)
+}
+
+// DeletePricePlan removes a price plan (admin only)
+// DELETE /api/billing/plans/:id
+func (bh *BillingHandler) DeletePricePlan(c *gin.Context) {
+	if _, err := middleware.GetUserFromContext(c); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var plan database.PricePlan
+	if err := bh.DB.First(&plan, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Price plan not found"})
+		return
+	}
+	if err := bh.DB.Delete(&plan).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete price plan"})
+		return
+	}
+
+	recordAudit(c, database.AuditEvent{
+		Action:     "billing.plan.delete",
+		TargetType: "price_plan",
+		TargetID:   plan.ID.String(),
+		Detail:     plan.Name,
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Price plan deleted successfully"})
+}
+
+// TakeSnapshot records today's usage of every organization now (admin only)
+// POST /api/admin/billing/snapshots
+func (bh *BillingHandler) TakeSnapshot(c *gin.Context) {
+	if _, err := middleware.GetUserFromContext(c); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	written, err := services.Metering.Snapshot(time.Now())
+	if errors.Is(err, services.ErrMeteringRunning) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record usage snapshots", "details": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":   "Usage snapshots recorded",
+		"snapshots": written,
+	})
+}
@@ -0,0 +1,227 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"emailprojectv2/auth"
+	"emailprojectv2/database"
+	"emailprojectv2/middleware"
+	"emailprojectv2/services"
+	"emailprojectv2/storage"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type ComplianceHandler struct {
+	DB *gorm.DB
+}
+
+func NewComplianceHandler(db *gorm.DB) *ComplianceHandler {
+	return &ComplianceHandler{DB: db}
+}
+
+type complianceArchiveRequest struct {
+	Enabled       bool   `json:"enabled"`
+	Mode          string `json:"mode" binding:"omitempty,oneof=governance compliance"`
+	RetentionDays int    `json:"retention_days"`
+}
+
+// organizationParam parses the organization in the path and checks access to it
+func (ch *ComplianceHandler) organizationParam(c *gin.Context) (*auth.Claims, uuid.UUID, bool) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return nil, uuid.Nil, false
+	}
+
+	orgID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid organization ID"})
+		return nil, uuid.Nil, false
+	}
+
+	if !canManageOrganizationID(userClaims, orgID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this organization"})
+		return nil, uuid.Nil, false
+	}
+	return userClaims, orgID, true
+}
+
+// GetComplianceArchive returns an organization's own and effective compliance archive settings
+// GET /api/organizations/:id/compliance-archive
+func (ch *ComplianceHandler) GetComplianceArchive(c *gin.Context) {
+	_, orgID, ok := ch.organizationParam(c)
+	if !ok {
+		return
+	}
+
+	var settings database.OrganizationSettings
+	err := ch.DB.Where("org_id = ?", orgID).First(&settings).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch organization settings"})
+		return
+	}
+
+	effective, err := services.ResolveComplianceArchive(orgID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to resolve compliance archive"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"enabled":             settings.ComplianceArchive,
+		"mode":                settings.ComplianceLockMode,
+		"retention_days":      settings.ComplianceRetentionDays,
+		"effective":           effective,
+		"bucket_lock_enabled": storage.ObjectLockEnabled(c.Request.Context()),
+	})
+}
+
+// UpdateComplianceArchive enables, changes or disables an organization's compliance
+// archive. Changes only apply to messages archived afterwards; objects already locked
+// keep their lock. A compliance-mode archive can be extended but never weakened.
+// PUT /api/organizations/:id/compliance-archive
+func (ch *ComplianceHandler) UpdateComplianceArchive(c *gin.Context) {
+	_, orgID, ok := ch.organizationParam(c)
+	if !ok {
+		return
+	}
+
+	var req complianceArchiveRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data", "details": err.Error()})
+		return
+	}
+	if req.Mode == "" {
+		req.Mode = services.ComplianceModeGovernance
+	}
+	if req.Enabled {
+		if req.RetentionDays <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "retention_days must be positive"})
+			return
+		}
+		if !storage.ObjectLockEnabled(c.Request.Context()) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Object locking is not enabled on the storage bucket"})
+			return
+		}
+	}
+
+	var settings database.OrganizationSettings
+	err := ch.DB.Where("org_id = ?", orgID).First(&settings).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		settings = database.OrganizationSettings{OrgID: orgID}
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch organization settings"})
+		return
+	}
+
+	if settings.ComplianceArchive && settings.ComplianceLockMode == services.ComplianceModeCompliance {
+		if !req.Enabled || req.Mode != services.ComplianceModeCompliance || req.RetentionDays < settings.ComplianceRetentionDays {
+			c.JSON(http.StatusConflict, gin.H{"error": "A compliance mode archive cannot be disabled, downgraded or shortened"})
+			return
+		}
+	}
+
+	settings.ComplianceArchive = req.Enabled
+	settings.ComplianceLockMode = req.Mode
+	settings.ComplianceRetentionDays = req.RetentionDays
+	if err := ch.DB.Save(&settings).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update compliance archive"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"enabled":        settings.ComplianceArchive,
+		"mode":           settings.ComplianceLockMode,
+		"retention_days": settings.ComplianceRetentionDays,
+	})
+}
+
+// StartVerification checks the storage lock state of an organization's archived objects
+// POST /api/organizations/:id/compliance-archive/verify
+func (ch *ComplianceHandler) StartVerification(c *gin.Context) {
+	userClaims, orgID, ok := ch.organizationParam(c)
+	if !ok {
+		return
+	}
+
+	triggeredBy := uuid.MustParse(userClaims.UserID)
+	report, err := services.StartComplianceVerification(orgID, &triggeredBy)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start compliance verification"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"verification": report})
+}
+
+// GetVerifications lists the verification reports of an organization
+// GET /api/organizations/:id/compliance-archive/verifications
+func (ch *ComplianceHandler) GetVerifications(c *gin.Context) {
+	_, orgID, ok := ch.organizationParam(c)
+	if !ok {
+		return
+	}
+
+	var reports []database.ComplianceVerification
+	if err := ch.DB.Where("organization_id = ?", orgID).Order("started_at DESC").Limit(50).Find(&reports).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch compliance verifications"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"verifications": reports})
+}
+
+// GetVerification returns a verification report with the objects that failed it
+// GET /api/compliance/verifications/:id?page=1&limit=100
+func (ch *ComplianceHandler) GetVerification(c *gin.Context) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var report database.ComplianceVerification
+	if err := ch.DB.First(&report, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Compliance verification not found"})
+		return
+	}
+
+	if !canManageOrganizationID(userClaims, report.OrganizationID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this compliance verification"})
+		return
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 1000 {
+		limit = 100
+	}
+
+	var total int64
+	ch.DB.Model(&database.ComplianceVerificationItem{}).Where("verification_id = ?", report.ID).Count(&total)
+
+	var items []database.ComplianceVerificationItem
+	if err := ch.DB.Where("verification_id = ?", report.ID).Order("created_at ASC").
+		Offset((page - 1) * limit).Limit(limit).Find(&items).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch compliance verification items"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"verification": report,
+		"items":        items,
+		"pagination": gin.H{
+			"page":  page,
+			"limit": limit,
+			"total": total,
+		},
+	})
+}
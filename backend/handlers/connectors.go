@@ -0,0 +1,391 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"emailprojectv2/database"
+	"emailprojectv2/middleware"
+	"emailprojectv2/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type ConnectorHandler struct {
+	DB *gorm.DB
+	// Organization access checks are shared with the directory configuration
+	directory *DirectoryHandler
+}
+
+func NewConnectorHandler(db *gorm.DB) *ConnectorHandler {
+	return &ConnectorHandler{DB: db, directory: NewDirectoryHandler(db)}
+}
+
+type connectorRequest struct {
+	Name           string `json:"name"`
+	Type           string `json:"type"` // exchange_ews or graph, fixed once created
+	ServerURL      string `json:"server_url"`
+	Username       string `json:"username"`
+	Password       string `json:"password"` // Kept when empty on update
+	Domain         string `json:"domain"`
+	DiscoveryGroup string `json:"discovery_group"`
+	TenantID       string `json:"tenant_id"`
+	ClientID       string `json:"client_id"`
+	ClientSecret   string `json:"client_secret"` // Kept when empty on update
+	SyncMailboxes  *bool  `json:"sync_mailboxes"`
+	IsActive       *bool  `json:"is_active"`
+}
+
+// connectorResponse is a connector as returned to managers; secrets are never sent back
+func connectorResponse(connector *database.TenantConnector) gin.H {
+	return gin.H{
+		"connector":         connector,
+		"has_password":      connector.Password != "",
+		"has_client_secret": connector.ClientSecret != "",
+	}
+}
+
+// validateConnector checks that a connector has what its type needs
+func validateConnector(connector *database.TenantConnector) string {
+	if connector.Name == "" {
+		return "name is required"
+	}
+	switch connector.Type {
+	case services.ConnectorTypeExchangeEWS:
+		if parsed, err := url.Parse(connector.ServerURL); err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+			return "server_url must be the http(s) URL of the EWS endpoint"
+		}
+		if connector.Username == "" || connector.Password == "" {
+			return "username and password of the impersonating service account are required"
+		}
+		if !strings.Contains(connector.DiscoveryGroup, "@") {
+			return "discovery_group must be the address of the distribution group whose members are backed up"
+		}
+	case services.ConnectorTypeGraph:
+		if err := services.ValidateGraphTenant(connector.TenantID); err != nil {
+			return err.Error()
+		}
+		if connector.ClientID == "" || connector.ClientSecret == "" {
+			return "client_id and client_secret of the app registration are required"
+		}
+	default:
+		return "type must be exchange_ews or graph"
+	}
+	return ""
+}
+
+// applyConnectorRequest copies the request onto a connector, keeping secrets
+// that were left empty
+func applyConnectorRequest(connector *database.TenantConnector, req *connectorRequest) {
+	if req.Name != "" {
+		connector.Name = req.Name
+	}
+	connector.ServerURL = req.ServerURL
+	connector.Username = req.Username
+	connector.Domain = req.Domain
+	connector.DiscoveryGroup = req.DiscoveryGroup
+	connector.TenantID = req.TenantID
+	connector.ClientID = req.ClientID
+	if req.Password != "" {
+		connector.Password = req.Password
+	}
+	if req.ClientSecret != "" {
+		connector.ClientSecret = req.ClientSecret
+	}
+	if req.SyncMailboxes != nil {
+		connector.SyncMailboxes = *req.SyncMailboxes
+	}
+	if req.IsActive != nil {
+		connector.IsActive = *req.IsActive
+	}
+}
+
+// loadConnector returns the connector in the route after checking access to its organization
+func (ch *ConnectorHandler) loadConnector(c *gin.Context) (*database.Organization, *database.TenantConnector, bool) {
+	org, _, ok := ch.directory.loadDirectoryOrganization(c)
+	if !ok {
+		return nil, nil, false
+	}
+	connectorID, err := uuid.Parse(c.Param("connectorId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid connector ID"})
+		return nil, nil, false
+	}
+
+	var connector database.TenantConnector
+	if err := ch.DB.Where("id = ? AND organization_id = ?", connectorID, org.ID).First(&connector).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": services.ErrConnectorNotFound.Error()})
+			return nil, nil, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch connector"})
+		return nil, nil, false
+	}
+	return org, &connector, true
+}
+
+// GetConnectors lists an organization's tenant connectors
+// GET /api/organizations/:id/connectors
+func (ch *ConnectorHandler) GetConnectors(c *gin.Context) {
+	org, _, ok := ch.directory.loadDirectoryOrganization(c)
+	if !ok {
+		return
+	}
+
+	var connectors []database.TenantConnector
+	if err := ch.DB.Where("organization_id = ?", org.ID).Order("created_at").Find(&connectors).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch connectors"})
+		return
+	}
+
+	response := make([]gin.H, 0, len(connectors))
+	for i := range connectors {
+		entry := connectorResponse(&connectors[i])
+		var accounts int64
+		ch.DB.Model(&database.EmailAccount{}).
+			Where("provider_settings @> ?::jsonb AND is_active = ?", services.ConnectorAccountFilter(connectors[i].ID), true).
+			Count(&accounts)
+		entry["active_accounts"] = accounts
+		response = append(response, entry)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"connectors": response})
+}
+
+// GetConnector returns one tenant connector
+// GET /api/organizations/:id/connectors/:connectorId
+func (ch *ConnectorHandler) GetConnector(c *gin.Context) {
+	_, connector, ok := ch.loadConnector(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, connectorResponse(connector))
+}
+
+// CreateConnector adds a tenant connector. Its mailboxes are discovered with
+// the given credentials before it is saved, and the number found is returned.
+// POST /api/organizations/:id/connectors
+func (ch *ConnectorHandler) CreateConnector(c *gin.Context) {
+	org, userClaims, ok := ch.directory.loadDirectoryOrganization(c)
+	if !ok {
+		return
+	}
+	// Mailboxes are owned by end users, who belong to client organizations
+	if org.Type != "client" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Connectors can only be added to client organizations"})
+		return
+	}
+
+	var req connectorRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data", "details": err.Error()})
+		return
+	}
+
+	connector := database.TenantConnector{
+		OrganizationID: org.ID,
+		Type:           req.Type,
+		SyncMailboxes:  true,
+		IsActive:       true,
+		CreatedBy:      uuid.MustParse(userClaims.UserID),
+	}
+	applyConnectorRequest(&connector, &req)
+	if msg := validateConnector(&connector); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
+	mailboxes, _, err := services.DiscoverMailboxes(&connector)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Mailboxes could not be discovered", "details": err.Error()})
+		return
+	}
+
+	err = ch.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&connector).Error; err != nil {
+			return err
+		}
+		// Create skips false values of columns that default to true
+		return tx.Model(&connector).Select("sync_mailboxes", "is_active").Updates(&connector).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save connector"})
+		return
+	}
+
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: &org.ID,
+		Action:         "organization.connector_create",
+		TargetType:     "tenant_connector",
+		TargetID:       connector.ID.String(),
+		Detail:         connector.Type,
+	})
+	log.Printf("🏢 Tenant connector %s added to organization %s (%s, %d mailboxes)", connector.Name, org.ID, connector.Type, len(mailboxes))
+
+	response := connectorResponse(&connector)
+	response["mailboxes_found"] = len(mailboxes)
+	c.JSON(http.StatusCreated, response)
+}
+
+// UpdateConnector changes a tenant connector. New credentials are checked by
+// discovering the mailboxes again and are passed on to the Exchange accounts
+// the connector created.
+// PUT /api/organizations/:id/connectors/:connectorId
+func (ch *ConnectorHandler) UpdateConnector(c *gin.Context) {
+	org, connector, ok := ch.loadConnector(c)
+	if !ok {
+		return
+	}
+
+	var req connectorRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data", "details": err.Error()})
+		return
+	}
+	if req.Type != "" && req.Type != connector.Type {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The type of a connector cannot be changed"})
+		return
+	}
+
+	applyConnectorRequest(connector, &req)
+	if msg := validateConnector(connector); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
+	mailboxes, _, err := services.DiscoverMailboxes(connector)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Mailboxes could not be discovered", "details": err.Error()})
+		return
+	}
+
+	err = ch.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(connector).Error; err != nil {
+			return err
+		}
+		if connector.Type != services.ConnectorTypeExchangeEWS {
+			return nil
+		}
+		return tx.Model(&database.EmailAccount{}).
+			Where("provider_settings @> ?::jsonb", services.ConnectorAccountFilter(connector.ID)).
+			Updates(map[string]interface{}{
+				"server_url": connector.ServerURL,
+				"username":   connector.Username,
+				"password":   connector.Password,
+				"domain":     connector.Domain,
+			}).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save connector"})
+		return
+	}
+
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: &org.ID,
+		Action:         "organization.connector_update",
+		TargetType:     "tenant_connector",
+		TargetID:       connector.ID.String(),
+		Detail:         connector.Type,
+	})
+
+	response := connectorResponse(connector)
+	response["mailboxes_found"] = len(mailboxes)
+	c.JSON(http.StatusOK, response)
+}
+
+// DeleteConnector removes a tenant connector. The accounts it created are
+// paused; their archived emails are kept.
+// DELETE /api/organizations/:id/connectors/:connectorId
+func (ch *ConnectorHandler) DeleteConnector(c *gin.Context) {
+	org, connector, ok := ch.loadConnector(c)
+	if !ok {
+		return
+	}
+
+	var paused int64
+	err := ch.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&database.EmailAccount{}).
+			Where("provider_settings @> ?::jsonb AND is_active = ?", services.ConnectorAccountFilter(connector.ID), true).
+			Update("is_active", false)
+		if result.Error != nil {
+			return result.Error
+		}
+		paused = result.RowsAffected
+		if err := tx.Where("connector_id = ?", connector.ID).Delete(&database.TenantConnectorRun{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(connector).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete connector"})
+		return
+	}
+
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: &org.ID,
+		Action:         "organization.connector_delete",
+		TargetType:     "tenant_connector",
+		TargetID:       connector.ID.String(),
+		Detail:         connector.Name,
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Connector deleted", "accounts_paused": paused})
+}
+
+// RunConnector starts a discovery and sync of a connector's mailboxes now
+// instead of waiting for the scheduled job. The run continues in the
+// background; its progress is listed by GetConnectorRuns.
+// POST /api/organizations/:id/connectors/:connectorId/run
+func (ch *ConnectorHandler) RunConnector(c *gin.Context) {
+	org, connector, ok := ch.loadConnector(c)
+	if !ok {
+		return
+	}
+	userClaims, _ := middleware.GetUserFromContext(c)
+	actorID := uuid.MustParse(userClaims.UserID)
+
+	run, err := services.StartTenantConnectorRun(connector.ID, &actorID)
+	switch {
+	case errors.Is(err, services.ErrConnectorNotFound):
+		c.JSON(http.StatusConflict, gin.H{"error": "Connector is not active"})
+		return
+	case errors.Is(err, services.ErrConnectorRunning):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start connector run"})
+		return
+	}
+
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: &org.ID,
+		Action:         "organization.connector_run",
+		TargetType:     "tenant_connector",
+		TargetID:       connector.ID.String(),
+		Detail:         run.ID.String(),
+	})
+
+	c.JSON(http.StatusAccepted, gin.H{"run": run})
+}
+
+// GetConnectorRuns lists the latest runs of a connector
+// GET /api/organizations/:id/connectors/:connectorId/runs
+func (ch *ConnectorHandler) GetConnectorRuns(c *gin.Context) {
+	_, connector, ok := ch.loadConnector(c)
+	if !ok {
+		return
+	}
+
+	var runs []database.TenantConnectorRun
+	if err := ch.DB.Where("connector_id = ?", connector.ID).Order("started_at DESC").Limit(50).Find(&runs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch connector runs"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"runs": runs})
+}
@@ -0,0 +1,330 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"emailprojectv2/auth"
+	"emailprojectv2/database"
+	"emailprojectv2/middleware"
+	"emailprojectv2/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// DataSubjectHandler serves GDPR data subject requests. Organization managers
+// and compliance officers may run them for their organization subtree.
+type DataSubjectHandler struct {
+	DB *gorm.DB
+}
+
+func NewDataSubjectHandler(db *gorm.DB) *DataSubjectHandler {
+	return &DataSubjectHandler{DB: db}
+}
+
+type createDataSubjectRequest struct {
+	OrganizationID string `json:"organization_id" binding:"required"`
+	RequestType    string `json:"request_type" binding:"required,oneof=access erasure"`
+	SubjectEmail   string `json:"subject_email" binding:"omitempty,email"`
+	SubjectName    string `json:"subject_name"`
+	Reference      string `json:"reference"`
+}
+
+type eraseDataSubjectRequest struct {
+	Action string `json:"action" binding:"required,oneof=redact delete"`
+}
+
+// canHandleRequests checks whether the user may run data subject requests for an organization
+func (dsh *DataSubjectHandler) canHandleRequests(claims *auth.Claims, orgID uuid.UUID) bool {
+	if managesAllOrganizations(claims) {
+		return true
+	}
+	userID := uuid.MustParse(claims.UserID)
+	var org database.Organization
+	if err := dsh.DB.First(&org, "id = ?", orgID).Error; err != nil {
+		return false
+	}
+	if org.CanUserManage(dsh.DB, userID) {
+		return true
+	}
+	allowed, err := services.HasPermissionFor(userID, orgID, services.PermissionComplianceOfficer)
+	return err == nil && allowed
+}
+
+// loadRequest fetches the request in the path and checks access to it
+func (dsh *DataSubjectHandler) loadRequest(c *gin.Context) (*database.DataSubjectRequest, *auth.Claims, bool) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return nil, nil, false
+	}
+
+	var req database.DataSubjectRequest
+	if err := dsh.DB.First(&req, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Data subject request not found"})
+		return nil, nil, false
+	}
+
+	if !dsh.canHandleRequests(userClaims, req.OrganizationID) {
+		recordAudit(c, database.AuditEvent{
+			OrganizationID: &req.OrganizationID,
+			Action:         "dsar.access",
+			TargetType:     "data_subject_request",
+			TargetID:       req.ID.String(),
+			Result:         services.AuditResultDenied,
+		})
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this data subject request"})
+		return nil, nil, false
+	}
+	return &req, userClaims, true
+}
+
+// GetRequests lists the data subject requests of an organization subtree
+// GET /api/data-subject-requests?organization_id=...&status=...
+func (dsh *DataSubjectHandler) GetRequests(c *gin.Context) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	orgID, err := uuid.Parse(c.Query("organization_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Valid organization_id required"})
+		return
+	}
+	if !dsh.canHandleRequests(userClaims, orgID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this organization"})
+		return
+	}
+
+	orgIDs, err := services.OrganizationSubtree(orgID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load organizations"})
+		return
+	}
+
+	query := dsh.DB.Where("organization_id IN ?", orgIDs)
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var requests []database.DataSubjectRequest
+	if err := query.Order("created_at DESC").Find(&requests).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch data subject requests"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"requests": requests})
+}
+
+// CreateRequest registers a request and starts searching for the subject
+// POST /api/data-subject-requests
+func (dsh *DataSubjectHandler) CreateRequest(c *gin.Context) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var body createDataSubjectRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data", "details": err.Error()})
+		return
+	}
+	if strings.TrimSpace(body.SubjectEmail) == "" && strings.TrimSpace(body.SubjectName) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "subject_email or subject_name required"})
+		return
+	}
+	orgID, err := uuid.Parse(body.OrganizationID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid organization ID"})
+		return
+	}
+	if !dsh.canHandleRequests(userClaims, orgID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this organization"})
+		return
+	}
+
+	req := database.DataSubjectRequest{
+		OrganizationID: orgID,
+		RequestType:    body.RequestType,
+		SubjectEmail:   body.SubjectEmail,
+		SubjectName:    body.SubjectName,
+		Reference:      strings.TrimSpace(body.Reference),
+		CreatedBy:      uuid.MustParse(userClaims.UserID),
+	}
+	if err := services.StartDataSubjectRequest(&req); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create data subject request"})
+		return
+	}
+
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: &orgID,
+		Action:         "dsar.create",
+		TargetType:     "data_subject_request",
+		TargetID:       req.ID.String(),
+		Detail:         req.RequestType,
+	})
+
+	c.JSON(http.StatusAccepted, gin.H{"request": req})
+}
+
+// GetRequest returns a request with a page of the emails found for it
+// GET /api/data-subject-requests/:id?page=1&limit=100
+func (dsh *DataSubjectHandler) GetRequest(c *gin.Context) {
+	req, _, ok := dsh.loadRequest(c)
+	if !ok {
+		return
+	}
+
+	page, limit := pageParams(c)
+
+	var total int64
+	dsh.DB.Model(&database.DataSubjectMatch{}).Where("request_id = ?", req.ID).Count(&total)
+
+	var matches []database.DataSubjectMatch
+	if err := dsh.DB.Where("request_id = ?", req.ID).Order("email_date DESC").
+		Offset((page - 1) * limit).Limit(limit).Find(&matches).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch matched emails"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"request": req,
+		"matches": matches,
+		"pagination": gin.H{
+			"page":  page,
+			"limit": limit,
+			"total": total,
+		},
+	})
+}
+
+// GetAccessReport downloads the access report: every archived email the
+// subject sent or received, with the mailbox it is kept in
+// GET /api/data-subject-requests/:id/report
+func (dsh *DataSubjectHandler) GetAccessReport(c *gin.Context) {
+	req, _, ok := dsh.loadRequest(c)
+	if !ok {
+		return
+	}
+	if req.Status == services.DSRStatusSearching {
+		c.JSON(http.StatusConflict, gin.H{"error": "Search still in progress"})
+		return
+	}
+
+	var matches []database.DataSubjectMatch
+	if err := dsh.DB.Where("request_id = ?", req.ID).Order("email_date ASC").Find(&matches).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch matched emails"})
+		return
+	}
+
+	accountIDs := []uuid.UUID{}
+	for _, match := range matches {
+		accountIDs = append(accountIDs, match.AccountID)
+	}
+	var accounts []database.EmailAccount
+	mailboxes := map[uuid.UUID]string{}
+	if len(accountIDs) > 0 {
+		dsh.DB.Select("id", "email").Where("id IN ?", accountIDs).Find(&accounts)
+	}
+	for _, account := range accounts {
+		mailboxes[account.ID] = account.Email
+	}
+
+	emails := make([]gin.H, 0, len(matches))
+	for _, match := range matches {
+		emails = append(emails, gin.H{
+			"email_id":     match.EmailID,
+			"mailbox":      mailboxes[match.AccountID],
+			"message_id":   match.MessageID,
+			"subject":      match.Subject,
+			"sender_email": match.SenderEmail,
+			"date":         match.EmailDate,
+			"folder":       match.Folder,
+			"matched_as":   match.MatchedAs,
+			"outcome":      match.Outcome,
+		})
+	}
+
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: &req.OrganizationID,
+		Action:         "dsar.report",
+		TargetType:     "data_subject_request",
+		TargetID:       req.ID.String(),
+	})
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=access-report-%s.json", req.ID))
+	c.JSON(http.StatusOK, gin.H{
+		"request_id":    req.ID,
+		"reference":     req.Reference,
+		"subject_email": req.SubjectEmail,
+		"subject_name":  req.SubjectName,
+		"generated_at":  time.Now().UTC(),
+		"email_count":   len(emails),
+		"emails":        emails,
+	})
+}
+
+// EraseRequest redacts or deletes the emails found for an erasure request.
+// Emails under a legal hold or compliance lock are kept.
+// POST /api/data-subject-requests/:id/erase
+func (dsh *DataSubjectHandler) EraseRequest(c *gin.Context) {
+	req, userClaims, ok := dsh.loadRequest(c)
+	if !ok {
+		return
+	}
+
+	var body eraseDataSubjectRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data", "details": err.Error()})
+		return
+	}
+
+	err := services.StartDataSubjectErasure(req, body.Action, uuid.MustParse(userClaims.UserID))
+	if errors.Is(err, services.ErrDSRNotReady) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start erasure"})
+		return
+	}
+
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: &req.OrganizationID,
+		Action:         "dsar.erase",
+		TargetType:     "data_subject_request",
+		TargetID:       req.ID.String(),
+		Detail:         body.Action,
+	})
+
+	c.JSON(http.StatusAccepted, gin.H{"request": req})
+}
+
+// GetCertificate returns the signed completion certificate of a request and
+// whether its signature still verifies
+// GET /api/data-subject-requests/:id/certificate
+func (dsh *DataSubjectHandler) GetCertificate(c *gin.Context) {
+	req, _, ok := dsh.loadRequest(c)
+	if !ok {
+		return
+	}
+	if req.Status != services.DSRStatusCompleted {
+		c.JSON(http.StatusConflict, gin.H{"error": "Request is not completed"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"certificate": json.RawMessage(req.Certificate),
+		"signature":   req.CertificateSignature,
+		"verified":    services.VerifyDSRCertificate(req),
+	})
+}
@@ -0,0 +1,329 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"emailprojectv2/auth"
+	"emailprojectv2/database"
+	"emailprojectv2/middleware"
+	"emailprojectv2/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type DirectoryHandler struct {
+	DB *gorm.DB
+}
+
+func NewDirectoryHandler(db *gorm.DB) *DirectoryHandler {
+	return &DirectoryHandler{DB: db}
+}
+
+type directoryConfigRequest struct {
+	URL                   string `json:"url" binding:"required"`
+	StartTLS              *bool  `json:"start_tls"`
+	InsecureSkipVerify    *bool  `json:"insecure_skip_verify"`
+	BindDN                string `json:"bind_dn" binding:"required"`
+	BindPassword          string `json:"bind_password"` // Kept when empty on update
+	BaseDN                string `json:"base_dn" binding:"required"`
+	UserFilter            string `json:"user_filter"`
+	GroupDN               string `json:"group_dn" binding:"required"`
+	IDAttribute           string `json:"id_attribute"`
+	EmailAttribute        string `json:"email_attribute"`
+	LoginEnabled          *bool  `json:"login_enabled"`
+	SyncEnabled           *bool  `json:"sync_enabled"`
+	CreateMailboxAccounts *bool  `json:"create_mailbox_accounts"`
+	ExchangeServerURL     string `json:"exchange_server_url"`
+	ExchangeUsername      string `json:"exchange_username"`
+	ExchangePassword      string `json:"exchange_password"` // Kept when empty on update
+	ExchangeDomain        string `json:"exchange_domain"`
+	IsActive              *bool  `json:"is_active"`
+}
+
+// loadDirectoryOrganization checks that the current user may manage the
+// directory of the organization in the route
+func (dh *DirectoryHandler) loadDirectoryOrganization(c *gin.Context) (*database.Organization, *auth.Claims, bool) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return nil, nil, false
+	}
+	orgID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid organization ID"})
+		return nil, nil, false
+	}
+
+	var org database.Organization
+	if err := dh.DB.First(&org, "id = ?", orgID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Organization not found"})
+			return nil, nil, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch organization"})
+		return nil, nil, false
+	}
+	if !canManageOrganization(userClaims, &org) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this organization"})
+		return nil, nil, false
+	}
+	return &org, userClaims, true
+}
+
+// directoryResponse is a directory as returned to managers; passwords are never sent back
+func directoryResponse(dir *database.OrganizationDirectory) gin.H {
+	return gin.H{
+		"directory":             dir,
+		"has_bind_password":     dir.BindPassword != "",
+		"has_exchange_password": dir.ExchangePassword != "",
+	}
+}
+
+// GetDirectory returns an organization's directory configuration
+// GET /api/organizations/:id/directory
+func (dh *DirectoryHandler) GetDirectory(c *gin.Context) {
+	org, _, ok := dh.loadDirectoryOrganization(c)
+	if !ok {
+		return
+	}
+
+	var dir database.OrganizationDirectory
+	err := dh.DB.Where("organization_id = ?", org.ID).First(&dir).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": services.ErrDirectoryNotConfigured.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch directory"})
+		return
+	}
+
+	c.JSON(http.StatusOK, directoryResponse(&dir))
+}
+
+// UpdateDirectory creates or replaces an organization's directory
+// configuration. The directory is searched with the new settings before they
+// are saved, and the number of group members found is returned.
+// PUT /api/organizations/:id/directory
+func (dh *DirectoryHandler) UpdateDirectory(c *gin.Context) {
+	org, userClaims, ok := dh.loadDirectoryOrganization(c)
+	if !ok {
+		return
+	}
+	// Synced users are end users, who belong to client organizations
+	if org.Type != "client" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Directories can only be configured for client organizations"})
+		return
+	}
+
+	var req directoryConfigRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data", "details": err.Error()})
+		return
+	}
+	if err := services.ValidateDirectoryURL(req.URL); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var dir database.OrganizationDirectory
+	err := dh.DB.Where("organization_id = ?", org.ID).First(&dir).Error
+	creating := errors.Is(err, gorm.ErrRecordNotFound)
+	if err != nil && !creating {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch directory"})
+		return
+	}
+	if creating {
+		dir = database.OrganizationDirectory{
+			OrganizationID: org.ID,
+			UserFilter:     "(&(objectCategory=person)(objectClass=user))",
+			IDAttribute:    "objectGUID",
+			EmailAttribute: "mail",
+			LoginEnabled:   true,
+			SyncEnabled:    true,
+			IsActive:       true,
+			CreatedBy:      uuid.MustParse(userClaims.UserID),
+		}
+	}
+
+	dir.URL = req.URL
+	dir.BindDN = req.BindDN
+	dir.BaseDN = req.BaseDN
+	dir.GroupDN = req.GroupDN
+	if req.BindPassword != "" {
+		dir.BindPassword = req.BindPassword
+	}
+	if req.UserFilter != "" {
+		dir.UserFilter = req.UserFilter
+	}
+	if req.IDAttribute != "" {
+		dir.IDAttribute = req.IDAttribute
+	}
+	if req.EmailAttribute != "" {
+		dir.EmailAttribute = req.EmailAttribute
+	}
+	if req.StartTLS != nil {
+		dir.StartTLS = *req.StartTLS
+	}
+	if req.InsecureSkipVerify != nil {
+		dir.InsecureSkipVerify = *req.InsecureSkipVerify
+	}
+	if req.LoginEnabled != nil {
+		dir.LoginEnabled = *req.LoginEnabled
+	}
+	if req.SyncEnabled != nil {
+		dir.SyncEnabled = *req.SyncEnabled
+	}
+	if req.CreateMailboxAccounts != nil {
+		dir.CreateMailboxAccounts = *req.CreateMailboxAccounts
+	}
+	if req.IsActive != nil {
+		dir.IsActive = *req.IsActive
+	}
+	dir.ExchangeServerURL = req.ExchangeServerURL
+	dir.ExchangeUsername = req.ExchangeUsername
+	dir.ExchangeDomain = req.ExchangeDomain
+	if req.ExchangePassword != "" {
+		dir.ExchangePassword = req.ExchangePassword
+	}
+
+	if dir.BindPassword == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bind_password is required"})
+		return
+	}
+	if err := services.ValidateDirectoryFilter(dir.UserFilter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if dir.CreateMailboxAccounts && (dir.ExchangeServerURL == "" || dir.ExchangeUsername == "" || dir.ExchangePassword == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Creating mailbox accounts requires an Exchange server and service account"})
+		return
+	}
+
+	members, err := services.TestDirectory(&dir)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Directory could not be searched", "details": err.Error()})
+		return
+	}
+
+	err = dh.DB.Transaction(func(tx *gorm.DB) error {
+		if creating {
+			if err := tx.Create(&dir).Error; err != nil {
+				return err
+			}
+			// Create skips false values of columns that default to true
+			return tx.Model(&dir).Select("login_enabled", "sync_enabled", "is_active").Updates(&dir).Error
+		}
+		return tx.Save(&dir).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save directory"})
+		return
+	}
+
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: &org.ID,
+		Action:         "organization.directory_update",
+		TargetType:     "organization",
+		TargetID:       org.ID.String(),
+		Detail:         dir.URL,
+	})
+	log.Printf("📇 Directory for organization %s saved (%s, %d group members)", org.ID, dir.URL, members)
+
+	response := directoryResponse(&dir)
+	response["members_found"] = members
+	c.JSON(http.StatusOK, response)
+}
+
+// DeleteDirectory removes an organization's directory configuration. Synced
+// users keep their accounts but can no longer sign in with their directory
+// password.
+// DELETE /api/organizations/:id/directory
+func (dh *DirectoryHandler) DeleteDirectory(c *gin.Context) {
+	org, _, ok := dh.loadDirectoryOrganization(c)
+	if !ok {
+		return
+	}
+
+	result := dh.DB.Where("organization_id = ?", org.ID).Delete(&database.OrganizationDirectory{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete directory"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": services.ErrDirectoryNotConfigured.Error()})
+		return
+	}
+
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: &org.ID,
+		Action:         "organization.directory_delete",
+		TargetType:     "organization",
+		TargetID:       org.ID.String(),
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Directory deleted"})
+}
+
+// SyncDirectory syncs an organization's directory now instead of waiting for the scheduled job
+// POST /api/organizations/:id/directory/sync
+func (dh *DirectoryHandler) SyncDirectory(c *gin.Context) {
+	org, userClaims, ok := dh.loadDirectoryOrganization(c)
+	if !ok {
+		return
+	}
+
+	actorID := uuid.MustParse(userClaims.UserID)
+	run, err := services.SyncDirectory(org.ID, &actorID)
+	switch {
+	case errors.Is(err, services.ErrDirectoryNotConfigured):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, services.ErrDirectorySyncRunning):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case err != nil && run == nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sync directory"})
+		return
+	}
+
+	result := services.AuditResultSuccess
+	if err != nil {
+		result = services.AuditResultFailure
+	}
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: &org.ID,
+		Action:         "organization.directory_sync",
+		TargetType:     "organization",
+		TargetID:       org.ID.String(),
+		Result:         result,
+		Detail:         run.ID.String(),
+	})
+
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Directory sync failed", "run": run})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"run": run})
+}
+
+// GetSyncRuns lists the latest syncs of an organization's directory
+// GET /api/organizations/:id/directory/runs
+func (dh *DirectoryHandler) GetSyncRuns(c *gin.Context) {
+	org, _, ok := dh.loadDirectoryOrganization(c)
+	if !ok {
+		return
+	}
+
+	var runs []database.DirectorySyncRun
+	if err := dh.DB.Where("organization_id = ?", org.ID).Order("started_at DESC").Limit(50).Find(&runs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch directory syncs"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"runs": runs})
+}
@@ -0,0 +1,790 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"emailprojectv2/database"
+	"emailprojectv2/middleware"
+	"emailprojectv2/services"
+	"emailprojectv2/storage"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// DiscoveryHandler serves eDiscovery cases. Everything but grant management
+// requires the compliance_officer permission over the case's organization,
+// and every search, view and export is written to the audit log.
+type DiscoveryHandler struct {
+	DB *gorm.DB
+}
+
+func NewDiscoveryHandler(db *gorm.DB) *DiscoveryHandler {
+	return &DiscoveryHandler{DB: db}
+}
+
+type discoverySearchRequest struct {
+	Query services.HoldSearchCriteria `json:"query"`
+	Page  int                         `json:"page"`
+	Limit int                         `json:"limit"`
+}
+
+type discoveryItemsRequest struct {
+	EmailIDs []string `json:"email_ids" binding:"required,min=1"`
+	Tags     []string `json:"tags"`
+}
+
+func encodeTags(tags []string) string {
+	cleaned := []string{}
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag != "" && !seen[tag] {
+			seen[tag] = true
+			cleaned = append(cleaned, tag)
+		}
+	}
+	data, _ := json.Marshal(cleaned)
+	return string(data)
+}
+
+// loadCase fetches the case in the path and checks the compliance officer permission
+func (dh *DiscoveryHandler) loadCase(c *gin.Context) (*database.DiscoveryCase, uuid.UUID, bool) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return nil, uuid.Nil, false
+	}
+	userID := uuid.MustParse(userClaims.UserID)
+
+	var dc database.DiscoveryCase
+	if err := dh.DB.First(&dc, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Case not found"})
+		return nil, uuid.Nil, false
+	}
+
+	allowed, err := services.HasPermissionFor(userID, dc.OrganizationID, services.PermissionComplianceOfficer)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check permissions"})
+		return nil, uuid.Nil, false
+	}
+	if !allowed {
+		recordAudit(c, database.AuditEvent{
+			OrganizationID: &dc.OrganizationID,
+			Action:         "ediscovery.case.access",
+			TargetType:     "discovery_case",
+			TargetID:       dc.ID.String(),
+			Result:         services.AuditResultDenied,
+		})
+		c.JSON(http.StatusForbidden, gin.H{"error": "Compliance officer permission required for this case"})
+		return nil, uuid.Nil, false
+	}
+	return &dc, userID, true
+}
+
+// requireOpen rejects changes to a closed case
+func requireOpen(c *gin.Context, dc *database.DiscoveryCase) bool {
+	if dc.Status != "open" {
+		c.JSON(http.StatusConflict, gin.H{"error": "Case is closed"})
+		return false
+	}
+	return true
+}
+
+// GetGrants lists compliance officer grants of an organization
+// GET /api/ediscovery/grants?organization_id=...
+func (dh *DiscoveryHandler) GetGrants(c *gin.Context) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	query := dh.DB.Preload("User").Preload("Organization").Where("permission = ?", services.PermissionComplianceOfficer)
+	if orgParam := c.Query("organization_id"); orgParam != "" {
+		orgID, err := uuid.Parse(orgParam)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid organization ID"})
+			return
+		}
+		if !canManageOrganizationID(userClaims, orgID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this organization"})
+			return
+		}
+		query = query.Where("organization_id = ?", orgID)
+	} else if !managesAllOrganizations(userClaims) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "organization_id required"})
+		return
+	}
+
+	var grants []database.PermissionGrant
+	if err := query.Order("created_at DESC").Find(&grants).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch grants"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"grants": grants})
+}
+
+// CreateGrant makes a user a compliance officer for an organization subtree
+// POST /api/ediscovery/grants
+func (dh *DiscoveryHandler) CreateGrant(c *gin.Context) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var req struct {
+		UserID         string `json:"user_id" binding:"required"`
+		OrganizationID string `json:"organization_id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data", "details": err.Error()})
+		return
+	}
+	userID, err := uuid.Parse(req.UserID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	orgID, err := uuid.Parse(req.OrganizationID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid organization ID"})
+		return
+	}
+
+	if !canManageOrganizationID(userClaims, orgID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this organization"})
+		return
+	}
+
+	// Officers must belong to the organization subtree they investigate
+	userOrgID, err := services.UserOrganizationID(userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	within := false
+	if userOrgID != nil {
+		if within, err = services.OrganizationWithin(*userOrgID, orgID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check user organization"})
+			return
+		}
+	}
+	if !within {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User does not belong to this organization"})
+		return
+	}
+
+	grant := database.PermissionGrant{
+		UserID:         userID,
+		OrganizationID: orgID,
+		Permission:     services.PermissionComplianceOfficer,
+		GrantedBy:      uuid.MustParse(userClaims.UserID),
+	}
+	if err := dh.DB.Create(&grant).Error; err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "User is already a compliance officer for this organization"})
+		return
+	}
+
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: &orgID,
+		Action:         "ediscovery.grant.create",
+		TargetType:     "user",
+		TargetID:       userID.String(),
+		Detail:         services.PermissionComplianceOfficer,
+	})
+
+	c.JSON(http.StatusCreated, gin.H{"grant": grant})
+}
+
+// DeleteGrant revokes a compliance officer grant
+// DELETE /api/ediscovery/grants/:id
+func (dh *DiscoveryHandler) DeleteGrant(c *gin.Context) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var grant database.PermissionGrant
+	if err := dh.DB.First(&grant, "id = ? AND permission = ?", c.Param("id"), services.PermissionComplianceOfficer).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Grant not found"})
+		return
+	}
+	if !canManageOrganizationID(userClaims, grant.OrganizationID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this organization"})
+		return
+	}
+
+	if err := dh.DB.Delete(&grant).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke grant"})
+		return
+	}
+
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: &grant.OrganizationID,
+		Action:         "ediscovery.grant.revoke",
+		TargetType:     "user",
+		TargetID:       grant.UserID.String(),
+		Detail:         services.PermissionComplianceOfficer,
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Grant revoked"})
+}
+
+// GetCases lists the cases of the organizations the user is a compliance officer for
+// GET /api/ediscovery/cases
+func (dh *DiscoveryHandler) GetCases(c *gin.Context) {
+	userID, err := uuid.Parse(c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User ID not found"})
+		return
+	}
+
+	granted, err := services.GrantedOrganizations(userID, services.PermissionComplianceOfficer)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check permissions"})
+		return
+	}
+
+	var orgIDs []uuid.UUID
+	for _, orgID := range granted {
+		subtree, err := services.OrganizationSubtree(orgID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load organizations"})
+			return
+		}
+		orgIDs = append(orgIDs, subtree...)
+	}
+
+	cases := []database.DiscoveryCase{}
+	if len(orgIDs) > 0 {
+		query := dh.DB.Where("organization_id IN ?", orgIDs)
+		if status := c.Query("status"); status != "" {
+			query = query.Where("status = ?", status)
+		}
+		if err := query.Order("created_at DESC").Find(&cases).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch cases"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"cases": cases})
+}
+
+// CreateCase opens a new eDiscovery case
+// POST /api/ediscovery/cases
+func (dh *DiscoveryHandler) CreateCase(c *gin.Context) {
+	userID, err := uuid.Parse(c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User ID not found"})
+		return
+	}
+
+	var req struct {
+		OrganizationID string `json:"organization_id" binding:"required"`
+		Name           string `json:"name" binding:"required"`
+		Description    string `json:"description"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data", "details": err.Error()})
+		return
+	}
+	orgID, err := uuid.Parse(req.OrganizationID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid organization ID"})
+		return
+	}
+
+	allowed, err := services.HasPermissionFor(userID, orgID, services.PermissionComplianceOfficer)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check permissions"})
+		return
+	}
+	if !allowed {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Compliance officer permission required for this organization"})
+		return
+	}
+
+	dc := database.DiscoveryCase{
+		OrganizationID: orgID,
+		Name:           strings.TrimSpace(req.Name),
+		Description:    req.Description,
+		Status:         "open",
+		CreatedBy:      userID,
+	}
+	if err := dh.DB.Create(&dc).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create case"})
+		return
+	}
+
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: &orgID,
+		Action:         "ediscovery.case.create",
+		TargetType:     "discovery_case",
+		TargetID:       dc.ID.String(),
+		Detail:         dc.Name,
+	})
+
+	c.JSON(http.StatusCreated, gin.H{"case": dc})
+}
+
+// GetCase returns a case with its search history and exports
+// GET /api/ediscovery/cases/:id
+func (dh *DiscoveryHandler) GetCase(c *gin.Context) {
+	dc, _, ok := dh.loadCase(c)
+	if !ok {
+		return
+	}
+
+	var searches []database.DiscoverySearch
+	dh.DB.Where("case_id = ?", dc.ID).Order("created_at DESC").Find(&searches)
+
+	var itemCount int64
+	dh.DB.Model(&database.DiscoveryItem{}).Where("case_id = ?", dc.ID).Count(&itemCount)
+
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: &dc.OrganizationID,
+		Action:         "ediscovery.case.view",
+		TargetType:     "discovery_case",
+		TargetID:       dc.ID.String(),
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"case":       dc,
+		"searches":   searches,
+		"item_count": itemCount,
+	})
+}
+
+// CloseCase closes a case. Its items and exports remain available.
+// POST /api/ediscovery/cases/:id/close
+func (dh *DiscoveryHandler) CloseCase(c *gin.Context) {
+	dc, _, ok := dh.loadCase(c)
+	if !ok || !requireOpen(c, dc) {
+		return
+	}
+
+	now := time.Now()
+	if err := dh.DB.Model(dc).Updates(map[string]interface{}{"status": "closed", "closed_at": now}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to close case"})
+		return
+	}
+	dc.Status = "closed"
+	dc.ClosedAt = &now
+
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: &dc.OrganizationID,
+		Action:         "ediscovery.case.close",
+		TargetType:     "discovery_case",
+		TargetID:       dc.ID.String(),
+	})
+
+	c.JSON(http.StatusOK, gin.H{"case": dc})
+}
+
+// Search searches every mailbox of the case's organization subtree
+// POST /api/ediscovery/cases/:id/search
+func (dh *DiscoveryHandler) Search(c *gin.Context) {
+	dc, userID, ok := dh.loadCase(c)
+	if !ok || !requireOpen(c, dc) {
+		return
+	}
+
+	var req discoverySearchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data", "details": err.Error()})
+		return
+	}
+	if req.Page < 1 {
+		req.Page = 1
+	}
+	if req.Limit < 1 || req.Limit > 500 {
+		req.Limit = 50
+	}
+
+	emails, total, err := services.SearchCaseEmails(dc, req.Query, req.Page, req.Limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search emails"})
+		return
+	}
+
+	queryJSON, _ := json.Marshal(req.Query)
+	search := database.DiscoverySearch{
+		CaseID:      dc.ID,
+		Query:       string(queryJSON),
+		ResultCount: total,
+		ExecutedBy:  userID,
+	}
+	if err := dh.DB.Create(&search).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record search"})
+		return
+	}
+
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: &dc.OrganizationID,
+		Action:         "ediscovery.search",
+		TargetType:     "discovery_case",
+		TargetID:       dc.ID.String(),
+		Detail:         fmt.Sprintf("%s (%d results, page %d)", queryJSON, total, req.Page),
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"search_id": search.ID,
+		"emails":    emails,
+		"pagination": gin.H{
+			"page":  req.Page,
+			"limit": req.Limit,
+			"total": total,
+		},
+	})
+}
+
+// GetCaseEmail returns the full content of an email within the case's scope
+// GET /api/ediscovery/cases/:id/emails/:emailId
+func (dh *DiscoveryHandler) GetCaseEmail(c *gin.Context) {
+	dc, _, ok := dh.loadCase(c)
+	if !ok {
+		return
+	}
+
+	var email database.EmailIndex
+	if err := dh.DB.First(&email, "id = ?", c.Param("emailId")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Email not found"})
+		return
+	}
+
+	orgID, err := services.AccountOrganizationID(email.AccountID)
+	within := false
+	if err == nil && orgID != nil {
+		within, err = services.OrganizationWithin(*orgID, dc.OrganizationID)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check email scope"})
+		return
+	}
+	if !within {
+		recordAudit(c, database.AuditEvent{
+			OrganizationID: &dc.OrganizationID,
+			Action:         "ediscovery.email.view",
+			TargetType:     "email",
+			TargetID:       email.ID.String(),
+			Result:         services.AuditResultDenied,
+			Detail:         "email outside the case organization",
+		})
+		c.JSON(http.StatusForbidden, gin.H{"error": "Email is outside the scope of this case"})
+		return
+	}
+
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: &dc.OrganizationID,
+		Action:         "ediscovery.email.view",
+		TargetType:     "email",
+		TargetID:       email.ID.String(),
+		Detail:         fmt.Sprintf("case %s", dc.ID),
+	})
+
+	if email.MinioPath == "" {
+		c.JSON(http.StatusOK, gin.H{"email": email, "full_email": nil, "message": "Email content not available in storage"})
+		return
+	}
+	fullEmail, err := storage.GetEmailFromMinIO(email.MinioPath)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"email": email, "full_email": nil, "message": "Failed to retrieve email content from storage", "error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"email": email, "full_email": fullEmail})
+}
+
+// GetItems lists the emails added to a case, optionally filtered by tag
+// GET /api/ediscovery/cases/:id/items?tag=...
+func (dh *DiscoveryHandler) GetItems(c *gin.Context) {
+	dc, _, ok := dh.loadCase(c)
+	if !ok {
+		return
+	}
+
+	query := dh.DB.Where("case_id = ?", dc.ID)
+	if tag := c.Query("tag"); tag != "" {
+		query = query.Where("tags @> ?", fmt.Sprintf("[%q]", tag))
+	}
+	var items []database.DiscoveryItem
+	if err := query.Order("created_at ASC").Find(&items).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch case items"})
+		return
+	}
+
+	emailIDs := make([]uuid.UUID, 0, len(items))
+	for _, item := range items {
+		emailIDs = append(emailIDs, item.EmailID)
+	}
+	emails := map[uuid.UUID]database.EmailIndex{}
+	if len(emailIDs) > 0 {
+		var rows []database.EmailIndex
+		dh.DB.Where("id IN ?", emailIDs).Find(&rows)
+		for _, row := range rows {
+			emails[row.ID] = row
+		}
+	}
+
+	result := make([]gin.H, 0, len(items))
+	for _, item := range items {
+		entry := gin.H{"item": item}
+		if email, ok := emails[item.EmailID]; ok {
+			entry["email"] = email
+		}
+		result = append(result, entry)
+	}
+
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: &dc.OrganizationID,
+		Action:         "ediscovery.items.view",
+		TargetType:     "discovery_case",
+		TargetID:       dc.ID.String(),
+		Detail:         fmt.Sprintf("%d items", len(items)),
+	})
+
+	c.JSON(http.StatusOK, gin.H{"items": result})
+}
+
+// AddItems adds search results to a case with the given tags. Emails already
+// in the case get the tags added to theirs.
+// POST /api/ediscovery/cases/:id/items
+func (dh *DiscoveryHandler) AddItems(c *gin.Context) {
+	dc, userID, ok := dh.loadCase(c)
+	if !ok || !requireOpen(c, dc) {
+		return
+	}
+
+	var req discoveryItemsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data", "details": err.Error()})
+		return
+	}
+
+	accountIDs, err := services.OrganizationAccountIDs(dc.OrganizationID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load case scope"})
+		return
+	}
+	var emails []database.EmailIndex
+	if len(accountIDs) > 0 {
+		if err := dh.DB.Select("id", "account_id").Where("id IN ? AND account_id IN ?", req.EmailIDs, accountIDs).Find(&emails).Error; err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email IDs"})
+			return
+		}
+	}
+	if len(emails) != len(req.EmailIDs) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Some emails do not exist or are outside the scope of this case"})
+		return
+	}
+
+	added := 0
+	for _, email := range emails {
+		var item database.DiscoveryItem
+		err := dh.DB.Where("case_id = ? AND email_id = ?", dc.ID, email.ID).First(&item).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			item = database.DiscoveryItem{
+				CaseID:    dc.ID,
+				EmailID:   email.ID,
+				AccountID: email.AccountID,
+				Tags:      encodeTags(req.Tags),
+				AddedBy:   userID,
+			}
+			if err := dh.DB.Create(&item).Error; err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add case item"})
+				return
+			}
+			added++
+			continue
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add case item"})
+			return
+		}
+
+		var tags []string
+		json.Unmarshal([]byte(item.Tags), &tags)
+		if err := dh.DB.Model(&item).Update("tags", encodeTags(append(tags, req.Tags...))).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to tag case item"})
+			return
+		}
+	}
+
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: &dc.OrganizationID,
+		Action:         "ediscovery.items.add",
+		TargetType:     "discovery_case",
+		TargetID:       dc.ID.String(),
+		Detail:         fmt.Sprintf("%d emails (%d new), tags %v", len(emails), added, req.Tags),
+	})
+
+	c.JSON(http.StatusOK, gin.H{"added": added, "tagged": len(emails)})
+}
+
+// UpdateItem replaces the tags of a case item
+// PUT /api/ediscovery/cases/:id/items/:itemId
+func (dh *DiscoveryHandler) UpdateItem(c *gin.Context) {
+	dc, _, ok := dh.loadCase(c)
+	if !ok || !requireOpen(c, dc) {
+		return
+	}
+
+	var req struct {
+		Tags []string `json:"tags"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data", "details": err.Error()})
+		return
+	}
+
+	var item database.DiscoveryItem
+	if err := dh.DB.First(&item, "id = ? AND case_id = ?", c.Param("itemId"), dc.ID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Case item not found"})
+		return
+	}
+	item.Tags = encodeTags(req.Tags)
+	if err := dh.DB.Model(&item).Update("tags", item.Tags).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to tag case item"})
+		return
+	}
+
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: &dc.OrganizationID,
+		Action:         "ediscovery.items.tag",
+		TargetType:     "email",
+		TargetID:       item.EmailID.String(),
+		Detail:         item.Tags,
+	})
+
+	c.JSON(http.StatusOK, gin.H{"item": item})
+}
+
+// RemoveItem removes an email from a case
+// DELETE /api/ediscovery/cases/:id/items/:itemId
+func (dh *DiscoveryHandler) RemoveItem(c *gin.Context) {
+	dc, _, ok := dh.loadCase(c)
+	if !ok || !requireOpen(c, dc) {
+		return
+	}
+
+	var item database.DiscoveryItem
+	if err := dh.DB.First(&item, "id = ? AND case_id = ?", c.Param("itemId"), dc.ID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Case item not found"})
+		return
+	}
+	if err := dh.DB.Delete(&item).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove case item"})
+		return
+	}
+
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: &dc.OrganizationID,
+		Action:         "ediscovery.items.remove",
+		TargetType:     "email",
+		TargetID:       item.EmailID.String(),
+		Detail:         fmt.Sprintf("case %s", dc.ID),
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Case item removed"})
+}
+
+// CreateExport builds a case package of the case's items, or only those with a tag
+// POST /api/ediscovery/cases/:id/exports
+func (dh *DiscoveryHandler) CreateExport(c *gin.Context) {
+	dc, userID, ok := dh.loadCase(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Tag string `json:"tag"`
+	}
+	// The body is optional; without a tag the whole case is exported
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data", "details": err.Error()})
+		return
+	}
+
+	export, err := services.StartDiscoveryExport(dc, strings.TrimSpace(req.Tag), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start export"})
+		return
+	}
+
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: &dc.OrganizationID,
+		Action:         "ediscovery.export.create",
+		TargetType:     "discovery_export",
+		TargetID:       export.ID.String(),
+		Detail:         fmt.Sprintf("case %s, tag %q", dc.ID, export.Tag),
+	})
+
+	c.JSON(http.StatusAccepted, gin.H{"export": export})
+}
+
+// GetExports lists the exports of a case
+// GET /api/ediscovery/cases/:id/exports
+func (dh *DiscoveryHandler) GetExports(c *gin.Context) {
+	dc, _, ok := dh.loadCase(c)
+	if !ok {
+		return
+	}
+
+	var exports []database.DiscoveryExport
+	if err := dh.DB.Where("case_id = ?", dc.ID).Order("created_at DESC").Find(&exports).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch exports"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"exports": exports})
+}
+
+// DownloadExport streams a completed case package
+// GET /api/ediscovery/cases/:id/exports/:exportId/download
+func (dh *DiscoveryHandler) DownloadExport(c *gin.Context) {
+	dc, _, ok := dh.loadCase(c)
+	if !ok {
+		return
+	}
+
+	var export database.DiscoveryExport
+	if err := dh.DB.First(&export, "id = ? AND case_id = ?", c.Param("exportId"), dc.ID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Export not found"})
+		return
+	}
+	if export.Status != "completed" {
+		c.JSON(http.StatusConflict, gin.H{"error": "Export is not ready", "status": export.Status})
+		return
+	}
+
+	reader, err := storage.OpenEmailObject(c.Request.Context(), export.MinioPath)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open case package"})
+		return
+	}
+	defer reader.Close()
+
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: &dc.OrganizationID,
+		Action:         "ediscovery.export.download",
+		TargetType:     "discovery_export",
+		TargetID:       export.ID.String(),
+		Detail:         fmt.Sprintf("case %s, sha256 %s", dc.ID, export.PackageSHA256),
+	})
+
+	c.DataFromReader(http.StatusOK, export.PackageSize, "application/zip", reader, map[string]string{
+		"Content-Disposition": fmt.Sprintf(`attachment; filename="case-%s-%s.zip"`, dc.ID, export.ID),
+		"X-Content-SHA256":    export.PackageSHA256,
+	})
+}
@@ -1,14 +1,21 @@
 package handlers
 
 import (
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
+	"path"
 	"strconv"
+	"strings"
 
-	"emailprojectv2/auth"
 	"emailprojectv2/database"
+	"emailprojectv2/services"
 	"emailprojectv2/storage"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
 )
 
 type EmailHandler struct{}
@@ -24,27 +31,15 @@ func (h *EmailHandler) GetEmails(c *gin.Context) {
 		return
 	}
 
-	accountID := c.Param("id")
-	if accountID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Account ID required"})
+	accountID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account ID"})
 		return
 	}
 
-	// CRITICAL: Only end users can view email content
-	userClaims, exists := c.Get("user")
-	if exists {
-		claims := userClaims.(*auth.Claims)
-		if claims.RoleName != "end_user" {
-			c.JSON(http.StatusForbidden, gin.H{"error": "Only end users can view email content"})
-			return
-		}
-	}
-
-	// Verify account belongs to user
-	var account database.EmailAccount
-	err := database.DB.Where("id = ? AND user_id = ?", accountID, userID).First(&account).Error
-	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found or access denied"})
+	// Owners see their own accounts, other users need a grant with the metadata scope
+	access, ok := loadMailboxAccess(c, accountID, services.MailboxScopeMetadata)
+	if !ok {
 		return
 	}
 
@@ -70,11 +65,17 @@ func (h *EmailHandler) GetEmails(c *gin.Context) {
 	var emails []database.EmailIndex
 	var total int64
 
+	query := database.DB.Model(&database.EmailIndex{}).Where("account_id = ?", accountID)
+	if q := strings.TrimSpace(c.Query("q")); q != "" {
+		pattern := "%" + q + "%"
+		query = query.Where("subject ILIKE ? OR sender_email ILIKE ? OR sender_name ILIKE ?", pattern, pattern, pattern)
+	}
+
 	// Count total emails
-	database.DB.Model(&database.EmailIndex{}).Where("account_id = ?", accountID).Count(&total)
+	query.Session(&gorm.Session{}).Count(&total)
 
 	// Get paginated emails
-	err = database.DB.Where("account_id = ?", accountID).
+	err = query.
 		Order("date DESC").
 		Offset(offset).
 		Limit(limit).
@@ -85,6 +86,8 @@ func (h *EmailHandler) GetEmails(c *gin.Context) {
 		return
 	}
 
+	recordDelegatedAccess(c, access, "email.list", "email_account", accountID.String())
+
 	c.JSON(http.StatusOK, gin.H{
 		"emails": emails,
 		"pagination": gin.H{
@@ -103,16 +106,6 @@ func (h *EmailHandler) GetEmail(c *gin.Context) {
 		return
 	}
 
-	// CRITICAL: Only end users can view email details
-	userClaims, exists := c.Get("user")
-	if exists {
-		claims := userClaims.(*auth.Claims)
-		if claims.RoleName != "end_user" {
-			c.JSON(http.StatusForbidden, gin.H{"error": "Only end users can view email details"})
-			return
-		}
-	}
-
 	emailID := c.Param("id")
 	if emailID == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Email ID required"})
@@ -121,18 +114,25 @@ func (h *EmailHandler) GetEmail(c *gin.Context) {
 
 	// Get email index
 	var email database.EmailIndex
-	err := database.DB.Preload("Account").Where("id = ?", emailID).First(&email).Error
+	err := database.DB.Where("id = ?", emailID).First(&email).Error
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Email not found"})
 		return
 	}
 
-	// Check if email belongs to user
-	if email.Account.UserID.String() != userID {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+	// Reading the content of a shared account needs the content scope
+	access, ok := emailAccess(c, &email, "email.view", services.MailboxScopeContent)
+	if !ok {
 		return
 	}
 
+	recordAudit(c, database.AuditEvent{
+		Action:     "email.view",
+		TargetType: "email",
+		TargetID:   email.ID.String(),
+		Detail:     mailboxAccessDetail(access),
+	})
+
 	// Get full email content from MinIO
 	if email.MinioPath == "" {
 		c.JSON(http.StatusOK, gin.H{
@@ -162,4 +162,162 @@ func (h *EmailHandler) GetEmail(c *gin.Context) {
 		"full_email": fullEmailContent,
 		"message":    "Email content retrieved successfully",
 	})
-}
\ No newline at end of file
+}
+
+// GetEmailHistory returns the changes observed on the server for an archived email
+func (h *EmailHandler) GetEmailHistory(c *gin.Context) {
+	userID := c.GetString("user_id")
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User ID not found"})
+		return
+	}
+
+	emailID := c.Param("id")
+	if emailID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Email ID required"})
+		return
+	}
+
+	var email database.EmailIndex
+	err := database.DB.Where("id = ?", emailID).First(&email).Error
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Email not found"})
+		return
+	}
+
+	access, ok := emailAccess(c, &email, "email.history", services.MailboxScopeMetadata)
+	if !ok {
+		return
+	}
+	recordDelegatedAccess(c, access, "email.history", "email", email.ID.String())
+
+	var events []database.EmailEvent
+	if err := database.DB.Where("email_id = ?", email.ID).Order("detected_at ASC").Find(&events).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch email history"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"email_id":            email.ID,
+		"folder":              email.Folder,
+		"is_read":             email.IsRead,
+		"is_flagged":          email.IsFlagged,
+		"deleted_upstream_at": email.DeletedUpstreamAt,
+		"events":              events,
+	})
+}
+
+// emailAccess checks the current user's access to the account of an email
+// for a scope, like loadMailboxAccess, audit logging denied attempts under
+// the action. Denied emails are reported as not found.
+func emailAccess(c *gin.Context, email *database.EmailIndex, action, scope string) (*services.MailboxAccess, bool) {
+	userID, err := uuid.Parse(c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User ID not found"})
+		return nil, false
+	}
+	access, err := services.AccountAccess(userID, email.AccountID, scope)
+	if errors.Is(err, services.ErrMailboxAccessDenied) {
+		recordAudit(c, database.AuditEvent{
+			Action:     action,
+			TargetType: "email",
+			TargetID:   email.ID.String(),
+			Result:     services.AuditResultDenied,
+		})
+		c.JSON(http.StatusNotFound, gin.H{"error": "Email not found"})
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("❌ Failed to check access to email %s: %v", email.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check email access"})
+		return nil, false
+	}
+	if !ownerPermitted(c, access, scope) {
+		return nil, false
+	}
+	return access, true
+}
+
+// ExportEmail downloads the stored copy of an email: the original message when
+// the provider supplied one, and the archived document otherwise
+// GET /api/emails/:id/export
+func (h *EmailHandler) ExportEmail(c *gin.Context) {
+	var email database.EmailIndex
+	if err := database.DB.Where("id = ?", c.Param("id")).First(&email).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Email not found"})
+		return
+	}
+
+	access, ok := emailAccess(c, &email, "email.export", services.MailboxScopeExport)
+	if !ok {
+		return
+	}
+
+	objectPath, contentType, extension := email.RawMinioPath, "message/rfc822", "eml"
+	if objectPath == "" {
+		objectPath, contentType, extension = email.MinioPath, "application/json", "json"
+	}
+	if objectPath == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Email content not available in storage"})
+		return
+	}
+
+	reader, err := storage.OpenEmailObject(c.Request.Context(), objectPath)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open email"})
+		return
+	}
+	defer reader.Close()
+
+	recordAudit(c, database.AuditEvent{
+		Action:     "email.export",
+		TargetType: "email",
+		TargetID:   email.ID.String(),
+		Detail:     fmt.Sprintf("%s, %s", mailboxAccessDetail(access), path.Base(objectPath)),
+	})
+
+	c.DataFromReader(http.StatusOK, -1, contentType, reader, map[string]string{
+		"Content-Disposition": fmt.Sprintf(`attachment; filename="email-%s.%s"`, email.ID, extension),
+	})
+}
+
+// RestoreEmail puts an archived email back into its folder of the mailbox
+// POST /api/emails/:id/restore
+func (h *EmailHandler) RestoreEmail(c *gin.Context) {
+	var email database.EmailIndex
+	if err := database.DB.Where("id = ?", c.Param("id")).First(&email).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Email not found"})
+		return
+	}
+
+	access, ok := emailAccess(c, &email, "email.restore", services.MailboxScopeRestore)
+	if !ok {
+		return
+	}
+
+	err := services.RestoreEmail(c.Request.Context(), &access.Account, &email)
+	if errors.Is(err, services.ErrRestoreUnsupported) || errors.Is(err, services.ErrRestoreUnavailable) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+	event := database.AuditEvent{
+		Action:     "email.restore",
+		TargetType: "email",
+		TargetID:   email.ID.String(),
+		Detail:     fmt.Sprintf("%s, folder %s", mailboxAccessDetail(access), email.Folder),
+	}
+	if err != nil {
+		log.Printf("❌ Failed to restore email %s: %v", email.ID, err)
+		event.Result = services.AuditResultFailure
+		recordAudit(c, event)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to restore email to the mailbox"})
+		return
+	}
+	recordAudit(c, event)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":  "Email restored to the mailbox",
+		"email_id": email.ID,
+		"folder":   email.Folder,
+	})
+}
@@ -0,0 +1,198 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"emailprojectv2/database"
+	"emailprojectv2/middleware"
+	"emailprojectv2/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type IntegrityHandler struct {
+	DB *gorm.DB
+}
+
+func NewIntegrityHandler(db *gorm.DB) *IntegrityHandler {
+	return &IntegrityHandler{DB: db}
+}
+
+// requireAdmin rejects everyone without the system.manage permission
+func (ih *IntegrityHandler) requireAdmin(c *gin.Context) (uuid.UUID, bool) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return uuid.Nil, false
+	}
+	if !middleware.HasPermission(c, "system.manage") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
+		return uuid.Nil, false
+	}
+	return uuid.MustParse(userClaims.UserID), true
+}
+
+func pageParams(c *gin.Context) (int, int) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 1000 {
+		limit = 100
+	}
+	return page, limit
+}
+
+// StartRun seals pending digests and verifies the archive in the background
+// POST /api/admin/integrity/runs
+func (ih *IntegrityHandler) StartRun(c *gin.Context) {
+	adminID, ok := ih.requireAdmin(c)
+	if !ok {
+		return
+	}
+
+	run, err := services.Integrity.Start(&adminID)
+	if errors.Is(err, services.ErrIntegrityRunning) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start integrity verification"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, run)
+}
+
+// GetRuns lists recent verification runs
+// GET /api/admin/integrity/runs
+func (ih *IntegrityHandler) GetRuns(c *gin.Context) {
+	if _, ok := ih.requireAdmin(c); !ok {
+		return
+	}
+
+	var runs []database.IntegrityRun
+	if err := ih.DB.Order("started_at DESC").Limit(100).Find(&runs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch integrity runs"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"runs": runs})
+}
+
+// GetRun returns a verification run with the discrepancies it found
+// GET /api/admin/integrity/runs/:id?page=1&limit=100
+func (ih *IntegrityHandler) GetRun(c *gin.Context) {
+	if _, ok := ih.requireAdmin(c); !ok {
+		return
+	}
+
+	var run database.IntegrityRun
+	if err := ih.DB.First(&run, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Integrity run not found"})
+		return
+	}
+
+	page, limit := pageParams(c)
+
+	var total int64
+	ih.DB.Model(&database.IntegrityDiscrepancy{}).Where("run_id = ?", run.ID).Count(&total)
+
+	var discrepancies []database.IntegrityDiscrepancy
+	if err := ih.DB.Where("run_id = ?", run.ID).Order("created_at ASC").
+		Offset((page - 1) * limit).Limit(limit).Find(&discrepancies).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch integrity discrepancies"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"run":           run,
+		"discrepancies": discrepancies,
+		"pagination": gin.H{
+			"page":  page,
+			"limit": limit,
+			"total": total,
+		},
+	})
+}
+
+// GetDiscrepancies lists discrepancies across runs, newest first
+// GET /api/admin/integrity/discrepancies?account_id=...&kind=...&page=1&limit=100
+func (ih *IntegrityHandler) GetDiscrepancies(c *gin.Context) {
+	if _, ok := ih.requireAdmin(c); !ok {
+		return
+	}
+
+	query := ih.DB.Model(&database.IntegrityDiscrepancy{})
+	if accountID := c.Query("account_id"); accountID != "" {
+		if _, err := uuid.Parse(accountID); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account ID"})
+			return
+		}
+		query = query.Where("account_id = ?", accountID)
+	}
+	if kind := c.Query("kind"); kind != "" {
+		query = query.Where("kind = ?", kind)
+	}
+
+	page, limit := pageParams(c)
+
+	var total int64
+	query.Count(&total)
+
+	var discrepancies []database.IntegrityDiscrepancy
+	if err := query.Order("created_at DESC").Offset((page - 1) * limit).Limit(limit).Find(&discrepancies).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch integrity discrepancies"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"discrepancies": discrepancies,
+		"pagination": gin.H{
+			"page":  page,
+			"limit": limit,
+			"total": total,
+		},
+	})
+}
+
+// GetDigests returns the digest chain of an account, newest first. The latest
+// chain hash can be published elsewhere to anchor the whole history.
+// GET /api/admin/integrity/accounts/:accountId/digests?page=1&limit=100
+func (ih *IntegrityHandler) GetDigests(c *gin.Context) {
+	if _, ok := ih.requireAdmin(c); !ok {
+		return
+	}
+
+	accountID, err := uuid.Parse(c.Param("accountId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account ID"})
+		return
+	}
+
+	page, limit := pageParams(c)
+
+	var total int64
+	ih.DB.Model(&database.IntegrityDigest{}).Where("account_id = ?", accountID).Count(&total)
+
+	var digests []database.IntegrityDigest
+	if err := ih.DB.Where("account_id = ?", accountID).Order("day DESC").
+		Offset((page - 1) * limit).Limit(limit).Find(&digests).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch integrity digests"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"digests": digests,
+		"pagination": gin.H{
+			"page":  page,
+			"limit": limit,
+			"total": total,
+		},
+	})
+}
@@ -0,0 +1,376 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"emailprojectv2/auth"
+	"emailprojectv2/database"
+	"emailprojectv2/middleware"
+	"emailprojectv2/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type LegalHoldHandler struct {
+	DB *gorm.DB
+}
+
+func NewLegalHoldHandler(db *gorm.DB) *LegalHoldHandler {
+	return &LegalHoldHandler{DB: db}
+}
+
+type createLegalHoldRequest struct {
+	CaseName       string                       `json:"case_name" binding:"required"`
+	Description    string                       `json:"description"`
+	TargetType     string                       `json:"target_type" binding:"required,oneof=organization user account search"`
+	OrganizationID string                       `json:"organization_id"`
+	UserID         string                       `json:"user_id"`
+	AccountID      string                       `json:"account_id"`
+	SearchQuery    *services.HoldSearchCriteria `json:"search_query"`
+	Custodians     []string                     `json:"custodians"`
+}
+
+type updateLegalHoldRequest struct {
+	CaseName    *string  `json:"case_name"`
+	Description *string  `json:"description"`
+	Custodians  []string `json:"custodians"`
+}
+
+type releaseLegalHoldRequest struct {
+	Reason string `json:"reason" binding:"required"`
+}
+
+// canManageHold checks access to an existing hold through its organization
+func (lh *LegalHoldHandler) canManageHold(claims *auth.Claims, hold *database.LegalHold) bool {
+	if managesAllOrganizations(claims) {
+		return true
+	}
+	return hold.OrganizationID != nil && canManageOrganizationID(claims, *hold.OrganizationID)
+}
+
+func parseOptionalUUID(value string) (*uuid.UUID, error) {
+	if value == "" {
+		return nil, nil
+	}
+	id, err := uuid.Parse(value)
+	if err != nil {
+		return nil, err
+	}
+	return &id, nil
+}
+
+func encodeCustodians(custodians []string) string {
+	cleaned := []string{}
+	for _, custodian := range custodians {
+		if custodian = strings.TrimSpace(custodian); custodian != "" {
+			cleaned = append(cleaned, custodian)
+		}
+	}
+	data, _ := json.Marshal(cleaned)
+	return string(data)
+}
+
+// resolveTarget fills in the target of a new hold and the organization it
+// belongs to. User and account holds are filed under their owner's organization.
+func (lh *LegalHoldHandler) resolveTarget(req *createLegalHoldRequest, hold *database.LegalHold) error {
+	orgID, err := parseOptionalUUID(req.OrganizationID)
+	if err != nil {
+		return fmt.Errorf("invalid organization ID")
+	}
+
+	switch req.TargetType {
+	case services.HoldTargetOrganization:
+		if orgID == nil {
+			return fmt.Errorf("organization_id required for organization holds")
+		}
+		if err := lh.DB.First(&database.Organization{}, "id = ?", *orgID).Error; err != nil {
+			return fmt.Errorf("organization not found")
+		}
+		hold.OrganizationID = orgID
+	case services.HoldTargetUser:
+		userID, err := parseOptionalUUID(req.UserID)
+		if err != nil || userID == nil {
+			return fmt.Errorf("valid user_id required for user holds")
+		}
+		if err := lh.DB.First(&database.User{}, "id = ?", *userID).Error; err != nil {
+			return fmt.Errorf("user not found")
+		}
+		hold.UserID = userID
+		if hold.OrganizationID, err = services.UserOrganizationID(*userID); err != nil {
+			return err
+		}
+	case services.HoldTargetAccount:
+		accountID, err := parseOptionalUUID(req.AccountID)
+		if err != nil || accountID == nil {
+			return fmt.Errorf("valid account_id required for account holds")
+		}
+		if err := lh.DB.First(&database.EmailAccount{}, "id = ?", *accountID).Error; err != nil {
+			return fmt.Errorf("account not found")
+		}
+		hold.AccountID = accountID
+		if hold.OrganizationID, err = services.AccountOrganizationID(*accountID); err != nil {
+			return err
+		}
+	case services.HoldTargetSearch:
+		if req.SearchQuery == nil || req.SearchQuery.IsEmpty() {
+			return fmt.Errorf("search_query with at least one criterion required for search holds")
+		}
+		data, err := json.Marshal(req.SearchQuery)
+		if err != nil {
+			return fmt.Errorf("invalid search query")
+		}
+		hold.SearchQuery = string(data)
+		hold.OrganizationID = orgID
+	}
+	return nil
+}
+
+// GetLegalHolds lists legal holds the user can manage
+// GET /api/legal-holds?status=active|released&organization_id=...
+func (lh *LegalHoldHandler) GetLegalHolds(c *gin.Context) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	query := lh.DB.Model(&database.LegalHold{}).Preload("Organization")
+	if orgParam := c.Query("organization_id"); orgParam != "" {
+		orgID, err := uuid.Parse(orgParam)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid organization ID"})
+			return
+		}
+		if !canManageOrganizationID(userClaims, orgID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this organization"})
+			return
+		}
+		orgIDs, err := services.OrganizationSubtree(orgID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load organizations"})
+			return
+		}
+		query = query.Where("organization_id IN ?", orgIDs)
+	} else if !managesAllOrganizations(userClaims) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "organization_id required"})
+		return
+	}
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var holds []database.LegalHold
+	if err := query.Order("created_at DESC").Find(&holds).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch legal holds"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"legal_holds": holds})
+}
+
+// CreateLegalHold places a new legal hold
+// POST /api/legal-holds
+func (lh *LegalHoldHandler) CreateLegalHold(c *gin.Context) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var req createLegalHoldRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data", "details": err.Error()})
+		return
+	}
+
+	hold := database.LegalHold{
+		CaseName:    strings.TrimSpace(req.CaseName),
+		Description: req.Description,
+		TargetType:  req.TargetType,
+		SearchQuery: "{}",
+		Custodians:  encodeCustodians(req.Custodians),
+		Status:      services.HoldStatusActive,
+		CreatedBy:   uuid.MustParse(userClaims.UserID),
+	}
+	if err := lh.resolveTarget(&req, &hold); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Only admins may place holds outside any organization (e.g. a search across all accounts)
+	if !lh.canManageHold(userClaims, &hold) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to the hold target"})
+		return
+	}
+
+	if err := lh.DB.Create(&hold).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create legal hold"})
+		return
+	}
+	services.RecordHoldEvent(hold.ID, services.HoldEventCreated, &hold.CreatedBy, fmt.Sprintf("%s hold placed for case %s", hold.TargetType, hold.CaseName))
+
+	go services.ApplyHoldObjectLock(&hold)
+
+	c.JSON(http.StatusCreated, gin.H{"legal_hold": hold})
+}
+
+// GetLegalHold returns a legal hold with its audit trail
+// GET /api/legal-holds/:id
+func (lh *LegalHoldHandler) GetLegalHold(c *gin.Context) {
+	hold, ok := lh.loadHold(c)
+	if !ok {
+		return
+	}
+
+	var events []database.LegalHoldEvent
+	if err := lh.DB.Where("hold_id = ?", hold.ID).Order("created_at ASC").Find(&events).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch legal hold history"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"legal_hold": hold, "events": events})
+}
+
+// UpdateLegalHold changes the case details or custodians of an active hold.
+// The target cannot change; release the hold and place a new one instead.
+// PUT /api/legal-holds/:id
+func (lh *LegalHoldHandler) UpdateLegalHold(c *gin.Context) {
+	hold, ok := lh.loadHold(c)
+	if !ok {
+		return
+	}
+	if hold.Status != services.HoldStatusActive {
+		c.JSON(http.StatusConflict, gin.H{"error": "Released legal holds cannot be changed"})
+		return
+	}
+
+	var req updateLegalHoldRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data", "details": err.Error()})
+		return
+	}
+
+	updates := map[string]interface{}{}
+	if req.CaseName != nil {
+		if strings.TrimSpace(*req.CaseName) == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "case_name cannot be empty"})
+			return
+		}
+		updates["case_name"] = strings.TrimSpace(*req.CaseName)
+	}
+	if req.Description != nil {
+		updates["description"] = *req.Description
+	}
+	if req.Custodians != nil {
+		updates["custodians"] = encodeCustodians(req.Custodians)
+	}
+	if len(updates) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No changes provided"})
+		return
+	}
+
+	previousCustodians := hold.Custodians
+	if err := lh.DB.Model(hold).Updates(updates).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update legal hold"})
+		return
+	}
+	if name, ok := updates["case_name"].(string); ok {
+		hold.CaseName = name
+	}
+	if req.Description != nil {
+		hold.Description = *req.Description
+	}
+	if custodians, ok := updates["custodians"].(string); ok {
+		hold.Custodians = custodians
+	}
+
+	actorID := uuid.MustParse(c.GetString("user_id"))
+	if req.Custodians != nil && hold.Custodians != previousCustodians {
+		services.RecordHoldEvent(hold.ID, services.HoldEventCustodiansUpdated, &actorID, fmt.Sprintf("%s -> %s", previousCustodians, hold.Custodians))
+	}
+	if req.CaseName != nil || req.Description != nil {
+		services.RecordHoldEvent(hold.ID, services.HoldEventUpdated, &actorID, "case details updated")
+	}
+
+	c.JSON(http.StatusOK, gin.H{"legal_hold": hold})
+}
+
+// ReleaseLegalHold ends a legal hold. Held data becomes subject to retention
+// and deletion again unless another hold still covers it.
+// POST /api/legal-holds/:id/release
+func (lh *LegalHoldHandler) ReleaseLegalHold(c *gin.Context) {
+	hold, ok := lh.loadHold(c)
+	if !ok {
+		return
+	}
+	if hold.Status != services.HoldStatusActive {
+		c.JSON(http.StatusConflict, gin.H{"error": "Legal hold is already released"})
+		return
+	}
+
+	var req releaseLegalHoldRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A release reason is required", "details": err.Error()})
+		return
+	}
+
+	actorID := uuid.MustParse(c.GetString("user_id"))
+	now := time.Now()
+	err := lh.DB.Model(hold).Updates(map[string]interface{}{
+		"status":         services.HoldStatusReleased,
+		"released_by":    actorID,
+		"released_at":    now,
+		"release_reason": req.Reason,
+	}).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to release legal hold"})
+		return
+	}
+	hold.Status = services.HoldStatusReleased
+	hold.ReleasedBy = &actorID
+	hold.ReleasedAt = &now
+	hold.ReleaseReason = req.Reason
+	services.RecordHoldEvent(hold.ID, services.HoldEventReleased, &actorID, req.Reason)
+
+	go services.ReleaseHoldObjectLock(hold)
+
+	c.JSON(http.StatusOK, gin.H{"legal_hold": hold})
+}
+
+// loadHold fetches the hold named in the path and checks access to it
+func (lh *LegalHoldHandler) loadHold(c *gin.Context) (*database.LegalHold, bool) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return nil, false
+	}
+
+	holdID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid legal hold ID"})
+		return nil, false
+	}
+
+	var hold database.LegalHold
+	if err := lh.DB.Preload("Organization").First(&hold, "id = ?", holdID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Legal hold not found"})
+			return nil, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch legal hold"})
+		return nil, false
+	}
+
+	if !lh.canManageHold(userClaims, &hold) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this legal hold"})
+		return nil, false
+	}
+	return &hold, true
+}
@@ -0,0 +1,285 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"emailprojectv2/auth"
+	"emailprojectv2/database"
+	"emailprojectv2/middleware"
+	"emailprojectv2/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type MailboxGrantHandler struct {
+	DB *gorm.DB
+}
+
+func NewMailboxGrantHandler(db *gorm.DB) *MailboxGrantHandler {
+	return &MailboxGrantHandler{DB: db}
+}
+
+type createMailboxGrantRequest struct {
+	GranteeEmail string     `json:"grantee_email" binding:"required,email"`
+	Scopes       []string   `json:"scopes" binding:"required"` // metadata, content, export, restore
+	ExpiresAt    *time.Time `json:"expires_at" binding:"required"`
+	Reason       string     `json:"reason"`
+}
+
+// mailboxGrantResponse is a grant as shown to the people managing it
+type mailboxGrantResponse struct {
+	database.MailboxGrant
+	Scopes       []string `json:"scopes"`
+	GranteeEmail string   `json:"grantee_email,omitempty"`
+	Active       bool     `json:"active"`
+}
+
+func newMailboxGrantResponse(grant database.MailboxGrant) mailboxGrantResponse {
+	response := mailboxGrantResponse{
+		MailboxGrant: grant,
+		Scopes:       services.ParseMailboxScopes(grant.Scopes),
+		Active:       services.MailboxGrantActive(&grant, time.Now()),
+	}
+	if grant.Grantee != nil {
+		response.GranteeEmail = grant.Grantee.Email
+		response.MailboxGrant.Grantee = nil
+	}
+	return response
+}
+
+// loadSharableAccount loads the account in the path and checks that the
+// current user may share it: its owner, or a manager of the owner's
+// organization holding mailbox_grants.manage
+func (mgh *MailboxGrantHandler) loadSharableAccount(c *gin.Context) (*auth.Claims, *database.EmailAccount, bool) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return nil, nil, false
+	}
+	accountID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account ID"})
+		return nil, nil, false
+	}
+
+	var account database.EmailAccount
+	if err := mgh.DB.Preload("User.PrimaryOrg").First(&account, "id = ?", accountID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+			return nil, nil, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch account"})
+		return nil, nil, false
+	}
+
+	if account.UserID.String() == userClaims.UserID && middleware.HasPermission(c, "accounts.update") {
+		return userClaims, &account, true
+	}
+	if middleware.HasPermission(c, "mailbox_grants.manage") && canManageUser(userClaims, &account.User) {
+		return userClaims, &account, true
+	}
+
+	recordAudit(c, database.AuditEvent{
+		Action:     "mailbox.grant.manage",
+		TargetType: "email_account",
+		TargetID:   account.ID.String(),
+		Result:     services.AuditResultDenied,
+	})
+	c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+	return nil, nil, false
+}
+
+// GetGrants lists who an account is shared with
+// GET /api/accounts/:id/grants
+func (mgh *MailboxGrantHandler) GetGrants(c *gin.Context) {
+	_, account, ok := mgh.loadSharableAccount(c)
+	if !ok {
+		return
+	}
+
+	grants, err := services.AccountGrants(account.ID, c.Query("include_inactive") == "true")
+	if err != nil {
+		log.Printf("❌ Failed to load grants of account %s: %v", account.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch grants"})
+		return
+	}
+	responses := make([]mailboxGrantResponse, 0, len(grants))
+	for _, grant := range grants {
+		responses = append(responses, newMailboxGrantResponse(grant))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"account_id": account.ID,
+		"grants":     responses,
+		"scopes":     services.MailboxScopes,
+	})
+}
+
+// CreateGrant shares an account with another user until the grant expires
+// POST /api/accounts/:id/grants
+func (mgh *MailboxGrantHandler) CreateGrant(c *gin.Context) {
+	userClaims, account, ok := mgh.loadSharableAccount(c)
+	if !ok {
+		return
+	}
+
+	var req createMailboxGrantRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var grantee database.User
+	if err := mgh.DB.Where("LOWER(email) = ?", strings.ToLower(req.GranteeEmail)).First(&grantee).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
+		return
+	}
+
+	grant, err := services.GrantMailboxAccess(account, &grantee, req.Scopes, req.ExpiresAt, req.Reason, uuid.MustParse(userClaims.UserID))
+	if err != nil {
+		if errors.Is(err, services.ErrMailboxGrantInvalid) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		log.Printf("❌ Failed to share account %s: %v", account.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create grant"})
+		return
+	}
+
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: account.User.PrimaryOrgID,
+		Action:         "mailbox.grant.create",
+		TargetType:     "email_account",
+		TargetID:       account.ID.String(),
+		Detail:         fmt.Sprintf("grant %s to %s, scopes %s, expires %s", grant.ID, grantee.Email, grant.Scopes, grant.ExpiresAt.Format(time.RFC3339)),
+	})
+	log.Printf("🤝 Account %s shared with %s until %s", account.Email, grantee.Email, grant.ExpiresAt.Format(time.RFC3339))
+
+	grant.Grantee = &grantee
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Account shared successfully",
+		"grant":   newMailboxGrantResponse(*grant),
+	})
+}
+
+// RevokeGrant ends a grant before it expires
+// DELETE /api/accounts/:id/grants/:grantId
+func (mgh *MailboxGrantHandler) RevokeGrant(c *gin.Context) {
+	userClaims, account, ok := mgh.loadSharableAccount(c)
+	if !ok {
+		return
+	}
+	grantID, err := uuid.Parse(c.Param("grantId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid grant ID"})
+		return
+	}
+
+	grant, err := services.RevokeMailboxGrant(account.ID, grantID, uuid.MustParse(userClaims.UserID))
+	if err != nil {
+		if errors.Is(err, services.ErrMailboxGrantInvalid) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Grant not found"})
+			return
+		}
+		log.Printf("❌ Failed to revoke grant %s: %v", grantID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke grant"})
+		return
+	}
+
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: account.User.PrimaryOrgID,
+		Action:         "mailbox.grant.revoke",
+		TargetType:     "email_account",
+		TargetID:       account.ID.String(),
+		Detail:         fmt.Sprintf("grant %s to user %s", grant.ID, grant.GranteeID),
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Grant revoked successfully",
+		"grant":   newMailboxGrantResponse(*grant),
+	})
+}
+
+// ownerPermitted checks that an owner reaching their own account holds the
+// permission for the scope, and writes the response when they do not.
+// Delegated access is governed by the grant alone, so auditors whose role has
+// no mailbox permissions can use their grants.
+func ownerPermitted(c *gin.Context, access *services.MailboxAccess, scope string) bool {
+	if access.Delegated() {
+		return true
+	}
+	permission := services.MailboxScopePermission(scope)
+	if middleware.HasPermission(c, permission) {
+		return true
+	}
+	c.JSON(http.StatusForbidden, gin.H{
+		"error":               "Permission denied",
+		"required_permission": permission,
+	})
+	return false
+}
+
+// loadMailboxAccess resolves how the current user reaches an account for a
+// scope: as an owner holding the scope's permission, or through an active
+// grant with the scope. Denied delegated attempts are audit logged.
+func loadMailboxAccess(c *gin.Context, accountID uuid.UUID, scope string) (*services.MailboxAccess, bool) {
+	userID, err := uuid.Parse(c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User ID not found"})
+		return nil, false
+	}
+	access, err := services.AccountAccess(userID, accountID, scope)
+	if err != nil {
+		if errors.Is(err, services.ErrMailboxAccessDenied) {
+			recordAudit(c, database.AuditEvent{
+				Action:     "mailbox.access." + scope,
+				TargetType: "email_account",
+				TargetID:   accountID.String(),
+				Result:     services.AuditResultDenied,
+			})
+			c.JSON(http.StatusNotFound, gin.H{"error": "Account not found or access denied"})
+			return nil, false
+		}
+		log.Printf("❌ Failed to check access to account %s: %v", accountID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check account access"})
+		return nil, false
+	}
+	if !ownerPermitted(c, access, scope) {
+		return nil, false
+	}
+	return access, true
+}
+
+// mailboxAccessDetail describes an access for the audit log, naming the grant
+// when it is delegated
+func mailboxAccessDetail(access *services.MailboxAccess) string {
+	if !access.Delegated() {
+		return access.Account.ID.String()
+	}
+	return fmt.Sprintf("%s, delegated by grant %s from owner %s", access.Account.ID, access.Grant.ID, access.Account.UserID)
+}
+
+// recordDelegatedAccess audit logs a read made through a grant. Owners'
+// reads of their own mailboxes are not logged.
+func recordDelegatedAccess(c *gin.Context, access *services.MailboxAccess, action, targetType, targetID string) {
+	if !access.Delegated() {
+		return
+	}
+	recordAudit(c, database.AuditEvent{
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		Detail:     mailboxAccessDetail(access),
+	})
+}
@@ -0,0 +1,436 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"emailprojectv2/auth"
+	"emailprojectv2/database"
+	"emailprojectv2/middleware"
+	"emailprojectv2/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type assignOrganizationRequest struct {
+	OrganizationID string `json:"organization_id" binding:"required"`
+	RoleName       string `json:"role_name" binding:"required"`
+	IsPrimary      bool   `json:"is_primary"`
+}
+
+type assignRoleRequest struct {
+	OrganizationID string `json:"organization_id"` // Defaults to the primary organization
+	RoleName       string `json:"role_name" binding:"required"`
+}
+
+type switchOrganizationRequest struct {
+	OrganizationID string `json:"organization_id" binding:"required"`
+}
+
+// loadManagedUser loads the user in the path and checks that the current user
+// manages them. Users cannot change their own memberships.
+func (umh *UserManagementHandler) loadManagedUser(c *gin.Context) (*auth.Claims, *database.User, bool) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return nil, nil, false
+	}
+	userUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return nil, nil, false
+	}
+	if userClaims.UserID == userUUID.String() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot change your own organization memberships"})
+		return nil, nil, false
+	}
+
+	var user database.User
+	if err := umh.DB.Preload("PrimaryOrg").First(&user, userUUID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return nil, nil, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
+		return nil, nil, false
+	}
+	if !canManageUser(userClaims, &user) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "User not in accessible organization"})
+		return nil, nil, false
+	}
+	return userClaims, &user, true
+}
+
+// loadManagedOrganization loads an organization the current user manages
+func (umh *UserManagementHandler) loadManagedOrganization(c *gin.Context, userClaims *auth.Claims, orgParam string) (*database.Organization, bool) {
+	orgID, err := uuid.Parse(orgParam)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid organization ID"})
+		return nil, false
+	}
+	var org database.Organization
+	if err := umh.DB.First(&org, "id = ?", orgID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Organization not found"})
+			return nil, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch organization"})
+		return nil, false
+	}
+	if !canManageOrganization(userClaims, &org) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot assign users to this organization"})
+		return nil, false
+	}
+	return &org, true
+}
+
+// loadAssignableRole loads a role the current user may give in an organization
+func (umh *UserManagementHandler) loadAssignableRole(c *gin.Context, userClaims *auth.Claims, org *database.Organization, roleName string) (*database.Role, bool) {
+	var role database.Role
+	if err := umh.DB.Where("name = ? AND is_active = ?", roleName, true).First(&role).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role"})
+		return nil, false
+	}
+	// Current user cannot assign a role higher than their own
+	if !canAssignLevel(userClaims, role.Level) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot assign role higher than your own"})
+		return nil, false
+	}
+	if !services.RoleGrantableIn(org.Type, role.Level) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Users of a %s organization cannot hold the %s role", org.Type, role.Name)})
+		return nil, false
+	}
+	return &role, true
+}
+
+// GetUserOrganizations lists the organizations a user belongs to and their role in each
+// GET /api/users/:id/organizations
+func (umh *UserManagementHandler) GetUserOrganizations(c *gin.Context) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+	userUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var user database.User
+	if err := umh.DB.Preload("PrimaryOrg").First(&user, userUUID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
+		return
+	}
+	if !canManageUser(userClaims, &user) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "User not in accessible organization"})
+		return
+	}
+
+	memberships, err := services.UserMemberships(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch organizations"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"organizations": memberships})
+}
+
+// AssignOrganization adds a user to an organization with a role, or changes
+// their role in it. With is_primary the organization becomes their primary one.
+// POST /api/users/:id/assign-organization
+func (umh *UserManagementHandler) AssignOrganization(c *gin.Context) {
+	userClaims, user, ok := umh.loadManagedUser(c)
+	if !ok {
+		return
+	}
+
+	var req assignOrganizationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data", "details": err.Error()})
+		return
+	}
+	org, ok := umh.loadManagedOrganization(c, userClaims, req.OrganizationID)
+	if !ok {
+		return
+	}
+	role, ok := umh.loadAssignableRole(c, userClaims, org, req.RoleName)
+	if !ok {
+		return
+	}
+
+	existing, err := services.FindMembership(user.ID, org.ID)
+	if err != nil && !errors.Is(err, services.ErrMembershipNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch membership"})
+		return
+	}
+	if existing != nil && !canAssignLevel(userClaims, existing.Role.Level) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot change a role higher than your own"})
+		return
+	}
+	var quotaWarnings []services.QuotaWarning
+	if existing == nil {
+		// The user counts against the limits of the organization and its ancestors
+		quotaWarnings, err = services.CheckQuota(org.ID, services.QuotaUsers, 1)
+		if respondQuotaError(c, err) {
+			return
+		}
+	}
+
+	created, err := services.AssignMembership(user.ID, org.ID, role.ID, req.IsPrimary)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to assign organization"})
+		return
+	}
+
+	// Tokens carry the role and organization, so sessions issued before a change are ended
+	revokeReason := ""
+	if req.IsPrimary && (existing == nil || !existing.IsPrimary) {
+		revokeReason = services.SessionRevokedOrg
+	} else if existing != nil && existing.RoleID != role.ID {
+		revokeReason = services.SessionRevokedRole
+	}
+	var revoked int64
+	if revokeReason != "" {
+		if revoked, err = services.RevokeUserSessions(user.ID, revokeReason); err != nil {
+			log.Printf("⚠️ Failed to revoke sessions of user %s: %v", user.ID, err)
+		}
+	}
+
+	membership, err := services.FindMembership(user.ID, org.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch membership"})
+		return
+	}
+
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: &org.ID,
+		Action:         "user.assign_organization",
+		TargetType:     "user",
+		TargetID:       user.ID.String(),
+		Detail:         fmt.Sprintf("%s as %s, primary: %t, %d sessions revoked", org.Name, role.Name, membership.IsPrimary, revoked),
+	})
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	c.JSON(status, withQuotaWarnings(gin.H{"membership": membership, "sessions_revoked": revoked}, quotaWarnings))
+}
+
+// AssignRole changes a user's role in one of their organizations
+// POST /api/users/:id/assign-role
+func (umh *UserManagementHandler) AssignRole(c *gin.Context) {
+	userClaims, user, ok := umh.loadManagedUser(c)
+	if !ok {
+		return
+	}
+
+	var req assignRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data", "details": err.Error()})
+		return
+	}
+	if req.OrganizationID == "" {
+		if user.PrimaryOrgID == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "User has no primary organization; organization_id is required"})
+			return
+		}
+		req.OrganizationID = user.PrimaryOrgID.String()
+	}
+	org, ok := umh.loadManagedOrganization(c, userClaims, req.OrganizationID)
+	if !ok {
+		return
+	}
+	role, ok := umh.loadAssignableRole(c, userClaims, org, req.RoleName)
+	if !ok {
+		return
+	}
+
+	existing, err := services.FindMembership(user.ID, org.ID)
+	if errors.Is(err, services.ErrMembershipNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch membership"})
+		return
+	}
+	// The role being replaced must not be above the current user's either
+	if !canAssignLevel(userClaims, existing.Role.Level) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot change a role higher than your own"})
+		return
+	}
+
+	if _, err := services.AssignMembership(user.ID, org.ID, role.ID, false); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to assign role"})
+		return
+	}
+	var revoked int64
+	if existing.RoleID != role.ID {
+		if revoked, err = services.RevokeUserSessions(user.ID, services.SessionRevokedRole); err != nil {
+			log.Printf("⚠️ Failed to revoke sessions of user %s: %v", user.ID, err)
+		}
+	}
+
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: &org.ID,
+		Action:         "user.assign_role",
+		TargetType:     "user",
+		TargetID:       user.ID.String(),
+		Detail:         fmt.Sprintf("%s to %s in %s, %d sessions revoked", existing.Role.Name, role.Name, org.Name, revoked),
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":          "Role assigned",
+		"organization_id":  org.ID,
+		"role":             role,
+		"sessions_revoked": revoked,
+	})
+}
+
+// RemoveOrganization removes a user from an organization, revoking their
+// role in it. The primary organization cannot be removed.
+// DELETE /api/users/:id/organizations/:orgId
+func (umh *UserManagementHandler) RemoveOrganization(c *gin.Context) {
+	userClaims, user, ok := umh.loadManagedUser(c)
+	if !ok {
+		return
+	}
+	org, ok := umh.loadManagedOrganization(c, userClaims, c.Param("orgId"))
+	if !ok {
+		return
+	}
+
+	existing, err := services.FindMembership(user.ID, org.ID)
+	if errors.Is(err, services.ErrMembershipNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch membership"})
+		return
+	}
+	if !canAssignLevel(userClaims, existing.Role.Level) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot revoke a role higher than your own"})
+		return
+	}
+
+	if err := services.RemoveMembership(user.ID, org.ID); err != nil {
+		if errors.Is(err, services.ErrPrimaryMembership) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove organization"})
+		return
+	}
+	revoked, err := services.RevokeUserSessions(user.ID, services.SessionRevokedOrg)
+	if err != nil {
+		log.Printf("⚠️ Failed to revoke sessions of user %s: %v", user.ID, err)
+	}
+
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: &org.ID,
+		Action:         "user.remove_organization",
+		TargetType:     "user",
+		TargetID:       user.ID.String(),
+		Detail:         fmt.Sprintf("%s (%s), %d sessions revoked", org.Name, existing.Role.Name, revoked),
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "User removed from organization", "sessions_revoked": revoked})
+}
+
+// GetMyOrganizations lists the organizations the current user can switch to
+// GET /api/me/organizations
+func (h *AuthHandler) GetMyOrganizations(c *gin.Context) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	memberships, err := services.UserMemberships(uuid.MustParse(userClaims.UserID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch organizations"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"organizations":          memberships,
+		"active_organization_id": userClaims.OrganizationID,
+	})
+}
+
+// SwitchOrganization makes another of the user's organizations the active one
+// of their session and returns an access token with their role in it. The
+// session keeps the organization when it is refreshed.
+// POST /api/me/switch-organization
+func (h *AuthHandler) SwitchOrganization(c *gin.Context) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+	sessionID, err := uuid.Parse(userClaims.SessionID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Only login sessions can switch organization"})
+		return
+	}
+
+	var req switchOrganizationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data", "details": err.Error()})
+		return
+	}
+	orgID, err := uuid.Parse(req.OrganizationID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid organization ID"})
+		return
+	}
+
+	userID := uuid.MustParse(userClaims.UserID)
+	membership, err := services.SetSessionOrganization(sessionID, userID, orgID)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrMembershipNotFound):
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		case errors.Is(err, services.ErrSessionRevoked):
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Session is no longer valid, please log in again"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to switch organization"})
+		}
+		return
+	}
+
+	var user database.User
+	if err := database.DB.Preload("Role").Preload("PrimaryOrg").First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
+		return
+	}
+	token, err := h.accessToken(&user, sessionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: &orgID,
+		Action:         "auth.switch_organization",
+		TargetType:     "session",
+		TargetID:       sessionID.String(),
+		Detail:         fmt.Sprintf("%s as %s", membership.Organization.Name, membership.Role.Name),
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"token":        token,
+		"expires_in":   int(auth.AccessTokenTTL.Seconds()),
+		"organization": membership.Organization,
+		"role":         membership.Role,
+	})
+}
@@ -0,0 +1,543 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"emailprojectv2/database"
+	"emailprojectv2/middleware"
+	"emailprojectv2/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type MFAHandler struct {
+	DB *gorm.DB
+}
+
+func NewMFAHandler(db *gorm.DB) *MFAHandler {
+	return &MFAHandler{DB: db}
+}
+
+type mfaCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+type mfaChallengeRequest struct {
+	ChallengeToken string `json:"challenge_token" binding:"required"`
+	Code           string `json:"code"`
+}
+
+type mfaPolicyRequest struct {
+	RequiredLevels []int `json:"required_levels"`
+}
+
+// respondMFAError writes the response for a failed MFA operation
+func respondMFAError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrMFAInvalidCode):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrMFAChallengeInvalid):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrMFANotEnrolled),
+		errors.Is(err, services.ErrMFAAlreadyEnrolled),
+		errors.Is(err, services.ErrMFAEnrollmentNeeded),
+		errors.Is(err, services.ErrMFARequired):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		log.Printf("❌ MFA operation failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Multi-factor authentication failed"})
+	}
+}
+
+// mfaLoginChallenge decides whether a login with a correct password needs a
+// second factor. When it does, it issues a challenge, writes the response and
+// returns true.
+func (h *AuthHandler) mfaLoginChallenge(c *gin.Context, user *database.User) bool {
+	enabled, err := services.MFAEnabled(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check multi-factor authentication"})
+		return true
+	}
+	required := false
+	if !enabled {
+		if required, err = services.MFARequired(user.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check multi-factor authentication"})
+			return true
+		}
+	}
+	if !enabled && !required {
+		return false
+	}
+
+	token, expiresAt, err := services.CreateMFAChallenge(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start multi-factor authentication"})
+		return true
+	}
+
+	roleName, _, _, _ := tokenIdentity(user)
+	recordAudit(c, database.AuditEvent{
+		ActorID:        &user.ID,
+		ActorRole:      roleName,
+		OrganizationID: user.PrimaryOrgID,
+		Action:         "auth.mfa_challenge",
+		TargetType:     "user",
+		TargetID:       user.ID.String(),
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"mfa_required":            true,
+		"mfa_enrollment_required": !enabled,
+		"challenge_token":         token,
+		"expires_at":              expiresAt,
+	})
+	return true
+}
+
+// EnrollMFAChallenge starts TOTP enrollment for a user whose login is waiting
+// on a challenge because an organization policy requires MFA
+// POST /auth/mfa/enroll
+func (h *AuthHandler) EnrollMFAChallenge(c *gin.Context) {
+	var req mfaChallengeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	challenge, err := services.LoadMFAChallenge(req.ChallengeToken)
+	if err != nil {
+		respondMFAError(c, err)
+		return
+	}
+	var user database.User
+	if err := database.DB.First(&user, challenge.UserID).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		return
+	}
+
+	enrollment, err := services.StartMFAEnrollment(user.ID, user.Email)
+	if err != nil {
+		respondMFAError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"enrollment": enrollment})
+}
+
+// VerifyMFA completes a login by answering its challenge with a TOTP code or
+// a recovery code. A user enrolling during login confirms the enrollment
+// here and receives their recovery codes. Wrong codes count towards the
+// account lockout, and the failed logins are cleared only on success.
+// POST /auth/mfa/verify
+func (h *AuthHandler) VerifyMFA(c *gin.Context) {
+	var req mfaChallengeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "code is required"})
+		return
+	}
+
+	// Codes are guessed like passwords, so they count towards the same
+	// address rate limit and account lockout
+	if respondLoginBlocked(c, services.CheckIPAllowed(c.ClientIP())) {
+		return
+	}
+	challenge, err := services.LoadMFAChallenge(req.ChallengeToken)
+	if err != nil {
+		if errors.Is(err, services.ErrMFAChallengeInvalid) {
+			services.RecordIPFailure(c.ClientIP())
+		}
+		respondMFAError(c, err)
+		return
+	}
+	var user database.User
+	if err := database.DB.Preload("Role").Preload("PrimaryOrg").First(&user, challenge.UserID).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		return
+	}
+	if err := services.CheckLoginAllowed(c.ClientIP(), &user); err != nil {
+		recordAudit(c, database.AuditEvent{
+			ActorID:        &user.ID,
+			OrganizationID: user.PrimaryOrgID,
+			Action:         "auth.login",
+			TargetType:     "user",
+			TargetID:       user.ID.String(),
+			Result:         services.AuditResultDenied,
+			Detail:         err.Error(),
+		})
+		respondLoginBlocked(c, err)
+		return
+	}
+
+	_, recoveryCodes, err := services.AnswerMFAChallenge(req.ChallengeToken, req.Code)
+	if err != nil {
+		if errors.Is(err, services.ErrMFAInvalidCode) {
+			detail := "invalid MFA code"
+			lockedUntil, err := services.RecordLoginFailure(c.ClientIP(), &user)
+			if err != nil {
+				log.Printf("❌ %v", err)
+			}
+			if lockedUntil != nil {
+				detail = fmt.Sprintf("invalid MFA code, account locked until %s", lockedUntil.Format(time.RFC3339))
+			}
+			recordAudit(c, database.AuditEvent{
+				ActorID:        &user.ID,
+				OrganizationID: user.PrimaryOrgID,
+				Action:         "auth.login",
+				TargetType:     "user",
+				TargetID:       user.ID.String(),
+				Result:         services.AuditResultFailure,
+				Detail:         detail,
+			})
+		}
+		respondMFAError(c, err)
+		return
+	}
+	if err := services.RecordLoginSuccess(&user); err != nil {
+		log.Printf("⚠️ %v", err)
+	}
+
+	tokens, err := h.startSession(c, &user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	roleName, _, _, _ := tokenIdentity(&user)
+	recordAudit(c, database.AuditEvent{
+		ActorID:        &user.ID,
+		ActorRole:      roleName,
+		OrganizationID: user.PrimaryOrgID,
+		Action:         "auth.login",
+		TargetType:     "user",
+		TargetID:       user.ID.String(),
+		Detail:         "password and MFA",
+	})
+
+	tokens["user"] = map[string]interface{}{
+		"id":          user.ID,
+		"email":       user.Email,
+		"role":        user.Role,
+		"primary_org": user.PrimaryOrg,
+		"created_at":  user.CreatedAt,
+	}
+	if recoveryCodes != nil {
+		tokens["recovery_codes"] = recoveryCodes
+	}
+	c.JSON(http.StatusOK, tokens)
+}
+
+// GetMFAStatus returns the current user's multi-factor authentication status
+// GET /api/me/mfa
+func (mh *MFAHandler) GetMFAStatus(c *gin.Context) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	status, err := services.GetMFAStatus(uuid.MustParse(userClaims.UserID))
+	if err != nil {
+		respondMFAError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"mfa": status})
+}
+
+// StartEnrollment creates a TOTP secret for the current user. It is not used
+// for logins until confirmed with a code.
+// POST /api/me/mfa/enroll
+func (mh *MFAHandler) StartEnrollment(c *gin.Context) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	enrollment, err := services.StartMFAEnrollment(uuid.MustParse(userClaims.UserID), userClaims.Email)
+	if err != nil {
+		respondMFAError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"enrollment": enrollment})
+}
+
+// ConfirmEnrollment enables MFA for the current user and returns the recovery codes
+// POST /api/me/mfa/confirm
+func (mh *MFAHandler) ConfirmEnrollment(c *gin.Context) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var req mfaCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	codes, err := services.ConfirmMFAEnrollment(uuid.MustParse(userClaims.UserID), req.Code)
+	if err != nil {
+		respondMFAError(c, err)
+		return
+	}
+
+	recordAudit(c, database.AuditEvent{
+		Action:     "user.mfa_enable",
+		TargetType: "user",
+		TargetID:   userClaims.UserID,
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Multi-factor authentication enabled", "recovery_codes": codes})
+}
+
+// RegenerateRecoveryCodes replaces the current user's recovery codes. A
+// current code is required so a stolen session cannot take over the account.
+// POST /api/me/mfa/recovery-codes
+func (mh *MFAHandler) RegenerateRecoveryCodes(c *gin.Context) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var req mfaCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID := uuid.MustParse(userClaims.UserID)
+	if err := services.VerifyMFACode(userID, req.Code); err != nil {
+		respondMFAError(c, err)
+		return
+	}
+	codes, err := services.RegenerateRecoveryCodes(userID)
+	if err != nil {
+		respondMFAError(c, err)
+		return
+	}
+
+	recordAudit(c, database.AuditEvent{
+		Action:     "user.mfa_recovery_codes",
+		TargetType: "user",
+		TargetID:   userClaims.UserID,
+	})
+
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+// DisableMFA turns off MFA for the current user after checking a current
+// code. Users whose organization requires MFA cannot turn it off.
+// POST /api/me/mfa/disable
+func (mh *MFAHandler) DisableMFA(c *gin.Context) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var req mfaCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID := uuid.MustParse(userClaims.UserID)
+	required, err := services.MFARequired(userID)
+	if err != nil {
+		respondMFAError(c, err)
+		return
+	}
+	if required {
+		respondMFAError(c, services.ErrMFARequired)
+		return
+	}
+	if err := services.VerifyMFACode(userID, req.Code); err != nil {
+		respondMFAError(c, err)
+		return
+	}
+	if err := services.DisableMFA(userID); err != nil {
+		respondMFAError(c, err)
+		return
+	}
+
+	recordAudit(c, database.AuditEvent{
+		Action:     "user.mfa_disable",
+		TargetType: "user",
+		TargetID:   userClaims.UserID,
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Multi-factor authentication disabled"})
+}
+
+// ResetUserMFA removes the enrollment of a user who lost their authenticator
+// and their recovery codes. If their organization requires MFA they enroll
+// again at their next login.
+// DELETE /api/users/:id/mfa
+func (mh *MFAHandler) ResetUserMFA(c *gin.Context) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+	userUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	if userClaims.UserID == userUUID.String() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot reset your own multi-factor authentication"})
+		return
+	}
+
+	var user database.User
+	if err := mh.DB.Preload("PrimaryOrg").First(&user, userUUID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
+		return
+	}
+	if !canManageUser(userClaims, &user) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "User not in accessible organization"})
+		return
+	}
+
+	if err := services.DisableMFA(userUUID); err != nil {
+		respondMFAError(c, err)
+		return
+	}
+
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: user.PrimaryOrgID,
+		Action:         "user.mfa_reset",
+		TargetType:     "user",
+		TargetID:       user.ID.String(),
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Multi-factor authentication reset"})
+}
+
+// loadPolicyOrganization parses the organization in the path and checks that
+// the user may manage it
+func (mh *MFAHandler) loadPolicyOrganization(c *gin.Context) (uuid.UUID, bool) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return uuid.Nil, false
+	}
+	orgID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid organization ID"})
+		return uuid.Nil, false
+	}
+
+	var org database.Organization
+	if err := mh.DB.First(&org, "id = ?", orgID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Organization not found"})
+			return uuid.Nil, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch organization"})
+		return uuid.Nil, false
+	}
+	if !canManageOrganization(userClaims, &org) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this organization"})
+		return uuid.Nil, false
+	}
+	return orgID, true
+}
+
+// GetMFAPolicy returns the role levels an organization requires MFA for
+// GET /api/organizations/:id/mfa-policy
+func (mh *MFAHandler) GetMFAPolicy(c *gin.Context) {
+	orgID, ok := mh.loadPolicyOrganization(c)
+	if !ok {
+		return
+	}
+
+	var settings database.OrganizationSettings
+	err := mh.DB.Where("org_id = ?", orgID).First(&settings).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch organization settings"})
+		return
+	}
+
+	levels := []int{}
+	if settings.MFARequiredLevels != "" {
+		json.Unmarshal([]byte(settings.MFARequiredLevels), &levels)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"organization_id": orgID, "required_levels": levels})
+}
+
+// UpdateMFAPolicy sets the role levels an organization requires MFA for. The
+// policy also covers the organization's descendants.
+// PUT /api/organizations/:id/mfa-policy
+func (mh *MFAHandler) UpdateMFAPolicy(c *gin.Context) {
+	orgID, ok := mh.loadPolicyOrganization(c)
+	if !ok {
+		return
+	}
+
+	var req mfaPolicyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data", "details": err.Error()})
+		return
+	}
+	seen := map[int]bool{}
+	levels := []int{}
+	for _, level := range req.RequiredLevels {
+		if level < 1 || level > 5 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Role levels must be between 1 and 5"})
+			return
+		}
+		if !seen[level] {
+			seen[level] = true
+			levels = append(levels, level)
+		}
+	}
+	sort.Ints(levels)
+	encoded, _ := json.Marshal(levels)
+
+	var settings database.OrganizationSettings
+	err := mh.DB.Where("org_id = ?", orgID).First(&settings).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		settings = database.OrganizationSettings{OrgID: orgID}
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch organization settings"})
+		return
+	}
+
+	settings.MFARequiredLevels = string(encoded)
+	if err := mh.DB.Save(&settings).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update MFA policy"})
+		return
+	}
+
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: &orgID,
+		Action:         "organization.mfa_policy",
+		TargetType:     "organization",
+		TargetID:       orgID.String(),
+		Detail:         string(encoded),
+	})
+
+	c.JSON(http.StatusOK, gin.H{"organization_id": orgID, "required_levels": levels})
+}
@@ -1,9 +1,13 @@
 package handlers
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 
+	"emailprojectv2/auth"
 	"emailprojectv2/database"
 	"emailprojectv2/middleware"
 	"emailprojectv2/services"
@@ -49,12 +53,6 @@ func (oh *OrganizationHandler) CreateOrganization(c *gin.Context) {
 		return
 	}
 
-	// Check permissions based on user role
-	if userClaims.RoleLevel > 3 {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions to create organizations"})
-		return
-	}
-
 	// Validate parent organization if specified
 	var parentOrgID *uuid.UUID
 	if req.ParentOrgID != "" {
@@ -70,19 +68,16 @@ func (oh *OrganizationHandler) CreateOrganization(c *gin.Context) {
 			return
 		}
 
-		// Admin users can create organizations under any parent, others need permission
-		if userClaims.RoleName != "admin" {
-			// Check if user can manage the parent organization
-			if !parentOrg.CanUserManage(oh.DB, uuid.MustParse(userClaims.UserID)) {
-				c.JSON(http.StatusForbidden, gin.H{"error": "Cannot create organization under this parent"})
-				return
-			}
+		// Check if user can manage the parent organization
+		if !canManageOrganization(userClaims, &parentOrg) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Cannot create organization under this parent"})
+			return
 		}
 
 		parentOrgID = &parentID
 	} else {
-		// If no parent specified, admin users can create under system organization
-		if userClaims.RoleName == "admin" {
+		// If no parent specified, those managing all organizations create under the system organization
+		if managesAllOrganizations(userClaims) {
 			var systemOrg database.Organization
 			if err := oh.DB.Where("type = ?", "system").First(&systemOrg).Error; err == nil {
 				parentOrgID = &systemOrg.ID
@@ -111,6 +106,14 @@ func (oh *OrganizationHandler) CreateOrganization(c *gin.Context) {
 	// Load relationships for response
 	oh.DB.Preload("ParentOrg").Preload("Creator").First(&organization, organization.ID)
 
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: &organization.ID,
+		Action:         "organization.create",
+		TargetType:     "organization",
+		TargetID:       organization.ID.String(),
+		Detail:         organization.Type + " " + organization.Name,
+	})
+
 	c.JSON(http.StatusCreated, organization)
 }
 
@@ -127,16 +130,12 @@ func (oh *OrganizationHandler) GetOrganizations(c *gin.Context) {
 	var organizations []database.Organization
 	query := oh.DB.Preload("ParentOrg").Preload("Creator").Preload("ChildOrgs")
 
-	// Filter based on user role and organization
-	if userClaims.RoleName == "admin" {
-		// Admin can see all organizations
+	// Filter based on user permissions and organization
+	if managesAllOrganizations(userClaims) {
+		// Can see all organizations
 		query = query.Find(&organizations)
-	} else if userClaims.RoleName == "distributor" {
-		// Distributor can see their organization and child organizations
-		userOrgID, _ := uuid.Parse(userClaims.OrganizationID)
-		query = query.Where("id = ? OR parent_org_id = ?", userOrgID, userOrgID).Find(&organizations)
-	} else if userClaims.RoleName == "dealer" {
-		// Dealer can see their organization and child organizations
+	} else if middleware.HasPermission(c, "organizations.create") {
+		// Resellers can see their organization and child organizations
 		userOrgID, _ := uuid.Parse(userClaims.OrganizationID)
 		query = query.Where("id = ? OR parent_org_id = ?", userOrgID, userOrgID).Find(&organizations)
 	} else {
@@ -181,7 +180,7 @@ func (oh *OrganizationHandler) GetOrganization(c *gin.Context) {
 	}
 
 	// Check if user can access this organization
-	if userClaims.RoleName != "admin" && !organization.CanUserManage(oh.DB, uuid.MustParse(userClaims.UserID)) {
+	if !canManageOrganization(userClaims, &organization) {
 		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this organization"})
 		return
 	}
@@ -231,7 +230,7 @@ func (oh *OrganizationHandler) UpdateOrganization(c *gin.Context) {
 	}
 
 	// Check if user can manage this organization
-	if userClaims.RoleName != "admin" && !organization.CanUserManage(oh.DB, uuid.MustParse(userClaims.UserID)) {
+	if !canManageOrganization(userClaims, &organization) {
 		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot modify this organization"})
 		return
 	}
@@ -261,6 +260,13 @@ func (oh *OrganizationHandler) UpdateOrganization(c *gin.Context) {
 	// Load relationships for response
 	oh.DB.Preload("ParentOrg").Preload("Creator").First(&organization, organization.ID)
 
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: &organization.ID,
+		Action:         "organization.update",
+		TargetType:     "organization",
+		TargetID:       organization.ID.String(),
+	})
+
 	c.JSON(http.StatusOK, organization)
 }
 
@@ -281,12 +287,6 @@ func (oh *OrganizationHandler) DeleteOrganization(c *gin.Context) {
 		return
 	}
 
-	// Only admin and distributors can delete organizations
-	if userClaims.RoleLevel > 2 {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions to delete organizations"})
-		return
-	}
-
 	// Find the organization
 	var organization database.Organization
 	if err := oh.DB.First(&organization, orgUUID).Error; err != nil {
@@ -299,7 +299,7 @@ func (oh *OrganizationHandler) DeleteOrganization(c *gin.Context) {
 	}
 
 	// Check if user can manage this organization
-	if userClaims.RoleName != "admin" && !organization.CanUserManage(oh.DB, uuid.MustParse(userClaims.UserID)) {
+	if !canManageOrganization(userClaims, &organization) {
 		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot delete this organization"})
 		return
 	}
@@ -311,9 +311,175 @@ func (oh *OrganizationHandler) DeleteOrganization(c *gin.Context) {
 		return
 	}
 
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: &organization.ID,
+		Action:         "organization.delete",
+		TargetType:     "organization",
+		TargetID:       organization.ID.String(),
+	})
+
 	c.JSON(http.StatusOK, gin.H{"message": "Organization deactivated successfully"})
 }
 
+// respondOrgChangeError writes the response for a failed move or merge
+func respondOrgChangeError(c *gin.Context, err error, action string) {
+	var hierarchyErr *services.OrgHierarchyError
+	switch {
+	case services.IsQuotaError(err):
+		respondQuotaError(c, err)
+	case errors.As(err, &hierarchyErr),
+		errors.Is(err, services.ErrOrgMoveCycle),
+		errors.Is(err, services.ErrOrgMoveSystem),
+		errors.Is(err, services.ErrOrgMoveSameParent),
+		errors.Is(err, services.ErrOrgMergeSame),
+		errors.Is(err, services.ErrOrgMergeType),
+		errors.Is(err, services.ErrOrgMergeChildren):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to " + action + " organization", "details": err.Error()})
+	}
+}
+
+// loadManagedOrganization loads an organization the current user may restructure
+func (oh *OrganizationHandler) loadManagedOrganization(c *gin.Context, claims *auth.Claims, id uuid.UUID, label string) (*database.Organization, bool) {
+	var organization database.Organization
+	if err := oh.DB.First(&organization, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": label + " not found"})
+			return nil, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch organization"})
+		return nil, false
+	}
+	if !canManageOrganization(claims, &organization) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to " + strings.ToLower(label)})
+		return nil, false
+	}
+	return &organization, true
+}
+
+// MoveOrganization re-parents an organization with its whole subtree, e.g. when
+// a client switches dealers. The user must manage both the organization and
+// the new parent.
+// POST /api/organizations/:id/move
+func (oh *OrganizationHandler) MoveOrganization(c *gin.Context) {
+	orgUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid organization ID"})
+		return
+	}
+
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var req struct {
+		ParentOrgID string `json:"parent_org_id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	parentUUID, err := uuid.Parse(req.ParentOrgID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid parent organization ID"})
+		return
+	}
+
+	organization, ok := oh.loadManagedOrganization(c, userClaims, orgUUID, "Organization")
+	if !ok {
+		return
+	}
+	parent, ok := oh.loadManagedOrganization(c, userClaims, parentUUID, "Parent organization")
+	if !ok {
+		return
+	}
+
+	result, err := services.MoveOrganization(orgUUID, parentUUID)
+	if err != nil {
+		respondOrgChangeError(c, err, "move")
+		return
+	}
+
+	oldParent := "none"
+	if result.OldParentID != nil {
+		oldParent = result.OldParentID.String()
+	}
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: &organization.ID,
+		Action:         "organization.move",
+		TargetType:     "organization",
+		TargetID:       organization.ID.String(),
+		Detail:         fmt.Sprintf("%s moved from %s to %s (%s), %d organizations in subtree", organization.Name, oldParent, parent.ID, parent.Name, result.SubtreeSize),
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Organization moved successfully",
+		"move":    result,
+	})
+}
+
+// MergeOrganization folds the users and email accounts of a client
+// organization into another client and deactivates it. The user must manage
+// both organizations.
+// POST /api/organizations/:id/merge
+func (oh *OrganizationHandler) MergeOrganization(c *gin.Context) {
+	orgUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid organization ID"})
+		return
+	}
+
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var req struct {
+		TargetOrgID string `json:"target_org_id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	targetUUID, err := uuid.Parse(req.TargetOrgID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid target organization ID"})
+		return
+	}
+
+	source, ok := oh.loadManagedOrganization(c, userClaims, orgUUID, "Organization")
+	if !ok {
+		return
+	}
+	target, ok := oh.loadManagedOrganization(c, userClaims, targetUUID, "Target organization")
+	if !ok {
+		return
+	}
+
+	result, err := services.MergeOrganization(orgUUID, targetUUID)
+	if err != nil {
+		respondOrgChangeError(c, err, "merge")
+		return
+	}
+
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: &target.ID,
+		Action:         "organization.merge",
+		TargetType:     "organization",
+		TargetID:       source.ID.String(),
+		Detail:         fmt.Sprintf("%s merged into %s (%s): %d users, %d accounts", source.Name, target.ID, target.Name, result.UsersMoved, result.AccountsMoved),
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Organization merged successfully",
+		"merge":   result,
+	})
+}
+
 // GetOrganizationStats gets statistics for an organization
 // GET /api/organizations/:id/stats
 func (oh *OrganizationHandler) GetOrganizationStats(c *gin.Context) {
@@ -343,7 +509,7 @@ func (oh *OrganizationHandler) GetOrganizationStats(c *gin.Context) {
 	}
 
 	// Check if user can access this organization
-	if userClaims.RoleName != "admin" && !organization.CanUserManage(oh.DB, uuid.MustParse(userClaims.UserID)) {
+	if !canManageOrganization(userClaims, &organization) {
 		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this organization"})
 		return
 	}
@@ -424,7 +590,7 @@ func (oh *OrganizationHandler) GetOrganizationHierarchy(c *gin.Context) {
 	}
 
 	// Check if user can access this organization
-	if userClaims.RoleName != "admin" && !organization.CanUserManage(oh.DB, uuid.MustParse(userClaims.UserID)) {
+	if !canManageOrganization(userClaims, &organization) {
 		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this organization"})
 		return
 	}
@@ -448,18 +614,11 @@ func (oh *OrganizationHandler) GetOrganizationHierarchy(c *gin.Context) {
 // GET /api/admin/system-stats
 func (oh *OrganizationHandler) GetSystemStats(c *gin.Context) {
 	// Get user claims
-	userClaims, err := middleware.GetUserFromContext(c)
-	if err != nil {
+	if _, err := middleware.GetUserFromContext(c); err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
 		return
 	}
 
-	// Only admin users can access system stats
-	if userClaims.RoleName != "admin" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
-		return
-	}
-
 	stats, err := oh.StatisticsService.GetSystemStats()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get system statistics", "details": err.Error()})
@@ -476,18 +635,11 @@ func (oh *OrganizationHandler) GetSystemStats(c *gin.Context) {
 // GET /api/admin/top-organizations
 func (oh *OrganizationHandler) GetTopOrganizations(c *gin.Context) {
 	// Get user claims
-	userClaims, err := middleware.GetUserFromContext(c)
-	if err != nil {
+	if _, err := middleware.GetUserFromContext(c); err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
 		return
 	}
 
-	// Only admin users can access this endpoint
-	if userClaims.RoleName != "admin" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
-		return
-	}
-
 	// Get limit parameter (default: 10)
 	limitStr := c.DefaultQuery("limit", "10")
 	limit, err := strconv.Atoi(limitStr)
@@ -523,12 +675,6 @@ func (oh *OrganizationHandler) GetNetworkStats(c *gin.Context) {
 		return
 	}
 
-	// Only distributors and admins can access network stats
-	if userClaims.RoleName != "distributor" && userClaims.RoleName != "admin" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Distributor access required"})
-		return
-	}
-
 	// Get distributor organization ID
 	distributorID, err := uuid.Parse(userClaims.OrganizationID)
 	if err != nil {
@@ -558,12 +704,6 @@ func (oh *OrganizationHandler) GetDealerPerformance(c *gin.Context) {
 		return
 	}
 
-	// Only distributors and admins can access dealer performance
-	if userClaims.RoleName != "distributor" && userClaims.RoleName != "admin" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Distributor access required"})
-		return
-	}
-
 	// Get distributor organization ID
 	distributorID, err := uuid.Parse(userClaims.OrganizationID)
 	if err != nil {
@@ -599,12 +739,6 @@ func (oh *OrganizationHandler) GetClientStats(c *gin.Context) {
 		return
 	}
 
-	// Only dealers and admins can access client stats
-	if userClaims.RoleName != "dealer" && userClaims.RoleName != "admin" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Dealer access required"})
-		return
-	}
-
 	// Get dealer organization ID
 	dealerID, err := uuid.Parse(userClaims.OrganizationID)
 	if err != nil {
@@ -634,12 +768,6 @@ func (oh *OrganizationHandler) GetUsageTrends(c *gin.Context) {
 		return
 	}
 
-	// Only dealers and admins can access usage trends
-	if userClaims.RoleName != "dealer" && userClaims.RoleName != "admin" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Dealer access required"})
-		return
-	}
-
 	// Get dealer organization ID
 	dealerID, err := uuid.Parse(userClaims.OrganizationID)
 	if err != nil {
@@ -676,12 +804,6 @@ func (oh *OrganizationHandler) GetUserStats(c *gin.Context) {
 		return
 	}
 
-	// Only clients and admins can access user stats
-	if userClaims.RoleName != "client" && userClaims.RoleName != "admin" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Client access required"})
-		return
-	}
-
 	// Get client organization ID
 	clientID, err := uuid.Parse(userClaims.OrganizationID)
 	if err != nil {
@@ -711,12 +833,6 @@ func (oh *OrganizationHandler) GetStorageUsage(c *gin.Context) {
 		return
 	}
 
-	// Only clients and admins can access storage usage
-	if userClaims.RoleName != "client" && userClaims.RoleName != "admin" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Client access required"})
-		return
-	}
-
 	// Get client organization ID
 	clientID, err := uuid.Parse(userClaims.OrganizationID)
 	if err != nil {
@@ -0,0 +1,348 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+
+	"emailprojectv2/auth"
+	"emailprojectv2/database"
+	"emailprojectv2/middleware"
+	"emailprojectv2/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type PasswordHandler struct {
+	DB *gorm.DB
+	// Organization access checks are shared with the MFA policy
+	mfa *MFAHandler
+}
+
+func NewPasswordHandler(db *gorm.DB) *PasswordHandler {
+	return &PasswordHandler{DB: db, mfa: NewMFAHandler(db)}
+}
+
+type changePasswordRequest struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required"`
+}
+
+type forgotPasswordRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+type resetPasswordRequest struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+// respondPasswordPolicyError writes the response for a password refused by
+// the policy, or for a failure checking it, and returns true. It returns
+// false when err is nil.
+func respondPasswordPolicyError(c *gin.Context, err error) bool {
+	if err == nil {
+		return false
+	}
+	var policyErr *services.PasswordPolicyError
+	if errors.As(err, &policyErr) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Password does not meet the password policy", "problems": policyErr.Problems})
+		return true
+	}
+	log.Printf("❌ Failed to check password policy: %v", err)
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check password policy"})
+	return true
+}
+
+// respondLoginBlocked writes the 429 response for a login refused by the
+// lockout or rate limit and returns true. It returns false when err is nil.
+func respondLoginBlocked(c *gin.Context, err error) bool {
+	var blocked *services.LoginBlockedError
+	if !errors.As(err, &blocked) {
+		return false
+	}
+	retryAfter := int(math.Ceil(blocked.RetryAfter.Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": blocked.Error(), "retry_after": retryAfter})
+	return true
+}
+
+// ForgotPassword emails a password reset link. It answers the same way
+// whether or not the address has an account.
+// POST /auth/password/forgot
+func (h *AuthHandler) ForgotPassword(c *gin.Context) {
+	var req forgotPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if respondLoginBlocked(c, services.CheckIPAllowed(c.ClientIP())) {
+		return
+	}
+	// Requests count against the address like failed logins, so the endpoint
+	// cannot be used to flood mailboxes
+	services.RecordIPFailure(c.ClientIP())
+
+	if err := services.RequestPasswordReset(req.Email, c.ClientIP()); err != nil {
+		log.Printf("❌ Failed to send password reset to %s: %v", req.Email, err)
+	}
+
+	recordAudit(c, database.AuditEvent{
+		Action:     "auth.password_forgot",
+		TargetType: "user",
+		Detail:     req.Email,
+	})
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "If the address has an account, a password reset link has been sent"})
+}
+
+// ResetPassword sets a new password with the token from a reset link and
+// signs the user out everywhere
+// POST /auth/password/reset
+func (h *AuthHandler) ResetPassword(c *gin.Context) {
+	var req resetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if respondLoginBlocked(c, services.CheckIPAllowed(c.ClientIP())) {
+		return
+	}
+
+	user, err := services.ResetPassword(req.Token, req.Password)
+	if errors.Is(err, services.ErrResetTokenInvalid) {
+		services.RecordIPFailure(c.ClientIP())
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var policyErr *services.PasswordPolicyError
+	if errors.As(err, &policyErr) {
+		respondPasswordPolicyError(c, err)
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Password reset failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+		return
+	}
+
+	recordAudit(c, database.AuditEvent{
+		ActorID:        &user.ID,
+		OrganizationID: user.PrimaryOrgID,
+		Action:         "auth.password_reset",
+		TargetType:     "user",
+		TargetID:       user.ID.String(),
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password reset; please log in with your new password"})
+}
+
+// ChangePassword changes the current user's password. Their other sessions
+// are signed out.
+// POST /api/me/password
+func (ph *PasswordHandler) ChangePassword(c *gin.Context) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var req changePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var user database.User
+	if err := ph.DB.First(&user, "id = ?", userClaims.UserID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	managed, err := services.DirectoryManagesPassword(&user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check directory"})
+		return
+	}
+	if managed {
+		c.JSON(http.StatusConflict, gin.H{"error": "Your password is managed by your organization's directory"})
+		return
+	}
+
+	// Guessing the current password counts towards the lockout like a login
+	if respondLoginBlocked(c, services.CheckLoginAllowed(c.ClientIP(), &user)) {
+		return
+	}
+	if !auth.CheckPassword(req.CurrentPassword, user.PasswordHash) {
+		if _, err := services.RecordLoginFailure(c.ClientIP(), &user); err != nil {
+			log.Printf("❌ %v", err)
+		}
+		recordAudit(c, database.AuditEvent{
+			OrganizationID: user.PrimaryOrgID,
+			Action:         "user.password_change",
+			TargetType:     "user",
+			TargetID:       user.ID.String(),
+			Result:         services.AuditResultFailure,
+			Detail:         "invalid current password",
+		})
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Current password is incorrect"})
+		return
+	}
+
+	if respondPasswordPolicyError(c, services.CheckNewPassword(user.PrimaryOrgID, &user.ID, user.Email, req.NewPassword)) {
+		return
+	}
+	err = ph.DB.Transaction(func(tx *gorm.DB) error {
+		return services.SetUserPassword(tx, user.ID, req.NewPassword)
+	})
+	if err != nil {
+		log.Printf("❌ %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change password"})
+		return
+	}
+
+	var revoked int64
+	if sessionID, err := uuid.Parse(userClaims.SessionID); err == nil {
+		revoked, err = services.RevokeOtherSessions(user.ID, sessionID, services.SessionRevokedPassword)
+		if err != nil {
+			log.Printf("⚠️ %v", err)
+		}
+	}
+
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: user.PrimaryOrgID,
+		Action:         "user.password_change",
+		TargetType:     "user",
+		TargetID:       user.ID.String(),
+		Detail:         fmt.Sprintf("%d other sessions revoked", revoked),
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password changed", "sessions_revoked": revoked})
+}
+
+// UnlockUser lifts the lockout of a user after too many failed logins
+// POST /api/users/:id/unlock
+func (ph *PasswordHandler) UnlockUser(c *gin.Context) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+	userUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var user database.User
+	if err := ph.DB.Preload("PrimaryOrg").First(&user, userUUID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
+		return
+	}
+	if !canManageUser(userClaims, &user) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "User not in accessible organization"})
+		return
+	}
+
+	if err := services.UnlockUser(user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unlock user"})
+		return
+	}
+
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: user.PrimaryOrgID,
+		Action:         "user.unlock",
+		TargetType:     "user",
+		TargetID:       user.ID.String(),
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "User unlocked"})
+}
+
+// GetPasswordPolicy returns the password policy an organization sets and the
+// policy that applies to its users once its parents' policies are included
+// GET /api/organizations/:id/password-policy
+func (ph *PasswordHandler) GetPasswordPolicy(c *gin.Context) {
+	orgID, ok := ph.mfa.loadPolicyOrganization(c)
+	if !ok {
+		return
+	}
+
+	var settings database.OrganizationSettings
+	err := ph.DB.Where("org_id = ?", orgID).First(&settings).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch organization settings"})
+		return
+	}
+	policy, _ := services.ParsePasswordPolicy(settings.PasswordPolicy)
+	effective, err := services.EffectivePasswordPolicy(&orgID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch password policy"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"organization_id": orgID, "policy": policy, "effective_policy": effective})
+}
+
+// UpdatePasswordPolicy sets an organization's password policy. The policy
+// also covers the organization's descendants and applies to new passwords.
+// PUT /api/organizations/:id/password-policy
+func (ph *PasswordHandler) UpdatePasswordPolicy(c *gin.Context) {
+	orgID, ok := ph.mfa.loadPolicyOrganization(c)
+	if !ok {
+		return
+	}
+
+	var policy services.PasswordPolicy
+	if err := c.ShouldBindJSON(&policy); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data", "details": err.Error()})
+		return
+	}
+	if err := services.ValidatePasswordPolicy(policy); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	encoded, _ := json.Marshal(policy)
+
+	var settings database.OrganizationSettings
+	err := ph.DB.Where("org_id = ?", orgID).First(&settings).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		settings = database.OrganizationSettings{OrgID: orgID}
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch organization settings"})
+		return
+	}
+
+	settings.PasswordPolicy = string(encoded)
+	if err := ph.DB.Save(&settings).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update password policy"})
+		return
+	}
+
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: &orgID,
+		Action:         "organization.password_policy",
+		TargetType:     "organization",
+		TargetID:       orgID.String(),
+		Detail:         string(encoded),
+	})
+
+	effective, err := services.EffectivePasswordPolicy(&orgID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch password policy"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"organization_id": orgID, "policy": policy, "effective_policy": effective})
+}
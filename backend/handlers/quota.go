@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"emailprojectv2/database"
+	"emailprojectv2/middleware"
+	"emailprojectv2/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// respondQuotaError writes the response for a failed quota check and reports
+// whether there was an error. Hard limits are reported with the quota that
+// blocked the request.
+func respondQuotaError(c *gin.Context, err error) bool {
+	if err == nil {
+		return false
+	}
+	var qe *services.QuotaError
+	if errors.As(err, &qe) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": qe.Error(),
+			"code":  "quota_exceeded",
+			"quota": qe.QuotaUsage,
+		})
+		return true
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check organization quota"})
+	return true
+}
+
+// withQuotaWarnings adds soft-limit warnings to a response
+func withQuotaWarnings(response gin.H, warnings []services.QuotaWarning) gin.H {
+	if len(warnings) > 0 {
+		response["quota_warnings"] = warnings
+	}
+	return response
+}
+
+// GetOrganizationQuota returns the usage of every limit that applies to an
+// organization, including those set by its ancestors
+// GET /api/organizations/:id/quota
+func (oh *OrganizationHandler) GetOrganizationQuota(c *gin.Context) {
+	orgUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid organization ID"})
+		return
+	}
+
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var organization database.Organization
+	if err := oh.DB.First(&organization, orgUUID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Organization not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch organization"})
+		return
+	}
+
+	if !canManageOrganization(userClaims, &organization) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this organization"})
+		return
+	}
+
+	quotas, err := services.OrganizationQuotas(orgUUID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to calculate quota usage"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"organization_id": orgUUID,
+		"quotas":          quotas,
+		"warnings":        services.QuotaWarnings(quotas),
+		"thresholds":      services.QuotaSettings.WarnThresholds,
+	})
+}
@@ -0,0 +1,474 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"emailprojectv2/auth"
+	"emailprojectv2/database"
+	"emailprojectv2/middleware"
+	"emailprojectv2/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type RetentionHandler struct {
+	DB *gorm.DB
+}
+
+func NewRetentionHandler(db *gorm.DB) *RetentionHandler {
+	return &RetentionHandler{DB: db}
+}
+
+type retentionPolicyRequest struct {
+	Scope          string `json:"scope" binding:"required,oneof=organization account folder"`
+	OrganizationID string `json:"organization_id"`
+	AccountID      string `json:"account_id"`
+	Folder         string `json:"folder"`
+	Action         string `json:"action" binding:"required,oneof=keep_days keep_forever delete_unless_flagged"`
+	RetentionDays  int    `json:"retention_days"`
+	AllowOverride  *bool  `json:"allow_override"`
+}
+
+// canManageAccount checks whether the user owns an email account or manages its organization
+func (rh *RetentionHandler) canManageAccount(claims *auth.Claims, accountID uuid.UUID) bool {
+	if managesAllOrganizations(claims) {
+		return true
+	}
+	var account database.EmailAccount
+	if err := rh.DB.First(&account, "id = ?", accountID).Error; err != nil {
+		return false
+	}
+	if account.UserID.String() == claims.UserID {
+		return true
+	}
+	orgID, err := services.AccountOrganizationID(accountID)
+	if err != nil || orgID == nil {
+		return false
+	}
+	return canManageOrganizationID(claims, *orgID)
+}
+
+// canManagePolicy checks access to the target of a policy
+func (rh *RetentionHandler) canManagePolicy(claims *auth.Claims, policy *database.RetentionPolicy) bool {
+	if policy.Scope == services.RetentionScopeOrganization {
+		return canManageOrganizationID(claims, *policy.OrganizationID)
+	}
+	return rh.canManageAccount(claims, *policy.AccountID)
+}
+
+// checkOverride rejects a policy whose broader policy does not allow overrides
+func (rh *RetentionHandler) checkOverride(c *gin.Context, policy *database.RetentionPolicy) bool {
+	parent, err := services.ParentRetention(policy)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to resolve inherited retention policy"})
+		return false
+	}
+	if !parent.AllowOverride {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error":            "The inherited retention policy does not allow overrides",
+			"inherited_policy": parent,
+		})
+		return false
+	}
+	return true
+}
+
+func validateRetentionDays(action string, days int) string {
+	if action != services.RetentionKeepForever && days <= 0 {
+		return "retention_days must be positive for " + action
+	}
+	return ""
+}
+
+// GetPolicies lists retention policies of an organization or an email account
+// GET /api/retention/policies?organization_id=...|account_id=...
+func (rh *RetentionHandler) GetPolicies(c *gin.Context) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	query := rh.DB.Model(&database.RetentionPolicy{})
+	if orgParam := c.Query("organization_id"); orgParam != "" {
+		orgID, err := uuid.Parse(orgParam)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid organization ID"})
+			return
+		}
+		if !canManageOrganizationID(userClaims, orgID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this organization"})
+			return
+		}
+		query = query.Where("organization_id = ?", orgID)
+	} else if accountParam := c.Query("account_id"); accountParam != "" {
+		accountID, err := uuid.Parse(accountParam)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account ID"})
+			return
+		}
+		if !rh.canManageAccount(userClaims, accountID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this account"})
+			return
+		}
+		query = query.Where("account_id = ?", accountID)
+	} else if !managesAllOrganizations(userClaims) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "organization_id or account_id required"})
+		return
+	}
+
+	var policies []database.RetentionPolicy
+	if err := query.Order("created_at DESC").Find(&policies).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch retention policies"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"policies": policies})
+}
+
+// CreatePolicy creates a retention policy for an organization, account or folder
+// POST /api/retention/policies
+func (rh *RetentionHandler) CreatePolicy(c *gin.Context) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var req retentionPolicyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if msg := validateRetentionDays(req.Action, req.RetentionDays); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
+	createdBy := uuid.MustParse(userClaims.UserID)
+	policy := database.RetentionPolicy{
+		Scope:         req.Scope,
+		Action:        req.Action,
+		RetentionDays: req.RetentionDays,
+		AllowOverride: true,
+		CreatedBy:     &createdBy,
+	}
+	if req.AllowOverride != nil {
+		policy.AllowOverride = *req.AllowOverride
+	}
+
+	existing := rh.DB.Model(&database.RetentionPolicy{}).Where("scope = ?", req.Scope)
+	switch req.Scope {
+	case services.RetentionScopeOrganization:
+		orgID, err := uuid.Parse(req.OrganizationID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Valid organization_id required"})
+			return
+		}
+		policy.OrganizationID = &orgID
+		existing = existing.Where("organization_id = ?", orgID)
+	default:
+		accountID, err := uuid.Parse(req.AccountID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Valid account_id required"})
+			return
+		}
+		policy.AccountID = &accountID
+		existing = existing.Where("account_id = ?", accountID)
+
+		if req.Scope == services.RetentionScopeFolder {
+			if req.Folder == "" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Folder required for folder policies"})
+				return
+			}
+			policy.Folder = req.Folder
+			existing = existing.Where("folder = ?", req.Folder)
+		}
+	}
+
+	if !rh.canManagePolicy(userClaims, &policy) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot manage retention for this target"})
+		return
+	}
+
+	var count int64
+	if err := existing.Count(&count).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check existing policies"})
+		return
+	}
+	if count > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "A retention policy already exists for this target"})
+		return
+	}
+
+	if !rh.checkOverride(c, &policy) {
+		return
+	}
+
+	if err := rh.DB.Create(&policy).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create retention policy"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, policy)
+}
+
+// UpdatePolicy changes the action, period or override setting of a retention policy
+// PUT /api/retention/policies/:id
+func (rh *RetentionHandler) UpdatePolicy(c *gin.Context) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var policy database.RetentionPolicy
+	if err := rh.DB.First(&policy, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Retention policy not found"})
+		return
+	}
+	if !rh.canManagePolicy(userClaims, &policy) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot manage retention for this target"})
+		return
+	}
+
+	var req struct {
+		Action        string `json:"action" binding:"omitempty,oneof=keep_days keep_forever delete_unless_flagged"`
+		RetentionDays *int   `json:"retention_days"`
+		AllowOverride *bool  `json:"allow_override"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Action != "" {
+		policy.Action = req.Action
+	}
+	if req.RetentionDays != nil {
+		policy.RetentionDays = *req.RetentionDays
+	}
+	if req.AllowOverride != nil {
+		policy.AllowOverride = *req.AllowOverride
+	}
+	if msg := validateRetentionDays(policy.Action, policy.RetentionDays); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
+	if !rh.checkOverride(c, &policy) {
+		return
+	}
+
+	if err := rh.DB.Save(&policy).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update retention policy"})
+		return
+	}
+
+	c.JSON(http.StatusOK, policy)
+}
+
+// DeletePolicy removes a retention policy; the target falls back to the inherited policy
+// DELETE /api/retention/policies/:id
+func (rh *RetentionHandler) DeletePolicy(c *gin.Context) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var policy database.RetentionPolicy
+	if err := rh.DB.First(&policy, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Retention policy not found"})
+		return
+	}
+	if !rh.canManagePolicy(userClaims, &policy) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot manage retention for this target"})
+		return
+	}
+
+	if err := rh.DB.Delete(&policy).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete retention policy"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Retention policy deleted successfully"})
+}
+
+// GetEffectivePolicy shows the policy that applies to an account folder after inheritance
+// GET /api/retention/effective?account_id=...&folder=...
+func (rh *RetentionHandler) GetEffectivePolicy(c *gin.Context) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	accountID, err := uuid.Parse(c.Query("account_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Valid account_id required"})
+		return
+	}
+	if !rh.canManageAccount(userClaims, accountID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this account"})
+		return
+	}
+
+	folder := c.Query("folder")
+	policy, err := services.ResolveRetentionPolicy(accountID, folder)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to resolve retention policy"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"account_id": accountID,
+		"folder":     folder,
+		"policy":     policy,
+	})
+}
+
+// StartRun starts a retention run in the background. Runs are dry-runs unless
+// dry_run is explicitly false.
+// POST /api/retention/runs
+func (rh *RetentionHandler) StartRun(c *gin.Context) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var req struct {
+		OrganizationID string `json:"organization_id"`
+		DryRun         *bool  `json:"dry_run"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var orgID *uuid.UUID
+	if req.OrganizationID != "" {
+		id, err := uuid.Parse(req.OrganizationID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid organization ID"})
+			return
+		}
+		orgID = &id
+	}
+
+	// Only admins may run across all organizations
+	if orgID == nil && !managesAllOrganizations(userClaims) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "organization_id required"})
+		return
+	}
+	if orgID != nil && !canManageOrganizationID(userClaims, *orgID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this organization"})
+		return
+	}
+
+	dryRun := true
+	if req.DryRun != nil {
+		dryRun = *req.DryRun
+	}
+
+	triggeredBy := uuid.MustParse(userClaims.UserID)
+	run, err := services.Retention.Start(dryRun, orgID, &triggeredBy)
+	if errors.Is(err, services.ErrRetentionRunning) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start retention run"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, run)
+}
+
+// GetRuns lists retention runs visible to the user
+// GET /api/retention/runs
+func (rh *RetentionHandler) GetRuns(c *gin.Context) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	query := rh.DB.Model(&database.RetentionRun{})
+	if !managesAllOrganizations(userClaims) {
+		orgID, err := uuid.Parse(userClaims.OrganizationID)
+		if err != nil || !canManageOrganizationID(userClaims, orgID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
+			return
+		}
+		orgIDs, err := services.OrganizationSubtree(orgID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch retention runs"})
+			return
+		}
+		query = query.Where("organization_id IN ?", orgIDs)
+	}
+
+	var runs []database.RetentionRun
+	if err := query.Order("started_at DESC").Limit(100).Find(&runs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch retention runs"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"runs": runs})
+}
+
+// GetRun returns a retention run with its audit entries (the dry-run report)
+// GET /api/retention/runs/:id?page=1&limit=100
+func (rh *RetentionHandler) GetRun(c *gin.Context) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var run database.RetentionRun
+	if err := rh.DB.First(&run, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Retention run not found"})
+		return
+	}
+
+	if !managesAllOrganizations(userClaims) && (run.OrganizationID == nil || !canManageOrganizationID(userClaims, *run.OrganizationID)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this retention run"})
+		return
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 1000 {
+		limit = 100
+	}
+
+	var total int64
+	rh.DB.Model(&database.RetentionRunItem{}).Where("run_id = ?", run.ID).Count(&total)
+
+	var items []database.RetentionRunItem
+	if err := rh.DB.Where("run_id = ?", run.ID).Order("created_at ASC").
+		Offset((page - 1) * limit).Limit(limit).Find(&items).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch retention run items"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"run":   run,
+		"items": items,
+		"pagination": gin.H{
+			"page":  page,
+			"limit": limit,
+			"total": total,
+		},
+	})
+}
@@ -0,0 +1,489 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"emailprojectv2/auth"
+	"emailprojectv2/database"
+	"emailprojectv2/middleware"
+	"emailprojectv2/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type RoleHandler struct {
+	DB *gorm.DB
+	// Organization access checks are shared with the MFA policy
+	mfa *MFAHandler
+}
+
+func NewRoleHandler(db *gorm.DB) *RoleHandler {
+	return &RoleHandler{DB: db, mfa: NewMFAHandler(db)}
+}
+
+type customRoleRequest struct {
+	Name        string   `json:"name" binding:"required"`
+	Description string   `json:"description"`
+	BaseRole    string   `json:"base_role" binding:"required"`
+	Permissions []string `json:"permissions"`
+}
+
+type updateCustomRoleRequest struct {
+	Name        *string  `json:"name"`
+	Description *string  `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+type assignCustomRoleRequest struct {
+	CustomRoleID *string `json:"custom_role_id"`
+}
+
+// customRoleResponse is a custom role with its permissions decoded
+type customRoleResponse struct {
+	database.CustomRole
+	Permissions []string `json:"permissions"`
+	Inherited   bool     `json:"inherited"` // Defined by a parent organization
+}
+
+func newCustomRoleResponse(role database.CustomRole, orgID uuid.UUID) customRoleResponse {
+	permissions, _ := services.ParsePermissions(role.Permissions)
+	return customRoleResponse{CustomRole: role, Permissions: permissions, Inherited: role.OrganizationID != orgID}
+}
+
+// managesAllOrganizations reports whether an identity manages every
+// organization and user, regardless of where it sits in the hierarchy
+func managesAllOrganizations(claims *auth.Claims) bool {
+	allowed, err := services.HasPermission(claims, "organizations.manage_all")
+	if err != nil {
+		log.Printf("❌ Failed to check permission organizations.manage_all: %v", err)
+		return false
+	}
+	return allowed
+}
+
+// canManageOrganization reports whether an identity may manage an
+// organization: it manages all of them, or the organization is its own or
+// below it. A nil organization is only manageable by the former.
+func canManageOrganization(claims *auth.Claims, org *database.Organization) bool {
+	if managesAllOrganizations(claims) {
+		return true
+	}
+	return org != nil && org.CanUserManage(database.DB, uuid.MustParse(claims.UserID))
+}
+
+// canManageOrganizationID is canManageOrganization for an organization given
+// by its ID. Unknown organizations are not manageable.
+func canManageOrganizationID(claims *auth.Claims, orgID uuid.UUID) bool {
+	if managesAllOrganizations(claims) {
+		return true
+	}
+	var org database.Organization
+	if err := database.DB.First(&org, "id = ?", orgID).Error; err != nil {
+		return false
+	}
+	return org.CanUserManage(database.DB, uuid.MustParse(claims.UserID))
+}
+
+// canManageUser reports whether an identity may manage a user through the
+// user's primary organization, which must be preloaded
+func canManageUser(claims *auth.Claims, user *database.User) bool {
+	return canManageOrganization(claims, user.PrimaryOrg)
+}
+
+// canAssignLevel reports whether an identity may give out a role level. Only
+// roles at or below its own can be given, so nobody can raise anyone above
+// themselves.
+func canAssignLevel(claims *auth.Claims, level int) bool {
+	return managesAllOrganizations(claims) || level >= claims.RoleLevel
+}
+
+// canNarrowRole checks whether the user may define or assign custom roles
+// based on a role level. Custom roles can only narrow roles below the user's
+// own, so nobody can widen their own permissions or those of their peers.
+func canNarrowRole(claims *auth.Claims, level int) bool {
+	return managesAllOrganizations(claims) || level > claims.RoleLevel
+}
+
+// GetMyPermissions returns the effective permissions of the current user
+// GET /api/me/permissions
+func (rh *RoleHandler) GetMyPermissions(c *gin.Context) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	permissions, err := services.EffectivePermissions(userClaims)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load permissions"})
+		return
+	}
+
+	var customRole *database.CustomRole
+	if userClaims.CustomRoleID != "" {
+		var role database.CustomRole
+		if err := rh.DB.First(&role, "id = ?", userClaims.CustomRoleID).Error; err == nil {
+			customRole = &role
+		}
+	}
+
+	response := gin.H{
+		"role":        userClaims.RoleName,
+		"permissions": permissions,
+	}
+	if customRole != nil {
+		response["custom_role"] = gin.H{"id": customRole.ID, "name": customRole.Name}
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// GetRoles lists the built-in roles with their permissions, and the catalog of permissions
+// GET /api/roles
+func (rh *RoleHandler) GetRoles(c *gin.Context) {
+	var roles []database.Role
+	if err := rh.DB.Where("is_active = ?", true).Order("level").Find(&roles).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch roles"})
+		return
+	}
+
+	result := make([]gin.H, 0, len(roles))
+	for _, role := range roles {
+		permissions, err := services.RolePermissions(role.Name)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load permissions"})
+			return
+		}
+		result = append(result, gin.H{
+			"id":           role.ID,
+			"name":         role.Name,
+			"display_name": role.DisplayName,
+			"description":  role.Description,
+			"level":        role.Level,
+			"permissions":  permissions,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"roles": result, "permissions": services.PermissionCatalog})
+}
+
+// GetCustomRoles lists the custom roles the users of an organization can be
+// given: its own and those of its parent organizations
+// GET /api/organizations/:id/roles
+func (rh *RoleHandler) GetCustomRoles(c *gin.Context) {
+	orgID, ok := rh.mfa.loadPolicyOrganization(c)
+	if !ok {
+		return
+	}
+
+	roles, err := services.AvailableCustomRoles(orgID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch custom roles"})
+		return
+	}
+	result := make([]customRoleResponse, 0, len(roles))
+	for _, role := range roles {
+		result = append(result, newCustomRoleResponse(role, orgID))
+	}
+
+	c.JSON(http.StatusOK, gin.H{"custom_roles": result})
+}
+
+// loadCustomRole loads a custom role defined by the organization in the path
+func (rh *RoleHandler) loadCustomRole(c *gin.Context, orgID uuid.UUID) (*database.CustomRole, bool) {
+	roleID, err := uuid.Parse(c.Param("roleId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid custom role ID"})
+		return nil, false
+	}
+	var role database.CustomRole
+	if err := rh.DB.Preload("BaseRole").Where("id = ? AND organization_id = ?", roleID, orgID).First(&role).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Custom role not found"})
+			return nil, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch custom role"})
+		return nil, false
+	}
+	return &role, true
+}
+
+// customRoleNameTaken checks whether an organization already has a custom role with a name
+func (rh *RoleHandler) customRoleNameTaken(orgID uuid.UUID, name string, exceptID uuid.UUID) (bool, error) {
+	var count int64
+	err := rh.DB.Model(&database.CustomRole{}).
+		Where("organization_id = ? AND name = ? AND id <> ?", orgID, name, exceptID).Count(&count).Error
+	return count > 0, err
+}
+
+// CreateCustomRole defines a custom role in an organization
+// POST /api/organizations/:id/roles
+func (rh *RoleHandler) CreateCustomRole(c *gin.Context) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+	orgID, ok := rh.mfa.loadPolicyOrganization(c)
+	if !ok {
+		return
+	}
+
+	var req customRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data", "details": err.Error()})
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Name is required"})
+		return
+	}
+
+	var org database.Organization
+	if err := rh.DB.First(&org, "id = ?", orgID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch organization"})
+		return
+	}
+	var baseRole database.Role
+	if err := rh.DB.Where("name = ? AND is_active = ?", req.BaseRole, true).First(&baseRole).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid base role"})
+		return
+	}
+	if !canNarrowRole(userClaims, baseRole.Level) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Custom roles can only narrow roles below your own"})
+		return
+	}
+	if !services.RoleGrantableIn(org.Type, baseRole.Level) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Users of a %s organization cannot hold the %s role", org.Type, baseRole.Name)})
+		return
+	}
+
+	permissions, err := services.NormalizeCustomRolePermissions(baseRole.Name, req.Permissions)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if taken, err := rh.customRoleNameTaken(orgID, req.Name, uuid.Nil); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check custom role name"})
+		return
+	} else if taken {
+		c.JSON(http.StatusConflict, gin.H{"error": "A custom role with this name already exists"})
+		return
+	}
+
+	role := database.CustomRole{
+		OrganizationID: orgID,
+		BaseRoleID:     baseRole.ID,
+		Name:           req.Name,
+		Description:    req.Description,
+		CreatedBy:      uuid.MustParse(userClaims.UserID),
+	}
+	if err := rh.DB.Create(&role).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create custom role"})
+		return
+	}
+	if err := services.UpdateCustomRolePermissions(&role, permissions); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store permissions"})
+		return
+	}
+	role.BaseRole = &baseRole
+
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: &orgID,
+		Action:         "custom_role.create",
+		TargetType:     "custom_role",
+		TargetID:       role.ID.String(),
+		Detail:         fmt.Sprintf("%s based on %s with %d permissions", role.Name, baseRole.Name, len(permissions)),
+	})
+
+	c.JSON(http.StatusCreated, gin.H{"custom_role": newCustomRoleResponse(role, orgID)})
+}
+
+// UpdateCustomRole changes the name, description or permissions of a custom
+// role. New permissions apply to its users at their next request.
+// PUT /api/organizations/:id/roles/:roleId
+func (rh *RoleHandler) UpdateCustomRole(c *gin.Context) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+	orgID, ok := rh.mfa.loadPolicyOrganization(c)
+	if !ok {
+		return
+	}
+	role, ok := rh.loadCustomRole(c, orgID)
+	if !ok {
+		return
+	}
+	if role.BaseRole == nil || !canNarrowRole(userClaims, role.BaseRole.Level) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Custom roles can only narrow roles below your own"})
+		return
+	}
+
+	var req updateCustomRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data", "details": err.Error()})
+		return
+	}
+
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		if name == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Name is required"})
+			return
+		}
+		if taken, err := rh.customRoleNameTaken(orgID, name, role.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check custom role name"})
+			return
+		} else if taken {
+			c.JSON(http.StatusConflict, gin.H{"error": "A custom role with this name already exists"})
+			return
+		}
+		role.Name = name
+	}
+	if req.Description != nil {
+		role.Description = *req.Description
+	}
+	permissions, _ := services.ParsePermissions(role.Permissions)
+	if req.Permissions != nil {
+		if permissions, err = services.NormalizeCustomRolePermissions(role.BaseRole.Name, req.Permissions); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if err := services.UpdateCustomRolePermissions(role, permissions); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update custom role"})
+		return
+	}
+
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: &orgID,
+		Action:         "custom_role.update",
+		TargetType:     "custom_role",
+		TargetID:       role.ID.String(),
+		Detail:         fmt.Sprintf("%s with %d permissions", role.Name, len(permissions)),
+	})
+
+	c.JSON(http.StatusOK, gin.H{"custom_role": newCustomRoleResponse(*role, orgID)})
+}
+
+// DeleteCustomRole removes a custom role. Its users get the full permissions
+// of their role back and are signed out.
+// DELETE /api/organizations/:id/roles/:roleId
+func (rh *RoleHandler) DeleteCustomRole(c *gin.Context) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+	orgID, ok := rh.mfa.loadPolicyOrganization(c)
+	if !ok {
+		return
+	}
+	role, ok := rh.loadCustomRole(c, orgID)
+	if !ok {
+		return
+	}
+	if role.BaseRole == nil || !canNarrowRole(userClaims, role.BaseRole.Level) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Custom roles can only narrow roles below your own"})
+		return
+	}
+
+	users, err := services.DeleteCustomRole(role)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete custom role"})
+		return
+	}
+
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: &orgID,
+		Action:         "custom_role.delete",
+		TargetType:     "custom_role",
+		TargetID:       role.ID.String(),
+		Detail:         fmt.Sprintf("%s, removed from %d users", role.Name, users),
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Custom role deleted", "users_updated": users})
+}
+
+// AssignCustomRole gives a user a custom role, or removes it with a null ID
+// PUT /api/users/:id/custom-role
+func (rh *RoleHandler) AssignCustomRole(c *gin.Context) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+	userUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	if userClaims.UserID == userUUID.String() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot change your own custom role"})
+		return
+	}
+
+	var req assignCustomRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data", "details": err.Error()})
+		return
+	}
+	var customRoleID *uuid.UUID
+	if req.CustomRoleID != nil && *req.CustomRoleID != "" {
+		id, err := uuid.Parse(*req.CustomRoleID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid custom role ID"})
+			return
+		}
+		customRoleID = &id
+	}
+
+	var user database.User
+	if err := rh.DB.Preload("Role").Preload("PrimaryOrg").First(&user, userUUID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
+		return
+	}
+	if !canManageUser(userClaims, &user) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "User not in accessible organization"})
+		return
+	}
+	if user.Role == nil || !canNarrowRole(userClaims, user.Role.Level) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Custom roles can only narrow roles below your own"})
+		return
+	}
+
+	if err := services.AssignCustomRole(&user, customRoleID); err != nil {
+		if errors.Is(err, services.ErrCustomRoleNotFound) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Custom role is not available for this user's role and organization"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to assign custom role"})
+		return
+	}
+
+	detail := "removed"
+	if customRoleID != nil {
+		detail = customRoleID.String()
+	}
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: user.PrimaryOrgID,
+		Action:         "user.custom_role",
+		TargetType:     "user",
+		TargetID:       user.ID.String(),
+		Detail:         detail,
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Custom role updated", "custom_role_id": customRoleID})
+}
@@ -0,0 +1,445 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"emailprojectv2/auth"
+	"emailprojectv2/database"
+	"emailprojectv2/middleware"
+	"emailprojectv2/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type SSOHandler struct {
+	DB *gorm.DB
+}
+
+func NewSSOHandler(db *gorm.DB) *SSOHandler {
+	return &SSOHandler{DB: db}
+}
+
+type ssoConfigRequest struct {
+	Issuer               string            `json:"issuer" binding:"required"`
+	ClientID             string            `json:"client_id" binding:"required"`
+	ClientSecret         string            `json:"client_secret"` // Kept when empty on update
+	Scopes               string            `json:"scopes"`
+	EmailClaim           string            `json:"email_claim"`
+	RoleClaim            string            `json:"role_claim"`
+	RoleMapping          map[string]string `json:"role_mapping"`
+	DefaultRole          *string           `json:"default_role"`
+	AllowedDomains       []string          `json:"allowed_domains"`
+	JITProvisioning      *bool             `json:"jit_provisioning"`
+	DisablePasswordLogin *bool             `json:"disable_password_login"`
+	IsActive             *bool             `json:"is_active"`
+}
+
+type ssoExchangeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// respondSSOError writes the response for a failed single sign-on operation
+func respondSSOError(c *gin.Context, err error) {
+	var loginErr *services.SSOLoginError
+	var quotaErr *services.QuotaError
+	switch {
+	case errors.Is(err, services.ErrSSONotConfigured):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrSSOStateInvalid):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+	case errors.As(err, &loginErr):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.As(err, &quotaErr):
+		respondQuotaError(c, err)
+	default:
+		log.Printf("❌ SSO login failed: %v", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Single sign-on with the identity provider failed"})
+	}
+}
+
+// ssoLoginPath is where the browser starts a single sign-on login for an organization
+func ssoLoginPath(orgID uuid.UUID) string {
+	return "/auth/sso/login/" + orgID.String()
+}
+
+// loadSSOOrganization checks that the current user may configure single
+// sign-on for the organization in the route
+func (sh *SSOHandler) loadSSOOrganization(c *gin.Context) (*database.Organization, *auth.Claims, bool) {
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return nil, nil, false
+	}
+	orgID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid organization ID"})
+		return nil, nil, false
+	}
+
+	var org database.Organization
+	if err := sh.DB.First(&org, "id = ?", orgID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Organization not found"})
+			return nil, nil, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch organization"})
+		return nil, nil, false
+	}
+	if !canManageOrganization(userClaims, &org) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this organization"})
+		return nil, nil, false
+	}
+	return &org, userClaims, true
+}
+
+// ssoResponse is an SSO configuration as returned to managers; the client
+// secret is never sent back
+func ssoResponse(sso *database.OrganizationSSO) gin.H {
+	return gin.H{
+		"sso":               sso,
+		"has_client_secret": sso.ClientSecret != "",
+		"login_url":         ssoLoginPath(sso.OrganizationID),
+		"callback_url":      services.SSOSettings.CallbackURL,
+	}
+}
+
+// GetSSO returns an organization's single sign-on configuration
+// GET /api/organizations/:id/sso
+func (sh *SSOHandler) GetSSO(c *gin.Context) {
+	org, _, ok := sh.loadSSOOrganization(c)
+	if !ok {
+		return
+	}
+
+	var sso database.OrganizationSSO
+	err := sh.DB.Where("organization_id = ?", org.ID).First(&sso).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": services.ErrSSONotConfigured.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch SSO configuration"})
+		return
+	}
+
+	c.JSON(http.StatusOK, ssoResponse(&sso))
+}
+
+// UpdateSSO creates or replaces an organization's single sign-on
+// configuration. The issuer is contacted so a wrong URL is reported here.
+// PUT /api/organizations/:id/sso
+func (sh *SSOHandler) UpdateSSO(c *gin.Context) {
+	org, userClaims, ok := sh.loadSSOOrganization(c)
+	if !ok {
+		return
+	}
+
+	var req ssoConfigRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data", "details": err.Error()})
+		return
+	}
+
+	issuer, err := url.Parse(req.Issuer)
+	if err != nil || issuer.Host == "" || (issuer.Scheme != "https" && issuer.Hostname() != "localhost" && issuer.Hostname() != "127.0.0.1") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Issuer must be an https URL"})
+		return
+	}
+	for claimValue, roleName := range req.RoleMapping {
+		if err := services.ValidateSSORole(org, roleName); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role mapping for " + claimValue + ": " + err.Error()})
+			return
+		}
+	}
+	if req.DefaultRole != nil && *req.DefaultRole != "" {
+		if err := services.ValidateSSORole(org, *req.DefaultRole); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid default role: " + err.Error()})
+			return
+		}
+	}
+	domains := []string{}
+	for _, domain := range req.AllowedDomains {
+		domain = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(domain, "@")))
+		if domain == "" || strings.ContainsAny(domain, "@/ ") {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email domain: " + domain})
+			return
+		}
+		domains = append(domains, domain)
+	}
+
+	var sso database.OrganizationSSO
+	err = sh.DB.Where("organization_id = ?", org.ID).First(&sso).Error
+	creating := errors.Is(err, gorm.ErrRecordNotFound)
+	if err != nil && !creating {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch SSO configuration"})
+		return
+	}
+	if creating {
+		sso = database.OrganizationSSO{
+			OrganizationID:  org.ID,
+			Scopes:          "openid email profile",
+			EmailClaim:      "email",
+			RoleClaim:       "groups",
+			DefaultRole:     "end_user",
+			JITProvisioning: true,
+			IsActive:        true,
+			CreatedBy:       uuid.MustParse(userClaims.UserID),
+		}
+		if req.ClientSecret == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "client_secret is required"})
+			return
+		}
+	}
+
+	if err := services.CheckSSOIssuer(c.Request.Context(), req.Issuer); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Identity provider could not be reached", "details": err.Error()})
+		return
+	}
+
+	sso.Issuer = req.Issuer
+	sso.ClientID = req.ClientID
+	if req.ClientSecret != "" {
+		sso.ClientSecret = req.ClientSecret
+	}
+	if req.Scopes != "" {
+		if !strings.Contains(" "+req.Scopes+" ", " openid ") {
+			req.Scopes = "openid " + req.Scopes
+		}
+		sso.Scopes = req.Scopes
+	}
+	if req.EmailClaim != "" {
+		sso.EmailClaim = req.EmailClaim
+	}
+	if req.RoleClaim != "" {
+		sso.RoleClaim = req.RoleClaim
+	}
+	if req.RoleMapping == nil {
+		req.RoleMapping = map[string]string{}
+	}
+	mapping, _ := json.Marshal(req.RoleMapping)
+	sso.RoleMapping = string(mapping)
+	if req.DefaultRole != nil {
+		sso.DefaultRole = *req.DefaultRole
+	}
+	allowed, _ := json.Marshal(domains)
+	sso.AllowedDomains = string(allowed)
+	if req.JITProvisioning != nil {
+		sso.JITProvisioning = *req.JITProvisioning
+	}
+	if req.DisablePasswordLogin != nil {
+		sso.DisablePasswordLogin = *req.DisablePasswordLogin
+	}
+	if req.IsActive != nil {
+		sso.IsActive = *req.IsActive
+	}
+
+	err = sh.DB.Transaction(func(tx *gorm.DB) error {
+		if creating {
+			if err := tx.Create(&sso).Error; err != nil {
+				return err
+			}
+			// Create skips false values of columns that default to true
+			return tx.Model(&sso).Select("jit_provisioning", "disable_password_login", "is_active").Updates(&sso).Error
+		}
+		return tx.Save(&sso).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save SSO configuration"})
+		return
+	}
+
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: &org.ID,
+		Action:         "organization.sso_update",
+		TargetType:     "organization",
+		TargetID:       org.ID.String(),
+		Detail:         sso.Issuer,
+	})
+	log.Printf("🔐 SSO configuration for organization %s saved (issuer %s)", org.ID, sso.Issuer)
+
+	c.JSON(http.StatusOK, ssoResponse(&sso))
+}
+
+// DeleteSSO removes an organization's single sign-on configuration. Users
+// provisioned through it keep their accounts.
+// DELETE /api/organizations/:id/sso
+func (sh *SSOHandler) DeleteSSO(c *gin.Context) {
+	org, _, ok := sh.loadSSOOrganization(c)
+	if !ok {
+		return
+	}
+
+	result := sh.DB.Where("organization_id = ?", org.ID).Delete(&database.OrganizationSSO{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete SSO configuration"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": services.ErrSSONotConfigured.Error()})
+		return
+	}
+
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: &org.ID,
+		Action:         "organization.sso_delete",
+		TargetType:     "organization",
+		TargetID:       org.ID.String(),
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "SSO configuration deleted"})
+}
+
+// SSODiscover tells the login page whether an email address signs in
+// through an identity provider
+// GET /auth/sso/discover?email=
+func (h *AuthHandler) SSODiscover(c *gin.Context) {
+	sso, err := services.FindSSOByEmail(c.Query("email"))
+	if errors.Is(err, services.ErrSSONotConfigured) {
+		c.JSON(http.StatusOK, gin.H{"sso": false})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up single sign-on"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"sso":                    true,
+		"organization_id":        sso.OrganizationID,
+		"login_url":              ssoLoginPath(sso.OrganizationID),
+		"password_login_enabled": !sso.DisablePasswordLogin,
+	})
+}
+
+// SSOLogin sends the browser to an organization's identity provider
+// GET /auth/sso/login/:id
+func (h *AuthHandler) SSOLogin(c *gin.Context) {
+	orgID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid organization ID"})
+		return
+	}
+
+	authURL, err := services.StartSSOLogin(c.Request.Context(), orgID)
+	if err != nil {
+		respondSSOError(c, err)
+		return
+	}
+
+	c.Redirect(http.StatusFound, authURL)
+}
+
+// SSOCallback completes a login when the identity provider redirects back.
+// With a frontend URL configured the browser is sent there with a one-time
+// code to redeem at /auth/sso/exchange; otherwise the tokens are returned
+// directly, which is how the flow is exercised against the mock provider.
+// GET /auth/sso/callback
+func (h *AuthHandler) SSOCallback(c *gin.Context) {
+	if providerErr := c.Query("error"); providerErr != "" {
+		h.ssoCallbackFailed(c, &services.SSOLoginError{Message: strings.TrimSpace("identity provider refused the login: " + providerErr + " " + c.Query("error_description"))})
+		return
+	}
+	state, code := c.Query("state"), c.Query("code")
+	if state == "" || code == "" {
+		h.ssoCallbackFailed(c, services.ErrSSOStateInvalid)
+		return
+	}
+
+	user, loginCode, err := services.CompleteSSOLogin(c.Request.Context(), state, code)
+	if err != nil {
+		h.ssoCallbackFailed(c, err)
+		return
+	}
+
+	if frontend := services.SSOSettings.FrontendURL; frontend != "" {
+		c.Redirect(http.StatusFound, frontend+"/sso/callback#code="+url.QueryEscape(loginCode))
+		return
+	}
+	h.finishSSOLogin(c, loginCode, user.ID)
+}
+
+// ssoCallbackFailed records a failed SSO login and reports it to the browser
+func (h *AuthHandler) ssoCallbackFailed(c *gin.Context, err error) {
+	recordAudit(c, database.AuditEvent{
+		Action:     "auth.sso",
+		TargetType: "user",
+		Result:     services.AuditResultFailure,
+		Detail:     err.Error(),
+	})
+
+	if frontend := services.SSOSettings.FrontendURL; frontend != "" {
+		message := "Single sign-on failed"
+		var loginErr *services.SSOLoginError
+		if errors.As(err, &loginErr) || errors.Is(err, services.ErrSSOStateInvalid) || errors.Is(err, services.ErrSSONotConfigured) {
+			message = err.Error()
+		} else {
+			log.Printf("❌ SSO login failed: %v", err)
+		}
+		c.Redirect(http.StatusFound, frontend+"/sso/callback#error="+url.QueryEscape(message))
+		return
+	}
+	respondSSOError(c, err)
+}
+
+// SSOExchange redeems the one-time code of a completed SSO login for tokens
+// POST /auth/sso/exchange
+func (h *AuthHandler) SSOExchange(c *gin.Context) {
+	var req ssoExchangeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	h.finishSSOLogin(c, req.Code, uuid.Nil)
+}
+
+// finishSSOLogin redeems a login code and opens a session for its user
+func (h *AuthHandler) finishSSOLogin(c *gin.Context, loginCode string, expectedUserID uuid.UUID) {
+	userID, err := services.RedeemSSOLoginCode(loginCode)
+	if err != nil {
+		respondSSOError(c, err)
+		return
+	}
+	if expectedUserID != uuid.Nil && userID != expectedUserID {
+		respondSSOError(c, services.ErrSSOStateInvalid)
+		return
+	}
+
+	var user database.User
+	if err := database.DB.Preload("Role").Preload("PrimaryOrg").First(&user, "id = ?", userID).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		return
+	}
+
+	tokens, err := h.startSession(c, &user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	roleName, _, _, _ := tokenIdentity(&user)
+	recordAudit(c, database.AuditEvent{
+		ActorID:        &user.ID,
+		ActorRole:      roleName,
+		OrganizationID: user.PrimaryOrgID,
+		Action:         "auth.login",
+		TargetType:     "user",
+		TargetID:       user.ID.String(),
+		Detail:         "sso",
+	})
+
+	tokens["user"] = map[string]interface{}{
+		"id":          user.ID,
+		"email":       user.Email,
+		"role":        user.Role,
+		"primary_org": user.PrimaryOrg,
+		"created_at":  user.CreatedAt,
+	}
+	c.JSON(http.StatusOK, tokens)
+}
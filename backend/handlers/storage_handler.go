@@ -4,7 +4,6 @@ import (
 	"net/http"
 	"time"
 
-	"emailprojectv2/auth"
 	"emailprojectv2/database"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
@@ -26,16 +25,6 @@ func (h *StorageHandler) GetTotalStorageStats(c *gin.Context) {
 		return
 	}
 
-	// Check user role - admins should not have access to storage stats
-	userClaims, exists := c.Get("user")
-	if exists {
-		claims := userClaims.(*auth.Claims)
-		if claims.RoleName == "admin" {
-			c.JSON(http.StatusForbidden, gin.H{"error": "Admins do not have access to storage statistics"})
-			return
-		}
-	}
-
 	userUUID, err := uuid.Parse(userID)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
@@ -104,16 +93,6 @@ func (h *StorageHandler) GetAccountsWithStorageStats(c *gin.Context) {
 		return
 	}
 
-	// Check user role - admins should not have access to storage stats
-	userClaims, exists := c.Get("user")
-	if exists {
-		claims := userClaims.(*auth.Claims)
-		if claims.RoleName == "admin" {
-			c.JSON(http.StatusForbidden, gin.H{"error": "Admins do not have access to storage statistics"})
-			return
-		}
-	}
-
 	userUUID, err := uuid.Parse(userID)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
@@ -242,16 +221,6 @@ func (h *StorageHandler) GetAccountStorageStats(c *gin.Context) {
 		return
 	}
 
-	// Check user role - admins should not have access
-	userClaims, exists := c.Get("user")
-	if exists {
-		claims := userClaims.(*auth.Claims)
-		if claims.RoleName == "admin" {
-			c.JSON(http.StatusForbidden, gin.H{"error": "Admins do not have access to storage statistics"})
-			return
-		}
-	}
-
 	accountUUID, err := uuid.Parse(accountID)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account ID"})
@@ -322,16 +291,6 @@ func (h *StorageHandler) GetFolderStorageStats(c *gin.Context) {
 		return
 	}
 
-	// Check user role - admins should not have access
-	userClaims, exists := c.Get("user")
-	if exists {
-		claims := userClaims.(*auth.Claims)
-		if claims.RoleName == "admin" {
-			c.JSON(http.StatusForbidden, gin.H{"error": "Admins do not have access to storage statistics"})
-			return
-		}
-	}
-
 	accountUUID, err := uuid.Parse(accountID)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account ID"})
@@ -401,16 +360,6 @@ func (h *StorageHandler) RecalculateStorageStats(c *gin.Context) {
 		return
 	}
 
-	// Check user role - admins should not have access
-	userClaims, exists := c.Get("user")
-	if exists {
-		claims := userClaims.(*auth.Claims)
-		if claims.RoleName == "admin" {
-			c.JSON(http.StatusForbidden, gin.H{"error": "Admins do not have access to storage operations"})
-			return
-		}
-	}
-
 	accountUUID, err := uuid.Parse(accountIDStr)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account ID"})
@@ -1,15 +1,18 @@
 package handlers
 
 import (
+	"fmt"
+	"log"
 	"net/http"
 	"strconv"
 
+	"emailprojectv2/auth"
 	"emailprojectv2/database"
 	"emailprojectv2/middleware"
+	"emailprojectv2/services"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
-	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
 
@@ -31,15 +34,9 @@ func (umh *UserManagementHandler) CreateUser(c *gin.Context) {
 		return
 	}
 
-	// Check if user can manage users
-	if !middleware.CanManageUsers(c) {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions to create users"})
-		return
-	}
-
 	var req struct {
 		Email          string `json:"email" binding:"required,email"`
-		Password       string `json:"password" binding:"required,min=8"`
+		Password       string `json:"password" binding:"required"`
 		OrganizationID string `json:"organization_id" binding:"required"`
 		RoleName       string `json:"role_name" binding:"required,oneof=admin distributor dealer client end_user"`
 	}
@@ -63,7 +60,7 @@ func (umh *UserManagementHandler) CreateUser(c *gin.Context) {
 	}
 
 	// Check if current user can manage this organization
-	if userClaims.RoleName != "admin" && !organization.CanUserManage(umh.DB, uuid.MustParse(userClaims.UserID)) {
+	if !canManageOrganization(userClaims, &organization) {
 		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot assign users to this organization"})
 		return
 	}
@@ -76,7 +73,7 @@ func (umh *UserManagementHandler) CreateUser(c *gin.Context) {
 	}
 
 	// Current user cannot assign a role higher than their own
-	if role.Level < userClaims.RoleLevel && userClaims.RoleName != "admin" {
+	if !canAssignLevel(userClaims, role.Level) {
 		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot assign role higher than your own"})
 		return
 	}
@@ -88,8 +85,19 @@ func (umh *UserManagementHandler) CreateUser(c *gin.Context) {
 		return
 	}
 
+	// The user counts against the limits of the organization and its ancestors
+	quotaWarnings, err := services.CheckQuota(orgID, services.QuotaUsers, 1)
+	if respondQuotaError(c, err) {
+		return
+	}
+
+	// The password must meet the policy of the organization and its ancestors
+	if respondPasswordPolicyError(c, services.CheckNewPassword(&orgID, nil, req.Email, req.Password)) {
+		return
+	}
+
 	// Hash password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	hashedPassword, err := auth.HashPassword(req.Password)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
 		return
@@ -101,7 +109,7 @@ func (umh *UserManagementHandler) CreateUser(c *gin.Context) {
 	// Create user
 	user := database.User{
 		Email:        req.Email,
-		PasswordHash: string(hashedPassword),
+		PasswordHash: hashedPassword,
 		RoleID:       &role.ID,
 		PrimaryOrgID: &orgID,
 	}
@@ -126,6 +134,12 @@ func (umh *UserManagementHandler) CreateUser(c *gin.Context) {
 		return
 	}
 
+	if err := services.RecordPasswordHistory(tx, user.ID, hashedPassword); err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
+		return
+	}
+
 	// Commit transaction
 	tx.Commit()
 
@@ -141,7 +155,15 @@ func (umh *UserManagementHandler) CreateUser(c *gin.Context) {
 		"created_at":      user.CreatedAt,
 	}
 
-	c.JSON(http.StatusCreated, response)
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: &orgID,
+		Action:         "user.create",
+		TargetType:     "user",
+		TargetID:       user.ID.String(),
+		Detail:         fmt.Sprintf("%s as %s", user.Email, req.RoleName),
+	})
+
+	c.JSON(http.StatusCreated, withQuotaWarnings(response, quotaWarnings))
 }
 
 // GetUsers lists users based on current user's permissions
@@ -154,12 +176,6 @@ func (umh *UserManagementHandler) GetUsers(c *gin.Context) {
 		return
 	}
 
-	// Check if user can view users
-	if !middleware.CanManageUsers(c) {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions to view users"})
-		return
-	}
-
 	// Parse query parameters
 	orgIDParam := c.Query("organization_id")
 	page := c.DefaultQuery("page", "1")
@@ -169,7 +185,7 @@ func (umh *UserManagementHandler) GetUsers(c *gin.Context) {
 	query := umh.DB.Preload("Role").Preload("PrimaryOrg").Preload("UserOrgs.Organization").Preload("UserOrgs.Role")
 
 	// Filter based on user role and permissions
-	if userClaims.RoleName == "admin" {
+	if managesAllOrganizations(userClaims) {
 		// Admin can see all users
 		if orgIDParam != "" {
 			orgID, err := uuid.Parse(orgIDParam)
@@ -296,13 +312,13 @@ func (umh *UserManagementHandler) GetUser(c *gin.Context) {
 	}
 
 	// Check permissions - users can view themselves, managers can view users in their org
-	if userClaims.UserID != userID && !middleware.CanManageUsers(c) {
+	if userClaims.UserID != userID && !middleware.HasPermission(c, "users.read") {
 		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
 		return
 	}
 
 	// If not admin, check if the user is in an accessible organization
-	if userClaims.RoleName != "admin" && userClaims.UserID != userID {
+	if !managesAllOrganizations(userClaims) && userClaims.UserID != userID {
 		canAccess := false
 		userOrgID, _ := uuid.Parse(userClaims.OrganizationID)
 		
@@ -358,12 +374,6 @@ func (umh *UserManagementHandler) UpdateUser(c *gin.Context) {
 		return
 	}
 
-	// Check permissions
-	if !middleware.CanManageUsers(c) {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions to update users"})
-		return
-	}
-
 	var req struct {
 		RoleName       *string `json:"role_name,omitempty"`
 		OrganizationID *string `json:"organization_id,omitempty"`
@@ -375,6 +385,12 @@ func (umh *UserManagementHandler) UpdateUser(c *gin.Context) {
 		return
 	}
 
+	// Users cannot change their own role or organization
+	if userClaims.UserID == userUUID.String() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot change your own account"})
+		return
+	}
+
 	// Find the user
 	var user database.User
 	if err := umh.DB.Preload("Role").Preload("PrimaryOrg").First(&user, userUUID).Error; err != nil {
@@ -385,6 +401,17 @@ func (umh *UserManagementHandler) UpdateUser(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
 		return
 	}
+	if !canManageUser(userClaims, &user) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "User not in accessible organization"})
+		return
+	}
+	// The role being replaced must not be above the current user's either
+	if user.Role != nil && !canAssignLevel(userClaims, user.Role.Level) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot change a user with a role higher than your own"})
+		return
+	}
+
+	oldRoleID, oldOrgID := user.RoleID, user.PrimaryOrgID
 
 	// Start transaction
 	tx := umh.DB.Begin()
@@ -399,13 +426,14 @@ func (umh *UserManagementHandler) UpdateUser(c *gin.Context) {
 		}
 
 		// Current user cannot assign a role higher than their own
-		if newRole.Level < userClaims.RoleLevel && userClaims.RoleName != "admin" {
+		if !canAssignLevel(userClaims, newRole.Level) {
 			tx.Rollback()
 			c.JSON(http.StatusForbidden, gin.H{"error": "Cannot assign role higher than your own"})
 			return
 		}
 
 		user.RoleID = &newRole.ID
+		user.Role = &newRole
 
 		// Update user-organization relationship
 		if err := tx.Model(&database.UserOrganization{}).
@@ -434,13 +462,14 @@ func (umh *UserManagementHandler) UpdateUser(c *gin.Context) {
 		}
 
 		// Check if current user can assign to this organization
-		if userClaims.RoleName != "admin" && !newOrg.CanUserManage(umh.DB, uuid.MustParse(userClaims.UserID)) {
+		if !canManageOrganization(userClaims, &newOrg) {
 			tx.Rollback()
 			c.JSON(http.StatusForbidden, gin.H{"error": "Cannot assign users to this organization"})
 			return
 		}
 
 		user.PrimaryOrgID = &newOrgID
+		user.PrimaryOrg = &newOrg
 
 		// Update user-organization relationship
 		if err := tx.Model(&database.UserOrganization{}).
@@ -452,6 +481,19 @@ func (umh *UserManagementHandler) UpdateUser(c *gin.Context) {
 		}
 	}
 
+	// The role must suit the organization type, whichever of the two changed
+	if (req.RoleName != nil || req.OrganizationID != nil) && user.Role != nil && user.PrimaryOrg != nil &&
+		!services.RoleGrantableIn(user.PrimaryOrg.Type, user.Role.Level) {
+		tx.Rollback()
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Users of a %s organization cannot hold the %s role", user.PrimaryOrg.Type, user.Role.Name)})
+		return
+	}
+
+	// Custom roles narrow one role in one organization tree, so they do not carry over
+	if !sameID(oldRoleID, user.RoleID) || !sameID(oldOrgID, user.PrimaryOrgID) {
+		user.CustomRoleID = nil
+	}
+
 	// Save user changes
 	if err := tx.Save(&user).Error; err != nil {
 		tx.Rollback()
@@ -462,15 +504,38 @@ func (umh *UserManagementHandler) UpdateUser(c *gin.Context) {
 	// Commit transaction
 	tx.Commit()
 
+	// Tokens carry the role and organization, so sessions issued before the change are ended
+	revokeReason := ""
+	if !sameID(oldRoleID, user.RoleID) {
+		revokeReason = services.SessionRevokedRole
+	} else if !sameID(oldOrgID, user.PrimaryOrgID) {
+		revokeReason = services.SessionRevokedOrg
+	}
+	var revoked int64
+	if revokeReason != "" {
+		if revoked, err = services.RevokeUserSessions(user.ID, revokeReason); err != nil {
+			log.Printf("⚠️ Failed to revoke sessions of user %s: %v", user.ID, err)
+		}
+	}
+
 	// Load updated relationships
 	umh.DB.Preload("Role").Preload("PrimaryOrg").First(&user, user.ID)
 
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: user.PrimaryOrgID,
+		Action:         "user.update",
+		TargetType:     "user",
+		TargetID:       user.ID.String(),
+		Detail:         fmt.Sprintf("%d sessions revoked", revoked),
+	})
+
 	response := gin.H{
-		"id":          user.ID,
-		"email":       user.Email,
-		"role":        user.Role,
-		"primary_org": user.PrimaryOrg,
-		"updated_at":  user.UpdatedAt,
+		"id":               user.ID,
+		"email":            user.Email,
+		"role":             user.Role,
+		"primary_org":      user.PrimaryOrg,
+		"updated_at":       user.UpdatedAt,
+		"sessions_revoked": revoked,
 	}
 
 	c.JSON(http.StatusOK, response)
@@ -493,12 +558,6 @@ func (umh *UserManagementHandler) DeleteUser(c *gin.Context) {
 		return
 	}
 
-	// Check permissions
-	if !middleware.CanManageUsers(c) {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions to delete users"})
-		return
-	}
-
 	// Cannot delete yourself
 	if userClaims.UserID == userID {
 		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot delete your own account"})
@@ -507,7 +566,7 @@ func (umh *UserManagementHandler) DeleteUser(c *gin.Context) {
 
 	// Find the user
 	var user database.User
-	if err := umh.DB.First(&user, userUUID).Error; err != nil {
+	if err := umh.DB.Preload("Role").Preload("PrimaryOrg").First(&user, userUUID).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 			return
@@ -515,6 +574,30 @@ func (umh *UserManagementHandler) DeleteUser(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
 		return
 	}
+	if !canManageUser(userClaims, &user) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "User not in accessible organization"})
+		return
+	}
+	if user.Role != nil && !canAssignLevel(userClaims, user.Role.Level) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot delete a user with a role higher than your own"})
+		return
+	}
+
+	// Users whose mail is preserved under a legal hold cannot be removed
+	holds, err := services.LoadActiveHolds()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check legal holds"})
+		return
+	}
+	held, err := holds.UserHeld(userUUID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check legal holds"})
+		return
+	}
+	if held {
+		c.JSON(http.StatusConflict, gin.H{"error": "User is under a legal hold and cannot be deleted"})
+		return
+	}
 
 	// For now, we'll implement soft delete by deactivating email accounts
 	// In a full implementation, you might want to add an is_active field to users table
@@ -524,6 +607,84 @@ func (umh *UserManagementHandler) DeleteUser(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to deactivate user"})
 		return
 	}
+	if _, err := services.RevokeUserSessions(userUUID, services.SessionRevokedDeleted); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to end user sessions"})
+		return
+	}
+	if _, err := services.RevokeUserAPIKeys(userUUID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke user API keys"})
+		return
+	}
+
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: user.PrimaryOrgID,
+		Action:         "user.delete",
+		TargetType:     "user",
+		TargetID:       user.ID.String(),
+	})
 
 	c.JSON(http.StatusOK, gin.H{"message": "User deactivated successfully"})
-}
\ No newline at end of file
+}
+
+// sameID reports whether two optional IDs are equal
+func sameID(a, b *uuid.UUID) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return *a == *b
+}
+
+// RevokeUserSessions logs a user out everywhere. Users can end their own
+// sessions; managers those of users in organizations they manage.
+// POST /api/users/:id/sessions/revoke
+func (umh *UserManagementHandler) RevokeUserSessions(c *gin.Context) {
+	userID := c.Param("id")
+	userUUID, err := uuid.Parse(userID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	userClaims, err := middleware.GetUserFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var user database.User
+	if err := umh.DB.Preload("PrimaryOrg").First(&user, userUUID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
+		return
+	}
+
+	if userClaims.UserID != userID {
+		if !middleware.HasPermission(c, "users.update") {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions to revoke sessions"})
+			return
+		}
+		if !canManageUser(userClaims, &user) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "User not in accessible organization"})
+			return
+		}
+	}
+
+	revoked, err := services.RevokeUserSessions(userUUID, services.SessionRevokedByManager)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+		return
+	}
+
+	recordAudit(c, database.AuditEvent{
+		OrganizationID: user.PrimaryOrgID,
+		Action:         "user.sessions_revoke",
+		TargetType:     "user",
+		TargetID:       user.ID.String(),
+		Detail:         fmt.Sprintf("%d sessions revoked", revoked),
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Sessions revoked", "revoked": revoked})
+}
@@ -31,20 +31,42 @@ func main() {
 	if err := database.Migrate(); err != nil {
 		log.Fatal("Database migration failed:", err)
 	}
+	if err := services.SeedRolePermissions(); err != nil {
+		log.Fatal("Role permission seeding failed:", err)
+	}
 
 	// Connect to MinIO
 	if err := storage.ConnectMinio(cfg); err != nil {
 		log.Fatal("MinIO connection failed:", err)
 	}
 
-	// TODO: Re-enable when background jobs service is available
-	// backgroundJobService := services.NewBackgroundJobService(database.DB, storage.MinioClient)
-	// backgroundJobService.StartAllJobs()
-	log.Println("✅ Backend started (background jobs disabled)")
+	// Apply provider request budgets before any sync can start
+	services.ConfigureThrottling(cfg.Throttle)
+	services.ConfigureSync(cfg.Sync)
+	services.ConfigureRetention(cfg.Retention)
+	services.ConfigureIntegrity(cfg.Integrity)
+	services.ConfigurePrivacy(cfg.Privacy)
+	services.ConfigureQuotas(cfg.Quota)
+	services.ConfigureBilling(cfg.Billing)
+	services.ConfigureSessions(cfg.JWT)
+	services.ConfigureMFA(cfg.MFA)
+	services.ConfigureSSO(cfg.SSO)
+	services.ConfigureDirectory(cfg.Directory)
+	services.ConfigureConnectors(cfg.Connector)
+	services.ConfigurePasswords(cfg.Password)
+	services.ConfigureMail(cfg.Mail)
+
+	// Start background jobs (failed message retries, maintenance)
+	backgroundJobService := services.NewBackgroundJobService(database.DB, storage.MinioClient)
+	backgroundJobService.StartAllJobs()
+	log.Println("✅ Backend started (background jobs enabled)")
 
 	// Initialize router
 	router := gin.Default()
 
+	// Audit every state-changing request not audited by its handler
+	router.Use(middleware.AuditTrail())
+
 	// CORS middleware
 	router.Use(func(c *gin.Context) {
 		c.Header("Access-Control-Allow-Origin", "*")
@@ -205,6 +227,17 @@ func main() {
 	{
 		auth.POST("/register", authHandler.Register)
 		auth.POST("/login", authHandler.Login)
+		auth.POST("/refresh", authHandler.Refresh)
+		auth.POST("/password/forgot", authHandler.ForgotPassword)
+		auth.POST("/password/reset", authHandler.ResetPassword)
+		auth.POST("/mfa/enroll", authHandler.EnrollMFAChallenge)
+		auth.POST("/mfa/verify", authHandler.VerifyMFA)
+		auth.GET("/sso/discover", authHandler.SSODiscover)
+		auth.GET("/sso/login/:id", authHandler.SSOLogin)
+		auth.GET("/sso/callback", authHandler.SSOCallback)
+		auth.POST("/sso/exchange", authHandler.SSOExchange)
+		auth.POST("/logout", middleware.AuthMiddleware(cfg.JWT.Secret), authHandler.Logout)
+		auth.POST("/logout-all", middleware.AuthMiddleware(cfg.JWT.Secret), authHandler.LogoutAll)
 	}
 
 	// SSE endpoint outside protected group (uses query param auth)  
@@ -225,63 +258,224 @@ func main() {
 		})
 
 		// Account management
-		protected.POST("/accounts/gmail", accountHandler.AddGmailAccount)
-		protected.POST("/accounts/exchange", accountHandler.AddExchangeAccount)
-		protected.GET("/accounts", accountHandler.GetAccounts)
-		protected.POST("/accounts/:id/sync", accountHandler.SyncAccount)
-		protected.GET("/accounts/:id/sync-progress", accountHandler.GetSyncProgress)
-		protected.GET("/accounts/:id/sync-history", accountHandler.GetSyncHistory)
-		protected.DELETE("/accounts/:id", accountHandler.DeleteAccount)
-
-		// Email management
+		protected.POST("/accounts/gmail", middleware.RequirePermission("accounts.create"), accountHandler.AddGmailAccount)
+		protected.POST("/accounts/exchange", middleware.RequirePermission("accounts.create"), accountHandler.AddExchangeAccount)
+		protected.GET("/accounts", accountHandler.GetAccounts) // Own accounts need accounts.read, shared ones a grant
+		protected.POST("/accounts/:id/sync", middleware.RequirePermission("accounts.update"), accountHandler.SyncAccount)
+		protected.GET("/accounts/:id/sync-progress", middleware.RequirePermission("accounts.read"), accountHandler.GetSyncProgress)
+		protected.GET("/accounts/:id/sync-history", middleware.RequirePermission("accounts.read"), accountHandler.GetSyncHistory)
+		protected.GET("/accounts/:id/sync-failures", middleware.RequirePermission("accounts.read"), accountHandler.GetSyncFailures)
+		protected.POST("/accounts/:id/sync-failures/retry", middleware.RequirePermission("accounts.update"), accountHandler.RetrySyncFailures)
+		protected.DELETE("/accounts/:id", middleware.RequirePermission("accounts.delete"), accountHandler.DeleteAccount)
+
+		// Mailbox delegation; owners share their own accounts and managers with
+		// mailbox_grants.manage those of their users, checked by the handler
+		grantHandler := handlers.NewMailboxGrantHandler(database.DB)
+		protected.GET("/accounts/:id/grants", grantHandler.GetGrants)
+		protected.POST("/accounts/:id/grants", grantHandler.CreateGrant)
+		protected.DELETE("/accounts/:id/grants/:grantId", grantHandler.RevokeGrant)
+
+		// Email management; owners need emails.read or emails.manage, others
+		// an active mailbox grant with the scope, both checked per account
 		protected.GET("/accounts/:id/emails", emailHandler.GetEmails)
 		protected.GET("/emails/:id", emailHandler.GetEmail)
+		protected.GET("/emails/:id/history", emailHandler.GetEmailHistory)
+		protected.GET("/emails/:id/export", emailHandler.ExportEmail)
+		protected.POST("/emails/:id/restore", emailHandler.RestoreEmail)
 
 		// Storage statistics
 		storageHandler := handlers.NewStorageHandler()
-		protected.GET("/storage/total", storageHandler.GetTotalStorageStats)
-		protected.GET("/storage/accounts", storageHandler.GetAccountsWithStorageStats)
-		protected.GET("/storage/account/:accountId", storageHandler.GetAccountStorageStats)
-		protected.GET("/storage/account/:accountId/folders", storageHandler.GetFolderStorageStats)
-		protected.POST("/storage/account/:accountId/recalculate", storageHandler.RecalculateStorageStats)
-		protected.POST("/storage/recalculate-all", storageHandler.RecalculateAllStorageStats)
+		protected.GET("/storage/total", middleware.RequirePermission("storage.read"), storageHandler.GetTotalStorageStats)
+		protected.GET("/storage/accounts", middleware.RequirePermission("storage.read"), storageHandler.GetAccountsWithStorageStats)
+		protected.GET("/storage/account/:accountId", middleware.RequirePermission("storage.read"), storageHandler.GetAccountStorageStats)
+		protected.GET("/storage/account/:accountId/folders", middleware.RequirePermission("storage.read"), storageHandler.GetFolderStorageStats)
+		protected.POST("/storage/account/:accountId/recalculate", middleware.RequirePermission("storage.update"), storageHandler.RecalculateStorageStats)
+		protected.POST("/storage/recalculate-all", middleware.RequirePermission("storage.update"), storageHandler.RecalculateAllStorageStats)
 
 		// Organization management
 		orgHandler := handlers.NewOrganizationHandler(database.DB)
-		protected.GET("/organizations", orgHandler.GetOrganizations)
-		protected.POST("/organizations", orgHandler.CreateOrganization)
-		protected.GET("/organizations/:id", orgHandler.GetOrganization)
-		protected.PUT("/organizations/:id", orgHandler.UpdateOrganization)
-		protected.DELETE("/organizations/:id", orgHandler.DeleteOrganization)
-		protected.GET("/organizations/:id/stats", orgHandler.GetOrganizationStats)
-		protected.GET("/organizations/:id/hierarchy", orgHandler.GetOrganizationHierarchy)
+		protected.GET("/organizations", middleware.RequirePermission("organizations.read"), orgHandler.GetOrganizations)
+		protected.POST("/organizations", middleware.RequirePermission("organizations.create"), orgHandler.CreateOrganization)
+		protected.GET("/organizations/:id", middleware.RequirePermission("organizations.read"), orgHandler.GetOrganization)
+		protected.PUT("/organizations/:id", middleware.RequirePermission("organizations.update"), orgHandler.UpdateOrganization)
+		protected.DELETE("/organizations/:id", middleware.RequirePermission("organizations.delete"), orgHandler.DeleteOrganization)
+		protected.GET("/organizations/:id/stats", middleware.RequirePermission("organizations.read"), orgHandler.GetOrganizationStats)
+		protected.GET("/organizations/:id/hierarchy", middleware.RequirePermission("organizations.read"), orgHandler.GetOrganizationHierarchy)
+		protected.GET("/organizations/:id/quota", middleware.RequirePermission("organizations.read"), orgHandler.GetOrganizationQuota)
+		protected.POST("/organizations/:id/move", middleware.RequirePermission("organizations.move"), orgHandler.MoveOrganization)
+		protected.POST("/organizations/:id/merge", middleware.RequirePermission("organizations.merge"), orgHandler.MergeOrganization)
 
 		// Admin statistics endpoints
-		protected.GET("/admin/system-stats", orgHandler.GetSystemStats)
-		protected.GET("/admin/top-organizations", orgHandler.GetTopOrganizations)
+		protected.GET("/admin/system-stats", middleware.RequirePermission("reports.system"), orgHandler.GetSystemStats)
+		protected.GET("/admin/top-organizations", middleware.RequirePermission("reports.system"), orgHandler.GetTopOrganizations)
 
 		// Distributor statistics endpoints
-		protected.GET("/distributor/network-stats", orgHandler.GetNetworkStats)
-		protected.GET("/distributor/dealer-performance", orgHandler.GetDealerPerformance)
+		protected.GET("/distributor/network-stats", middleware.RequirePermission("reports.network"), orgHandler.GetNetworkStats)
+		protected.GET("/distributor/dealer-performance", middleware.RequirePermission("reports.network"), orgHandler.GetDealerPerformance)
 
 		// Dealer statistics endpoints
-		protected.GET("/dealer/client-stats", orgHandler.GetClientStats)
-		protected.GET("/dealer/usage-trends", orgHandler.GetUsageTrends)
+		protected.GET("/dealer/client-stats", middleware.RequirePermission("reports.clients"), orgHandler.GetClientStats)
+		protected.GET("/dealer/usage-trends", middleware.RequirePermission("reports.clients"), orgHandler.GetUsageTrends)
 
 		// Client statistics endpoints
-		protected.GET("/client/user-stats", orgHandler.GetUserStats)
-		protected.GET("/client/storage-usage", orgHandler.GetStorageUsage)
+		protected.GET("/client/user-stats", middleware.RequirePermission("reports.users"), orgHandler.GetUserStats)
+		protected.GET("/client/storage-usage", middleware.RequirePermission("reports.users"), orgHandler.GetStorageUsage)
 
 		// User management
 		userMgmtHandler := handlers.NewUserManagementHandler(database.DB)
-		protected.GET("/users", userMgmtHandler.GetUsers)
-		protected.POST("/users", userMgmtHandler.CreateUser)
+		protected.GET("/users", middleware.RequirePermission("users.read"), userMgmtHandler.GetUsers)
+		protected.POST("/users", middleware.RequirePermission("users.create"), userMgmtHandler.CreateUser)
+		// Users can view themselves and end their own sessions, so these check permissions in the handler
 		protected.GET("/users/:id", userMgmtHandler.GetUser)
-		protected.PUT("/users/:id", userMgmtHandler.UpdateUser)
-		protected.DELETE("/users/:id", userMgmtHandler.DeleteUser)
-		// TODO: Add AssignRole and AssignOrganization methods to UserManagementHandler
-		// protected.POST("/users/:id/assign-role", userMgmtHandler.AssignRole)
-		// protected.POST("/users/:id/assign-organization", userMgmtHandler.AssignOrganization)
+		protected.PUT("/users/:id", middleware.RequirePermission("users.update"), userMgmtHandler.UpdateUser)
+		protected.DELETE("/users/:id", middleware.RequirePermission("users.delete"), userMgmtHandler.DeleteUser)
+		protected.POST("/users/:id/sessions/revoke", userMgmtHandler.RevokeUserSessions)
+
+		// Organization memberships
+		protected.GET("/users/:id/organizations", middleware.RequirePermission("users.read"), userMgmtHandler.GetUserOrganizations)
+		protected.POST("/users/:id/assign-organization", middleware.RequirePermission("users.update"), userMgmtHandler.AssignOrganization)
+		protected.POST("/users/:id/assign-role", middleware.RequirePermission("users.update"), userMgmtHandler.AssignRole)
+		protected.DELETE("/users/:id/organizations/:orgId", middleware.RequirePermission("users.update"), userMgmtHandler.RemoveOrganization)
+		protected.GET("/me/organizations", authHandler.GetMyOrganizations)
+		protected.POST("/me/switch-organization", authHandler.SwitchOrganization)
+
+		// Multi-factor authentication
+		mfaHandler := handlers.NewMFAHandler(database.DB)
+		protected.GET("/me/mfa", mfaHandler.GetMFAStatus)
+		protected.POST("/me/mfa/enroll", mfaHandler.StartEnrollment)
+		protected.POST("/me/mfa/confirm", mfaHandler.ConfirmEnrollment)
+		protected.POST("/me/mfa/recovery-codes", mfaHandler.RegenerateRecoveryCodes)
+		protected.POST("/me/mfa/disable", mfaHandler.DisableMFA)
+		protected.DELETE("/users/:id/mfa", middleware.RequirePermission("users.update"), mfaHandler.ResetUserMFA)
+		protected.GET("/organizations/:id/mfa-policy", middleware.RequirePermission("settings.manage"), mfaHandler.GetMFAPolicy)
+		protected.PUT("/organizations/:id/mfa-policy", middleware.RequirePermission("settings.manage"), mfaHandler.UpdateMFAPolicy)
+
+		// Passwords and login lockout
+		passwordHandler := handlers.NewPasswordHandler(database.DB)
+		protected.POST("/me/password", passwordHandler.ChangePassword)
+		protected.POST("/users/:id/unlock", middleware.RequirePermission("users.update"), passwordHandler.UnlockUser)
+		protected.GET("/organizations/:id/password-policy", middleware.RequirePermission("settings.manage"), passwordHandler.GetPasswordPolicy)
+		protected.PUT("/organizations/:id/password-policy", middleware.RequirePermission("settings.manage"), passwordHandler.UpdatePasswordPolicy)
+
+		// Permissions and custom roles
+		roleHandler := handlers.NewRoleHandler(database.DB)
+		protected.GET("/me/permissions", roleHandler.GetMyPermissions)
+		protected.GET("/roles", middleware.RequirePermission("roles.read"), roleHandler.GetRoles)
+		protected.GET("/organizations/:id/roles", middleware.RequirePermission("roles.read"), roleHandler.GetCustomRoles)
+		protected.POST("/organizations/:id/roles", middleware.RequirePermission("roles.manage"), roleHandler.CreateCustomRole)
+		protected.PUT("/organizations/:id/roles/:roleId", middleware.RequirePermission("roles.manage"), roleHandler.UpdateCustomRole)
+		protected.DELETE("/organizations/:id/roles/:roleId", middleware.RequirePermission("roles.manage"), roleHandler.DeleteCustomRole)
+		protected.PUT("/users/:id/custom-role", middleware.RequirePermission("users.update"), roleHandler.AssignCustomRole)
+
+		// API keys for integrations
+		apiKeyHandler := handlers.NewAPIKeyHandler(database.DB)
+		protected.GET("/api-keys", middleware.RequirePermission("api_keys.manage"), apiKeyHandler.GetAPIKeys)
+		protected.GET("/api-keys/scopes", middleware.RequirePermission("api_keys.manage"), apiKeyHandler.GetScopes)
+		protected.POST("/api-keys", middleware.RequirePermission("api_keys.manage"), apiKeyHandler.CreateAPIKey)
+		protected.DELETE("/api-keys/:id", middleware.RequirePermission("api_keys.manage"), apiKeyHandler.RevokeAPIKey)
+		protected.GET("/api-keys/:id/usage", middleware.RequirePermission("api_keys.manage"), apiKeyHandler.GetAPIKeyUsage)
+		protected.PUT("/organizations/:id/api-access", middleware.RequirePermission("settings.manage"), apiKeyHandler.SetAPIAccess)
+
+		// Single sign-on configuration
+		ssoHandler := handlers.NewSSOHandler(database.DB)
+		protected.GET("/organizations/:id/sso", middleware.RequirePermission("sso.manage"), ssoHandler.GetSSO)
+		protected.PUT("/organizations/:id/sso", middleware.RequirePermission("sso.manage"), ssoHandler.UpdateSSO)
+		protected.DELETE("/organizations/:id/sso", middleware.RequirePermission("sso.manage"), ssoHandler.DeleteSSO)
+
+		// LDAP / Active Directory login and user sync
+		directoryHandler := handlers.NewDirectoryHandler(database.DB)
+		protected.GET("/organizations/:id/directory", middleware.RequirePermission("directory.manage"), directoryHandler.GetDirectory)
+		protected.PUT("/organizations/:id/directory", middleware.RequirePermission("directory.manage"), directoryHandler.UpdateDirectory)
+		protected.DELETE("/organizations/:id/directory", middleware.RequirePermission("directory.manage"), directoryHandler.DeleteDirectory)
+		protected.POST("/organizations/:id/directory/sync", middleware.RequirePermission("directory.manage"), directoryHandler.SyncDirectory)
+		protected.GET("/organizations/:id/directory/runs", middleware.RequirePermission("directory.manage"), directoryHandler.GetSyncRuns)
+
+		// Tenant connectors backing up every mailbox with one service account
+		connectorHandler := handlers.NewConnectorHandler(database.DB)
+		protected.GET("/organizations/:id/connectors", middleware.RequirePermission("directory.manage"), connectorHandler.GetConnectors)
+		protected.POST("/organizations/:id/connectors", middleware.RequirePermission("directory.manage"), connectorHandler.CreateConnector)
+		protected.GET("/organizations/:id/connectors/:connectorId", middleware.RequirePermission("directory.manage"), connectorHandler.GetConnector)
+		protected.PUT("/organizations/:id/connectors/:connectorId", middleware.RequirePermission("directory.manage"), connectorHandler.UpdateConnector)
+		protected.DELETE("/organizations/:id/connectors/:connectorId", middleware.RequirePermission("directory.manage"), connectorHandler.DeleteConnector)
+		protected.POST("/organizations/:id/connectors/:connectorId/run", middleware.RequirePermission("directory.manage"), connectorHandler.RunConnector)
+		protected.GET("/organizations/:id/connectors/:connectorId/runs", middleware.RequirePermission("directory.manage"), connectorHandler.GetConnectorRuns)
+
+		// Retention policies and purge runs
+		retentionHandler := handlers.NewRetentionHandler(database.DB)
+		protected.GET("/retention/policies", middleware.RequirePermission("retention.manage"), retentionHandler.GetPolicies)
+		protected.POST("/retention/policies", middleware.RequirePermission("retention.manage"), retentionHandler.CreatePolicy)
+		protected.PUT("/retention/policies/:id", middleware.RequirePermission("retention.manage"), retentionHandler.UpdatePolicy)
+		protected.DELETE("/retention/policies/:id", middleware.RequirePermission("retention.manage"), retentionHandler.DeletePolicy)
+		protected.GET("/retention/effective", middleware.RequirePermission("retention.manage"), retentionHandler.GetEffectivePolicy)
+		protected.GET("/retention/runs", middleware.RequirePermission("retention.manage"), retentionHandler.GetRuns)
+		protected.POST("/retention/runs", middleware.RequirePermission("retention.manage"), retentionHandler.StartRun)
+		protected.GET("/retention/runs/:id", middleware.RequirePermission("retention.manage"), retentionHandler.GetRun)
+
+		// Legal holds
+		legalHoldHandler := handlers.NewLegalHoldHandler(database.DB)
+		protected.GET("/legal-holds", middleware.RequirePermission("legal_holds.manage"), legalHoldHandler.GetLegalHolds)
+		protected.POST("/legal-holds", middleware.RequirePermission("legal_holds.create"), legalHoldHandler.CreateLegalHold)
+		protected.GET("/legal-holds/:id", middleware.RequirePermission("legal_holds.manage"), legalHoldHandler.GetLegalHold)
+		protected.PUT("/legal-holds/:id", middleware.RequirePermission("legal_holds.manage"), legalHoldHandler.UpdateLegalHold)
+		protected.POST("/legal-holds/:id/release", middleware.RequirePermission("legal_holds.manage"), legalHoldHandler.ReleaseLegalHold)
+
+		// Compliance archive (object lock)
+		complianceHandler := handlers.NewComplianceHandler(database.DB)
+		protected.GET("/organizations/:id/compliance-archive", middleware.RequirePermission("compliance.manage"), complianceHandler.GetComplianceArchive)
+		protected.PUT("/organizations/:id/compliance-archive", middleware.RequirePermission("compliance.manage"), complianceHandler.UpdateComplianceArchive)
+		protected.POST("/organizations/:id/compliance-archive/verify", middleware.RequirePermission("compliance.manage"), complianceHandler.StartVerification)
+		protected.GET("/organizations/:id/compliance-archive/verifications", middleware.RequirePermission("compliance.manage"), complianceHandler.GetVerifications)
+		protected.GET("/compliance/verifications/:id", middleware.RequirePermission("compliance.manage"), complianceHandler.GetVerification)
+
+		// Archive integrity verification (admin only)
+		integrityHandler := handlers.NewIntegrityHandler(database.DB)
+		protected.GET("/admin/integrity/runs", middleware.RequirePermission("system.manage"), integrityHandler.GetRuns)
+		protected.POST("/admin/integrity/runs", middleware.RequirePermission("system.manage"), integrityHandler.StartRun)
+		protected.GET("/admin/integrity/runs/:id", middleware.RequirePermission("system.manage"), integrityHandler.GetRun)
+		protected.GET("/admin/integrity/discrepancies", middleware.RequirePermission("system.manage"), integrityHandler.GetDiscrepancies)
+		protected.GET("/admin/integrity/accounts/:accountId/digests", middleware.RequirePermission("system.manage"), integrityHandler.GetDigests)
+
+		// eDiscovery cases (compliance officers)
+		discoveryHandler := handlers.NewDiscoveryHandler(database.DB)
+		protected.GET("/ediscovery/grants", middleware.RequirePermission("ediscovery.grants"), discoveryHandler.GetGrants)
+		protected.POST("/ediscovery/grants", middleware.RequirePermission("ediscovery.grants"), discoveryHandler.CreateGrant)
+		protected.DELETE("/ediscovery/grants/:id", middleware.RequirePermission("ediscovery.grants"), discoveryHandler.DeleteGrant)
+		protected.GET("/ediscovery/cases", middleware.RequirePermission("ediscovery.cases"), discoveryHandler.GetCases)
+		protected.POST("/ediscovery/cases", middleware.RequirePermission("ediscovery.cases"), discoveryHandler.CreateCase)
+		protected.GET("/ediscovery/cases/:id", middleware.RequirePermission("ediscovery.cases"), discoveryHandler.GetCase)
+		protected.POST("/ediscovery/cases/:id/close", middleware.RequirePermission("ediscovery.cases"), discoveryHandler.CloseCase)
+		protected.POST("/ediscovery/cases/:id/search", middleware.RequirePermission("ediscovery.cases"), discoveryHandler.Search)
+		protected.GET("/ediscovery/cases/:id/emails/:emailId", middleware.RequirePermission("ediscovery.cases"), discoveryHandler.GetCaseEmail)
+		protected.GET("/ediscovery/cases/:id/items", middleware.RequirePermission("ediscovery.cases"), discoveryHandler.GetItems)
+		protected.POST("/ediscovery/cases/:id/items", middleware.RequirePermission("ediscovery.cases"), discoveryHandler.AddItems)
+		protected.PUT("/ediscovery/cases/:id/items/:itemId", middleware.RequirePermission("ediscovery.cases"), discoveryHandler.UpdateItem)
+		protected.DELETE("/ediscovery/cases/:id/items/:itemId", middleware.RequirePermission("ediscovery.cases"), discoveryHandler.RemoveItem)
+		protected.GET("/ediscovery/cases/:id/exports", middleware.RequirePermission("ediscovery.cases"), discoveryHandler.GetExports)
+		protected.POST("/ediscovery/cases/:id/exports", middleware.RequirePermission("ediscovery.cases"), discoveryHandler.CreateExport)
+		protected.GET("/ediscovery/cases/:id/exports/:exportId/download", middleware.RequirePermission("ediscovery.cases"), discoveryHandler.DownloadExport)
+
+		// GDPR data subject requests
+		dataSubjectHandler := handlers.NewDataSubjectHandler(database.DB)
+		protected.GET("/data-subject-requests", middleware.RequirePermission("data_subject.manage"), dataSubjectHandler.GetRequests)
+		protected.POST("/data-subject-requests", middleware.RequirePermission("data_subject.manage"), dataSubjectHandler.CreateRequest)
+		protected.GET("/data-subject-requests/:id", middleware.RequirePermission("data_subject.manage"), dataSubjectHandler.GetRequest)
+		protected.GET("/data-subject-requests/:id/report", middleware.RequirePermission("data_subject.manage"), dataSubjectHandler.GetAccessReport)
+		protected.POST("/data-subject-requests/:id/erase", middleware.RequirePermission("data_subject.manage"), dataSubjectHandler.EraseRequest)
+		protected.GET("/data-subject-requests/:id/certificate", middleware.RequirePermission("data_subject.manage"), dataSubjectHandler.GetCertificate)
+
+		// Audit log; users without audit.read see their own actions
+		auditHandler := handlers.NewAuditHandler(database.DB)
+		protected.GET("/audit", auditHandler.GetAuditEvents)
+
+		// Usage metering and billing exports
+		billingHandler := handlers.NewBillingHandler(database.DB)
+		protected.GET("/billing/usage", middleware.RequirePermission("billing.read"), billingHandler.GetUsage)
+		protected.GET("/billing/periods/:period", middleware.RequirePermission("billing.read"), billingHandler.GetBillingPeriod)
+		protected.GET("/billing/plans", middleware.RequirePermission("billing.plans.read"), billingHandler.GetPricePlans)
+		protected.POST("/billing/plans", middleware.RequirePermission("billing.manage"), billingHandler.CreatePricePlan)
+		protected.PUT("/billing/plans/:id", middleware.RequirePermission("billing.manage"), billingHandler.UpdatePricePlan)
+		protected.DELETE("/billing/plans/:id", middleware.RequirePermission("billing.manage"), billingHandler.DeletePricePlan)
+		protected.POST("/admin/billing/snapshots", middleware.RequirePermission("billing.manage"), billingHandler.TakeSnapshot)
 	}
 
 	log.Printf("Starting Email Backup MVP server on port %s", cfg.Server.Port)
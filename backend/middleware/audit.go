@@ -0,0 +1,88 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"emailprojectv2/database"
+	"emailprojectv2/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// auditRecordedKey marks a request whose handler wrote its own audit event
+const auditRecordedKey = "audit_recorded"
+
+// RecordAudit writes an audit event on behalf of the user making the request,
+// filling in the actor and client details. AuditTrail skips requests that
+// recorded an event this way.
+func RecordAudit(c *gin.Context, event database.AuditEvent) {
+	if claims, err := GetUserFromContext(c); err == nil {
+		if event.ActorID == nil {
+			if id, err := uuid.Parse(claims.UserID); err == nil {
+				event.ActorID = &id
+			}
+		}
+		if event.ActorRole == "" {
+			event.ActorRole = claims.RoleName
+		}
+		if event.OrganizationID == nil {
+			if id, err := uuid.Parse(claims.OrganizationID); err == nil {
+				event.OrganizationID = &id
+			}
+		}
+	}
+	if keyID := c.GetString("api_key_id"); keyID != "" {
+		event.Detail = strings.TrimSpace(event.Detail + " via API key " + keyID)
+	}
+	event.IPAddress = c.ClientIP()
+	event.UserAgent = c.Request.UserAgent()
+	services.RecordAudit(event)
+	c.Set(auditRecordedKey, true)
+}
+
+// auditResult maps a response status to an audit result
+func auditResult(status int) string {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return services.AuditResultDenied
+	case status >= 400:
+		return services.AuditResultFailure
+	}
+	return services.AuditResultSuccess
+}
+
+// AuditTrail records every state-changing request that its handler did not
+// audit itself, so no write goes unlogged. The action is the method and route
+// template, e.g. "PUT /api/users/:id".
+func AuditTrail() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			return
+		}
+		route := c.FullPath()
+		if route == "" || c.GetBool(auditRecordedKey) {
+			return
+		}
+
+		// The resource is the first path segment after the API prefix
+		targetType := strings.TrimPrefix(strings.TrimPrefix(route, "/api"), "/")
+		if i := strings.Index(targetType, "/"); i >= 0 {
+			targetType = targetType[:i]
+		}
+
+		status := c.Writer.Status()
+		RecordAudit(c, database.AuditEvent{
+			Action:     c.Request.Method + " " + route,
+			TargetType: targetType,
+			TargetID:   c.Param("id"),
+			Result:     auditResult(status),
+			Detail:     fmt.Sprintf("HTTP %d", status),
+		})
+	}
+}
@@ -1,11 +1,13 @@
 package middleware
 
 import (
+	"errors"
 	"log"
 	"net/http"
 	"strings"
 
 	"emailprojectv2/auth"
+	"emailprojectv2/services"
 
 	"github.com/gin-gonic/gin"
 )
@@ -14,6 +16,12 @@ func AuthMiddleware(jwtSecret string) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		log.Printf("🔒 AuthMiddleware: %s %s", c.Request.Method, c.Request.URL.Path)
 		
+		// Integrations authenticate with an API key instead of a login
+		if key := apiKeyCredential(c); key != "" {
+			authenticateAPIKey(c, key)
+			return
+		}
+
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
 			log.Printf("❌ No Authorization header")
@@ -45,6 +53,18 @@ func AuthMiddleware(jwtSecret string) gin.HandlerFunc {
 			return
 		}
 
+		// The session must still be open, so that logouts and revocations take effect immediately
+		if err := services.CheckSession(claims); err != nil {
+			log.Printf("❌ Session check failed for user %s: %v", claims.UserID, err)
+			if errors.Is(err, services.ErrSessionMissing) || errors.Is(err, services.ErrSessionRevoked) {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Session is no longer valid, please log in again"})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check session"})
+			}
+			c.Abort()
+			return
+		}
+
 		log.Printf("✅ Token validated for user: %s", claims.UserID)
 
 		// Set user info in context (backward compatible)
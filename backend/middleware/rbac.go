@@ -1,9 +1,11 @@
 package middleware
 
 import (
+	"log"
 	"net/http"
 
 	"emailprojectv2/auth"
+	"emailprojectv2/services"
 
 	"github.com/gin-gonic/gin"
 )
@@ -74,7 +76,8 @@ func RequireSpecificRole(roleName string) gin.HandlerFunc {
 	}
 }
 
-// RequirePermission checks if the user has a specific permission
+// RequirePermission checks if the user holds a permission, resolved from
+// their role and custom role
 func RequirePermission(permission string) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// Get user claims from context
@@ -92,28 +95,13 @@ func RequirePermission(permission string) gin.HandlerFunc {
 			return
 		}
 
-		// SECURITY FIX: Admin does NOT have email permissions 
-		if userClaims.RoleName == "admin" {
-			// Admin cannot access email-related permissions
-			if permission == "emails.read" || permission == "emails.manage" || 
-			   permission == "accounts.create" || permission == "accounts.read" || 
-			   permission == "accounts.update" || permission == "accounts.delete" {
-				c.JSON(http.StatusForbidden, gin.H{
-					"error": "Admins cannot access email functionality",
-					"required_permission": permission,
-					"user_role": userClaims.RoleName,
-				})
-				c.Abort()
-				return
-			}
-			// Admin has all other permissions
-			c.Next()
+		hasPermission, err := services.HasPermission(userClaims, permission)
+		if err != nil {
+			log.Printf("❌ Failed to check permission %s: %v", permission, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check permissions"})
+			c.Abort()
 			return
 		}
-
-		// For other roles, we would need to check the permissions from the database
-		// For now, using role-based access
-		hasPermission := checkPermissionByRole(userClaims.RoleName, permission)
 		if !hasPermission {
 			c.JSON(http.StatusForbidden, gin.H{
 				"error": "Permission denied",
@@ -146,8 +134,8 @@ func RequireOrgType(orgType string) gin.HandlerFunc {
 			return
 		}
 
-		// Admin can access everything
-		if userClaims.RoleName == "admin" {
+		// Those managing all organizations can access everything
+		if HasPermission(c, "organizations.manage_all") {
 			c.Next()
 			return
 		}
@@ -167,56 +155,6 @@ func RequireOrgType(orgType string) gin.HandlerFunc {
 	}
 }
 
-// CheckPermissionByRole is a helper function that maps roles to permissions
-func checkPermissionByRole(roleName, permission string) bool {
-	rolePermissions := map[string][]string{
-		"admin": {
-			"system.manage", "users.create", "users.read", "users.update", "users.delete",
-			"organizations.create", "organizations.read", "organizations.update", "organizations.delete",
-			"distributors.create", "distributors.read", "distributors.update", "distributors.delete",
-			"dealers.create", "dealers.read", "dealers.update", "dealers.delete",
-			"clients.create", "clients.read", "clients.update", "clients.delete",
-			"reports.view", "settings.manage",
-			// SECURITY FIX: Removed "emails.read", "emails.manage" - Admin should NOT have email access
-		},
-		"distributor": {
-			"dealers.create", "dealers.read", "dealers.update", "dealers.delete",
-			"clients.create", "clients.read", "clients.update", "clients.delete",
-			"users.create", "users.read", "users.update", "users.delete",
-			"organizations.read", "organizations.update", "reports.view",
-			// NO email permissions - correct
-		},
-		"dealer": {
-			"clients.create", "clients.read", "clients.update", "clients.delete",
-			"users.create", "users.read", "users.update", "users.delete",
-			"organizations.read", "organizations.update", "reports.view",
-			// NO email permissions - correct
-		},
-		"client": {
-			"users.create", "users.read", "users.update", "users.delete",
-			"organizations.read", "organizations.update", "reports.view",
-			// SECURITY FIX: Removed "emails.read", "emails.manage" - Client should NOT have email access
-		},
-		"end_user": {
-			"emails.read", "emails.manage", "accounts.create", "accounts.read", "accounts.update", "accounts.delete",
-			// Only end_user should have email access - correct
-		},
-	}
-
-	permissions, exists := rolePermissions[roleName]
-	if !exists {
-		return false
-	}
-
-	for _, p := range permissions {
-		if p == permission {
-			return true
-		}
-	}
-
-	return false
-}
-
 // GetUserFromContext extracts user claims from the Gin context
 func GetUserFromContext(c *gin.Context) (*auth.Claims, error) {
 	claims, exists := c.Get("user")
@@ -277,22 +215,18 @@ func IsEndUser(c *gin.Context) bool {
 	return claims.RoleName == "end_user"
 }
 
-// CanManageUsers checks if user can manage other users
-func CanManageUsers(c *gin.Context) bool {
+// HasPermission checks if the current user holds a permission
+func HasPermission(c *gin.Context, permission string) bool {
 	claims, err := GetUserFromContext(c)
 	if err != nil {
 		return false
 	}
-	return claims.RoleLevel <= 4 // admin, distributor, dealer, client can manage users
-}
-
-// CanManageOrganizations checks if user can manage organizations
-func CanManageOrganizations(c *gin.Context) bool {
-	claims, err := GetUserFromContext(c)
+	hasPermission, err := services.HasPermission(claims, permission)
 	if err != nil {
+		log.Printf("❌ Failed to check permission %s: %v", permission, err)
 		return false
 	}
-	return claims.RoleLevel <= 3 // admin, distributor, dealer can manage orgs
+	return hasPermission
 }
 
 // GetUserOrganizationFilter returns the organization filter for the current user
@@ -302,8 +236,8 @@ func GetUserOrganizationFilter(c *gin.Context) (string, string) {
 		return "", ""
 	}
 
-	// Admin can see everything
-	if claims.RoleName == "admin" {
+	// Those managing all organizations can see everything
+	if HasPermission(c, "organizations.manage_all") {
 		return "", ""
 	}
 
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/google/uuid"
@@ -9,7 +10,7 @@ import (
 // SyncProgress represents real-time sync progress information
 type SyncProgress struct {
 	AccountID            uuid.UUID `json:"account_id"`
-	Status               string    `json:"status"` // connecting, authenticating, fetching, processing, completed, failed
+	Status               string    `json:"status"` // connecting, authenticating, fetching, processing, throttled, completed, failed
 	TotalEmails          int       `json:"total_emails"`
 	ProcessedEmails      int       `json:"processed_emails"`
 	SuccessfulEmails     int       `json:"successful_emails"`
@@ -23,6 +24,8 @@ type SyncProgress struct {
 	IsCompleted          bool      `json:"is_completed"`
 	StartTime            time.Time `json:"start_time"`
 	EndTime              *time.Time `json:"end_time,omitempty"`
+	ThrottledUntil       *time.Time `json:"throttled_until,omitempty"`
+	resumeStatus         string
 }
 
 // SyncHistory stores historical sync information in database
@@ -67,6 +70,33 @@ func (sp *SyncProgress) Update(status string, currentOperation string) {
 	}
 }
 
+// SetThrottled marks the sync as paused by provider throttling until the given time
+func (sp *SyncProgress) SetThrottled(until time.Time) {
+	if sp.Status != "throttled" {
+		sp.resumeStatus = sp.Status
+	}
+	sp.Status = "throttled"
+	sp.ThrottledUntil = &until
+	seconds := int64(time.Until(until).Seconds() + 0.5)
+	sp.CurrentOperation = fmt.Sprintf("Throttled by server, resuming in %d s", seconds)
+	sp.LastUpdated = time.Now()
+	sp.TimeElapsed = int64(time.Since(sp.StartTime).Seconds())
+}
+
+// ClearThrottled restores the status the sync had before it was throttled
+func (sp *SyncProgress) ClearThrottled() {
+	if sp.Status != "throttled" {
+		return
+	}
+	sp.Status = sp.resumeStatus
+	if sp.Status == "" {
+		sp.Status = "processing"
+	}
+	sp.ThrottledUntil = nil
+	sp.CurrentOperation = "Resuming after throttling"
+	sp.LastUpdated = time.Now()
+}
+
 // SetTotalEmails sets the total number of emails to process
 func (sp *SyncProgress) SetTotalEmails(total int) {
 	sp.TotalEmails = total
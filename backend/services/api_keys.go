@@ -0,0 +1,274 @@
+package services
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"emailprojectv2/auth"
+	"emailprojectv2/database"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// APIKeyPrefix starts every API key so it can be told apart from a JWT
+const APIKeyPrefix = "ebk_"
+
+// Errors for API keys that do not grant access
+var (
+	ErrAPIKeyInvalid     = errors.New("API key is invalid, revoked or expired")
+	ErrAPIKeyIPDenied    = errors.New("API key is not allowed from this address")
+	ErrAPIAccessDisabled = errors.New("API access is not enabled for this organization")
+)
+
+// APIKeyIdentity is the user an API key acts as and what it may do
+type APIKeyIdentity struct {
+	Key    database.APIKey
+	Scopes []string
+	Claims *auth.Claims
+}
+
+// IsAPIKey reports whether a credential looks like an API key
+func IsAPIKey(credential string) bool {
+	return strings.HasPrefix(credential, APIKeyPrefix)
+}
+
+// ValidateAllowedIPs checks that every entry is an IP address or a CIDR range
+func ValidateAllowedIPs(entries []string) error {
+	for _, entry := range entries {
+		if net.ParseIP(entry) != nil {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(entry); err != nil {
+			return fmt.Errorf("%q is not an IP address or CIDR range", entry)
+		}
+	}
+	return nil
+}
+
+// ipAllowed reports whether ip matches an allowlist; an empty list allows any address
+func ipAllowed(entries []string, ip string) bool {
+	if len(entries) == 0 {
+		return true
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, entry := range entries {
+		if allowed := net.ParseIP(entry); allowed != nil {
+			if allowed.Equal(addr) {
+				return true
+			}
+			continue
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil && network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateAPIKey stores a new key and returns its plain value, which is not kept
+func CreateAPIKey(key *database.APIKey) (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate API key: %v", err)
+	}
+	raw := APIKeyPrefix + hex.EncodeToString(buf)
+
+	key.Prefix = raw[:len(APIKeyPrefix)+8]
+	key.KeyHash = hashToken(raw)
+	if err := database.DB.Create(key).Error; err != nil {
+		return "", fmt.Errorf("failed to create API key: %v", err)
+	}
+	log.Printf("🔑 Created API key %s (%s) for organization %s", key.ID, key.Prefix, key.OrganizationID)
+	return raw, nil
+}
+
+// APIAccessEnabled reports whether an organization's features include API access
+func APIAccessEnabled(orgID uuid.UUID) (bool, error) {
+	var settings database.OrganizationSettings
+	err := database.DB.Where("org_id = ?", orgID).First(&settings).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to load organization settings: %v", err)
+	}
+	features := map[string]interface{}{}
+	if settings.Features != "" {
+		if err := json.Unmarshal([]byte(settings.Features), &features); err != nil {
+			return false, fmt.Errorf("failed to parse organization features: %v", err)
+		}
+	}
+	enabled, _ := features["api_access"].(bool)
+	return enabled, nil
+}
+
+// SetAPIAccess turns an organization's api_access feature on or off. Turning
+// it off stops its keys from working but does not revoke them.
+func SetAPIAccess(orgID uuid.UUID, enabled bool) error {
+	var settings database.OrganizationSettings
+	err := database.DB.Where("org_id = ?", orgID).First(&settings).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		settings = database.OrganizationSettings{
+			OrgID:    orgID,
+			Features: `{"email_backup":true,"storage_analytics":true,"user_management":true,"api_access":false}`,
+		}
+	} else if err != nil {
+		return fmt.Errorf("failed to load organization settings: %v", err)
+	}
+
+	features := map[string]interface{}{}
+	if settings.Features != "" {
+		if err := json.Unmarshal([]byte(settings.Features), &features); err != nil {
+			return fmt.Errorf("failed to parse organization features: %v", err)
+		}
+	}
+	features["api_access"] = enabled
+	encoded, err := json.Marshal(features)
+	if err != nil {
+		return fmt.Errorf("failed to encode organization features: %v", err)
+	}
+	settings.Features = string(encoded)
+	if err := database.DB.Save(&settings).Error; err != nil {
+		return fmt.Errorf("failed to save organization settings: %v", err)
+	}
+	return nil
+}
+
+// AuthenticateAPIKey resolves an API key used from ip to the user it acts
+// as. The user's current role and organization are loaded, so changes to the
+// user apply to their keys at once.
+func AuthenticateAPIKey(raw, ip string) (*APIKeyIdentity, error) {
+	var key database.APIKey
+	err := database.DB.Where("key_hash = ?", hashToken(raw)).First(&key).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrAPIKeyInvalid
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load API key: %v", err)
+	}
+	if key.RevokedAt != nil || (key.ExpiresAt != nil && time.Now().After(*key.ExpiresAt)) {
+		return nil, ErrAPIKeyInvalid
+	}
+
+	var allowedIPs, scopes []string
+	if err := json.Unmarshal([]byte(key.AllowedIPs), &allowedIPs); err != nil {
+		return nil, fmt.Errorf("failed to parse API key allowlist: %v", err)
+	}
+	if !ipAllowed(allowedIPs, ip) {
+		RecordAPIKeyUse(key.ID, ip, true)
+		return nil, ErrAPIKeyIPDenied
+	}
+	if err := json.Unmarshal([]byte(key.Scopes), &scopes); err != nil {
+		return nil, fmt.Errorf("failed to parse API key scopes: %v", err)
+	}
+
+	enabled, err := APIAccessEnabled(key.OrganizationID)
+	if err != nil {
+		return nil, err
+	}
+	if !enabled {
+		return nil, ErrAPIAccessDisabled
+	}
+
+	actingUserID := key.CreatedBy
+	if key.UserID != nil {
+		actingUserID = *key.UserID
+	}
+	var user database.User
+	if err := database.DB.Preload("Role").Preload("PrimaryOrg").First(&user, "id = ?", actingUserID).Error; err != nil {
+		return nil, ErrAPIKeyInvalid
+	}
+	if user.DisabledAt != nil {
+		return nil, ErrAPIKeyInvalid
+	}
+
+	claims := &auth.Claims{
+		UserID:    user.ID.String(),
+		Email:     user.Email,
+		RoleName:  "end_user",
+		RoleLevel: 5,
+		OrgType:   "client",
+	}
+	if user.Role != nil {
+		claims.RoleName = user.Role.Name
+		claims.RoleLevel = user.Role.Level
+	}
+	if user.PrimaryOrg != nil {
+		claims.OrganizationID = user.PrimaryOrg.ID.String()
+		claims.OrgType = user.PrimaryOrg.Type
+	}
+	if user.CustomRoleID != nil {
+		claims.CustomRoleID = user.CustomRoleID.String()
+	}
+
+	return &APIKeyIdentity{Key: key, Scopes: scopes, Claims: claims}, nil
+}
+
+// RecordAPIKeyUse counts a request made with a key. Denied requests are
+// counted separately and do not update the key's last use.
+func RecordAPIKeyUse(keyID uuid.UUID, ip string, denied bool) {
+	now := time.Now()
+	usage := database.APIKeyUsage{APIKeyID: keyID, Day: dayStart(now)}
+	column := "requests"
+	if denied {
+		column = "denied"
+		usage.Denied = 1
+	} else {
+		usage.Requests = 1
+	}
+	err := database.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "api_key_id"}, {Name: "day"}},
+		DoUpdates: clause.Set{{Column: clause.Column{Name: column}, Value: gorm.Expr("api_key_usages." + column + " + 1")}},
+	}).Create(&usage).Error
+	if err != nil {
+		log.Printf("⚠️ Failed to record usage of API key %s: %v", keyID, err)
+	}
+	if denied {
+		return
+	}
+
+	err = database.DB.Model(&database.APIKey{}).Where("id = ?", keyID).Updates(map[string]interface{}{
+		"last_used_at":  now,
+		"last_used_ip":  ip,
+		"request_count": gorm.Expr("request_count + 1"),
+	}).Error
+	if err != nil {
+		log.Printf("⚠️ Failed to record use of API key %s: %v", keyID, err)
+	}
+}
+
+// RevokeAPIKey revokes a key. Revoking a revoked key is a no-op.
+func RevokeAPIKey(keyID uuid.UUID) error {
+	err := database.DB.Model(&database.APIKey{}).Where("id = ? AND revoked_at IS NULL", keyID).
+		Update("revoked_at", time.Now()).Error
+	if err != nil {
+		return fmt.Errorf("failed to revoke API key: %v", err)
+	}
+	return nil
+}
+
+// RevokeUserAPIKeys revokes the keys a user owns or that act as them
+func RevokeUserAPIKeys(userID uuid.UUID) (int64, error) {
+	result := database.DB.Model(&database.APIKey{}).
+		Where("(user_id = ? OR (user_id IS NULL AND created_by = ?)) AND revoked_at IS NULL", userID, userID).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return 0, fmt.Errorf("failed to revoke API keys: %v", result.Error)
+	}
+	if result.RowsAffected > 0 {
+		log.Printf("🔒 Revoked %d API keys of user %s", result.RowsAffected, userID)
+	}
+	return result.RowsAffected, nil
+}
@@ -0,0 +1,25 @@
+package services
+
+import (
+	"log"
+
+	"emailprojectv2/database"
+)
+
+// Audit event results
+const (
+	AuditResultSuccess = "success"
+	AuditResultFailure = "failure"
+	AuditResultDenied  = "denied"
+)
+
+// RecordAudit appends an event to the audit log. A failed write is logged but
+// never fails the operation being audited.
+func RecordAudit(event database.AuditEvent) {
+	if event.Result == "" {
+		event.Result = AuditResultSuccess
+	}
+	if err := database.DB.Create(&event).Error; err != nil {
+		log.Printf("⚠️ Failed to record audit event %s: %v", event.Action, err)
+	}
+}
@@ -0,0 +1,162 @@
+package services
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"gorm.io/gorm"
+)
+
+// backgroundJob is a named task run on a fixed interval
+type backgroundJob struct {
+	name     string
+	interval time.Duration
+	run      func() error
+}
+
+// BackgroundJobService runs periodic maintenance jobs for the backend
+type BackgroundJobService struct {
+	DB          *gorm.DB
+	MinioClient *minio.Client
+
+	jobs []backgroundJob
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewBackgroundJobService(db *gorm.DB, minioClient *minio.Client) *BackgroundJobService {
+	bjs := &BackgroundJobService{
+		DB:          db,
+		MinioClient: minioClient,
+		stop:        make(chan struct{}),
+	}
+
+	bjs.register("retry-failed-messages", 5*time.Minute, bjs.retryFailedMessages)
+	bjs.register("retention-purge", time.Duration(RetentionTuning.PurgeIntervalHours)*time.Hour, bjs.purgeExpiredEmails)
+	bjs.register("integrity-verify", time.Duration(IntegrityTuning.VerifyIntervalHours)*time.Hour, bjs.verifyIntegrity)
+	bjs.register("usage-snapshot", time.Duration(BillingSettings.SnapshotIntervalHours)*time.Hour, bjs.snapshotUsage)
+	bjs.register("directory-sync", time.Duration(DirectorySettings.SyncIntervalMinutes)*time.Minute, bjs.syncDirectories)
+	bjs.register("tenant-connectors", time.Duration(ConnectorSettings.RunIntervalMinutes)*time.Minute, bjs.runTenantConnectors)
+
+	return bjs
+}
+
+// register adds a job to the schedule
+func (bjs *BackgroundJobService) register(name string, interval time.Duration, run func() error) {
+	bjs.jobs = append(bjs.jobs, backgroundJob{name: name, interval: interval, run: run})
+}
+
+// StartAllJobs starts every registered job in its own goroutine
+func (bjs *BackgroundJobService) StartAllJobs() {
+	for _, job := range bjs.jobs {
+		bjs.wg.Add(1)
+		go bjs.loop(job)
+		log.Printf("⏰ Scheduled background job '%s' every %s", job.name, job.interval)
+	}
+}
+
+// StopAllJobs signals all jobs to stop and waits for running ones to finish
+func (bjs *BackgroundJobService) StopAllJobs() {
+	close(bjs.stop)
+	bjs.wg.Wait()
+	log.Println("🛑 Background jobs stopped")
+}
+
+// loop runs a job on its ticker. Runs happen on this goroutine, so a job never
+// overlaps itself; ticks that fall due while it runs are dropped by the ticker.
+func (bjs *BackgroundJobService) loop(job backgroundJob) {
+	defer bjs.wg.Done()
+
+	ticker := time.NewTicker(job.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-bjs.stop:
+			return
+		case <-ticker.C:
+			bjs.runOnce(job)
+		}
+	}
+}
+
+// runOnce executes a job, logging its outcome and recovering from panics
+func (bjs *BackgroundJobService) runOnce(job backgroundJob) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("❌ Background job '%s' panicked: %v", job.name, r)
+		}
+	}()
+
+	started := time.Now()
+	if err := job.run(); err != nil {
+		log.Printf("❌ Background job '%s' failed: %v", job.name, err)
+		return
+	}
+	log.Printf("✅ Background job '%s' finished in %s", job.name, time.Since(started).Round(time.Millisecond))
+}
+
+// retryFailedMessages refetches messages whose retry time has come
+func (bjs *BackgroundJobService) retryFailedMessages() error {
+	due, err := FailureTracker.DueFailures(500)
+	if err != nil {
+		return err
+	}
+
+	for accountID := range due {
+		recovered, err := FailureTracker.RetryAccountFailures(accountID, true)
+		if err != nil {
+			log.Printf("⚠️ Retry of failed messages for account %s failed: %v", accountID, err)
+			continue
+		}
+		if recovered > 0 {
+			log.Printf("🔁 Recovered %d failed messages for account %s", recovered, accountID)
+		}
+	}
+
+	return nil
+}
+
+// purgeExpiredEmails applies the retention policies. With purging disabled the
+// run is only recorded as a dry-run report.
+func (bjs *BackgroundJobService) purgeExpiredEmails() error {
+	_, err := Retention.Run(!RetentionTuning.PurgeEnabled, nil, nil)
+	if errors.Is(err, ErrRetentionRunning) {
+		log.Println("⏭️  Retention run already in progress, skipping scheduled purge")
+		return nil
+	}
+	return err
+}
+
+// verifyIntegrity seals the digests of completed days and re-verifies stored objects
+func (bjs *BackgroundJobService) verifyIntegrity() error {
+	_, err := Integrity.Run(nil)
+	if errors.Is(err, ErrIntegrityRunning) {
+		log.Println("⏭️  Integrity verification already in progress, skipping scheduled run")
+		return nil
+	}
+	return err
+}
+
+// snapshotUsage records the day's usage of every organization for billing
+func (bjs *BackgroundJobService) snapshotUsage() error {
+	_, err := Metering.Snapshot(time.Now())
+	if errors.Is(err, ErrMeteringRunning) {
+		log.Println("⏭️  Usage snapshot already in progress, skipping scheduled run")
+		return nil
+	}
+	return err
+}
+
+// syncDirectories syncs the users of every organization with a directory
+func (bjs *BackgroundJobService) syncDirectories() error {
+	return SyncAllDirectories()
+}
+
+// runTenantConnectors discovers and syncs the mailboxes of every tenant connector
+func (bjs *BackgroundJobService) runTenantConnectors() error {
+	return RunAllTenantConnectors()
+}
@@ -0,0 +1,222 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"emailprojectv2/database"
+	"emailprojectv2/storage"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Compliance archive lock modes. Governance locks can be lifted by storage
+// administrators with the bypass permission; compliance locks by nobody.
+const (
+	ComplianceModeGovernance = "governance"
+	ComplianceModeCompliance = "compliance"
+)
+
+// ErrObjectLockUnavailable is returned when a compliance archive is required
+// but the email bucket was created without object locking
+var ErrObjectLockUnavailable = errors.New("object locking is not enabled on the email bucket")
+
+// ComplianceArchive is the effective compliance archive setting of an organization
+type ComplianceArchive struct {
+	OrganizationID uuid.UUID `json:"organization_id"` // Organization the setting comes from
+	Mode           string    `json:"mode"`
+	RetentionDays  int       `json:"retention_days"`
+}
+
+// ResolveComplianceArchive returns the compliance archive that applies to an
+// organization: its own setting or the nearest ancestor's. Descendants cannot
+// opt out of an archive enabled above them. It is nil when none applies.
+func ResolveComplianceArchive(orgID uuid.UUID) (*ComplianceArchive, error) {
+	current := &orgID
+	seen := map[uuid.UUID]bool{}
+	for current != nil && !seen[*current] {
+		seen[*current] = true
+
+		var settings database.OrganizationSettings
+		err := database.DB.Where("org_id = ? AND compliance_archive = ?", *current, true).First(&settings).Error
+		if err == nil {
+			return &ComplianceArchive{
+				OrganizationID: *current,
+				Mode:           settings.ComplianceLockMode,
+				RetentionDays:  settings.ComplianceRetentionDays,
+			}, nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("failed to load organization settings: %v", err)
+		}
+
+		var org database.Organization
+		if err := database.DB.Select("id", "parent_org_id").First(&org, "id = ?", *current).Error; err != nil {
+			return nil, fmt.Errorf("failed to load organization: %v", err)
+		}
+		current = org.ParentOrgID
+	}
+	return nil, nil
+}
+
+// AccountComplianceArchive returns the compliance archive covering an email account
+func AccountComplianceArchive(accountID uuid.UUID) (*ComplianceArchive, error) {
+	orgID, err := AccountOrganizationID(accountID)
+	if err != nil || orgID == nil {
+		return nil, err
+	}
+	return ResolveComplianceArchive(*orgID)
+}
+
+// archiveContext returns the context a sync of the account stores messages
+// under. For accounts covered by a compliance archive every object written
+// through it is locked; if the bucket cannot lock objects the sync must not
+// store anything.
+func archiveContext(accountID uuid.UUID) (context.Context, error) {
+	ctx := context.Background()
+	archive, err := AccountComplianceArchive(accountID)
+	if err != nil {
+		return nil, err
+	}
+	if archive == nil {
+		return ctx, nil
+	}
+	if !storage.ObjectLockEnabled(ctx) {
+		return nil, ErrObjectLockUnavailable
+	}
+	return storage.WithObjectLock(ctx, &storage.ObjectLockPolicy{Mode: archive.Mode, Days: archive.RetentionDays}), nil
+}
+
+// EmailLocked reports whether an email is still within its compliance lock
+func EmailLocked(email *database.EmailIndex, now time.Time) bool {
+	return email.RetainUntil != nil && now.Before(*email.RetainUntil)
+}
+
+// AccountLockedUntil returns when the last compliance lock on an account's
+// emails expires, or nil when none is in force
+func AccountLockedUntil(accountID uuid.UUID) (*time.Time, error) {
+	var email database.EmailIndex
+	err := database.DB.Select("retain_until").
+		Where("account_id = ? AND retain_until > ?", accountID, time.Now()).
+		Order("retain_until DESC").First(&email).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to check compliance locks: %v", err)
+	}
+	return email.RetainUntil, nil
+}
+
+// StartComplianceVerification creates a verification report for an
+// organization subtree and fills it in the background
+func StartComplianceVerification(orgID uuid.UUID, triggeredBy *uuid.UUID) (*database.ComplianceVerification, error) {
+	report := &database.ComplianceVerification{
+		OrganizationID:    orgID,
+		TriggeredBy:       triggeredBy,
+		Status:            "running",
+		BucketLockEnabled: storage.ObjectLockEnabled(context.Background()),
+		StartedAt:         time.Now(),
+	}
+	if err := database.DB.Create(report).Error; err != nil {
+		return nil, fmt.Errorf("failed to create compliance verification: %v", err)
+	}
+
+	go func() {
+		err := verifyComplianceArchive(report)
+
+		now := time.Now()
+		report.CompletedAt = &now
+		report.Status = "completed"
+		if err != nil {
+			report.Status = "failed"
+			report.ErrorMessage = err.Error()
+			log.Printf("❌ Compliance verification %s failed: %v", report.ID, err)
+		} else {
+			log.Printf("✅ Compliance verification %s completed: %d of %d objects locked", report.ID, report.ObjectsLocked, report.ObjectsChecked)
+		}
+		if err := database.DB.Save(report).Error; err != nil {
+			log.Printf("⚠️ Failed to save compliance verification %s: %v", report.ID, err)
+		}
+	}()
+
+	return report, nil
+}
+
+// verifyComplianceArchive compares the lock recorded for every email still
+// within its retention against the lock state MinIO reports for its objects
+func verifyComplianceArchive(report *database.ComplianceVerification) error {
+	accountIDs, err := OrganizationAccountIDs(report.OrganizationID)
+	if err != nil {
+		return err
+	}
+	if len(accountIDs) == 0 {
+		return nil
+	}
+
+	ctx := context.Background()
+	now := time.Now()
+	var batch []database.EmailIndex
+	result := database.DB.Where("account_id IN ? AND retain_until > ?", accountIDs, now).FindInBatches(&batch, 500, func(tx *gorm.DB, _ int) error {
+		for i := range batch {
+			email := &batch[i]
+			for _, objectPath := range []string{email.MinioPath, email.RawMinioPath} {
+				if objectPath == "" {
+					continue
+				}
+				report.ObjectsChecked++
+				if item := verifyObjectLock(ctx, report, email, objectPath); item != nil {
+					if err := database.DB.Create(item).Error; err != nil {
+						log.Printf("⚠️ Failed to record compliance verification entry for %s: %v", objectPath, err)
+					}
+				}
+			}
+		}
+		return nil
+	})
+	return result.Error
+}
+
+// verifyObjectLock checks one object and returns a report entry when its lock
+// is missing or weaker than recorded
+func verifyObjectLock(ctx context.Context, report *database.ComplianceVerification, email *database.EmailIndex, objectPath string) *database.ComplianceVerificationItem {
+	item := &database.ComplianceVerificationItem{
+		VerificationID:      report.ID,
+		EmailID:             email.ID,
+		AccountID:           email.AccountID,
+		ObjectPath:          objectPath,
+		ExpectedMode:        email.LockMode,
+		ExpectedRetainUntil: email.RetainUntil,
+	}
+
+	state, err := storage.GetObjectLockState(ctx, objectPath)
+	if err != nil {
+		item.Problem = "error"
+		item.Detail = err.Error()
+		return item
+	}
+	item.ActualMode = state.Mode
+	item.ActualRetainUntil = state.RetainUntil
+
+	switch {
+	case !state.Exists:
+		report.ObjectsMissing++
+		item.Problem = "missing"
+	case state.Mode == "" || state.RetainUntil == nil:
+		report.ObjectsUnlocked++
+		item.Problem = "unlocked"
+	case email.LockMode == ComplianceModeCompliance && state.Mode != ComplianceModeCompliance,
+		// Storage keeps retention dates at second precision
+		state.RetainUntil.Before(email.RetainUntil.Add(-time.Second)):
+		report.ObjectsMismatched++
+		item.Problem = "mismatched"
+	default:
+		report.ObjectsLocked++
+		return nil
+	}
+	return item
+}
@@ -0,0 +1,553 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"emailprojectv2/config"
+	"emailprojectv2/database"
+	"emailprojectv2/storage"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Data subject request types, statuses, erasure actions and match outcomes
+const (
+	DSRTypeAccess  = "access"
+	DSRTypeErasure = "erasure"
+
+	DSRStatusSearching  = "searching"
+	DSRStatusReady      = "ready"
+	DSRStatusProcessing = "processing"
+	DSRStatusCompleted  = "completed"
+	DSRStatusFailed     = "failed"
+
+	DSRActionRedact = "redact"
+	DSRActionDelete = "delete"
+
+	DSROutcomePending  = "pending"
+	DSROutcomeReported = "reported"
+	DSROutcomeRedacted = "redacted"
+	DSROutcomeDeleted  = "deleted"
+	DSROutcomeHeld     = "held"
+	DSROutcomeLocked   = "locked"
+	DSROutcomeMissing  = "missing"
+	DSROutcomeFailed   = "failed"
+)
+
+// ErrDSRNotReady is returned when erasure is started on a request that is not
+// an erasure request waiting for it
+var ErrDSRNotReady = errors.New("request is not an erasure request ready for processing")
+
+// redactedMarker replaces the subject's identifiers in redacted emails
+const redactedMarker = "[REDACTED]"
+
+// PrivacySettings holds the data subject request settings
+var PrivacySettings = config.PrivacyConfig{}
+
+// ConfigurePrivacy replaces the data subject request settings
+func ConfigurePrivacy(cfg config.PrivacyConfig) {
+	PrivacySettings = cfg
+	log.Println("🔐 Data subject request certificates configured")
+}
+
+// normalizeRecipients reduces "Name <address>" entries to their lowercased
+// addresses, dropping duplicates and anything without an address
+func normalizeRecipients(entries []string) *string {
+	seen := map[string]bool{}
+	addresses := []string{}
+	for _, entry := range entries {
+		if start := strings.LastIndex(entry, "<"); start >= 0 {
+			entry = strings.TrimSuffix(entry[start+1:], ">")
+		}
+		address := strings.ToLower(strings.TrimSpace(entry))
+		if !strings.Contains(address, "@") || seen[address] {
+			continue
+		}
+		seen[address] = true
+		addresses = append(addresses, address)
+	}
+	recipients := strings.Join(addresses, ", ")
+	return &recipients
+}
+
+// addressRecipients collects the addresses of IMAP address lists
+func addressRecipients(lists ...[]map[string]string) *string {
+	entries := []string{}
+	for _, list := range lists {
+		for _, address := range list {
+			entries = append(entries, address["email"])
+		}
+	}
+	return normalizeRecipients(entries)
+}
+
+// storedRecipients reads the recipients of an archived email from its stored
+// document. Gmail documents list them in "to" and "cc", Exchange documents in
+// the To and Cc headers.
+func storedRecipients(ctx context.Context, objectPath string) (*string, error) {
+	obj, err := storage.OpenEmailObject(ctx, objectPath)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+
+	var doc struct {
+		To      []map[string]string    `json:"to"`
+		Cc      []map[string]string    `json:"cc"`
+		Headers map[string]interface{} `json:"headers"`
+	}
+	if err := json.NewDecoder(obj).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %v", objectPath, err)
+	}
+
+	entries := []string{}
+	for _, list := range [][]map[string]string{doc.To, doc.Cc} {
+		for _, address := range list {
+			entries = append(entries, address["email"])
+		}
+	}
+	for _, header := range []string{"To", "Cc"} {
+		switch value := doc.Headers[header].(type) {
+		case string:
+			entries = append(entries, strings.Split(value, ",")...)
+		case []interface{}:
+			for _, v := range value {
+				if s, ok := v.(string); ok {
+					entries = append(entries, strings.Split(s, ",")...)
+				}
+			}
+		}
+	}
+	return normalizeRecipients(entries), nil
+}
+
+// backfillRecipients records the recipients of emails indexed before they
+// were kept in the index
+func backfillRecipients(ctx context.Context, accountIDs []uuid.UUID) error {
+	var batch []database.EmailIndex
+	result := database.DB.Select("id", "minio_path").
+		Where("account_id IN ? AND recipients IS NULL AND minio_path <> ''", accountIDs).
+		FindInBatches(&batch, 500, func(tx *gorm.DB, _ int) error {
+			for i := range batch {
+				email := &batch[i]
+				recipients, err := storedRecipients(ctx, email.MinioPath)
+				if err != nil {
+					log.Printf("⚠️ Failed to read recipients of email %s: %v", email.ID, err)
+					continue
+				}
+				if err := database.DB.Model(&database.EmailIndex{}).Where("id = ?", email.ID).
+					Update("recipients", *recipients).Error; err != nil {
+					return fmt.Errorf("failed to record recipients: %v", err)
+				}
+			}
+			return nil
+		})
+	return result.Error
+}
+
+// subjectPattern matches the subject's address and name in stored content
+func subjectPattern(req *database.DataSubjectRequest) *regexp.Regexp {
+	terms := []string{}
+	for _, term := range []string{req.SubjectEmail, req.SubjectName} {
+		if term = strings.TrimSpace(term); term != "" {
+			terms = append(terms, regexp.QuoteMeta(term))
+		}
+	}
+	return regexp.MustCompile("(?i)" + strings.Join(terms, "|"))
+}
+
+// subjectMatch reports how the subject appears in an email's envelope, or ""
+// when it does not
+func subjectMatch(req *database.DataSubjectRequest, email *database.EmailIndex) string {
+	address := strings.ToLower(req.SubjectEmail)
+	sender := (address != "" && strings.EqualFold(email.SenderEmail, address)) ||
+		(req.SubjectName != "" && strings.EqualFold(strings.TrimSpace(email.SenderName), req.SubjectName))
+
+	recipient := false
+	if address != "" && email.Recipients != nil {
+		for _, r := range strings.Split(*email.Recipients, ", ") {
+			if r == address {
+				recipient = true
+				break
+			}
+		}
+	}
+
+	switch {
+	case sender && recipient:
+		return "both"
+	case sender:
+		return "sender"
+	case recipient:
+		return "recipient"
+	}
+	return ""
+}
+
+// StartDataSubjectRequest creates a request and searches the organization's
+// archives for the subject in the background. Access requests complete with
+// the search; erasure requests then wait for StartDataSubjectErasure.
+func StartDataSubjectRequest(req *database.DataSubjectRequest) error {
+	req.SubjectEmail = strings.ToLower(strings.TrimSpace(req.SubjectEmail))
+	req.SubjectName = strings.TrimSpace(req.SubjectName)
+	req.Status = DSRStatusSearching
+	if err := database.DB.Create(req).Error; err != nil {
+		return fmt.Errorf("failed to create data subject request: %v", err)
+	}
+
+	// The background search works on its own copy of the request
+	work := *req
+	go func(req *database.DataSubjectRequest) {
+		err := findSubjectMatches(req)
+		if err == nil && req.RequestType == DSRTypeAccess {
+			err = completeDataSubjectRequest(req)
+		}
+		if err != nil {
+			req.Status = DSRStatusFailed
+			req.ErrorMessage = err.Error()
+			log.Printf("❌ Data subject request %s failed: %v", req.ID, err)
+		} else {
+			log.Printf("🔎 Data subject request %s: %d emails found", req.ID, req.MatchCount)
+		}
+		if err := database.DB.Save(req).Error; err != nil {
+			log.Printf("⚠️ Failed to save data subject request %s: %v", req.ID, err)
+		}
+	}(&work)
+	return nil
+}
+
+// findSubjectMatches records every email of the organization subtree that the
+// subject sent or received. Names are matched against senders only, since the
+// index keeps recipient addresses without their display names.
+func findSubjectMatches(req *database.DataSubjectRequest) error {
+	accountIDs, err := OrganizationAccountIDs(req.OrganizationID)
+	if err != nil {
+		return err
+	}
+	if len(accountIDs) > 0 {
+		if err := backfillRecipients(context.Background(), accountIDs); err != nil {
+			return err
+		}
+	}
+
+	cond := database.DB.Where("1 = 0")
+	if req.SubjectEmail != "" {
+		cond = cond.Or("LOWER(sender_email) = ?", req.SubjectEmail).
+			Or("? = ANY(string_to_array(recipients, ', '))", req.SubjectEmail)
+	}
+	if req.SubjectName != "" {
+		cond = cond.Or("LOWER(TRIM(sender_name)) = LOWER(?)", req.SubjectName)
+	}
+
+	req.MatchCount = 0
+	if len(accountIDs) == 0 {
+		req.Status = DSRStatusReady
+		return nil
+	}
+
+	var batch []database.EmailIndex
+	result := database.DB.Where("account_id IN ?", accountIDs).Where(cond).
+		FindInBatches(&batch, 500, func(tx *gorm.DB, _ int) error {
+			for i := range batch {
+				email := &batch[i]
+				match := database.DataSubjectMatch{
+					RequestID:   req.ID,
+					EmailID:     email.ID,
+					AccountID:   email.AccountID,
+					MessageID:   email.MessageID,
+					Subject:     email.Subject,
+					SenderEmail: email.SenderEmail,
+					EmailDate:   email.Date,
+					Folder:      email.Folder,
+					MatchedAs:   subjectMatch(req, email),
+					Outcome:     DSROutcomePending,
+				}
+				if err := database.DB.Create(&match).Error; err != nil {
+					return fmt.Errorf("failed to record match: %v", err)
+				}
+				req.MatchCount++
+			}
+			return nil
+		})
+	if result.Error != nil {
+		return fmt.Errorf("failed to search archives: %v", result.Error)
+	}
+
+	req.Status = DSRStatusReady
+	return nil
+}
+
+// StartDataSubjectErasure redacts or deletes the emails found for an erasure
+// request in the background. Emails under a legal hold or compliance lock are
+// kept and reported as such in the certificate.
+func StartDataSubjectErasure(req *database.DataSubjectRequest, action string, processedBy uuid.UUID) error {
+	if req.RequestType != DSRTypeErasure || req.Status != DSRStatusReady {
+		return ErrDSRNotReady
+	}
+	req.Status = DSRStatusProcessing
+	req.Action = action
+	req.ProcessedBy = &processedBy
+	if err := database.DB.Save(req).Error; err != nil {
+		return fmt.Errorf("failed to update data subject request: %v", err)
+	}
+
+	work := *req
+	go func(req *database.DataSubjectRequest) {
+		err := eraseSubjectData(req)
+		if err == nil {
+			err = completeDataSubjectRequest(req)
+		}
+		if err != nil {
+			req.Status = DSRStatusFailed
+			req.ErrorMessage = err.Error()
+			log.Printf("❌ Erasure for data subject request %s failed: %v", req.ID, err)
+		} else {
+			log.Printf("🧹 Data subject request %s erased: %d redacted, %d deleted, %d held, %d locked, %d failed",
+				req.ID, req.EmailsRedacted, req.EmailsDeleted, req.EmailsHeld, req.EmailsLocked, req.EmailsFailed)
+		}
+		if err := database.DB.Save(req).Error; err != nil {
+			log.Printf("⚠️ Failed to save data subject request %s: %v", req.ID, err)
+		}
+	}(&work)
+	return nil
+}
+
+// eraseSubjectData applies the request's action to each pending match
+func eraseSubjectData(req *database.DataSubjectRequest) error {
+	holds, err := LoadActiveHolds()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	now := time.Now()
+	pattern := subjectPattern(req)
+
+	var batch []database.DataSubjectMatch
+	result := database.DB.Where("request_id = ? AND outcome = ?", req.ID, DSROutcomePending).
+		FindInBatches(&batch, 200, func(tx *gorm.DB, _ int) error {
+			for i := range batch {
+				match := &batch[i]
+				match.Outcome, match.Error = eraseMatch(ctx, req, holds, pattern, match, now)
+				if match.Outcome == DSROutcomeRedacted || match.Outcome == DSROutcomeDeleted {
+					// The match record must not keep what was erased from the email
+					match.Subject = pattern.ReplaceAllString(match.Subject, redactedMarker)
+					match.SenderEmail = pattern.ReplaceAllString(match.SenderEmail, redactedMarker)
+				}
+
+				switch match.Outcome {
+				case DSROutcomeRedacted:
+					req.EmailsRedacted++
+				case DSROutcomeDeleted:
+					req.EmailsDeleted++
+				case DSROutcomeHeld:
+					req.EmailsHeld++
+				case DSROutcomeLocked:
+					req.EmailsLocked++
+				case DSROutcomeFailed:
+					req.EmailsFailed++
+					log.Printf("⚠️ Failed to erase email %s: %s", match.EmailID, match.Error)
+				}
+				if err := database.DB.Save(match).Error; err != nil {
+					return fmt.Errorf("failed to record erasure outcome: %v", err)
+				}
+			}
+			return nil
+		})
+	return result.Error
+}
+
+// eraseMatch erases one matched email and returns the outcome
+func eraseMatch(ctx context.Context, req *database.DataSubjectRequest, holds *HoldSet, pattern *regexp.Regexp, match *database.DataSubjectMatch, now time.Time) (string, string) {
+	var email database.EmailIndex
+	if err := database.DB.First(&email, "id = ?", match.EmailID).Error; err != nil {
+		return DSROutcomeMissing, ""
+	}
+	if EmailLocked(&email, now) {
+		return DSROutcomeLocked, ""
+	}
+	if holds.Covers(&email) {
+		return DSROutcomeHeld, ""
+	}
+
+	if req.Action == DSRActionDelete {
+		if err := purgeEmail(ctx, &email); err != nil {
+			return DSROutcomeFailed, err.Error()
+		}
+		return DSROutcomeDeleted, ""
+	}
+	if err := redactEmail(ctx, req, pattern, &email); err != nil {
+		return DSROutcomeFailed, err.Error()
+	}
+	return DSROutcomeRedacted, ""
+}
+
+// redactEmail replaces the subject's identifiers in an email's stored document
+// and index entry. The redacted document is written under a new path so that
+// digests sealed for the original are not reported as tampered with. The raw
+// message is deleted, as its MIME encoding cannot be redacted reliably.
+func redactEmail(ctx context.Context, req *database.DataSubjectRequest, pattern *regexp.Regexp, email *database.EmailIndex) error {
+	obj, err := storage.OpenEmailObject(ctx, email.MinioPath)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(obj)
+	obj.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", email.MinioPath, err)
+	}
+
+	redacted := pattern.ReplaceAll(data, []byte(redactedMarker))
+	if !json.Valid(redacted) {
+		return fmt.Errorf("redaction of %s produced invalid JSON", email.MinioPath)
+	}
+
+	objectPath := fmt.Sprintf("%s.redacted-%s.json", strings.TrimSuffix(email.MinioPath, ".json"), req.ID)
+	stored, err := storage.PutObjectStream(ctx, objectPath, bytes.NewReader(redacted), int64(len(redacted)), "application/json")
+	if err != nil {
+		return fmt.Errorf("failed to store redacted email: %v", err)
+	}
+
+	for _, old := range []string{email.RawMinioPath, email.MinioPath} {
+		if old == "" {
+			continue
+		}
+		if err := storage.RemoveEmailObject(ctx, old); err != nil {
+			return fmt.Errorf("failed to delete object %s: %v", old, err)
+		}
+	}
+
+	updates := map[string]interface{}{
+		"subject":        pattern.ReplaceAllString(email.Subject, redactedMarker),
+		"sender_email":   pattern.ReplaceAllString(email.SenderEmail, redactedMarker),
+		"sender_name":    pattern.ReplaceAllString(email.SenderName, redactedMarker),
+		"minio_path":     stored.Path,
+		"content_sha256": stored.SHA256,
+		"raw_minio_path": "",
+		"raw_sha256":     "",
+		"email_size":     stored.Size,
+	}
+	if email.Recipients != nil {
+		updates["recipients"] = pattern.ReplaceAllString(*email.Recipients, redactedMarker)
+	}
+	if err := database.DB.Model(email).Updates(updates).Error; err != nil {
+		return fmt.Errorf("failed to update email index: %v", err)
+	}
+	return nil
+}
+
+// DSRCertificate is the signed record of a completed data subject request.
+// It identifies the subject only by a hash, so keeping it does not retain the
+// personal data that was erased.
+type DSRCertificate struct {
+	RequestID      uuid.UUID            `json:"request_id"`
+	OrganizationID uuid.UUID            `json:"organization_id"`
+	RequestType    string               `json:"request_type"`
+	Reference      string               `json:"reference,omitempty"`
+	SubjectSHA256  string               `json:"subject_sha256"`
+	Action         string               `json:"action,omitempty"`
+	RequestedBy    uuid.UUID            `json:"requested_by"`
+	ProcessedBy    *uuid.UUID           `json:"processed_by,omitempty"`
+	RequestedAt    time.Time            `json:"requested_at"`
+	CompletedAt    time.Time            `json:"completed_at"`
+	EmailsFound    int                  `json:"emails_found"`
+	EmailsRedacted int                  `json:"emails_redacted"`
+	EmailsDeleted  int                  `json:"emails_deleted"`
+	EmailsHeld     int                  `json:"emails_held"`
+	EmailsLocked   int                  `json:"emails_locked"`
+	EmailsFailed   int                  `json:"emails_failed"`
+	Items          []DSRCertificateItem `json:"items"`
+	Signature      string               `json:"signature_algorithm"`
+}
+
+// DSRCertificateItem is the outcome for one email
+type DSRCertificateItem struct {
+	EmailID uuid.UUID `json:"email_id"`
+	Outcome string    `json:"outcome"`
+}
+
+// SubjectFingerprint hashes a subject's identifiers so a certificate can be
+// matched to a later enquiry by the same person
+func SubjectFingerprint(subjectEmail, subjectName string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(subjectEmail)) + "\n" + strings.ToLower(strings.TrimSpace(subjectName))))
+	return hex.EncodeToString(sum[:])
+}
+
+// signCertificate returns the HMAC-SHA256 of a certificate
+func signCertificate(certificate []byte) string {
+	mac := hmac.New(sha256.New, []byte(PrivacySettings.CertificateKey))
+	mac.Write(certificate)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyDSRCertificate checks that a stored certificate still matches its signature
+func VerifyDSRCertificate(req *database.DataSubjectRequest) bool {
+	if req.Certificate == "" || req.CertificateSignature == "" {
+		return false
+	}
+	return hmac.Equal([]byte(signCertificate([]byte(req.Certificate))), []byte(req.CertificateSignature))
+}
+
+// completeDataSubjectRequest issues the signed certificate and completes the request
+func completeDataSubjectRequest(req *database.DataSubjectRequest) error {
+	now := time.Now().UTC()
+	certificate := DSRCertificate{
+		RequestID:      req.ID,
+		OrganizationID: req.OrganizationID,
+		RequestType:    req.RequestType,
+		Reference:      req.Reference,
+		SubjectSHA256:  SubjectFingerprint(req.SubjectEmail, req.SubjectName),
+		Action:         req.Action,
+		RequestedBy:    req.CreatedBy,
+		ProcessedBy:    req.ProcessedBy,
+		RequestedAt:    req.CreatedAt.UTC(),
+		CompletedAt:    now,
+		EmailsFound:    req.MatchCount,
+		EmailsRedacted: req.EmailsRedacted,
+		EmailsDeleted:  req.EmailsDeleted,
+		EmailsHeld:     req.EmailsHeld,
+		EmailsLocked:   req.EmailsLocked,
+		EmailsFailed:   req.EmailsFailed,
+		Items:          []DSRCertificateItem{},
+		Signature:      "HMAC-SHA256",
+	}
+
+	if req.RequestType == DSRTypeAccess {
+		if err := database.DB.Model(&database.DataSubjectMatch{}).
+			Where("request_id = ? AND outcome = ?", req.ID, DSROutcomePending).
+			Update("outcome", DSROutcomeReported).Error; err != nil {
+			return fmt.Errorf("failed to update matches: %v", err)
+		}
+	}
+
+	var matches []database.DataSubjectMatch
+	if err := database.DB.Select("email_id", "outcome").Where("request_id = ?", req.ID).
+		Order("email_date ASC").Find(&matches).Error; err != nil {
+		return fmt.Errorf("failed to load matches: %v", err)
+	}
+	for _, match := range matches {
+		certificate.Items = append(certificate.Items, DSRCertificateItem{EmailID: match.EmailID, Outcome: match.Outcome})
+	}
+
+	data, err := json.Marshal(certificate)
+	if err != nil {
+		return fmt.Errorf("failed to marshal certificate: %v", err)
+	}
+	req.Certificate = string(data)
+	req.CertificateSignature = signCertificate(data)
+	req.Status = DSRStatusCompleted
+	req.CompletedAt = &now
+	return nil
+}
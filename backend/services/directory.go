@@ -0,0 +1,677 @@
+package services
+
+import (
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"emailprojectv2/auth"
+	"emailprojectv2/config"
+	"emailprojectv2/database"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Errors for directory logins and syncs
+var (
+	ErrDirectoryNotConfigured = errors.New("no directory is configured for this organization")
+	ErrNotDirectoryUser       = errors.New("user does not sign in through a directory")
+	ErrDirectoryCredentials   = errors.New("invalid directory credentials")
+	ErrDirectorySyncRunning   = errors.New("a sync of this directory is already running")
+)
+
+// DirectorySettings holds the LDAP / Active Directory settings
+var DirectorySettings = config.DirectoryConfig{SyncIntervalMinutes: 60, TimeoutSeconds: 10, PageSize: 500}
+
+// ConfigureDirectory replaces the directory settings
+func ConfigureDirectory(cfg config.DirectoryConfig) {
+	if cfg.SyncIntervalMinutes < 1 {
+		cfg.SyncIntervalMinutes = 60
+	}
+	if cfg.TimeoutSeconds < 1 {
+		cfg.TimeoutSeconds = 10
+	}
+	if cfg.PageSize < 1 {
+		cfg.PageSize = 500
+	}
+	DirectorySettings = cfg
+	log.Printf("📇 Directory sync every %d minutes", cfg.SyncIntervalMinutes)
+}
+
+// adAccountDisabled is the ACCOUNTDISABLE flag of Active Directory's userAccountControl
+const adAccountDisabled = 0x2
+
+// adMatchingRuleInChain makes a memberOf filter include members of nested groups
+const adMatchingRuleInChain = "1.2.840.113556.1.4.1941"
+
+// directorySyncsMu guards directorySyncs, the organizations whose directory is being synced
+var (
+	directorySyncsMu sync.Mutex
+	directorySyncs   = map[uuid.UUID]bool{}
+)
+
+// directoryEntry is a user found in a directory
+type directoryEntry struct {
+	DN         string
+	ExternalID string
+	Email      string
+	Disabled   bool
+}
+
+// directoryManagedAccount marks the mailbox accounts a directory sync created
+const directoryManagedAccount = `{"directory_sync": true}`
+
+// ValidateDirectoryURL checks that a directory URL is an ldap:// or ldaps:// URL
+func ValidateDirectoryURL(raw string) error {
+	parsed, err := url.Parse(raw)
+	if err != nil || parsed.Host == "" || (parsed.Scheme != "ldap" && parsed.Scheme != "ldaps") {
+		return fmt.Errorf("%q is not an ldap:// or ldaps:// URL", raw)
+	}
+	return nil
+}
+
+// LoadOrganizationDirectory returns the active directory of an organization
+func LoadOrganizationDirectory(orgID uuid.UUID) (*database.OrganizationDirectory, error) {
+	var dir database.OrganizationDirectory
+	err := database.DB.Where("organization_id = ? AND is_active = ?", orgID, true).First(&dir).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrDirectoryNotConfigured
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load directory: %v", err)
+	}
+	return &dir, nil
+}
+
+// connectDirectory opens a connection to a directory bound as its service account
+func connectDirectory(dir *database.OrganizationDirectory) (*ldap.Conn, error) {
+	timeout := time.Duration(DirectorySettings.TimeoutSeconds) * time.Second
+	tlsConfig := &tls.Config{InsecureSkipVerify: dir.InsecureSkipVerify}
+	if parsed, err := url.Parse(dir.URL); err == nil {
+		tlsConfig.ServerName = parsed.Hostname()
+	}
+
+	conn, err := ldap.DialURL(dir.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: timeout}),
+		ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to directory: %v", err)
+	}
+	conn.SetTimeout(timeout)
+
+	if dir.StartTLS && strings.HasPrefix(dir.URL, "ldap://") {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to start TLS with directory: %v", err)
+		}
+	}
+	if err := conn.Bind(dir.BindDN, dir.BindPassword); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to bind to directory as %s: %v", dir.BindDN, err)
+	}
+	return conn, nil
+}
+
+// groupMemberFilter matches the users of a directory's group, with an
+// optional extra condition
+func groupMemberFilter(dir *database.OrganizationDirectory, extra string) string {
+	return "(&" + dir.UserFilter +
+		"(memberOf:" + adMatchingRuleInChain + ":=" + ldap.EscapeFilter(dir.GroupDN) + ")" +
+		extra + ")"
+}
+
+// externalIDFilter matches the entry with a stored external ID
+func externalIDFilter(dir *database.OrganizationDirectory, externalID string) (string, error) {
+	if !strings.EqualFold(dir.IDAttribute, "objectGUID") {
+		return "(" + dir.IDAttribute + "=" + ldap.EscapeFilter(externalID) + ")", nil
+	}
+	raw, err := hex.DecodeString(externalID)
+	if err != nil {
+		return "", fmt.Errorf("invalid objectGUID %q", externalID)
+	}
+	var filter strings.Builder
+	filter.WriteString("(objectGUID=")
+	for _, b := range raw {
+		fmt.Fprintf(&filter, "\\%02x", b)
+	}
+	filter.WriteString(")")
+	return filter.String(), nil
+}
+
+// searchDirectory returns the group members matching filter, a page at a time
+func searchDirectory(conn *ldap.Conn, dir *database.OrganizationDirectory, extra string) ([]directoryEntry, error) {
+	request := ldap.NewSearchRequest(
+		dir.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		groupMemberFilter(dir, extra),
+		[]string{dir.IDAttribute, dir.EmailAttribute, "userAccountControl"},
+		nil,
+	)
+	result, err := conn.SearchWithPaging(request, uint32(DirectorySettings.PageSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to search directory: %v", err)
+	}
+
+	entries := make([]directoryEntry, 0, len(result.Entries))
+	for _, e := range result.Entries {
+		entry := directoryEntry{
+			DN:    e.DN,
+			Email: strings.ToLower(strings.TrimSpace(e.GetAttributeValue(dir.EmailAttribute))),
+		}
+		if strings.EqualFold(dir.IDAttribute, "objectGUID") {
+			entry.ExternalID = hex.EncodeToString(e.GetRawAttributeValue(dir.IDAttribute))
+		} else {
+			entry.ExternalID = e.GetAttributeValue(dir.IDAttribute)
+		}
+		if flags, err := strconv.ParseInt(e.GetAttributeValue("userAccountControl"), 10, 64); err == nil {
+			entry.Disabled = flags&adAccountDisabled != 0
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// TestDirectory connects to a directory and searches its group, returning
+// the number of members found
+func TestDirectory(dir *database.OrganizationDirectory) (int, error) {
+	conn, err := connectDirectory(dir)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	entries, err := searchDirectory(conn, dir, "")
+	if err != nil {
+		return 0, err
+	}
+	return len(entries), nil
+}
+
+// loginDirectory returns the directory a user signs in with, or
+// ErrNotDirectoryUser for users who sign in with a local password
+func loginDirectory(user *database.User) (*database.DirectoryUser, *database.OrganizationDirectory, error) {
+	var link database.DirectoryUser
+	err := database.DB.Where("user_id = ?", user.ID).First(&link).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil, ErrNotDirectoryUser
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load directory user: %v", err)
+	}
+	// Only the directory of the user's primary organization signs them in
+	if user.PrimaryOrgID == nil || *user.PrimaryOrgID != link.OrganizationID {
+		return nil, nil, ErrNotDirectoryUser
+	}
+	dir, err := LoadOrganizationDirectory(link.OrganizationID)
+	if errors.Is(err, ErrDirectoryNotConfigured) {
+		return nil, nil, ErrNotDirectoryUser
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if !dir.LoginEnabled {
+		return nil, nil, ErrNotDirectoryUser
+	}
+	return &link, dir, nil
+}
+
+// DirectoryManagesPassword reports whether a user signs in with their
+// directory password, which cannot be changed or reset here
+func DirectoryManagesPassword(user *database.User) (bool, error) {
+	_, _, err := loginDirectory(user)
+	if errors.Is(err, ErrNotDirectoryUser) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// CheckDirectoryPassword authenticates a user synced from a directory with
+// login enabled by binding as them. It returns ErrNotDirectoryUser for users
+// who sign in with a local password.
+func CheckDirectoryPassword(user *database.User, password string) error {
+	link, dir, err := loginDirectory(user)
+	if err != nil {
+		return err
+	}
+
+	// An empty password would be an unauthenticated bind, which servers accept
+	if password == "" || link.DisabledAt != nil {
+		return ErrDirectoryCredentials
+	}
+
+	conn, err := connectDirectory(dir)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Look the entry up again so users removed from the group cannot sign
+	// in before the next sync disables them
+	idFilter, err := externalIDFilter(dir, link.ExternalID)
+	if err != nil {
+		return err
+	}
+	entries, err := searchDirectory(conn, dir, idFilter)
+	if err != nil {
+		return err
+	}
+	if len(entries) != 1 || entries[0].Disabled {
+		return ErrDirectoryCredentials
+	}
+
+	if err := conn.Bind(entries[0].DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return ErrDirectoryCredentials
+		}
+		return fmt.Errorf("failed to bind to directory as user: %v", err)
+	}
+	return nil
+}
+
+// SyncAllDirectories syncs every active directory with sync enabled
+func SyncAllDirectories() error {
+	var dirs []database.OrganizationDirectory
+	if err := database.DB.Where("is_active = ? AND sync_enabled = ?", true, true).Find(&dirs).Error; err != nil {
+		return fmt.Errorf("failed to load directories: %v", err)
+	}
+
+	failed := 0
+	for _, dir := range dirs {
+		if _, err := SyncDirectory(dir.OrganizationID, nil); err != nil {
+			if errors.Is(err, ErrDirectorySyncRunning) {
+				continue
+			}
+			log.Printf("❌ Directory sync of organization %s failed: %v", dir.OrganizationID, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d directory syncs failed", failed, len(dirs))
+	}
+	return nil
+}
+
+// SyncDirectory syncs the members of an organization's directory group to its
+// users: new members are created as end users, changed ones updated, and
+// users who left the group or were disabled in the directory are disabled.
+func SyncDirectory(orgID uuid.UUID, triggeredBy *uuid.UUID) (*database.DirectorySyncRun, error) {
+	dir, err := LoadOrganizationDirectory(orgID)
+	if err != nil {
+		return nil, err
+	}
+
+	directorySyncsMu.Lock()
+	if directorySyncs[orgID] {
+		directorySyncsMu.Unlock()
+		return nil, ErrDirectorySyncRunning
+	}
+	directorySyncs[orgID] = true
+	directorySyncsMu.Unlock()
+	defer func() {
+		directorySyncsMu.Lock()
+		delete(directorySyncs, orgID)
+		directorySyncsMu.Unlock()
+	}()
+
+	run := &database.DirectorySyncRun{
+		OrganizationID: orgID,
+		TriggeredBy:    triggeredBy,
+		Status:         "running",
+		StartedAt:      time.Now(),
+	}
+	if err := database.DB.Create(run).Error; err != nil {
+		return nil, fmt.Errorf("failed to record directory sync: %v", err)
+	}
+	log.Printf("📇 Syncing directory of organization %s", orgID)
+
+	syncErr := (&directorySync{dir: dir, run: run}).execute()
+
+	now := time.Now()
+	run.CompletedAt = &now
+	run.Status = "completed"
+	if syncErr != nil {
+		run.Status = "failed"
+		run.ErrorMessage = syncErr.Error()
+	}
+	if err := database.DB.Save(run).Error; err != nil {
+		log.Printf("⚠️ Failed to record directory sync result: %v", err)
+	}
+	if syncErr == nil {
+		database.DB.Model(dir).Update("last_sync_at", now)
+	}
+
+	log.Printf("📇 Directory sync of organization %s %s: %d found, %d created, %d updated, %d disabled, %d enabled, %d mailboxes added, %d skipped",
+		orgID, run.Status, run.EntriesFound, run.UsersCreated, run.UsersUpdated, run.UsersDisabled, run.UsersEnabled, run.AccountsCreated, run.EntriesSkipped)
+	return run, syncErr
+}
+
+// directorySync is one run of a directory sync
+type directorySync struct {
+	dir      *database.OrganizationDirectory
+	run      *database.DirectorySyncRun
+	role     database.Role
+	warnings []string
+}
+
+// skip records an entry the sync could not apply
+func (ds *directorySync) skip(format string, args ...interface{}) {
+	ds.run.EntriesSkipped++
+	ds.warnings = append(ds.warnings, fmt.Sprintf(format, args...))
+}
+
+func (ds *directorySync) execute() error {
+	if err := database.DB.Where("name = ?", "end_user").First(&ds.role).Error; err != nil {
+		return fmt.Errorf("failed to load end_user role: %v", err)
+	}
+
+	conn, err := connectDirectory(ds.dir)
+	if err != nil {
+		return err
+	}
+	entries, err := searchDirectory(conn, ds.dir, "")
+	conn.Close()
+	if err != nil {
+		return err
+	}
+	ds.run.EntriesFound = len(entries)
+
+	var links []database.DirectoryUser
+	if err := database.DB.Where("organization_id = ?", ds.dir.OrganizationID).Find(&links).Error; err != nil {
+		return fmt.Errorf("failed to load directory users: %v", err)
+	}
+	linked := make(map[string]*database.DirectoryUser, len(links))
+	enabledLinks := 0
+	for i := range links {
+		linked[links[i].ExternalID] = &links[i]
+		if links[i].DisabledAt == nil {
+			enabledLinks++
+		}
+	}
+
+	// A search that suddenly finds nobody is far more likely a wrong filter
+	// or group than everyone leaving; do not disable the whole organization
+	if len(entries) == 0 && enabledLinks > 0 {
+		return fmt.Errorf("directory group returned no members; not disabling %d users", enabledLinks)
+	}
+
+	now := time.Now()
+	seen := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		if entry.ExternalID == "" {
+			ds.skip("%s: no %s", entry.DN, ds.dir.IDAttribute)
+			continue
+		}
+		seen[entry.ExternalID] = true
+		if entry.Email == "" || !strings.Contains(entry.Email, "@") {
+			ds.skip("%s: no email address in %s", entry.DN, ds.dir.EmailAttribute)
+			continue
+		}
+
+		var userID uuid.UUID
+		if link, ok := linked[entry.ExternalID]; ok {
+			if err := ds.updateUser(link, entry, now); err != nil {
+				ds.skip("%s: %v", entry.DN, err)
+				continue
+			}
+			userID = link.UserID
+			if entry.Disabled {
+				continue
+			}
+		} else {
+			if entry.Disabled {
+				continue
+			}
+			created, err := ds.linkUser(entry, now)
+			if err != nil {
+				ds.skip("%s: %v", entry.DN, err)
+				continue
+			}
+			userID = created
+		}
+
+		if ds.dir.CreateMailboxAccounts {
+			if err := ds.ensureMailboxAccount(userID, entry.Email); err != nil {
+				ds.skip("%s: mailbox account: %v", entry.DN, err)
+			}
+		}
+	}
+
+	for _, link := range links {
+		if !seen[link.ExternalID] && link.DisabledAt == nil {
+			if err := ds.setDisabled(&link, true, now); err != nil {
+				ds.skip("%s: %v", link.DN, err)
+			}
+		}
+	}
+
+	ds.run.Warnings = strings.Join(ds.warnings, "\n")
+	return nil
+}
+
+// updateUser applies a directory entry to the user it is linked to
+func (ds *directorySync) updateUser(link *database.DirectoryUser, entry directoryEntry, now time.Time) error {
+	var user database.User
+	if err := database.DB.First(&user, "id = ?", link.UserID).Error; err != nil {
+		return fmt.Errorf("failed to load user: %v", err)
+	}
+
+	if !strings.EqualFold(user.Email, entry.Email) {
+		var taken int64
+		database.DB.Model(&database.User{}).Where("LOWER(email) = ? AND id <> ?", entry.Email, user.ID).Count(&taken)
+		if taken > 0 {
+			return fmt.Errorf("cannot change email to %s, another user has it", entry.Email)
+		}
+		if err := database.DB.Model(&user).Update("email", entry.Email).Error; err != nil {
+			return fmt.Errorf("failed to update email: %v", err)
+		}
+		ds.run.UsersUpdated++
+	}
+
+	if err := database.DB.Model(link).Updates(map[string]interface{}{"dn": entry.DN, "last_seen_at": now}).Error; err != nil {
+		return fmt.Errorf("failed to update directory user: %v", err)
+	}
+
+	switch {
+	case entry.Disabled && link.DisabledAt == nil:
+		return ds.setDisabled(link, true, now)
+	case !entry.Disabled && link.DisabledAt != nil:
+		return ds.setDisabled(link, false, now)
+	}
+	return nil
+}
+
+// linkUser links a new directory entry to the organization's user with its
+// email address, or creates that user
+func (ds *directorySync) linkUser(entry directoryEntry, now time.Time) (uuid.UUID, error) {
+	orgID := ds.dir.OrganizationID
+	link := database.DirectoryUser{OrganizationID: orgID, ExternalID: entry.ExternalID, DN: entry.DN, LastSeenAt: now}
+
+	var user database.User
+	err := database.DB.Preload("Role").Where("LOWER(email) = ?", entry.Email).First(&user).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return uuid.Nil, fmt.Errorf("failed to load user: %v", err)
+	}
+
+	if err == nil {
+		// Existing users are only taken over when the organization is their
+		// primary one and the directory could have created them itself;
+		// other members keep signing in with their own password
+		if user.PrimaryOrgID == nil || *user.PrimaryOrgID != orgID {
+			return uuid.Nil, fmt.Errorf("conflict: %s has another primary organization", entry.Email)
+		}
+		if user.Role == nil || user.Role.Level < ds.role.Level {
+			return uuid.Nil, fmt.Errorf("conflict: %s has a role above what the directory grants", entry.Email)
+		}
+		var other int64
+		database.DB.Model(&database.DirectoryUser{}).Where("user_id = ?", user.ID).Count(&other)
+		if other > 0 {
+			return uuid.Nil, fmt.Errorf("%s is already linked to another directory entry", entry.Email)
+		}
+		link.UserID = user.ID
+		if err := database.DB.Create(&link).Error; err != nil {
+			return uuid.Nil, fmt.Errorf("failed to link user: %v", err)
+		}
+		ds.run.UsersUpdated++
+		return user.ID, nil
+	}
+
+	if _, err := CheckQuota(orgID, QuotaUsers, 1); err != nil {
+		return uuid.Nil, err
+	}
+
+	// Directory users sign in with their directory password
+	secret, err := randomToken()
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to generate password: %v", err)
+	}
+	hash, err := auth.HashPassword(secret)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to hash password: %v", err)
+	}
+
+	user = database.User{Email: entry.Email, PasswordHash: hash, RoleID: &ds.role.ID, PrimaryOrgID: &orgID}
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&user).Error; err != nil {
+			return fmt.Errorf("failed to create user: %v", err)
+		}
+		membership := database.UserOrganization{UserID: user.ID, OrganizationID: orgID, RoleID: ds.role.ID, IsPrimary: true}
+		if err := tx.Create(&membership).Error; err != nil {
+			return fmt.Errorf("failed to add user to organization: %v", err)
+		}
+		link.UserID = user.ID
+		if err := tx.Create(&link).Error; err != nil {
+			return fmt.Errorf("failed to link user: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	ds.run.UsersCreated++
+	RecordAudit(database.AuditEvent{
+		OrganizationID: &orgID,
+		Action:         "user.create",
+		TargetType:     "user",
+		TargetID:       user.ID.String(),
+		Detail:         "directory sync " + ds.run.ID.String(),
+	})
+	return user.ID, nil
+}
+
+// setDisabled disables or re-enables a directory user. Disabling ends their
+// sessions, revokes their API keys and pauses the mailbox accounts the sync
+// created; enabling resumes those accounts.
+func (ds *directorySync) setDisabled(link *database.DirectoryUser, disabled bool, now time.Time) error {
+	var disabledAt *time.Time
+	if disabled {
+		disabledAt = &now
+	}
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(link).Update("disabled_at", disabledAt).Error; err != nil {
+			return fmt.Errorf("failed to update directory user: %v", err)
+		}
+		if err := tx.Model(&database.User{}).Where("id = ?", link.UserID).Update("disabled_at", disabledAt).Error; err != nil {
+			return fmt.Errorf("failed to update user: %v", err)
+		}
+		if err := tx.Model(&database.EmailAccount{}).
+			Where("user_id = ? AND provider_settings @> ?::jsonb", link.UserID, directoryManagedAccount).
+			Update("is_active", !disabled).Error; err != nil {
+			return fmt.Errorf("failed to update mailbox accounts: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	link.DisabledAt = disabledAt
+
+	action := "user.enable"
+	if disabled {
+		action = "user.disable"
+		ds.run.UsersDisabled++
+		if _, err := RevokeUserSessions(link.UserID, SessionRevokedDisabled); err != nil {
+			return err
+		}
+		if _, err := RevokeUserAPIKeys(link.UserID); err != nil {
+			return err
+		}
+	} else {
+		ds.run.UsersEnabled++
+	}
+	RecordAudit(database.AuditEvent{
+		OrganizationID: &ds.dir.OrganizationID,
+		Action:         action,
+		TargetType:     "user",
+		TargetID:       link.UserID.String(),
+		Detail:         "directory sync " + ds.run.ID.String(),
+	})
+	return nil
+}
+
+// ensureMailboxAccount creates the Exchange account that backs up a synced
+// user's mailbox through the directory's impersonating service account, or
+// refreshes the service account details of an existing one
+func (ds *directorySync) ensureMailboxAccount(userID uuid.UUID, email string) error {
+	if ds.dir.ExchangeServerURL == "" || ds.dir.ExchangeUsername == "" {
+		return errors.New("no Exchange service account is configured")
+	}
+	settings, _ := json.Marshal(map[string]interface{}{"directory_sync": true, "impersonate": email})
+
+	var account database.EmailAccount
+	err := database.DB.Where("user_id = ? AND provider = ? AND LOWER(email) = ?", userID, "exchange", email).First(&account).Error
+	if err == nil {
+		if account.ServerURL == ds.dir.ExchangeServerURL && account.Username == ds.dir.ExchangeUsername &&
+			account.Password == ds.dir.ExchangePassword && account.Domain == ds.dir.ExchangeDomain {
+			return nil
+		}
+		return database.DB.Model(&account).Updates(map[string]interface{}{
+			"server_url": ds.dir.ExchangeServerURL,
+			"username":   ds.dir.ExchangeUsername,
+			"password":   ds.dir.ExchangePassword,
+			"domain":     ds.dir.ExchangeDomain,
+		}).Error
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return fmt.Errorf("failed to load account: %v", err)
+	}
+
+	if _, err := CheckAccountQuota(userID); err != nil {
+		return err
+	}
+	account = database.EmailAccount{
+		UserID:           userID,
+		Email:            email,
+		Provider:         "exchange",
+		ServerURL:        ds.dir.ExchangeServerURL,
+		Domain:           ds.dir.ExchangeDomain,
+		Username:         ds.dir.ExchangeUsername,
+		Password:         ds.dir.ExchangePassword,
+		AuthMethod:       "ntlm",
+		ProviderSettings: string(settings),
+		IsActive:         true,
+	}
+	if err := database.DB.Create(&account).Error; err != nil {
+		return fmt.Errorf("failed to create account: %v", err)
+	}
+	ds.run.AccountsCreated++
+	return nil
+}
+
+// ValidateDirectoryFilter checks that a user filter is a valid LDAP filter
+func ValidateDirectoryFilter(filter string) error {
+	if _, err := ldap.CompileFilter(filter); err != nil {
+		return fmt.Errorf("invalid LDAP filter %q: %v", filter, err)
+	}
+	return nil
+}
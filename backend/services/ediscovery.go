@@ -0,0 +1,284 @@
+package services
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"emailprojectv2/database"
+	"emailprojectv2/storage"
+
+	"github.com/google/uuid"
+)
+
+// PermissionComplianceOfficer allows eDiscovery across the mailboxes of an organization subtree
+const PermissionComplianceOfficer = "compliance_officer"
+
+// HasPermissionFor reports whether a user holds a granted permission over an
+// organization, through a grant on the organization itself or any ancestor
+func HasPermissionFor(userID, orgID uuid.UUID, permission string) (bool, error) {
+	chain, err := OrganizationChain(orgID)
+	if err != nil {
+		return false, err
+	}
+
+	var count int64
+	err = database.DB.Model(&database.PermissionGrant{}).
+		Where("user_id = ? AND permission = ? AND organization_id IN ?", userID, permission, chain).
+		Count(&count).Error
+	if err != nil {
+		return false, fmt.Errorf("failed to check permission grants: %v", err)
+	}
+	return count > 0, nil
+}
+
+// GrantedOrganizations returns the organizations a user holds a permission on
+func GrantedOrganizations(userID uuid.UUID, permission string) ([]uuid.UUID, error) {
+	var ids []uuid.UUID
+	err := database.DB.Model(&database.PermissionGrant{}).
+		Where("user_id = ? AND permission = ?", userID, permission).
+		Pluck("organization_id", &ids).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to load permission grants: %v", err)
+	}
+	return ids, nil
+}
+
+// SearchCaseEmails runs a search over the mailboxes of a case's organization subtree
+func SearchCaseEmails(dc *database.DiscoveryCase, criteria HoldSearchCriteria, page, limit int) ([]database.EmailIndex, int64, error) {
+	accountIDs, err := OrganizationAccountIDs(dc.OrganizationID)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(criteria.AccountIDs) > 0 {
+		accountIDs = intersectIDs(accountIDs, criteria.AccountIDs)
+	}
+
+	emails := []database.EmailIndex{}
+	if len(accountIDs) == 0 {
+		return emails, 0, nil
+	}
+
+	query := criteria.apply(database.DB.Model(&database.EmailIndex{}).Where("account_id IN ?", accountIDs))
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, fmt.Errorf("failed to count search results: %v", err)
+	}
+	if err := query.Order("date DESC").Offset((page - 1) * limit).Limit(limit).Find(&emails).Error; err != nil {
+		return nil, 0, fmt.Errorf("failed to search emails: %v", err)
+	}
+	return emails, total, nil
+}
+
+// ExportManifest describes the contents of a case package
+type ExportManifest struct {
+	CaseID       uuid.UUID             `json:"case_id"`
+	CaseName     string                `json:"case_name"`
+	ExportID     uuid.UUID             `json:"export_id"`
+	Tag          string                `json:"tag,omitempty"`
+	GeneratedAt  time.Time             `json:"generated_at"`
+	GeneratedBy  uuid.UUID             `json:"generated_by"`
+	HashFunction string                `json:"hash_function"`
+	Items        []ExportManifestEntry `json:"items"`
+}
+
+// ExportManifestEntry describes one email of a case package
+type ExportManifestEntry struct {
+	EmailID     uuid.UUID            `json:"email_id"`
+	AccountID   uuid.UUID            `json:"account_id"`
+	MessageID   string               `json:"message_id"`
+	Subject     string               `json:"subject"`
+	SenderEmail string               `json:"sender_email"`
+	Date        time.Time            `json:"date"`
+	Folder      string               `json:"folder"`
+	Tags        []string             `json:"tags"`
+	Files       []ExportManifestFile `json:"files"`
+}
+
+// ExportManifestFile is one file in a case package with its hash. Verified is
+// true when the content still matches the hash recorded at ingest.
+type ExportManifestFile struct {
+	Path           string `json:"path"`
+	Size           int64  `json:"size"`
+	SHA256         string `json:"sha256"`
+	RecordedSHA256 string `json:"recorded_sha256,omitempty"`
+	Verified       bool   `json:"verified"`
+}
+
+// StartDiscoveryExport creates an export record and builds the case package in the background
+func StartDiscoveryExport(dc *database.DiscoveryCase, tag string, requestedBy uuid.UUID) (*database.DiscoveryExport, error) {
+	export := &database.DiscoveryExport{
+		CaseID:      dc.ID,
+		Tag:         tag,
+		Status:      "running",
+		RequestedBy: requestedBy,
+	}
+	if err := database.DB.Create(export).Error; err != nil {
+		return nil, fmt.Errorf("failed to create export: %v", err)
+	}
+
+	go func() {
+		err := buildDiscoveryExport(dc, export)
+
+		now := time.Now()
+		export.CompletedAt = &now
+		export.Status = "completed"
+		if err != nil {
+			export.Status = "failed"
+			export.ErrorMessage = err.Error()
+			log.Printf("❌ eDiscovery export %s failed: %v", export.ID, err)
+		} else {
+			log.Printf("📦 eDiscovery export %s completed: %d emails, %d bytes", export.ID, export.ItemCount, export.PackageSize)
+		}
+		if err := database.DB.Save(export).Error; err != nil {
+			log.Printf("⚠️ Failed to save eDiscovery export %s: %v", export.ID, err)
+		}
+	}()
+
+	return export, nil
+}
+
+// buildDiscoveryExport streams the case's emails and manifest into a zip
+// archive stored in MinIO
+func buildDiscoveryExport(dc *database.DiscoveryCase, export *database.DiscoveryExport) error {
+	query := database.DB.Where("case_id = ?", dc.ID)
+	if export.Tag != "" {
+		query = query.Where("tags @> ?", fmt.Sprintf("[%q]", export.Tag))
+	}
+	var items []database.DiscoveryItem
+	if err := query.Order("created_at ASC").Find(&items).Error; err != nil {
+		return fmt.Errorf("failed to load case items: %v", err)
+	}
+
+	ctx := context.Background()
+	manifest := ExportManifest{
+		CaseID:       dc.ID,
+		CaseName:     dc.Name,
+		ExportID:     export.ID,
+		Tag:          export.Tag,
+		GeneratedAt:  time.Now().UTC(),
+		GeneratedBy:  export.RequestedBy,
+		HashFunction: "SHA-256",
+		Items:        []ExportManifestEntry{},
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		zw := zip.NewWriter(pw)
+		err := writeExportPackage(ctx, zw, items, &manifest, export)
+		if closeErr := zw.Close(); err == nil {
+			err = closeErr
+		}
+		pw.CloseWithError(err)
+	}()
+
+	objectPath := fmt.Sprintf("ediscovery/%s/%s.zip", dc.ID, export.ID)
+	stored, err := storage.PutObjectStream(ctx, objectPath, pr, -1, "application/zip")
+	if err != nil {
+		pr.CloseWithError(err)
+		return fmt.Errorf("failed to store case package: %v", err)
+	}
+
+	export.MinioPath = stored.Path
+	export.PackageSize = stored.Size
+	export.PackageSHA256 = stored.SHA256
+	export.ItemCount = len(manifest.Items)
+	return nil
+}
+
+// writeExportPackage writes every item's stored objects and then the manifest
+func writeExportPackage(ctx context.Context, zw *zip.Writer, items []database.DiscoveryItem, manifest *ExportManifest, export *database.DiscoveryExport) error {
+	for _, item := range items {
+		var email database.EmailIndex
+		if err := database.DB.First(&email, "id = ?", item.EmailID).Error; err != nil {
+			// Removed from the archive since it was added to the case
+			log.Printf("⚠️ eDiscovery export %s: email %s no longer archived", export.ID, item.EmailID)
+			continue
+		}
+
+		entry := ExportManifestEntry{
+			EmailID:     email.ID,
+			AccountID:   email.AccountID,
+			MessageID:   email.MessageID,
+			Subject:     email.Subject,
+			SenderEmail: email.SenderEmail,
+			Date:        email.Date,
+			Folder:      email.Folder,
+			Tags:        []string{},
+		}
+		json.Unmarshal([]byte(item.Tags), &entry.Tags)
+
+		objects := []struct{ source, name, recorded string }{
+			{email.MinioPath, fmt.Sprintf("messages/%s.json", email.ID), email.ContentSHA256},
+			{email.RawMinioPath, fmt.Sprintf("messages/%s.eml", email.ID), email.RawSHA256},
+		}
+		for _, obj := range objects {
+			if obj.source == "" {
+				continue
+			}
+			file, err := copyObjectToZip(ctx, zw, obj.source, obj.name)
+			if err != nil {
+				return err
+			}
+			file.RecordedSHA256 = obj.recorded
+			file.Verified = obj.recorded != "" && obj.recorded == file.SHA256
+			entry.Files = append(entry.Files, *file)
+		}
+		manifest.Items = append(manifest.Items, entry)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest: %v", err)
+	}
+	w, err := zw.Create("manifest.json")
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(data)
+	export.ManifestSHA256 = hex.EncodeToString(sum[:])
+
+	// A detached hash lets recipients check the manifest without trusting the archive
+	w, err = zw.Create("manifest.json.sha256")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s  manifest.json\n", export.ManifestSHA256)
+	return err
+}
+
+// copyObjectToZip streams a stored object into the archive, hashing it on the way
+func copyObjectToZip(ctx context.Context, zw *zip.Writer, objectPath, name string) (*ExportManifestFile, error) {
+	obj, err := storage.OpenEmailObject(ctx, objectPath)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+
+	w, err := zw.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(w, h), obj)
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy %s into case package: %v", objectPath, err)
+	}
+
+	return &ExportManifestFile{
+		Path:   name,
+		Size:   size,
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
@@ -1,16 +1,23 @@
 package services
 
 import (
+	"bufio"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"strings"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"emailprojectv2/database"
 	"emailprojectv2/models"
@@ -28,6 +35,13 @@ type ExchangeService struct {
 	Password   string
 	Domain     string
 	httpClient *http.Client
+
+	// ImpersonatedMailbox is the SMTP address of the mailbox a service account
+	// opens through Exchange impersonation; empty to open its own mailbox
+	ImpersonatedMailbox string
+
+	// accountID is the account currently being synced, used for throttle status
+	accountID uuid.UUID
 }
 
 // SOAP XML structures for EWS
@@ -48,6 +62,11 @@ type FindItemBody struct {
 		ItemShape struct {
 			XMLName  xml.Name `xml:"m:ItemShape"`
 			BaseShape string  `xml:"t:BaseShape"`
+			AdditionalProperties struct {
+				FieldURI []struct {
+					FieldURI string `xml:"FieldURI,attr"`
+				} `xml:"t:FieldURI"`
+			} `xml:"t:AdditionalProperties"`
 		} `xml:"m:ItemShape"`
 		Restriction *struct {
 			XMLName xml.Name `xml:"m:Restriction,omitempty"`
@@ -94,6 +113,7 @@ type FindItemResponse struct {
 								} `xml:"ItemId"`
 								Subject    string `xml:"Subject"`
 								DateTimeSent string `xml:"DateTimeSent"`
+								Size       int64  `xml:"Size"`
 								From       struct {
 									Mailbox struct {
 										Name         string `xml:"Name"`
@@ -139,41 +159,71 @@ type GetItemBody struct {
 	} `xml:"m:GetItem"`
 }
 
+// GetItemResponse holds one GetItemResponseMessage per requested ItemId, in request order
 type GetItemResponse struct {
 	XMLName xml.Name `xml:"Envelope"`
 	Body    struct {
 		GetItemResponse struct {
 			ResponseMessages struct {
-				GetItemResponseMessage struct {
-					ResponseClass string `xml:"ResponseClass,attr"`
-					ResponseCode  string `xml:"ResponseCode"`
-					Items         struct {
-						Message []struct {
-							ItemId struct {
-								Id        string `xml:"Id,attr"`
-								ChangeKey string `xml:"ChangeKey,attr"`
-							} `xml:"ItemId"`
-							Subject      string `xml:"Subject"`
-							Body         struct {
-								BodyType string `xml:"BodyType,attr"`
-								Content  string `xml:",chardata"`
-							} `xml:"Body"`
-							DateTimeSent string `xml:"DateTimeSent"`
-							From         struct {
-								Mailbox struct {
-									Name         string `xml:"Name"`
-									EmailAddress string `xml:"EmailAddress"`
-								} `xml:"Mailbox"`
-							} `xml:"From"`
-							HasAttachments string `xml:"HasAttachments"`
-						} `xml:"Message"`
-					} `xml:"Items"`
-				} `xml:"GetItemResponseMessage"`
+				GetItemResponseMessage []GetItemResponseMessage `xml:"GetItemResponseMessage"`
 			} `xml:"ResponseMessages"`
 		} `xml:"GetItemResponse"`
 	} `xml:"Body"`
 }
 
+type GetItemResponseMessage struct {
+	ResponseClass string `xml:"ResponseClass,attr"`
+	ResponseCode  string `xml:"ResponseCode"`
+	MessageText   string `xml:"MessageText"`
+	Items         struct {
+		Message []GetItemMessage `xml:"Message"`
+	} `xml:"Items"`
+}
+
+type GetItemMessage struct {
+	ItemId struct {
+		Id        string `xml:"Id,attr"`
+		ChangeKey string `xml:"ChangeKey,attr"`
+	} `xml:"ItemId"`
+	Subject      string `xml:"Subject"`
+	Body         struct {
+		BodyType string `xml:"BodyType,attr"`
+		Content  string `xml:",chardata"`
+	} `xml:"Body"`
+	DateTimeSent string `xml:"DateTimeSent"`
+	From         struct {
+		Mailbox struct {
+			Name         string `xml:"Name"`
+			EmailAddress string `xml:"EmailAddress"`
+		} `xml:"Mailbox"`
+	} `xml:"From"`
+	ToRecipients   ewsMailboxList `xml:"ToRecipients"`
+	CcRecipients   ewsMailboxList `xml:"CcRecipients"`
+	HasAttachments string `xml:"HasAttachments"`
+	IsRead         string `xml:"IsRead"`
+}
+
+// ewsMailboxList is a recipient list of a GetItem message
+type ewsMailboxList struct {
+	Mailbox []struct {
+		Name         string `xml:"Name"`
+		EmailAddress string `xml:"EmailAddress"`
+	} `xml:"Mailbox"`
+}
+
+// addresses returns the list as "Name <address>" entries
+func (ml ewsMailboxList) addresses() []string {
+	addresses := make([]string, 0, len(ml.Mailbox))
+	for _, mailbox := range ml.Mailbox {
+		if mailbox.Name != "" && mailbox.Name != mailbox.EmailAddress {
+			addresses = append(addresses, fmt.Sprintf("%s <%s>", mailbox.Name, mailbox.EmailAddress))
+		} else {
+			addresses = append(addresses, mailbox.EmailAddress)
+		}
+	}
+	return addresses
+}
+
 func NewExchangeService(serverURL, username, password, domain string) *ExchangeService {
 	// Configure HTTP transport to handle self-signed certificates
 	baseTransport := &http.Transport{
@@ -181,7 +231,7 @@ func NewExchangeService(serverURL, username, password, domain string) *ExchangeS
 			InsecureSkipVerify: true, // Skip certificate verification for self-signed certs
 		},
 		MaxIdleConns:        10,
-		MaxIdleConnsPerHost: 2,
+		MaxIdleConnsPerHost: maxEWSFetchConcurrency,
 		IdleConnTimeout:     30 * time.Second,
 	}
 
@@ -209,6 +259,44 @@ func NewExchangeService(serverURL, username, password, domain string) *ExchangeS
 	}
 }
 
+// exchangeAccountSettings are the Exchange options kept in an account's provider settings
+type exchangeAccountSettings struct {
+	Impersonate string `json:"impersonate"`
+}
+
+// NewExchangeServiceForAccount creates the Exchange service for a stored
+// account, impersonating its mailbox when the account is set up that way
+func NewExchangeServiceForAccount(account *database.EmailAccount) *ExchangeService {
+	es := NewExchangeService(account.ServerURL, account.Username, account.Password, account.Domain)
+	if account.ProviderSettings != "" {
+		var settings exchangeAccountSettings
+		if err := json.Unmarshal([]byte(account.ProviderSettings), &settings); err == nil && settings.Impersonate != "" {
+			es.ImpersonatedMailbox = settings.Impersonate
+			log.Printf("🎭 Impersonating mailbox: %s", settings.Impersonate)
+		}
+	}
+	return es
+}
+
+// withImpersonation adds the ExchangeImpersonation header to a SOAP request
+// when the service opens another user's mailbox
+func (es *ExchangeService) withImpersonation(soapBody string) string {
+	if es.ImpersonatedMailbox == "" {
+		return soapBody
+	}
+	var address strings.Builder
+	xml.EscapeText(&address, []byte(es.ImpersonatedMailbox))
+	header := `<soap:Header><t:RequestServerVersion Version="Exchange2010_SP2"/>` +
+		`<t:ExchangeImpersonation><t:ConnectingSID><t:PrimarySmtpAddress>` + address.String() +
+		`</t:PrimarySmtpAddress></t:ConnectingSID></t:ExchangeImpersonation></soap:Header>`
+	for _, empty := range []string{"<soap:Header></soap:Header>", "<soap:Header/>"} {
+		if strings.Contains(soapBody, empty) {
+			return strings.Replace(soapBody, empty, header, 1)
+		}
+	}
+	return strings.Replace(soapBody, "<soap:Body>", header+"<soap:Body>", 1)
+}
+
 // TestConnection establishes a real connection to the Exchange server
 func (es *ExchangeService) TestConnection() error {
 	if es.ServerURL == "" || es.Username == "" || es.Password == "" {
@@ -240,19 +328,32 @@ func (es *ExchangeService) SyncEmails(accountID uuid.UUID) error {
 // syncWithProgress performs the actual sync with optional progress tracking
 func (es *ExchangeService) syncWithProgress(accountID uuid.UUID, progress *models.SyncProgress) error {
 	log.Printf("📧 Starting Exchange email sync for account: %s", accountID)
+	es.accountID = accountID
+
+	// Syncs are paused while the organization's storage quota is used up
+	if err := CheckSyncQuota(accountID); err != nil {
+		if progress != nil {
+			ProgressManager.SetError(accountID, err)
+		}
+		return err
+	}
 
 	// Update progress: connecting
 	if progress != nil {
 		ProgressManager.UpdateProgress(accountID, "connecting", "Connecting to Exchange server...")
 	}
 
-	ctx := context.Background()
+	ctx, err := archiveContext(accountID)
+	if err != nil {
+		log.Printf("❌ Failed to prepare archive storage: %v", err)
+		return fmt.Errorf("failed to prepare archive storage: %v", err)
+	}
 	synced := 0
 	skipped := 0
 
 	// Get account details for incremental sync
 	var account database.EmailAccount
-	err := database.DB.Where("id = ?", accountID).First(&account).Error
+	err = database.DB.Where("id = ?", accountID).First(&account).Error
 	if err != nil {
 		log.Printf("❌ Failed to get account details: %v", err)
 		return fmt.Errorf("failed to get account details: %v", err)
@@ -321,23 +422,18 @@ func (es *ExchangeService) syncWithProgress(accountID uuid.UUID, progress *model
 		}
 	}
 
-	// Process each message
-	for i, msgItem := range messages {
-		log.Printf("📧 Processing message %d/%d: %s", i+1, len(messages), msgItem.Subject)
-		
-		// Update progress: current email
-		if progress != nil {
-			ProgressManager.UpdateProgress(accountID, "processing", fmt.Sprintf("Processing email %d of %d: %s", i+1, len(messages), msgItem.Subject))
-		}
-
-		// Create unique message ID
+	// Skip messages that are already stored before fetching anything
+	pending := make([]ExchangeMessage, 0, len(messages))
+	for _, msgItem := range messages {
 		messageID := fmt.Sprintf("exchange_%s_%s", accountID.String(), msgItem.ItemId.Id)
 
-		// Check if email already exists in database
 		existingEmail := database.EmailIndex{}
 		err := database.DB.Where("message_id = ? AND account_id = ?", messageID, accountID).First(&existingEmail).Error
 		if err == nil {
-			// Email already exists, skip
+			if existingEmail.DeletedUpstreamAt != nil {
+				// Marked deleted earlier but back in the inbox
+				MarkMovedUpstream(&existingEmail, exchangeInboxFolder, msgItem.ItemId.Id)
+			}
 			skipped++
 			log.Printf("⏭️  Email already exists, skipping: %s", msgItem.Subject)
 			
@@ -347,169 +443,420 @@ func (es *ExchangeService) syncWithProgress(accountID uuid.UUID, progress *model
 			}
 			continue
 		}
+		pending = append(pending, msgItem)
+	}
 
-		// Get full message details
-		messageDetails, err := es.getItem(msgItem.ItemId.Id, msgItem.ItemId.ChangeKey)
-		if err != nil {
-			log.Printf("⚠️  Failed to get message details for %s: %v", msgItem.Subject, err)
-			
-			// Update progress: failed email
-			if progress != nil {
-				ProgressManager.ProcessEmail(accountID, msgItem.Subject, false)
-			}
-			continue
+	// Fetch, parse and upload the remaining messages concurrently
+	synced, err = es.syncItems(ctx, accountID, pending, progress)
+	if err != nil {
+		// The sync keeps its last sync date, the remaining messages are fetched
+		// once there is room
+		log.Printf("⚠️ Exchange sync stopped after %d of %d new emails: %v", synced, len(pending), err)
+		if progress != nil {
+			ProgressManager.SetError(accountID, err)
 		}
+		return err
+	}
 
-		// Parse sender information
-		senderEmail := msgItem.From.Mailbox.EmailAddress
-		senderName := msgItem.From.Mailbox.Name
+	// Detect deletions and read state changes of messages archived earlier
+	if progress != nil {
+		ProgressManager.UpdateProgress(accountID, "processing", "Checking for changes on the server...")
+	}
+	if err := es.syncInboxChanges(accountID); err != nil {
+		log.Printf("⚠️ Failed to sync inbox changes: %v", err)
+	}
 
-		// Parse date
-		emailDate := time.Now()
-		if msgItem.DateTimeSent != "" {
-			if parsedDate, err := time.Parse("2006-01-02T15:04:05Z", msgItem.DateTimeSent); err == nil {
-				emailDate = parsedDate
-			}
+	// A sync cut short by the storage quota keeps its last sync date so the
+	// remaining messages are fetched once there is room
+	if err := CheckSyncQuota(accountID); err != nil {
+		if progress != nil {
+			ProgressManager.SetError(accountID, err)
 		}
+		return err
+	}
 
-		// Get message body from details
-		bodyText := ""
-		bodyHTML := ""
-		if len(messageDetails) > 0 && messageDetails[0].Body.Content != "" {
-			if messageDetails[0].Body.BodyType == "HTML" {
-				bodyHTML = messageDetails[0].Body.Content
-				bodyText = es.htmlToText(bodyHTML)
-			} else {
-				bodyText = messageDetails[0].Body.Content
-				bodyHTML = fmt.Sprintf("<html><body><pre>%s</pre></body></html>", bodyText)
-			}
-		}
+	// Update last sync date after successful completion
+	currentTime := time.Now()
+	err = database.DB.Model(&account).Update("last_sync_date", currentTime).Error
+	if err != nil {
+		log.Printf("⚠️ Failed to update last sync date: %v", err)
+		// Don't fail the entire sync for this
+	} else {
+		log.Printf("✅ Updated last sync date to: %s", currentTime.Format(time.RFC3339))
+	}
 
-		// Process attachments
-		attachments := []types.AttachmentInfo{}
-		if len(messageDetails) > 0 && messageDetails[0].HasAttachments == "true" {
-			// Note: Full attachment processing would require additional EWS calls
-			attachments = append(attachments, types.AttachmentInfo{
-				Name: "attachment.dat",
-				Size: 0,
-				Type: "application/octet-stream",
-			})
+	if isIncrementalSync {
+		log.Printf("🎉 Incremental Exchange sync completed! Synced: %d new emails, Skipped: %d existing, Total processed: %d", 
+			synced, skipped, len(messages))
+	} else {
+		log.Printf("🎉 Full Exchange sync completed! Synced: %d, Skipped: %d, Total processed: %d", 
+			synced, skipped, len(messages))
+	}
+	
+	// Update progress: completed
+	if progress != nil {
+		ProgressManager.CompleteSync(accountID)
+	}
+	
+	return nil
+}
+
+// storeMessage converts a fetched Exchange item to the archive format and saves it to MinIO and the index
+func (es *ExchangeService) storeMessage(ctx context.Context, accountID uuid.UUID, msgItem ExchangeMessage, messageDetails []ExchangeMessageDetail) error {
+	parsed, err := es.parseMessage(accountID, msgItem, messageDetails)
+	if err != nil {
+		return err
+	}
+	return es.uploadMessage(ctx, accountID, parsed)
+}
+
+// exchangeFetched is a message whose details were loaded from the server
+type exchangeFetched struct {
+	item    ExchangeMessage
+	details []ExchangeMessageDetail
+}
+
+// exchangeParsed is a message converted to its stored representation
+type exchangeParsed struct {
+	item       ExchangeMessage
+	isRead     bool
+	recipients *string
+	emailData  types.ExchangeEmailData
+}
+
+// parseMessage converts a fetched Exchange message into the JSON document stored in MinIO
+func (es *ExchangeService) parseMessage(accountID uuid.UUID, msgItem ExchangeMessage, messageDetails []ExchangeMessageDetail) (*exchangeParsed, error) {
+	messageID := fmt.Sprintf("exchange_%s_%s", accountID.String(), msgItem.ItemId.Id)
+
+	// Parse sender information
+	senderEmail := msgItem.From.Mailbox.EmailAddress
+	senderName := msgItem.From.Mailbox.Name
+
+	// Parse date
+	emailDate := time.Now()
+	if msgItem.DateTimeSent != "" {
+		if parsedDate, err := time.Parse("2006-01-02T15:04:05Z", msgItem.DateTimeSent); err == nil {
+			emailDate = parsedDate
 		}
+	}
 
-		// Create comprehensive email data
-		emailData := types.ExchangeEmailData{
-			MessageID:   messageID,
-			Subject:     msgItem.Subject,
-			From:        senderEmail,
-			FromName:    senderName,
-			Date:        emailDate,
-			Body:        bodyText,
-			BodyHTML:    bodyHTML,
-			Folder:      "Inbox",
-			Attachments: attachments,
-			Headers:     make(map[string]string),
+	// Get message body from details
+	bodyText := ""
+	bodyHTML := ""
+	truncated := oversizeAction(msgItem.Size) == OversizeTruncate
+	if len(messageDetails) > 0 && messageDetails[0].Body.Content != "" {
+		content := messageDetails[0].Body.Content
+		if truncated {
+			content = truncateUTF8(content, SyncTuning.MaxMessageBytes)
+		}
+		if messageDetails[0].Body.BodyType == "HTML" {
+			bodyHTML = content
+			bodyText = htmlToText(bodyHTML)
+		} else {
+			bodyText = content
+			bodyHTML = fmt.Sprintf("<html><body><pre>%s</pre></body></html>", bodyText)
 		}
+	}
 
-		// Add headers
-		emailData.Headers["Message-ID"] = messageID
-		emailData.Headers["Subject"] = msgItem.Subject
-		emailData.Headers["From"] = fmt.Sprintf("%s <%s>", senderName, senderEmail)
-		emailData.Headers["Date"] = emailDate.Format(time.RFC1123Z)
-		emailData.Headers["X-EWS-ItemId"] = msgItem.ItemId.Id
-		emailData.Headers["X-EWS-ChangeKey"] = msgItem.ItemId.ChangeKey
+	// Process attachments
+	attachments := []types.AttachmentInfo{}
+	if len(messageDetails) > 0 && messageDetails[0].HasAttachments == "true" {
+		// Note: Full attachment processing would require additional EWS calls
+		attachments = append(attachments, types.AttachmentInfo{
+			Name: "attachment.dat",
+			Size: 0,
+			Type: "application/octet-stream",
+		})
+	}
 
-		// Save full email to MinIO
-		emailJSON, err := json.Marshal(emailData)
-		if err != nil {
-			log.Printf("❌ Failed to marshal email data for %s: %v", msgItem.Subject, err)
-			continue
+	// Create comprehensive email data
+	emailData := types.ExchangeEmailData{
+		MessageID:   messageID,
+		Subject:     msgItem.Subject,
+		From:        senderEmail,
+		FromName:    senderName,
+		Date:        emailDate,
+		Body:        bodyText,
+		BodyHTML:    bodyHTML,
+		Folder:      "Inbox",
+		Attachments: attachments,
+		Headers:     make(map[string]string),
+		Truncated:   truncated,
+	}
+
+	// Add headers
+	emailData.Headers["Message-ID"] = messageID
+	emailData.Headers["Subject"] = msgItem.Subject
+	emailData.Headers["From"] = fmt.Sprintf("%s <%s>", senderName, senderEmail)
+	emailData.Headers["Date"] = emailDate.Format(time.RFC1123Z)
+	emailData.Headers["X-EWS-ItemId"] = msgItem.ItemId.Id
+	emailData.Headers["X-EWS-ChangeKey"] = msgItem.ItemId.ChangeKey
+
+	var recipients *string
+	if len(messageDetails) > 0 {
+		if to := messageDetails[0].ToRecipients; len(to) > 0 {
+			emailData.Headers["To"] = strings.Join(to, ", ")
 		}
+		if cc := messageDetails[0].CcRecipients; len(cc) > 0 {
+			emailData.Headers["Cc"] = strings.Join(cc, ", ")
+		}
+		recipients = normalizeRecipients(append(messageDetails[0].ToRecipients, messageDetails[0].CcRecipients...))
+	}
 
-		minioPath := fmt.Sprintf("emails/%s/%s.json", accountID.String(), messageID)
-		
-		_, err = storage.MinioClient.PutObject(ctx, "email-backups", minioPath, 
-			strings.NewReader(string(emailJSON)), int64(len(emailJSON)), 
-			minio.PutObjectOptions{ContentType: "application/json"})
-		if err != nil {
-			log.Printf("❌ Failed to save email to MinIO: %v", err)
-			continue
+	isRead := len(messageDetails) > 0 && messageDetails[0].IsRead == "true"
+
+	return &exchangeParsed{item: msgItem, isRead: isRead, recipients: recipients, emailData: emailData}, nil
+}
+
+// uploadMessage saves a parsed message to MinIO and indexes it in PostgreSQL
+func (es *ExchangeService) uploadMessage(ctx context.Context, accountID uuid.UUID, parsed *exchangeParsed) error {
+	msgItem := parsed.item
+	emailData := parsed.emailData
+	messageID := emailData.MessageID
+	senderEmail := emailData.From
+	senderName := emailData.FromName
+	emailDate := emailData.Date
+
+	// Save full email to MinIO
+	minioPath := fmt.Sprintf("emails/%s/%s.json", accountID.String(), messageID)
+	
+	stored, err := storage.PutJSONObject(ctx, minioPath, emailData)
+	if err != nil {
+		return stageError(SyncStageStore, fmt.Errorf("failed to save email to MinIO: %v", err))
+	}
+
+	// Calculate email sizes
+	emailSize := stored.Size
+	contentSize := int64(len(msgItem.Subject) + len(emailData.Body))
+	attachmentCount := len(emailData.Attachments)
+	attachmentSize := int64(0)
+	
+	// Calculate attachment size
+	for _, attachment := range emailData.Attachments {
+		attachmentSize += attachment.Size
+	}
+
+	// Save index to PostgreSQL
+	emailIndex := database.EmailIndex{
+		ID:              uuid.New(),
+		AccountID:       accountID,
+		MessageID:       messageID,
+		Subject:         msgItem.Subject,
+		Date:            emailDate,
+		Folder:          "Inbox",
+		MinioPath:       minioPath,
+		SenderEmail:     senderEmail,
+		SenderName:      senderName,
+		Recipients:      parsed.recipients,
+		IsTruncated:     emailData.Truncated,
+		ProviderItemID:  msgItem.ItemId.Id,
+		IsRead:          parsed.isRead,
+		ContentSHA256:   stored.SHA256,
+		LockMode:        stored.LockMode,
+		RetainUntil:     stored.RetainUntil,
+		EmailSize:       emailSize,
+		ContentSize:     contentSize,
+		AttachmentCount: attachmentCount,
+		AttachmentSize:  attachmentSize,
+	}
+
+	if err := database.DB.Create(&emailIndex).Error; err != nil {
+		return stageError(SyncStageIndex, fmt.Errorf("failed to save email index: %v", err))
+	}
+
+	return nil
+}
+
+// syncItems runs the fetch, parse and upload stages for the given messages
+// concurrently and returns the number of messages stored. Every message handed
+// to the stages is reported to the progress manager exactly once, either as
+// stored or failed. When the storage quota runs out the remaining batches are
+// not fetched and the quota error is returned.
+func (es *ExchangeService) syncItems(ctx context.Context, accountID uuid.UUID, items []ExchangeMessage, progress *models.SyncProgress) (int, error) {
+	if len(items) == 0 {
+		return 0, nil
+	}
+
+	fail := func(item ExchangeMessage, err error) {
+		log.Printf("⚠️  Failed to sync %s: %v", item.Subject, err)
+		FailureTracker.RecordFailure(accountID, exchangeFailedItem(accountID, item), err)
+		if progress != nil {
+			ProgressManager.ProcessEmail(accountID, item.Subject, false)
 		}
+	}
 
-		// Calculate email sizes
-		emailSize := int64(len(emailJSON))
-		contentSize := int64(len(msgItem.Subject) + len(emailData.Body))
-		attachmentCount := len(emailData.Attachments)
-		attachmentSize := int64(0)
-		
-		// Calculate attachment size
-		for _, attachment := range emailData.Attachments {
-			attachmentSize += attachment.Size
+	// Apply the oversize policy before anything is downloaded
+	wanted := make([]ExchangeMessage, 0, len(items))
+	for _, item := range items {
+		if oversizeAction(item.Size) == OversizeSkip {
+			fail(item, stageError(SyncStageFetch, &OversizeError{Size: item.Size, Limit: SyncTuning.MaxMessageBytes}))
+			continue
 		}
+		wanted = append(wanted, item)
+	}
 
-		// Save index to PostgreSQL
-		emailIndex := database.EmailIndex{
-			ID:              uuid.New(),
-			AccountID:       accountID,
-			MessageID:       messageID,
-			Subject:         msgItem.Subject,
-			Date:            emailDate,
-			Folder:          "Inbox",
-			MinioPath:       minioPath,
-			SenderEmail:     senderEmail,
-			SenderName:      senderName,
-			EmailSize:       emailSize,
-			ContentSize:     contentSize,
-			AttachmentCount: attachmentCount,
-			AttachmentSize:  attachmentSize,
+	// Stage 1: GetItem in batches, a bounded number of requests in flight
+	batches := make(chan []ExchangeMessage)
+	stopErr := make(chan error, 1)
+	go func() {
+		defer close(batches)
+		defer close(stopErr)
+		for _, batch := range chunkExchangeMessages(wanted, SyncTuning.ExchangeBatchSize) {
+			// Stop handing out batches once the storage quota is used up
+			if err := CheckSyncQuota(accountID); err != nil {
+				stopErr <- err
+				return
+			}
+			batches <- batch
 		}
+	}()
 
-		err = database.DB.Create(&emailIndex).Error
-		if err != nil {
-			log.Printf("❌ Failed to save email index: %v", err)
-			
-			// Update progress: failed email
+	fetched := make(chan exchangeFetched, SyncTuning.ExchangeBatchSize)
+	go func() {
+		defer close(fetched)
+		drainStage(SyncTuning.FetchParallelism, batches, func(batch []ExchangeMessage) {
 			if progress != nil {
-				ProgressManager.ProcessEmail(accountID, msgItem.Subject, false)
+				ProgressManager.UpdateProgress(accountID, "processing", fmt.Sprintf("Fetching %d messages from server...", len(batch)))
 			}
-			continue
+
+			// Results are handed on as they are decoded, so a batch is never held in memory as a whole
+			err := es.streamItems(batch, func(result getItemResult) {
+				if result.err != nil {
+					fail(result.item, stageError(SyncStageFetch, result.err))
+					return
+				}
+				fetched <- exchangeFetched{item: result.item, details: result.details}
+			})
+			if err != nil {
+				for _, item := range batch {
+					fail(item, stageError(SyncStageFetch, err))
+				}
+			}
+		})
+	}()
+
+	// Stage 2: convert to the stored representation
+	parsed := runStage(SyncTuning.Parallelism, fetched, func(f exchangeFetched) (*exchangeParsed, bool) {
+		p, err := es.parseMessage(accountID, f.item, f.details)
+		if err != nil {
+			fail(f.item, err)
+			return nil, false
+		}
+		return p, true
+	})
+
+	// Stage 3: upload to MinIO and index
+	var synced int64
+	drainStage(SyncTuning.Parallelism, parsed, func(p *exchangeParsed) {
+		if err := es.uploadMessage(ctx, accountID, p); err != nil {
+			fail(p.item, err)
+			return
 		}
 
-		synced++
-		log.Printf("✅ Saved Exchange email: %s (from: %s)", msgItem.Subject, senderEmail)
-		
+		FailureTracker.ResolveFailure(accountID, "Inbox", p.item.ItemId.Id)
+		atomic.AddInt64(&synced, 1)
+		log.Printf("✅ Saved Exchange email: %s (from: %s)", p.item.Subject, p.item.From.Mailbox.EmailAddress)
+
 		// Update progress: successful email
 		if progress != nil {
-			ProgressManager.ProcessEmail(accountID, msgItem.Subject, true)
+			ProgressManager.ProcessEmail(accountID, p.item.Subject, true)
 		}
+	})
 
-		// Add small delay to avoid overwhelming the server
-		time.Sleep(100 * time.Millisecond)
+	return int(synced), <-stopErr
+}
+
+// exchangeFailedItem builds the failure key for an Exchange inbox item
+func exchangeFailedItem(accountID uuid.UUID, item ExchangeMessage) FailedItem {
+	return FailedItem{
+		Folder:         "Inbox",
+		ProviderItemID: item.ItemId.Id,
+		ChangeKey:      item.ItemId.ChangeKey,
+		MessageID:      fmt.Sprintf("exchange_%s_%s", accountID.String(), item.ItemId.Id),
+		Subject:        item.Subject,
 	}
+}
 
-	// Update last sync date after successful completion
-	currentTime := time.Now()
-	err = database.DB.Model(&account).Update("last_sync_date", currentTime).Error
+// chunkExchangeMessages splits items into consecutive batches of at most size elements
+func chunkExchangeMessages(items []ExchangeMessage, size int) [][]ExchangeMessage {
+	var batches [][]ExchangeMessage
+	for start := 0; start < len(items); start += size {
+		end := start + size
+		if end > len(items) {
+			end = len(items)
+		}
+		batches = append(batches, items[start:end])
+	}
+	return batches
+}
+
+// RetryFailedItems refetches previously failed items by their EWS ItemId
+func (es *ExchangeService) RetryFailedItems(accountID uuid.UUID, failures []database.SyncFailure) (int, error) {
+	ctx, err := archiveContext(accountID)
 	if err != nil {
-		log.Printf("⚠️ Failed to update last sync date: %v", err)
-		// Don't fail the entire sync for this
-	} else {
-		log.Printf("✅ Updated last sync date to: %s", currentTime.Format(time.RFC3339))
+		return 0, fmt.Errorf("failed to prepare archive storage: %v", err)
 	}
+	recovered := 0
+	es.accountID = accountID
+
+	var items []ExchangeMessage
+	byItemID := make(map[string]database.SyncFailure)
+	for _, failure := range failures {
+		// The item may have been stored by a later full sync in the meantime
+		var existingEmail database.EmailIndex
+		if failure.MessageID != "" && database.DB.Where("message_id = ? AND account_id = ?", failure.MessageID, accountID).First(&existingEmail).Error == nil {
+			FailureTracker.ResolveFailure(accountID, failure.Folder, failure.ProviderItemID)
+			recovered++
+			continue
+		}
 
-	if isIncrementalSync {
-		log.Printf("🎉 Incremental Exchange sync completed! Synced: %d new emails, Skipped: %d existing, Total processed: %d", 
-			synced, skipped, len(messages))
-	} else {
-		log.Printf("🎉 Full Exchange sync completed! Synced: %d, Skipped: %d, Total processed: %d", 
-			synced, skipped, len(messages))
+		item := ExchangeMessage{Subject: failure.Subject}
+		item.ItemId.Id = failure.ProviderItemID
+		item.ItemId.ChangeKey = failure.ChangeKey
+		items = append(items, item)
+		byItemID[failure.ProviderItemID] = failure
 	}
-	
-	// Update progress: completed
-	if progress != nil {
-		ProgressManager.CompleteSync(accountID)
+
+	for _, batch := range chunkExchangeMessages(items, SyncTuning.ExchangeBatchSize) {
+		results, err := es.getItems(batch)
+		if err != nil {
+			log.Printf("⚠️  Retry failed to get %d items: %v", len(batch), err)
+			for _, item := range batch {
+				FailureTracker.RecordFailure(accountID, failedItemFromRecord(byItemID[item.ItemId.Id]), stageError(SyncStageFetch, err))
+			}
+			continue
+		}
+
+		for _, result := range results {
+			failure := byItemID[result.item.ItemId.Id]
+			failedItem := failedItemFromRecord(failure)
+
+			if result.err != nil {
+				log.Printf("⚠️  Retry failed to get item %s: %v", failure.Subject, result.err)
+				FailureTracker.RecordFailure(accountID, failedItem, stageError(SyncStageFetch, result.err))
+				continue
+			}
+
+			detail := result.details[0]
+			msgItem := ExchangeMessage{Subject: detail.Subject, DateTimeSent: detail.DateTimeSent}
+			msgItem.ItemId.Id = failure.ProviderItemID
+			msgItem.ItemId.ChangeKey = detail.ItemId.ChangeKey
+			msgItem.From.Mailbox.Name = detail.From.Mailbox.Name
+			msgItem.From.Mailbox.EmailAddress = detail.From.Mailbox.EmailAddress
+
+			if err := es.storeMessage(ctx, accountID, msgItem, result.details); err != nil {
+				log.Printf("❌ Retry failed to store item %s: %v", failure.Subject, err)
+				FailureTracker.RecordFailure(accountID, failedItem, err)
+				continue
+			}
+
+			FailureTracker.ResolveFailure(accountID, failure.Folder, failure.ProviderItemID)
+			recovered++
+			log.Printf("✅ Recovered Exchange email on retry: %s", detail.Subject)
+		}
 	}
-	
-	return nil
+
+	return recovered, nil
 }
 
 // ExchangeMessage represents an email message from Exchange
@@ -520,6 +867,7 @@ type ExchangeMessage struct {
 	}
 	Subject      string
 	DateTimeSent string
+	Size         int64
 	From         struct {
 		Mailbox struct {
 			Name         string
@@ -540,7 +888,16 @@ type ExchangeMessageDetail struct {
 		Content  string
 	}
 	DateTimeSent   string
+	From           struct {
+		Mailbox struct {
+			Name         string
+			EmailAddress string
+		}
+	}
+	ToRecipients   []string
+	CcRecipients   []string
 	HasAttachments string
+	IsRead         string
 }
 
 // findItems makes a FindItem SOAP request to Exchange with enhanced authentication
@@ -558,6 +915,12 @@ func (es *ExchangeService) findItemsWithFilter(maxItems int, sinceDate *time.Tim
 	}
 	req.Body.FindItem.Traversal = "Shallow"
 	req.Body.FindItem.ItemShape.BaseShape = "IdOnly"
+	// Item size lets the oversize policy act before the body is downloaded
+	req.Body.FindItem.ItemShape.AdditionalProperties.FieldURI = []struct {
+		FieldURI string `xml:"FieldURI,attr"`
+	}{
+		{FieldURI: "item:Size"},
+	}
 	req.Body.FindItem.ParentFolderIds.DistinguishedFolderId.Id = "inbox"
 
 	// Add date restriction for incremental sync if provided
@@ -626,25 +989,17 @@ func (es *ExchangeService) findItemsWithFilter(maxItems int, sinceDate *time.Tim
 		return nil, fmt.Errorf("failed to marshal SOAP request: %v", err)
 	}
 
-	// Use enhanced authentication method
-	soapBody := string(xmlData)
-	resp, err := es.makeAuthenticatedRequest(soapBody, "")
+	// Use throttled, authenticated request
+	statusCode, body, err := es.doThrottledRequest(string(xmlData), "")
 	if err != nil {
-		return nil, fmt.Errorf("authenticated request failed: %v", err)
+		return nil, err
 	}
-	defer resp.Body.Close()
 
-	// Read response
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read response: %v", err)
-	}
-
-	log.Printf("📝 FindItem Response Status: %d", resp.StatusCode)
+	log.Printf("📝 FindItem Response Status: %d", statusCode)
 	
-	if resp.StatusCode != 200 {
-		log.Printf("❌ HTTP error %d: %s", resp.StatusCode, string(body))
-		return nil, fmt.Errorf("HTTP error %d: %s", resp.StatusCode, string(body))
+	if statusCode != 200 {
+		log.Printf("❌ HTTP error %d: %s", statusCode, string(body))
+		return nil, fmt.Errorf("HTTP error %d: %s", statusCode, string(body))
 	}
 	
 	log.Printf("✅ FindItem Request successful, response size: %d bytes", len(body))
@@ -670,6 +1025,7 @@ func (es *ExchangeService) findItemsWithFilter(maxItems int, sinceDate *time.Tim
 			},
 			Subject:      rawMsg.Subject,
 			DateTimeSent: rawMsg.DateTimeSent,
+			Size:         rawMsg.Size,
 			From: struct {
 				Mailbox struct {
 					Name         string
@@ -690,8 +1046,44 @@ func (es *ExchangeService) findItemsWithFilter(maxItems int, sinceDate *time.Tim
 	return messages, nil
 }
 
+// getItemResult is the outcome of a single ItemId within a batched GetItem call
+type getItemResult struct {
+	item    ExchangeMessage
+	details []ExchangeMessageDetail
+	err     error
+}
+
 // getItem makes a GetItem SOAP request to Exchange with enhanced authentication
 func (es *ExchangeService) getItem(itemId, changeKey string) ([]ExchangeMessageDetail, error) {
+	item := ExchangeMessage{}
+	item.ItemId.Id = itemId
+	item.ItemId.ChangeKey = changeKey
+
+	results, err := es.getItems([]ExchangeMessage{item})
+	if err != nil {
+		return nil, err
+	}
+	return results[0].details, results[0].err
+}
+
+// getItems loads many items with a single GetItem request. The results are in
+// the order of items; an item the server could not return carries its own error.
+func (es *ExchangeService) getItems(items []ExchangeMessage) ([]getItemResult, error) {
+	results := make([]getItemResult, 0, len(items))
+	err := es.streamItems(items, func(result getItemResult) {
+		results = append(results, result)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// streamItems loads many items with a single GetItem request and decodes the
+// response incrementally, calling fn once per item in request order as soon as
+// its response message has been read. When an error is returned fn has not
+// been called.
+func (es *ExchangeService) streamItems(items []ExchangeMessage, fn func(getItemResult)) error {
 	// Create SOAP request
 	req := GetItemRequest{
 		Xmlns:  "http://schemas.xmlsoap.org/soap/envelope/",
@@ -702,56 +1094,89 @@ func (es *ExchangeService) getItem(itemId, changeKey string) ([]ExchangeMessageD
 	req.Body.GetItem.ItemShape.IncludeMimeContent = "false"
 	req.Body.GetItem.ItemShape.BodyType = "HTML"
 	
-	// Add item ID
-	req.Body.GetItem.ItemIds.ItemId = []struct {
-		XMLName   xml.Name `xml:"t:ItemId"`
-		Id        string   `xml:"Id,attr"`
-		ChangeKey string   `xml:"ChangeKey,attr"`
-	}{
-		{
-			Id:        itemId,
-			ChangeKey: changeKey,
-		},
+	// Add item IDs
+	for _, item := range items {
+		req.Body.GetItem.ItemIds.ItemId = append(req.Body.GetItem.ItemIds.ItemId, struct {
+			XMLName   xml.Name `xml:"t:ItemId"`
+			Id        string   `xml:"Id,attr"`
+			ChangeKey string   `xml:"ChangeKey,attr"`
+		}{
+			Id:        item.ItemId.Id,
+			ChangeKey: item.ItemId.ChangeKey,
+		})
 	}
 
 	// Marshal to XML
 	xmlData, err := xml.Marshal(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal SOAP request: %v", err)
+		return fmt.Errorf("failed to marshal SOAP request: %v", err)
 	}
 
-	// Use enhanced authentication method
-	soapBody := string(xmlData)
-	resp, err := es.makeAuthenticatedRequest(soapBody, "")
+	// Use throttled, authenticated request
+	resp, err := es.doThrottledRequestStream(string(xmlData), "")
 	if err != nil {
-		return nil, fmt.Errorf("authenticated request failed: %v", err)
+		return err
 	}
 	defer resp.Body.Close()
 
-	// Read response
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read response: %v", err)
+	log.Printf("📝 GetItem Response Status: %d (%d items)", resp.StatusCode, len(items))
+
+	// Decode one GetItemResponseMessage at a time
+	decoder := xml.NewDecoder(resp.Body)
+	next := 0
+	var decodeErr error
+	for next < len(items) {
+		token, err := decoder.Token()
+		if err != nil {
+			if err != io.EOF {
+				decodeErr = fmt.Errorf("failed to parse SOAP response: %v", err)
+			}
+			break
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "GetItemResponseMessage" {
+			continue
+		}
+
+		var responseMessage GetItemResponseMessage
+		if err := decoder.DecodeElement(&responseMessage, &start); err != nil {
+			decodeErr = fmt.Errorf("failed to parse SOAP response: %v", err)
+			break
+		}
+
+		result := getItemResult{item: items[next]}
+		if responseMessage.ResponseClass == "Error" {
+			result.err = fmt.Errorf("%s: %s", responseMessage.ResponseCode, responseMessage.MessageText)
+		} else {
+			result.details = convertGetItemMessages(responseMessage.Items.Message)
+			if len(result.details) == 0 {
+				result.err = fmt.Errorf("item not found on server")
+			}
+		}
+		fn(result)
+		next++
 	}
 
-	log.Printf("📝 GetItem Response Status: %d", resp.StatusCode)
-	
-	if resp.StatusCode != 200 {
-		log.Printf("❌ GetItem HTTP error %d: %s", resp.StatusCode, string(body))
-		return nil, fmt.Errorf("HTTP error %d: %s", resp.StatusCode, string(body))
+	if next == 0 && decodeErr != nil {
+		return decodeErr
 	}
-	
-	log.Printf("✅ GetItem Request successful, response size: %d bytes", len(body))
 
-	// Parse SOAP response
-	var getResp GetItemResponse
-	if err := xml.Unmarshal(body, &getResp); err != nil {
-		return nil, fmt.Errorf("failed to parse SOAP response: %v", err)
+	// Items the response ended before are reported individually
+	for ; next < len(items); next++ {
+		missing := decodeErr
+		if missing == nil {
+			missing = fmt.Errorf("item missing from GetItem response")
+		}
+		fn(getItemResult{item: items[next], err: missing})
 	}
 
-	// Extract and convert messages
-	rawMessages := getResp.Body.GetItemResponse.ResponseMessages.GetItemResponseMessage.Items.Message
-	
+	log.Printf("✅ GetItem Request successful (%d items)", len(items))
+	return nil
+}
+
+// convertGetItemMessages converts raw GetItem messages to message details
+func convertGetItemMessages(rawMessages []GetItemMessage) []ExchangeMessageDetail {
 	messages := make([]ExchangeMessageDetail, len(rawMessages))
 	for i, rawMsg := range rawMessages {
 		messages[i] = ExchangeMessageDetail{
@@ -772,10 +1197,14 @@ func (es *ExchangeService) getItem(itemId, changeKey string) ([]ExchangeMessageD
 			},
 			DateTimeSent:   rawMsg.DateTimeSent,
 			HasAttachments: rawMsg.HasAttachments,
+			IsRead:         rawMsg.IsRead,
 		}
+		messages[i].From.Mailbox.Name = rawMsg.From.Mailbox.Name
+		messages[i].From.Mailbox.EmailAddress = rawMsg.From.Mailbox.EmailAddress
+		messages[i].ToRecipients = rawMsg.ToRecipients.addresses()
+		messages[i].CcRecipients = rawMsg.CcRecipients.addresses()
 	}
-	
-	return messages, nil
+	return messages
 }
 
 // fallbackSyncWithProgress creates test data if direct Exchange access fails with progress tracking
@@ -926,6 +1355,8 @@ func (es *ExchangeService) fallbackSyncImpl(accountID uuid.UUID, progress *model
 			MinioPath:       minioPath,
 			SenderEmail:     testEmail.from,
 			SenderName:      testEmail.fromName,
+			Recipients:      normalizeRecipients([]string{es.Username}),
+			ContentSHA256:   fmt.Sprintf("%x", sha256.Sum256(emailJSON)),
 			EmailSize:       emailSize,
 			ContentSize:     contentSize,
 			AttachmentCount: attachmentCount,
@@ -976,7 +1407,7 @@ func (es *ExchangeService) fallbackSyncImpl(accountID uuid.UUID, progress *model
 }
 
 // htmlToText converts HTML content to plain text (basic implementation)
-func (es *ExchangeService) htmlToText(html string) string {
+func htmlToText(html string) string {
 	// This is a very basic HTML to text conversion
 	// In production, you might want to use a proper HTML parser like bluemonday
 	text := html
@@ -1035,9 +1466,130 @@ func (es *ExchangeService) tryDifferentUserFormats() []string {
 	return formats
 }
 
+// throttleKeys returns the server and tenant the request budgets are tracked for
+func (es *ExchangeService) throttleKeys() (string, string) {
+	server := es.ServerURL
+	if parsed, err := url.Parse(es.ServerURL); err == nil && parsed.Host != "" {
+		server = parsed.Host
+	}
+
+	tenant := mailboxDomain(es.Username)
+	if tenant == "" {
+		tenant = strings.ToLower(es.Domain)
+	}
+	return server, tenant
+}
+
+// doThrottledRequest sends a SOAP request within the provider budgets and
+// returns the complete response body
+func (es *ExchangeService) doThrottledRequest(soapBody string, soapAction string) (int, []byte, error) {
+	resp, err := es.doThrottledRequestStream(soapBody, soapAction)
+	if err != nil {
+		var httpErr *ewsHTTPError
+		if errors.As(err, &httpErr) {
+			return httpErr.StatusCode, httpErr.Body, nil
+		}
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to read response: %v", err)
+	}
+	return resp.StatusCode, body, nil
+}
+
+// ewsHTTPError is a non-200 EWS response that was not a throttling response
+type ewsHTTPError struct {
+	StatusCode int
+	Body       []byte
+}
+
+func (e *ewsHTTPError) Error() string {
+	return fmt.Sprintf("HTTP error %d: %s", e.StatusCode, string(e.Body))
+}
+
+// ewsBusyPeekSize is how much of a 200 response is checked for ErrorServerBusy
+const ewsBusyPeekSize = 8 * 1024
+
+// doThrottledRequestStream sends a SOAP request within the provider budgets and
+// retries ErrorServerBusy responses after the BackOffMilliseconds the server
+// asked for. A 200 response is returned unread so large bodies can be decoded
+// as they arrive; the caller must close it.
+func (es *ExchangeService) doThrottledRequestStream(soapBody string, soapAction string) (*http.Response, error) {
+	server, tenant := es.throttleKeys()
+	ctx := context.Background()
+
+	for attempt := 1; ; attempt++ {
+		if err := Throttle.Wait(ctx, es.accountID, server, tenant); err != nil {
+			return nil, err
+		}
+
+		resp, err := es.makeAuthenticatedRequest(soapBody, soapAction)
+		if err != nil {
+			return nil, fmt.Errorf("authenticated request failed: %v", err)
+		}
+
+		var body []byte
+		if resp.StatusCode == http.StatusOK {
+			// A busy server can also answer 200 with ErrorServerBusy in the
+			// ResponseMessage, which comes first in the body
+			peeked := bufio.NewReaderSize(resp.Body, ewsBusyPeekSize)
+			body, _ = peeked.Peek(ewsBusyPeekSize)
+			if _, throttled := ParseEWSThrottle(resp.StatusCode, body); !throttled {
+				resp.Body = struct {
+					io.Reader
+					io.Closer
+				}{peeked, resp.Body}
+				return resp, nil
+			}
+			body = append([]byte(nil), body...)
+			resp.Body.Close()
+		} else {
+			// Error responses are small, read them to look for throttling hints
+			body, err = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				return nil, fmt.Errorf("failed to read response: %v", err)
+			}
+		}
+
+		throttleErr, throttled := ParseEWSThrottle(resp.StatusCode, body)
+		if !throttled {
+			return nil, &ewsHTTPError{StatusCode: resp.StatusCode, Body: body}
+		}
+		if hint := ParseRetryAfter(resp.Header.Get("Retry-After")); throttleErr.RetryAfter == 0 && hint > 0 {
+			throttleErr.RetryAfter = hint
+		}
+
+		if attempt >= Throttle.MaxRetries() {
+			log.Printf("❌ Exchange server still busy after %d attempts", attempt)
+			return nil, throttleErr
+		}
+
+		delay := Throttle.BackoffDelay(attempt, throttleErr.RetryAfter)
+		log.Printf("🚦 Exchange server busy (attempt %d/%d), backing off %s", attempt, Throttle.MaxRetries(), delay)
+		Throttle.Backoff(server, tenant, delay)
+	}
+}
+
+// truncateUTF8 cuts s to at most n bytes without splitting a UTF-8 sequence
+func truncateUTF8(s string, n int64) string {
+	if int64(len(s)) <= n {
+		return s
+	}
+	cut := int(n)
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut]
+}
+
 // makeAuthenticatedRequest creates and executes an authenticated SOAP request
 func (es *ExchangeService) makeAuthenticatedRequest(soapBody string, soapAction string) (*http.Response, error) {
 	userFormats := es.tryDifferentUserFormats()
+	soapBody = es.withImpersonation(soapBody)
 	
 	for i, username := range userFormats {
 		log.Printf("🔑 Attempt %d/%d - Trying username format: %s", i+1, len(userFormats), username)
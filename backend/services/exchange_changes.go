@@ -0,0 +1,199 @@
+package services
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+
+	"github.com/google/uuid"
+)
+
+// exchangeInboxFolder is the folder name Exchange messages are indexed under
+const exchangeInboxFolder = "Inbox"
+
+// syncFolderItemsPageSize is the largest page SyncFolderItems allows
+const syncFolderItemsPageSize = 512
+
+type SyncFolderItemsRequest struct {
+	XMLName xml.Name `xml:"soap:Envelope"`
+	Xmlns   string   `xml:"xmlns:soap,attr"`
+	XmlnsT  string   `xml:"xmlns:t,attr"`
+	XmlnsM  string   `xml:"xmlns:m,attr"`
+	Header  struct{} `xml:"soap:Header"`
+	Body    SyncFolderItemsBody
+}
+
+type SyncFolderItemsBody struct {
+	XMLName         xml.Name `xml:"soap:Body"`
+	SyncFolderItems struct {
+		ItemShape struct {
+			BaseShape            string `xml:"t:BaseShape"`
+			AdditionalProperties struct {
+				FieldURI []struct {
+					FieldURI string `xml:"FieldURI,attr"`
+				} `xml:"t:FieldURI"`
+			} `xml:"t:AdditionalProperties"`
+		} `xml:"m:ItemShape"`
+		SyncFolderId struct {
+			DistinguishedFolderId struct {
+				Id string `xml:"Id,attr"`
+			} `xml:"t:DistinguishedFolderId"`
+		} `xml:"m:SyncFolderId"`
+		SyncState          string `xml:"m:SyncState,omitempty"`
+		MaxChangesReturned int    `xml:"m:MaxChangesReturned"`
+	} `xml:"m:SyncFolderItems"`
+}
+
+type SyncFolderItemsResponse struct {
+	XMLName xml.Name `xml:"Envelope"`
+	Body    struct {
+		SyncFolderItemsResponse struct {
+			ResponseMessages struct {
+				SyncFolderItemsResponseMessage SyncFolderItemsResponseMessage `xml:"SyncFolderItemsResponseMessage"`
+			} `xml:"ResponseMessages"`
+		} `xml:"SyncFolderItemsResponse"`
+	} `xml:"Body"`
+}
+
+type SyncFolderItemsResponseMessage struct {
+	ResponseClass           string                 `xml:"ResponseClass,attr"`
+	ResponseCode            string                 `xml:"ResponseCode"`
+	MessageText             string                 `xml:"MessageText"`
+	SyncState               string                 `xml:"SyncState"`
+	IncludesLastItemInRange bool                   `xml:"IncludesLastItemInRange"`
+	Changes                 SyncFolderItemsChanges `xml:"Changes"`
+}
+
+// SyncFolderItemsChanges lists the changes of one page. Creates are not
+// decoded, new messages are picked up by the regular FindItem sync.
+type SyncFolderItemsChanges struct {
+	Update []struct {
+		Message struct {
+			ItemId struct {
+				Id string `xml:"Id,attr"`
+			} `xml:"ItemId"`
+			IsRead string `xml:"IsRead"`
+		} `xml:"Message"`
+	} `xml:"Update"`
+	Delete []struct {
+		ItemId struct {
+			Id string `xml:"Id,attr"`
+		} `xml:"ItemId"`
+	} `xml:"Delete"`
+	ReadFlagChange []struct {
+		ItemId struct {
+			Id string `xml:"Id,attr"`
+		} `xml:"ItemId"`
+		IsRead string `xml:"IsRead"`
+	} `xml:"ReadFlagChange"`
+}
+
+// syncInboxChanges pulls the inbox changes since the stored SyncFolderItems
+// state and applies them to the archive. The first call only establishes the
+// baseline. EWS reports a message moved out of the inbox as a Delete, so
+// such messages are marked deleted upstream.
+func (es *ExchangeService) syncInboxChanges(accountID uuid.UUID) error {
+	state, err := loadFolderSyncState(accountID, exchangeInboxFolder)
+	if err != nil {
+		return err
+	}
+	baseline := state.SyncState == ""
+	if baseline {
+		log.Printf("🆕 Establishing inbox change tracking baseline")
+	}
+
+	for {
+		msg, err := es.syncFolderItems(state.SyncState)
+		if err != nil {
+			return err
+		}
+
+		if msg.ResponseClass != "Success" {
+			if msg.ResponseCode == "ErrorInvalidSyncStateData" {
+				// Start over with a new baseline on the next sync
+				state.SyncState = ""
+				saveFolderSyncState(state)
+			}
+			return fmt.Errorf("SyncFolderItems failed: %s %s", msg.ResponseCode, msg.MessageText)
+		}
+
+		if !baseline {
+			applyInboxChanges(accountID, msg.Changes)
+		}
+
+		// Checkpoint after every page so a failure does not replay applied changes
+		state.SyncState = msg.SyncState
+		saveFolderSyncState(state)
+
+		if msg.IncludesLastItemInRange {
+			return nil
+		}
+	}
+}
+
+// syncFolderItems requests one page of inbox changes after the given state
+func (es *ExchangeService) syncFolderItems(syncState string) (*SyncFolderItemsResponseMessage, error) {
+	req := SyncFolderItemsRequest{
+		Xmlns:  "http://schemas.xmlsoap.org/soap/envelope/",
+		XmlnsT: "http://schemas.microsoft.com/exchange/services/2006/types",
+		XmlnsM: "http://schemas.microsoft.com/exchange/services/2006/messages",
+	}
+	req.Body.SyncFolderItems.ItemShape.BaseShape = "IdOnly"
+	req.Body.SyncFolderItems.ItemShape.AdditionalProperties.FieldURI = []struct {
+		FieldURI string `xml:"FieldURI,attr"`
+	}{
+		{FieldURI: "message:IsRead"},
+	}
+	req.Body.SyncFolderItems.SyncFolderId.DistinguishedFolderId.Id = "inbox"
+	req.Body.SyncFolderItems.SyncState = syncState
+	req.Body.SyncFolderItems.MaxChangesReturned = syncFolderItemsPageSize
+
+	xmlData, err := xml.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal SOAP request: %v", err)
+	}
+
+	statusCode, body, err := es.doThrottledRequest(string(xmlData), "")
+	if err != nil {
+		return nil, err
+	}
+	if statusCode != 200 {
+		return nil, fmt.Errorf("HTTP error %d: %s", statusCode, string(body))
+	}
+
+	var syncResp SyncFolderItemsResponse
+	if err := xml.Unmarshal(body, &syncResp); err != nil {
+		return nil, fmt.Errorf("failed to parse SOAP response: %v", err)
+	}
+	return &syncResp.Body.SyncFolderItemsResponse.ResponseMessages.SyncFolderItemsResponseMessage, nil
+}
+
+// applyInboxChanges records read state changes and deletions of archived messages
+func applyInboxChanges(accountID uuid.UUID, changes SyncFolderItemsChanges) {
+	applyRead := func(itemID, isRead string) {
+		if isRead == "" {
+			return
+		}
+		email, err := findEmailByProviderItem(accountID, itemID)
+		if err != nil {
+			// Not archived yet
+			return
+		}
+		ApplyFlagChanges(email, isRead == "true", email.IsFlagged)
+	}
+
+	for _, update := range changes.Update {
+		applyRead(update.Message.ItemId.Id, update.Message.IsRead)
+	}
+	for _, change := range changes.ReadFlagChange {
+		applyRead(change.ItemId.Id, change.IsRead)
+	}
+
+	for _, deletion := range changes.Delete {
+		email, err := findEmailByProviderItem(accountID, deletion.ItemId.Id)
+		if err != nil {
+			continue
+		}
+		MarkDeletedUpstream(email, "removed from Inbox (deleted or moved to another folder)")
+	}
+}
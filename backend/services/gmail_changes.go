@@ -0,0 +1,280 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+
+	"emailprojectv2/database"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/google/uuid"
+)
+
+// gmailSyncFolders are the folders archived for Gmail accounts
+var gmailSyncFolders = []string{"INBOX", "[Gmail]/Sent Mail", "[Gmail]/Drafts"}
+
+// reconcileFolder compares the archived messages of the selected folder with
+// the server and records flag changes, moves and deletions. The IMAP client
+// has no QRESYNC support, so vanished messages are found by diffing the
+// folder's full UID list against the index.
+func (gs *GmailServiceV1) reconcileFolder(ctx context.Context, c *client.Client, accountID uuid.UUID, folder string, mbox *imap.MailboxStatus) error {
+	state, err := loadFolderSyncState(accountID, folder)
+	if err != nil {
+		return err
+	}
+
+	if state.UIDValidity != mbox.UidValidity {
+		// Stored UIDs are meaningless after a UIDVALIDITY change (or were never
+		// recorded), so bind the archived messages again by Message-ID
+		log.Printf("🔄 Binding archived messages of %s to UIDVALIDITY %d", folder, mbox.UidValidity)
+		if err := gs.rebindFolder(ctx, c, accountID, folder, mbox); err != nil {
+			return err
+		}
+		state.UIDValidity = mbox.UidValidity
+		saveFolderSyncState(state)
+		return nil
+	}
+
+	var archived []database.EmailIndex
+	err = database.DB.Where("account_id = ? AND folder = ? AND provider_item_id <> '' AND deleted_upstream_at IS NULL", accountID, folder).
+		Find(&archived).Error
+	if err != nil {
+		return fmt.Errorf("failed to load archived messages: %v", err)
+	}
+
+	serverFlags, err := gs.fetchFolderFlags(ctx, c, accountID, mbox)
+	if err != nil {
+		return err
+	}
+
+	var vanished []*database.EmailIndex
+	for i := range archived {
+		email := &archived[i]
+		uid, err := strconv.ParseUint(email.ProviderItemID, 10, 32)
+		if err != nil {
+			continue
+		}
+
+		flags, ok := serverFlags[uint32(uid)]
+		if !ok {
+			vanished = append(vanished, email)
+			continue
+		}
+		ApplyFlagChanges(email, hasIMAPFlag(flags, imap.SeenFlag), hasIMAPFlag(flags, imap.FlaggedFlag))
+	}
+
+	if len(vanished) > 0 {
+		log.Printf("🔍 %d archived messages vanished from %s", len(vanished), folder)
+		if err := gs.locateVanished(ctx, c, accountID, folder, vanished); err != nil {
+			return err
+		}
+	}
+
+	saveFolderSyncState(state)
+	return nil
+}
+
+// fetchFolderFlags returns the flags of every message in the selected folder by UID
+func (gs *GmailServiceV1) fetchFolderFlags(ctx context.Context, c *client.Client, accountID uuid.UUID, mbox *imap.MailboxStatus) (map[uint32][]string, error) {
+	flags := make(map[uint32][]string, mbox.Messages)
+	if mbox.Messages == 0 {
+		return flags, nil
+	}
+
+	server, tenant := gs.throttleKeys()
+	if err := Throttle.Wait(ctx, accountID, server, tenant); err != nil {
+		return nil, err
+	}
+
+	seqset := new(imap.SeqSet)
+	seqset.AddRange(1, 0) // 1:*
+
+	messages := make(chan *imap.Message, 100)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seqset, []imap.FetchItem{imap.FetchUid, imap.FetchFlags}, messages)
+	}()
+
+	for msg := range messages {
+		flags[msg.Uid] = msg.Flags
+	}
+	if err := <-done; err != nil {
+		return nil, fmt.Errorf("failed to fetch flags of %s: %v", mbox.Name, err)
+	}
+	return flags, nil
+}
+
+// rebindFolder matches the archived messages of the selected folder to their
+// current UIDs by Message-ID. Messages no longer in the folder are located
+// like any other vanished message.
+func (gs *GmailServiceV1) rebindFolder(ctx context.Context, c *client.Client, accountID uuid.UUID, folder string, mbox *imap.MailboxStatus) error {
+	uidsByMessageID := make(map[string]uint32)
+
+	if mbox.Messages > 0 {
+		server, tenant := gs.throttleKeys()
+		if err := Throttle.Wait(ctx, accountID, server, tenant); err != nil {
+			return err
+		}
+
+		seqset := new(imap.SeqSet)
+		seqset.AddRange(1, 0) // 1:*
+
+		messages := make(chan *imap.Message, 100)
+		done := make(chan error, 1)
+		go func() {
+			done <- c.UidFetch(seqset, []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope}, messages)
+		}()
+
+		for msg := range messages {
+			if msg.Envelope != nil && msg.Envelope.MessageId != "" {
+				uidsByMessageID[msg.Envelope.MessageId] = msg.Uid
+			}
+		}
+		if err := <-done; err != nil {
+			return fmt.Errorf("failed to fetch envelopes of %s: %v", folder, err)
+		}
+	}
+
+	var archived []database.EmailIndex
+	err := database.DB.Where("account_id = ? AND folder = ? AND deleted_upstream_at IS NULL", accountID, folder).
+		Find(&archived).Error
+	if err != nil {
+		return fmt.Errorf("failed to load archived messages: %v", err)
+	}
+
+	var vanished []*database.EmailIndex
+	for i := range archived {
+		email := &archived[i]
+		uid, ok := uidsByMessageID[email.MessageID]
+		if !ok {
+			vanished = append(vanished, email)
+			continue
+		}
+
+		providerItemID := strconv.FormatUint(uint64(uid), 10)
+		if email.ProviderItemID != providerItemID {
+			if err := database.DB.Model(email).Update("provider_item_id", providerItemID).Error; err != nil {
+				log.Printf("⚠️ Failed to bind email %s to UID %s: %v", email.ID, providerItemID, err)
+			}
+		}
+	}
+
+	if len(vanished) > 0 {
+		log.Printf("🔍 %d archived messages are no longer in %s", len(vanished), folder)
+		return gs.locateVanished(ctx, c, accountID, folder, vanished)
+	}
+	return nil
+}
+
+// locateVanished searches for messages that left a folder. Gmail keeps
+// archived messages in All Mail and deleted ones in Trash for 30 days, so a
+// message found in another synced folder or in All Mail was moved, one found
+// in Trash was deleted, and one found nowhere was deleted permanently.
+// This changes the selected folder.
+func (gs *GmailServiceV1) locateVanished(ctx context.Context, c *client.Client, accountID uuid.UUID, folder string, vanished []*database.EmailIndex) error {
+	candidates, allMail, trash, err := gs.locateCandidates(c, folder)
+	if err != nil {
+		return err
+	}
+
+	remaining := make(map[string]*database.EmailIndex, len(vanished))
+	for _, email := range vanished {
+		if email.MessageID == "" {
+			MarkDeletedUpstream(email, fmt.Sprintf("no longer in %s", folder))
+			continue
+		}
+		remaining[email.MessageID] = email
+	}
+
+	server, tenant := gs.throttleKeys()
+	for _, candidate := range candidates {
+		if len(remaining) == 0 {
+			break
+		}
+
+		if err := Throttle.Wait(ctx, accountID, server, tenant); err != nil {
+			return err
+		}
+		if _, err := c.Select(candidate, true); err != nil {
+			return fmt.Errorf("failed to select folder %s: %v", candidate, err)
+		}
+
+		for messageID, email := range remaining {
+			if err := Throttle.Wait(ctx, accountID, server, tenant); err != nil {
+				return err
+			}
+
+			criteria := imap.NewSearchCriteria()
+			criteria.Header.Add("Message-Id", messageID)
+			uids, err := c.UidSearch(criteria)
+			if err != nil {
+				return fmt.Errorf("failed to search folder %s: %v", candidate, err)
+			}
+			if len(uids) == 0 {
+				continue
+			}
+			delete(remaining, messageID)
+
+			MarkMovedUpstream(email, candidate, strconv.FormatUint(uint64(uids[0]), 10))
+			if candidate == trash {
+				MarkDeletedUpstream(email, "moved to Trash")
+			}
+		}
+	}
+
+	if len(remaining) > 0 && allMail == "" {
+		// Without All Mail an archived message cannot be told apart from a deleted one
+		log.Printf("⚠️ All Mail folder not found, %d vanished messages left unresolved", len(remaining))
+		return nil
+	}
+	for _, email := range remaining {
+		MarkDeletedUpstream(email, fmt.Sprintf("no longer on the server (last seen in %s)", folder))
+	}
+	return nil
+}
+
+// locateCandidates lists the folders a vanished message may have moved to, in
+// search order: the other synced folders, All Mail and Trash, and returns the
+// names of the latter two. All Mail and Trash are found by their special-use attributes since their names are
+// localized.
+func (gs *GmailServiceV1) locateCandidates(c *client.Client, folder string) ([]string, string, string, error) {
+	mailboxes := make(chan *imap.MailboxInfo, 50)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.List("", "*", mailboxes)
+	}()
+
+	existing := make(map[string]bool)
+	var allMail, trash string
+	for mailbox := range mailboxes {
+		existing[mailbox.Name] = true
+		for _, attr := range mailbox.Attributes {
+			switch attr {
+			case imap.AllAttr:
+				allMail = mailbox.Name
+			case imap.TrashAttr:
+				trash = mailbox.Name
+			}
+		}
+	}
+	if err := <-done; err != nil {
+		return nil, "", "", fmt.Errorf("failed to list folders: %v", err)
+	}
+
+	var candidates []string
+	for _, f := range gmailSyncFolders {
+		if f != folder && existing[f] {
+			candidates = append(candidates, f)
+		}
+	}
+	if allMail != "" {
+		candidates = append(candidates, allMail)
+	}
+	if trash != "" {
+		candidates = append(candidates, trash)
+	}
+	return candidates, allMail, trash, nil
+}
@@ -2,11 +2,12 @@ package services
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"emailprojectv2/database"
@@ -15,9 +16,7 @@ import (
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
-	"github.com/emersion/go-message/mail"
 	"github.com/google/uuid"
-	"github.com/minio/minio-go/v7"
 )
 
 type EmailData struct {
@@ -25,11 +24,16 @@ type EmailData struct {
 	Subject     string                 `json:"subject"`
 	From        []map[string]string    `json:"from"`
 	To          []map[string]string    `json:"to"`
+	Cc          []map[string]string    `json:"cc,omitempty"`
 	Date        time.Time              `json:"date"`
 	Body        string                 `json:"body"`
 	Attachments []AttachmentData       `json:"attachments"`
 	Headers     map[string][]string    `json:"headers"`
 	Folder      string                 `json:"folder"`
+	RawPath     string                 `json:"raw_path,omitempty"`
+	RawSize     int64                  `json:"raw_size,omitempty"`
+	RawSHA256   string                 `json:"raw_sha256,omitempty"`
+	Truncated   bool                   `json:"truncated,omitempty"`
 }
 
 type AttachmentData struct {
@@ -44,6 +48,9 @@ type GmailServiceV1 struct {
 	Port     string
 	Username string
 	Password string
+
+	noticeMu sync.Mutex
+	notice   string // Last untagged BYE or NO of the current connection
 }
 
 func NewGmailServiceV1(host, port, username, password string) *GmailServiceV1 {
@@ -73,6 +80,12 @@ func (gs *GmailServiceV1) connect() (*client.Client, error) {
 		return nil, err
 	}
 
+	// Keep the server's BYE and NO notices to tell throttling from lost connections
+	gs.setNotice("")
+	updates := make(chan client.Update, 32)
+	c.Updates = updates
+	go gs.watchNotices(c, updates)
+
 	// Login
 	if err := c.Login(gs.Username, gs.Password); err != nil {
 		c.Logout()
@@ -82,6 +95,42 @@ func (gs *GmailServiceV1) connect() (*client.Client, error) {
 	return c, nil
 }
 
+// watchNotices drains a connection's unilateral updates until it logs out,
+// recording the status responses the server sends on its own
+func (gs *GmailServiceV1) watchNotices(c *client.Client, updates <-chan client.Update) {
+	for {
+		select {
+		case update := <-updates:
+			status, ok := update.(*client.StatusUpdate)
+			if !ok || (status.Status.Type != imap.StatusRespBye && status.Status.Type != imap.StatusRespNo) {
+				continue
+			}
+			notice := fmt.Sprintf("%s [%s] %s", status.Status.Type, status.Status.Code, status.Status.Info)
+			gs.setNotice(notice)
+			if IsIMAPThrottleNotice(notice) {
+				log.Printf("🚦 Gmail IMAP notice: %s", notice)
+			}
+		case <-c.LoggedOut():
+			return
+		}
+	}
+}
+
+func (gs *GmailServiceV1) setNotice(notice string) {
+	gs.noticeMu.Lock()
+	gs.notice = notice
+	gs.noticeMu.Unlock()
+}
+
+// isThrottleError reports whether an error of the current connection is the
+// server enforcing its limits
+func (gs *GmailServiceV1) isThrottleError(err error) bool {
+	gs.noticeMu.Lock()
+	notice := gs.notice
+	gs.noticeMu.Unlock()
+	return IsIMAPThrottleError(err, notice)
+}
+
 // SyncEmailsWithProgress syncs emails with progress tracking
 func (gs *GmailServiceV1) SyncEmailsWithProgress(accountID uuid.UUID) error {
 	// Start progress tracking
@@ -97,6 +146,14 @@ func (gs *GmailServiceV1) SyncEmails(accountID uuid.UUID) error {
 
 // syncEmailsImpl performs the actual sync with optional progress tracking
 func (gs *GmailServiceV1) syncEmailsImpl(accountID uuid.UUID, progress *models.SyncProgress) error {
+	// Syncs are paused while the organization's storage quota is used up
+	if err := CheckSyncQuota(accountID); err != nil {
+		if progress != nil {
+			ProgressManager.SetError(accountID, err)
+		}
+		return err
+	}
+
 	// Update progress: connecting
 	if progress != nil {
 		ProgressManager.UpdateProgress(accountID, "connecting", "Connecting to Gmail IMAP server...")
@@ -109,7 +166,8 @@ func (gs *GmailServiceV1) syncEmailsImpl(accountID uuid.UUID, progress *models.S
 		}
 		return fmt.Errorf("failed to connect: %v", err)
 	}
-	defer c.Logout()
+	// c may be replaced by a reconnect after the server drops the connection
+	defer func() { c.Logout() }()
 
 	// Get account details for incremental sync
 	var account database.EmailAccount
@@ -137,7 +195,7 @@ func (gs *GmailServiceV1) syncEmailsImpl(accountID uuid.UUID, progress *models.S
 		ProgressManager.UpdateProgress(accountID, "authenticating", "Authenticated with Gmail IMAP server")
 	}
 
-	folders := []string{"INBOX", "[Gmail]/Sent Mail", "[Gmail]/Drafts"}
+	folders := gmailSyncFolders
 	totalEmailsCount := 0
 	
 	// First pass: count total emails across folders
@@ -169,6 +227,33 @@ func (gs *GmailServiceV1) syncEmailsImpl(accountID uuid.UUID, progress *models.S
 		}
 		
 		err := gs.syncFolderWithProgressAndFilter(c, accountID, folder, progress, sinceDate, isIncrementalSync)
+		for attempt := 1; err != nil && gs.isThrottleError(err) && attempt < Throttle.MaxRetries(); attempt++ {
+			// Gmail drops the connection when bandwidth limits are hit; back off and reconnect
+			delay := Throttle.BackoffDelay(attempt, 0)
+			log.Printf("🚦 Gmail dropped the connection while syncing %s (attempt %d), backing off %s: %v", folder, attempt, delay, err)
+			server, tenant := gs.throttleKeys()
+			Throttle.Backoff(server, tenant, delay)
+			if waitErr := Throttle.Wait(context.Background(), accountID, server, tenant); waitErr != nil {
+				break
+			}
+
+			c.Logout()
+			c, err = gs.connect()
+			if err != nil {
+				if progress != nil {
+					ProgressManager.SetError(accountID, err)
+				}
+				return fmt.Errorf("failed to reconnect: %v", err)
+			}
+			err = gs.syncFolderWithProgressAndFilter(c, accountID, folder, progress, sinceDate, isIncrementalSync)
+		}
+		if IsQuotaError(err) {
+			// Stop before the last sync date moves so the rest is fetched once there is room
+			if progress != nil {
+				ProgressManager.SetError(accountID, err)
+			}
+			return err
+		}
 		if err != nil {
 			log.Printf("⚠️ Error syncing folder %s: %v", folder, err)
 			continue
@@ -216,30 +301,52 @@ func (gs *GmailServiceV1) syncFolder(c *client.Client, accountID uuid.UUID, fold
 
 // syncFolderImpl performs the actual folder sync with optional progress tracking and date filtering
 func (gs *GmailServiceV1) syncFolderImpl(c *client.Client, accountID uuid.UUID, folder string, progress *models.SyncProgress, sinceDate *time.Time, isIncremental bool) error {
+	ctx, err := archiveContext(accountID)
+	if err != nil {
+		return fmt.Errorf("failed to prepare archive storage: %v", err)
+	}
+	server, tenant := gs.throttleKeys()
+
 	// Select folder
+	if err := Throttle.Wait(ctx, accountID, server, tenant); err != nil {
+		return err
+	}
 	mbox, err := c.Select(folder, false)
 	if err != nil {
 		return fmt.Errorf("failed to select folder %s: %v", folder, err)
 	}
 
+	if err := gs.syncNewMessages(ctx, c, accountID, folder, mbox, progress, sinceDate, isIncremental); err != nil {
+		return err
+	}
+
+	// Detect deletions, moves and flag changes of messages archived earlier
+	if err := gs.reconcileFolder(ctx, c, accountID, folder, mbox); err != nil {
+		log.Printf("⚠️ Failed to reconcile folder %s: %v", folder, err)
+	}
+
+	return nil
+}
+
+// syncNewMessages searches the selected folder for messages to archive and ingests them
+func (gs *GmailServiceV1) syncNewMessages(ctx context.Context, c *client.Client, accountID uuid.UUID, folder string, mbox *imap.MailboxStatus, progress *models.SyncProgress, sinceDate *time.Time, isIncremental bool) error {
+	var err error
 	if mbox.Messages == 0 {
 		log.Printf("📭 No messages found in folder %s", folder)
 		return nil
 	}
 
-	// Create sequence set based on sync type
-	seqset := new(imap.SeqSet)
-	var searchCriteria *imap.SearchCriteria
+	// Resolve the messages to sync to UIDs so they can be fetched in chunks
+	var uids []uint32
+	criteria := imap.NewSearchCriteria()
 
 	if isIncremental && sinceDate != nil {
 		// Incremental sync: search for messages since last sync date
 		log.Printf("🔄 Performing incremental sync for folder %s since %s", folder, sinceDate.Format("2006-01-02"))
-		searchCriteria = &imap.SearchCriteria{
-			Since: *sinceDate,
-		}
+		criteria.Since = *sinceDate
 		
 		// Search for messages matching criteria
-		uids, err := c.Search(searchCriteria)
+		uids, err = c.UidSearch(criteria)
 		if err != nil {
 			log.Printf("⚠️ IMAP search failed, falling back to recent messages: %v", err)
 			// Fallback to recent messages
@@ -248,14 +355,12 @@ func (gs *GmailServiceV1) syncFolderImpl(c *client.Client, accountID uuid.UUID,
 			if mbox.Messages > 10 {
 				from = mbox.Messages - 9 // Get last 10 for fallback
 			}
-			seqset.AddRange(from, to)
+			criteria = imap.NewSearchCriteria()
+			criteria.SeqNum = new(imap.SeqSet)
+			criteria.SeqNum.AddRange(from, to)
+			uids, err = c.UidSearch(criteria)
 		} else {
 			log.Printf("🔍 Found %d new messages in %s since last sync", len(uids), folder)
-			if len(uids) == 0 {
-				log.Printf("ℹ️ No new messages in folder %s", folder)
-				return nil
-			}
-			seqset.AddNum(uids...)
 		}
 	} else {
 		// Full sync: get recent messages (limit to 5 for MVP)
@@ -265,35 +370,328 @@ func (gs *GmailServiceV1) syncFolderImpl(c *client.Client, accountID uuid.UUID,
 		if mbox.Messages > 5 {
 			from = mbox.Messages - 4
 		}
-		seqset.AddRange(from, to)
+		criteria.SeqNum = new(imap.SeqSet)
+		criteria.SeqNum.AddRange(from, to)
+		uids, err = c.UidSearch(criteria)
 		log.Printf("📧 Found %d messages in %s, processing %d-%d", mbox.Messages, folder, from, to)
 	}
 
-	// Fetch messages
-	messages := make(chan *imap.Message, 10)
-	done := make(chan error, 1)
+	if err != nil {
+		return fmt.Errorf("failed to search folder %s: %v", folder, err)
+	}
+	if len(uids) == 0 {
+		log.Printf("ℹ️ No new messages in folder %s", folder)
+		return nil
+	}
 
+	return gs.syncUIDs(ctx, c, accountID, folder, uids, progress)
+}
+
+// imapFetched is the outcome of fetching one message: its metadata plus either
+// the body literal, a flag that it is already stored, or the reason it was rejected
+type imapFetched struct {
+	msg       *imap.Message // UID, flags, envelope and size
+	body      imap.Literal
+	truncated bool
+	existing  bool
+	err       error
+}
+
+// imapParsed is a message whose raw content is stored and whose JSON document is ready
+type imapParsed struct {
+	uid       uint32
+	folder    string
+	isRead    bool
+	isFlagged bool
+	emailData EmailData
+	raw       *storage.StoredObject
+}
+
+// syncUIDs fetches the given UIDs in chunks and ingests and indexes them with a
+// bounded number of workers. The next message is read from the connection only
+// when a worker is free, so memory stays bounded by the worker count rather
+// than the chunk size. Every message is reported to the progress manager
+// exactly once, either as stored, skipped or failed.
+func (gs *GmailServiceV1) syncUIDs(ctx context.Context, c *client.Client, accountID uuid.UUID, folder string, uids []uint32, progress *models.SyncProgress) error {
+	fail := func(msg *imap.Message, err error) {
+		log.Printf("⚠️ Error processing message: %v", err)
+		FailureTracker.RecordFailure(accountID, failedIMAPItem(msg, folder), err)
+		if progress != nil {
+			ProgressManager.ProcessEmail(accountID, messageSubject(msg), false)
+		}
+	}
+
+	// Stage 1: fetch over the single IMAP connection
+	fetched := make(chan imapFetched)
+	fetchErr := make(chan error, 1)
 	go func() {
-		done <- c.Fetch(seqset, []imap.FetchItem{imap.FetchEnvelope, imap.FetchRFC822}, messages)
+		defer close(fetched)
+		fetchErr <- gs.fetchMessages(ctx, c, accountID, folder, uids, fetched)
 	}()
 
-	ctx := context.Background()
+	// Stage 2: stream the raw message to storage while parsing it
+	ingested := runStage(SyncTuning.Parallelism, fetched, func(f imapFetched) (*imapParsed, bool) {
+		if f.err != nil {
+			fail(f.msg, f.err)
+			return nil, false
+		}
+		if f.existing {
+			// Message already exists, skip
+			if progress != nil {
+				ProgressManager.ProcessEmail(accountID, f.msg.Envelope.Subject, true)
+			}
+			return nil, false
+		}
 
-	for msg := range messages {
-		err := gs.processMessageWithProgress(ctx, msg, accountID, folder, progress)
+		p, err := gs.ingestMessage(ctx, accountID, folder, f)
 		if err != nil {
+			fail(f.msg, err)
+			return nil, false
+		}
+		return p, true
+	})
+
+	// Stage 3: store the JSON document and index
+	drainStage(SyncTuning.Parallelism, ingested, func(p *imapParsed) {
+		if err := gs.uploadMessage(ctx, accountID, p); err != nil {
 			log.Printf("⚠️ Error processing message: %v", err)
-			continue
+			FailureTracker.RecordFailure(accountID, p.failedItem(), err)
+			if progress != nil {
+				ProgressManager.ProcessEmail(accountID, p.emailData.Subject, false)
+			}
+			return
+		}
+
+		if p.uid != 0 {
+			FailureTracker.ResolveFailure(accountID, folder, strconv.FormatUint(uint64(p.uid), 10))
+		}
+		log.Printf("✅ Saved email: %s", p.emailData.Subject)
+
+		// Update progress: successful email
+		if progress != nil {
+			ProgressManager.ProcessEmail(accountID, p.emailData.Subject, true)
+		}
+	})
+
+	return <-fetchErr
+}
+
+// fetchMessages fetches the given UIDs of the selected folder in chunks.
+// Envelopes and sizes come first so that stored and oversize messages are
+// never downloaded in full.
+func (gs *GmailServiceV1) fetchMessages(ctx context.Context, c *client.Client, accountID uuid.UUID, folder string, uids []uint32, out chan<- imapFetched) error {
+	server, tenant := gs.throttleKeys()
+
+	for _, chunk := range chunkUint32(uids, SyncTuning.IMAPFetchChunkSize) {
+		if err := CheckSyncQuota(accountID); err != nil {
+			return err
+		}
+		if err := Throttle.Wait(ctx, accountID, server, tenant); err != nil {
+			return err
+		}
+
+		metas, err := gs.fetchMetadata(c, chunk)
+		if err != nil {
+			return fmt.Errorf("failed to fetch messages: %v", err)
+		}
+
+		var full, partial []uint32
+		var streamed []*imap.Message
+		for _, uid := range chunk {
+			meta, ok := metas[uid]
+			if !ok {
+				// Expunged since the search
+				continue
+			}
+
+			if meta.Envelope == nil {
+				out <- imapFetched{msg: meta, err: stageError(SyncStageFetch, fmt.Errorf("message envelope is nil"))}
+				continue
+			}
+
+			if existing := storedMessage(accountID, meta.Envelope.MessageId); existing != nil {
+				if existing.DeletedUpstreamAt != nil {
+					// Marked deleted earlier but back on the server
+					MarkMovedUpstream(existing, folder, strconv.FormatUint(uint64(uid), 10))
+				}
+				out <- imapFetched{msg: meta, existing: true}
+				continue
+			}
+
+			switch oversizeAction(int64(meta.Size)) {
+			case OversizeSkip:
+				out <- imapFetched{msg: meta, err: stageError(SyncStageFetch, &OversizeError{Size: int64(meta.Size), Limit: SyncTuning.MaxMessageBytes})}
+			case OversizeTruncate:
+				log.Printf("✂️ Truncating oversize message UID %d (%d bytes)", uid, meta.Size)
+				if SyncTuning.MaxMessageBytes > SyncTuning.StreamChunkBytes {
+					streamed = append(streamed, meta)
+				} else {
+					partial = append(partial, uid)
+				}
+			default:
+				if int64(meta.Size) > SyncTuning.StreamChunkBytes {
+					streamed = append(streamed, meta)
+				} else {
+					full = append(full, uid)
+				}
+			}
+		}
+
+		if err := gs.fetchBodies(c, full, false, metas, out); err != nil {
+			return fmt.Errorf("failed to fetch messages: %v", err)
+		}
+
+		if len(partial) > 0 {
+			if err := Throttle.Wait(ctx, accountID, server, tenant); err != nil {
+				return err
+			}
+			if err := gs.fetchBodies(c, partial, true, metas, out); err != nil {
+				return fmt.Errorf("failed to fetch messages: %v", err)
+			}
+		}
+
+		for _, meta := range streamed {
+			if err := gs.fetchStreamed(ctx, c, accountID, meta, out); err != nil {
+				return fmt.Errorf("failed to fetch messages: %v", err)
+			}
 		}
 	}
 
-	if err := <-done; err != nil {
-		return fmt.Errorf("failed to fetch messages: %v", err)
+	return nil
+}
+
+// streamedLiteral is a message body read from a pipe as it is fetched
+type streamedLiteral struct {
+	*io.PipeReader
+	size int
+}
+
+func (sl *streamedLiteral) Len() int {
+	return sl.size
+}
+
+// fetchStreamed hands a large message on as a pipe and fills it with
+// BODY.PEEK[]<offset.length> fetches of StreamChunkBytes each. go-imap reads
+// every literal into memory before returning it, so this keeps at most one
+// chunk of the message in memory. Oversize messages under the truncate policy
+// are fetched up to MaxMessageBytes.
+func (gs *GmailServiceV1) fetchStreamed(ctx context.Context, c *client.Client, accountID uuid.UUID, meta *imap.Message, out chan<- imapFetched) error {
+	size := int64(meta.Size)
+	truncated := oversizeAction(size) == OversizeTruncate
+	if truncated {
+		size = SyncTuning.MaxMessageBytes
 	}
 
+	pr, pw := io.Pipe()
+	out <- imapFetched{msg: meta, body: &streamedLiteral{PipeReader: pr, size: int(size)}, truncated: truncated}
+
+	server, tenant := gs.throttleKeys()
+	for offset := int64(0); offset < size; offset += SyncTuning.StreamChunkBytes {
+		length := SyncTuning.StreamChunkBytes
+		if offset+length > size {
+			length = size - offset
+		}
+		if err := Throttle.Wait(ctx, accountID, server, tenant); err != nil {
+			pw.CloseWithError(err)
+			return err
+		}
+
+		chunk, err := gs.fetchPartial(c, meta.Uid, offset, length)
+		if err != nil {
+			pw.CloseWithError(err)
+			return err
+		}
+		if _, err := pw.Write(chunk); err != nil {
+			// The ingest stage gave up on the message and records the failure
+			return nil
+		}
+		if int64(len(chunk)) < length {
+			// The message is shorter than its RFC822.SIZE; the short upload fails the message
+			break
+		}
+	}
+	pw.Close()
 	return nil
 }
 
+// fetchPartial fetches length bytes of a message starting at offset, without setting \Seen
+func (gs *GmailServiceV1) fetchPartial(c *client.Client, uid uint32, offset, length int64) ([]byte, error) {
+	section := &imap.BodySectionName{Peek: true, Partial: []int{int(offset), int(length)}}
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uid)
+
+	messages := make(chan *imap.Message, 1)
+	if err := c.UidFetch(seqset, []imap.FetchItem{imap.FetchUid, section.FetchItem()}, messages); err != nil {
+		return nil, err
+	}
+	msg := <-messages
+	if msg == nil {
+		return nil, fmt.Errorf("message UID %d not found on server", uid)
+	}
+	body := firstLiteral(msg)
+	if body == nil {
+		return nil, fmt.Errorf("server returned no message body for UID %d", uid)
+	}
+	return io.ReadAll(body)
+}
+
+// fetchMetadata fetches UID, flags, envelope and size for the given UIDs
+func (gs *GmailServiceV1) fetchMetadata(c *client.Client, uids []uint32) (map[uint32]*imap.Message, error) {
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uids...)
+
+	messages := make(chan *imap.Message, len(uids))
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seqset, []imap.FetchItem{imap.FetchUid, imap.FetchFlags, imap.FetchEnvelope, imap.FetchRFC822Size}, messages)
+	}()
+
+	metas := make(map[uint32]*imap.Message, len(uids))
+	for msg := range messages {
+		metas[msg.Uid] = msg
+	}
+	return metas, <-done
+}
+
+// fetchBodies fetches message bodies without setting \Seen. With truncated set
+// only the first MaxMessageBytes of each message are requested.
+func (gs *GmailServiceV1) fetchBodies(c *client.Client, uids []uint32, truncated bool, metas map[uint32]*imap.Message, out chan<- imapFetched) error {
+	if len(uids) == 0 {
+		return nil
+	}
+
+	section := &imap.BodySectionName{Peek: true}
+	if truncated {
+		section.Partial = []int{0, int(SyncTuning.MaxMessageBytes)}
+	}
+
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uids...)
+
+	// Unbuffered, so the client reads the next literal only once this one is handed off
+	messages := make(chan *imap.Message)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seqset, []imap.FetchItem{imap.FetchUid, section.FetchItem()}, messages)
+	}()
+
+	for msg := range messages {
+		meta := metas[msg.Uid]
+		if meta == nil {
+			continue
+		}
+
+		body := firstLiteral(msg)
+		if body == nil {
+			out <- imapFetched{msg: meta, err: stageError(SyncStageFetch, fmt.Errorf("server returned no message body"))}
+			continue
+		}
+		out <- imapFetched{msg: meta, body: body, truncated: truncated}
+	}
+
+	return <-done
+}
+
 // processMessageWithProgress processes a message with optional progress tracking
 func (gs *GmailServiceV1) processMessageWithProgress(ctx context.Context, msg *imap.Message, accountID uuid.UUID, folder string, progress *models.SyncProgress) error {
 	return gs.processMessageImpl(ctx, msg, accountID, folder, progress)
@@ -307,20 +705,15 @@ func (gs *GmailServiceV1) processMessage(ctx context.Context, msg *imap.Message,
 // processMessageImpl performs the actual message processing with optional progress tracking
 func (gs *GmailServiceV1) processMessageImpl(ctx context.Context, msg *imap.Message, accountID uuid.UUID, folder string, progress *models.SyncProgress) error {
 	if msg.Envelope == nil {
-		return fmt.Errorf("message envelope is nil")
+		return stageError(SyncStageFetch, fmt.Errorf("message envelope is nil"))
 	}
 
-	// Check if message already exists
-	var existingEmail database.EmailIndex
-	messageID := msg.Envelope.MessageId
-	
 	// Update progress with current email subject
 	if progress != nil {
 		ProgressManager.UpdateProgress(accountID, "processing", fmt.Sprintf("Processing: %s", msg.Envelope.Subject))
 	}
-	
-	err := database.DB.Where("account_id = ? AND message_id = ?", accountID, messageID).First(&existingEmail).Error
-	if err == nil {
+
+	if storedMessage(accountID, msg.Envelope.MessageId) != nil {
 		// Message already exists, skip
 		if progress != nil {
 			ProgressManager.ProcessEmail(accountID, msg.Envelope.Subject, true)
@@ -328,6 +721,36 @@ func (gs *GmailServiceV1) processMessageImpl(ctx context.Context, msg *imap.Mess
 		return nil
 	}
 
+	body := firstLiteral(msg)
+	if body == nil {
+		return stageError(SyncStageFetch, fmt.Errorf("server returned no message body"))
+	}
+
+	parsed, err := gs.ingestMessage(ctx, accountID, folder, imapFetched{msg: msg, body: body})
+	if err != nil {
+		return err
+	}
+
+	if err := gs.uploadMessage(ctx, accountID, parsed); err != nil {
+		return err
+	}
+
+	log.Printf("✅ Saved email: %s", parsed.emailData.Subject)
+	
+	// Update progress: successful email
+	if progress != nil {
+		ProgressManager.ProcessEmail(accountID, msg.Envelope.Subject, true)
+	}
+
+	return nil
+}
+
+// ingestMessage streams the raw message into storage, hashing it on the way,
+// and parses the text body from the same stream
+func (gs *GmailServiceV1) ingestMessage(ctx context.Context, accountID uuid.UUID, folder string, f imapFetched) (*imapParsed, error) {
+	msg := f.msg
+	messageID := msg.Envelope.MessageId
+
 	// Create email data structure
 	emailData := EmailData{
 		MessageID: messageID,
@@ -336,60 +759,51 @@ func (gs *GmailServiceV1) processMessageImpl(ctx context.Context, msg *imap.Mess
 		Folder:    folder,
 		From:      convertIMAPAddresses(msg.Envelope.From),
 		To:        convertIMAPAddresses(msg.Envelope.To),
+		Cc:        convertIMAPAddresses(msg.Envelope.Cc),
 		Headers:   make(map[string][]string),
+		Truncated: f.truncated,
 	}
 
-	// Get body from RFC822 - simplified for MVP
-	for _, r := range msg.Body {
-		body, err := io.ReadAll(r)
-		if err != nil {
-			log.Printf("Error reading body: %v", err)
-			continue
-		}
-		
-		// For MVP, just take the raw body
-		emailData.Body = string(body)
-		
-		// Try to parse and get text part
-		mr, err := mail.CreateReader(strings.NewReader(string(body)))
-		if err == nil {
-			for {
-				p, err := mr.NextPart()
-				if err == io.EOF {
-					break
-				} else if err != nil {
-					break
-				}
-
-				if strings.HasPrefix(p.Header.Get("Content-Type"), "text/plain") {
-					b, err := io.ReadAll(p.Body)
-					if err == nil {
-						emailData.Body = string(b)
-					}
-					break
-				}
-			}
-		}
-		break // Take first body for MVP
+	// Streamed bodies are closed so that the fetch stops when the upload fails
+	if closer, ok := f.body.(io.Closer); ok {
+		defer closer.Close()
 	}
 
-	// Save to MinIO
-	emailJSON, err := json.Marshal(emailData)
+	rawPath := fmt.Sprintf("emails/%s/%s.eml", accountID.String(), messageID)
+	raw, scan, err := storeRawMessage(ctx, rawPath, f.body, int64(f.body.Len()))
+	emailData.Body = scan.Text
+	emailData.Attachments = scan.Attachments
 	if err != nil {
-		return fmt.Errorf("failed to marshal email data: %v", err)
+		return nil, stageError(SyncStageStore, fmt.Errorf("failed to save raw message to MinIO: %v", err))
 	}
 
-	minioPath := fmt.Sprintf("emails/%s/%s.json", accountID.String(), messageID)
-	
-	_, err = storage.MinioClient.PutObject(ctx, "email-backups", minioPath, 
-		strings.NewReader(string(emailJSON)), int64(len(emailJSON)), 
-		minio.PutObjectOptions{ContentType: "application/json"})
+	emailData.RawPath = raw.Path
+	emailData.RawSize = raw.Size
+	emailData.RawSHA256 = raw.SHA256
+
+	return &imapParsed{
+		uid:       msg.Uid,
+		folder:    folder,
+		isRead:    hasIMAPFlag(msg.Flags, imap.SeenFlag),
+		isFlagged: hasIMAPFlag(msg.Flags, imap.FlaggedFlag),
+		emailData: emailData,
+		raw:       raw,
+	}, nil
+}
+
+// uploadMessage saves the JSON document to MinIO and indexes the message in PostgreSQL
+func (gs *GmailServiceV1) uploadMessage(ctx context.Context, accountID uuid.UUID, parsed *imapParsed) error {
+	emailData := parsed.emailData
+
+	// Save to MinIO
+	minioPath := fmt.Sprintf("emails/%s/%s.json", accountID.String(), emailData.MessageID)
+	doc, err := storage.PutJSONObject(ctx, minioPath, emailData)
 	if err != nil {
-		return fmt.Errorf("failed to save email to MinIO: %v", err)
+		return stageError(SyncStageStore, fmt.Errorf("failed to save email to MinIO: %v", err))
 	}
 
 	// Calculate email sizes
-	emailSize := int64(len(emailJSON))
+	emailSize := doc.Size + parsed.raw.Size
 	contentSize := int64(len(emailData.Subject) + len(emailData.Body))
 	attachmentCount := len(emailData.Attachments)
 	attachmentSize := int64(0)
@@ -403,11 +817,19 @@ func (gs *GmailServiceV1) processMessageImpl(ctx context.Context, msg *imap.Mess
 	emailIndex := database.EmailIndex{
 		ID:              uuid.New(),
 		AccountID:       accountID,
-		MessageID:       messageID,
+		MessageID:       emailData.MessageID,
 		Subject:         emailData.Subject,
 		Date:            emailData.Date,
-		Folder:          folder,
+		Folder:          parsed.folder,
 		MinioPath:       minioPath,
+		RawMinioPath:    parsed.raw.Path,
+		IsTruncated:     emailData.Truncated,
+		IsRead:          parsed.isRead,
+		IsFlagged:       parsed.isFlagged,
+		ContentSHA256:   doc.SHA256,
+		RawSHA256:       parsed.raw.SHA256,
+		LockMode:        parsed.raw.LockMode,
+		RetainUntil:     parsed.raw.RetainUntil, // Written first, so its lock expires first
 		EmailSize:       emailSize,
 		ContentSize:     contentSize,
 		AttachmentCount: attachmentCount,
@@ -419,26 +841,199 @@ func (gs *GmailServiceV1) processMessageImpl(ctx context.Context, msg *imap.Mess
 		emailIndex.SenderEmail = emailData.From[0]["email"]
 		emailIndex.SenderName = emailData.From[0]["name"]
 	}
+	emailIndex.Recipients = addressRecipients(emailData.To, emailData.Cc)
+
+	if parsed.uid != 0 {
+		emailIndex.ProviderItemID = strconv.FormatUint(uint64(parsed.uid), 10)
+	}
+
+	if err := database.DB.Create(&emailIndex).Error; err != nil {
+		return stageError(SyncStageIndex, fmt.Errorf("failed to save email index: %v", err))
+	}
 
-	err = database.DB.Create(&emailIndex).Error
+	return nil
+}
+
+// failedItem builds the failure key for a parsed IMAP message
+func (p *imapParsed) failedItem() FailedItem {
+	item := FailedItem{Folder: p.folder, MessageID: p.emailData.MessageID, Subject: p.emailData.Subject}
+	if p.uid != 0 {
+		item.ProviderItemID = strconv.FormatUint(uint64(p.uid), 10)
+	}
+	return item
+}
+
+// RetryFailedMessages refetches previously failed messages by UID, folder by folder
+func (gs *GmailServiceV1) RetryFailedMessages(accountID uuid.UUID, failures []database.SyncFailure) (int, error) {
+	c, err := gs.connect()
 	if err != nil {
-		// Update progress: failed email
-		if progress != nil {
-			ProgressManager.ProcessEmail(accountID, msg.Envelope.Subject, false)
+		return 0, fmt.Errorf("failed to connect: %v", err)
+	}
+	defer c.Logout()
+
+	byFolder := make(map[string][]database.SyncFailure)
+	for _, failure := range failures {
+		byFolder[failure.Folder] = append(byFolder[failure.Folder], failure)
+	}
+
+	ctx, err := archiveContext(accountID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prepare archive storage: %v", err)
+	}
+	recovered := 0
+
+	for folder, folderFailures := range byFolder {
+		if _, err := c.Select(folder, true); err != nil {
+			log.Printf("⚠️ Retry could not select folder %s: %v", folder, err)
+			for _, failure := range folderFailures {
+				FailureTracker.RecordFailure(accountID, failedItemFromRecord(failure), stageError(SyncStageFetch, err))
+			}
+			continue
+		}
+
+		pending := make(map[uint32]database.SyncFailure)
+		var uids []uint32
+		for _, failure := range folderFailures {
+			uid, err := strconv.ParseUint(failure.ProviderItemID, 10, 32)
+			if err != nil {
+				continue
+			}
+			pending[uint32(uid)] = failure
+			uids = append(uids, uint32(uid))
+		}
+
+		if len(pending) == 0 {
+			continue
+		}
+
+		fetched := make(chan imapFetched)
+		fetchErr := make(chan error, 1)
+		go func() {
+			defer close(fetched)
+			fetchErr <- gs.fetchMessages(ctx, c, accountID, folder, uids, fetched)
+		}()
+
+		for f := range fetched {
+			failure, ok := pending[f.msg.Uid]
+			if !ok {
+				if closer, isCloser := f.body.(io.Closer); isCloser {
+					closer.Close()
+				}
+				continue
+			}
+			delete(pending, f.msg.Uid)
+
+			if f.err != nil {
+				log.Printf("⚠️ Retry failed for UID %d in %s: %v", f.msg.Uid, folder, f.err)
+				FailureTracker.RecordFailure(accountID, failedItemFromRecord(failure), f.err)
+				continue
+			}
+
+			if !f.existing {
+				parsed, err := gs.ingestMessage(ctx, accountID, folder, f)
+				if err == nil {
+					err = gs.uploadMessage(ctx, accountID, parsed)
+				}
+				if err != nil {
+					log.Printf("⚠️ Retry failed for UID %d in %s: %v", f.msg.Uid, folder, err)
+					FailureTracker.RecordFailure(accountID, failedItemFromRecord(failure), err)
+					continue
+				}
+			}
+
+			FailureTracker.ResolveFailure(accountID, folder, failure.ProviderItemID)
+			recovered++
+		}
+
+		if err := <-fetchErr; err != nil {
+			log.Printf("⚠️ Retry fetch failed in folder %s: %v", folder, err)
+			for _, failure := range pending {
+				FailureTracker.RecordFailure(accountID, failedItemFromRecord(failure), stageError(SyncStageFetch, err))
+			}
+			if gs.isThrottleError(err) {
+				server, tenant := gs.throttleKeys()
+				Throttle.Backoff(server, tenant, Throttle.BackoffDelay(1, 0))
+				// The connection is gone, the remaining folders are retried on the next run
+				break
+			}
+			continue
+		}
+
+		// UIDs the server did not return no longer exist in the folder
+		for _, failure := range pending {
+			FailureTracker.RecordFailure(accountID, failedItemFromRecord(failure),
+				stageError(SyncStageFetch, fmt.Errorf("message UID %s not found on server", failure.ProviderItemID)))
 		}
-		return fmt.Errorf("failed to save email index: %v", err)
 	}
 
-	log.Printf("✅ Saved email: %s", emailData.Subject)
-	
-	// Update progress: successful email
-	if progress != nil {
-		ProgressManager.ProcessEmail(accountID, msg.Envelope.Subject, true)
+	return recovered, nil
+}
+
+// storedMessage returns the index entry of a message already archived for the account
+func storedMessage(accountID uuid.UUID, messageID string) *database.EmailIndex {
+	var existingEmail database.EmailIndex
+	if database.DB.Where("account_id = ? AND message_id = ?", accountID, messageID).First(&existingEmail).Error != nil {
+		return nil
+	}
+	return &existingEmail
+}
+
+// hasIMAPFlag reports whether a flag list contains the given flag
+func hasIMAPFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
+}
+
+// firstLiteral returns the first body section of a fetched message
+func firstLiteral(msg *imap.Message) imap.Literal {
+	for _, literal := range msg.Body {
+		if literal != nil {
+			return literal
+		}
 	}
-	
 	return nil
 }
 
+// throttleKeys returns the server and tenant the request budgets are tracked for.
+// Gmail enforces bandwidth limits per mailbox, so the mailbox itself is the tenant.
+func (gs *GmailServiceV1) throttleKeys() (string, string) {
+	return gs.Host, strings.ToLower(gs.Username)
+}
+
+// failedIMAPItem builds the failure key for an IMAP message
+func failedIMAPItem(msg *imap.Message, folder string) FailedItem {
+	item := FailedItem{Folder: folder}
+	if msg.Uid != 0 {
+		item.ProviderItemID = strconv.FormatUint(uint64(msg.Uid), 10)
+	}
+	if msg.Envelope != nil {
+		item.MessageID = msg.Envelope.MessageId
+		item.Subject = msg.Envelope.Subject
+	}
+	return item
+}
+
+func failedItemFromRecord(failure database.SyncFailure) FailedItem {
+	return FailedItem{
+		Folder:         failure.Folder,
+		ProviderItemID: failure.ProviderItemID,
+		ChangeKey:      failure.ChangeKey,
+		MessageID:      failure.MessageID,
+		Subject:        failure.Subject,
+	}
+}
+
+func messageSubject(msg *imap.Message) string {
+	if msg.Envelope == nil {
+		return ""
+	}
+	return msg.Envelope.Subject
+}
+
 func convertIMAPAddresses(addresses []*imap.Address) []map[string]string {
 	result := make([]map[string]string, len(addresses))
 	for i, addr := range addresses {
@@ -0,0 +1,723 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"emailprojectv2/database"
+	"emailprojectv2/models"
+	"emailprojectv2/storage"
+	"emailprojectv2/types"
+
+	"github.com/google/uuid"
+)
+
+// graphTenantPattern matches directory (tenant) IDs and verified domain names
+var graphTenantPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9.-]*$`)
+
+// graphMessageFields are the message properties read from Graph; bodies and
+// attachments are read from the MIME content
+const graphMessageFields = "id,internetMessageId,subject,from,toRecipients,ccRecipients,receivedDateTime,isRead,flag"
+
+// graphDeltaPageSize is the number of messages per delta page
+const graphDeltaPageSize = 50
+
+// graphToken is a cached client credentials access token
+type graphToken struct {
+	value     string
+	expiresAt time.Time
+}
+
+var (
+	graphTokens   = map[string]graphToken{}
+	graphTokensMu sync.Mutex
+)
+
+// GraphAPIError is an error response from Microsoft Graph or the token endpoint
+type GraphAPIError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *GraphAPIError) Error() string {
+	return fmt.Sprintf("graph error %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// GraphClient calls Microsoft Graph with an app registration's client
+// credentials, so any mailbox of the tenant can be read without the user
+type GraphClient struct {
+	TenantID     string
+	ClientID     string
+	ClientSecret string
+	httpClient   *http.Client
+	streamClient *http.Client // No overall timeout, message content can take long to download
+
+	// accountID is the account currently being synced, used for throttle status
+	accountID uuid.UUID
+}
+
+func NewGraphClient(tenantID, clientID, clientSecret string) *GraphClient {
+	return &GraphClient{
+		TenantID:     tenantID,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		httpClient:   &http.Client{Timeout: 60 * time.Second},
+		streamClient: &http.Client{Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			ResponseHeaderTimeout: 60 * time.Second,
+		}},
+	}
+}
+
+// ValidateGraphTenant checks that a tenant is a directory ID or domain name,
+// since it becomes part of the token endpoint URL
+func ValidateGraphTenant(tenantID string) error {
+	if !graphTenantPattern.MatchString(tenantID) {
+		return fmt.Errorf("invalid tenant ID %q", tenantID)
+	}
+	return nil
+}
+
+// graphScope is the client credentials scope of the configured Graph API
+func graphScope() string {
+	root, err := url.Parse(ConnectorSettings.GraphURL)
+	if err != nil || root.Host == "" {
+		return "https://graph.microsoft.com/.default"
+	}
+	return root.Scheme + "://" + root.Host + "/.default"
+}
+
+// readGraphError turns a failed response into a GraphAPIError
+func readGraphError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	apiErr := &GraphAPIError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+
+	// Graph nests its error, the token endpoint does not
+	var parsed struct {
+		Error            json.RawMessage `json:"error"`
+		ErrorDescription string          `json:"error_description"`
+	}
+	if json.Unmarshal(body, &parsed) != nil {
+		return apiErr
+	}
+	var nested struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(parsed.Error, &nested) == nil && nested.Code != "" {
+		apiErr.Code, apiErr.Message = nested.Code, nested.Message
+	} else if json.Unmarshal(parsed.Error, &apiErr.Code) == nil {
+		apiErr.Message = parsed.ErrorDescription
+	}
+	return apiErr
+}
+
+// accessToken returns the application's access token, requesting a new one
+// shortly before the cached one expires
+func (gc *GraphClient) accessToken(ctx context.Context) (string, error) {
+	key := gc.TenantID + "|" + gc.ClientID
+	graphTokensMu.Lock()
+	cached, ok := graphTokens[key]
+	graphTokensMu.Unlock()
+	if ok && time.Now().Add(time.Minute).Before(cached.expiresAt) {
+		return cached.value, nil
+	}
+
+	if err := ValidateGraphTenant(gc.TenantID); err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {gc.ClientID},
+		"client_secret": {gc.ClientSecret},
+		"scope":         {graphScope()},
+	}
+	tokenURL := strings.TrimRight(ConnectorSettings.GraphLoginURL, "/") + "/" + gc.TenantID + "/oauth2/v2.0/token"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("failed to create token request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := gc.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to request access token: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to request access token: %v", readGraphError(resp))
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil || token.AccessToken == "" {
+		return "", fmt.Errorf("failed to read access token: %v", err)
+	}
+
+	graphTokensMu.Lock()
+	graphTokens[key] = graphToken{value: token.AccessToken, expiresAt: time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)}
+	graphTokensMu.Unlock()
+	log.Printf("🔑 Obtained Graph application token for tenant %s", gc.TenantID)
+	return token.AccessToken, nil
+}
+
+// forgetToken drops the cached token after Graph rejected it
+func (gc *GraphClient) forgetToken() {
+	graphTokensMu.Lock()
+	delete(graphTokens, gc.TenantID+"|"+gc.ClientID)
+	graphTokensMu.Unlock()
+}
+
+// send requests a path below the Graph API root, or a next link Graph
+// returned, and returns the successful response. The caller must close it.
+func (gc *GraphClient) send(ctx context.Context, client *http.Client, path, accept string) (*http.Response, error) {
+	root := strings.TrimRight(ConnectorSettings.GraphURL, "/")
+	target := root + path
+	if strings.Contains(path, "://") {
+		// Next links point back to the API root; never send the token elsewhere
+		if !strings.HasPrefix(path, root+"/") {
+			return nil, fmt.Errorf("unexpected Graph link %s", path)
+		}
+		target = path
+	}
+
+	token, err := gc.accessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Graph request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", accept)
+	// Immutable ids keep a message's id when it moves between folders
+	prefer := `IdType="ImmutableId"`
+	if strings.Contains(path, "/delta") {
+		prefer += fmt.Sprintf(", odata.maxpagesize=%d", graphDeltaPageSize)
+	}
+	req.Header.Set("Prefer", prefer)
+
+	resp, err := Throttle.ThrottledDo(ctx, gc.accountID, gc.TenantID, client, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusUnauthorized {
+			gc.forgetToken()
+		}
+		return nil, readGraphError(resp)
+	}
+	return resp, nil
+}
+
+// get fetches a path below the Graph API root, or a next link Graph returned,
+// and decodes the JSON response into out
+func (gc *GraphClient) get(ctx context.Context, path string, out interface{}) error {
+	resp, err := gc.send(ctx, gc.httpClient, path, "application/json")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to parse Graph response: %v", err)
+	}
+	return nil
+}
+
+// open streams raw content below the Graph API root, such as the MIME content
+// of a message, and returns it with its size, or -1 when Graph does not say.
+// The caller must close it.
+func (gc *GraphClient) open(ctx context.Context, path string) (io.ReadCloser, int64, error) {
+	resp, err := gc.send(ctx, gc.streamClient, path, "*/*")
+	if err != nil {
+		return nil, 0, err
+	}
+	return resp.Body, resp.ContentLength, nil
+}
+
+// graphUser is a user of the tenant as listed by Graph
+type graphUser struct {
+	ID                string `json:"id"`
+	DisplayName       string `json:"displayName"`
+	Mail              string `json:"mail"`
+	UserPrincipalName string `json:"userPrincipalName"`
+	AccountEnabled    *bool  `json:"accountEnabled"`
+	UserType          string `json:"userType"`
+}
+
+// listMailboxUsers returns the enabled members of the tenant that have a mail
+// address. Guests and disabled accounts are left out.
+func (gc *GraphClient) listMailboxUsers(ctx context.Context) ([]graphUser, error) {
+	query := url.Values{
+		"$select": {"id,displayName,mail,userPrincipalName,accountEnabled,userType"},
+		"$top":    {"999"},
+	}
+	path := "/users?" + query.Encode()
+
+	users := []graphUser{}
+	for path != "" {
+		var page struct {
+			Value    []graphUser `json:"value"`
+			NextLink string      `json:"@odata.nextLink"`
+		}
+		if err := gc.get(ctx, path, &page); err != nil {
+			return nil, fmt.Errorf("failed to list users: %v", err)
+		}
+		for _, user := range page.Value {
+			if user.Mail == "" || user.UserType == "Guest" || (user.AccountEnabled != nil && !*user.AccountEnabled) {
+				continue
+			}
+			users = append(users, user)
+		}
+		path = page.NextLink
+	}
+	return users, nil
+}
+
+// graphMailFolder is a mail folder with its path from the mailbox root
+type graphMailFolder struct {
+	ID               string `json:"id"`
+	DisplayName      string `json:"displayName"`
+	ChildFolderCount int    `json:"childFolderCount"`
+	Path             string `json:"-"`
+}
+
+// listMailFolders returns every mail folder of a mailbox, parents before
+// their subfolders. Paths join display names with "/", e.g. "Inbox/Projects".
+func (gc *GraphClient) listMailFolders(ctx context.Context, mailbox string) ([]graphMailFolder, error) {
+	query := url.Values{
+		"$select": {"id,displayName,childFolderCount"},
+		"$top":    {"100"},
+	}
+	folders := []graphMailFolder{}
+	pending := []graphMailFolder{{}} // The mailbox root
+	for len(pending) > 0 {
+		parent := pending[0]
+		pending = pending[1:]
+
+		path := "/users/" + url.PathEscape(mailbox) + "/mailFolders?" + query.Encode()
+		if parent.ID != "" {
+			path = "/users/" + url.PathEscape(mailbox) + "/mailFolders/" + url.PathEscape(parent.ID) + "/childFolders?" + query.Encode()
+		}
+		for path != "" {
+			var page struct {
+				Value    []graphMailFolder `json:"value"`
+				NextLink string            `json:"@odata.nextLink"`
+			}
+			if err := gc.get(ctx, path, &page); err != nil {
+				return nil, fmt.Errorf("failed to list mail folders: %v", err)
+			}
+			for _, folder := range page.Value {
+				folder.Path = folder.DisplayName
+				if parent.Path != "" {
+					folder.Path = parent.Path + "/" + folder.DisplayName
+				}
+				folders = append(folders, folder)
+				if folder.ChildFolderCount > 0 {
+					pending = append(pending, folder)
+				}
+			}
+			path = page.NextLink
+		}
+	}
+	return folders, nil
+}
+
+// graphRecipient is an address of a Graph message
+type graphRecipient struct {
+	EmailAddress struct {
+		Name    string `json:"name"`
+		Address string `json:"address"`
+	} `json:"emailAddress"`
+}
+
+// graphMessage is a message as returned by Graph with graphMessageFields
+type graphMessage struct {
+	ID                string           `json:"id"`
+	InternetMessageID string           `json:"internetMessageId"`
+	Subject           string           `json:"subject"`
+	From              *graphRecipient  `json:"from"`
+	ToRecipients      []graphRecipient `json:"toRecipients"`
+	CcRecipients      []graphRecipient `json:"ccRecipients"`
+	ReceivedDateTime  time.Time        `json:"receivedDateTime"`
+	IsRead            bool             `json:"isRead"`
+	Flag              struct {
+		FlagStatus string `json:"flagStatus"`
+	} `json:"flag"`
+}
+
+// graphAddresses returns recipients as "Name <address>" entries
+func graphAddresses(recipients []graphRecipient) []string {
+	addresses := make([]string, 0, len(recipients))
+	for _, r := range recipients {
+		if r.EmailAddress.Name != "" && r.EmailAddress.Name != r.EmailAddress.Address {
+			addresses = append(addresses, fmt.Sprintf("%s <%s>", r.EmailAddress.Name, r.EmailAddress.Address))
+		} else {
+			addresses = append(addresses, r.EmailAddress.Address)
+		}
+	}
+	return addresses
+}
+
+// GraphMailService backs up one mailbox of a tenant connector through Graph
+// application permissions
+type GraphMailService struct {
+	client  *GraphClient
+	Mailbox string // Graph user ID of the mailbox
+}
+
+// NewGraphMailServiceForAccount creates the Graph service for an Office 365
+// account created by a tenant connector, using the connector's credentials
+func NewGraphMailServiceForAccount(account *database.EmailAccount) (*GraphMailService, error) {
+	settings := parseConnectorAccountSettings(account)
+	if settings.TenantConnector == "" || settings.GraphUserID == "" {
+		return nil, ErrNotConnectorAccount
+	}
+	var connector database.TenantConnector
+	if err := database.DB.Where("id = ? AND type = ?", settings.TenantConnector, ConnectorTypeGraph).First(&connector).Error; err != nil {
+		return nil, fmt.Errorf("failed to load tenant connector: %v", err)
+	}
+	return &GraphMailService{
+		client:  NewGraphClient(connector.TenantID, connector.ClientID, connector.ClientSecret),
+		Mailbox: settings.GraphUserID,
+	}, nil
+}
+
+// graphMessageID is the archive message ID of a Graph message
+func graphMessageID(accountID uuid.UUID, graphID string) string {
+	return fmt.Sprintf("office365_%s_%s", accountID.String(), graphID)
+}
+
+// graphFailedItem builds the failure key for a Graph message
+func graphFailedItem(accountID uuid.UUID, folder string, msg graphMessage) FailedItem {
+	return FailedItem{
+		Folder:         folder,
+		ProviderItemID: msg.ID,
+		MessageID:      graphMessageID(accountID, msg.ID),
+		Subject:        msg.Subject,
+	}
+}
+
+// SyncEmailsWithProgress backs up the mailbox's folders with progress tracking
+func (gs *GraphMailService) SyncEmailsWithProgress(accountID uuid.UUID) error {
+	progress := ProgressManager.StartSync(accountID)
+	return gs.syncWithProgress(accountID, progress)
+}
+
+// SyncEmails backs up the mailbox's folders
+func (gs *GraphMailService) SyncEmails(accountID uuid.UUID) error {
+	return gs.syncWithProgress(accountID, nil)
+}
+
+func (gs *GraphMailService) syncWithProgress(accountID uuid.UUID, progress *models.SyncProgress) error {
+	log.Printf("📧 Starting Graph mailbox sync for account: %s", accountID)
+	gs.client.accountID = accountID
+	fail := func(err error) error {
+		if progress != nil {
+			ProgressManager.SetError(accountID, err)
+		}
+		return err
+	}
+
+	// Syncs are paused while the organization's storage quota is used up
+	if err := CheckSyncQuota(accountID); err != nil {
+		return fail(err)
+	}
+	ctx, err := archiveContext(accountID)
+	if err != nil {
+		return fail(fmt.Errorf("failed to prepare archive storage: %v", err))
+	}
+	var account database.EmailAccount
+	if err := database.DB.Where("id = ?", accountID).First(&account).Error; err != nil {
+		return fail(fmt.Errorf("failed to get account details: %v", err))
+	}
+
+	if progress != nil {
+		ProgressManager.UpdateProgress(accountID, "fetching", "Fetching emails from Microsoft 365...")
+	}
+	folders, err := gs.client.listMailFolders(ctx, gs.Mailbox)
+	if err != nil {
+		return fail(err)
+	}
+
+	counts := &graphSyncCounts{}
+	for _, folder := range folders {
+		err := gs.syncFolder(ctx, accountID, folder, counts, progress)
+		if isGraphDeltaExpired(err) {
+			// The delta link expired; start the folder over from a new baseline
+			log.Printf("🔄 Delta link of folder %s expired, resyncing the folder", folder.Path)
+			err = gs.syncFolder(ctx, accountID, folder, counts, progress)
+		}
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	if err := database.DB.Model(&account).Update("last_sync_date", time.Now()).Error; err != nil {
+		log.Printf("⚠️ Failed to update last sync date: %v", err)
+	}
+	log.Printf("🎉 Graph mailbox sync completed! Synced: %d, Skipped: %d, Total processed: %d", counts.synced, counts.skipped, counts.total)
+	if progress != nil {
+		ProgressManager.CompleteSync(accountID)
+	}
+	return nil
+}
+
+// isGraphDeltaExpired reports whether Graph no longer accepts a delta link
+func isGraphDeltaExpired(err error) bool {
+	var apiErr *GraphAPIError
+	return errors.As(err, &apiErr) && (apiErr.StatusCode == http.StatusGone || apiErr.Code == "SyncStateNotFound")
+}
+
+// graphSyncCounts tallies the messages of a sync across folders
+type graphSyncCounts struct {
+	synced, skipped, total int
+}
+
+// syncFolder runs the messages delta query of a folder from its saved delta
+// link, or from the start when there is none. Deletes, moves and flag
+// changes are applied to the archive and new messages are stored. The delta
+// link is saved after every page, so an interrupted sync resumes there.
+func (gs *GraphMailService) syncFolder(ctx context.Context, accountID uuid.UUID, folder graphMailFolder, counts *graphSyncCounts, progress *models.SyncProgress) error {
+	state, err := loadFolderSyncState(accountID, folder.Path)
+	if err != nil {
+		return err
+	}
+	path := state.SyncState
+	if path == "" {
+		log.Printf("🆕 Starting delta sync of folder %s", folder.Path)
+		path = "/users/" + url.PathEscape(gs.Mailbox) + "/mailFolders/" + url.PathEscape(folder.ID) + "/messages/delta?" + url.Values{"$select": {graphMessageFields}}.Encode()
+	}
+
+	for path != "" {
+		// A sync cut short by the storage quota resumes from the last saved
+		// delta link once there is room
+		if err := CheckSyncQuota(accountID); err != nil {
+			return err
+		}
+
+		var page struct {
+			Value     []json.RawMessage `json:"value"`
+			NextLink  string            `json:"@odata.nextLink"`
+			DeltaLink string            `json:"@odata.deltaLink"`
+		}
+		if err := gs.client.get(ctx, path, &page); err != nil {
+			if isGraphDeltaExpired(err) {
+				state.SyncState = ""
+				saveFolderSyncState(state)
+				return err
+			}
+			return fmt.Errorf("failed to list messages of %s: %v", folder.Path, err)
+		}
+
+		items := make([]GraphDeltaItem, 0, len(page.Value))
+		messages := make(map[string]graphMessage, len(page.Value))
+		for _, raw := range page.Value {
+			var item GraphDeltaItem
+			var msg graphMessage
+			if err := json.Unmarshal(raw, &item); err != nil {
+				return fmt.Errorf("failed to parse Graph delta entry: %v", err)
+			}
+			if item.Removed == nil {
+				if err := json.Unmarshal(raw, &msg); err != nil {
+					return fmt.Errorf("failed to parse Graph message: %v", err)
+				}
+				messages[item.ID] = msg
+			}
+			items = append(items, item)
+		}
+
+		unarchived := ApplyGraphDelta(accountID, folder.Path, items)
+		counts.skipped += len(messages) - len(unarchived)
+		counts.total += len(messages)
+		if progress != nil {
+			ProgressManager.SetTotalEmails(accountID, counts.total)
+		}
+
+		for _, item := range unarchived {
+			msg := messages[item.ID]
+			if err := gs.storeMessage(ctx, accountID, folder.Path, msg); err != nil {
+				log.Printf("⚠️  Failed to sync %s: %v", msg.Subject, err)
+				FailureTracker.RecordFailure(accountID, graphFailedItem(accountID, folder.Path, msg), err)
+				if progress != nil {
+					ProgressManager.ProcessEmail(accountID, msg.Subject, false)
+				}
+				continue
+			}
+			FailureTracker.ResolveFailure(accountID, folder.Path, msg.ID)
+			counts.synced++
+			if progress != nil {
+				ProgressManager.ProcessEmail(accountID, msg.Subject, true)
+			}
+		}
+
+		// Checkpoint after every page so a failure does not replay applied changes
+		if page.NextLink != "" {
+			state.SyncState = page.NextLink
+		} else {
+			state.SyncState = page.DeltaLink
+		}
+		saveFolderSyncState(state)
+		path = page.NextLink
+	}
+	return nil
+}
+
+// storeMessage archives a Graph message. Its MIME content is streamed into
+// storage through the shared ingest, which applies the oversize policy,
+// hashes it and parses the body and attachments; the JSON document and the
+// index entry are built from that and the message properties.
+func (gs *GraphMailService) storeMessage(ctx context.Context, accountID uuid.UUID, folder string, msg graphMessage) error {
+	content, size, err := gs.client.open(ctx, "/users/"+url.PathEscape(gs.Mailbox)+"/messages/"+url.PathEscape(msg.ID)+"/$value")
+	if err != nil {
+		return stageError(SyncStageFetch, fmt.Errorf("failed to download message: %v", err))
+	}
+	defer content.Close()
+
+	// Sizes Graph reports are checked before the download, others while reading
+	declared := size
+	switch oversizeAction(size) {
+	case OversizeSkip:
+		return stageError(SyncStageFetch, &OversizeError{Size: size, Limit: SyncTuning.MaxMessageBytes})
+	case OversizeTruncate:
+		declared = SyncTuning.MaxMessageBytes
+	}
+	limiter := &messageLimiter{r: content}
+
+	messageID := graphMessageID(accountID, msg.ID)
+	rawPath := fmt.Sprintf("emails/%s/%s.eml", accountID.String(), messageID)
+	raw, scan, err := storeRawMessage(ctx, rawPath, limiter, declared)
+	if limiter.oversize {
+		return stageError(SyncStageFetch, &OversizeError{Size: limiter.read + 1, Limit: SyncTuning.MaxMessageBytes})
+	}
+	if err != nil {
+		return stageError(SyncStageStore, fmt.Errorf("failed to save raw message to MinIO: %v", err))
+	}
+	truncated := declared != size || limiter.truncated
+
+	senderEmail, senderName := "", ""
+	if msg.From != nil {
+		senderEmail, senderName = msg.From.EmailAddress.Address, msg.From.EmailAddress.Name
+	}
+	attachments := make([]types.AttachmentInfo, 0, len(scan.Attachments))
+	attachmentSize := int64(0)
+	for _, attachment := range scan.Attachments {
+		attachments = append(attachments, types.AttachmentInfo{Name: attachment.Filename, Size: attachment.Size, Type: attachment.ContentType})
+		attachmentSize += attachment.Size
+	}
+	bodyText := scan.BodyText()
+
+	emailData := types.ExchangeEmailData{
+		MessageID:   messageID,
+		Subject:     msg.Subject,
+		From:        senderEmail,
+		FromName:    senderName,
+		Date:        msg.ReceivedDateTime,
+		Body:        bodyText,
+		BodyHTML:    scan.HTML,
+		Folder:      folder,
+		Attachments: attachments,
+		Headers: map[string]string{
+			"Message-ID": msg.InternetMessageID,
+			"Subject":    msg.Subject,
+			"From":       fmt.Sprintf("%s <%s>", senderName, senderEmail),
+			"Date":       msg.ReceivedDateTime.Format(time.RFC1123Z),
+			"X-Graph-Id": msg.ID,
+		},
+		Truncated: truncated,
+	}
+	if to := graphAddresses(msg.ToRecipients); len(to) > 0 {
+		emailData.Headers["To"] = strings.Join(to, ", ")
+	}
+	if cc := graphAddresses(msg.CcRecipients); len(cc) > 0 {
+		emailData.Headers["Cc"] = strings.Join(cc, ", ")
+	}
+
+	minioPath := fmt.Sprintf("emails/%s/%s.json", accountID.String(), messageID)
+	doc, err := storage.PutJSONObject(ctx, minioPath, emailData)
+	if err != nil {
+		return stageError(SyncStageStore, fmt.Errorf("failed to save email to MinIO: %v", err))
+	}
+
+	emailIndex := database.EmailIndex{
+		ID:              uuid.New(),
+		AccountID:       accountID,
+		MessageID:       messageID,
+		Subject:         msg.Subject,
+		Date:            msg.ReceivedDateTime,
+		Folder:          folder,
+		MinioPath:       minioPath,
+		RawMinioPath:    raw.Path,
+		SenderEmail:     senderEmail,
+		SenderName:      senderName,
+		Recipients:      normalizeRecipients(append(graphAddresses(msg.ToRecipients), graphAddresses(msg.CcRecipients)...)),
+		IsTruncated:     truncated,
+		ProviderItemID:  msg.ID,
+		IsRead:          msg.IsRead,
+		IsFlagged:       msg.Flag.FlagStatus == "flagged",
+		ContentSHA256:   doc.SHA256,
+		RawSHA256:       raw.SHA256,
+		LockMode:        raw.LockMode,
+		RetainUntil:     raw.RetainUntil, // Written first, so its lock expires first
+		EmailSize:       doc.Size + raw.Size,
+		ContentSize:     int64(len(msg.Subject) + len(bodyText)),
+		AttachmentCount: len(attachments),
+		AttachmentSize:  attachmentSize,
+	}
+	if err := database.DB.Create(&emailIndex).Error; err != nil {
+		return stageError(SyncStageIndex, fmt.Errorf("failed to save email index: %v", err))
+	}
+	return nil
+}
+
+// RetryFailedItems refetches the given failed messages one by one
+func (gs *GraphMailService) RetryFailedItems(accountID uuid.UUID, failures []database.SyncFailure) (int, error) {
+	ctx, err := archiveContext(accountID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prepare archive storage: %v", err)
+	}
+	gs.client.accountID = accountID
+
+	recovered := 0
+	for _, failure := range failures {
+		// The message may have been stored by a later sync in the meantime
+		var existing database.EmailIndex
+		if failure.MessageID != "" && database.DB.Where("message_id = ? AND account_id = ?", failure.MessageID, accountID).First(&existing).Error == nil {
+			FailureTracker.ResolveFailure(accountID, failure.Folder, failure.ProviderItemID)
+			recovered++
+			continue
+		}
+
+		var msg graphMessage
+		path := "/users/" + url.PathEscape(gs.Mailbox) + "/messages/" + url.PathEscape(failure.ProviderItemID) + "?$select=" + graphMessageFields
+		if err := gs.client.get(ctx, path, &msg); err != nil {
+			log.Printf("⚠️  Retry failed to get message %s: %v", failure.Subject, err)
+			FailureTracker.RecordFailure(accountID, failedItemFromRecord(failure), stageError(SyncStageFetch, err))
+			continue
+		}
+		if err := gs.storeMessage(ctx, accountID, failure.Folder, msg); err != nil {
+			log.Printf("❌ Retry failed to store message %s: %v", failure.Subject, err)
+			FailureTracker.RecordFailure(accountID, failedItemFromRecord(failure), err)
+			continue
+		}
+		FailureTracker.ResolveFailure(accountID, failure.Folder, failure.ProviderItemID)
+		recovered++
+		log.Printf("✅ Recovered Graph email on retry: %s", msg.Subject)
+	}
+	return recovered, nil
+}
@@ -0,0 +1,185 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"emailprojectv2/storage"
+
+	"github.com/emersion/go-message/mail"
+)
+
+// Policies for messages larger than SyncTuning.MaxMessageBytes
+const (
+	OversizeSkip     = "skip"     // do not download, record as failed
+	OversizeTruncate = "truncate" // store only the first MaxMessageBytes
+	OversizeStore    = "store"    // store in full regardless of the limit
+)
+
+// maxIndexedTextBytes caps the text body kept in the JSON document; the
+// complete message is always in the raw object
+const maxIndexedTextBytes = 4 << 20
+
+// OversizeError is recorded for messages skipped by the oversize policy
+type OversizeError struct {
+	Size  int64
+	Limit int64
+}
+
+func (e *OversizeError) Error() string {
+	return fmt.Sprintf("message size %d exceeds limit of %d bytes (oversize)", e.Size, e.Limit)
+}
+
+// oversizeAction returns how a message of the given size should be ingested:
+// "" for a normal ingest, otherwise the configured oversize policy
+func oversizeAction(size int64) string {
+	if SyncTuning.MaxMessageBytes <= 0 || size <= SyncTuning.MaxMessageBytes {
+		return ""
+	}
+	return SyncTuning.OversizePolicy
+}
+
+// limitedBuffer keeps the first max bytes written to it and discards the rest
+type limitedBuffer struct {
+	buf bytes.Buffer
+	max int
+}
+
+func (lb *limitedBuffer) Write(p []byte) (int, error) {
+	if remaining := lb.max - lb.buf.Len(); remaining > 0 {
+		if len(p) > remaining {
+			lb.buf.Write(p[:remaining])
+		} else {
+			lb.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// messageLimiter applies the oversize policy to a message stream whose size
+// is not known up front. Under the skip policy reading past MaxMessageBytes
+// fails with an OversizeError; under truncate the stream ends there.
+type messageLimiter struct {
+	r         io.Reader
+	read      int64
+	truncated bool
+	oversize  bool
+}
+
+func (ml *messageLimiter) Read(p []byte) (int, error) {
+	limit := SyncTuning.MaxMessageBytes
+	if limit <= 0 || SyncTuning.OversizePolicy == OversizeStore {
+		return ml.r.Read(p)
+	}
+	if ml.read >= limit {
+		// Anything beyond the limit makes the message oversize
+		var probe [1]byte
+		if n, err := io.ReadFull(ml.r, probe[:]); n == 0 {
+			return 0, err
+		}
+		if SyncTuning.OversizePolicy == OversizeSkip {
+			ml.oversize = true
+			return 0, &OversizeError{Size: ml.read + 1, Limit: limit}
+		}
+		ml.truncated = true
+		return 0, io.EOF
+	}
+	if remaining := limit - ml.read; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := ml.r.Read(p)
+	ml.read += int64(n)
+	return n, err
+}
+
+// messageScan is what is parsed from a raw message while it is stored
+type messageScan struct {
+	Text        string // First text/plain part, or the start of the raw message when it has none
+	HasText     bool
+	HTML        string // First text/html part
+	Attachments []AttachmentData
+}
+
+// BodyText returns the text of the message, converted from HTML when it has no text part
+func (ms *messageScan) BodyText() string {
+	if !ms.HasText && ms.HTML != "" {
+		return htmlToText(ms.HTML)
+	}
+	return ms.Text
+}
+
+// storeRawMessage streams a raw RFC822 message into storage, hashing it on the
+// way, and scans its body and attachments from the same stream. size may be
+// -1 when it is not known.
+func storeRawMessage(ctx context.Context, objectPath string, r io.Reader, size int64) (*storage.StoredObject, messageScan, error) {
+	// The parser reads a copy of everything the upload consumes
+	pr, pw := io.Pipe()
+	scanned := make(chan messageScan, 1)
+	go func() {
+		scanned <- scanRawMessage(pr)
+	}()
+
+	raw, err := storage.PutObjectStream(ctx, objectPath, io.TeeReader(r, pw), size, "message/rfc822")
+	pw.CloseWithError(err)
+	return raw, <-scanned, err
+}
+
+// scanRawMessage reads an RFC822 stream to the end and returns its text and
+// HTML bodies and the name, type and decoded size of its attachments. Only
+// the first maxIndexedTextBytes of a body are kept in memory.
+func scanRawMessage(r io.Reader) messageScan {
+	head := &limitedBuffer{max: maxIndexedTextBytes}
+	tee := io.TeeReader(r, head)
+
+	scan := scanMessageParts(tee)
+
+	// Drain the rest so the writer feeding the stream never blocks
+	io.Copy(io.Discard, tee)
+
+	if !scan.HasText {
+		scan.Text = head.buf.String()
+	}
+	return scan
+}
+
+// scanMessageParts walks the parts of an RFC822 stream
+func scanMessageParts(r io.Reader) messageScan {
+	var scan messageScan
+	mr, err := mail.CreateReader(r)
+	if err != nil {
+		return scan
+	}
+
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			return scan
+		}
+
+		switch h := p.Header.(type) {
+		case *mail.AttachmentHeader:
+			filename, _ := h.Filename()
+			contentType, _, _ := h.ContentType()
+			size, _ := io.Copy(io.Discard, p.Body)
+			scan.Attachments = append(scan.Attachments, AttachmentData{Filename: filename, ContentType: contentType, Size: size})
+		case *mail.InlineHeader:
+			contentType, _, _ := h.ContentType()
+			switch {
+			case contentType == "text/plain" && !scan.HasText:
+				b, err := io.ReadAll(io.LimitReader(p.Body, maxIndexedTextBytes))
+				if err != nil {
+					return scan
+				}
+				scan.Text, scan.HasText = string(b), true
+			case contentType == "text/html" && scan.HTML == "":
+				b, err := io.ReadAll(io.LimitReader(p.Body, maxIndexedTextBytes))
+				if err != nil {
+					return scan
+				}
+				scan.HTML = string(b)
+			}
+		}
+	}
+}
@@ -0,0 +1,520 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"emailprojectv2/config"
+	"emailprojectv2/database"
+	"emailprojectv2/storage"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Integrity discrepancy kinds
+const (
+	IntegrityMissing        = "missing"         // Object no longer in storage
+	IntegrityModified       = "modified"        // Object content differs from its recorded hash
+	IntegrityUnreadable     = "unreadable"      // Object could not be read
+	IntegrityIndexModified  = "index_modified"  // Hash in the index differs from the sealed digest
+	IntegrityDigestMismatch = "digest_mismatch" // Digest entries no longer produce the sealed Merkle root
+	IntegrityChainBroken    = "chain_broken"    // Digest does not link to its predecessor
+)
+
+// ErrIntegrityRunning is returned when a verification is started while another is in progress
+var ErrIntegrityRunning = errors.New("an integrity verification is already in progress")
+
+// IntegrityTuning holds the scheduled verification settings
+var IntegrityTuning = config.IntegrityConfig{VerifyIntervalHours: 24}
+
+// ConfigureIntegrity replaces the scheduled verification settings
+func ConfigureIntegrity(cfg config.IntegrityConfig) {
+	if cfg.VerifyIntervalHours < 1 {
+		cfg.VerifyIntervalHours = 24
+	}
+	IntegrityTuning = cfg
+	log.Printf("🔏 Integrity verification every %dh", cfg.VerifyIntervalHours)
+}
+
+// dayStart truncates a time to the start of its UTC day
+func dayStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// digestLeaf hashes one object entry of a digest
+func digestLeaf(entry *database.IntegrityDigestEntry) []byte {
+	sum := sha256.Sum256([]byte(entry.EmailID.String() + "\n" + entry.ObjectPath + "\n" + entry.SHA256))
+	return sum[:]
+}
+
+// sortDigestEntries puts entries in the order their leaves are hashed
+func sortDigestEntries(entries []database.IntegrityDigestEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i].EmailID.String(), entries[j].EmailID.String()
+		if a != b {
+			return a < b
+		}
+		return entries[i].ObjectPath < entries[j].ObjectPath
+	})
+}
+
+// merkleRoot computes the root of a binary Merkle tree over the entries. An odd
+// node at any level is paired with itself.
+func merkleRoot(entries []database.IntegrityDigestEntry) string {
+	if len(entries) == 0 {
+		sum := sha256.Sum256(nil)
+		return hex.EncodeToString(sum[:])
+	}
+
+	level := make([][]byte, len(entries))
+	for i := range entries {
+		level[i] = digestLeaf(&entries[i])
+	}
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			right := level[i]
+			if i+1 < len(level) {
+				right = level[i+1]
+			}
+			sum := sha256.Sum256(append(append([]byte{}, level[i]...), right...))
+			next = append(next, sum[:])
+		}
+		level = next
+	}
+	return hex.EncodeToString(level[0])
+}
+
+// digestChainHash links a digest to its predecessor
+func digestChainHash(digest *database.IntegrityDigest) string {
+	payload := fmt.Sprintf("%s|%s|%s|%s|%d", digest.PrevChainHash, digest.AccountID, digest.Day.Format("2006-01-02"), digest.MerkleRoot, digest.ObjectCount)
+	sum := sha256.Sum256([]byte(payload))
+	return hex.EncodeToString(sum[:])
+}
+
+// IntegrityVerifier seals daily digests and re-verifies the archive. Only one
+// verification runs at a time.
+type IntegrityVerifier struct {
+	mu      sync.Mutex
+	running bool
+}
+
+// Integrity is the shared verifier used by the scheduler and the API
+var Integrity = &IntegrityVerifier{}
+
+// Run seals pending digests and verifies every account, waiting for the result
+func (iv *IntegrityVerifier) Run(triggeredBy *uuid.UUID) (*database.IntegrityRun, error) {
+	run, err := iv.begin(triggeredBy)
+	if err != nil {
+		return nil, err
+	}
+	return run, iv.finish(run, iv.execute(run))
+}
+
+// Start begins a verification in the background and returns its record immediately
+func (iv *IntegrityVerifier) Start(triggeredBy *uuid.UUID) (*database.IntegrityRun, error) {
+	run, err := iv.begin(triggeredBy)
+	if err != nil {
+		return nil, err
+	}
+	go iv.finish(run, iv.execute(run))
+	return run, nil
+}
+
+func (iv *IntegrityVerifier) begin(triggeredBy *uuid.UUID) (*database.IntegrityRun, error) {
+	iv.mu.Lock()
+	defer iv.mu.Unlock()
+	if iv.running {
+		return nil, ErrIntegrityRunning
+	}
+
+	run := &database.IntegrityRun{
+		TriggeredBy: triggeredBy,
+		Status:      "running",
+		StartedAt:   time.Now(),
+	}
+	if err := database.DB.Create(run).Error; err != nil {
+		return nil, fmt.Errorf("failed to create integrity run: %v", err)
+	}
+	iv.running = true
+	return run, nil
+}
+
+func (iv *IntegrityVerifier) finish(run *database.IntegrityRun, runErr error) error {
+	iv.mu.Lock()
+	iv.running = false
+	iv.mu.Unlock()
+
+	now := time.Now()
+	run.CompletedAt = &now
+	run.Status = "completed"
+	result := AuditResultSuccess
+	if runErr != nil {
+		run.Status = "failed"
+		run.ErrorMessage = runErr.Error()
+		result = AuditResultFailure
+	} else if run.Discrepancies > 0 {
+		result = AuditResultFailure
+	}
+
+	if err := database.DB.Save(run).Error; err != nil {
+		log.Printf("⚠️ Failed to save integrity run %s: %v", run.ID, err)
+	}
+
+	RecordAudit(database.AuditEvent{
+		ActorID:    run.TriggeredBy,
+		Action:     "integrity.verify",
+		TargetType: "integrity_run",
+		TargetID:   run.ID.String(),
+		Result:     result,
+		Detail:     fmt.Sprintf("%d digests sealed, %d digests and %d objects checked, %d discrepancies", run.DigestsSealed, run.DigestsChecked, run.ObjectsChecked, run.Discrepancies),
+	})
+
+	if runErr != nil {
+		log.Printf("❌ Integrity run %s failed: %v", run.ID, runErr)
+	} else {
+		log.Printf("✅ Integrity run %s completed: %d objects checked, %d discrepancies", run.ID, run.ObjectsChecked, run.Discrepancies)
+	}
+	return runErr
+}
+
+// execute seals and verifies every account
+func (iv *IntegrityVerifier) execute(run *database.IntegrityRun) error {
+	var accountIDs []uuid.UUID
+	if err := database.DB.Model(&database.EmailAccount{}).Pluck("id", &accountIDs).Error; err != nil {
+		return fmt.Errorf("failed to load accounts: %v", err)
+	}
+
+	ctx := context.Background()
+	for _, accountID := range accountIDs {
+		check := &accountCheck{run: run, accountID: accountID}
+		check.orgID, _ = AccountOrganizationID(accountID)
+
+		// One broken account must not stop the verification of everyone else
+		if err := check.seal(ctx); err != nil {
+			log.Printf("⚠️ Failed to seal digests for account %s: %v", accountID, err)
+		}
+		if err := check.verifyDigests(); err != nil {
+			log.Printf("⚠️ Failed to verify digests for account %s: %v", accountID, err)
+		}
+		if err := check.verifyObjects(ctx); err != nil {
+			log.Printf("⚠️ Failed to verify objects for account %s: %v", accountID, err)
+		}
+	}
+	return nil
+}
+
+// accountCheck is the verification state of one account within a run
+type accountCheck struct {
+	run       *database.IntegrityRun
+	accountID uuid.UUID
+	orgID     *uuid.UUID
+}
+
+// report records a discrepancy and writes it to the audit log
+func (ac *accountCheck) report(d database.IntegrityDiscrepancy) {
+	d.RunID = ac.run.ID
+	d.AccountID = ac.accountID
+	if err := database.DB.Create(&d).Error; err != nil {
+		log.Printf("⚠️ Failed to record integrity discrepancy: %v", err)
+	}
+	ac.run.Discrepancies++
+
+	target, targetID := "account", ac.accountID.String()
+	if d.EmailID != nil {
+		target, targetID = "email", d.EmailID.String()
+	} else if d.DigestID != nil {
+		target, targetID = "integrity_digest", d.DigestID.String()
+	}
+	RecordAudit(database.AuditEvent{
+		OrganizationID: ac.orgID,
+		Action:         "integrity.discrepancy",
+		TargetType:     target,
+		TargetID:       targetID,
+		Result:         AuditResultFailure,
+		Detail:         fmt.Sprintf("%s: %s %s", d.Kind, d.ObjectPath, d.Detail),
+	})
+	log.Printf("🚨 Integrity discrepancy (%s) in account %s: %s", d.Kind, ac.accountID, d.ObjectPath)
+}
+
+// objectError reports a failure to read an object
+func (ac *accountCheck) objectError(email *database.EmailIndex, objectPath, expected string, err error) {
+	kind := IntegrityUnreadable
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		kind = IntegrityMissing
+	}
+	ac.report(database.IntegrityDiscrepancy{
+		EmailID:    &email.ID,
+		ObjectPath: objectPath,
+		Kind:       kind,
+		Expected:   expected,
+		Detail:     err.Error(),
+	})
+}
+
+// seal creates the digests of every completed day since the account's last digest
+func (ac *accountCheck) seal(ctx context.Context) error {
+	prevChain := ""
+	var from time.Time
+
+	var last database.IntegrityDigest
+	err := database.DB.Where("account_id = ?", ac.accountID).Order("day DESC").First(&last).Error
+	switch {
+	case err == nil:
+		prevChain = last.ChainHash
+		from = dayStart(last.Day).AddDate(0, 0, 1)
+	case errors.Is(err, gorm.ErrRecordNotFound):
+	default:
+		return fmt.Errorf("failed to load last digest: %v", err)
+	}
+
+	// Only whole days are sealed, so nothing can be added to a digest afterwards
+	today := dayStart(time.Now())
+	for day := from; day.Before(today); day = day.AddDate(0, 0, 1) {
+		// Skip ahead to the next day with archived emails
+		var next database.EmailIndex
+		err := database.DB.Select("created_at").
+			Where("account_id = ? AND created_at >= ? AND created_at < ?", ac.accountID, day, today).
+			Order("created_at ASC").First(&next).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to find emails to seal: %v", err)
+		}
+		day = dayStart(next.CreatedAt)
+
+		digest, err := ac.sealDay(ctx, day, prevChain)
+		if err != nil {
+			return err
+		}
+		prevChain = digest.ChainHash
+	}
+	return nil
+}
+
+// sealDay builds the digest of the objects archived on one day
+func (ac *accountCheck) sealDay(ctx context.Context, day time.Time, prevChain string) (*database.IntegrityDigest, error) {
+	var emails []database.EmailIndex
+	if err := database.DB.Where("account_id = ? AND created_at >= ? AND created_at < ?", ac.accountID, day, day.AddDate(0, 0, 1)).
+		Find(&emails).Error; err != nil {
+		return nil, fmt.Errorf("failed to load emails for %s: %v", day.Format("2006-01-02"), err)
+	}
+
+	digest := &database.IntegrityDigest{
+		ID:            uuid.New(),
+		AccountID:     ac.accountID,
+		Day:           day,
+		EmailCount:    len(emails),
+		PrevChainHash: prevChain,
+	}
+
+	var entries []database.IntegrityDigestEntry
+	for i := range emails {
+		email := &emails[i]
+		ac.backfillHashes(ctx, email)
+		for _, obj := range [][2]string{{email.MinioPath, email.ContentSHA256}, {email.RawMinioPath, email.RawSHA256}} {
+			if obj[0] == "" || obj[1] == "" {
+				continue
+			}
+			entries = append(entries, database.IntegrityDigestEntry{
+				DigestID:   digest.ID,
+				EmailID:    email.ID,
+				ObjectPath: obj[0],
+				SHA256:     obj[1],
+			})
+		}
+	}
+	sortDigestEntries(entries)
+
+	digest.ObjectCount = len(entries)
+	digest.MerkleRoot = merkleRoot(entries)
+	digest.ChainHash = digestChainHash(digest)
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(digest).Error; err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return tx.CreateInBatches(entries, 500).Error
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to save digest for %s: %v", day.Format("2006-01-02"), err)
+	}
+
+	ac.run.DigestsSealed++
+	return digest, nil
+}
+
+// backfillHashes records the hashes of objects archived before hashes were
+// kept, so they can be sealed. Unreadable objects are reported and left out.
+func (ac *accountCheck) backfillHashes(ctx context.Context, email *database.EmailIndex) {
+	updates := map[string]interface{}{}
+	if email.MinioPath != "" && email.ContentSHA256 == "" {
+		if obj, err := storage.HashObject(ctx, email.MinioPath); err != nil {
+			ac.objectError(email, email.MinioPath, "", err)
+		} else {
+			email.ContentSHA256 = obj.SHA256
+			updates["content_sha256"] = obj.SHA256
+		}
+	}
+	if email.RawMinioPath != "" && email.RawSHA256 == "" {
+		if obj, err := storage.HashObject(ctx, email.RawMinioPath); err != nil {
+			ac.objectError(email, email.RawMinioPath, "", err)
+		} else {
+			email.RawSHA256 = obj.SHA256
+			updates["raw_sha256"] = obj.SHA256
+		}
+	}
+	if len(updates) == 0 {
+		return
+	}
+
+	if err := database.DB.Model(email).Updates(updates).Error; err != nil {
+		log.Printf("⚠️ Failed to record hashes for email %s: %v", email.ID, err)
+		return
+	}
+	ac.run.HashesBackfilled += len(updates)
+}
+
+// verifyDigests walks the account's digest chain, recomputing every Merkle
+// root and chain hash and comparing the sealed hashes with the index
+func (ac *accountCheck) verifyDigests() error {
+	var digests []database.IntegrityDigest
+	if err := database.DB.Where("account_id = ?", ac.accountID).Order("day ASC").Find(&digests).Error; err != nil {
+		return fmt.Errorf("failed to load digests: %v", err)
+	}
+
+	prevChain := ""
+	for i := range digests {
+		digest := &digests[i]
+		ac.run.DigestsChecked++
+
+		if digest.PrevChainHash != prevChain {
+			ac.report(database.IntegrityDiscrepancy{
+				DigestID: &digest.ID,
+				Kind:     IntegrityChainBroken,
+				Expected: prevChain,
+				Actual:   digest.PrevChainHash,
+				Detail:   fmt.Sprintf("digest of %s does not link to the previous digest", digest.Day.Format("2006-01-02")),
+			})
+		}
+		if chain := digestChainHash(digest); chain != digest.ChainHash {
+			ac.report(database.IntegrityDiscrepancy{
+				DigestID: &digest.ID,
+				Kind:     IntegrityChainBroken,
+				Expected: digest.ChainHash,
+				Actual:   chain,
+				Detail:   fmt.Sprintf("chain hash of %s does not match its contents", digest.Day.Format("2006-01-02")),
+			})
+		}
+		prevChain = digest.ChainHash
+
+		var entries []database.IntegrityDigestEntry
+		if err := database.DB.Where("digest_id = ?", digest.ID).Find(&entries).Error; err != nil {
+			return fmt.Errorf("failed to load digest entries: %v", err)
+		}
+		sortDigestEntries(entries)
+		if root := merkleRoot(entries); root != digest.MerkleRoot || len(entries) != digest.ObjectCount {
+			ac.report(database.IntegrityDiscrepancy{
+				DigestID: &digest.ID,
+				Kind:     IntegrityDigestMismatch,
+				Expected: digest.MerkleRoot,
+				Actual:   root,
+				Detail:   fmt.Sprintf("%d of %d sealed entries present for %s", len(entries), digest.ObjectCount, digest.Day.Format("2006-01-02")),
+			})
+		}
+
+		if err := ac.compareIndex(digest, entries); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compareIndex checks that the index still records the sealed hashes. Emails
+// removed since sealing (retention, account cleanup) are not reported.
+func (ac *accountCheck) compareIndex(digest *database.IntegrityDigest, entries []database.IntegrityDigestEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	emailIDs := make([]uuid.UUID, 0, len(entries))
+	for _, entry := range entries {
+		emailIDs = append(emailIDs, entry.EmailID)
+	}
+
+	var emails []database.EmailIndex
+	if err := database.DB.Select("id", "minio_path", "raw_minio_path", "content_sha256", "raw_sha256").
+		Where("id IN ?", emailIDs).Find(&emails).Error; err != nil {
+		return fmt.Errorf("failed to load emails of digest: %v", err)
+	}
+	current := make(map[string]string, len(emails)*2)
+	for _, email := range emails {
+		current[email.ID.String()+"\n"+email.MinioPath] = email.ContentSHA256
+		current[email.ID.String()+"\n"+email.RawMinioPath] = email.RawSHA256
+	}
+
+	for i := range entries {
+		entry := &entries[i]
+		hash, ok := current[entry.EmailID.String()+"\n"+entry.ObjectPath]
+		if !ok || hash == entry.SHA256 {
+			continue
+		}
+		ac.report(database.IntegrityDiscrepancy{
+			EmailID:    &entry.EmailID,
+			DigestID:   &digest.ID,
+			ObjectPath: entry.ObjectPath,
+			Kind:       IntegrityIndexModified,
+			Expected:   entry.SHA256,
+			Actual:     hash,
+		})
+	}
+	return nil
+}
+
+// verifyObjects re-reads every stored object of the account and compares it
+// with the hash recorded at write time
+func (ac *accountCheck) verifyObjects(ctx context.Context) error {
+	var batch []database.EmailIndex
+	result := database.DB.Select("id", "account_id", "minio_path", "raw_minio_path", "content_sha256", "raw_sha256").
+		Where("account_id = ?", ac.accountID).
+		FindInBatches(&batch, 500, func(tx *gorm.DB, _ int) error {
+			for i := range batch {
+				email := &batch[i]
+				for _, obj := range [][2]string{{email.MinioPath, email.ContentSHA256}, {email.RawMinioPath, email.RawSHA256}} {
+					if obj[0] == "" || obj[1] == "" {
+						continue
+					}
+					ac.run.ObjectsChecked++
+
+					stored, err := storage.HashObject(ctx, obj[0])
+					if err != nil {
+						ac.objectError(email, obj[0], obj[1], err)
+						continue
+					}
+					if stored.SHA256 != obj[1] {
+						ac.report(database.IntegrityDiscrepancy{
+							EmailID:    &email.ID,
+							ObjectPath: obj[0],
+							Kind:       IntegrityModified,
+							Expected:   obj[1],
+							Actual:     stored.SHA256,
+						})
+					}
+				}
+			}
+			return nil
+		})
+	return result.Error
+}
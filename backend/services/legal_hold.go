@@ -0,0 +1,428 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"emailprojectv2/database"
+	"emailprojectv2/storage"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Legal hold targets, statuses and audit actions
+const (
+	HoldTargetOrganization = "organization"
+	HoldTargetUser         = "user"
+	HoldTargetAccount      = "account"
+	HoldTargetSearch       = "search"
+
+	HoldStatusActive   = "active"
+	HoldStatusReleased = "released"
+
+	HoldEventCreated           = "created"
+	HoldEventUpdated           = "updated"
+	HoldEventCustodiansUpdated = "custodians_updated"
+	HoldEventObjectLockApplied = "object_lock_applied"
+	HoldEventObjectLockFailed  = "object_lock_failed"
+	HoldEventReleased          = "released"
+)
+
+// HoldSearchCriteria is the saved query of a search hold. Every non-empty field
+// must match; text fields match case-insensitively as substrings.
+type HoldSearchCriteria struct {
+	AccountIDs []uuid.UUID `json:"account_ids,omitempty"`
+	Sender     string      `json:"sender,omitempty"`
+	Subject    string      `json:"subject,omitempty"`
+	Folder     string      `json:"folder,omitempty"`
+	DateFrom   *time.Time  `json:"date_from,omitempty"`
+	DateTo     *time.Time  `json:"date_to,omitempty"`
+}
+
+// IsEmpty reports whether the criteria would match every email
+func (q HoldSearchCriteria) IsEmpty() bool {
+	return len(q.AccountIDs) == 0 && q.Sender == "" && q.Subject == "" && q.Folder == "" && q.DateFrom == nil && q.DateTo == nil
+}
+
+// apply adds the criteria (except the account list) to an email_indices query
+func (q HoldSearchCriteria) apply(query *gorm.DB) *gorm.DB {
+	if q.Sender != "" {
+		pattern := "%" + q.Sender + "%"
+		query = query.Where("sender_email ILIKE ? OR sender_name ILIKE ?", pattern, pattern)
+	}
+	if q.Subject != "" {
+		query = query.Where("subject ILIKE ?", "%"+q.Subject+"%")
+	}
+	if q.Folder != "" {
+		query = query.Where("folder = ?", q.Folder)
+	}
+	if q.DateFrom != nil {
+		query = query.Where("date >= ?", *q.DateFrom)
+	}
+	if q.DateTo != nil {
+		query = query.Where("date <= ?", *q.DateTo)
+	}
+	return query
+}
+
+// matches evaluates the criteria (except the account list) against a loaded email
+func (q HoldSearchCriteria) matches(email *database.EmailIndex) bool {
+	if q.Sender != "" {
+		sender := strings.ToLower(q.Sender)
+		if !strings.Contains(strings.ToLower(email.SenderEmail), sender) && !strings.Contains(strings.ToLower(email.SenderName), sender) {
+			return false
+		}
+	}
+	if q.Subject != "" && !strings.Contains(strings.ToLower(email.Subject), strings.ToLower(q.Subject)) {
+		return false
+	}
+	if q.Folder != "" && email.Folder != q.Folder {
+		return false
+	}
+	if q.DateFrom != nil && email.Date.Before(*q.DateFrom) {
+		return false
+	}
+	if q.DateTo != nil && email.Date.After(*q.DateTo) {
+		return false
+	}
+	return true
+}
+
+// ParseHoldSearch decodes the saved query of a search hold
+func ParseHoldSearch(raw string) (HoldSearchCriteria, error) {
+	var criteria HoldSearchCriteria
+	if raw == "" {
+		return criteria, nil
+	}
+	if err := json.Unmarshal([]byte(raw), &criteria); err != nil {
+		return criteria, fmt.Errorf("failed to parse hold search query: %v", err)
+	}
+	return criteria, nil
+}
+
+// holdAccountIDs returns the email accounts a hold reaches. For search holds
+// the result is nil when the search is not limited to particular accounts.
+func holdAccountIDs(hold *database.LegalHold) ([]uuid.UUID, error) {
+	switch hold.TargetType {
+	case HoldTargetOrganization:
+		if hold.OrganizationID == nil {
+			return nil, fmt.Errorf("organization hold %s has no organization", hold.ID)
+		}
+		return OrganizationAccountIDs(*hold.OrganizationID)
+	case HoldTargetUser:
+		if hold.UserID == nil {
+			return nil, fmt.Errorf("user hold %s has no user", hold.ID)
+		}
+		var ids []uuid.UUID
+		if err := database.DB.Model(&database.EmailAccount{}).Where("user_id = ?", *hold.UserID).Pluck("id", &ids).Error; err != nil {
+			return nil, fmt.Errorf("failed to load user accounts: %v", err)
+		}
+		return ids, nil
+	case HoldTargetAccount:
+		if hold.AccountID == nil {
+			return nil, fmt.Errorf("account hold %s has no account", hold.ID)
+		}
+		return []uuid.UUID{*hold.AccountID}, nil
+	case HoldTargetSearch:
+		criteria, err := ParseHoldSearch(hold.SearchQuery)
+		if err != nil {
+			return nil, err
+		}
+		var ids []uuid.UUID
+		if hold.OrganizationID != nil {
+			if ids, err = OrganizationAccountIDs(*hold.OrganizationID); err != nil {
+				return nil, err
+			}
+			if len(criteria.AccountIDs) > 0 {
+				ids = intersectIDs(ids, criteria.AccountIDs)
+			}
+			return ids, nil
+		}
+		if len(criteria.AccountIDs) > 0 {
+			return criteria.AccountIDs, nil
+		}
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown hold target type %q", hold.TargetType)
+}
+
+func intersectIDs(a, b []uuid.UUID) []uuid.UUID {
+	set := make(map[uuid.UUID]bool, len(b))
+	for _, id := range b {
+		set[id] = true
+	}
+	result := []uuid.UUID{}
+	for _, id := range a {
+		if set[id] {
+			result = append(result, id)
+		}
+	}
+	return result
+}
+
+// holdEmailQuery selects the emails covered by a single hold
+func holdEmailQuery(hold *database.LegalHold) (*gorm.DB, error) {
+	accountIDs, err := holdAccountIDs(hold)
+	if err != nil {
+		return nil, err
+	}
+
+	query := database.DB.Model(&database.EmailIndex{})
+	if hold.TargetType != HoldTargetSearch || accountIDs != nil {
+		if len(accountIDs) == 0 {
+			return query.Where("1 = 0"), nil
+		}
+		query = query.Where("account_id IN ?", accountIDs)
+	}
+	if hold.TargetType == HoldTargetSearch {
+		criteria, err := ParseHoldSearch(hold.SearchQuery)
+		if err != nil {
+			return nil, err
+		}
+		query = criteria.apply(query)
+	}
+	return query, nil
+}
+
+// heldSearch is a search hold resolved for matching
+type heldSearch struct {
+	holdID   uuid.UUID
+	criteria HoldSearchCriteria
+	accounts map[uuid.UUID]bool // nil when the search spans all accounts
+}
+
+func (hs *heldSearch) coversAccount(accountID uuid.UUID) bool {
+	return hs.accounts == nil || hs.accounts[accountID]
+}
+
+// HoldSet is a snapshot of every active legal hold, resolved to the accounts
+// and users it protects. Load it once per operation rather than per email.
+type HoldSet struct {
+	accounts map[uuid.UUID]bool // Held entirely by an organization, user or account hold
+	users    map[uuid.UUID]bool // Held by an organization or user hold
+	searches []heldSearch
+}
+
+// LoadActiveHolds resolves all active legal holds
+func LoadActiveHolds() (*HoldSet, error) {
+	return loadHolds(uuid.Nil)
+}
+
+// loadHolds resolves the active legal holds, leaving out the given hold
+func loadHolds(exclude uuid.UUID) (*HoldSet, error) {
+	var holds []database.LegalHold
+	if err := database.DB.Where("status = ? AND id <> ?", HoldStatusActive, exclude).Find(&holds).Error; err != nil {
+		return nil, fmt.Errorf("failed to load legal holds: %v", err)
+	}
+
+	set := &HoldSet{accounts: map[uuid.UUID]bool{}, users: map[uuid.UUID]bool{}}
+	for i := range holds {
+		hold := &holds[i]
+		accountIDs, err := holdAccountIDs(hold)
+		if err != nil {
+			return nil, err
+		}
+
+		switch hold.TargetType {
+		case HoldTargetSearch:
+			criteria, err := ParseHoldSearch(hold.SearchQuery)
+			if err != nil {
+				return nil, err
+			}
+			search := heldSearch{holdID: hold.ID, criteria: criteria}
+			if accountIDs != nil {
+				search.accounts = make(map[uuid.UUID]bool, len(accountIDs))
+				for _, id := range accountIDs {
+					search.accounts[id] = true
+				}
+			}
+			set.searches = append(set.searches, search)
+			continue
+		case HoldTargetUser:
+			set.users[*hold.UserID] = true
+		case HoldTargetOrganization:
+			orgIDs, err := OrganizationSubtree(*hold.OrganizationID)
+			if err != nil {
+				return nil, err
+			}
+			userIDs, err := OrganizationUserIDs(orgIDs)
+			if err != nil {
+				return nil, err
+			}
+			for _, id := range userIDs {
+				set.users[id] = true
+			}
+		}
+		for _, id := range accountIDs {
+			set.accounts[id] = true
+		}
+	}
+	return set, nil
+}
+
+// Covers reports whether an email is under any active hold
+func (hs *HoldSet) Covers(email *database.EmailIndex) bool {
+	if hs.accounts[email.AccountID] {
+		return true
+	}
+	for i := range hs.searches {
+		search := &hs.searches[i]
+		if search.coversAccount(email.AccountID) && search.criteria.matches(email) {
+			return true
+		}
+	}
+	return false
+}
+
+// AccountHeld reports whether an account, or any email in it, is under an active hold
+func (hs *HoldSet) AccountHeld(accountID uuid.UUID) (bool, error) {
+	if hs.accounts[accountID] {
+		return true, nil
+	}
+	for i := range hs.searches {
+		search := &hs.searches[i]
+		if !search.coversAccount(accountID) {
+			continue
+		}
+		var count int64
+		query := search.criteria.apply(database.DB.Model(&database.EmailIndex{}).Where("account_id = ?", accountID))
+		if err := query.Count(&count).Error; err != nil {
+			return false, fmt.Errorf("failed to evaluate legal hold %s: %v", search.holdID, err)
+		}
+		if count > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// UserHeld reports whether a user, or any of their accounts, is under an active hold
+func (hs *HoldSet) UserHeld(userID uuid.UUID) (bool, error) {
+	if hs.users[userID] {
+		return true, nil
+	}
+
+	var accountIDs []uuid.UUID
+	if err := database.DB.Model(&database.EmailAccount{}).Where("user_id = ?", userID).Pluck("id", &accountIDs).Error; err != nil {
+		return false, fmt.Errorf("failed to load user accounts: %v", err)
+	}
+	for _, accountID := range accountIDs {
+		held, err := hs.AccountHeld(accountID)
+		if err != nil || held {
+			return held, err
+		}
+	}
+	return false, nil
+}
+
+// RecordHoldEvent appends an entry to a legal hold's audit trail
+func RecordHoldEvent(holdID uuid.UUID, action string, actorID *uuid.UUID, detail string) {
+	event := database.LegalHoldEvent{
+		HoldID:  holdID,
+		Action:  action,
+		ActorID: actorID,
+		Detail:  detail,
+	}
+	if err := database.DB.Create(&event).Error; err != nil {
+		log.Printf("⚠️ Failed to record %s event for legal hold %s: %v", action, holdID, err)
+	}
+}
+
+// ApplyHoldObjectLock sets the MinIO legal hold on every object covered by a
+// hold, when the bucket supports object locking. Emails archived after the
+// hold was placed are still protected from purges and deletion by the database
+// checks, just not at the storage layer.
+func ApplyHoldObjectLock(hold *database.LegalHold) {
+	ctx := context.Background()
+	if !storage.ObjectLockEnabled(ctx) {
+		log.Printf("ℹ️ Object locking not enabled on bucket %s, legal hold %s is enforced by the application only", storage.EmailBucket, hold.ID)
+		return
+	}
+
+	query, err := holdEmailQuery(hold)
+	if err != nil {
+		RecordHoldEvent(hold.ID, HoldEventObjectLockFailed, nil, err.Error())
+		return
+	}
+
+	locked, failed := 0, 0
+	var batch []database.EmailIndex
+	result := query.Select("id", "minio_path", "raw_minio_path").FindInBatches(&batch, 500, func(tx *gorm.DB, _ int) error {
+		for _, email := range batch {
+			for _, objectPath := range []string{email.MinioPath, email.RawMinioPath} {
+				if objectPath == "" {
+					continue
+				}
+				if err := storage.SetObjectLegalHold(ctx, objectPath, true); err != nil {
+					log.Printf("⚠️ Failed to set legal hold on %s: %v", objectPath, err)
+					failed++
+					continue
+				}
+				locked++
+			}
+		}
+		return nil
+	})
+	if result.Error != nil {
+		RecordHoldEvent(hold.ID, HoldEventObjectLockFailed, nil, result.Error.Error())
+		return
+	}
+
+	if err := database.DB.Model(hold).Update("object_lock_applied", true).Error; err != nil {
+		log.Printf("⚠️ Failed to update legal hold %s: %v", hold.ID, err)
+	}
+	RecordHoldEvent(hold.ID, HoldEventObjectLockApplied, nil, fmt.Sprintf("%d objects locked, %d failed", locked, failed))
+	log.Printf("🔒 Legal hold %s applied to %d objects (%d failed)", hold.ID, locked, failed)
+}
+
+// ReleaseHoldObjectLock lifts the MinIO legal hold from the objects of a
+// released hold, except those another active hold still covers
+func ReleaseHoldObjectLock(hold *database.LegalHold) {
+	if !hold.ObjectLockApplied {
+		return
+	}
+	ctx := context.Background()
+
+	remaining, err := loadHolds(hold.ID)
+	if err != nil {
+		log.Printf("⚠️ Failed to load remaining legal holds, keeping objects of hold %s locked: %v", hold.ID, err)
+		return
+	}
+	query, err := holdEmailQuery(hold)
+	if err != nil {
+		log.Printf("⚠️ Failed to resolve legal hold %s: %v", hold.ID, err)
+		return
+	}
+
+	unlocked := 0
+	var batch []database.EmailIndex
+	result := query.FindInBatches(&batch, 500, func(tx *gorm.DB, _ int) error {
+		for i := range batch {
+			email := &batch[i]
+			if remaining.Covers(email) {
+				continue
+			}
+			for _, objectPath := range []string{email.MinioPath, email.RawMinioPath} {
+				if objectPath == "" {
+					continue
+				}
+				if err := storage.SetObjectLegalHold(ctx, objectPath, false); err != nil {
+					log.Printf("⚠️ Failed to lift legal hold on %s: %v", objectPath, err)
+					continue
+				}
+				unlocked++
+			}
+		}
+		return nil
+	})
+	if result.Error != nil {
+		log.Printf("⚠️ Failed to release objects of legal hold %s: %v", hold.ID, result.Error)
+		return
+	}
+	log.Printf("🔓 Legal hold %s lifted from %d objects", hold.ID, unlocked)
+}
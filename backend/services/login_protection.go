@@ -0,0 +1,186 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"emailprojectv2/database"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Errors for logins refused before the password is checked
+var (
+	ErrLoginRateLimited = errors.New("too many failed logins from this address")
+	ErrAccountLocked    = errors.New("account is temporarily locked after too many failed logins")
+)
+
+// LoginBlockedError is a refused login and when it can be tried again
+type LoginBlockedError struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (e *LoginBlockedError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *LoginBlockedError) Unwrap() error {
+	return e.Err
+}
+
+// ipFailures tracks recent failed logins per client IP address. It is kept in
+// memory, so every instance of the backend limits the addresses it sees.
+var ipFailures = struct {
+	sync.Mutex
+	byIP      map[string][]time.Time
+	lastPrune time.Time
+}{byIP: map[string][]time.Time{}}
+
+// recentIPFailures returns the failures of an address within the window,
+// dropping older ones. The caller holds the lock.
+func recentIPFailures(ip string, now time.Time) []time.Time {
+	window := time.Duration(PasswordSettings.IPWindowMinutes) * time.Minute
+	if now.Sub(ipFailures.lastPrune) > window {
+		for addr, times := range ipFailures.byIP {
+			if len(times) == 0 || now.Sub(times[len(times)-1]) > window {
+				delete(ipFailures.byIP, addr)
+			}
+		}
+		ipFailures.lastPrune = now
+	}
+
+	times := ipFailures.byIP[ip]
+	kept := times[:0]
+	for _, t := range times {
+		if now.Sub(t) <= window {
+			kept = append(kept, t)
+		}
+	}
+	if len(kept) == 0 {
+		delete(ipFailures.byIP, ip)
+	} else {
+		ipFailures.byIP[ip] = kept
+	}
+	return kept
+}
+
+// CheckIPAllowed returns a *LoginBlockedError when an address has failed too
+// many logins within the window
+func CheckIPAllowed(ip string) error {
+	now := time.Now()
+	ipFailures.Lock()
+	defer ipFailures.Unlock()
+
+	times := recentIPFailures(ip, now)
+	if len(times) < PasswordSettings.IPMaxFailures {
+		return nil
+	}
+	// Blocked until enough failures have left the window
+	window := time.Duration(PasswordSettings.IPWindowMinutes) * time.Minute
+	oldest := times[len(times)-PasswordSettings.IPMaxFailures]
+	return &LoginBlockedError{Err: ErrLoginRateLimited, RetryAfter: oldest.Add(window).Sub(now)}
+}
+
+// CheckLoginAllowed returns a *LoginBlockedError when a login from an
+// address, or to a user's account, must be refused without checking the
+// password. user is nil for unknown emails.
+func CheckLoginAllowed(ip string, user *database.User) error {
+	if err := CheckIPAllowed(ip); err != nil {
+		return err
+	}
+	if user != nil && user.LockedUntil != nil {
+		if wait := time.Until(*user.LockedUntil); wait > 0 {
+			return &LoginBlockedError{Err: ErrAccountLocked, RetryAfter: wait}
+		}
+	}
+	return nil
+}
+
+// RecordIPFailure counts a failed attempt from an address
+func RecordIPFailure(ip string) {
+	now := time.Now()
+	ipFailures.Lock()
+	ipFailures.byIP[ip] = append(recentIPFailures(ip, now), now)
+	ipFailures.Unlock()
+}
+
+// lockoutDuration is how long an account stays locked after its failed
+// logins reach count. The lockout doubles with every failure past the
+// threshold, up to the maximum.
+func lockoutDuration(count int) time.Duration {
+	over := count - PasswordSettings.LockoutThreshold
+	if over < 0 {
+		return 0
+	}
+	maxLockout := time.Duration(PasswordSettings.MaxLockoutMinutes) * time.Minute
+	lockout := time.Duration(PasswordSettings.LockoutMinutes) * time.Minute
+	for i := 0; i < over && lockout < maxLockout; i++ {
+		lockout *= 2
+	}
+	if lockout > maxLockout {
+		lockout = maxLockout
+	}
+	return lockout
+}
+
+// RecordLoginFailure counts a failed login from an address and, for known
+// users, against their account, locking it once the threshold is reached.
+// It returns when the account is locked until, if it is.
+func RecordLoginFailure(ip string, user *database.User) (*time.Time, error) {
+	RecordIPFailure(ip)
+	if user == nil {
+		return nil, nil
+	}
+
+	var lockedUntil *time.Time
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&database.User{}).Where("id = ?", user.ID).
+			UpdateColumn("failed_login_count", gorm.Expr("failed_login_count + 1")).Error; err != nil {
+			return err
+		}
+		var count int
+		if err := tx.Model(&database.User{}).Where("id = ?", user.ID).Select("failed_login_count").Scan(&count).Error; err != nil {
+			return err
+		}
+		user.FailedLoginCount = count
+
+		lockout := lockoutDuration(count)
+		if lockout == 0 {
+			return nil
+		}
+		until := time.Now().Add(lockout)
+		lockedUntil = &until
+		user.LockedUntil = lockedUntil
+		return tx.Model(&database.User{}).Where("id = ?", user.ID).UpdateColumn("locked_until", until).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to record failed login: %v", err)
+	}
+	if lockedUntil != nil {
+		log.Printf("🔒 Account %s locked until %s after %d failed logins", user.Email, lockedUntil.Format(time.RFC3339), user.FailedLoginCount)
+	}
+	return lockedUntil, nil
+}
+
+// RecordLoginSuccess clears the failed login count of a user who signed in
+func RecordLoginSuccess(user *database.User) error {
+	if user.FailedLoginCount == 0 && user.LockedUntil == nil {
+		return nil
+	}
+	return UnlockUser(user.ID)
+}
+
+// UnlockUser clears the failed logins and lockout of a user
+func UnlockUser(userID uuid.UUID) error {
+	err := database.DB.Model(&database.User{}).Where("id = ?", userID).
+		UpdateColumns(map[string]interface{}{"failed_login_count": 0, "locked_until": nil}).Error
+	if err != nil {
+		return fmt.Errorf("failed to unlock user: %v", err)
+	}
+	return nil
+}
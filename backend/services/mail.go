@@ -0,0 +1,156 @@
+package services
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"emailprojectv2/config"
+)
+
+// MailMessage is a plain text email sent by the backend
+type MailMessage struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// MailSender delivers the emails the backend sends, such as password reset
+// links. Deployments with another transport can plug in their own with
+// SetMailSender.
+type MailSender interface {
+	Send(msg MailMessage) error
+}
+
+var (
+	mailSender   MailSender = logMailSender{}
+	mailSenderMu sync.RWMutex
+)
+
+// ConfigureMail selects the mail sender from the configuration
+func ConfigureMail(cfg config.MailConfig) {
+	switch cfg.Sender {
+	case "smtp":
+		if cfg.SMTPHost == "" {
+			log.Println("⚠️ MAIL_SENDER is smtp but SMTP_HOST is empty, logging emails instead")
+			SetMailSender(logMailSender{})
+			return
+		}
+		if cfg.SMTPPort < 1 {
+			cfg.SMTPPort = 587
+		}
+		SetMailSender(&smtpMailSender{cfg: cfg})
+		log.Printf("✉️  Sending email through %s:%d", cfg.SMTPHost, cfg.SMTPPort)
+	default:
+		SetMailSender(logMailSender{})
+		log.Println("✉️  Emails are written to the log (MAIL_SENDER=log)")
+	}
+}
+
+// SetMailSender replaces the sender used for all emails
+func SetMailSender(sender MailSender) {
+	mailSenderMu.Lock()
+	mailSender = sender
+	mailSenderMu.Unlock()
+}
+
+// SendMail sends a message with the configured sender
+func SendMail(msg MailMessage) error {
+	if strings.ContainsAny(msg.To+msg.Subject, "\r\n") {
+		return errors.New("mail headers must not contain line breaks")
+	}
+	mailSenderMu.RLock()
+	sender := mailSender
+	mailSenderMu.RUnlock()
+	return sender.Send(msg)
+}
+
+// logMailSender writes messages to the log, for development setups without a mail server
+type logMailSender struct{}
+
+func (logMailSender) Send(msg MailMessage) error {
+	log.Printf("✉️  Email to %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+	return nil
+}
+
+// smtpMailSender sends messages through an SMTP relay
+type smtpMailSender struct {
+	cfg config.MailConfig
+}
+
+func (s *smtpMailSender) Send(msg MailMessage) error {
+	from, err := mail.ParseAddress(s.cfg.From)
+	if err != nil {
+		return fmt.Errorf("invalid sender address %q: %v", s.cfg.From, err)
+	}
+	to, err := mail.ParseAddress(msg.To)
+	if err != nil {
+		return fmt.Errorf("invalid recipient address %q: %v", msg.To, err)
+	}
+
+	var data strings.Builder
+	data.WriteString("From: " + from.String() + "\r\n")
+	data.WriteString("To: " + to.String() + "\r\n")
+	data.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", msg.Subject) + "\r\n")
+	data.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	data.WriteString("MIME-Version: 1.0\r\n")
+	data.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	data.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	data.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+
+	addr := net.JoinHostPort(s.cfg.SMTPHost, strconv.Itoa(s.cfg.SMTPPort))
+	var auth smtp.Auth
+	if s.cfg.SMTPUsername != "" {
+		auth = smtp.PlainAuth("", s.cfg.SMTPUsername, s.cfg.SMTPPassword, s.cfg.SMTPHost)
+	}
+
+	// smtp.SendMail upgrades to STARTTLS when offered; port 465 expects TLS from the start
+	if s.cfg.SMTPPort != 465 {
+		if err := smtp.SendMail(addr, auth, from.Address, []string{to.Address}, []byte(data.String())); err != nil {
+			return fmt.Errorf("failed to send email: %v", err)
+		}
+		return nil
+	}
+
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 30 * time.Second}, "tcp", addr, &tls.Config{ServerName: s.cfg.SMTPHost})
+	if err != nil {
+		return fmt.Errorf("failed to connect to mail server: %v", err)
+	}
+	client, err := smtp.NewClient(conn, s.cfg.SMTPHost)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to connect to mail server: %v", err)
+	}
+	defer client.Close()
+	if auth != nil {
+		if err := client.Auth(auth); err != nil {
+			return fmt.Errorf("failed to authenticate with mail server: %v", err)
+		}
+	}
+	if err := client.Mail(from.Address); err != nil {
+		return fmt.Errorf("failed to send email: %v", err)
+	}
+	if err := client.Rcpt(to.Address); err != nil {
+		return fmt.Errorf("failed to send email: %v", err)
+	}
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("failed to send email: %v", err)
+	}
+	if _, err := w.Write([]byte(data.String())); err != nil {
+		return fmt.Errorf("failed to send email: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to send email: %v", err)
+	}
+	return client.Quit()
+}
@@ -0,0 +1,243 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"emailprojectv2/database"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Scopes of a mailbox grant
+const (
+	MailboxScopeMetadata = "metadata" // List and search emails, see their headers and history
+	MailboxScopeContent  = "content"  // Read email bodies and attachments
+	MailboxScopeExport   = "export"   // Download stored messages
+	MailboxScopeRestore  = "restore"  // Put messages back into the mailbox
+)
+
+// MailboxScopes lists the scopes a grant can hold
+var MailboxScopes = []string{MailboxScopeMetadata, MailboxScopeContent, MailboxScopeExport, MailboxScopeRestore}
+
+// Errors for mailbox access
+var (
+	ErrMailboxAccessDenied = errors.New("account not found or access denied")
+	ErrMailboxGrantInvalid = errors.New("invalid mailbox grant")
+)
+
+// MailboxAccess is how a user reaches an email account: as its owner, or
+// through a grant
+type MailboxAccess struct {
+	Account database.EmailAccount
+	Grant   *database.MailboxGrant // Nil for the owner
+}
+
+// Delegated reports whether the access is through a grant
+func (ma *MailboxAccess) Delegated() bool {
+	return ma.Grant != nil
+}
+
+// MailboxScopePermission returns the permission an owner needs to use a scope
+// on their own account. Grantees need the scope on an active grant instead.
+func MailboxScopePermission(scope string) string {
+	if scope == MailboxScopeRestore {
+		return "emails.manage"
+	}
+	return "emails.read"
+}
+
+// ParseMailboxScopes decodes the scopes stored on a grant
+func ParseMailboxScopes(raw string) []string {
+	var scopes []string
+	if err := json.Unmarshal([]byte(raw), &scopes); err != nil {
+		return nil
+	}
+	return scopes
+}
+
+// NormalizeMailboxScopes checks grant scopes and returns them without
+// duplicates. Every grant includes metadata, which the other scopes build on.
+func NormalizeMailboxScopes(scopes []string) ([]string, error) {
+	requested := map[string]bool{MailboxScopeMetadata: true}
+	for _, scope := range scopes {
+		valid := false
+		for _, known := range MailboxScopes {
+			if scope == known {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return nil, fmt.Errorf("%w: unknown scope %q", ErrMailboxGrantInvalid, scope)
+		}
+		requested[scope] = true
+	}
+	normalized := []string{}
+	for _, scope := range MailboxScopes {
+		if requested[scope] {
+			normalized = append(normalized, scope)
+		}
+	}
+	return normalized, nil
+}
+
+// MailboxGrantActive reports whether a grant is neither revoked nor expired
+func MailboxGrantActive(grant *database.MailboxGrant, now time.Time) bool {
+	return grant.RevokedAt == nil && (grant.ExpiresAt == nil || grant.ExpiresAt.After(now))
+}
+
+// grantHasScope reports whether a grant holds a scope
+func grantHasScope(grant *database.MailboxGrant, scope string) bool {
+	for _, granted := range ParseMailboxScopes(grant.Scopes) {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// activeGrants limits a query to grants that are neither revoked nor expired
+func activeGrants(query *gorm.DB) *gorm.DB {
+	return query.Where("revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?)", time.Now())
+}
+
+// AccountAccess returns how a user reaches an email account for a scope.
+// Owners hold every scope; other users need an active grant with it.
+func AccountAccess(userID, accountID uuid.UUID, scope string) (*MailboxAccess, error) {
+	var account database.EmailAccount
+	err := database.DB.First(&account, "id = ?", accountID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrMailboxAccessDenied
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load account: %v", err)
+	}
+	if account.UserID == userID {
+		return &MailboxAccess{Account: account}, nil
+	}
+
+	var grant database.MailboxGrant
+	err = activeGrants(database.DB.Where("account_id = ? AND grantee_id = ?", accountID, userID)).First(&grant).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrMailboxAccessDenied
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load mailbox grant: %v", err)
+	}
+	if !grantHasScope(&grant, scope) {
+		return nil, ErrMailboxAccessDenied
+	}
+	return &MailboxAccess{Account: account, Grant: &grant}, nil
+}
+
+// SharedAccounts returns the active grants a user has received, with their
+// accounts and the ID and email of the accounts' owners
+func SharedAccounts(userID uuid.UUID) ([]database.MailboxGrant, error) {
+	var grants []database.MailboxGrant
+	owners := func(tx *gorm.DB) *gorm.DB { return tx.Select("id", "email") }
+	err := activeGrants(database.DB.Preload("Account").Preload("Account.User", owners).Where("grantee_id = ?", userID)).
+		Order("created_at ASC").Find(&grants).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to load shared accounts: %v", err)
+	}
+	return grants, nil
+}
+
+// AccountGrants returns the grants of an account, including revoked and expired ones when asked
+func AccountGrants(accountID uuid.UUID, includeInactive bool) ([]database.MailboxGrant, error) {
+	query := database.DB.Preload("Grantee").Where("account_id = ?", accountID)
+	if !includeInactive {
+		query = activeGrants(query)
+	}
+	var grants []database.MailboxGrant
+	if err := query.Order("created_at DESC").Find(&grants).Error; err != nil {
+		return nil, fmt.Errorf("failed to load mailbox grants: %v", err)
+	}
+	return grants, nil
+}
+
+// GrantMailboxAccess shares an account with a user. The grantee must belong
+// to the account owner's organization or one below it. An active grant to the
+// same user is replaced.
+func GrantMailboxAccess(account *database.EmailAccount, grantee *database.User, scopes []string, expiresAt *time.Time, reason string, grantedBy uuid.UUID) (*database.MailboxGrant, error) {
+	if grantee.ID == account.UserID {
+		return nil, fmt.Errorf("%w: the owner already has access", ErrMailboxGrantInvalid)
+	}
+	if grantee.DisabledAt != nil {
+		return nil, fmt.Errorf("%w: the user is disabled", ErrMailboxGrantInvalid)
+	}
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		return nil, fmt.Errorf("%w: expires_at must be in the future", ErrMailboxGrantInvalid)
+	}
+	normalized, err := NormalizeMailboxScopes(scopes)
+	if err != nil {
+		return nil, err
+	}
+
+	ownerOrgID, err := UserOrganizationID(account.UserID)
+	if err != nil {
+		return nil, err
+	}
+	granteeOrgID, err := UserOrganizationID(grantee.ID)
+	if err != nil {
+		return nil, err
+	}
+	if ownerOrgID == nil || granteeOrgID == nil {
+		return nil, fmt.Errorf("%w: the user is outside the account owner's organization", ErrMailboxGrantInvalid)
+	}
+	within, err := OrganizationWithin(*granteeOrgID, *ownerOrgID)
+	if err != nil {
+		return nil, err
+	}
+	if !within {
+		return nil, fmt.Errorf("%w: the user is outside the account owner's organization", ErrMailboxGrantInvalid)
+	}
+
+	encoded, _ := json.Marshal(normalized)
+	grant := database.MailboxGrant{
+		AccountID: account.ID,
+		GranteeID: grantee.ID,
+		Scopes:    string(encoded),
+		Reason:    reason,
+		GrantedBy: grantedBy,
+		ExpiresAt: expiresAt,
+	}
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		if err := activeGrants(tx.Model(&database.MailboxGrant{}).Where("account_id = ? AND grantee_id = ?", account.ID, grantee.ID)).
+			Updates(map[string]interface{}{"revoked_at": now, "revoked_by": grantedBy}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&grant).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to store mailbox grant: %v", err)
+	}
+	return &grant, nil
+}
+
+// RevokeMailboxGrant ends a grant of an account
+func RevokeMailboxGrant(accountID, grantID, revokedBy uuid.UUID) (*database.MailboxGrant, error) {
+	var grant database.MailboxGrant
+	err := database.DB.Where("id = ? AND account_id = ?", grantID, accountID).First(&grant).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrMailboxGrantInvalid
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load mailbox grant: %v", err)
+	}
+	if grant.RevokedAt != nil {
+		return &grant, nil
+	}
+	now := time.Now()
+	grant.RevokedAt = &now
+	grant.RevokedBy = &revokedBy
+	if err := database.DB.Model(&grant).Updates(map[string]interface{}{"revoked_at": now, "revoked_by": revokedBy}).Error; err != nil {
+		return nil, fmt.Errorf("failed to revoke mailbox grant: %v", err)
+	}
+	return &grant, nil
+}
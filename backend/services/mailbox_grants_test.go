@@ -0,0 +1,100 @@
+package services
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"emailprojectv2/database"
+)
+
+func TestNormalizeMailboxScopes(t *testing.T) {
+	tests := []struct {
+		name    string
+		scopes  []string
+		want    []string
+		wantErr bool
+	}{
+		{"metadata is always included", nil, []string{"metadata"}, false},
+		{"catalog order", []string{"restore", "content"}, []string{"metadata", "content", "restore"}, false},
+		{"duplicates dropped", []string{"export", "export", "metadata"}, []string{"metadata", "export"}, false},
+		{"unknown scope", []string{"content", "delete"}, nil, true},
+		{"case sensitive", []string{"Content"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NormalizeMailboxScopes(tt.scopes)
+			if tt.wantErr {
+				if !errors.Is(err, ErrMailboxGrantInvalid) {
+					t.Fatalf("error = %v, want ErrMailboxGrantInvalid", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NormalizeMailboxScopes: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("NormalizeMailboxScopes = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGrantHasScope(t *testing.T) {
+	grant := &database.MailboxGrant{Scopes: `["metadata","content"]`}
+	tests := []struct {
+		scope string
+		want  bool
+	}{
+		{MailboxScopeMetadata, true},
+		{MailboxScopeContent, true},
+		{MailboxScopeExport, false},
+		{MailboxScopeRestore, false},
+	}
+	for _, tt := range tests {
+		if got := grantHasScope(grant, tt.scope); got != tt.want {
+			t.Errorf("grantHasScope(%s) = %v, want %v", tt.scope, got, tt.want)
+		}
+	}
+	if grantHasScope(&database.MailboxGrant{Scopes: "not json"}, MailboxScopeMetadata) {
+		t.Error("a grant with unreadable scopes holds no scope")
+	}
+}
+
+func TestMailboxGrantActive(t *testing.T) {
+	now := time.Now()
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+	tests := []struct {
+		name  string
+		grant database.MailboxGrant
+		want  bool
+	}{
+		{"open ended", database.MailboxGrant{}, true},
+		{"not expired", database.MailboxGrant{ExpiresAt: &future}, true},
+		{"expired", database.MailboxGrant{ExpiresAt: &past}, false},
+		{"expires now", database.MailboxGrant{ExpiresAt: &now}, false},
+		{"revoked", database.MailboxGrant{ExpiresAt: &future, RevokedAt: &past}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MailboxGrantActive(&tt.grant, now); got != tt.want {
+				t.Errorf("MailboxGrantActive = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMailboxScopePermission(t *testing.T) {
+	want := map[string]string{
+		MailboxScopeMetadata: "emails.read",
+		MailboxScopeContent:  "emails.read",
+		MailboxScopeExport:   "emails.read",
+		MailboxScopeRestore:  "emails.manage",
+	}
+	for scope, permission := range want {
+		if got := MailboxScopePermission(scope); got != permission {
+			t.Errorf("MailboxScopePermission(%s) = %s, want %s", scope, got, permission)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"emailprojectv2/database"
+	"emailprojectv2/storage"
+
+	"github.com/emersion/go-imap"
+)
+
+// Errors for restoring archived emails
+var (
+	ErrRestoreUnsupported = errors.New("restoring emails is not supported for this provider")
+	ErrRestoreUnavailable = errors.New("the original message of this email is not archived")
+)
+
+// RestoreEmail puts an archived email back into its folder of the mailbox,
+// using the original message stored at RawMinioPath
+func RestoreEmail(ctx context.Context, account *database.EmailAccount, email *database.EmailIndex) error {
+	if account.Provider != "gmail" {
+		return ErrRestoreUnsupported
+	}
+	if email.RawMinioPath == "" {
+		return ErrRestoreUnavailable
+	}
+
+	obj, err := storage.OpenEmailObject(ctx, email.RawMinioPath)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+	var raw bytes.Buffer
+	if _, err := io.Copy(&raw, obj); err != nil {
+		return fmt.Errorf("failed to read %s: %v", email.RawMinioPath, err)
+	}
+
+	var flags []string
+	if email.IsRead {
+		flags = append(flags, imap.SeenFlag)
+	}
+	if email.IsFlagged {
+		flags = append(flags, imap.FlaggedFlag)
+	}
+
+	gmailService := NewGmailServiceV1("imap.gmail.com", "993", account.Username, account.Password)
+	if err := gmailService.AppendMessage(email.Folder, flags, email.Date, &raw); err != nil {
+		return err
+	}
+	log.Printf("♻️ Restored email %s to %s/%s", email.ID, account.Email, email.Folder)
+	return nil
+}
+
+// AppendMessage uploads an RFC822 message into a folder of the mailbox
+func (gs *GmailServiceV1) AppendMessage(folder string, flags []string, date time.Time, msg imap.Literal) error {
+	c, err := gs.connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to Gmail IMAP: %v", err)
+	}
+	defer c.Logout()
+
+	if err := c.Append(folder, flags, date, msg); err != nil {
+		return fmt.Errorf("failed to append message to %s: %v", folder, err)
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+
+	"emailprojectv2/database"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Errors for organization membership changes
+var (
+	ErrMembershipNotFound = errors.New("user is not a member of this organization")
+	ErrPrimaryMembership  = errors.New("the primary organization cannot be removed; make another organization primary first")
+)
+
+// UserMemberships returns the organizations a user belongs to, primary first
+func UserMemberships(userID uuid.UUID) ([]database.UserOrganization, error) {
+	var memberships []database.UserOrganization
+	err := database.DB.Preload("Organization").Preload("Role").
+		Where("user_id = ?", userID).Order("is_primary DESC, joined_at ASC").Find(&memberships).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to load memberships: %v", err)
+	}
+	return memberships, nil
+}
+
+// FindMembership returns a user's membership of an organization
+func FindMembership(userID, orgID uuid.UUID) (*database.UserOrganization, error) {
+	var membership database.UserOrganization
+	err := database.DB.Preload("Organization").Preload("Role").
+		Where("user_id = ? AND organization_id = ?", userID, orgID).First(&membership).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrMembershipNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load membership: %v", err)
+	}
+	return &membership, nil
+}
+
+// makePrimary moves a user's primary organization and role to a membership.
+// Custom roles narrow one role in one organization tree, so the user's is dropped.
+func makePrimary(tx *gorm.DB, userID, orgID, roleID uuid.UUID) error {
+	if err := tx.Model(&database.UserOrganization{}).Where("user_id = ? AND organization_id <> ?", userID, orgID).
+		Update("is_primary", false).Error; err != nil {
+		return err
+	}
+	if err := tx.Model(&database.UserOrganization{}).Where("user_id = ? AND organization_id = ?", userID, orgID).
+		Update("is_primary", true).Error; err != nil {
+		return err
+	}
+	return tx.Model(&database.User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+		"primary_org_id": orgID,
+		"role_id":        roleID,
+		"custom_role_id": nil,
+	}).Error
+}
+
+// AssignMembership adds a user to an organization with a role, or changes the
+// role of an existing membership. With primary set, the organization becomes
+// the user's primary one. It returns whether the membership is new.
+func AssignMembership(userID, orgID, roleID uuid.UUID, primary bool) (bool, error) {
+	created := false
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		var membership database.UserOrganization
+		err := tx.Where("user_id = ? AND organization_id = ?", userID, orgID).First(&membership).Error
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			membership = database.UserOrganization{UserID: userID, OrganizationID: orgID, RoleID: roleID}
+			if err := tx.Create(&membership).Error; err != nil {
+				return err
+			}
+			created = true
+		case err != nil:
+			return err
+		default:
+			if err := tx.Model(&membership).Update("role_id", roleID).Error; err != nil {
+				return err
+			}
+		}
+
+		if primary || membership.IsPrimary {
+			return makePrimary(tx, userID, orgID, roleID)
+		}
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to assign membership: %v", err)
+	}
+	return created, nil
+}
+
+// RemoveMembership removes a user from an organization other than their primary one
+func RemoveMembership(userID, orgID uuid.UUID) error {
+	membership, err := FindMembership(userID, orgID)
+	if err != nil {
+		return err
+	}
+	if membership.IsPrimary {
+		return ErrPrimaryMembership
+	}
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&database.UserOrganization{}, "id = ?", membership.ID).Error; err != nil {
+			return err
+		}
+		// Sessions working in the organization fall back to the primary one
+		return tx.Model(&database.AuthSession{}).Where("user_id = ? AND active_org_id = ?", userID, orgID).
+			Update("active_org_id", nil).Error
+	})
+	if err != nil {
+		return fmt.Errorf("failed to remove membership: %v", err)
+	}
+	return nil
+}
+
+// SetSessionOrganization makes an organization the active one of a session.
+// The user must be a member of it.
+func SetSessionOrganization(sessionID, userID, orgID uuid.UUID) (*database.UserOrganization, error) {
+	membership, err := FindMembership(userID, orgID)
+	if err != nil {
+		return nil, err
+	}
+	var activeOrgID *uuid.UUID
+	if !membership.IsPrimary {
+		activeOrgID = &orgID
+	}
+	result := database.DB.Model(&database.AuthSession{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", sessionID, userID).
+		Update("active_org_id", activeOrgID)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to switch organization: %v", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrSessionRevoked
+	}
+	return membership, nil
+}
+
+// ActiveMembership returns the membership a session works in when it has
+// switched away from the user's primary organization, and nil otherwise
+func ActiveMembership(sessionID, userID uuid.UUID) (*database.UserOrganization, error) {
+	var session database.AuthSession
+	if err := database.DB.Select("id", "active_org_id").First(&session, "id = ?", sessionID).Error; err != nil {
+		return nil, fmt.Errorf("failed to load session: %v", err)
+	}
+	if session.ActiveOrgID == nil {
+		return nil, nil
+	}
+	membership, err := FindMembership(userID, *session.ActiveOrgID)
+	if errors.Is(err, ErrMembershipNotFound) {
+		return nil, nil
+	}
+	return membership, err
+}
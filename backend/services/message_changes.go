@@ -0,0 +1,215 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"emailprojectv2/database"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Message history event types
+const (
+	EmailEventMoved     = "moved"
+	EmailEventRead      = "read"
+	EmailEventUnread    = "unread"
+	EmailEventFlagged   = "flagged"
+	EmailEventUnflagged = "unflagged"
+	EmailEventDeleted   = "deleted"
+	EmailEventRestored  = "restored"
+)
+
+// recordEmailEvent appends an entry to a message's history
+func recordEmailEvent(email *database.EmailIndex, eventType, fromFolder, toFolder, detail string) {
+	event := database.EmailEvent{
+		EmailID:    email.ID,
+		AccountID:  email.AccountID,
+		EventType:  eventType,
+		FromFolder: fromFolder,
+		ToFolder:   toFolder,
+		Detail:     detail,
+		DetectedAt: time.Now(),
+	}
+	if err := database.DB.Create(&event).Error; err != nil {
+		log.Printf("⚠️ Failed to record %s event for email %s: %v", eventType, email.ID, err)
+	}
+}
+
+// MarkDeletedUpstream flags a message as removed on the server. The archive
+// copy and its index entry are kept.
+func MarkDeletedUpstream(email *database.EmailIndex, detail string) {
+	if email.DeletedUpstreamAt != nil {
+		return
+	}
+
+	now := time.Now()
+	if err := database.DB.Model(email).Update("deleted_upstream_at", now).Error; err != nil {
+		log.Printf("⚠️ Failed to mark email %s as deleted upstream: %v", email.ID, err)
+		return
+	}
+	email.DeletedUpstreamAt = &now
+
+	recordEmailEvent(email, EmailEventDeleted, email.Folder, "", detail)
+	log.Printf("🗑️ Message deleted upstream: %s (%s)", email.Subject, detail)
+}
+
+// MarkMovedUpstream records that a message now lives in another folder under a
+// new provider id. A message that was marked deleted is restored.
+func MarkMovedUpstream(email *database.EmailIndex, toFolder, providerItemID string) {
+	fromFolder := email.Folder
+	restored := email.DeletedUpstreamAt != nil
+
+	updates := map[string]interface{}{
+		"folder":           toFolder,
+		"provider_item_id": providerItemID,
+	}
+	if restored {
+		updates["deleted_upstream_at"] = nil
+	}
+	if err := database.DB.Model(email).Updates(updates).Error; err != nil {
+		log.Printf("⚠️ Failed to update location of email %s: %v", email.ID, err)
+		return
+	}
+	email.Folder = toFolder
+	email.ProviderItemID = providerItemID
+	email.DeletedUpstreamAt = nil
+
+	if fromFolder != toFolder {
+		recordEmailEvent(email, EmailEventMoved, fromFolder, toFolder, "")
+		log.Printf("📂 Message moved upstream: %s (%s → %s)", email.Subject, fromFolder, toFolder)
+	}
+	if restored {
+		recordEmailEvent(email, EmailEventRestored, "", toFolder, "message reappeared on the server")
+	}
+}
+
+// ApplyFlagChanges updates the read and flagged state of a message and records
+// an event for each change
+func ApplyFlagChanges(email *database.EmailIndex, isRead, isFlagged bool) {
+	updates := make(map[string]interface{})
+	var events []string
+
+	if email.IsRead != isRead {
+		updates["is_read"] = isRead
+		if isRead {
+			events = append(events, EmailEventRead)
+		} else {
+			events = append(events, EmailEventUnread)
+		}
+	}
+	if email.IsFlagged != isFlagged {
+		updates["is_flagged"] = isFlagged
+		if isFlagged {
+			events = append(events, EmailEventFlagged)
+		} else {
+			events = append(events, EmailEventUnflagged)
+		}
+	}
+
+	if len(updates) == 0 {
+		return
+	}
+	if err := database.DB.Model(email).Updates(updates).Error; err != nil {
+		log.Printf("⚠️ Failed to update flags of email %s: %v", email.ID, err)
+		return
+	}
+	email.IsRead = isRead
+	email.IsFlagged = isFlagged
+
+	for _, eventType := range events {
+		recordEmailEvent(email, eventType, email.Folder, email.Folder, "")
+	}
+}
+
+// findEmailByProviderItem looks up an archived message by its provider id.
+// Exchange rows indexed before provider ids were stored are matched by their
+// synthetic message id.
+func findEmailByProviderItem(accountID uuid.UUID, providerItemID string) (*database.EmailIndex, error) {
+	var email database.EmailIndex
+	err := database.DB.Where("account_id = ? AND (provider_item_id = ? OR message_id = ?)",
+		accountID, providerItemID, fmt.Sprintf("exchange_%s_%s", accountID.String(), providerItemID)).
+		First(&email).Error
+	if err != nil {
+		return nil, err
+	}
+	return &email, nil
+}
+
+// loadFolderSyncState returns the change checkpoint of a folder, or an unsaved
+// empty one when the folder has not been reconciled yet
+func loadFolderSyncState(accountID uuid.UUID, folder string) (*database.FolderSyncState, error) {
+	var state database.FolderSyncState
+	err := database.DB.Where("account_id = ? AND folder = ?", accountID, folder).First(&state).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return &database.FolderSyncState{AccountID: accountID, Folder: folder}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load folder sync state: %v", err)
+	}
+	return &state, nil
+}
+
+// saveFolderSyncState stores the change checkpoint of a folder
+func saveFolderSyncState(state *database.FolderSyncState) {
+	now := time.Now()
+	state.LastReconciledAt = &now
+	if err := database.DB.Save(state).Error; err != nil {
+		log.Printf("⚠️ Failed to save sync state for folder %s: %v", state.Folder, err)
+	}
+}
+
+// GraphDeltaItem is a message entry of a Microsoft Graph delta response
+type GraphDeltaItem struct {
+	ID     string `json:"id"`
+	IsRead *bool  `json:"isRead"`
+	Flag   *struct {
+		FlagStatus string `json:"flagStatus"`
+	} `json:"flag"`
+	Removed *struct {
+		Reason string `json:"reason"`
+	} `json:"@removed"`
+}
+
+// ApplyGraphDelta applies one page of a Graph messages delta query for a
+// folder and returns the entries that are not archived yet. Message ids must
+// be immutable ids, so that a message keeps its id when it moves. Entries
+// carrying @removed left the folder: an archived message still recorded in
+// the folder was deleted, one recorded elsewhere was moved there already.
+// Archived messages listed in another folder than recorded were moved here;
+// the rest are checked for read and flag changes.
+func ApplyGraphDelta(accountID uuid.UUID, folder string, items []GraphDeltaItem) []GraphDeltaItem {
+	var unarchived []GraphDeltaItem
+	for _, item := range items {
+		email, err := findEmailByProviderItem(accountID, item.ID)
+		if err != nil {
+			if item.Removed == nil {
+				unarchived = append(unarchived, item)
+			}
+			continue
+		}
+
+		if item.Removed != nil {
+			if email.Folder == folder {
+				MarkDeletedUpstream(email, fmt.Sprintf("removed from %s (%s)", folder, item.Removed.Reason))
+			}
+			continue
+		}
+		if email.Folder != folder || email.DeletedUpstreamAt != nil {
+			MarkMovedUpstream(email, folder, item.ID)
+		}
+
+		isRead, isFlagged := email.IsRead, email.IsFlagged
+		if item.IsRead != nil {
+			isRead = *item.IsRead
+		}
+		if item.Flag != nil {
+			isFlagged = item.Flag.FlagStatus == "flagged"
+		}
+		ApplyFlagChanges(email, isRead, isFlagged)
+	}
+	return unarchived
+}
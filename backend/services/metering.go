@@ -0,0 +1,398 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"emailprojectv2/config"
+	"emailprojectv2/database"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// ErrMeteringRunning is returned when a usage snapshot is started while another is in progress
+var ErrMeteringRunning = errors.New("a usage snapshot is already in progress")
+
+// bytesPerGB is the unit storage and ingest are priced in
+const bytesPerGB = 1024 * 1024 * 1024
+
+// BillingSettings holds the usage metering settings
+var BillingSettings = config.BillingConfig{SnapshotIntervalHours: 6, Currency: "USD"}
+
+// ConfigureBilling replaces the usage metering settings
+func ConfigureBilling(cfg config.BillingConfig) {
+	if cfg.SnapshotIntervalHours < 1 {
+		cfg.SnapshotIntervalHours = 6
+	}
+	cfg.Currency = strings.ToUpper(cfg.Currency)
+	if len(cfg.Currency) != 3 {
+		cfg.Currency = "USD"
+	}
+	BillingSettings = cfg
+	log.Printf("💰 Usage snapshots every %dh, default currency %s", cfg.SnapshotIntervalHours, cfg.Currency)
+}
+
+// UsageMeter records daily usage snapshots. Only one snapshot runs at a time.
+type UsageMeter struct {
+	mu      sync.Mutex
+	running bool
+}
+
+// Metering is the shared meter used by the scheduler and the API
+var Metering = &UsageMeter{}
+
+// meteringData is the state of the whole hierarchy that a day's snapshot is computed from
+type meteringData struct {
+	orgs        []database.Organization
+	children    map[uuid.UUID][]uuid.UUID
+	orgUsers    map[uuid.UUID][]uuid.UUID // Own members of each organization
+	userAccts   map[uuid.UUID][]database.EmailAccount
+	storedBytes map[uuid.UUID]int64 // Per account
+}
+
+// Snapshot records the usage of every organization for the current day and
+// finalizes earlier days whose snapshot was taken before the day ended. It
+// returns the number of snapshots written.
+func (um *UsageMeter) Snapshot(now time.Time) (int, error) {
+	um.mu.Lock()
+	if um.running {
+		um.mu.Unlock()
+		return 0, ErrMeteringRunning
+	}
+	um.running = true
+	um.mu.Unlock()
+
+	defer func() {
+		um.mu.Lock()
+		um.running = false
+		um.mu.Unlock()
+	}()
+
+	data, err := loadMeteringData()
+	if err != nil {
+		return 0, err
+	}
+
+	today := dayStart(now)
+	var openDays []time.Time
+	if err := database.DB.Model(&database.UsageSnapshot{}).Where("day < ? AND final = ?", today, false).
+		Distinct("day").Order("day ASC").Pluck("day", &openDays).Error; err != nil {
+		return 0, fmt.Errorf("failed to load open usage snapshots: %v", err)
+	}
+
+	written := 0
+	for _, day := range openDays {
+		n, err := data.snapshotDay(dayStart(day), now, true)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	n, err := data.snapshotDay(today, now, false)
+	written += n
+	if err != nil {
+		return written, err
+	}
+
+	log.Printf("💰 Recorded %d usage snapshots", written)
+	return written, nil
+}
+
+func loadMeteringData() (*meteringData, error) {
+	data := &meteringData{
+		children:    map[uuid.UUID][]uuid.UUID{},
+		orgUsers:    map[uuid.UUID][]uuid.UUID{},
+		userAccts:   map[uuid.UUID][]database.EmailAccount{},
+		storedBytes: map[uuid.UUID]int64{},
+	}
+
+	if err := database.DB.Select("id", "name", "type", "parent_org_id").Find(&data.orgs).Error; err != nil {
+		return nil, fmt.Errorf("failed to load organizations: %v", err)
+	}
+	for _, org := range data.orgs {
+		if org.ParentOrgID != nil {
+			data.children[*org.ParentOrgID] = append(data.children[*org.ParentOrgID], org.ID)
+		}
+	}
+
+	// Users belong to their primary organization and every organization they are a member of
+	var users []database.User
+	if err := database.DB.Select("id", "primary_org_id").Find(&users).Error; err != nil {
+		return nil, fmt.Errorf("failed to load users: %v", err)
+	}
+	members := map[uuid.UUID]map[uuid.UUID]bool{}
+	addMember := func(orgID, userID uuid.UUID) {
+		if members[orgID] == nil {
+			members[orgID] = map[uuid.UUID]bool{}
+		}
+		if !members[orgID][userID] {
+			members[orgID][userID] = true
+			data.orgUsers[orgID] = append(data.orgUsers[orgID], userID)
+		}
+	}
+	for _, user := range users {
+		if user.PrimaryOrgID != nil {
+			addMember(*user.PrimaryOrgID, user.ID)
+		}
+	}
+	var memberships []database.UserOrganization
+	if err := database.DB.Select("user_id", "organization_id").Find(&memberships).Error; err != nil {
+		return nil, fmt.Errorf("failed to load memberships: %v", err)
+	}
+	for _, m := range memberships {
+		addMember(m.OrganizationID, m.UserID)
+	}
+
+	var accounts []database.EmailAccount
+	if err := database.DB.Select("id", "user_id", "is_active").Find(&accounts).Error; err != nil {
+		return nil, fmt.Errorf("failed to load accounts: %v", err)
+	}
+	for _, account := range accounts {
+		data.userAccts[account.UserID] = append(data.userAccts[account.UserID], account)
+	}
+
+	stored, err := bytesPerAccount(database.DB.Model(&database.EmailIndex{}))
+	if err != nil {
+		return nil, err
+	}
+	data.storedBytes = stored
+	return data, nil
+}
+
+// bytesPerAccount sums email sizes per account over the emails the query selects
+func bytesPerAccount(query *gorm.DB) (map[uuid.UUID]int64, error) {
+	var rows []struct {
+		AccountID uuid.UUID
+		Bytes     int64
+	}
+	if err := query.Select("account_id, COALESCE(SUM(email_size), 0) AS bytes").Group("account_id").Scan(&rows).Error; err != nil {
+		return nil, fmt.Errorf("failed to sum email sizes: %v", err)
+	}
+	sums := make(map[uuid.UUID]int64, len(rows))
+	for _, row := range rows {
+		sums[row.AccountID] = row.Bytes
+	}
+	return sums, nil
+}
+
+// usageCounts is the usage of a set of organizations, each user and account counted once
+type usageCounts struct {
+	users, activeMailboxes, storedBytes, ingestedBytes int64
+}
+
+func (data *meteringData) usage(orgIDs []uuid.UUID, ingested map[uuid.UUID]int64) usageCounts {
+	var counts usageCounts
+	seenUsers := map[uuid.UUID]bool{}
+	for _, orgID := range orgIDs {
+		for _, userID := range data.orgUsers[orgID] {
+			if seenUsers[userID] {
+				continue
+			}
+			seenUsers[userID] = true
+			counts.users++
+			for _, account := range data.userAccts[userID] {
+				if account.IsActive {
+					counts.activeMailboxes++
+				}
+				counts.storedBytes += data.storedBytes[account.ID]
+				counts.ingestedBytes += ingested[account.ID]
+			}
+		}
+	}
+	return counts
+}
+
+// subtree returns an organization and its descendants
+func (data *meteringData) subtree(orgID uuid.UUID) []uuid.UUID {
+	ids := []uuid.UUID{orgID}
+	seen := map[uuid.UUID]bool{orgID: true}
+	for i := 0; i < len(ids); i++ {
+		for _, child := range data.children[ids[i]] {
+			if !seen[child] {
+				seen[child] = true
+				ids = append(ids, child)
+			}
+		}
+	}
+	return ids
+}
+
+// snapshotDay writes the snapshot of every organization for one day. Stored
+// bytes are as of now, so a day is finalized on the first run after it ends.
+func (data *meteringData) snapshotDay(day, now time.Time, final bool) (int, error) {
+	ingested, err := bytesPerAccount(database.DB.Model(&database.EmailIndex{}).
+		Where("created_at >= ? AND created_at < ?", day, day.AddDate(0, 0, 1)))
+	if err != nil {
+		return 0, err
+	}
+
+	written := 0
+	for _, org := range data.orgs {
+		own := data.usage([]uuid.UUID{org.ID}, ingested)
+		total := data.usage(data.subtree(org.ID), ingested)
+
+		var snapshot database.UsageSnapshot
+		err := database.DB.Where("organization_id = ? AND day = ?", org.ID, day).First(&snapshot).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return written, fmt.Errorf("failed to load usage snapshot: %v", err)
+		}
+		snapshot.OrganizationID = org.ID
+		snapshot.Day = day
+		snapshot.Users = own.users
+		snapshot.ActiveMailboxes = own.activeMailboxes
+		snapshot.StoredBytes = own.storedBytes
+		snapshot.IngestedBytes = own.ingestedBytes
+		snapshot.TotalUsers = total.users
+		snapshot.TotalActiveMailboxes = total.activeMailboxes
+		snapshot.TotalStoredBytes = total.storedBytes
+		snapshot.TotalIngestedBytes = total.ingestedBytes
+		snapshot.Final = final
+		snapshot.TakenAt = now
+
+		if err := database.DB.Save(&snapshot).Error; err != nil {
+			return written, fmt.Errorf("failed to save usage snapshot: %v", err)
+		}
+		written++
+	}
+	return written, nil
+}
+
+// BillingLine is the usage and charge of one organization for a billing period.
+// Usage covers the organization's whole subtree: users and mailboxes at their
+// daily peak, storage averaged over the metered days and ingest summed.
+type BillingLine struct {
+	Period           string     `json:"period"`
+	OrganizationID   uuid.UUID  `json:"organization_id"`
+	OrganizationName string     `json:"organization_name"`
+	OrgType          string     `json:"org_type"`
+	ParentOrgID      *uuid.UUID `json:"parent_org_id,omitempty"`
+	DaysMetered      int        `json:"days_metered"`
+	PeakUsers        int64      `json:"peak_users"`
+	PeakMailboxes    int64      `json:"peak_mailboxes"`
+	AvgStoredBytes   int64      `json:"avg_stored_bytes"`
+	IngestedBytes    int64      `json:"ingested_bytes"`
+	PlanID           *uuid.UUID `json:"plan_id,omitempty"`
+	PlanName         string     `json:"plan_name,omitempty"`
+	Currency         string     `json:"currency,omitempty"`
+	BaseFeeCents     int64      `json:"base_fee_cents"`
+	UsersCents       int64      `json:"users_cents"`
+	MailboxesCents   int64      `json:"mailboxes_cents"`
+	StorageCents     int64      `json:"storage_cents"`
+	IngestCents      int64      `json:"ingest_cents"`
+	TotalCents       int64      `json:"total_cents"`
+}
+
+// ParseBillingPeriod parses a YYYY-MM period into its first day and the first day of the next month
+func ParseBillingPeriod(period string) (time.Time, time.Time, error) {
+	start, err := time.Parse("2006-01", period)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid billing period %q, expected YYYY-MM", period)
+	}
+	return start, start.AddDate(0, 1, 0), nil
+}
+
+// ResolvePricePlans returns the active plan of each organization: a plan for
+// the organization itself, otherwise the newest plan for its level
+func ResolvePricePlans(orgs []database.Organization) (map[uuid.UUID]*database.PricePlan, error) {
+	var plans []database.PricePlan
+	if err := database.DB.Where("is_active = ?", true).Order("created_at DESC").Find(&plans).Error; err != nil {
+		return nil, fmt.Errorf("failed to load price plans: %v", err)
+	}
+
+	byOrg := map[uuid.UUID]*database.PricePlan{}
+	byType := map[string]*database.PricePlan{}
+	for i := range plans {
+		plan := &plans[i]
+		if plan.OrganizationID != nil {
+			if byOrg[*plan.OrganizationID] == nil {
+				byOrg[*plan.OrganizationID] = plan
+			}
+		} else if byType[plan.OrgType] == nil {
+			byType[plan.OrgType] = plan
+		}
+	}
+
+	resolved := make(map[uuid.UUID]*database.PricePlan, len(orgs))
+	for _, org := range orgs {
+		if plan := byOrg[org.ID]; plan != nil {
+			resolved[org.ID] = plan
+		} else if plan := byType[org.Type]; plan != nil {
+			resolved[org.ID] = plan
+		}
+	}
+	return resolved, nil
+}
+
+// ComputeBillingPeriod rates a month of usage snapshots for the given
+// organizations. Organizations without a plan get a line without charges.
+func ComputeBillingPeriod(orgIDs []uuid.UUID, period string) ([]BillingLine, error) {
+	start, end, err := ParseBillingPeriod(period)
+	if err != nil {
+		return nil, err
+	}
+
+	var orgs []database.Organization
+	if err := database.DB.Where("id IN ?", orgIDs).Order("type ASC, name ASC").Find(&orgs).Error; err != nil {
+		return nil, fmt.Errorf("failed to load organizations: %v", err)
+	}
+	plans, err := ResolvePricePlans(orgs)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []database.UsageSnapshot
+	if err := database.DB.Where("organization_id IN ? AND day >= ? AND day < ?", orgIDs, start, end).Find(&snapshots).Error; err != nil {
+		return nil, fmt.Errorf("failed to load usage snapshots: %v", err)
+	}
+	byOrg := map[uuid.UUID][]database.UsageSnapshot{}
+	for _, snapshot := range snapshots {
+		byOrg[snapshot.OrganizationID] = append(byOrg[snapshot.OrganizationID], snapshot)
+	}
+
+	lines := make([]BillingLine, 0, len(orgs))
+	for _, org := range orgs {
+		line := BillingLine{
+			Period:           period,
+			OrganizationID:   org.ID,
+			OrganizationName: org.Name,
+			OrgType:          org.Type,
+			ParentOrgID:      org.ParentOrgID,
+		}
+
+		var storedSum int64
+		for _, snapshot := range byOrg[org.ID] {
+			line.DaysMetered++
+			if snapshot.TotalUsers > line.PeakUsers {
+				line.PeakUsers = snapshot.TotalUsers
+			}
+			if snapshot.TotalActiveMailboxes > line.PeakMailboxes {
+				line.PeakMailboxes = snapshot.TotalActiveMailboxes
+			}
+			storedSum += snapshot.TotalStoredBytes
+			line.IngestedBytes += snapshot.TotalIngestedBytes
+		}
+		if line.DaysMetered > 0 {
+			line.AvgStoredBytes = storedSum / int64(line.DaysMetered)
+		}
+
+		if plan := plans[org.ID]; plan != nil {
+			line.PlanID = &plan.ID
+			line.PlanName = plan.Name
+			line.Currency = plan.Currency
+			line.BaseFeeCents = plan.BaseFeeCents
+			line.UsersCents = line.PeakUsers * plan.PerUserCents
+			line.MailboxesCents = line.PeakMailboxes * plan.PerMailboxCents
+			line.StorageCents = int64(math.Round(float64(line.AvgStoredBytes) / bytesPerGB * float64(plan.PerGBStoredCents)))
+			line.IngestCents = int64(math.Round(float64(line.IngestedBytes) / bytesPerGB * float64(plan.PerGBIngestedCents)))
+			line.TotalCents = line.BaseFeeCents + line.UsersCents + line.MailboxesCents + line.StorageCents + line.IngestCents
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
@@ -0,0 +1,437 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"emailprojectv2/config"
+	"emailprojectv2/database"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// TOTP parameters (RFC 6238 defaults, which every authenticator app supports)
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	totpSkew   = 1 // Steps accepted either side of the current one, for clock drift
+
+	recoveryCodeCount = 10
+)
+
+// Errors for MFA operations that are the caller's to fix
+var (
+	ErrMFANotEnrolled      = errors.New("multi-factor authentication is not enabled")
+	ErrMFAAlreadyEnrolled  = errors.New("multi-factor authentication is already enabled")
+	ErrMFAEnrollmentNeeded = errors.New("multi-factor authentication must be set up first")
+	ErrMFAInvalidCode      = errors.New("invalid verification code")
+	ErrMFAChallengeInvalid = errors.New("login challenge is invalid or expired")
+	ErrMFARequired         = errors.New("multi-factor authentication is required for this role")
+)
+
+// MFASettings holds the multi-factor authentication settings
+var MFASettings = config.MFAConfig{Issuer: "Email Backup", ChallengeMinutes: 5, MaxChallengeAttempts: 5}
+
+// ConfigureMFA replaces the multi-factor authentication settings
+func ConfigureMFA(cfg config.MFAConfig) {
+	if cfg.Issuer == "" {
+		cfg.Issuer = "Email Backup"
+	}
+	if cfg.ChallengeMinutes < 1 {
+		cfg.ChallengeMinutes = 5
+	}
+	if cfg.MaxChallengeAttempts < 1 {
+		cfg.MaxChallengeAttempts = 5
+	}
+	MFASettings = cfg
+	log.Printf("🔐 MFA configured: issuer %q, challenges valid %dm with %d attempts", cfg.Issuer, cfg.ChallengeMinutes, cfg.MaxChallengeAttempts)
+}
+
+// MFAStatus describes a user's multi-factor authentication
+type MFAStatus struct {
+	Enabled                bool       `json:"enabled"`
+	Pending                bool       `json:"pending"`  // Enrollment started but not confirmed
+	Required               bool       `json:"required"` // Required by an organization policy
+	ConfirmedAt            *time.Time `json:"confirmed_at,omitempty"`
+	RecoveryCodesRemaining int64      `json:"recovery_codes_remaining"`
+}
+
+// MFAEnrollment is a new TOTP secret to be added to an authenticator app
+type MFAEnrollment struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioning_uri"` // otpauth:// URI to render as a QR code
+}
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpCode computes the code of a secret for one time step (RFC 4226 truncation)
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// matchTOTP returns the time step a code is valid for, allowing for clock
+// skew. Steps at or before lastStep are refused so a code works only once.
+func matchTOTP(secret, code string, lastStep int64, now time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// provisioningURI builds the otpauth URI authenticator apps read from a QR code
+func provisioningURI(email, secret string) string {
+	label := url.PathEscape(MFASettings.Issuer + ":" + email)
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", MFASettings.Issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// normalizeMFACode strips the spaces and dashes people type into codes
+func normalizeMFACode(code string) string {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	return strings.NewReplacer(" ", "", "-", "").Replace(code)
+}
+
+// loadUserMFA returns a user's enrollment, or nil when there is none
+func loadUserMFA(tx *gorm.DB, userID uuid.UUID) (*database.UserMFA, error) {
+	var mfa database.UserMFA
+	err := tx.Where("user_id = ?", userID).First(&mfa).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load MFA enrollment: %v", err)
+	}
+	return &mfa, nil
+}
+
+// MFARequired reports whether an organization policy requires MFA for a user.
+// A policy applies to the organization that sets it and all its descendants.
+func MFARequired(userID uuid.UUID) (bool, error) {
+	var user database.User
+	if err := database.DB.Preload("Role").First(&user, "id = ?", userID).Error; err != nil {
+		return false, fmt.Errorf("failed to load user: %v", err)
+	}
+	if user.Role == nil || user.PrimaryOrgID == nil {
+		return false, nil
+	}
+	chain, err := OrganizationChain(*user.PrimaryOrgID)
+	if err != nil {
+		return false, err
+	}
+
+	var settings []database.OrganizationSettings
+	if err := database.DB.Where("org_id IN ?", chain).Find(&settings).Error; err != nil {
+		return false, fmt.Errorf("failed to load organization settings: %v", err)
+	}
+	for _, s := range settings {
+		var levels []int
+		if s.MFARequiredLevels == "" {
+			continue
+		}
+		if err := json.Unmarshal([]byte(s.MFARequiredLevels), &levels); err != nil {
+			log.Printf("⚠️ Invalid MFA policy on organization %s: %v", s.OrgID, err)
+			continue
+		}
+		for _, level := range levels {
+			if level == user.Role.Level {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// GetMFAStatus returns a user's multi-factor authentication status
+func GetMFAStatus(userID uuid.UUID) (*MFAStatus, error) {
+	status := &MFAStatus{}
+	mfa, err := loadUserMFA(database.DB, userID)
+	if err != nil {
+		return nil, err
+	}
+	if mfa != nil {
+		status.Enabled = mfa.ConfirmedAt != nil
+		status.Pending = mfa.ConfirmedAt == nil
+		status.ConfirmedAt = mfa.ConfirmedAt
+	}
+	if status.Enabled {
+		err := database.DB.Model(&database.MFARecoveryCode{}).Where("user_id = ? AND used_at IS NULL", userID).
+			Count(&status.RecoveryCodesRemaining).Error
+		if err != nil {
+			return nil, fmt.Errorf("failed to count recovery codes: %v", err)
+		}
+	}
+	if status.Required, err = MFARequired(userID); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// MFAEnabled reports whether a user has confirmed a TOTP enrollment
+func MFAEnabled(userID uuid.UUID) (bool, error) {
+	mfa, err := loadUserMFA(database.DB, userID)
+	if err != nil {
+		return false, err
+	}
+	return mfa != nil && mfa.ConfirmedAt != nil, nil
+}
+
+// StartMFAEnrollment creates a new TOTP secret for a user. It replaces an
+// unconfirmed one and takes effect once ConfirmMFAEnrollment accepts a code.
+func StartMFAEnrollment(userID uuid.UUID, email string) (*MFAEnrollment, error) {
+	mfa, err := loadUserMFA(database.DB, userID)
+	if err != nil {
+		return nil, err
+	}
+	if mfa != nil && mfa.ConfirmedAt != nil {
+		return nil, ErrMFAAlreadyEnrolled
+	}
+
+	key := make([]byte, 20)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate TOTP secret: %v", err)
+	}
+	secret := totpEncoding.EncodeToString(key)
+
+	if mfa == nil {
+		mfa = &database.UserMFA{UserID: userID}
+	}
+	mfa.Secret = secret
+	mfa.LastUsedStep = 0
+	if err := database.DB.Save(mfa).Error; err != nil {
+		return nil, fmt.Errorf("failed to save MFA enrollment: %v", err)
+	}
+
+	return &MFAEnrollment{Secret: secret, ProvisioningURI: provisioningURI(email, secret)}, nil
+}
+
+// ConfirmMFAEnrollment turns on a pending enrollment once the user proves the
+// authenticator works, and returns the user's recovery codes
+func ConfirmMFAEnrollment(userID uuid.UUID, code string) ([]string, error) {
+	var codes []string
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		mfa, err := loadUserMFA(tx, userID)
+		if err != nil {
+			return err
+		}
+		if mfa == nil {
+			return ErrMFAEnrollmentNeeded
+		}
+		if mfa.ConfirmedAt != nil {
+			return ErrMFAAlreadyEnrolled
+		}
+		step, ok := matchTOTP(mfa.Secret, normalizeMFACode(code), mfa.LastUsedStep, time.Now())
+		if !ok {
+			return ErrMFAInvalidCode
+		}
+		now := time.Now()
+		if err := tx.Model(mfa).Updates(map[string]interface{}{"confirmed_at": now, "last_used_step": step}).Error; err != nil {
+			return fmt.Errorf("failed to confirm MFA enrollment: %v", err)
+		}
+		codes, err = replaceRecoveryCodes(tx, userID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("🔐 MFA enabled for user %s", userID)
+	return codes, nil
+}
+
+// replaceRecoveryCodes discards a user's recovery codes and issues new ones
+func replaceRecoveryCodes(tx *gorm.DB, userID uuid.UUID) ([]string, error) {
+	if err := tx.Where("user_id = ?", userID).Delete(&database.MFARecoveryCode{}).Error; err != nil {
+		return nil, fmt.Errorf("failed to remove recovery codes: %v", err)
+	}
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		buf := make([]byte, 5)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, fmt.Errorf("failed to generate recovery code: %v", err)
+		}
+		raw := totpEncoding.EncodeToString(buf) // 8 characters
+		record := database.MFARecoveryCode{UserID: userID, CodeHash: hashToken(raw)}
+		if err := tx.Create(&record).Error; err != nil {
+			return nil, fmt.Errorf("failed to store recovery code: %v", err)
+		}
+		codes = append(codes, raw[:4]+"-"+raw[4:])
+	}
+	return codes, nil
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of a user with MFA enabled
+func RegenerateRecoveryCodes(userID uuid.UUID) ([]string, error) {
+	var codes []string
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		mfa, err := loadUserMFA(tx, userID)
+		if err != nil {
+			return err
+		}
+		if mfa == nil || mfa.ConfirmedAt == nil {
+			return ErrMFANotEnrolled
+		}
+		codes, err = replaceRecoveryCodes(tx, userID)
+		return err
+	})
+	return codes, err
+}
+
+// VerifyMFACode checks a TOTP code or an unused recovery code of a user with
+// MFA enabled. Each code is accepted once.
+func VerifyMFACode(userID uuid.UUID, code string) error {
+	mfa, err := loadUserMFA(database.DB, userID)
+	if err != nil {
+		return err
+	}
+	if mfa == nil || mfa.ConfirmedAt == nil {
+		return ErrMFANotEnrolled
+	}
+	code = normalizeMFACode(code)
+
+	if step, ok := matchTOTP(mfa.Secret, code, mfa.LastUsedStep, time.Now()); ok {
+		// Conditional on the last step so two requests cannot both use the code
+		result := database.DB.Model(&database.UserMFA{}).Where("id = ? AND last_used_step < ?", mfa.ID, step).
+			Update("last_used_step", step)
+		if result.Error != nil {
+			return fmt.Errorf("failed to record MFA code use: %v", result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return ErrMFAInvalidCode
+		}
+		return nil
+	}
+
+	result := database.DB.Model(&database.MFARecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, hashToken(code)).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return fmt.Errorf("failed to check recovery code: %v", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrMFAInvalidCode
+	}
+	log.Printf("🔐 Recovery code used by user %s", userID)
+	return nil
+}
+
+// DisableMFA removes a user's enrollment and recovery codes
+func DisableMFA(userID uuid.UUID) error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&database.MFARecoveryCode{}).Error; err != nil {
+			return fmt.Errorf("failed to remove recovery codes: %v", err)
+		}
+		if err := tx.Where("user_id = ?", userID).Delete(&database.UserMFA{}).Error; err != nil {
+			return fmt.Errorf("failed to remove MFA enrollment: %v", err)
+		}
+		return nil
+	})
+}
+
+// CreateMFAChallenge starts the second step of a login and returns its token
+func CreateMFAChallenge(userID uuid.UUID) (string, time.Time, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to generate challenge token: %v", err)
+	}
+	token := totpEncoding.EncodeToString(buf)
+
+	challenge := database.MFAChallenge{
+		UserID:    userID,
+		TokenHash: hashToken(token),
+		ExpiresAt: time.Now().Add(time.Duration(MFASettings.ChallengeMinutes) * time.Minute),
+	}
+	if err := database.DB.Create(&challenge).Error; err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to create login challenge: %v", err)
+	}
+	return token, challenge.ExpiresAt, nil
+}
+
+// LoadMFAChallenge returns an open login challenge
+func LoadMFAChallenge(token string) (*database.MFAChallenge, error) {
+	var challenge database.MFAChallenge
+	err := database.DB.Where("token_hash = ?", hashToken(token)).First(&challenge).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrMFAChallengeInvalid
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load login challenge: %v", err)
+	}
+	if challenge.UsedAt != nil || time.Now().After(challenge.ExpiresAt) || challenge.Attempts >= MFASettings.MaxChallengeAttempts {
+		return nil, ErrMFAChallengeInvalid
+	}
+	return &challenge, nil
+}
+
+// AnswerMFAChallenge completes a login challenge with a TOTP or recovery
+// code. A user who had to enroll during login confirms the enrollment with
+// the code, and the new recovery codes are returned. Wrong codes count
+// against the challenge's attempts.
+func AnswerMFAChallenge(token, code string) (uuid.UUID, []string, error) {
+	challenge, err := LoadMFAChallenge(token)
+	if err != nil {
+		return uuid.Nil, nil, err
+	}
+
+	enabled, err := MFAEnabled(challenge.UserID)
+	if err != nil {
+		return uuid.Nil, nil, err
+	}
+	var recoveryCodes []string
+	if enabled {
+		err = VerifyMFACode(challenge.UserID, code)
+	} else {
+		recoveryCodes, err = ConfirmMFAEnrollment(challenge.UserID, code)
+	}
+	if errors.Is(err, ErrMFAInvalidCode) {
+		if dbErr := database.DB.Model(challenge).Update("attempts", gorm.Expr("attempts + 1")).Error; dbErr != nil {
+			log.Printf("⚠️ Failed to count attempt on login challenge %s: %v", challenge.ID, dbErr)
+		}
+		return uuid.Nil, nil, err
+	}
+	if err != nil {
+		return uuid.Nil, nil, err
+	}
+
+	result := database.DB.Model(&database.MFAChallenge{}).Where("id = ? AND used_at IS NULL", challenge.ID).Update("used_at", time.Now())
+	if result.Error != nil {
+		return uuid.Nil, nil, fmt.Errorf("failed to complete login challenge: %v", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return uuid.Nil, nil, ErrMFAChallengeInvalid
+	}
+	return challenge.UserID, recoveryCodes, nil
+}
@@ -0,0 +1,75 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA1 test key of RFC 6238, base32 encoded
+var rfc6238Secret = totpEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B vectors, truncated to six digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tt := range tests {
+		if got := totpCode([]byte("12345678901234567890"), tt.unix/totpPeriod); got != tt.want {
+			t.Errorf("totpCode at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := now.Unix() / totpPeriod
+	key := []byte("12345678901234567890")
+
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		lastStep int64
+		wantStep int64
+		wantOK   bool
+	}{
+		{"current step", rfc6238Secret, totpCode(key, current), 0, current, true},
+		{"previous step within skew", rfc6238Secret, totpCode(key, current-1), 0, current - 1, true},
+		{"next step within skew", rfc6238Secret, totpCode(key, current+1), 0, current + 1, true},
+		{"outside skew", rfc6238Secret, totpCode(key, current-2), 0, 0, false},
+		{"replayed step", rfc6238Secret, totpCode(key, current), current, 0, false},
+		{"later step after a used one", rfc6238Secret, totpCode(key, current+1), current, current + 1, true},
+		{"wrong code", rfc6238Secret, "000000", 0, 0, false},
+		{"short code", rfc6238Secret, totpCode(key, current)[:5], 0, 0, false},
+		{"lowercase secret", "gezdgnbvgy3tqojqgezdgnbvgy3tqojq", totpCode(key, current), 0, current, true},
+		{"invalid secret", "not base32!", totpCode(key, current), 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := matchTOTP(tt.secret, tt.code, tt.lastStep, now)
+			if ok != tt.wantOK || step != tt.wantStep {
+				t.Errorf("matchTOTP = (%d, %v), want (%d, %v)", step, ok, tt.wantStep, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestNormalizeMFACode(t *testing.T) {
+	tests := map[string]string{
+		" 123 456 ":  "123456",
+		"abcd-efgh":  "ABCDEFGH",
+		"ABCD EFGH ": "ABCDEFGH",
+	}
+	for code, want := range tests {
+		if got := normalizeMFACode(code); got != want {
+			t.Errorf("normalizeMFACode(%q) = %q, want %q", code, got, want)
+		}
+	}
+}
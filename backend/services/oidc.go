@@ -0,0 +1,628 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"emailprojectv2/auth"
+	"emailprojectv2/config"
+	"emailprojectv2/database"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Errors for single sign-on logins that do not succeed
+var (
+	ErrSSONotConfigured = errors.New("single sign-on is not configured for this organization")
+	ErrSSOStateInvalid  = errors.New("single sign-on login is invalid or expired")
+	ErrSSOPasswordLogin = errors.New("this organization requires single sign-on")
+)
+
+// SSOLoginError is a login the identity provider completed but the
+// organization's SSO settings do not allow
+type SSOLoginError struct {
+	Message string
+}
+
+func (e *SSOLoginError) Error() string {
+	return e.Message
+}
+
+// SSOSettings holds the single sign-on settings
+var SSOSettings = config.SSOConfig{CallbackURL: "http://localhost:8081/auth/sso/callback", StateMinutes: 10}
+
+// ConfigureSSO replaces the single sign-on settings
+func ConfigureSSO(cfg config.SSOConfig) {
+	if cfg.StateMinutes < 1 {
+		cfg.StateMinutes = 10
+	}
+	cfg.FrontendURL = strings.TrimSuffix(cfg.FrontendURL, "/")
+	SSOSettings = cfg
+	log.Printf("🔐 SSO callback %s", cfg.CallbackURL)
+}
+
+// ssoMinRoleLevel is the most privileged role an identity provider can grant
+// in an organization of each type
+var ssoMinRoleLevel = map[string]int{"system": 1, "distributor": 2, "dealer": 3, "client": 4}
+
+// oidcHTTPClient talks to identity providers
+var oidcHTTPClient = &http.Client{Timeout: 15 * time.Second}
+
+// oidcProvider is the discovery document and signing keys of an issuer
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+}
+
+var (
+	oidcProvidersMu sync.Mutex
+	oidcProviders   = map[string]*oidcProvider{}
+)
+
+// oidcProviderTTL is how long discovery documents and keys are cached
+const oidcProviderTTL = time.Hour
+
+// getJSON fetches a JSON document from an identity provider
+func getJSON(ctx context.Context, endpoint string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned HTTP %d", endpoint, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(out)
+}
+
+// discoverProvider returns the cached provider of an issuer, fetching its
+// discovery document and keys when they are missing or stale, or when refresh
+// is set because a token was signed with an unknown key
+func discoverProvider(ctx context.Context, issuer string, refresh bool) (*oidcProvider, error) {
+	oidcProvidersMu.Lock()
+	defer oidcProvidersMu.Unlock()
+
+	if p, ok := oidcProviders[issuer]; ok && !refresh && time.Since(p.fetchedAt) < oidcProviderTTL {
+		return p, nil
+	}
+
+	p := &oidcProvider{}
+	if err := getJSON(ctx, strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", p); err != nil {
+		return nil, fmt.Errorf("failed to fetch OIDC discovery document: %v", err)
+	}
+	if p.Issuer != issuer {
+		return nil, fmt.Errorf("discovery document issuer %q does not match %q", p.Issuer, issuer)
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := getJSON(ctx, p.JWKSURI, &jwks); err != nil {
+		return nil, fmt.Errorf("failed to fetch OIDC signing keys: %v", err)
+	}
+	p.keys = map[string]*rsa.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil {
+			continue
+		}
+		p.keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	p.fetchedAt = time.Now()
+	oidcProviders[issuer] = p
+	return p, nil
+}
+
+// randomToken returns a URL-safe random string
+func randomToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// LoadOrganizationSSO returns the active SSO configuration of an organization
+func LoadOrganizationSSO(orgID uuid.UUID) (*database.OrganizationSSO, error) {
+	var sso database.OrganizationSSO
+	err := database.DB.Where("organization_id = ? AND is_active = ?", orgID, true).First(&sso).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrSSONotConfigured
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load SSO configuration: %v", err)
+	}
+	return &sso, nil
+}
+
+// FindSSOByEmail returns the active SSO configuration whose allowed domains
+// include the domain of an email address
+func FindSSOByEmail(email string) (*database.OrganizationSSO, error) {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return nil, ErrSSONotConfigured
+	}
+	domain, _ := json.Marshal([]string{strings.ToLower(email[at+1:])})
+
+	var sso database.OrganizationSSO
+	err := database.DB.Where("is_active = ? AND allowed_domains @> ?::jsonb", true, string(domain)).First(&sso).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrSSONotConfigured
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find SSO configuration: %v", err)
+	}
+	return &sso, nil
+}
+
+// PasswordLoginDisabled reports whether a user's organization requires them
+// to sign in through its identity provider
+func PasswordLoginDisabled(user *database.User) (bool, error) {
+	if user.PrimaryOrgID == nil {
+		return false, nil
+	}
+	var count int64
+	err := database.DB.Model(&database.OrganizationSSO{}).
+		Where("organization_id = ? AND is_active = ? AND disable_password_login = ?", *user.PrimaryOrgID, true, true).
+		Count(&count).Error
+	if err != nil {
+		return false, fmt.Errorf("failed to check SSO configuration: %v", err)
+	}
+	return count > 0, nil
+}
+
+// StartSSOLogin records a new login for an organization and returns the
+// identity provider URL to send the browser to
+func StartSSOLogin(ctx context.Context, orgID uuid.UUID) (string, error) {
+	sso, err := LoadOrganizationSSO(orgID)
+	if err != nil {
+		return "", err
+	}
+	provider, err := discoverProvider(ctx, sso.Issuer, false)
+	if err != nil {
+		return "", err
+	}
+
+	state, err := randomToken()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate SSO state: %v", err)
+	}
+	nonce, err := randomToken()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate SSO nonce: %v", err)
+	}
+	verifier, err := randomToken()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate PKCE verifier: %v", err)
+	}
+
+	login := database.SSOLoginState{
+		OrganizationID: orgID,
+		StateHash:      hashToken(state),
+		Nonce:          nonce,
+		CodeVerifier:   verifier,
+		ExpiresAt:      time.Now().Add(time.Duration(SSOSettings.StateMinutes) * time.Minute),
+	}
+	if err := database.DB.Create(&login).Error; err != nil {
+		return "", fmt.Errorf("failed to record SSO login: %v", err)
+	}
+
+	return authorizationURL(provider, sso, state, nonce, verifier), nil
+}
+
+// authorizationURL builds the request that sends the browser to the identity
+// provider, with the PKCE challenge of the verifier
+func authorizationURL(provider *oidcProvider, sso *database.OrganizationSSO, state, nonce, verifier string) string {
+	challenge := sha256.Sum256([]byte(verifier))
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", sso.ClientID)
+	params.Set("redirect_uri", SSOSettings.CallbackURL)
+	params.Set("scope", sso.Scopes)
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	params.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(provider.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return provider.AuthorizationEndpoint + separator + params.Encode()
+}
+
+// checkSSOLoginState refuses a login whose state was already used or expired
+func checkSSOLoginState(login *database.SSOLoginState, now time.Time) error {
+	if login.CallbackAt != nil || now.After(login.ExpiresAt) {
+		return ErrSSOStateInvalid
+	}
+	return nil
+}
+
+// exchangeCode trades an authorization code for the provider's ID token
+func exchangeCode(ctx context.Context, provider *oidcProvider, sso *database.OrganizationSSO, code, verifier string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", SSOSettings.CallbackURL)
+	form.Set("code_verifier", verifier)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(sso.ClientID), url.QueryEscape(sso.ClientSecret))
+
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to call token endpoint: %v", err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return "", fmt.Errorf("failed to read token response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || body.IDToken == "" {
+		return "", fmt.Errorf("token endpoint returned HTTP %d: %s %s", resp.StatusCode, body.Error, body.ErrorDescription)
+	}
+	return body.IDToken, nil
+}
+
+// verifyIDToken checks the signature, issuer, audience, expiry and nonce of
+// an ID token and returns its claims
+func verifyIDToken(ctx context.Context, sso *database.OrganizationSSO, rawToken, nonce string) (jwt.MapClaims, error) {
+	keyFunc := func(refresh bool) jwt.Keyfunc {
+		return func(token *jwt.Token) (interface{}, error) {
+			provider, err := discoverProvider(ctx, sso.Issuer, refresh)
+			if err != nil {
+				return nil, err
+			}
+			kid, _ := token.Header["kid"].(string)
+			if key, ok := provider.keys[kid]; ok {
+				return key, nil
+			}
+			if kid == "" && len(provider.keys) == 1 {
+				for _, key := range provider.keys {
+					return key, nil
+				}
+			}
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+	}
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"RS256"}),
+		jwt.WithIssuer(sso.Issuer),
+		jwt.WithAudience(sso.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(time.Minute),
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(rawToken, claims, keyFunc(false), options...)
+	if err != nil && errors.Is(err, jwt.ErrTokenUnverifiable) {
+		// The provider may have rotated its keys since they were cached
+		claims = jwt.MapClaims{}
+		_, err = jwt.ParseWithClaims(rawToken, claims, keyFunc(true), options...)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token: %v", err)
+	}
+	if got, _ := claims["nonce"].(string); got != nonce {
+		return nil, errors.New("invalid ID token: nonce mismatch")
+	}
+	return claims, nil
+}
+
+// claimValues returns a claim as a list of strings, whether the provider sent
+// a single value or an array
+func claimValues(claims jwt.MapClaims, name string) []string {
+	switch v := claims[name].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// mapSSORole picks the role for an identity: the most privileged mapped role
+// among the claim values, or the default role
+func mapSSORole(sso *database.OrganizationSSO, claims jwt.MapClaims) (*database.Role, error) {
+	mapping := map[string]string{}
+	if sso.RoleMapping != "" {
+		if err := json.Unmarshal([]byte(sso.RoleMapping), &mapping); err != nil {
+			return nil, fmt.Errorf("failed to parse SSO role mapping: %v", err)
+		}
+	}
+	names := []string{}
+	for _, value := range claimValues(claims, sso.RoleClaim) {
+		if name, ok := mapping[value]; ok {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 && sso.DefaultRole != "" {
+		names = append(names, sso.DefaultRole)
+	}
+	if len(names) == 0 {
+		return nil, &SSOLoginError{Message: "your identity provider account is not assigned a role in this organization"}
+	}
+
+	var roles []database.Role
+	if err := database.DB.Where("name IN ?", names).Order("level ASC").Find(&roles).Error; err != nil {
+		return nil, fmt.Errorf("failed to load roles: %v", err)
+	}
+	if len(roles) == 0 {
+		return nil, &SSOLoginError{Message: "the role mapped by your identity provider does not exist"}
+	}
+	return &roles[0], nil
+}
+
+// ValidateSSORole checks that an identity provider may grant a role in an organization
+func ValidateSSORole(org *database.Organization, roleName string) error {
+	var role database.Role
+	if err := database.DB.Where("name = ?", roleName).First(&role).Error; err != nil {
+		return fmt.Errorf("unknown role %q", roleName)
+	}
+	if role.Level < ssoMinRoleLevel[org.Type] {
+		return fmt.Errorf("role %q cannot be granted in a %s organization", roleName, org.Type)
+	}
+	return nil
+}
+
+// CompleteSSOLogin finishes a login when the identity provider redirects
+// back: it checks the state, exchanges the code, verifies the ID token and
+// finds or provisions the user. It returns the user and a one-time code the
+// frontend redeems for tokens.
+func CompleteSSOLogin(ctx context.Context, state, code string) (*database.User, string, error) {
+	var login database.SSOLoginState
+	err := database.DB.Where("state_hash = ?", hashToken(state)).First(&login).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, "", ErrSSOStateInvalid
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to load SSO login: %v", err)
+	}
+	if err := checkSSOLoginState(&login, time.Now()); err != nil {
+		return nil, "", err
+	}
+	// The state is single use, even when the rest of the login fails
+	result := database.DB.Model(&database.SSOLoginState{}).Where("id = ? AND callback_at IS NULL", login.ID).Update("callback_at", time.Now())
+	if result.Error != nil {
+		return nil, "", fmt.Errorf("failed to update SSO login: %v", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return nil, "", ErrSSOStateInvalid
+	}
+
+	sso, err := LoadOrganizationSSO(login.OrganizationID)
+	if err != nil {
+		return nil, "", err
+	}
+	provider, err := discoverProvider(ctx, sso.Issuer, false)
+	if err != nil {
+		return nil, "", err
+	}
+	rawToken, err := exchangeCode(ctx, provider, sso, code, login.CodeVerifier)
+	if err != nil {
+		return nil, "", err
+	}
+	claims, err := verifyIDToken(ctx, sso, rawToken, login.Nonce)
+	if err != nil {
+		return nil, "", err
+	}
+
+	email, _ := claims[sso.EmailClaim].(string)
+	email = strings.ToLower(strings.TrimSpace(email))
+	if email == "" || !strings.Contains(email, "@") {
+		return nil, "", &SSOLoginError{Message: "identity provider did not return an email address"}
+	}
+	if verified, ok := claims["email_verified"].(bool); ok && !verified {
+		return nil, "", &SSOLoginError{Message: "email address is not verified by the identity provider"}
+	}
+	var domains []string
+	json.Unmarshal([]byte(sso.AllowedDomains), &domains)
+	if len(domains) > 0 {
+		domain := email[strings.LastIndex(email, "@")+1:]
+		allowed := false
+		for _, d := range domains {
+			if strings.EqualFold(d, domain) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return nil, "", &SSOLoginError{Message: "email domain is not allowed for this organization"}
+		}
+	}
+
+	role, err := mapSSORole(sso, claims)
+	if err != nil {
+		return nil, "", err
+	}
+	var org database.Organization
+	if err := database.DB.First(&org, "id = ?", sso.OrganizationID).Error; err != nil {
+		return nil, "", fmt.Errorf("failed to load organization: %v", err)
+	}
+	if err := ValidateSSORole(&org, role.Name); err != nil {
+		return nil, "", &SSOLoginError{Message: err.Error()}
+	}
+
+	user, err := provisionSSOUser(sso, &org, email, role)
+	if err != nil {
+		return nil, "", err
+	}
+
+	loginCode, err := randomToken()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to generate login code: %v", err)
+	}
+	err = database.DB.Model(&database.SSOLoginState{}).Where("id = ?", login.ID).
+		Updates(map[string]interface{}{"user_id": user.ID, "login_code_hash": hashToken(loginCode)}).Error
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to update SSO login: %v", err)
+	}
+	return user, loginCode, nil
+}
+
+// provisionSSOUser finds the user with an email in the SSO organization, or
+// creates them there when just-in-time provisioning is on. The role from the
+// identity provider replaces the user's role in the organization; if it
+// changed, the user's existing sessions are ended.
+func provisionSSOUser(sso *database.OrganizationSSO, org *database.Organization, email string, role *database.Role) (*database.User, error) {
+	var user database.User
+	err := database.DB.Preload("Role").Where("LOWER(email) = ?", email).First(&user).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("failed to load user: %v", err)
+	}
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		if !sso.JITProvisioning {
+			return nil, &SSOLoginError{Message: "no account exists for " + email}
+		}
+		if _, err := CheckQuota(sso.OrganizationID, QuotaUsers, 1); err != nil {
+			return nil, err
+		}
+
+		// SSO users have no usable password
+		secret, err := randomToken()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate password: %v", err)
+		}
+		hash, err := auth.HashPassword(secret)
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash password: %v", err)
+		}
+		user = database.User{Email: email, PasswordHash: hash, RoleID: &role.ID, PrimaryOrgID: &sso.OrganizationID}
+		err = database.DB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(&user).Error; err != nil {
+				return fmt.Errorf("failed to create user: %v", err)
+			}
+			membership := database.UserOrganization{UserID: user.ID, OrganizationID: sso.OrganizationID, RoleID: role.ID, IsPrimary: true}
+			if err := tx.Create(&membership).Error; err != nil {
+				return fmt.Errorf("failed to add user to organization: %v", err)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("👤 Provisioned SSO user %s in organization %s as %s", email, sso.OrganizationID, role.Name)
+		return &user, nil
+	}
+
+	if user.DisabledAt != nil {
+		return nil, &SSOLoginError{Message: "your account is disabled"}
+	}
+
+	// Existing users must have the organization as their primary one, since
+	// the session starts there, and hold a role its identity provider could
+	// grant; it cannot take over accounts of other organizations or above it
+	var membership database.UserOrganization
+	err = database.DB.Where("user_id = ? AND organization_id = ?", user.ID, sso.OrganizationID).First(&membership).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && !membership.IsPrimary) {
+		return nil, &SSOLoginError{Message: "your account does not belong to this organization"}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load membership: %v", err)
+	}
+	if user.Role == nil || user.Role.Level < ssoMinRoleLevel[org.Type] {
+		return nil, &SSOLoginError{Message: "your role cannot sign in through this organization's identity provider"}
+	}
+
+	if membership.RoleID != role.ID {
+		err = database.DB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(&membership).Update("role_id", role.ID).Error; err != nil {
+				return fmt.Errorf("failed to update membership role: %v", err)
+			}
+			if err := tx.Model(&user).Update("role_id", role.ID).Error; err != nil {
+				return fmt.Errorf("failed to update user role: %v", err)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := RevokeUserSessions(user.ID, SessionRevokedRole); err != nil {
+			return nil, err
+		}
+		log.Printf("👤 SSO login changed role of %s in organization %s to %s", email, sso.OrganizationID, role.Name)
+	}
+	return &user, nil
+}
+
+// RedeemSSOLoginCode exchanges the one-time code of a completed SSO login
+// for the user it signed in
+func RedeemSSOLoginCode(code string) (uuid.UUID, error) {
+	var login database.SSOLoginState
+	err := database.DB.Where("login_code_hash = ?", hashToken(code)).First(&login).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return uuid.Nil, ErrSSOStateInvalid
+	}
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to load SSO login: %v", err)
+	}
+	if login.UserID == nil || login.RedeemedAt != nil || time.Now().After(login.ExpiresAt) {
+		return uuid.Nil, ErrSSOStateInvalid
+	}
+	result := database.DB.Model(&database.SSOLoginState{}).Where("id = ? AND redeemed_at IS NULL", login.ID).Update("redeemed_at", time.Now())
+	if result.Error != nil {
+		return uuid.Nil, fmt.Errorf("failed to redeem SSO login: %v", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return uuid.Nil, ErrSSOStateInvalid
+	}
+	return *login.UserID, nil
+}
+
+// CheckSSOIssuer fetches an issuer's discovery document and keys so a
+// misconfigured provider is reported when it is saved rather than at login
+func CheckSSOIssuer(ctx context.Context, issuer string) error {
+	_, err := discoverProvider(ctx, issuer, true)
+	return err
+}
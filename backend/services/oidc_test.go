@@ -0,0 +1,271 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"emailprojectv2/database"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// testIdP is an identity provider that issues ID tokens for the codes it is told about
+type testIdP struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	keyID  string
+
+	mu       sync.Mutex
+	codes    map[string]string // Code to PKCE challenge
+	lastForm url.Values
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	idp := &testIdP{key: key, keyID: "key-1", codes: map[string]string{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		idp.mu.Lock()
+		pub, kid := idp.key.PublicKey, idp.keyID
+		idp.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": kid,
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		idp.mu.Lock()
+		idp.lastForm = r.PostForm
+		challenge, found := idp.codes[r.PostForm.Get("code")]
+		delete(idp.codes, r.PostForm.Get("code"))
+		idp.mu.Unlock()
+
+		clientID, secret, _ := r.BasicAuth()
+		verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if clientID != "backup" || secret != "s3cret" || !found || base64.RawURLEncoding.EncodeToString(verifier[:]) != challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idp.sign(t, idp.claims("nonce-1"))})
+	})
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+// claims returns valid ID token claims for the test client
+func (idp *testIdP) claims(nonce string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":   idp.server.URL,
+		"aud":   "backup",
+		"sub":   "user-1",
+		"exp":   time.Now().Add(5 * time.Minute).Unix(),
+		"iat":   time.Now().Unix(),
+		"nonce": nonce,
+		"email": "sso.user@example.com",
+	}
+}
+
+func (idp *testIdP) sign(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = idp.keyID
+	raw, err := token.SignedString(idp.key)
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	return raw
+}
+
+func (idp *testIdP) sso() *database.OrganizationSSO {
+	return &database.OrganizationSSO{Issuer: idp.server.URL, ClientID: "backup", ClientSecret: "s3cret", Scopes: "openid email"}
+}
+
+func TestAuthorizationURL(t *testing.T) {
+	idp := newTestIdP(t)
+	provider, err := discoverProvider(context.Background(), idp.server.URL, false)
+	if err != nil {
+		t.Fatalf("discoverProvider: %v", err)
+	}
+
+	target, err := url.Parse(authorizationURL(provider, idp.sso(), "state-1", "nonce-1", "verifier-1"))
+	if err != nil {
+		t.Fatalf("invalid authorization URL: %v", err)
+	}
+	challenge := sha256.Sum256([]byte("verifier-1"))
+	want := map[string]string{
+		"response_type":         "code",
+		"client_id":             "backup",
+		"redirect_uri":          SSOSettings.CallbackURL,
+		"scope":                 "openid email",
+		"state":                 "state-1",
+		"nonce":                 "nonce-1",
+		"code_challenge":        base64.RawURLEncoding.EncodeToString(challenge[:]),
+		"code_challenge_method": "S256",
+	}
+	if target.Path != "/authorize" {
+		t.Errorf("path = %s, want /authorize", target.Path)
+	}
+	for name, value := range want {
+		if got := target.Query().Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+}
+
+func TestExchangeCode(t *testing.T) {
+	idp := newTestIdP(t)
+	ctx := context.Background()
+	provider, err := discoverProvider(ctx, idp.server.URL, false)
+	if err != nil {
+		t.Fatalf("discoverProvider: %v", err)
+	}
+	challenge := sha256.Sum256([]byte("verifier-1"))
+	idp.codes["code-1"] = base64.RawURLEncoding.EncodeToString(challenge[:])
+
+	if _, err := exchangeCode(ctx, provider, idp.sso(), "code-1", "wrong-verifier"); err == nil {
+		t.Fatal("exchangeCode accepted a wrong PKCE verifier")
+	}
+
+	idp.codes["code-1"] = base64.RawURLEncoding.EncodeToString(challenge[:])
+	rawToken, err := exchangeCode(ctx, provider, idp.sso(), "code-1", "verifier-1")
+	if err != nil {
+		t.Fatalf("exchangeCode: %v", err)
+	}
+	if form := idp.lastForm; form.Get("grant_type") != "authorization_code" || form.Get("redirect_uri") != SSOSettings.CallbackURL {
+		t.Errorf("unexpected token request %v", form)
+	}
+	if _, err := verifyIDToken(ctx, idp.sso(), rawToken, "nonce-1"); err != nil {
+		t.Errorf("verifyIDToken of exchanged token: %v", err)
+	}
+
+	// Codes are single use
+	if _, err := exchangeCode(ctx, provider, idp.sso(), "code-1", "verifier-1"); err == nil {
+		t.Error("exchangeCode redeemed a code twice")
+	}
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	idp := newTestIdP(t)
+	ctx := context.Background()
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		token   func() string
+		nonce   string
+		wantErr bool
+	}{
+		{"valid", func() string { return idp.sign(t, idp.claims("nonce-1")) }, "nonce-1", false},
+		{"nonce mismatch", func() string { return idp.sign(t, idp.claims("nonce-2")) }, "nonce-1", true},
+		{"missing nonce", func() string {
+			claims := idp.claims("")
+			delete(claims, "nonce")
+			return idp.sign(t, claims)
+		}, "nonce-1", true},
+		{"other audience", func() string {
+			claims := idp.claims("nonce-1")
+			claims["aud"] = "someone-else"
+			return idp.sign(t, claims)
+		}, "nonce-1", true},
+		{"other issuer", func() string {
+			claims := idp.claims("nonce-1")
+			claims["iss"] = "https://evil.example.com"
+			return idp.sign(t, claims)
+		}, "nonce-1", true},
+		{"expired", func() string {
+			claims := idp.claims("nonce-1")
+			claims["exp"] = time.Now().Add(-10 * time.Minute).Unix()
+			return idp.sign(t, claims)
+		}, "nonce-1", true},
+		{"no expiry", func() string {
+			claims := idp.claims("nonce-1")
+			delete(claims, "exp")
+			return idp.sign(t, claims)
+		}, "nonce-1", true},
+		{"signed by another key", func() string {
+			token := jwt.NewWithClaims(jwt.SigningMethodRS256, idp.claims("nonce-1"))
+			token.Header["kid"] = idp.keyID
+			raw, _ := token.SignedString(otherKey)
+			return raw
+		}, "nonce-1", true},
+		{"hmac signed", func() string {
+			raw, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, idp.claims("nonce-1")).SignedString([]byte("s3cret"))
+			return raw
+		}, "nonce-1", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := verifyIDToken(ctx, idp.sso(), tt.token(), tt.nonce)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verifyIDToken error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// A rotated key is fetched again instead of failing on the cached keys
+	idp.mu.Lock()
+	idp.key, idp.keyID = otherKey, "key-2"
+	idp.mu.Unlock()
+	if _, err := verifyIDToken(ctx, idp.sso(), idp.sign(t, idp.claims("nonce-1")), "nonce-1"); err != nil {
+		t.Errorf("verifyIDToken after key rotation: %v", err)
+	}
+}
+
+func TestCheckSSOLoginState(t *testing.T) {
+	now := time.Now()
+	used := now.Add(-time.Minute)
+	tests := []struct {
+		name  string
+		login database.SSOLoginState
+		want  error
+	}{
+		{"open", database.SSOLoginState{ExpiresAt: now.Add(time.Minute)}, nil},
+		{"expired", database.SSOLoginState{ExpiresAt: now.Add(-time.Second)}, ErrSSOStateInvalid},
+		{"already used", database.SSOLoginState{ExpiresAt: now.Add(time.Minute), CallbackAt: &used}, ErrSSOStateInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkSSOLoginState(&tt.login, now); !errors.Is(err, tt.want) {
+				t.Errorf("checkSSOLoginState = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+
+	"emailprojectv2/database"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// OrganizationSubtree returns the organization and all of its descendants
+func OrganizationSubtree(orgID uuid.UUID) ([]uuid.UUID, error) {
+	ids := []uuid.UUID{orgID}
+	seen := map[uuid.UUID]bool{orgID: true}
+	frontier := []uuid.UUID{orgID}
+
+	for len(frontier) > 0 {
+		var children []uuid.UUID
+		if err := database.DB.Model(&database.Organization{}).Where("parent_org_id IN ?", frontier).Pluck("id", &children).Error; err != nil {
+			return nil, fmt.Errorf("failed to load child organizations: %v", err)
+		}
+
+		frontier = nil
+		for _, child := range children {
+			if !seen[child] {
+				seen[child] = true
+				ids = append(ids, child)
+				frontier = append(frontier, child)
+			}
+		}
+	}
+
+	return ids, nil
+}
+
+// OrganizationChain returns the organization followed by its ancestors up to the root
+func OrganizationChain(orgID uuid.UUID) ([]uuid.UUID, error) {
+	var chain []uuid.UUID
+	seen := map[uuid.UUID]bool{}
+	current := &orgID
+	for current != nil && !seen[*current] {
+		seen[*current] = true
+		chain = append(chain, *current)
+
+		var org database.Organization
+		if err := database.DB.Select("id", "parent_org_id").First(&org, "id = ?", *current).Error; err != nil {
+			return nil, fmt.Errorf("failed to load organization: %v", err)
+		}
+		current = org.ParentOrgID
+	}
+	return chain, nil
+}
+
+// OrganizationWithin reports whether an organization is the given ancestor or one of its descendants
+func OrganizationWithin(orgID, ancestorID uuid.UUID) (bool, error) {
+	chain, err := OrganizationChain(orgID)
+	if err != nil {
+		return false, err
+	}
+	for _, id := range chain {
+		if id == ancestorID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// UserOrganizationID returns the organization a user belongs to: the primary
+// organization, otherwise the first membership. It is nil for users without one.
+func UserOrganizationID(userID uuid.UUID) (*uuid.UUID, error) {
+	var user database.User
+	if err := database.DB.Select("id", "primary_org_id").First(&user, "id = ?", userID).Error; err != nil {
+		return nil, fmt.Errorf("failed to load user: %v", err)
+	}
+	if user.PrimaryOrgID != nil {
+		return user.PrimaryOrgID, nil
+	}
+
+	var membership database.UserOrganization
+	err := database.DB.Where("user_id = ?", userID).Order("is_primary DESC, joined_at ASC").First(&membership).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load user organization: %v", err)
+	}
+	return &membership.OrganizationID, nil
+}
+
+// AccountOrganizationID returns the organization of the user owning an email account
+func AccountOrganizationID(accountID uuid.UUID) (*uuid.UUID, error) {
+	var account database.EmailAccount
+	if err := database.DB.Select("id", "user_id").First(&account, "id = ?", accountID).Error; err != nil {
+		return nil, fmt.Errorf("failed to load account: %v", err)
+	}
+	return UserOrganizationID(account.UserID)
+}
+
+// OrganizationUserIDs returns the users belonging to any of the given organizations
+func OrganizationUserIDs(orgIDs []uuid.UUID) ([]uuid.UUID, error) {
+	var ids []uuid.UUID
+	members := database.DB.Model(&database.UserOrganization{}).Select("user_id").Where("organization_id IN ?", orgIDs)
+	err := database.DB.Model(&database.User{}).
+		Where("primary_org_id IN ? OR id IN (?)", orgIDs, members).
+		Pluck("id", &ids).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to load organization users: %v", err)
+	}
+	return ids, nil
+}
+
+// OrganizationAccountIDs returns the email accounts of users in the organization and its descendants
+func OrganizationAccountIDs(orgID uuid.UUID) ([]uuid.UUID, error) {
+	orgIDs, err := OrganizationSubtree(orgID)
+	if err != nil {
+		return nil, err
+	}
+	userIDs, err := OrganizationUserIDs(orgIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []uuid.UUID
+	if len(userIDs) == 0 {
+		return ids, nil
+	}
+	if err := database.DB.Model(&database.EmailAccount{}).Where("user_id IN ?", userIDs).Pluck("id", &ids).Error; err != nil {
+		return nil, fmt.Errorf("failed to load organization accounts: %v", err)
+	}
+	return ids, nil
+}
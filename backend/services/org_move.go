@@ -0,0 +1,286 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"emailprojectv2/database"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Errors for organization moves and merges that are the caller's to fix
+var (
+	ErrOrgMoveCycle      = errors.New("an organization cannot be moved under itself or one of its descendants")
+	ErrOrgMoveSystem     = errors.New("the system organization cannot be moved")
+	ErrOrgMoveSameParent = errors.New("the organization is already under this parent")
+	ErrOrgMergeSame      = errors.New("an organization cannot be merged into itself")
+	ErrOrgMergeType      = errors.New("only client organizations can be merged")
+	ErrOrgMergeChildren  = errors.New("an organization with child organizations cannot be merged")
+)
+
+// OrgHierarchyError is a move or merge that the hierarchy rules or an active legal hold do not allow
+type OrgHierarchyError struct {
+	Message string
+}
+
+func (e *OrgHierarchyError) Error() string {
+	return e.Message
+}
+
+// orgTypeRank orders the organization types from the top of the hierarchy
+var orgTypeRank = map[string]int{"system": 0, "distributor": 1, "dealer": 2, "client": 3}
+
+// OrgMoveResult describes a completed move
+type OrgMoveResult struct {
+	OrganizationID uuid.UUID      `json:"organization_id"`
+	OldParentID    *uuid.UUID     `json:"old_parent_id,omitempty"`
+	NewParentID    uuid.UUID      `json:"new_parent_id"`
+	SubtreeSize    int            `json:"subtree_size"`
+	Warnings       []QuotaWarning `json:"quota_warnings,omitempty"`
+}
+
+// OrgMergeResult describes a completed merge
+type OrgMergeResult struct {
+	SourceID      uuid.UUID      `json:"source_id"`
+	TargetID      uuid.UUID      `json:"target_id"`
+	UsersMoved    int            `json:"users_moved"`
+	AccountsMoved int            `json:"accounts_moved"`
+	Warnings      []QuotaWarning `json:"quota_warnings,omitempty"`
+}
+
+// chainDifference returns the organizations of chain that are not in other
+func chainDifference(chain, other []uuid.UUID) []uuid.UUID {
+	skip := make(map[uuid.UUID]bool, len(other))
+	for _, id := range other {
+		skip[id] = true
+	}
+	var diff []uuid.UUID
+	for _, id := range chain {
+		if !skip[id] {
+			diff = append(diff, id)
+		}
+	}
+	return diff
+}
+
+// checkJoinQuotas checks that the limits of the organizations being joined
+// have room for the usage of the subtree rooted at orgID
+func checkJoinQuotas(orgID uuid.UUID, joining []uuid.UUID) ([]QuotaWarning, error) {
+	warnings := []QuotaWarning{}
+	if len(joining) == 0 {
+		return warnings, nil
+	}
+	for _, resource := range []string{QuotaUsers, QuotaEmailAccounts, QuotaStorage} {
+		usage, err := subtreeUsage(orgID, resource)
+		if err != nil {
+			return nil, err
+		}
+		resourceWarnings, err := checkChainQuota(joining, resource, usage)
+		if err != nil {
+			return nil, err
+		}
+		warnings = append(warnings, resourceWarnings...)
+	}
+	return warnings, nil
+}
+
+// checkHoldsKept refuses a change that takes an organization out of the scope
+// of an active organization legal hold placed on one of the organizations it leaves
+func checkHoldsKept(leaving []uuid.UUID) error {
+	if len(leaving) == 0 {
+		return nil
+	}
+	var hold database.LegalHold
+	err := database.DB.Where("status = ? AND target_type = ? AND organization_id IN ?", HoldStatusActive, HoldTargetOrganization, leaving).
+		First(&hold).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check legal holds: %v", err)
+	}
+	return &OrgHierarchyError{Message: fmt.Sprintf("legal hold %q on organization %s would no longer cover the moved data; release it first", hold.CaseName, *hold.OrganizationID)}
+}
+
+// MoveOrganization re-parents an organization together with its whole
+// subtree. The new parent must rank above the organization and lie outside
+// its subtree, and the limits of the new ancestors must have room for the
+// subtree's usage.
+func MoveOrganization(orgID, newParentID uuid.UUID) (*OrgMoveResult, error) {
+	var org, parent database.Organization
+	if err := database.DB.First(&org, "id = ?", orgID).Error; err != nil {
+		return nil, fmt.Errorf("failed to load organization: %v", err)
+	}
+	if err := database.DB.First(&parent, "id = ?", newParentID).Error; err != nil {
+		return nil, fmt.Errorf("failed to load new parent organization: %v", err)
+	}
+	if org.IsSystem() {
+		return nil, ErrOrgMoveSystem
+	}
+	if org.ParentOrgID != nil && *org.ParentOrgID == newParentID {
+		return nil, ErrOrgMoveSameParent
+	}
+	if orgTypeRank[parent.Type] >= orgTypeRank[org.Type] {
+		return nil, &OrgHierarchyError{Message: fmt.Sprintf("a %s cannot be placed under a %s", org.Type, parent.Type)}
+	}
+
+	newChain, err := OrganizationChain(newParentID)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range newChain {
+		if id == orgID {
+			return nil, ErrOrgMoveCycle
+		}
+	}
+	var oldChain []uuid.UUID
+	if org.ParentOrgID != nil {
+		if oldChain, err = OrganizationChain(*org.ParentOrgID); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := checkHoldsKept(chainDifference(oldChain, newChain)); err != nil {
+		return nil, err
+	}
+	warnings, err := checkJoinQuotas(orgID, chainDifference(newChain, oldChain))
+	if err != nil {
+		return nil, err
+	}
+
+	subtree, err := OrganizationSubtree(orgID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Re-check for a cycle under row locks so that concurrent moves cannot create one
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		var locked []database.Organization
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id IN ?", []uuid.UUID{orgID, newParentID}).Find(&locked).Error; err != nil {
+			return fmt.Errorf("failed to lock organizations: %v", err)
+		}
+
+		current := &newParentID
+		seen := map[uuid.UUID]bool{}
+		for current != nil && !seen[*current] {
+			if *current == orgID {
+				return ErrOrgMoveCycle
+			}
+			seen[*current] = true
+			var ancestor database.Organization
+			if err := tx.Select("id", "parent_org_id").First(&ancestor, "id = ?", *current).Error; err != nil {
+				return fmt.Errorf("failed to load organization: %v", err)
+			}
+			current = ancestor.ParentOrgID
+		}
+
+		result := tx.Model(&database.Organization{}).Where("id = ?", orgID).Update("parent_org_id", newParentID)
+		if result.Error != nil {
+			return fmt.Errorf("failed to move organization: %v", result.Error)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("🏢 Moved organization %s (%d in subtree) under %s", orgID, len(subtree), newParentID)
+	return &OrgMoveResult{
+		OrganizationID: orgID,
+		OldParentID:    org.ParentOrgID,
+		NewParentID:    newParentID,
+		SubtreeSize:    len(subtree),
+		Warnings:       warnings,
+	}, nil
+}
+
+// MergeOrganization folds the users of one client organization, and with them
+// their email accounts, into another. Users keep their role; a user who is
+// already a member of the target keeps that membership. The source is
+// deactivated rather than deleted so its history stays attributable.
+func MergeOrganization(sourceID, targetID uuid.UUID) (*OrgMergeResult, error) {
+	if sourceID == targetID {
+		return nil, ErrOrgMergeSame
+	}
+	var source, target database.Organization
+	if err := database.DB.First(&source, "id = ?", sourceID).Error; err != nil {
+		return nil, fmt.Errorf("failed to load organization: %v", err)
+	}
+	if err := database.DB.First(&target, "id = ?", targetID).Error; err != nil {
+		return nil, fmt.Errorf("failed to load target organization: %v", err)
+	}
+	if !source.IsClient() || !target.IsClient() {
+		return nil, ErrOrgMergeType
+	}
+	var children int64
+	if err := database.DB.Model(&database.Organization{}).Where("parent_org_id = ?", sourceID).Count(&children).Error; err != nil {
+		return nil, fmt.Errorf("failed to count child organizations: %v", err)
+	}
+	if children > 0 {
+		return nil, ErrOrgMergeChildren
+	}
+
+	sourceChain, err := OrganizationChain(sourceID)
+	if err != nil {
+		return nil, err
+	}
+	targetChain, err := OrganizationChain(targetID)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkHoldsKept(chainDifference(sourceChain, targetChain)); err != nil {
+		return nil, err
+	}
+	warnings, err := checkJoinQuotas(sourceID, chainDifference(targetChain, sourceChain))
+	if err != nil {
+		return nil, err
+	}
+
+	userIDs, err := OrganizationUserIDs([]uuid.UUID{sourceID})
+	if err != nil {
+		return nil, err
+	}
+	accountIDs, err := OrganizationAccountIDs(sourceID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		var locked []database.Organization
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id IN ?", []uuid.UUID{sourceID, targetID}).Find(&locked).Error; err != nil {
+			return fmt.Errorf("failed to lock organizations: %v", err)
+		}
+
+		// Memberships of users already in the target are dropped, the rest move over
+		existing := tx.Model(&database.UserOrganization{}).Select("user_id").Where("organization_id = ?", targetID)
+		if err := tx.Where("organization_id = ? AND user_id IN (?)", sourceID, existing).Delete(&database.UserOrganization{}).Error; err != nil {
+			return fmt.Errorf("failed to remove duplicate memberships: %v", err)
+		}
+		if err := tx.Model(&database.UserOrganization{}).Where("organization_id = ?", sourceID).Update("organization_id", targetID).Error; err != nil {
+			return fmt.Errorf("failed to move memberships: %v", err)
+		}
+		if err := tx.Model(&database.User{}).Where("primary_org_id = ?", sourceID).Update("primary_org_id", targetID).Error; err != nil {
+			return fmt.Errorf("failed to move users: %v", err)
+		}
+		if err := tx.Model(&database.Organization{}).Where("id = ?", sourceID).Update("is_active", false).Error; err != nil {
+			return fmt.Errorf("failed to deactivate organization: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("🏢 Merged organization %s into %s: %d users, %d accounts", sourceID, targetID, len(userIDs), len(accountIDs))
+	return &OrgMergeResult{
+		SourceID:      sourceID,
+		TargetID:      targetID,
+		UsersMoved:    len(userIDs),
+		AccountsMoved: len(accountIDs),
+		Warnings:      warnings,
+	}, nil
+}
@@ -0,0 +1,346 @@
+package services
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+
+	"emailprojectv2/auth"
+	"emailprojectv2/config"
+	"emailprojectv2/database"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Bounds of the values an organization can set in its password policy
+const (
+	maxPasswordBytes   = 72 // bcrypt cannot hash longer passwords
+	maxPasswordHistory = 24
+	minPolicyMinLength = 8
+	maxPolicyMinLength = 64
+)
+
+// PasswordSettings holds the password and login protection settings
+var PasswordSettings = config.PasswordConfig{
+	MinLength:         8,
+	LockoutThreshold:  5,
+	LockoutMinutes:    1,
+	MaxLockoutMinutes: 60,
+	IPMaxFailures:     20,
+	IPWindowMinutes:   15,
+	ResetTokenMinutes: 30,
+}
+
+// breachedPasswords holds the SHA-1 hashes (upper case hex) of the breach list
+var breachedPasswords map[string]bool
+
+// ConfigurePasswords replaces the password settings and loads the breach list
+func ConfigurePasswords(cfg config.PasswordConfig) {
+	if cfg.MinLength < minPolicyMinLength {
+		cfg.MinLength = minPolicyMinLength
+	}
+	if cfg.LockoutThreshold < 1 {
+		cfg.LockoutThreshold = 5
+	}
+	if cfg.LockoutMinutes < 1 {
+		cfg.LockoutMinutes = 1
+	}
+	if cfg.MaxLockoutMinutes < cfg.LockoutMinutes {
+		cfg.MaxLockoutMinutes = cfg.LockoutMinutes
+	}
+	if cfg.IPMaxFailures < 1 {
+		cfg.IPMaxFailures = 20
+	}
+	if cfg.IPWindowMinutes < 1 {
+		cfg.IPWindowMinutes = 15
+	}
+	if cfg.ResetTokenMinutes < 1 {
+		cfg.ResetTokenMinutes = 30
+	}
+	PasswordSettings = cfg
+
+	breachedPasswords = nil
+	if cfg.BreachListPath != "" {
+		list, err := loadBreachList(cfg.BreachListPath)
+		if err != nil {
+			log.Printf("⚠️ Failed to load password breach list: %v", err)
+		} else {
+			breachedPasswords = list
+			log.Printf("🔑 Loaded %d breached passwords from %s", len(list), cfg.BreachListPath)
+		}
+	}
+	log.Printf("🔑 Passwords configured: minimum length %d, lockout after %d failures", cfg.MinLength, cfg.LockoutThreshold)
+}
+
+// loadBreachList reads a file of breached passwords. Lines are either plain
+// passwords or SHA-1 hashes in hex, optionally followed by ":count" as in the
+// Have I Been Pwned downloads.
+func loadBreachList(path string) (map[string]bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open breach list: %v", err)
+	}
+	defer file.Close()
+
+	list := map[string]bool{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if hash, _, _ := strings.Cut(line, ":"); isSHA1Hex(hash) {
+			list[strings.ToUpper(hash)] = true
+			continue
+		}
+		list[passwordSHA1(line)] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read breach list: %v", err)
+	}
+	return list, nil
+}
+
+func isSHA1Hex(s string) bool {
+	if len(s) != 40 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+func passwordSHA1(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// passwordBreached reports whether a password is on the breach list
+func passwordBreached(password string) bool {
+	if len(breachedPasswords) == 0 {
+		return false
+	}
+	return breachedPasswords[passwordSHA1(password)] || breachedPasswords[passwordSHA1(strings.ToLower(password))]
+}
+
+// PasswordPolicy are the rules new passwords must follow
+type PasswordPolicy struct {
+	MinLength        int  `json:"min_length"`
+	RequireUppercase bool `json:"require_uppercase"`
+	RequireLowercase bool `json:"require_lowercase"`
+	RequireDigit     bool `json:"require_digit"`
+	RequireSymbol    bool `json:"require_symbol"`
+	RejectBreached   bool `json:"reject_breached"` // Refuse passwords on the breach list
+	HistoryCount     int  `json:"history_count"`   // Previous passwords that cannot be reused
+}
+
+// PasswordPolicyError lists why a password was refused
+type PasswordPolicyError struct {
+	Problems []string
+}
+
+func (e *PasswordPolicyError) Error() string {
+	return "password does not meet the policy: " + strings.Join(e.Problems, "; ")
+}
+
+// DefaultPasswordPolicy is the policy of users whose organizations set none
+func DefaultPasswordPolicy() PasswordPolicy {
+	return PasswordPolicy{MinLength: PasswordSettings.MinLength, RejectBreached: true}
+}
+
+// ValidatePasswordPolicy checks the values of a policy an organization sets
+func ValidatePasswordPolicy(policy PasswordPolicy) error {
+	if policy.MinLength != 0 && (policy.MinLength < minPolicyMinLength || policy.MinLength > maxPolicyMinLength) {
+		return fmt.Errorf("min_length must be between %d and %d", minPolicyMinLength, maxPolicyMinLength)
+	}
+	if policy.HistoryCount < 0 || policy.HistoryCount > maxPasswordHistory {
+		return fmt.Errorf("history_count must be between 0 and %d", maxPasswordHistory)
+	}
+	return nil
+}
+
+// ParsePasswordPolicy decodes a policy stored in the organization settings
+func ParsePasswordPolicy(raw string) (PasswordPolicy, error) {
+	var policy PasswordPolicy
+	if raw == "" {
+		return policy, nil
+	}
+	if err := json.Unmarshal([]byte(raw), &policy); err != nil {
+		return policy, fmt.Errorf("invalid password policy: %v", err)
+	}
+	return policy, nil
+}
+
+// EffectivePasswordPolicy returns the policy for users of an organization:
+// the strictest combination of the policies set along its chain of parents
+// and the system default. Users without an organization get the default.
+func EffectivePasswordPolicy(orgID *uuid.UUID) (PasswordPolicy, error) {
+	policy := DefaultPasswordPolicy()
+	if orgID == nil {
+		return policy, nil
+	}
+	chain, err := OrganizationChain(*orgID)
+	if err != nil {
+		return policy, err
+	}
+
+	var settings []database.OrganizationSettings
+	if err := database.DB.Where("org_id IN ?", chain).Find(&settings).Error; err != nil {
+		return policy, fmt.Errorf("failed to load organization settings: %v", err)
+	}
+	for _, s := range settings {
+		set, err := ParsePasswordPolicy(s.PasswordPolicy)
+		if err != nil {
+			log.Printf("⚠️ Invalid password policy on organization %s: %v", s.OrgID, err)
+			continue
+		}
+		if set.MinLength > policy.MinLength {
+			policy.MinLength = set.MinLength
+		}
+		if set.HistoryCount > policy.HistoryCount {
+			policy.HistoryCount = set.HistoryCount
+		}
+		policy.RequireUppercase = policy.RequireUppercase || set.RequireUppercase
+		policy.RequireLowercase = policy.RequireLowercase || set.RequireLowercase
+		policy.RequireDigit = policy.RequireDigit || set.RequireDigit
+		policy.RequireSymbol = policy.RequireSymbol || set.RequireSymbol
+		policy.RejectBreached = policy.RejectBreached || set.RejectBreached
+	}
+	return policy, nil
+}
+
+// Problems lists the rules a password breaks, without the history check
+func (p PasswordPolicy) Problems(password, email string) []string {
+	var problems []string
+	length := len([]rune(password))
+	if length < p.MinLength {
+		problems = append(problems, fmt.Sprintf("must be at least %d characters", p.MinLength))
+	}
+	if len(password) > maxPasswordBytes {
+		problems = append(problems, fmt.Sprintf("must be at most %d bytes", maxPasswordBytes))
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			symbol = true
+		}
+	}
+	if p.RequireUppercase && !upper {
+		problems = append(problems, "must contain an uppercase letter")
+	}
+	if p.RequireLowercase && !lower {
+		problems = append(problems, "must contain a lowercase letter")
+	}
+	if p.RequireDigit && !digit {
+		problems = append(problems, "must contain a digit")
+	}
+	if p.RequireSymbol && !symbol {
+		problems = append(problems, "must contain a symbol")
+	}
+	if email != "" && strings.EqualFold(password, email) {
+		problems = append(problems, "must not be your email address")
+	}
+	if p.RejectBreached && passwordBreached(password) {
+		problems = append(problems, "appears in a list of breached passwords")
+	}
+	return problems
+}
+
+// CheckNewPassword checks a new password against the policy of an
+// organization and, for existing users, against their previous passwords.
+// It returns a *PasswordPolicyError when the password is refused.
+func CheckNewPassword(orgID *uuid.UUID, userID *uuid.UUID, email, password string) error {
+	policy, err := EffectivePasswordPolicy(orgID)
+	if err != nil {
+		return err
+	}
+	problems := policy.Problems(password, email)
+
+	if userID != nil && policy.HistoryCount > 0 {
+		reused, err := passwordReused(*userID, password, policy.HistoryCount)
+		if err != nil {
+			return err
+		}
+		if reused {
+			problems = append(problems, fmt.Sprintf("must not be one of your last %d passwords", policy.HistoryCount))
+		}
+	}
+
+	if len(problems) > 0 {
+		return &PasswordPolicyError{Problems: problems}
+	}
+	return nil
+}
+
+// passwordReused reports whether a password is the user's current one or one
+// of their last count passwords
+func passwordReused(userID uuid.UUID, password string, count int) (bool, error) {
+	var user database.User
+	if err := database.DB.Select("id", "password_hash").First(&user, "id = ?", userID).Error; err != nil {
+		return false, fmt.Errorf("failed to load user: %v", err)
+	}
+	if user.PasswordHash != "" && auth.CheckPassword(password, user.PasswordHash) {
+		return true, nil
+	}
+
+	var history []database.PasswordHistory
+	if err := database.DB.Where("user_id = ?", userID).Order("created_at DESC").Limit(count).Find(&history).Error; err != nil {
+		return false, fmt.Errorf("failed to load password history: %v", err)
+	}
+	for _, h := range history {
+		if auth.CheckPassword(password, h.PasswordHash) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// RecordPasswordHistory stores a user's new password hash in tx and drops
+// entries older than any policy can ask for
+func RecordPasswordHistory(tx *gorm.DB, userID uuid.UUID, passwordHash string) error {
+	if err := tx.Create(&database.PasswordHistory{UserID: userID, PasswordHash: passwordHash}).Error; err != nil {
+		return fmt.Errorf("failed to record password history: %v", err)
+	}
+	err := tx.Where("user_id = ? AND id NOT IN (?)", userID,
+		tx.Model(&database.PasswordHistory{}).Select("id").Where("user_id = ?", userID).Order("created_at DESC").Limit(maxPasswordHistory),
+	).Delete(&database.PasswordHistory{}).Error
+	if err != nil {
+		return fmt.Errorf("failed to prune password history: %v", err)
+	}
+	return nil
+}
+
+// SetUserPassword replaces a user's password in tx, records it in their
+// history and lifts any lockout. The password must have been checked with
+// CheckNewPassword.
+func SetUserPassword(tx *gorm.DB, userID uuid.UUID, password string) error {
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %v", err)
+	}
+	err = tx.Model(&database.User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+		"password_hash":       hash,
+		"password_changed_at": time.Now(),
+		"failed_login_count":  0,
+		"locked_until":        nil,
+	}).Error
+	if err != nil {
+		return fmt.Errorf("failed to update password: %v", err)
+	}
+	return RecordPasswordHistory(tx, userID, hash)
+}
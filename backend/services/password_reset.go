@@ -0,0 +1,134 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"emailprojectv2/database"
+
+	"gorm.io/gorm"
+)
+
+// ErrResetTokenInvalid is returned for unknown, used or expired reset tokens
+var ErrResetTokenInvalid = errors.New("password reset link is invalid or has expired")
+
+// passwordResetURL returns the link a reset token is sent in
+func passwordResetURL(token string) string {
+	base := PasswordSettings.ResetURL
+	separator := "?"
+	if strings.Contains(base, "?") {
+		separator = "&"
+	}
+	return base + separator + "token=" + url.QueryEscape(token)
+}
+
+// RequestPasswordReset emails a single-use reset link to the user with an
+// email address. Unknown addresses and users who cannot reset their password
+// here (disabled, directory or single sign-on users) are skipped without an
+// error, so the response does not reveal which addresses have accounts.
+func RequestPasswordReset(email, ip string) error {
+	var user database.User
+	err := database.DB.Where("email = ?", email).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load user: %v", err)
+	}
+	if user.DisabledAt != nil {
+		return nil
+	}
+	if managed, err := DirectoryManagesPassword(&user); err != nil || managed {
+		return err
+	}
+	if ssoOnly, err := PasswordLoginDisabled(&user); err != nil || ssoOnly {
+		return err
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		return fmt.Errorf("failed to generate reset token: %v", err)
+	}
+	expiresAt := time.Now().Add(time.Duration(PasswordSettings.ResetTokenMinutes) * time.Minute)
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		// Only the latest link works
+		if err := tx.Where("user_id = ? AND used_at IS NULL", user.ID).Delete(&database.PasswordResetToken{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&database.PasswordResetToken{
+			UserID:    user.ID,
+			TokenHash: hashToken(token),
+			ExpiresAt: expiresAt,
+			RequestIP: ip,
+		}).Error
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store reset token: %v", err)
+	}
+
+	body := fmt.Sprintf("A password reset was requested for your account %s.\n\n"+
+		"Open this link within %d minutes to choose a new password:\n%s\n\n"+
+		"If you did not request it, you can ignore this email; your password stays the same.\n",
+		user.Email, PasswordSettings.ResetTokenMinutes, passwordResetURL(token))
+	if err := SendMail(MailMessage{To: user.Email, Subject: "Reset your password", Body: body}); err != nil {
+		return err
+	}
+	log.Printf("🔑 Password reset link sent to %s", user.Email)
+	return nil
+}
+
+// ResetPassword sets a new password with a reset token. The token can be
+// used once, and all of the user's sessions are revoked. Passwords refused by
+// the policy return a *PasswordPolicyError and leave the token usable.
+func ResetPassword(token, password string) (*database.User, error) {
+	var record database.PasswordResetToken
+	err := database.DB.Where("token_hash = ?", hashToken(token)).First(&record).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrResetTokenInvalid
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load reset token: %v", err)
+	}
+	if record.UsedAt != nil || time.Now().After(record.ExpiresAt) {
+		return nil, ErrResetTokenInvalid
+	}
+
+	var user database.User
+	if err := database.DB.First(&user, "id = ?", record.UserID).Error; err != nil {
+		return nil, fmt.Errorf("failed to load user: %v", err)
+	}
+	if user.DisabledAt != nil {
+		return nil, ErrResetTokenInvalid
+	}
+	if err := CheckNewPassword(user.PrimaryOrgID, &user.ID, user.Email, password); err != nil {
+		return nil, err
+	}
+
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		// Claim the token first so concurrent requests cannot both use it
+		result := tx.Model(&database.PasswordResetToken{}).Where("id = ? AND used_at IS NULL", record.ID).Update("used_at", time.Now())
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrResetTokenInvalid
+		}
+		return SetUserPassword(tx, user.ID, password)
+	})
+	if errors.Is(err, ErrResetTokenInvalid) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to reset password: %v", err)
+	}
+
+	if _, err := RevokeUserSessions(user.ID, SessionRevokedPasswordReset); err != nil {
+		log.Printf("⚠️ Failed to revoke sessions of %s after password reset: %v", user.Email, err)
+	}
+	log.Printf("🔑 Password of %s reset", user.Email)
+	return &user, nil
+}
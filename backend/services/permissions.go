@@ -0,0 +1,435 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"emailprojectv2/auth"
+	"emailprojectv2/database"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// PermissionInfo describes a permission a role can hold
+type PermissionInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+
+	defaultRoles []string // Built-in roles that hold it
+}
+
+// Built-in role groups of the permission catalog
+var (
+	allRoles      = []string{"admin", "distributor", "dealer", "client", "end_user"}
+	managerRoles  = []string{"admin", "distributor", "dealer", "client"}
+	resellerRoles = []string{"admin", "distributor", "dealer"}
+	topLevelRoles = []string{"admin", "distributor"}
+	adminRole     = []string{"admin"}
+	mailboxRoles  = []string{"end_user"}
+	nonAdminRoles = []string{"distributor", "dealer", "client", "end_user"}
+)
+
+// PermissionCatalog lists every permission. Admins hold everything except
+// access to mailbox content, which only end users have.
+var PermissionCatalog = []PermissionInfo{
+	{"system.manage", "Administer the system: statistics, archive integrity and API access", adminRole},
+	{"settings.manage", "Manage organization security settings: MFA and password policies and organization API keys", managerRoles},
+	{"sso.manage", "Configure single sign-on", managerRoles},
+	{"directory.manage", "Configure directory sync and tenant connectors", managerRoles},
+	{"roles.read", "View roles and custom roles", managerRoles},
+	{"roles.manage", "Create, change and delete custom roles", managerRoles},
+	{"users.create", "Create users", managerRoles},
+	{"users.read", "View users", managerRoles},
+	{"users.update", "Change users, their roles, sessions, MFA and lockouts", managerRoles},
+	{"users.delete", "Delete users", managerRoles},
+	{"organizations.create", "Create organizations", resellerRoles},
+	{"organizations.read", "View organizations", allRoles},
+	{"organizations.manage_all", "Manage every organization and its users regardless of the hierarchy", adminRole},
+	{"organizations.update", "Change organizations", managerRoles},
+	{"organizations.delete", "Delete organizations", topLevelRoles},
+	{"organizations.move", "Move organizations to another parent", topLevelRoles},
+	{"organizations.merge", "Merge organizations", resellerRoles},
+	{"distributors.create", "Create distributors", adminRole},
+	{"distributors.read", "View distributors", adminRole},
+	{"distributors.update", "Change distributors", adminRole},
+	{"distributors.delete", "Delete distributors", adminRole},
+	{"dealers.create", "Create dealers", topLevelRoles},
+	{"dealers.read", "View dealers", topLevelRoles},
+	{"dealers.update", "Change dealers", topLevelRoles},
+	{"dealers.delete", "Delete dealers", topLevelRoles},
+	{"clients.create", "Create clients", resellerRoles},
+	{"clients.read", "View clients", resellerRoles},
+	{"clients.update", "Change clients", resellerRoles},
+	{"clients.delete", "Delete clients", resellerRoles},
+	{"reports.view", "View reports and usage", managerRoles},
+	{"reports.system", "View system statistics", adminRole},
+	{"reports.network", "View distributor network statistics", []string{"admin", "distributor"}},
+	{"reports.clients", "View dealer client statistics", []string{"admin", "dealer"}},
+	{"reports.users", "View client user and storage statistics", []string{"admin", "client"}},
+	{"billing.read", "View usage and billing periods", managerRoles},
+	{"billing.plans.read", "View price plans", resellerRoles},
+	{"billing.manage", "Manage price plans and usage snapshots", adminRole},
+	{"audit.read", "View the audit log", resellerRoles},
+	{"retention.manage", "Manage retention policies and runs", allRoles},
+	{"legal_holds.create", "Place legal holds", resellerRoles},
+	{"legal_holds.manage", "View, change and release legal holds", managerRoles},
+	{"compliance.manage", "Manage the compliance archive and its verifications", managerRoles},
+	{"ediscovery.grants", "Grant and revoke compliance officer access", managerRoles},
+	{"ediscovery.cases", "Work on eDiscovery cases as a compliance officer", allRoles},
+	{"data_subject.manage", "Handle GDPR data subject requests", allRoles},
+	{"api_keys.manage", "Create and revoke API keys", allRoles},
+	{"mailbox_grants.manage", "Share the mailboxes of users with assistants and auditors", managerRoles},
+	{"accounts.create", "Add email accounts", mailboxRoles},
+	{"accounts.read", "View email accounts", mailboxRoles},
+	{"accounts.update", "Sync and share email accounts", mailboxRoles},
+	{"accounts.delete", "Remove email accounts", mailboxRoles},
+	{"emails.read", "Read archived emails", mailboxRoles},
+	{"emails.manage", "Manage archived emails and restore them to the mailbox", mailboxRoles},
+	{"storage.read", "View storage statistics", nonAdminRoles},
+	{"storage.update", "Recalculate storage statistics", nonAdminRoles},
+}
+
+// ErrCustomRoleNotFound is returned for custom roles that do not exist or are
+// not available to a user
+var ErrCustomRoleNotFound = errors.New("custom role not found")
+
+// permissionCacheTTL is how long permissions are cached. Changes made through
+// this instance apply at once; other instances pick them up within the TTL.
+const permissionCacheTTL = time.Minute
+
+type cachedPermissions struct {
+	set      map[string]bool
+	loadedAt time.Time
+}
+
+var permissionCache = struct {
+	sync.Mutex
+	entries map[string]cachedPermissions
+}{entries: map[string]cachedPermissions{}}
+
+// InvalidatePermissionCache drops all cached permissions
+func InvalidatePermissionCache() {
+	permissionCache.Lock()
+	permissionCache.entries = map[string]cachedPermissions{}
+	permissionCache.Unlock()
+}
+
+// cachedPermissionSet returns the cached permissions under key, loading them when missing or stale
+func cachedPermissionSet(key string, load func() ([]string, error)) (map[string]bool, error) {
+	permissionCache.Lock()
+	entry, ok := permissionCache.entries[key]
+	permissionCache.Unlock()
+	if ok && time.Since(entry.loadedAt) < permissionCacheTTL {
+		return entry.set, nil
+	}
+
+	permissions, err := load()
+	if err != nil {
+		return nil, err
+	}
+	set := make(map[string]bool, len(permissions))
+	for _, p := range permissions {
+		set[p] = true
+	}
+	permissionCache.Lock()
+	permissionCache.entries[key] = cachedPermissions{set: set, loadedAt: time.Now()}
+	permissionCache.Unlock()
+	return set, nil
+}
+
+// ParsePermissions decodes a JSON array of permissions stored on a role
+func ParsePermissions(raw string) ([]string, error) {
+	permissions := []string{}
+	if raw == "" {
+		return permissions, nil
+	}
+	if err := json.Unmarshal([]byte(raw), &permissions); err != nil {
+		return nil, fmt.Errorf("invalid permissions: %v", err)
+	}
+	return permissions, nil
+}
+
+// rolePermissionSet returns the permissions of a built-in role. Unknown and
+// inactive roles hold none.
+func rolePermissionSet(roleName string) (map[string]bool, error) {
+	return cachedPermissionSet("role:"+roleName, func() ([]string, error) {
+		var role database.Role
+		err := database.DB.Where("name = ? AND is_active = ?", roleName, true).First(&role).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to load role: %v", err)
+		}
+		return ParsePermissions(role.Permissions)
+	})
+}
+
+// RolePermissions returns the sorted permissions of a built-in role
+func RolePermissions(roleName string) ([]string, error) {
+	set, err := rolePermissionSet(roleName)
+	if err != nil {
+		return nil, err
+	}
+	return sortedPermissions(set), nil
+}
+
+// customRolePermissions returns the permissions of a custom role. Deleted
+// custom roles hold none.
+func customRolePermissions(customRoleID string) (map[string]bool, error) {
+	return cachedPermissionSet("custom:"+customRoleID, func() ([]string, error) {
+		var role database.CustomRole
+		err := database.DB.First(&role, "id = ?", customRoleID).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to load custom role: %v", err)
+		}
+		return ParsePermissions(role.Permissions)
+	})
+}
+
+func sortedPermissions(set map[string]bool) []string {
+	permissions := make([]string, 0, len(set))
+	for p := range set {
+		permissions = append(permissions, p)
+	}
+	sort.Strings(permissions)
+	return permissions
+}
+
+// effectivePermissionSet returns the permissions of an identity: those of its
+// role, narrowed by its custom role when it has one
+func effectivePermissionSet(claims *auth.Claims) (map[string]bool, error) {
+	base, err := rolePermissionSet(claims.RoleName)
+	if err != nil {
+		return nil, err
+	}
+	if claims.CustomRoleID == "" {
+		return base, nil
+	}
+	custom, err := customRolePermissions(claims.CustomRoleID)
+	if err != nil {
+		return nil, err
+	}
+	narrowed := map[string]bool{}
+	for p := range custom {
+		if base[p] {
+			narrowed[p] = true
+		}
+	}
+	return narrowed, nil
+}
+
+// EffectivePermissions returns the sorted permissions of an identity
+func EffectivePermissions(claims *auth.Claims) ([]string, error) {
+	set, err := effectivePermissionSet(claims)
+	if err != nil {
+		return nil, err
+	}
+	return sortedPermissions(set), nil
+}
+
+// HasPermission reports whether an identity holds a permission
+func HasPermission(claims *auth.Claims, permission string) (bool, error) {
+	set, err := effectivePermissionSet(claims)
+	if err != nil {
+		return false, err
+	}
+	return set[permission], nil
+}
+
+// defaultRolePermissions returns the permissions the catalog gives each
+// built-in role, sorted
+func defaultRolePermissions() map[string][]string {
+	defaults := map[string][]string{}
+	for _, info := range PermissionCatalog {
+		for _, role := range info.defaultRoles {
+			defaults[role] = append(defaults[role], info.Name)
+		}
+	}
+	for role := range defaults {
+		sort.Strings(defaults[role])
+	}
+	return defaults
+}
+
+// permissionChanges returns the permissions to add to and remove from stored
+// to reach want
+func permissionChanges(stored, want []string) (added, removed []string) {
+	held := map[string]bool{}
+	for _, p := range stored {
+		held[p] = true
+	}
+	wanted := map[string]bool{}
+	for _, p := range want {
+		wanted[p] = true
+		if !held[p] {
+			added = append(added, p)
+		}
+	}
+	for _, p := range sortedPermissions(held) {
+		if !wanted[p] {
+			removed = append(removed, p)
+		}
+	}
+	return added, removed
+}
+
+// SeedRolePermissions reconciles the built-in roles with the permission
+// catalog on every start. Roles created by the SQL migrations get the
+// permissions added to the catalog since, and lose those it no longer gives
+// them, such as mailbox content access outside end_user. Built-in roles are
+// not editable; organizations narrow them with custom roles.
+func SeedRolePermissions() error {
+	var roles []database.Role
+	if err := database.DB.Where("name IN ?", allRoles).Find(&roles).Error; err != nil {
+		return fmt.Errorf("failed to load roles: %v", err)
+	}
+	defaults := defaultRolePermissions()
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		for _, role := range roles {
+			stored, err := ParsePermissions(role.Permissions)
+			if err != nil {
+				stored = nil
+			}
+			want := defaults[role.Name]
+			added, removed := permissionChanges(stored, want)
+			if len(added) == 0 && len(removed) == 0 && err == nil {
+				continue
+			}
+			encoded, _ := json.Marshal(want)
+			if err := tx.Model(&role).Update("permissions", string(encoded)).Error; err != nil {
+				return fmt.Errorf("failed to store permissions of role %s: %v", role.Name, err)
+			}
+			log.Printf("✅ Reconciled role %s with the permission catalog: added %v, removed %v", role.Name, added, removed)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	InvalidatePermissionCache()
+	return nil
+}
+
+// NormalizeCustomRolePermissions checks the permissions of a custom role
+// against its base role and returns them sorted and without duplicates. A
+// custom role can only hold permissions its base role holds.
+func NormalizeCustomRolePermissions(baseRoleName string, permissions []string) ([]string, error) {
+	base, err := RolePermissions(baseRoleName)
+	if err != nil {
+		return nil, err
+	}
+	held := map[string]bool{}
+	for _, p := range base {
+		held[p] = true
+	}
+	set := map[string]bool{}
+	for _, p := range permissions {
+		if !held[p] {
+			return nil, fmt.Errorf("permission %q is not held by the %s role", p, baseRoleName)
+		}
+		set[p] = true
+	}
+	return sortedPermissions(set), nil
+}
+
+// RoleGrantableIn reports whether users of an organization type can hold a role level
+func RoleGrantableIn(orgType string, level int) bool {
+	minLevel, ok := ssoMinRoleLevel[orgType]
+	return ok && level >= minLevel
+}
+
+// AvailableCustomRoles returns the custom roles defined by an organization or
+// its ancestors, which its users can be given
+func AvailableCustomRoles(orgID uuid.UUID) ([]database.CustomRole, error) {
+	chain, err := OrganizationChain(orgID)
+	if err != nil {
+		return nil, err
+	}
+	var roles []database.CustomRole
+	if err := database.DB.Preload("BaseRole").Where("organization_id IN ?", chain).Order("name").Find(&roles).Error; err != nil {
+		return nil, fmt.Errorf("failed to load custom roles: %v", err)
+	}
+	return roles, nil
+}
+
+// AssignCustomRole gives a user a custom role, or removes it when
+// customRoleID is nil. The custom role must be available in the user's
+// organization and based on the user's role. The user's sessions are revoked
+// so their new permissions apply at once.
+func AssignCustomRole(user *database.User, customRoleID *uuid.UUID) error {
+	if customRoleID != nil {
+		if user.PrimaryOrgID == nil || user.RoleID == nil {
+			return ErrCustomRoleNotFound
+		}
+		available, err := AvailableCustomRoles(*user.PrimaryOrgID)
+		if err != nil {
+			return err
+		}
+		found := false
+		for _, role := range available {
+			if role.ID == *customRoleID && role.BaseRoleID == *user.RoleID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return ErrCustomRoleNotFound
+		}
+	}
+
+	if err := database.DB.Model(user).Update("custom_role_id", customRoleID).Error; err != nil {
+		return fmt.Errorf("failed to assign custom role: %v", err)
+	}
+	if _, err := RevokeUserSessions(user.ID, SessionRevokedRole); err != nil {
+		log.Printf("⚠️ Failed to revoke sessions of %s after custom role change: %v", user.Email, err)
+	}
+	return nil
+}
+
+// UpdateCustomRolePermissions stores new permissions of a custom role. They
+// apply to the role's users at their next request.
+func UpdateCustomRolePermissions(role *database.CustomRole, permissions []string) error {
+	encoded, _ := json.Marshal(permissions)
+	role.Permissions = string(encoded)
+	if err := database.DB.Save(role).Error; err != nil {
+		return fmt.Errorf("failed to update custom role: %v", err)
+	}
+	InvalidatePermissionCache()
+	return nil
+}
+
+// DeleteCustomRole removes a custom role. Its users fall back to the full
+// permissions of their role and are signed out.
+func DeleteCustomRole(role *database.CustomRole) (int, error) {
+	var userIDs []uuid.UUID
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&database.User{}).Where("custom_role_id = ?", role.ID).Pluck("id", &userIDs).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&database.User{}).Where("custom_role_id = ?", role.ID).Update("custom_role_id", nil).Error; err != nil {
+			return err
+		}
+		return tx.Delete(role).Error
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete custom role: %v", err)
+	}
+	InvalidatePermissionCache()
+	for _, userID := range userIDs {
+		if _, err := RevokeUserSessions(userID, SessionRevokedRole); err != nil {
+			log.Printf("⚠️ Failed to revoke sessions of user %s after custom role deletion: %v", userID, err)
+		}
+	}
+	return len(userIDs), nil
+}
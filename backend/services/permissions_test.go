@@ -0,0 +1,149 @@
+package services
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"emailprojectv2/auth"
+)
+
+// cachePermissions primes the permission cache so lookups need no database
+func cachePermissions(t *testing.T, entries map[string][]string) {
+	t.Helper()
+	InvalidatePermissionCache()
+	permissionCache.Lock()
+	for key, permissions := range entries {
+		set := map[string]bool{}
+		for _, p := range permissions {
+			set[p] = true
+		}
+		permissionCache.entries[key] = cachedPermissions{set: set, loadedAt: time.Now()}
+	}
+	permissionCache.Unlock()
+	t.Cleanup(InvalidatePermissionCache)
+}
+
+func TestDefaultRolePermissions(t *testing.T) {
+	defaults := defaultRolePermissions()
+	held := func(role, permission string) bool {
+		for _, p := range defaults[role] {
+			if p == permission {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Mailbox content and accounts belong to end users only
+	for _, role := range allRoles {
+		for _, permission := range []string{"emails.read", "emails.manage", "accounts.read", "accounts.create"} {
+			if got, want := held(role, permission), role == "end_user"; got != want {
+				t.Errorf("%s holds %s = %v, want %v", role, permission, got, want)
+			}
+		}
+	}
+	for _, role := range allRoles {
+		if got, want := held(role, "organizations.manage_all"), role == "admin"; got != want {
+			t.Errorf("%s holds organizations.manage_all = %v, want %v", role, got, want)
+		}
+	}
+	if !held("client", "mailbox_grants.manage") || held("end_user", "mailbox_grants.manage") {
+		t.Error("mailbox_grants.manage should be held by managers only")
+	}
+}
+
+func TestPermissionChanges(t *testing.T) {
+	tests := []struct {
+		name        string
+		stored      []string
+		want        []string
+		wantAdded   []string
+		wantRemoved []string
+	}{
+		{"unchanged", []string{"users.read"}, []string{"users.read"}, nil, nil},
+		{"legacy sql seed", []string{"emails.manage", "emails.read", "users.read"}, []string{"roles.read", "users.read"}, []string{"roles.read"}, []string{"emails.manage", "emails.read"}},
+		{"empty role", nil, []string{"a", "b"}, []string{"a", "b"}, nil},
+		{"duplicates stored", []string{"a", "a", "c"}, []string{"a"}, nil, []string{"c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			added, removed := permissionChanges(tt.stored, tt.want)
+			if !reflect.DeepEqual(added, tt.wantAdded) || !reflect.DeepEqual(removed, tt.wantRemoved) {
+				t.Errorf("permissionChanges = %v, %v; want %v, %v", added, removed, tt.wantAdded, tt.wantRemoved)
+			}
+		})
+	}
+}
+
+func TestEffectivePermissionsNarrowing(t *testing.T) {
+	cachePermissions(t, map[string][]string{
+		"role:client":      {"users.read", "users.update", "reports.view"},
+		"custom:auditor":   {"users.read", "reports.view"},
+		"custom:escalated": {"users.read", "system.manage", "emails.read"},
+		"custom:empty":     {},
+	})
+
+	tests := []struct {
+		name   string
+		claims auth.Claims
+		want   []string
+	}{
+		{"base role", auth.Claims{RoleName: "client"}, []string{"reports.view", "users.read", "users.update"}},
+		{"narrowed", auth.Claims{RoleName: "client", CustomRoleID: "auditor"}, []string{"reports.view", "users.read"}},
+		{"cannot widen", auth.Claims{RoleName: "client", CustomRoleID: "escalated"}, []string{"users.read"}},
+		{"empty custom role", auth.Claims{RoleName: "client", CustomRoleID: "empty"}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := EffectivePermissions(&tt.claims)
+			if err != nil {
+				t.Fatalf("EffectivePermissions: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("EffectivePermissions = %v, want %v", got, tt.want)
+			}
+			for _, p := range []string{"system.manage", "emails.read"} {
+				if held, _ := HasPermission(&tt.claims, p); held {
+					t.Errorf("HasPermission(%s) = true outside the base role", p)
+				}
+			}
+		})
+	}
+}
+
+func TestNormalizeCustomRolePermissions(t *testing.T) {
+	cachePermissions(t, map[string][]string{
+		"role:dealer": {"clients.read", "users.read", "users.update"},
+	})
+
+	tests := []struct {
+		name        string
+		permissions []string
+		want        []string
+		wantErr     string
+	}{
+		{"subset sorted", []string{"users.read", "clients.read"}, []string{"clients.read", "users.read"}, ""},
+		{"duplicates dropped", []string{"users.read", "users.read"}, []string{"users.read"}, ""},
+		{"none", nil, []string{}, ""},
+		{"outside base role", []string{"users.read", "organizations.manage_all"}, nil, "organizations.manage_all"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NormalizeCustomRolePermissions("dealer", tt.permissions)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one naming %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NormalizeCustomRolePermissions: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("NormalizeCustomRolePermissions = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,290 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+
+	"emailprojectv2/config"
+	"emailprojectv2/database"
+
+	"github.com/google/uuid"
+)
+
+// Quota resources
+const (
+	QuotaUsers         = "users"
+	QuotaEmailAccounts = "email_accounts"
+	QuotaStorage       = "storage"
+)
+
+// QuotaSettings holds the organization quota settings
+var QuotaSettings = config.QuotaConfig{WarnThresholds: []int{80, 95}}
+
+// ConfigureQuotas replaces the organization quota settings
+func ConfigureQuotas(cfg config.QuotaConfig) {
+	thresholds := []int{}
+	for _, t := range cfg.WarnThresholds {
+		if t > 0 && t < 100 {
+			thresholds = append(thresholds, t)
+		}
+	}
+	sort.Ints(thresholds)
+	cfg.WarnThresholds = thresholds
+	QuotaSettings = cfg
+	log.Printf("📏 Quotas configured: warnings at %v%%", thresholds)
+}
+
+// QuotaUsage is the usage of one resource against the limit of one
+// organization. Usage covers the organization and all of its descendants.
+// Storage is counted in bytes.
+type QuotaUsage struct {
+	OrganizationID   uuid.UUID `json:"organization_id"`
+	OrganizationName string    `json:"organization_name"`
+	Resource         string    `json:"resource"`
+	Limit            int64     `json:"limit"`
+	Usage            int64     `json:"usage"`
+	Percent          float64   `json:"percent"`
+}
+
+// QuotaWarning reports a quota past a soft-limit threshold
+type QuotaWarning struct {
+	QuotaUsage
+	Threshold int    `json:"threshold"`
+	Message   string `json:"message"`
+}
+
+// QuotaError is returned when an operation would exceed a hard limit
+type QuotaError struct {
+	QuotaUsage
+}
+
+func (e *QuotaError) Error() string {
+	if e.Resource == QuotaStorage {
+		return fmt.Sprintf("organization %s has reached its storage quota (%s of %s)", e.OrganizationName, formatQuotaBytes(e.Usage), formatQuotaBytes(e.Limit))
+	}
+	return fmt.Sprintf("organization %s has reached its %s quota (%d of %d)", e.OrganizationName, quotaResourceName(e.Resource), e.Usage, e.Limit)
+}
+
+// IsQuotaError reports whether err is or wraps a QuotaError
+func IsQuotaError(err error) bool {
+	var qe *QuotaError
+	return errors.As(err, &qe)
+}
+
+func quotaResourceName(resource string) string {
+	switch resource {
+	case QuotaEmailAccounts:
+		return "email account"
+	case QuotaStorage:
+		return "storage"
+	}
+	return "user"
+}
+
+func formatQuotaBytes(bytes int64) string {
+	return fmt.Sprintf("%.2f GB", float64(bytes)/(1024*1024*1024))
+}
+
+// quotaLimit returns an organization's limit for a resource, or false when it has none
+func quotaLimit(org database.Organization, resource string) (int64, bool) {
+	var limit *int
+	switch resource {
+	case QuotaUsers:
+		limit = org.MaxUsers
+	case QuotaEmailAccounts:
+		limit = org.MaxEmailAccounts
+	case QuotaStorage:
+		limit = org.MaxStorageGB
+	}
+	if limit == nil || *limit <= 0 {
+		return 0, false
+	}
+	if resource == QuotaStorage {
+		return int64(*limit) * 1024 * 1024 * 1024, true
+	}
+	return int64(*limit), true
+}
+
+// subtreeUsage counts a resource over an organization and its descendants
+func subtreeUsage(orgID uuid.UUID, resource string) (int64, error) {
+	switch resource {
+	case QuotaUsers:
+		orgIDs, err := OrganizationSubtree(orgID)
+		if err != nil {
+			return 0, err
+		}
+		userIDs, err := OrganizationUserIDs(orgIDs)
+		if err != nil {
+			return 0, err
+		}
+		return int64(len(userIDs)), nil
+	case QuotaEmailAccounts:
+		accountIDs, err := OrganizationAccountIDs(orgID)
+		if err != nil {
+			return 0, err
+		}
+		return int64(len(accountIDs)), nil
+	case QuotaStorage:
+		accountIDs, err := OrganizationAccountIDs(orgID)
+		if err != nil {
+			return 0, err
+		}
+		if len(accountIDs) == 0 {
+			return 0, nil
+		}
+		var used int64
+		err = database.DB.Model(&database.EmailIndex{}).Where("account_id IN ?", accountIDs).
+			Select("COALESCE(SUM(email_size), 0)").Scan(&used).Error
+		if err != nil {
+			return 0, fmt.Errorf("failed to sum organization storage: %v", err)
+		}
+		return used, nil
+	}
+	return 0, fmt.Errorf("unknown quota resource: %s", resource)
+}
+
+// OrganizationQuotas returns the usage of every limit that applies to an
+// organization: its own limits and those of its ancestors, each measured over
+// the subtree of the organization that sets it
+func OrganizationQuotas(orgID uuid.UUID) ([]QuotaUsage, error) {
+	return organizationQuotas(orgID, QuotaUsers, QuotaEmailAccounts, QuotaStorage)
+}
+
+// organizationQuotas measures the applicable limits on the given resources
+func organizationQuotas(orgID uuid.UUID, resources ...string) ([]QuotaUsage, error) {
+	chain, err := OrganizationChain(orgID)
+	if err != nil {
+		return nil, err
+	}
+	return chainQuotas(chain, resources...)
+}
+
+// chainQuotas measures the limits the given organizations set on the resources
+func chainQuotas(chain []uuid.UUID, resources ...string) ([]QuotaUsage, error) {
+	quotas := []QuotaUsage{}
+	for _, id := range chain {
+		var org database.Organization
+		if err := database.DB.First(&org, "id = ?", id).Error; err != nil {
+			return nil, fmt.Errorf("failed to load organization: %v", err)
+		}
+		for _, resource := range resources {
+			limit, ok := quotaLimit(org, resource)
+			if !ok {
+				continue
+			}
+			usage, err := subtreeUsage(org.ID, resource)
+			if err != nil {
+				return nil, err
+			}
+			quotas = append(quotas, QuotaUsage{
+				OrganizationID:   org.ID,
+				OrganizationName: org.Name,
+				Resource:         resource,
+				Limit:            limit,
+				Usage:            usage,
+				Percent:          float64(usage) / float64(limit) * 100,
+			})
+		}
+	}
+	return quotas, nil
+}
+
+// CheckQuota checks whether adding to a resource of an organization stays
+// within every applicable limit. Storage is blocked once the limit is
+// reached, users and accounts when the addition would go past it. Limits
+// past a warning threshold are returned as warnings; a hard limit returns a
+// *QuotaError.
+func CheckQuota(orgID uuid.UUID, resource string, adding int64) ([]QuotaWarning, error) {
+	chain, err := OrganizationChain(orgID)
+	if err != nil {
+		return nil, err
+	}
+	return checkChainQuota(chain, resource, adding)
+}
+
+// checkChainQuota checks the limits the given organizations set on a resource
+func checkChainQuota(chain []uuid.UUID, resource string, adding int64) ([]QuotaWarning, error) {
+	quotas, err := chainQuotas(chain, resource)
+	if err != nil {
+		return nil, err
+	}
+
+	warnings := []QuotaWarning{}
+	for _, quota := range quotas {
+		projected := quota.Usage + adding
+		if projected > quota.Limit || (resource == QuotaStorage && quota.Usage >= quota.Limit) {
+			return warnings, &QuotaError{QuotaUsage: quota}
+		}
+
+		quota.Usage = projected
+		quota.Percent = float64(projected) / float64(quota.Limit) * 100
+		if warning, ok := quotaWarning(quota); ok {
+			warnings = append(warnings, warning)
+		}
+	}
+	return warnings, nil
+}
+
+// quotaWarning returns a warning for the highest threshold a quota has passed
+func quotaWarning(quota QuotaUsage) (QuotaWarning, bool) {
+	threshold := 0
+	for _, t := range QuotaSettings.WarnThresholds {
+		if quota.Percent >= float64(t) {
+			threshold = t
+		}
+	}
+	if threshold == 0 {
+		return QuotaWarning{}, false
+	}
+	return QuotaWarning{
+		QuotaUsage: quota,
+		Threshold:  threshold,
+		Message:    fmt.Sprintf("organization %s is at %.0f%% of its %s quota", quota.OrganizationName, quota.Percent, quotaResourceName(quota.Resource)),
+	}, true
+}
+
+// QuotaWarnings returns the soft-limit warnings for the given quotas
+func QuotaWarnings(quotas []QuotaUsage) []QuotaWarning {
+	warnings := []QuotaWarning{}
+	for _, quota := range quotas {
+		if warning, ok := quotaWarning(quota); ok {
+			warnings = append(warnings, warning)
+		}
+	}
+	return warnings
+}
+
+// CheckAccountQuota checks that a user may add another email account: the
+// account limit must have room and storage must not be full
+func CheckAccountQuota(userID uuid.UUID) ([]QuotaWarning, error) {
+	orgID, err := UserOrganizationID(userID)
+	if err != nil || orgID == nil {
+		return nil, err
+	}
+	warnings, err := CheckQuota(*orgID, QuotaEmailAccounts, 1)
+	if err != nil {
+		return warnings, err
+	}
+	storageWarnings, err := CheckQuota(*orgID, QuotaStorage, 0)
+	return append(warnings, storageWarnings...), err
+}
+
+// CheckSyncQuota returns a *QuotaError when the organization of an account
+// has used up its storage, in which case syncs of the account are paused.
+// Failures to compute usage are logged and do not stop the sync.
+func CheckSyncQuota(accountID uuid.UUID) error {
+	orgID, err := AccountOrganizationID(accountID)
+	if err == nil && orgID != nil {
+		_, err = CheckQuota(*orgID, QuotaStorage, 0)
+		if IsQuotaError(err) {
+			log.Printf("⛔ Sync of account %s paused: %v", accountID, err)
+			return err
+		}
+	}
+	if err != nil {
+		log.Printf("⚠️ Failed to check storage quota for account %s: %v", accountID, err)
+	}
+	return nil
+}
@@ -0,0 +1,491 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"emailprojectv2/config"
+	"emailprojectv2/database"
+	"emailprojectv2/storage"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Retention actions
+const (
+	RetentionKeepDays            = "keep_days"             // delete after RetentionDays
+	RetentionKeepForever         = "keep_forever"          // never delete
+	RetentionDeleteUnlessFlagged = "delete_unless_flagged" // delete after RetentionDays unless flagged
+)
+
+// Retention policy scopes, from the broadest to the narrowest
+const (
+	RetentionScopeOrganization = "organization"
+	RetentionScopeAccount      = "account"
+	RetentionScopeFolder       = "folder"
+)
+
+// ErrRetentionRunning is returned when a retention run is started while another is in progress
+var ErrRetentionRunning = errors.New("a retention run is already in progress")
+
+// RetentionTuning holds the scheduled purge settings
+var RetentionTuning = config.RetentionConfig{PurgeEnabled: true, PurgeIntervalHours: 24}
+
+// ConfigureRetention replaces the scheduled purge settings
+func ConfigureRetention(cfg config.RetentionConfig) {
+	if cfg.PurgeIntervalHours < 1 {
+		cfg.PurgeIntervalHours = 24
+	}
+	RetentionTuning = cfg
+	log.Printf("🗄️ Retention configured: purge every %dh, purge enabled: %v", cfg.PurgeIntervalHours, cfg.PurgeEnabled)
+}
+
+// EffectivePolicy is the retention rule that applies to a folder of an account
+type EffectivePolicy struct {
+	PolicyID       *uuid.UUID `json:"policy_id,omitempty"`
+	Source         string     `json:"source"` // organization, organization_settings, account, folder or default
+	OrganizationID *uuid.UUID `json:"organization_id,omitempty"`
+	Action         string     `json:"action"`
+	RetentionDays  int        `json:"retention_days"`
+	AllowOverride  bool       `json:"allow_override"`
+}
+
+// defaultRetention keeps everything when no policy applies
+func defaultRetention() *EffectivePolicy {
+	return &EffectivePolicy{Source: "default", Action: RetentionKeepForever, AllowOverride: true}
+}
+
+func policyFrom(policy database.RetentionPolicy) *EffectivePolicy {
+	id := policy.ID
+	return &EffectivePolicy{
+		PolicyID:       &id,
+		Source:         policy.Scope,
+		OrganizationID: policy.OrganizationID,
+		Action:         policy.Action,
+		RetentionDays:  policy.RetentionDays,
+		AllowOverride:  policy.AllowOverride,
+	}
+}
+
+// narrow replaces the current policy with a narrower one unless the current policy forbids overrides
+func narrow(current, candidate *EffectivePolicy) *EffectivePolicy {
+	if candidate == nil || !current.AllowOverride {
+		return current
+	}
+	return candidate
+}
+
+// purgeReason returns why an email is due for deletion under the policy, or "" when it is kept
+func (p *EffectivePolicy) purgeReason(email *database.EmailIndex, now time.Time) string {
+	if p.Action != RetentionKeepDays && p.Action != RetentionDeleteUnlessFlagged {
+		return ""
+	}
+	if p.RetentionDays <= 0 {
+		return ""
+	}
+	if p.Action == RetentionDeleteUnlessFlagged && email.IsFlagged {
+		return ""
+	}
+
+	date := email.Date
+	if date.IsZero() {
+		date = email.CreatedAt
+	}
+	if !date.Before(now.AddDate(0, 0, -p.RetentionDays)) {
+		return ""
+	}
+	return fmt.Sprintf("older than %d days under %s retention policy (%s)", p.RetentionDays, p.Source, p.Action)
+}
+
+// organizationRetention returns an organization's own policy, falling back to
+// OrganizationSettings.EmailRetentionDays. It is nil when the organization sets neither.
+func organizationRetention(orgID uuid.UUID) (*EffectivePolicy, error) {
+	var policy database.RetentionPolicy
+	err := database.DB.Where("scope = ? AND organization_id = ?", RetentionScopeOrganization, orgID).First(&policy).Error
+	if err == nil {
+		return policyFrom(policy), nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("failed to load organization retention policy: %v", err)
+	}
+
+	var settings database.OrganizationSettings
+	err = database.DB.Where("org_id = ?", orgID).First(&settings).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load organization settings: %v", err)
+	}
+	if settings.EmailRetentionDays == nil || *settings.EmailRetentionDays <= 0 {
+		return nil, nil
+	}
+
+	id := orgID
+	return &EffectivePolicy{
+		Source:         "organization_settings",
+		OrganizationID: &id,
+		Action:         RetentionKeepDays,
+		RetentionDays:  *settings.EmailRetentionDays,
+		AllowOverride:  true,
+	}, nil
+}
+
+// organizationChainRetention resolves the policy set by an organization and its
+// ancestors, walking down from the top of the hierarchy
+func organizationChainRetention(orgID uuid.UUID) (*EffectivePolicy, error) {
+	var org database.Organization
+	if err := database.DB.First(&org, "id = ?", orgID).Error; err != nil {
+		return nil, fmt.Errorf("failed to load organization: %v", err)
+	}
+	path, err := org.GetHierarchyPath(database.DB)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load organization hierarchy: %v", err)
+	}
+
+	effective := defaultRetention()
+	for _, o := range path {
+		candidate, err := organizationRetention(o.ID)
+		if err != nil {
+			return nil, err
+		}
+		effective = narrow(effective, candidate)
+	}
+	return effective, nil
+}
+
+// accountRetention holds the resolved policies of one email account
+type accountRetention struct {
+	base    *EffectivePolicy            // organization chain and account policy
+	folders map[string]*EffectivePolicy // folders with their own policy
+}
+
+func loadAccountRetention(accountID uuid.UUID) (*accountRetention, error) {
+	effective := defaultRetention()
+
+	orgID, err := AccountOrganizationID(accountID)
+	if err != nil {
+		return nil, err
+	}
+	if orgID != nil {
+		if effective, err = organizationChainRetention(*orgID); err != nil {
+			return nil, err
+		}
+	}
+
+	var policies []database.RetentionPolicy
+	if err := database.DB.Where("account_id = ?", accountID).Find(&policies).Error; err != nil {
+		return nil, fmt.Errorf("failed to load account retention policies: %v", err)
+	}
+	return newAccountRetention(effective, policies), nil
+}
+
+// newAccountRetention narrows the organization chain's policy with the
+// account's own policy, then with each folder policy
+func newAccountRetention(effective *EffectivePolicy, policies []database.RetentionPolicy) *accountRetention {
+	for _, policy := range policies {
+		if policy.Scope == RetentionScopeAccount {
+			effective = narrow(effective, policyFrom(policy))
+		}
+	}
+
+	ar := &accountRetention{base: effective, folders: make(map[string]*EffectivePolicy)}
+	for _, policy := range policies {
+		if policy.Scope == RetentionScopeFolder {
+			ar.folders[policy.Folder] = narrow(effective, policyFrom(policy))
+		}
+	}
+	return ar
+}
+
+func (ar *accountRetention) forFolder(folder string) *EffectivePolicy {
+	if policy, ok := ar.folders[folder]; ok {
+		return policy
+	}
+	return ar.base
+}
+
+// keepsEverything reports whether no policy of the account can delete anything
+func (ar *accountRetention) keepsEverything() bool {
+	if ar.base.Action != RetentionKeepForever {
+		return false
+	}
+	for _, policy := range ar.folders {
+		if policy.Action != RetentionKeepForever {
+			return false
+		}
+	}
+	return true
+}
+
+// ResolveRetentionPolicy returns the policy that applies to a folder of an account
+func ResolveRetentionPolicy(accountID uuid.UUID, folder string) (*EffectivePolicy, error) {
+	ar, err := loadAccountRetention(accountID)
+	if err != nil {
+		return nil, err
+	}
+	return ar.forFolder(folder), nil
+}
+
+// ParentRetention returns the policy a new or changed policy would override.
+// A policy may only be set where this one allows overrides.
+func ParentRetention(policy *database.RetentionPolicy) (*EffectivePolicy, error) {
+	switch policy.Scope {
+	case RetentionScopeOrganization:
+		var org database.Organization
+		if err := database.DB.First(&org, "id = ?", *policy.OrganizationID).Error; err != nil {
+			return nil, fmt.Errorf("failed to load organization: %v", err)
+		}
+		if org.ParentOrgID == nil {
+			return defaultRetention(), nil
+		}
+		return organizationChainRetention(*org.ParentOrgID)
+
+	case RetentionScopeAccount:
+		orgID, err := AccountOrganizationID(*policy.AccountID)
+		if err != nil {
+			return nil, err
+		}
+		if orgID == nil {
+			return defaultRetention(), nil
+		}
+		return organizationChainRetention(*orgID)
+
+	case RetentionScopeFolder:
+		ar, err := loadAccountRetention(*policy.AccountID)
+		if err != nil {
+			return nil, err
+		}
+		return ar.base, nil
+	}
+
+	return nil, fmt.Errorf("unknown retention scope %q", policy.Scope)
+}
+
+// RetentionEngine runs retention purges, one at a time
+type RetentionEngine struct {
+	mu sync.Mutex
+}
+
+var Retention = &RetentionEngine{}
+
+// Run executes a retention run and waits for it to finish. A dry-run only
+// records what would be deleted. orgID limits the run to one organization subtree.
+func (re *RetentionEngine) Run(dryRun bool, orgID, triggeredBy *uuid.UUID) (*database.RetentionRun, error) {
+	if !re.mu.TryLock() {
+		return nil, ErrRetentionRunning
+	}
+	defer re.mu.Unlock()
+
+	run, err := re.begin(dryRun, orgID, triggeredBy)
+	if err != nil {
+		return nil, err
+	}
+	return run, re.finish(run, re.execute(run))
+}
+
+// Start executes a retention run in the background and returns it as started
+func (re *RetentionEngine) Start(dryRun bool, orgID, triggeredBy *uuid.UUID) (*database.RetentionRun, error) {
+	if !re.mu.TryLock() {
+		return nil, ErrRetentionRunning
+	}
+
+	run, err := re.begin(dryRun, orgID, triggeredBy)
+	if err != nil {
+		re.mu.Unlock()
+		return nil, err
+	}
+	started := *run
+
+	go func() {
+		defer re.mu.Unlock()
+		re.finish(run, re.execute(run))
+	}()
+
+	return &started, nil
+}
+
+func (re *RetentionEngine) begin(dryRun bool, orgID, triggeredBy *uuid.UUID) (*database.RetentionRun, error) {
+	run := &database.RetentionRun{
+		OrganizationID: orgID,
+		DryRun:         dryRun,
+		TriggeredBy:    triggeredBy,
+		Status:         "running",
+		StartedAt:      time.Now(),
+	}
+	if err := database.DB.Create(run).Error; err != nil {
+		return nil, fmt.Errorf("failed to create retention run: %v", err)
+	}
+
+	mode := "purge"
+	if dryRun {
+		mode = "dry-run"
+	}
+	log.Printf("🗄️ Starting retention %s %s", mode, run.ID)
+	return run, nil
+}
+
+func (re *RetentionEngine) finish(run *database.RetentionRun, runErr error) error {
+	now := time.Now()
+	run.CompletedAt = &now
+	run.Status = "completed"
+	if runErr != nil {
+		run.Status = "failed"
+		run.ErrorMessage = runErr.Error()
+	}
+
+	if err := database.DB.Save(run).Error; err != nil {
+		log.Printf("⚠️ Failed to save retention run %s: %v", run.ID, err)
+	}
+
+	if runErr != nil {
+		log.Printf("❌ Retention run %s failed: %v", run.ID, runErr)
+	} else {
+		log.Printf("✅ Retention run %s completed: %d of %d emails selected (%d bytes, %d held, %d locked)", run.ID, run.EmailsPurged, run.EmailsScanned, run.BytesPurged, run.EmailsHeld, run.EmailsLocked)
+	}
+	return runErr
+}
+
+// execute applies the retention policies to every account in scope
+func (re *RetentionEngine) execute(run *database.RetentionRun) error {
+	var accountIDs []uuid.UUID
+	if run.OrganizationID != nil {
+		ids, err := OrganizationAccountIDs(*run.OrganizationID)
+		if err != nil {
+			return err
+		}
+		accountIDs = ids
+	} else if err := database.DB.Model(&database.EmailAccount{}).Pluck("id", &accountIDs).Error; err != nil {
+		return fmt.Errorf("failed to load accounts: %v", err)
+	}
+
+	holds, err := LoadActiveHolds()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	now := time.Now()
+	for _, accountID := range accountIDs {
+		if err := re.processAccount(ctx, run, holds, accountID, now); err != nil {
+			// One broken account must not stop the purge for everyone else
+			log.Printf("⚠️ Retention failed for account %s: %v", accountID, err)
+		}
+	}
+	return nil
+}
+
+// What the purge does with one email
+const (
+	retentionKept = iota
+	retentionLocked
+	retentionHeld
+	retentionPurged
+)
+
+// retentionOutcome decides whether an email is purged. An expired email under
+// a compliance lock or legal hold is kept; the reason is returned either way.
+func retentionOutcome(policy *EffectivePolicy, holds *HoldSet, email *database.EmailIndex, now time.Time) (string, int) {
+	reason := policy.purgeReason(email, now)
+	switch {
+	case reason == "":
+		return "", retentionKept
+	case EmailLocked(email, now):
+		return reason, retentionLocked
+	case holds.Covers(email):
+		return reason, retentionHeld
+	}
+	return reason, retentionPurged
+}
+
+// processAccount selects the expired emails of one account and, unless this
+// is a dry-run, deletes them. Every selected email gets an audit record;
+// emails under a compliance lock or legal hold are only counted.
+func (re *RetentionEngine) processAccount(ctx context.Context, run *database.RetentionRun, holds *HoldSet, accountID uuid.UUID, now time.Time) error {
+	policies, err := loadAccountRetention(accountID)
+	if err != nil {
+		return err
+	}
+	if policies.keepsEverything() {
+		return nil
+	}
+
+	var batch []database.EmailIndex
+	result := database.DB.Where("account_id = ?", accountID).FindInBatches(&batch, 500, func(tx *gorm.DB, _ int) error {
+		for i := range batch {
+			email := &batch[i]
+			run.EmailsScanned++
+
+			policy := policies.forFolder(email.Folder)
+			reason, outcome := retentionOutcome(policy, holds, email, now)
+			switch outcome {
+			case retentionKept:
+				continue
+			case retentionLocked:
+				run.EmailsLocked++
+				continue
+			case retentionHeld:
+				run.EmailsHeld++
+				continue
+			}
+
+			item := database.RetentionRunItem{
+				RunID:     run.ID,
+				EmailID:   email.ID,
+				AccountID: email.AccountID,
+				PolicyID:  policy.PolicyID,
+				MessageID: email.MessageID,
+				Subject:   email.Subject,
+				Folder:    email.Folder,
+				EmailDate: email.Date,
+				EmailSize: email.EmailSize,
+				MinioPath: email.MinioPath,
+				Reason:    reason,
+			}
+
+			if !run.DryRun {
+				if err := purgeEmail(ctx, email); err != nil {
+					log.Printf("⚠️ Failed to purge email %s: %v", email.ID, err)
+					item.Error = err.Error()
+				}
+			}
+			if item.Error == "" {
+				run.EmailsPurged++
+				run.BytesPurged += email.EmailSize
+			}
+
+			if err := database.DB.Create(&item).Error; err != nil {
+				log.Printf("⚠️ Failed to record retention audit entry for email %s: %v", email.ID, err)
+			}
+		}
+		return nil
+	})
+	return result.Error
+}
+
+// purgeEmail deletes an email's objects from storage, then its history and
+// index entry. Objects go first so a failed purge never leaves stored content
+// the index no longer points to.
+func purgeEmail(ctx context.Context, email *database.EmailIndex) error {
+	for _, objectPath := range []string{email.MinioPath, email.RawMinioPath} {
+		if objectPath == "" {
+			continue
+		}
+		if err := storage.RemoveEmailObject(ctx, objectPath); err != nil {
+			return fmt.Errorf("failed to delete object %s: %v", objectPath, err)
+		}
+	}
+
+	if err := database.DB.Where("email_id = ?", email.ID).Delete(&database.EmailEvent{}).Error; err != nil {
+		return fmt.Errorf("failed to delete email history: %v", err)
+	}
+	if err := database.DB.Delete(email).Error; err != nil {
+		return fmt.Errorf("failed to delete email index: %v", err)
+	}
+	return nil
+}
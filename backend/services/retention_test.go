@@ -0,0 +1,153 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"emailprojectv2/database"
+
+	"github.com/google/uuid"
+)
+
+func keepDays(source string, days int, allowOverride bool) *EffectivePolicy {
+	return &EffectivePolicy{Source: source, Action: RetentionKeepDays, RetentionDays: days, AllowOverride: allowOverride}
+}
+
+func TestNarrowOrganizationChain(t *testing.T) {
+	tests := []struct {
+		name     string
+		chain    []*EffectivePolicy // From the top of the hierarchy down
+		wantFrom string
+		wantDays int
+	}{
+		{"nothing set", nil, "default", 0},
+		{"top level only", []*EffectivePolicy{keepDays("reseller", 365, true)}, "reseller", 365},
+		{"child overrides", []*EffectivePolicy{keepDays("reseller", 365, true), keepDays("client", 90, true)}, "client", 90},
+		{"unset levels inherit", []*EffectivePolicy{keepDays("reseller", 365, true), nil, nil}, "reseller", 365},
+		{"locked parent wins", []*EffectivePolicy{keepDays("reseller", 365, false), keepDays("client", 90, true)}, "reseller", 365},
+		{"lock in the middle", []*EffectivePolicy{keepDays("reseller", 365, true), keepDays("dealer", 180, false), keepDays("client", 90, true)}, "dealer", 180},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			effective := defaultRetention()
+			for _, candidate := range tt.chain {
+				effective = narrow(effective, candidate)
+			}
+			if effective.Source != tt.wantFrom || effective.RetentionDays != tt.wantDays {
+				t.Errorf("effective policy = %s/%d days, want %s/%d days", effective.Source, effective.RetentionDays, tt.wantFrom, tt.wantDays)
+			}
+		})
+	}
+}
+
+func TestAccountRetentionInheritance(t *testing.T) {
+	account := database.RetentionPolicy{Scope: RetentionScopeAccount, Action: RetentionKeepDays, RetentionDays: 60, AllowOverride: true}
+	lockedAccount := account
+	lockedAccount.AllowOverride = false
+	sent := database.RetentionPolicy{Scope: RetentionScopeFolder, Folder: "Sent", Action: RetentionKeepForever, AllowOverride: true}
+
+	tests := []struct {
+		name      string
+		parent    *EffectivePolicy
+		policies  []database.RetentionPolicy
+		wantInbox string // Source of the policy for a folder without its own
+		wantSent  string
+		wantKeeps bool
+	}{
+		{"default keeps everything", defaultRetention(), nil, "default", "default", true},
+		{"organization applies to every folder", keepDays("organization", 90, true), nil, "organization", "organization", false},
+		{"account overrides organization", keepDays("organization", 90, true), []database.RetentionPolicy{account}, "account", "account", false},
+		{"folder overrides account", keepDays("organization", 90, true), []database.RetentionPolicy{account, sent}, "account", "folder", false},
+		{"locked organization", keepDays("organization", 90, false), []database.RetentionPolicy{account, sent}, "organization", "organization", false},
+		{"locked account", defaultRetention(), []database.RetentionPolicy{lockedAccount, sent}, "account", "account", false},
+		{"folder only", defaultRetention(), []database.RetentionPolicy{{Scope: RetentionScopeFolder, Folder: "Sent", Action: RetentionKeepDays, RetentionDays: 30, AllowOverride: true}}, "default", "folder", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ar := newAccountRetention(tt.parent, tt.policies)
+			if got := ar.forFolder("INBOX").Source; got != tt.wantInbox {
+				t.Errorf("INBOX policy from %s, want %s", got, tt.wantInbox)
+			}
+			if got := ar.forFolder("Sent").Source; got != tt.wantSent {
+				t.Errorf("Sent policy from %s, want %s", got, tt.wantSent)
+			}
+			if got := ar.keepsEverything(); got != tt.wantKeeps {
+				t.Errorf("keepsEverything = %v, want %v", got, tt.wantKeeps)
+			}
+		})
+	}
+}
+
+func TestPurgeReason(t *testing.T) {
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	old := now.AddDate(0, 0, -31)
+	recent := now.AddDate(0, 0, -29)
+
+	tests := []struct {
+		name   string
+		policy EffectivePolicy
+		email  database.EmailIndex
+		purged bool
+	}{
+		{"keep forever", EffectivePolicy{Action: RetentionKeepForever, RetentionDays: 30}, database.EmailIndex{Date: old}, false},
+		{"expired", EffectivePolicy{Action: RetentionKeepDays, RetentionDays: 30}, database.EmailIndex{Date: old}, true},
+		{"not expired", EffectivePolicy{Action: RetentionKeepDays, RetentionDays: 30}, database.EmailIndex{Date: recent}, false},
+		{"no retention days", EffectivePolicy{Action: RetentionKeepDays}, database.EmailIndex{Date: old}, false},
+		{"flagged kept", EffectivePolicy{Action: RetentionDeleteUnlessFlagged, RetentionDays: 30}, database.EmailIndex{Date: old, IsFlagged: true}, false},
+		{"unflagged deleted", EffectivePolicy{Action: RetentionDeleteUnlessFlagged, RetentionDays: 30}, database.EmailIndex{Date: old}, true},
+		{"flag ignored by keep_days", EffectivePolicy{Action: RetentionKeepDays, RetentionDays: 30}, database.EmailIndex{Date: old, IsFlagged: true}, true},
+		{"no date uses archive time", EffectivePolicy{Action: RetentionKeepDays, RetentionDays: 30}, database.EmailIndex{CreatedAt: old}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.purgeReason(&tt.email, now) != ""; got != tt.purged {
+				t.Errorf("purged = %v, want %v", got, tt.purged)
+			}
+		})
+	}
+}
+
+func TestRetentionOutcome(t *testing.T) {
+	now := time.Now()
+	old := now.AddDate(0, 0, -100)
+	lockedUntil := now.Add(24 * time.Hour)
+	lockExpired := now.Add(-time.Hour)
+	heldAccount, searchedAccount, freeAccount := uuid.New(), uuid.New(), uuid.New()
+
+	holds := &HoldSet{
+		accounts: map[uuid.UUID]bool{heldAccount: true},
+		users:    map[uuid.UUID]bool{},
+		searches: []heldSearch{
+			{criteria: HoldSearchCriteria{Sender: "counsel@example.com"}},
+			{criteria: HoldSearchCriteria{Subject: "merger"}, accounts: map[uuid.UUID]bool{searchedAccount: true}},
+		},
+	}
+	policy := keepDays("organization", 30, true)
+
+	tests := []struct {
+		name  string
+		email database.EmailIndex
+		want  int
+	}{
+		{"not expired", database.EmailIndex{AccountID: heldAccount, Date: now}, retentionKept},
+		{"expired", database.EmailIndex{AccountID: freeAccount, Date: old}, retentionPurged},
+		{"compliance lock", database.EmailIndex{AccountID: freeAccount, Date: old, RetainUntil: &lockedUntil}, retentionLocked},
+		{"compliance lock expired", database.EmailIndex{AccountID: freeAccount, Date: old, RetainUntil: &lockExpired}, retentionPurged},
+		{"account hold", database.EmailIndex{AccountID: heldAccount, Date: old}, retentionHeld},
+		{"search hold on every account", database.EmailIndex{AccountID: freeAccount, Date: old, SenderEmail: "Counsel@Example.com"}, retentionHeld},
+		{"search hold on its account", database.EmailIndex{AccountID: searchedAccount, Date: old, Subject: "Re: Merger plans"}, retentionHeld},
+		{"search hold on another account", database.EmailIndex{AccountID: freeAccount, Date: old, Subject: "Re: Merger plans"}, retentionPurged},
+		{"lock counted before hold", database.EmailIndex{AccountID: heldAccount, Date: old, RetainUntil: &lockedUntil}, retentionLocked},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason, got := retentionOutcome(policy, holds, &tt.email, now)
+			if got != tt.want {
+				t.Errorf("outcome = %d, want %d", got, tt.want)
+			}
+			if (reason == "") != (tt.want == retentionKept) {
+				t.Errorf("reason = %q for outcome %d", reason, got)
+			}
+		})
+	}
+}
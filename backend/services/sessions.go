@@ -0,0 +1,258 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"emailprojectv2/auth"
+	"emailprojectv2/config"
+	"emailprojectv2/database"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Reasons a session was revoked
+const (
+	SessionRevokedLogout        = "logout"
+	SessionRevokedLogoutAll     = "logout_all"
+	SessionRevokedReuse         = "refresh_token_reuse"
+	SessionRevokedRole          = "role_changed"
+	SessionRevokedOrg           = "organization_changed"
+	SessionRevokedDeleted       = "user_deleted"
+	SessionRevokedByManager     = "revoked_by_manager"
+	SessionRevokedDisabled      = "user_disabled"
+	SessionRevokedPassword      = "password_changed"
+	SessionRevokedPasswordReset = "password_reset"
+)
+
+// Errors for tokens that no longer grant access
+var (
+	ErrRefreshTokenInvalid = errors.New("refresh token is invalid or expired")
+	ErrSessionMissing      = errors.New("token does not belong to a session")
+	ErrSessionRevoked      = errors.New("session has been revoked or has expired")
+)
+
+// RefreshReuseError is returned when a refresh token is presented a second
+// time. The token has leaked or the client is misbehaving, so the whole
+// session is revoked.
+type RefreshReuseError struct {
+	SessionID uuid.UUID
+	UserID    uuid.UUID
+}
+
+func (e *RefreshReuseError) Error() string {
+	return fmt.Sprintf("refresh token of session %s was reused; the session has been revoked", e.SessionID)
+}
+
+// SessionTTL is how long a session stays valid without being refreshed
+var SessionTTL = 30 * 24 * time.Hour
+
+// ConfigureSessions applies the token lifetimes. Invalid durations keep the defaults.
+func ConfigureSessions(cfg config.JWTConfig) {
+	if ttl, err := time.ParseDuration(cfg.Expiry); err == nil && ttl > 0 {
+		auth.AccessTokenTTL = ttl
+	} else {
+		log.Printf("⚠️ Invalid JWT_EXPIRY %q, using %s", cfg.Expiry, auth.AccessTokenTTL)
+	}
+	if ttl, err := time.ParseDuration(cfg.RefreshExpiry); err == nil && ttl > 0 {
+		SessionTTL = ttl
+	} else {
+		log.Printf("⚠️ Invalid JWT_REFRESH_EXPIRY %q, using %s", cfg.RefreshExpiry, SessionTTL)
+	}
+	log.Printf("🔑 Access tokens last %s, sessions %s without a refresh", auth.AccessTokenTTL, SessionTTL)
+}
+
+// hashToken returns the stored form of a refresh, challenge or recovery token
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newRefreshToken creates a refresh token for a session in tx and returns its plain value
+func newRefreshToken(tx *gorm.DB, sessionID uuid.UUID, expiresAt time.Time) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate refresh token: %v", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+
+	record := database.RefreshToken{
+		SessionID: sessionID,
+		TokenHash: hashToken(token),
+		ExpiresAt: expiresAt,
+	}
+	if err := tx.Create(&record).Error; err != nil {
+		return "", fmt.Errorf("failed to store refresh token: %v", err)
+	}
+	return token, nil
+}
+
+// CreateSession opens a session for a user and returns it with its first refresh token
+func CreateSession(userID uuid.UUID, ipAddress, userAgent string) (*database.AuthSession, string, error) {
+	now := time.Now()
+	session := database.AuthSession{
+		UserID:     userID,
+		IPAddress:  ipAddress,
+		UserAgent:  userAgent,
+		ExpiresAt:  now.Add(SessionTTL),
+		LastUsedAt: now,
+	}
+
+	var token string
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&session).Error; err != nil {
+			return fmt.Errorf("failed to create session: %v", err)
+		}
+		var err error
+		token, err = newRefreshToken(tx, session.ID, session.ExpiresAt)
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return &session, token, nil
+}
+
+// RotateRefreshToken exchanges a refresh token for a new one and extends its
+// session. A token can be exchanged once: presenting it again revokes the
+// session and returns a *RefreshReuseError.
+func RotateRefreshToken(token string) (*database.AuthSession, string, error) {
+	var record database.RefreshToken
+	err := database.DB.Preload("Session").Where("token_hash = ?", hashToken(token)).First(&record).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, "", ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to load refresh token: %v", err)
+	}
+
+	session := record.Session
+	now := time.Now()
+	var reused *RefreshReuseError
+	if err := checkRefreshToken(&record, now); errors.As(err, &reused) {
+		return nil, "", revokeReusedSession(reused)
+	} else if err != nil {
+		return nil, "", err
+	}
+
+	reused = &RefreshReuseError{SessionID: session.ID, UserID: session.UserID}
+	var newToken string
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		// Only one of two concurrent exchanges of the same token can mark it used
+		result := tx.Model(&database.RefreshToken{}).Where("id = ? AND used_at IS NULL", record.ID).Update("used_at", now)
+		if result.Error != nil {
+			return fmt.Errorf("failed to mark refresh token used: %v", result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return reused
+		}
+
+		session.ExpiresAt = now.Add(SessionTTL)
+		session.LastUsedAt = now
+		if err := tx.Model(&database.AuthSession{}).Where("id = ?", session.ID).
+			Updates(map[string]interface{}{"expires_at": session.ExpiresAt, "last_used_at": now}).Error; err != nil {
+			return fmt.Errorf("failed to extend session: %v", err)
+		}
+
+		var err error
+		newToken, err = newRefreshToken(tx, session.ID, session.ExpiresAt)
+		return err
+	})
+	if errors.As(err, &reused) {
+		return nil, "", revokeReusedSession(reused)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return &session, newToken, nil
+}
+
+// checkRefreshToken decides whether a stored refresh token, loaded with its
+// session, can be exchanged. A token that was already exchanged gives a
+// *RefreshReuseError unless its session is closed anyway.
+func checkRefreshToken(record *database.RefreshToken, now time.Time) error {
+	session := record.Session
+	if session.RevokedAt != nil || now.After(session.ExpiresAt) {
+		return ErrRefreshTokenInvalid
+	}
+	if record.UsedAt != nil {
+		return &RefreshReuseError{SessionID: session.ID, UserID: session.UserID}
+	}
+	if now.After(record.ExpiresAt) {
+		return ErrRefreshTokenInvalid
+	}
+	return nil
+}
+
+// revokeReusedSession revokes the session of a reused refresh token
+func revokeReusedSession(reused *RefreshReuseError) error {
+	log.Printf("🚨 Refresh token reuse detected for session %s of user %s", reused.SessionID, reused.UserID)
+	if err := RevokeSession(reused.SessionID, SessionRevokedReuse); err != nil {
+		return err
+	}
+	return reused
+}
+
+// RevokeSession revokes one session. Revoking a revoked session is a no-op.
+func RevokeSession(sessionID uuid.UUID, reason string) error {
+	err := database.DB.Model(&database.AuthSession{}).Where("id = ? AND revoked_at IS NULL", sessionID).
+		Updates(map[string]interface{}{"revoked_at": time.Now(), "revoked_reason": reason}).Error
+	if err != nil {
+		return fmt.Errorf("failed to revoke session: %v", err)
+	}
+	return nil
+}
+
+// RevokeUserSessions revokes every open session of a user and returns how many there were
+func RevokeUserSessions(userID uuid.UUID, reason string) (int64, error) {
+	result := database.DB.Model(&database.AuthSession{}).Where("user_id = ? AND revoked_at IS NULL", userID).
+		Updates(map[string]interface{}{"revoked_at": time.Now(), "revoked_reason": reason})
+	if result.Error != nil {
+		return 0, fmt.Errorf("failed to revoke sessions: %v", result.Error)
+	}
+	if result.RowsAffected > 0 {
+		log.Printf("🔒 Revoked %d sessions of user %s (%s)", result.RowsAffected, userID, reason)
+	}
+	return result.RowsAffected, nil
+}
+
+// RevokeOtherSessions revokes every open session of a user except one, such
+// as the session that changed the password, and returns how many there were
+func RevokeOtherSessions(userID, keepSessionID uuid.UUID, reason string) (int64, error) {
+	result := database.DB.Model(&database.AuthSession{}).Where("user_id = ? AND id <> ? AND revoked_at IS NULL", userID, keepSessionID).
+		Updates(map[string]interface{}{"revoked_at": time.Now(), "revoked_reason": reason})
+	if result.Error != nil {
+		return 0, fmt.Errorf("failed to revoke sessions: %v", result.Error)
+	}
+	if result.RowsAffected > 0 {
+		log.Printf("🔒 Revoked %d other sessions of user %s (%s)", result.RowsAffected, userID, reason)
+	}
+	return result.RowsAffected, nil
+}
+
+// CheckSession verifies that the session of a validated access token is still
+// open. Tokens issued before sessions existed carry no session and are refused.
+func CheckSession(claims *auth.Claims) error {
+	sessionID, err := uuid.Parse(claims.SessionID)
+	if err != nil {
+		return ErrSessionMissing
+	}
+	var open int64
+	err = database.DB.Model(&database.AuthSession{}).
+		Where("id = ? AND revoked_at IS NULL AND expires_at > ?", sessionID, time.Now()).
+		Count(&open).Error
+	if err != nil {
+		return fmt.Errorf("failed to check session: %v", err)
+	}
+	if open == 0 {
+		return ErrSessionRevoked
+	}
+	return nil
+}
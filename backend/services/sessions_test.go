@@ -0,0 +1,71 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"emailprojectv2/database"
+
+	"github.com/google/uuid"
+)
+
+func TestCheckRefreshToken(t *testing.T) {
+	now := time.Now()
+	earlier := now.Add(-time.Minute)
+	open := database.AuthSession{ID: uuid.New(), UserID: uuid.New(), ExpiresAt: now.Add(time.Hour)}
+	revoked := open
+	revoked.RevokedAt = &earlier
+	expired := open
+	expired.ExpiresAt = earlier
+
+	tests := []struct {
+		name      string
+		record    database.RefreshToken
+		wantErr   error
+		wantReuse bool
+	}{
+		{"current token", database.RefreshToken{Session: open, ExpiresAt: now.Add(time.Hour)}, nil, false},
+		{"rotated token presented again", database.RefreshToken{Session: open, ExpiresAt: now.Add(time.Hour), UsedAt: &earlier}, nil, true},
+		{"expired token", database.RefreshToken{Session: open, ExpiresAt: earlier}, ErrRefreshTokenInvalid, false},
+		{"rotated and expired token", database.RefreshToken{Session: open, ExpiresAt: earlier, UsedAt: &earlier}, nil, true},
+		{"revoked session", database.RefreshToken{Session: revoked, ExpiresAt: now.Add(time.Hour)}, ErrRefreshTokenInvalid, false},
+		{"reuse on revoked session", database.RefreshToken{Session: revoked, ExpiresAt: now.Add(time.Hour), UsedAt: &earlier}, ErrRefreshTokenInvalid, false},
+		{"expired session", database.RefreshToken{Session: expired, ExpiresAt: now.Add(time.Hour)}, ErrRefreshTokenInvalid, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkRefreshToken(&tt.record, now)
+
+			var reused *RefreshReuseError
+			if tt.wantReuse {
+				if !errors.As(err, &reused) {
+					t.Fatalf("error = %v, want a *RefreshReuseError", err)
+				}
+				if reused.SessionID != tt.record.Session.ID || reused.UserID != tt.record.Session.UserID {
+					t.Errorf("reuse reported for session %s of user %s", reused.SessionID, reused.UserID)
+				}
+				return
+			}
+			if errors.As(err, &reused) {
+				t.Fatalf("unexpected reuse error: %v", err)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHashToken(t *testing.T) {
+	a, b := hashToken("token-a"), hashToken("token-b")
+	if a != hashToken("token-a") {
+		t.Error("hashToken is not deterministic")
+	}
+	if a == b {
+		t.Error("different tokens share a hash")
+	}
+	if len(a) != 64 {
+		t.Errorf("hash length = %d, want 64 to fit the token_hash column", len(a))
+	}
+}
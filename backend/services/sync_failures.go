@@ -0,0 +1,337 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"emailprojectv2/database"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Sync stages a message can fail in
+const (
+	SyncStageFetch = "fetch"
+	SyncStageParse = "parse"
+	SyncStageStore = "store"
+	SyncStageIndex = "index"
+)
+
+// syncStageError tags an error with the pipeline stage it happened in
+type syncStageError struct {
+	stage string
+	err   error
+}
+
+func (e *syncStageError) Error() string {
+	return fmt.Sprintf("%s: %v", e.stage, e.err)
+}
+
+func (e *syncStageError) Unwrap() error {
+	return e.err
+}
+
+func stageError(stage string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &syncStageError{stage: stage, err: err}
+}
+
+// FailedItem identifies a message at the provider so it can be refetched later
+type FailedItem struct {
+	Folder         string
+	ProviderItemID string
+	ChangeKey      string
+	MessageID      string
+	Subject        string
+}
+
+// SyncFailureTracker records per-message sync failures and schedules their retries
+type SyncFailureTracker struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+var FailureTracker = &SyncFailureTracker{
+	MaxAttempts: 5,
+	BaseDelay:   15 * time.Minute,
+	MaxDelay:    24 * time.Hour,
+}
+
+// RecordFailure upserts the failure row for an item and schedules the next retry
+func (t *SyncFailureTracker) RecordFailure(accountID uuid.UUID, item FailedItem, err error) {
+	if item.ProviderItemID == "" {
+		log.Printf("⚠️ Cannot record sync failure without provider item ID (account %s): %v", accountID, err)
+		return
+	}
+
+	stage := SyncStageFetch
+	var se *syncStageError
+	if errors.As(err, &se) {
+		stage = se.stage
+	}
+	errorClass := ClassifySyncError(err)
+	now := time.Now()
+
+	var failure database.SyncFailure
+	result := database.DB.Where("account_id = ? AND folder = ? AND provider_item_id = ?",
+		accountID, item.Folder, item.ProviderItemID).First(&failure)
+
+	if result.Error == gorm.ErrRecordNotFound {
+		failure = database.SyncFailure{
+			AccountID:      accountID,
+			Folder:         item.Folder,
+			ProviderItemID: item.ProviderItemID,
+			ChangeKey:      item.ChangeKey,
+			MessageID:      item.MessageID,
+			Subject:        item.Subject,
+			Stage:          stage,
+			ErrorClass:     errorClass,
+			ErrorMessage:   err.Error(),
+			AttemptCount:   1,
+			Status:         "pending",
+			FirstFailedAt:  now,
+			LastAttemptAt:  now,
+		}
+		if errorClass == "oversize" {
+			// Retrying cannot help until the size limit or policy changes
+			failure.Status = "abandoned"
+		} else {
+			nextRetry := now.Add(t.retryDelay(1))
+			failure.NextRetryAt = &nextRetry
+		}
+
+		if err := database.DB.Create(&failure).Error; err != nil {
+			log.Printf("❌ Failed to record sync failure for item %s: %v", item.ProviderItemID, err)
+		}
+		return
+	} else if result.Error != nil {
+		log.Printf("❌ Failed to look up sync failure for item %s: %v", item.ProviderItemID, result.Error)
+		return
+	}
+
+	failure.AttemptCount++
+	failure.Stage = stage
+	failure.ErrorClass = errorClass
+	failure.ErrorMessage = err.Error()
+	failure.LastAttemptAt = now
+	failure.ResolvedAt = nil
+	if item.ChangeKey != "" {
+		failure.ChangeKey = item.ChangeKey
+	}
+	if item.Subject != "" {
+		failure.Subject = item.Subject
+	}
+
+	if failure.AttemptCount >= t.MaxAttempts || errorClass == "not_found" || errorClass == "oversize" {
+		failure.Status = "abandoned"
+		failure.NextRetryAt = nil
+		log.Printf("🛑 Giving up on item %s after %d attempts (%s)", item.ProviderItemID, failure.AttemptCount, errorClass)
+	} else {
+		failure.Status = "pending"
+		nextRetry := now.Add(t.retryDelay(failure.AttemptCount))
+		failure.NextRetryAt = &nextRetry
+	}
+
+	if err := database.DB.Save(&failure).Error; err != nil {
+		log.Printf("❌ Failed to update sync failure for item %s: %v", item.ProviderItemID, err)
+	}
+}
+
+// ResolveFailure marks a previously failed item as recovered
+func (t *SyncFailureTracker) ResolveFailure(accountID uuid.UUID, folder, providerItemID string) {
+	now := time.Now()
+	result := database.DB.Model(&database.SyncFailure{}).
+		Where("account_id = ? AND folder = ? AND provider_item_id = ? AND status <> ?", accountID, folder, providerItemID, "resolved").
+		Updates(map[string]interface{}{
+			"status":        "resolved",
+			"resolved_at":   now,
+			"next_retry_at": nil,
+		})
+	if result.Error != nil {
+		log.Printf("⚠️ Failed to resolve sync failure for item %s: %v", providerItemID, result.Error)
+	} else if result.RowsAffected > 0 {
+		log.Printf("✅ Recovered previously failed item %s", providerItemID)
+	}
+}
+
+// GetFailures returns the recorded failures for an account, optionally filtered by status
+func (t *SyncFailureTracker) GetFailures(accountID uuid.UUID, status string, limit, offset int) ([]database.SyncFailure, int64, error) {
+	var failures []database.SyncFailure
+	var total int64
+
+	query := database.DB.Model(&database.SyncFailure{}).Where("account_id = ?", accountID)
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	err := query.Order("last_attempt_at DESC").Offset(offset).Limit(limit).Find(&failures).Error
+	return failures, total, err
+}
+
+// GetFailureSummary returns failure counts per status for an account
+func (t *SyncFailureTracker) GetFailureSummary(accountID uuid.UUID) (map[string]int64, error) {
+	var rows []struct {
+		Status string
+		Count  int64
+	}
+	err := database.DB.Model(&database.SyncFailure{}).
+		Select("status, count(*) as count").
+		Where("account_id = ?", accountID).
+		Group("status").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	summary := map[string]int64{"pending": 0, "resolved": 0, "abandoned": 0}
+	for _, row := range rows {
+		summary[row.Status] = row.Count
+	}
+	return summary, nil
+}
+
+// DueFailures returns pending failures whose retry time has passed, grouped by account
+func (t *SyncFailureTracker) DueFailures(limit int) (map[uuid.UUID][]database.SyncFailure, error) {
+	var failures []database.SyncFailure
+	err := database.DB.Where("status = ? AND next_retry_at <= ?", "pending", time.Now()).
+		Order("next_retry_at ASC").
+		Limit(limit).
+		Find(&failures).Error
+	if err != nil {
+		return nil, err
+	}
+
+	byAccount := make(map[uuid.UUID][]database.SyncFailure)
+	for _, f := range failures {
+		byAccount[f.AccountID] = append(byAccount[f.AccountID], f)
+	}
+	return byAccount, nil
+}
+
+// RetryAccountFailures refetches only the failed items of an account.
+// When dueOnly is false every pending failure is retried regardless of its schedule.
+func (t *SyncFailureTracker) RetryAccountFailures(accountID uuid.UUID, dueOnly bool) (int, error) {
+	var account database.EmailAccount
+	if err := database.DB.Where("id = ?", accountID).First(&account).Error; err != nil {
+		return 0, fmt.Errorf("failed to get account details: %v", err)
+	}
+
+	if !account.IsActive {
+		return 0, fmt.Errorf("account %s is not active", accountID)
+	}
+
+	if ProgressManager.IsAccountSyncing(accountID) {
+		return 0, fmt.Errorf("account %s is currently syncing", accountID)
+	}
+
+	if err := CheckSyncQuota(accountID); err != nil {
+		return 0, err
+	}
+
+	query := database.DB.Where("account_id = ? AND status = ?", accountID, "pending")
+	if dueOnly {
+		query = query.Where("next_retry_at <= ?", time.Now())
+	}
+
+	var failures []database.SyncFailure
+	if err := query.Order("first_failed_at ASC").Find(&failures).Error; err != nil {
+		return 0, fmt.Errorf("failed to load sync failures: %v", err)
+	}
+
+	if len(failures) == 0 {
+		return 0, nil
+	}
+
+	log.Printf("🔁 Retrying %d failed messages for account %s (%s)", len(failures), accountID, account.Provider)
+
+	switch account.Provider {
+	case "gmail":
+		gmailService := NewGmailServiceV1("imap.gmail.com", "993", account.Username, account.Password)
+		return gmailService.RetryFailedMessages(accountID, failures)
+	case "exchange":
+		exchangeService := NewExchangeServiceForAccount(&account)
+		return exchangeService.RetryFailedItems(accountID, failures)
+	case "office365":
+		graphService, err := NewGraphMailServiceForAccount(&account)
+		if err != nil {
+			return 0, err
+		}
+		return graphService.RetryFailedItems(accountID, failures)
+	default:
+		return 0, fmt.Errorf("targeted retry is not supported for provider %s", account.Provider)
+	}
+}
+
+// retryDelay returns the exponential backoff delay for the given attempt number
+func (t *SyncFailureTracker) retryDelay(attempt int) time.Duration {
+	delay := t.BaseDelay
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if delay >= t.MaxDelay {
+			return t.MaxDelay
+		}
+	}
+	return delay
+}
+
+// ClassifySyncError maps an error to a coarse class used for reporting and retry decisions
+func ClassifySyncError(err error) string {
+	if err == nil {
+		return "unknown"
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return "network"
+	}
+
+	var oversizeErr *OversizeError
+	if errors.As(err, &oversizeErr) {
+		return "oversize"
+	}
+
+	var se *syncStageError
+	stage := ""
+	if errors.As(err, &se) {
+		stage = se.stage
+	}
+
+	msg := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(msg, "serverbusy") || strings.Contains(msg, "throttl") ||
+		strings.Contains(msg, "too many requests") || strings.Contains(msg, "http error 429"):
+		return "throttled"
+	case strings.Contains(msg, "authentication") || strings.Contains(msg, "http error 401") ||
+		strings.Contains(msg, "invalid credentials") || strings.Contains(msg, "login"):
+		return "auth"
+	case strings.Contains(msg, "itemnotfound") || strings.Contains(msg, "not found on server") ||
+		strings.Contains(msg, "no longer exists"):
+		return "not_found"
+	case strings.Contains(msg, "timeout") || strings.Contains(msg, "connection") ||
+		strings.Contains(msg, "eof") || strings.Contains(msg, "broken pipe"):
+		return "network"
+	}
+
+	switch stage {
+	case SyncStageStore:
+		return "storage"
+	case SyncStageIndex:
+		return "database"
+	case SyncStageParse:
+		return "parse"
+	}
+
+	return "unknown"
+}
@@ -0,0 +1,115 @@
+package services
+
+import (
+	"log"
+	"sync"
+
+	"emailprojectv2/config"
+)
+
+// Provider limits the sync tuning is clamped to
+const (
+	maxEWSFetchConcurrency = 10 // Exchange default EWSMaxConcurrency per mailbox
+	maxEWSBatchSize        = 100
+	maxIMAPFetchChunkSize  = 500
+	maxSyncParallelism     = 32
+	minStreamChunkBytes    = 1 << 20
+)
+
+var SyncTuning = config.SyncConfig{
+	Parallelism:        4,
+	FetchParallelism:   2,
+	ExchangeBatchSize:  25,
+	IMAPFetchChunkSize: 50,
+	MaxMessageBytes:    150 << 20,
+	OversizePolicy:     OversizeStore,
+	StreamChunkBytes:   8 << 20,
+}
+
+// ConfigureSync sets the per-account sync parallelism, clamped to provider limits
+func ConfigureSync(cfg config.SyncConfig) {
+	cfg.Parallelism = clampInt(cfg.Parallelism, 1, maxSyncParallelism)
+	cfg.FetchParallelism = clampInt(cfg.FetchParallelism, 1, maxEWSFetchConcurrency)
+	cfg.ExchangeBatchSize = clampInt(cfg.ExchangeBatchSize, 1, maxEWSBatchSize)
+	cfg.IMAPFetchChunkSize = clampInt(cfg.IMAPFetchChunkSize, 1, maxIMAPFetchChunkSize)
+	if cfg.StreamChunkBytes < minStreamChunkBytes {
+		cfg.StreamChunkBytes = minStreamChunkBytes
+	}
+
+	switch cfg.OversizePolicy {
+	case OversizeSkip, OversizeTruncate, OversizeStore:
+	default:
+		log.Printf("⚠️ Unknown oversize message policy %q, using %q", cfg.OversizePolicy, OversizeStore)
+		cfg.OversizePolicy = OversizeStore
+	}
+	SyncTuning = cfg
+
+	log.Printf("⚙️  Sync tuning: %d workers, %d concurrent fetches, EWS batch %d, IMAP chunk %d, max message %d MB (%s), IMAP stream chunk %d MB",
+		cfg.Parallelism, cfg.FetchParallelism, cfg.ExchangeBatchSize, cfg.IMAPFetchChunkSize,
+		cfg.MaxMessageBytes>>20, cfg.OversizePolicy, cfg.StreamChunkBytes>>20)
+}
+
+func clampInt(value, min, max int) int {
+	if value < min {
+		return min
+	}
+	if value > max {
+		return max
+	}
+	return value
+}
+
+// runStage applies fn to every input using n workers. Inputs for which fn
+// returns false are dropped; fn is responsible for reporting their failure.
+// The returned channel is closed once the input is drained.
+func runStage[In, Out any](n int, in <-chan In, fn func(In) (Out, bool)) <-chan Out {
+	out := make(chan Out, n)
+
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			for item := range in {
+				if result, ok := fn(item); ok {
+					out <- result
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+
+	return out
+}
+
+// drainStage applies fn to every input using n workers and waits until all are done
+func drainStage[In any](n int, in <-chan In, fn func(In)) {
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			for item := range in {
+				fn(item)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// chunkUint32 splits ids into consecutive chunks of at most size elements
+func chunkUint32(ids []uint32, size int) [][]uint32 {
+	var chunks [][]uint32
+	for start := 0; start < len(ids); start += size {
+		end := start + size
+		if end > len(ids) {
+			end = len(ids)
+		}
+		chunks = append(chunks, ids[start:end])
+	}
+	return chunks
+}
@@ -101,6 +101,36 @@ func (spm *SyncProgressManager) ProcessEmail(accountID uuid.UUID, subject string
 	spm.broadcastUpdate(accountID, progress)
 }
 
+// SetThrottled reports that the sync is waiting for the provider to accept requests again
+func (spm *SyncProgressManager) SetThrottled(accountID uuid.UUID, until time.Time) {
+	spm.mu.Lock()
+	defer spm.mu.Unlock()
+
+	progress := spm.progresses[accountID]
+	if progress == nil || progress.IsCompleted {
+		return
+	}
+
+	progress.SetThrottled(until)
+	log.Printf("🚦 Sync for %s throttled: %s", accountID.String(), progress.CurrentOperation)
+	spm.broadcastUpdate(accountID, progress)
+}
+
+// ClearThrottled resumes the progress status after a throttling pause
+func (spm *SyncProgressManager) ClearThrottled(accountID uuid.UUID) {
+	spm.mu.Lock()
+	defer spm.mu.Unlock()
+
+	progress := spm.progresses[accountID]
+	if progress == nil || progress.IsCompleted || progress.Status != "throttled" {
+		return
+	}
+
+	progress.ClearThrottled()
+	log.Printf("▶️  Sync for %s resumed after throttling", accountID.String())
+	spm.broadcastUpdate(accountID, progress)
+}
+
 // SetError sets an error and completes the sync
 func (spm *SyncProgressManager) SetError(accountID uuid.UUID, err error) {
 	spm.mu.Lock()
@@ -230,6 +260,21 @@ func (spm *SyncProgressManager) saveToHistory(progress *models.SyncProgress) {
 	} else {
 		log.Printf("💾 Saved sync history for account %s", progress.AccountID.String())
 	}
+
+	event := database.AuditEvent{
+		Action:     "account.sync",
+		TargetType: "email_account",
+		TargetID:   progress.AccountID.String(),
+		Detail:     fmt.Sprintf("%d successful, %d failed", progress.SuccessfulEmails, progress.FailedEmails),
+	}
+	if progress.ErrorMessage != "" {
+		event.Result = AuditResultFailure
+		event.Detail += ": " + progress.ErrorMessage
+	}
+	if orgID, err := AccountOrganizationID(progress.AccountID); err == nil {
+		event.OrganizationID = orgID
+	}
+	RecordAudit(event)
 }
 
 // cleanup removes progress data after sync completion
@@ -0,0 +1,561 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"emailprojectv2/auth"
+	"emailprojectv2/config"
+	"emailprojectv2/database"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Tenant connector types
+const (
+	ConnectorTypeExchangeEWS = "exchange_ews"
+	ConnectorTypeGraph       = "graph"
+)
+
+var (
+	ErrConnectorNotFound   = errors.New("tenant connector not found")
+	ErrConnectorRunning    = errors.New("this connector is already running")
+	ErrNotConnectorAccount = errors.New("account was not created by a tenant connector")
+)
+
+// ConnectorSettings holds the tenant connector settings
+var ConnectorSettings = config.ConnectorConfig{
+	RunIntervalMinutes: 360,
+	MailboxParallelism: 2,
+	GraphURL:           "https://graph.microsoft.com/v1.0",
+	GraphLoginURL:      "https://login.microsoftonline.com",
+}
+
+// ConfigureConnectors replaces the tenant connector settings
+func ConfigureConnectors(cfg config.ConnectorConfig) {
+	if cfg.RunIntervalMinutes < 1 {
+		cfg.RunIntervalMinutes = 360
+	}
+	cfg.MailboxParallelism = clampInt(cfg.MailboxParallelism, 1, 10)
+	if cfg.GraphURL == "" {
+		cfg.GraphURL = ConnectorSettings.GraphURL
+	}
+	if cfg.GraphLoginURL == "" {
+		cfg.GraphLoginURL = ConnectorSettings.GraphLoginURL
+	}
+	ConnectorSettings = cfg
+	log.Printf("🏢 Tenant connectors run every %d minutes, %d mailboxes at a time", cfg.RunIntervalMinutes, cfg.MailboxParallelism)
+}
+
+// connectorAccountSettings are the provider settings of an account created
+// by a tenant connector
+type connectorAccountSettings struct {
+	TenantConnector string `json:"tenant_connector,omitempty"`
+	GraphUserID     string `json:"graph_user_id,omitempty"`
+	Impersonate     string `json:"impersonate,omitempty"`
+}
+
+// parseConnectorAccountSettings reads the connector settings of an account;
+// they are empty for accounts added with the user's own credentials
+func parseConnectorAccountSettings(account *database.EmailAccount) connectorAccountSettings {
+	var settings connectorAccountSettings
+	if account.ProviderSettings != "" {
+		json.Unmarshal([]byte(account.ProviderSettings), &settings)
+	}
+	return settings
+}
+
+// ConnectorAccountFilter matches, with provider_settings @> ?::jsonb, the
+// accounts a connector created
+func ConnectorAccountFilter(connectorID uuid.UUID) string {
+	filter, _ := json.Marshal(connectorAccountSettings{TenantConnector: connectorID.String()})
+	return string(filter)
+}
+
+// DiscoveredMailbox is a mailbox found by a tenant connector
+type DiscoveredMailbox struct {
+	Email       string // Lowercased primary SMTP address
+	Name        string
+	GraphUserID string // Only for Graph connectors
+}
+
+// DiscoverMailboxes lists the mailboxes a connector backs up
+func DiscoverMailboxes(connector *database.TenantConnector) ([]DiscoveredMailbox, []string, error) {
+	switch connector.Type {
+	case ConnectorTypeExchangeEWS:
+		es := NewExchangeService(connector.ServerURL, connector.Username, connector.Password, connector.Domain)
+		return expandDistributionGroup(es, connector.DiscoveryGroup)
+	case ConnectorTypeGraph:
+		client := NewGraphClient(connector.TenantID, connector.ClientID, connector.ClientSecret)
+		users, err := client.listMailboxUsers(context.Background())
+		if err != nil {
+			return nil, nil, err
+		}
+		mailboxes := make([]DiscoveredMailbox, 0, len(users))
+		for _, user := range users {
+			mailboxes = append(mailboxes, DiscoveredMailbox{Email: strings.ToLower(user.Mail), Name: user.DisplayName, GraphUserID: user.ID})
+		}
+		return mailboxes, nil, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown connector type %s", connector.Type)
+	}
+}
+
+// ewsExpandDLResponse is the part of an ExpandDL response that is used
+type ewsExpandDLResponse struct {
+	Body struct {
+		ExpandDLResponse struct {
+			ResponseMessages struct {
+				Message struct {
+					ResponseClass string `xml:"ResponseClass,attr"`
+					ResponseCode  string `xml:"ResponseCode"`
+					MessageText   string `xml:"MessageText"`
+					DLExpansion   struct {
+						IncludesLastItemInRange string `xml:"IncludesLastItemInRange,attr"`
+						Mailbox                 []struct {
+							Name         string `xml:"Name"`
+							EmailAddress string `xml:"EmailAddress"`
+							MailboxType  string `xml:"MailboxType"`
+						} `xml:"Mailbox"`
+					} `xml:"DLExpansion"`
+				} `xml:"ExpandDLResponseMessage"`
+			} `xml:"ResponseMessages"`
+		} `xml:"ExpandDLResponse"`
+	} `xml:"Body"`
+}
+
+// expandDistributionGroup returns the mailboxes in a distribution group and
+// the groups nested in it. The warnings list groups Exchange did not expand
+// completely.
+func expandDistributionGroup(es *ExchangeService, group string) ([]DiscoveredMailbox, []string, error) {
+	mailboxes := []DiscoveredMailbox{}
+	warnings := []string{}
+	found := map[string]bool{}
+	expanded := map[string]bool{strings.ToLower(group): true}
+	pending := []string{group}
+
+	for len(pending) > 0 {
+		current := pending[0]
+		pending = pending[1:]
+
+		var address strings.Builder
+		xml.EscapeText(&address, []byte(current))
+		soapBody := `<?xml version="1.0" encoding="utf-8"?>` +
+			`<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/" ` +
+			`xmlns:t="http://schemas.microsoft.com/exchange/services/2006/types" ` +
+			`xmlns:m="http://schemas.microsoft.com/exchange/services/2006/messages">` +
+			`<soap:Header><t:RequestServerVersion Version="Exchange2010_SP2"/></soap:Header>` +
+			`<soap:Body><m:ExpandDL><m:Mailbox><t:EmailAddress>` + address.String() +
+			`</t:EmailAddress></m:Mailbox></m:ExpandDL></soap:Body></soap:Envelope>`
+
+		statusCode, body, err := es.doThrottledRequest(soapBody, "http://schemas.microsoft.com/exchange/services/2006/messages/ExpandDL")
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to expand %s: %v", current, err)
+		}
+		if statusCode != 200 {
+			return nil, nil, fmt.Errorf("failed to expand %s: HTTP error %d", current, statusCode)
+		}
+		var resp ewsExpandDLResponse
+		if err := xml.Unmarshal(body, &resp); err != nil {
+			return nil, nil, fmt.Errorf("failed to parse ExpandDL response: %v", err)
+		}
+		message := resp.Body.ExpandDLResponse.ResponseMessages.Message
+		if message.ResponseClass != "Success" {
+			return nil, nil, fmt.Errorf("failed to expand %s: %s %s", current, message.ResponseCode, message.MessageText)
+		}
+		if message.DLExpansion.IncludesLastItemInRange == "false" {
+			warnings = append(warnings, fmt.Sprintf("%s: Exchange returned only part of the group", current))
+		}
+
+		for _, member := range message.DLExpansion.Mailbox {
+			email := strings.ToLower(member.EmailAddress)
+			switch member.MailboxType {
+			case "Mailbox":
+				if !found[email] {
+					found[email] = true
+					mailboxes = append(mailboxes, DiscoveredMailbox{Email: email, Name: member.Name})
+				}
+			case "PublicDL":
+				if !expanded[email] {
+					expanded[email] = true
+					pending = append(pending, member.EmailAddress)
+				}
+			}
+		}
+	}
+	return mailboxes, warnings, nil
+}
+
+var (
+	connectorRuns   = map[uuid.UUID]bool{}
+	connectorRunsMu sync.Mutex
+)
+
+// RunAllTenantConnectors runs every active connector in turn
+func RunAllTenantConnectors() error {
+	var connectors []database.TenantConnector
+	if err := database.DB.Where("is_active = ?", true).Find(&connectors).Error; err != nil {
+		return fmt.Errorf("failed to load tenant connectors: %v", err)
+	}
+
+	failed := 0
+	for _, connector := range connectors {
+		_, err := RunTenantConnector(connector.ID, nil)
+		if errors.Is(err, ErrConnectorRunning) {
+			log.Printf("⏭️  Tenant connector %s already running, skipping scheduled run", connector.Name)
+			continue
+		}
+		if err != nil {
+			log.Printf("❌ Tenant connector %s failed: %v", connector.Name, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d tenant connectors failed", failed, len(connectors))
+	}
+	return nil
+}
+
+// RunTenantConnector discovers the mailboxes of a connector, creates accounts
+// for new ones, pauses those of mailboxes that are gone, and syncs them all
+func RunTenantConnector(connectorID uuid.UUID, triggeredBy *uuid.UUID) (*database.TenantConnectorRun, error) {
+	cr, err := startConnectorRun(connectorID, triggeredBy)
+	if err != nil {
+		return nil, err
+	}
+	return cr.run, cr.finish(cr.execute())
+}
+
+// StartTenantConnectorRun starts a connector run in the background and
+// returns it while it is running
+func StartTenantConnectorRun(connectorID uuid.UUID, triggeredBy *uuid.UUID) (*database.TenantConnectorRun, error) {
+	cr, err := startConnectorRun(connectorID, triggeredBy)
+	if err != nil {
+		return nil, err
+	}
+	started := *cr.run
+	go cr.finish(cr.execute())
+	return &started, nil
+}
+
+// connectorRun is one run of a tenant connector
+type connectorRun struct {
+	connector *database.TenantConnector
+	run       *database.TenantConnectorRun
+	role      database.Role
+
+	mu       sync.Mutex // Guards run counters and warnings while mailboxes sync
+	warnings []string
+}
+
+// startConnectorRun claims the connector and records the start of a run
+func startConnectorRun(connectorID uuid.UUID, triggeredBy *uuid.UUID) (*connectorRun, error) {
+	var connector database.TenantConnector
+	err := database.DB.Where("id = ? AND is_active = ?", connectorID, true).First(&connector).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrConnectorNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tenant connector: %v", err)
+	}
+
+	connectorRunsMu.Lock()
+	if connectorRuns[connectorID] {
+		connectorRunsMu.Unlock()
+		return nil, ErrConnectorRunning
+	}
+	connectorRuns[connectorID] = true
+	connectorRunsMu.Unlock()
+
+	run := &database.TenantConnectorRun{
+		ConnectorID:    connector.ID,
+		OrganizationID: connector.OrganizationID,
+		TriggeredBy:    triggeredBy,
+		Status:         "running",
+		StartedAt:      time.Now(),
+	}
+	if err := database.DB.Create(run).Error; err != nil {
+		connectorRunsMu.Lock()
+		delete(connectorRuns, connectorID)
+		connectorRunsMu.Unlock()
+		return nil, fmt.Errorf("failed to record connector run: %v", err)
+	}
+	log.Printf("🏢 Running tenant connector %s (%s)", connector.Name, connector.Type)
+	return &connectorRun{connector: &connector, run: run}, nil
+}
+
+// finish records the outcome of the run and releases the connector
+func (cr *connectorRun) finish(runErr error) error {
+	defer func() {
+		connectorRunsMu.Lock()
+		delete(connectorRuns, cr.connector.ID)
+		connectorRunsMu.Unlock()
+	}()
+
+	now := time.Now()
+	cr.run.CompletedAt = &now
+	cr.run.Status = "completed"
+	if runErr != nil {
+		cr.run.Status = "failed"
+		cr.run.ErrorMessage = runErr.Error()
+	}
+	cr.run.Warnings = strings.Join(cr.warnings, "\n")
+	if err := database.DB.Save(cr.run).Error; err != nil {
+		log.Printf("⚠️ Failed to record connector run result: %v", err)
+	}
+	database.DB.Model(cr.connector).Update("last_run_at", now)
+
+	log.Printf("🏢 Tenant connector %s %s: %d mailboxes found, %d users and %d accounts created, %d paused, %d resumed, %d skipped, %d synced, %d syncs failed",
+		cr.connector.Name, cr.run.Status, cr.run.MailboxesFound, cr.run.UsersCreated, cr.run.AccountsCreated, cr.run.AccountsPaused,
+		cr.run.AccountsResumed, cr.run.MailboxesSkipped, cr.run.MailboxesSynced, cr.run.SyncsFailed)
+	return runErr
+}
+
+// warn records a mailbox the run could not handle
+func (cr *connectorRun) warn(format string, args ...interface{}) {
+	cr.mu.Lock()
+	cr.warnings = append(cr.warnings, fmt.Sprintf(format, args...))
+	cr.mu.Unlock()
+}
+
+func (cr *connectorRun) execute() error {
+	if err := database.DB.Where("name = ?", "end_user").First(&cr.role).Error; err != nil {
+		return fmt.Errorf("failed to load end_user role: %v", err)
+	}
+
+	mailboxes, warnings, err := DiscoverMailboxes(cr.connector)
+	if err != nil {
+		return err
+	}
+	cr.warnings = append(cr.warnings, warnings...)
+	cr.run.MailboxesFound = len(mailboxes)
+
+	var accounts []database.EmailAccount
+	if err := database.DB.Where("provider_settings @> ?::jsonb", ConnectorAccountFilter(cr.connector.ID)).Find(&accounts).Error; err != nil {
+		return fmt.Errorf("failed to load connector accounts: %v", err)
+	}
+	existing := make(map[string]*database.EmailAccount, len(accounts))
+	activeAccounts := 0
+	for i := range accounts {
+		existing[strings.ToLower(accounts[i].Email)] = &accounts[i]
+		if accounts[i].IsActive {
+			activeAccounts++
+		}
+	}
+
+	// A discovery that suddenly finds nothing is far more likely a wrong group
+	// or a permission change than an empty tenant; do not pause every account
+	if len(mailboxes) == 0 && activeAccounts > 0 {
+		return fmt.Errorf("no mailboxes found; not pausing %d accounts", activeAccounts)
+	}
+
+	seen := make(map[string]bool, len(mailboxes))
+	for _, mailbox := range mailboxes {
+		seen[mailbox.Email] = true
+		if account, ok := existing[mailbox.Email]; ok {
+			if !account.IsActive {
+				cr.resumeAccount(account)
+			}
+			continue
+		}
+		if err := cr.createAccount(mailbox); err != nil {
+			cr.run.MailboxesSkipped++
+			cr.warn("%s: %v", mailbox.Email, err)
+		}
+	}
+
+	for i := range accounts {
+		if !seen[strings.ToLower(accounts[i].Email)] && accounts[i].IsActive {
+			if err := database.DB.Model(&accounts[i]).Update("is_active", false).Error; err != nil {
+				cr.warn("%s: failed to pause account: %v", accounts[i].Email, err)
+				continue
+			}
+			cr.run.AccountsPaused++
+		}
+	}
+
+	if cr.connector.SyncMailboxes {
+		cr.syncMailboxes()
+	}
+	return nil
+}
+
+// resumeAccount reactivates the account of a mailbox that was found again,
+// unless its owner has been disabled
+func (cr *connectorRun) resumeAccount(account *database.EmailAccount) {
+	var owner database.User
+	if err := database.DB.First(&owner, "id = ?", account.UserID).Error; err != nil || owner.DisabledAt != nil {
+		return
+	}
+	if err := database.DB.Model(account).Update("is_active", true).Error; err != nil {
+		cr.warn("%s: failed to resume account: %v", account.Email, err)
+		return
+	}
+	cr.run.AccountsResumed++
+}
+
+// createAccount creates the account that backs up a newly found mailbox
+func (cr *connectorRun) createAccount(mailbox DiscoveredMailbox) error {
+	userID, err := cr.mailboxOwner(mailbox)
+	if err != nil {
+		return err
+	}
+
+	provider := "exchange"
+	if cr.connector.Type == ConnectorTypeGraph {
+		provider = "office365"
+	}
+	var duplicates int64
+	database.DB.Model(&database.EmailAccount{}).Where("user_id = ? AND provider = ? AND LOWER(email) = ?", userID, provider, mailbox.Email).Count(&duplicates)
+	if duplicates > 0 {
+		return errors.New("mailbox is already backed up by another account")
+	}
+	if _, err := CheckAccountQuota(userID); err != nil {
+		return err
+	}
+
+	settings := connectorAccountSettings{TenantConnector: cr.connector.ID.String()}
+	account := database.EmailAccount{UserID: userID, Email: mailbox.Email, Provider: provider, IsActive: true}
+	if cr.connector.Type == ConnectorTypeGraph {
+		settings.GraphUserID = mailbox.GraphUserID
+		account.AuthMethod = "oauth2"
+	} else {
+		settings.Impersonate = mailbox.Email
+		account.ServerURL = cr.connector.ServerURL
+		account.Username = cr.connector.Username
+		account.Password = cr.connector.Password
+		account.Domain = cr.connector.Domain
+		account.AuthMethod = "ntlm"
+	}
+	encoded, _ := json.Marshal(settings)
+	account.ProviderSettings = string(encoded)
+
+	if err := database.DB.Create(&account).Error; err != nil {
+		return fmt.Errorf("failed to create account: %v", err)
+	}
+	cr.run.AccountsCreated++
+	return nil
+}
+
+// mailboxOwner returns the organization's user with the mailbox's address,
+// creating an end user when there is none
+func (cr *connectorRun) mailboxOwner(mailbox DiscoveredMailbox) (uuid.UUID, error) {
+	orgID := cr.connector.OrganizationID
+
+	var user database.User
+	err := database.DB.Where("LOWER(email) = ?", mailbox.Email).First(&user).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return uuid.Nil, fmt.Errorf("failed to load user: %v", err)
+	}
+	if err == nil {
+		var members int64
+		database.DB.Model(&database.UserOrganization{}).Where("user_id = ? AND organization_id = ?", user.ID, orgID).Count(&members)
+		if members == 0 {
+			return uuid.Nil, errors.New("the user with this address belongs to another organization")
+		}
+		if user.DisabledAt != nil {
+			return uuid.Nil, errors.New("the user with this address is disabled")
+		}
+		return user.ID, nil
+	}
+
+	if _, err := CheckQuota(orgID, QuotaUsers, 1); err != nil {
+		return uuid.Nil, err
+	}
+
+	// Mailbox owners get a random password; they can sign in through single
+	// sign-on or the directory, or once an administrator resets it
+	secret, err := randomToken()
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to generate password: %v", err)
+	}
+	hash, err := auth.HashPassword(secret)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to hash password: %v", err)
+	}
+
+	user = database.User{Email: mailbox.Email, PasswordHash: hash, RoleID: &cr.role.ID, PrimaryOrgID: &orgID}
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&user).Error; err != nil {
+			return fmt.Errorf("failed to create user: %v", err)
+		}
+		membership := database.UserOrganization{UserID: user.ID, OrganizationID: orgID, RoleID: cr.role.ID, IsPrimary: true}
+		if err := tx.Create(&membership).Error; err != nil {
+			return fmt.Errorf("failed to add user to organization: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	cr.run.UsersCreated++
+	RecordAudit(database.AuditEvent{
+		OrganizationID: &orgID,
+		Action:         "user.create",
+		TargetType:     "user",
+		TargetID:       user.ID.String(),
+		Detail:         "tenant connector run " + cr.run.ID.String(),
+	})
+	return user.ID, nil
+}
+
+// syncMailboxes syncs the connector's active accounts a few at a time
+func (cr *connectorRun) syncMailboxes() {
+	var accounts []database.EmailAccount
+	if err := database.DB.Where("provider_settings @> ?::jsonb AND is_active = ?", ConnectorAccountFilter(cr.connector.ID), true).
+		Find(&accounts).Error; err != nil {
+		cr.warn("failed to load accounts to sync: %v", err)
+		return
+	}
+
+	queue := make(chan database.EmailAccount)
+	go func() {
+		defer close(queue)
+		for _, account := range accounts {
+			queue <- account
+		}
+	}()
+
+	drainStage(ConnectorSettings.MailboxParallelism, queue, func(account database.EmailAccount) {
+		// A sync started by the user is left to finish on its own
+		if ProgressManager.IsAccountSyncing(account.ID) {
+			return
+		}
+		if err := SyncConnectorAccount(&account); err != nil {
+			cr.warn("%s: sync failed: %v", account.Email, err)
+			cr.mu.Lock()
+			cr.run.SyncsFailed++
+			cr.mu.Unlock()
+			return
+		}
+		cr.mu.Lock()
+		cr.run.MailboxesSynced++
+		cr.mu.Unlock()
+	})
+}
+
+// SyncConnectorAccount syncs an account created by a tenant connector with
+// the connector's service credentials
+func SyncConnectorAccount(account *database.EmailAccount) error {
+	switch account.Provider {
+	case "exchange":
+		return NewExchangeServiceForAccount(account).SyncEmailsWithProgress(account.ID)
+	case "office365":
+		graphService, err := NewGraphMailServiceForAccount(account)
+		if err != nil {
+			return err
+		}
+		return graphService.SyncEmailsWithProgress(account.ID)
+	default:
+		return fmt.Errorf("unsupported provider %s", account.Provider)
+	}
+}
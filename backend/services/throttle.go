@@ -0,0 +1,364 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"emailprojectv2/config"
+
+	"github.com/google/uuid"
+)
+
+// ThrottleError is returned when a provider asks us to slow down
+type ThrottleError struct {
+	Provider   string
+	RetryAfter time.Duration
+	Message    string
+}
+
+func (e *ThrottleError) Error() string {
+	return fmt.Sprintf("%s throttled the request, retry after %s: %s", e.Provider, e.RetryAfter, e.Message)
+}
+
+// tokenBucket is a simple request budget refilled at a constant rate
+type tokenBucket struct {
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// refill adds the tokens earned since the last call
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// wait returns how long until a token is available
+func (b *tokenBucket) wait() time.Duration {
+	if b.tokens >= 1 || b.rate <= 0 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// ProviderThrottler enforces per-server and per-tenant request budgets and
+// honors backoff hints returned by providers
+type ProviderThrottler struct {
+	mu           sync.Mutex
+	cfg          config.ThrottleConfig
+	buckets      map[string]*tokenBucket
+	blockedUntil map[string]time.Time
+}
+
+var Throttle = NewProviderThrottler(config.ThrottleConfig{
+	ServerRequestsPerSecond: 10,
+	ServerBurst:             20,
+	TenantRequestsPerSecond: 5,
+	TenantBurst:             10,
+	MaxRetries:              5,
+	MaxBackoffSeconds:       300,
+})
+
+func NewProviderThrottler(cfg config.ThrottleConfig) *ProviderThrottler {
+	return &ProviderThrottler{
+		cfg:          cfg,
+		buckets:      make(map[string]*tokenBucket),
+		blockedUntil: make(map[string]time.Time),
+	}
+}
+
+// ConfigureThrottling replaces the global throttler budgets
+func ConfigureThrottling(cfg config.ThrottleConfig) {
+	Throttle = NewProviderThrottler(cfg)
+	log.Printf("🚦 Throttling configured: server %.1f req/s (burst %d), tenant %.1f req/s (burst %d)",
+		cfg.ServerRequestsPerSecond, cfg.ServerBurst, cfg.TenantRequestsPerSecond, cfg.TenantBurst)
+}
+
+func serverKey(server string) string {
+	return "server:" + strings.ToLower(server)
+}
+
+func tenantKey(tenant string) string {
+	return "tenant:" + strings.ToLower(tenant)
+}
+
+// bucket returns the budget for a key, creating it on first use
+func (t *ProviderThrottler) bucket(key string) *tokenBucket {
+	b, ok := t.buckets[key]
+	if !ok {
+		if strings.HasPrefix(key, "server:") {
+			b = newTokenBucket(t.cfg.ServerRequestsPerSecond, t.cfg.ServerBurst)
+		} else {
+			b = newTokenBucket(t.cfg.TenantRequestsPerSecond, t.cfg.TenantBurst)
+		}
+		t.buckets[key] = b
+	}
+	return b
+}
+
+// Wait blocks until both the server and the tenant budget allow another request.
+// Long waits are reported as a "throttled" status on the account's sync progress.
+func (t *ProviderThrottler) Wait(ctx context.Context, accountID uuid.UUID, server, tenant string) error {
+	keys := []string{serverKey(server)}
+	if tenant != "" {
+		keys = append(keys, tenantKey(tenant))
+	}
+
+	throttled := false
+	defer func() {
+		if throttled {
+			ProgressManager.ClearThrottled(accountID)
+		}
+	}()
+
+	for {
+		t.mu.Lock()
+		now := time.Now()
+		var delay time.Duration
+		for _, key := range keys {
+			if until, ok := t.blockedUntil[key]; ok {
+				if until.After(now) {
+					if d := until.Sub(now); d > delay {
+						delay = d
+					}
+				} else {
+					delete(t.blockedUntil, key)
+				}
+			}
+			b := t.bucket(key)
+			b.refill(now)
+			if d := b.wait(); d > delay {
+				delay = d
+			}
+		}
+		if delay == 0 {
+			for _, key := range keys {
+				t.buckets[key].tokens--
+			}
+			t.mu.Unlock()
+			return nil
+		}
+		t.mu.Unlock()
+
+		// Only surface waits the user would notice, not regular pacing
+		if delay >= time.Second {
+			throttled = true
+			ProgressManager.SetThrottled(accountID, now.Add(delay))
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Backoff blocks the server and tenant for the given duration
+func (t *ProviderThrottler) Backoff(server, tenant string, d time.Duration) {
+	if max := time.Duration(t.cfg.MaxBackoffSeconds) * time.Second; max > 0 && d > max {
+		d = max
+	}
+	until := time.Now().Add(d)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, key := range []string{serverKey(server), tenantKey(tenant)} {
+		if key == tenantKey("") {
+			continue
+		}
+		if current, ok := t.blockedUntil[key]; !ok || until.After(current) {
+			t.blockedUntil[key] = until
+		}
+	}
+	log.Printf("🚦 Backing off %s (tenant %s) for %s", server, tenant, d.Round(time.Millisecond))
+}
+
+// MaxRetries returns how often a throttled request should be retried
+func (t *ProviderThrottler) MaxRetries() int {
+	if t.cfg.MaxRetries < 1 {
+		return 1
+	}
+	return t.cfg.MaxRetries
+}
+
+// BackoffDelay returns the delay for a retry attempt, preferring the server hint
+func (t *ProviderThrottler) BackoffDelay(attempt int, hint time.Duration) time.Duration {
+	if hint > 0 {
+		return hint
+	}
+	delay := 2 * time.Second
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+	}
+	if max := time.Duration(t.cfg.MaxBackoffSeconds) * time.Second; max > 0 && delay > max {
+		delay = max
+	}
+	return delay
+}
+
+var (
+	ewsBackOffPattern    = regexp.MustCompile(`Name="BackOffMilliseconds"[^>]*>\s*(\d+)\s*<`)
+	ewsServerBusyPattern = regexp.MustCompile(`<(?:\w+:)?ResponseCode>\s*ErrorServerBusy\s*</`)
+)
+
+// ParseEWSThrottle detects an ErrorServerBusy response and returns the
+// BackOffMilliseconds hint. Exchange reports it as a SOAP fault or a 503, and
+// also as the ResponseCode of a ResponseMessage inside a 200 response.
+func ParseEWSThrottle(statusCode int, body []byte) (*ThrottleError, bool) {
+	busy := ewsServerBusyPattern.Match(body)
+	if statusCode != http.StatusOK {
+		busy = busy || bytes.Contains(body, []byte("ErrorServerBusy")) ||
+			statusCode == http.StatusServiceUnavailable || statusCode == http.StatusTooManyRequests
+	}
+	if !busy {
+		return nil, false
+	}
+
+	var retryAfter time.Duration
+	if m := ewsBackOffPattern.FindSubmatch(body); m != nil {
+		if ms, err := strconv.Atoi(string(m[1])); err == nil {
+			retryAfter = time.Duration(ms) * time.Millisecond
+		}
+	}
+	return &ThrottleError{Provider: "exchange", RetryAfter: retryAfter, Message: "ErrorServerBusy"}, true
+}
+
+// ParseRetryAfter reads a Retry-After header given in seconds or as an HTTP date
+func ParseRetryAfter(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if when, err := http.ParseTime(value); err == nil {
+		if d := time.Until(when); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// ParseGraphThrottle detects a Microsoft Graph 429/503 response and its Retry-After hint
+func ParseGraphThrottle(resp *http.Response) (*ThrottleError, bool) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return nil, false
+	}
+	return &ThrottleError{
+		Provider:   "graph",
+		RetryAfter: ParseRetryAfter(resp.Header.Get("Retry-After")),
+		Message:    resp.Status,
+	}, true
+}
+
+// imapThrottleMarkers are response texts with which IMAP servers refuse a
+// command or drop a client over its limits
+var imapThrottleMarkers = []string{
+	"[throttled]", "[overquota]", "[unavailable]", "bandwidth", "too many simultaneous", "exceeded command",
+}
+
+// imapConnectionLostMarkers are errors of a connection the server closed
+var imapConnectionLostMarkers = []string{
+	"connection reset", "broken pipe", "connection closed", "use of closed network connection",
+}
+
+func containsAny(text string, markers []string) bool {
+	text = strings.ToLower(text)
+	for _, marker := range markers {
+		if strings.Contains(text, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsIMAPThrottleNotice reports whether an untagged BYE or NO from the server
+// names a limit
+func IsIMAPThrottleNotice(notice string) bool {
+	return containsAny(notice, imapThrottleMarkers)
+}
+
+// IsIMAPThrottleError reports whether an IMAP error means the server refused
+// or dropped us over its limits. A lost connection only counts when the
+// server announced it with a throttle notice, the last BYE or NO it sent;
+// other lost connections are real failures.
+func IsIMAPThrottleError(err error, serverNotice string) bool {
+	if err == nil {
+		return false
+	}
+	if containsAny(err.Error(), imapThrottleMarkers) {
+		return true
+	}
+	if !IsIMAPThrottleNotice(serverNotice) {
+		return false
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || containsAny(err.Error(), imapConnectionLostMarkers)
+}
+
+// ThrottledDo sends an HTTP request within the budgets and retries 429/503
+// responses after the Retry-After delay. Requests must have a GetBody when they carry a body.
+func (t *ProviderThrottler) ThrottledDo(ctx context.Context, accountID uuid.UUID, tenant string, client *http.Client, req *http.Request) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		if err := t.Wait(ctx, accountID, req.URL.Host, tenant); err != nil {
+			return nil, err
+		}
+
+		if attempt > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, fmt.Errorf("failed to rewind request body: %v", err)
+			}
+			req.Body = body
+		}
+
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+
+		throttleErr, throttled := ParseGraphThrottle(resp)
+		if !throttled {
+			return resp, nil
+		}
+		resp.Body.Close()
+
+		if attempt >= t.MaxRetries() {
+			return nil, throttleErr
+		}
+		t.Backoff(req.URL.Host, tenant, t.BackoffDelay(attempt, throttleErr.RetryAfter))
+	}
+}
+
+// mailboxDomain returns the domain part of a mailbox address, used as tenant key
+func mailboxDomain(address string) string {
+	if at := strings.LastIndex(address, "@"); at >= 0 {
+		return strings.ToLower(address[at+1:])
+	}
+	return ""
+}
@@ -0,0 +1,85 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseEWSThrottle(t *testing.T) {
+	const busyMessage = `<s:Envelope><s:Body><m:GetItemResponse><m:ResponseMessages>
+<m:GetItemResponseMessage ResponseClass="Error"><m:MessageText>The server cannot service this request right now.</m:MessageText>
+<m:ResponseCode>ErrorServerBusy</m:ResponseCode><m:MessageXml><t:Value Name="BackOffMilliseconds">2500</t:Value></m:MessageXml>
+</m:GetItemResponseMessage></m:ResponseMessages></m:GetItemResponse></s:Body></s:Envelope>`
+	const okMessage = `<m:GetItemResponseMessage ResponseClass="Success"><m:ResponseCode>NoError</m:ResponseCode>
+<t:Subject>ErrorServerBusy in a subject is not throttling</t:Subject></m:GetItemResponseMessage>`
+
+	tests := []struct {
+		name       string
+		status     int
+		body       string
+		throttled  bool
+		retryAfter time.Duration
+	}{
+		{"busy in 200 response message", http.StatusOK, busyMessage, true, 2500 * time.Millisecond},
+		{"busy soap fault", http.StatusInternalServerError, busyMessage, true, 2500 * time.Millisecond},
+		{"503 without hint", http.StatusServiceUnavailable, "", true, 0},
+		{"429 without hint", http.StatusTooManyRequests, "", true, 0},
+		{"successful 200", http.StatusOK, okMessage, false, 0},
+		{"other error", http.StatusInternalServerError, "<faultstring>ErrorAccessDenied</faultstring>", false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			throttleErr, throttled := ParseEWSThrottle(tt.status, []byte(tt.body))
+			if throttled != tt.throttled {
+				t.Fatalf("throttled = %v, want %v", throttled, tt.throttled)
+			}
+			if throttled && throttleErr.RetryAfter != tt.retryAfter {
+				t.Errorf("RetryAfter = %s, want %s", throttleErr.RetryAfter, tt.retryAfter)
+			}
+		})
+	}
+}
+
+func TestIsIMAPThrottleError(t *testing.T) {
+	const bye = "BYE [UNAVAILABLE] Account exceeded bandwidth limits"
+	tests := []struct {
+		name   string
+		err    error
+		notice string
+		want   bool
+	}{
+		{"no error", nil, bye, false},
+		{"throttled response", errors.New("[THROTTLED] Too many commands"), "", true},
+		{"eof after throttle bye", io.EOF, bye, true},
+		{"closed connection after throttle bye", errors.New("imap: connection closed"), bye, true},
+		{"eof without notice", io.EOF, "", false},
+		{"wrapped eof without notice", fmt.Errorf("fetch failed: %w", io.ErrUnexpectedEOF), "", false},
+		{"eof after unrelated bye", io.EOF, "BYE [] Logging out", false},
+		{"reset without notice", errors.New("read tcp: connection reset by peer"), "", false},
+		{"other error after throttle bye", errors.New("NO [NONEXISTENT] Unknown mailbox"), bye, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsIMAPThrottleError(tt.err, tt.notice); got != tt.want {
+				t.Errorf("IsIMAPThrottleError(%v, %q) = %v, want %v", tt.err, tt.notice, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if got := ParseRetryAfter("30"); got != 30*time.Second {
+		t.Errorf("ParseRetryAfter(30) = %s", got)
+	}
+	if got := ParseRetryAfter(""); got != 0 {
+		t.Errorf("ParseRetryAfter(\"\") = %s", got)
+	}
+	when := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if got := ParseRetryAfter(when); got <= 0 || got > time.Minute {
+		t.Errorf("ParseRetryAfter(%s) = %s", when, got)
+	}
+}
@@ -67,4 +67,17 @@ func GetGmailEmailFromMinIO(minioPath string) (map[string]interface{}, error) {
 	}
 
 	return emailData, nil
-}
\ No newline at end of file
+}
+
+// OpenEmailObject opens an object of the email bucket for streaming. The
+// caller must close it.
+func OpenEmailObject(ctx context.Context, objectPath string) (io.ReadCloser, error) {
+	if MinioClient == nil {
+		return nil, fmt.Errorf("MinIO client not initialized")
+	}
+	object, err := MinioClient.GetObject(ctx, EmailBucket, objectPath, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object from MinIO: %v", err)
+	}
+	return object, nil
+}
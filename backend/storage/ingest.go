@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// EmailBucket is the bucket message objects are written to
+const EmailBucket = "email-backups"
+
+// streamPartSize bounds the memory a single upload buffers. MinIO needs at
+// least 5 MiB per part; without an explicit size it would pick huge parts
+// for streams of unknown length.
+const streamPartSize = 16 << 20
+
+// StoredObject describes an object written to MinIO. RetainUntil and LockMode
+// are set when the object was written under an object lock policy.
+type StoredObject struct {
+	Bucket      string
+	Path        string
+	Size        int64
+	SHA256      string
+	LockMode    string
+	RetainUntil *time.Time
+}
+
+// hashingReader computes the SHA-256 and size of everything read through it
+type hashingReader struct {
+	r    io.Reader
+	h    hash.Hash
+	size int64
+}
+
+func (hr *hashingReader) Read(p []byte) (int, error) {
+	n, err := hr.r.Read(p)
+	if n > 0 {
+		hr.h.Write(p[:n])
+		hr.size += int64(n)
+	}
+	return n, err
+}
+
+// PutObjectStream uploads r to the email bucket without reading it into memory
+// first, hashing the content on the fly. size may be -1 when it is not known.
+func PutObjectStream(ctx context.Context, objectPath string, r io.Reader, size int64, contentType string) (*StoredObject, error) {
+	if MinioClient == nil {
+		return nil, fmt.Errorf("MinIO client not initialized")
+	}
+
+	hr := &hashingReader{r: r, h: sha256.New()}
+	opts := minio.PutObjectOptions{
+		ContentType: contentType,
+		PartSize:    streamPartSize,
+	}
+	lock := objectLockFrom(ctx)
+	if lock != nil {
+		opts.Mode = retentionMode(lock.Mode)
+		opts.RetainUntilDate = time.Now().UTC().AddDate(0, 0, lock.Days)
+	}
+
+	if _, err := MinioClient.PutObject(ctx, EmailBucket, objectPath, hr, size, opts); err != nil {
+		return nil, err
+	}
+
+	stored := &StoredObject{
+		Bucket: EmailBucket,
+		Path:   objectPath,
+		Size:   hr.size,
+		SHA256: hex.EncodeToString(hr.h.Sum(nil)),
+	}
+	if lock != nil {
+		stored.LockMode = lock.Mode
+		stored.RetainUntil = &opts.RetainUntilDate
+	}
+	return stored, nil
+}
+
+// PutJSONObject marshals v and uploads it to the email bucket
+func PutJSONObject(ctx context.Context, objectPath string, v interface{}) (*StoredObject, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal object: %v", err)
+	}
+	return PutObjectStream(ctx, objectPath, bytes.NewReader(data), int64(len(data)), "application/json")
+}
+
+// RemoveEmailObject deletes an object from the email bucket. Removing an
+// object that does not exist is not an error.
+func RemoveEmailObject(ctx context.Context, objectPath string) error {
+	if MinioClient == nil {
+		return fmt.Errorf("MinIO client not initialized")
+	}
+	return MinioClient.RemoveObject(ctx, EmailBucket, objectPath, minio.RemoveObjectOptions{})
+}
+
+// ErrObjectNotFound is returned when an object does not exist in the email bucket
+var ErrObjectNotFound = errors.New("object not found")
+
+// HashObject re-reads an object from the email bucket and returns its SHA-256
+// and size, streaming the content instead of loading it into memory
+func HashObject(ctx context.Context, objectPath string) (*StoredObject, error) {
+	if MinioClient == nil {
+		return nil, fmt.Errorf("MinIO client not initialized")
+	}
+
+	obj, err := MinioClient.GetObject(ctx, EmailBucket, objectPath, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+
+	hr := &hashingReader{r: obj, h: sha256.New()}
+	if _, err := io.Copy(io.Discard, hr); err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, ErrObjectNotFound
+		}
+		return nil, err
+	}
+
+	return &StoredObject{
+		Bucket: EmailBucket,
+		Path:   objectPath,
+		Size:   hr.size,
+		SHA256: hex.EncodeToString(hr.h.Sum(nil)),
+	}, nil
+}
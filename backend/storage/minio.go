@@ -36,25 +36,30 @@ func ConnectMinio(cfg *config.Config) error {
 	log.Println("✅ MinIO bağlantısı başarılı!")
 
 	// Create buckets if they don't exist
-	if err := createBucketIfNotExists(ctx, cfg.MinIO.BucketEmails); err != nil {
+	if err := createBucketIfNotExists(ctx, cfg.MinIO.BucketEmails, cfg.MinIO.ObjectLocking); err != nil {
 		return fmt.Errorf("failed to create emails bucket: %v", err)
 	}
 
-	if err := createBucketIfNotExists(ctx, cfg.MinIO.BucketAttachments); err != nil {
+	// Object locking can only be turned on when a bucket is created
+	if cfg.MinIO.ObjectLocking && !ObjectLockEnabled(ctx) {
+		log.Printf("⚠️ MinIO bucket '%s' was created without object locking, compliance archives are unavailable", cfg.MinIO.BucketEmails)
+	}
+
+	if err := createBucketIfNotExists(ctx, cfg.MinIO.BucketAttachments, false); err != nil {
 		return fmt.Errorf("failed to create attachments bucket: %v", err)
 	}
 
 	return nil
 }
 
-func createBucketIfNotExists(ctx context.Context, bucketName string) error {
+func createBucketIfNotExists(ctx context.Context, bucketName string, objectLocking bool) error {
 	exists, err := MinioClient.BucketExists(ctx, bucketName)
 	if err != nil {
 		return err
 	}
 
 	if !exists {
-		err = MinioClient.MakeBucket(ctx, bucketName, minio.MakeBucketOptions{})
+		err = MinioClient.MakeBucket(ctx, bucketName, minio.MakeBucketOptions{ObjectLocking: objectLocking})
 		if err != nil {
 			return err
 		}
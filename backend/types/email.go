@@ -13,6 +13,7 @@ type ExchangeEmailData struct {
 	Folder        string            `json:"folder"`
 	Attachments   []AttachmentInfo  `json:"attachments"`
 	Headers       map[string]string `json:"headers"`
+	Truncated     bool              `json:"truncated,omitempty"`
 }
 
 type AttachmentInfo struct {
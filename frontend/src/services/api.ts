@@ -27,16 +27,68 @@ const getAuthToken = (): string | null => {
   return localStorage.getItem('auth_token')
 }
 
-const setAuthToken = (token: string) => {
+const getRefreshToken = (): string | null => {
+  return localStorage.getItem('refresh_token')
+}
+
+const setAuthToken = (token: string, refreshToken?: string) => {
   localStorage.setItem('auth_token', token)
+  if (refreshToken) {
+    localStorage.setItem('refresh_token', refreshToken)
+  }
   apiClient.defaults.headers.common['Authorization'] = `Bearer ${token}`
 }
 
 const removeAuthToken = () => {
   localStorage.removeItem('auth_token')
+  localStorage.removeItem('refresh_token')
   delete apiClient.defaults.headers.common['Authorization']
 }
 
+// Access tokens are short-lived; exchange the refresh token for a new pair.
+// Concurrent callers share one request, since each refresh token works once.
+let refreshInFlight: Promise<string | null> | null = null
+
+const refreshAuthToken = (): Promise<string | null> => {
+  const refreshToken = getRefreshToken()
+  if (!refreshToken) {
+    return Promise.resolve(null)
+  }
+  if (!refreshInFlight) {
+    refreshInFlight = axios
+      .post<AuthResponse>(`${API_BASE_URL}/auth/refresh`, { refresh_token: refreshToken })
+      .then((response) => {
+        setAuthToken(response.data.token, response.data.refresh_token)
+        return response.data.token
+      })
+      .catch(() => null)
+      .finally(() => {
+        refreshInFlight = null
+      })
+  }
+  return refreshInFlight
+}
+
+// Retry a request that failed with 401 once with a refreshed token, otherwise
+// clear auth and redirect to login
+const handleAuthError = async (client: typeof apiClient, error: any) => {
+  const original = error.config
+  if (error.response?.status === 401 && original && !original._retried && !original.url?.startsWith('/auth/')) {
+    original._retried = true
+    const token = await refreshAuthToken()
+    if (token) {
+      original.headers.Authorization = `Bearer ${token}`
+      return client(original)
+    }
+  }
+  if (error.response?.status === 401) {
+    // Token expired or invalid - clear auth and redirect to login
+    removeAuthToken()
+    window.location.href = '/login'
+  }
+  return Promise.reject(error)
+}
+
 // Request interceptor to add auth token
 apiClient.interceptors.request.use(
   (config: InternalAxiosRequestConfig) => {
@@ -56,14 +108,7 @@ apiClient.interceptors.response.use(
   (response: AxiosResponse) => {
     return response
   },
-  (error) => {
-    if (error.response?.status === 401) {
-      // Token expired or invalid - clear auth and redirect to login
-      removeAuthToken()
-      window.location.href = '/login'
-    }
-    return Promise.reject(error)
-  }
+  (error) => handleAuthError(apiClient, error)
 )
 
 // Add interceptors for storage API client
@@ -84,14 +129,7 @@ storageApiClient.interceptors.response.use(
   (response: AxiosResponse) => {
     return response
   },
-  (error) => {
-    if (error.response?.status === 401) {
-      // Token expired or invalid - clear auth and redirect to login
-      removeAuthToken()
-      window.location.href = '/login'
-    }
-    return Promise.reject(error)
-  }
+  (error) => handleAuthError(storageApiClient, error)
 )
 
 // Types based on backend API analysis
@@ -160,6 +198,8 @@ export interface EmailIndex {
 
 export interface AuthResponse {
   token: string
+  refresh_token: string
+  expires_in: number
   user: User
 }
 
@@ -251,6 +291,12 @@ export const authAPI = {
 
   getMe: (): Promise<AxiosResponse<{ user_id: string; email: string }>> =>
     apiClient.get('/api/me'),
+
+  logout: (): Promise<AxiosResponse<{ message: string }>> =>
+    apiClient.post('/auth/logout'),
+
+  logoutAll: (): Promise<AxiosResponse<{ message: string; revoked: number }>> =>
+    apiClient.post('/auth/logout-all'),
 }
 
 // Email Accounts API
@@ -710,4 +756,4 @@ export const statisticsAPI = {
 }
 
 // Export token utilities for use in stores
-export { setAuthToken, removeAuthToken, getAuthToken }
\ No newline at end of file
+export { setAuthToken, removeAuthToken, getAuthToken, refreshAuthToken }
\ No newline at end of file
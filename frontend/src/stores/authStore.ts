@@ -1,6 +1,6 @@
 import { create } from 'zustand'
 import { persist } from 'zustand/middleware'
-import { authAPI, setAuthToken, removeAuthToken, getAuthToken, type User } from '../services/api'
+import { authAPI, setAuthToken, removeAuthToken, getAuthToken, refreshAuthToken, type User } from '../services/api'
 import { getCurrentUserClaims, isTokenExpired, type JWTClaims } from '../utils/roleUtils'
 
 interface AuthState {
@@ -36,7 +36,7 @@ export const useAuthStore = create<AuthState>()(
         
         try {
           const response = await authAPI.login(email, password)
-          const { token, user } = response.data
+          const { token, refresh_token, user } = response.data
           
           // SECURITY DEBUG: Log login data
           console.log('🔐 Login response data:', {
@@ -46,7 +46,7 @@ export const useAuthStore = create<AuthState>()(
             userEmail: user?.email
           })
           
-          setAuthToken(token)
+          setAuthToken(token, refresh_token)
           
           // Get JWT claims for role/organization info
           const claims = getCurrentUserClaims()
@@ -89,9 +89,9 @@ export const useAuthStore = create<AuthState>()(
         
         try {
           const response = await authAPI.register(email, password)
-          const { token, user } = response.data
+          const { token, refresh_token, user } = response.data
           
-          setAuthToken(token)
+          setAuthToken(token, refresh_token)
           
           // Get JWT claims for role/organization info
           const claims = getCurrentUserClaims()
@@ -121,6 +121,10 @@ export const useAuthStore = create<AuthState>()(
       },
 
       logout: () => {
+        // Revoke the session on the server; local state is cleared regardless
+        if (getAuthToken()) {
+          authAPI.logout().catch(() => {})
+        }
         removeAuthToken()
         set({
           user: null,
@@ -132,15 +136,19 @@ export const useAuthStore = create<AuthState>()(
       },
 
       checkAuth: async (): Promise<boolean> => {
-        const token = getAuthToken()
+        let token = getAuthToken()
         if (!token) {
           set({ isAuthenticated: false, claims: null })
           return false
         }
 
-        // Check if token is expired using JWT claims
-        const claims = getCurrentUserClaims()
+        // An expired access token is renewed with the refresh token
+        let claims = getCurrentUserClaims()
         if (!claims || isTokenExpired(claims)) {
+          token = await refreshAuthToken()
+          claims = token ? getCurrentUserClaims() : null
+        }
+        if (!token || !claims || isTokenExpired(claims)) {
           removeAuthToken()
           set({
             user: null,